@@ -0,0 +1,48 @@
+import { render, screen, fireEvent, waitFor } from '@testing-library/react'
+import '@testing-library/jest-dom'
+import LoginPage from '../login/page'
+import { login } from '@/lib/api'
+
+const mockPush = jest.fn()
+jest.mock('next/navigation', () => ({
+  useRouter: () => ({ push: mockPush }),
+}))
+
+jest.mock('@/lib/api', () => ({
+  login: jest.fn(),
+}))
+const mockedLogin = login as jest.MockedFunction<typeof login>
+
+const fillAndSubmit = (username: string, password: string) => {
+  fireEvent.change(screen.getByPlaceholderText('Username'), { target: { value: username } })
+  fireEvent.change(screen.getByPlaceholderText('Password'), { target: { value: password } })
+  fireEvent.click(screen.getByRole('button', { name: /Log in/i }))
+}
+
+describe('LoginPage', () => {
+  beforeEach(() => {
+    jest.clearAllMocks()
+  })
+
+  it('logs in and goes to the dashboard', async () => {
+    mockedLogin.mockResolvedValue({})
+    render(<LoginPage />)
+
+    fillAndSubmit(' alice ', 'secret')
+
+    await waitFor(() => {
+      expect(mockedLogin).toHaveBeenCalledWith('alice', 'secret')
+      expect(mockPush).toHaveBeenCalledWith('/dashboard')
+    })
+  })
+
+  it('shows an error when the login fails', async () => {
+    mockedLogin.mockRejectedValue(new Error('Request failed with status code 401'))
+    render(<LoginPage />)
+
+    fillAndSubmit('alice', 'wrong')
+
+    expect(await screen.findByText('Failed to log in')).toBeInTheDocument()
+    expect(mockPush).not.toHaveBeenCalled()
+  })
+})
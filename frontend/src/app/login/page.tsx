@@ -0,0 +1,60 @@
+'use client'
+
+import { FormEvent, useState } from 'react'
+import { useRouter } from 'next/navigation'
+import { isAxiosError } from 'axios'
+import { login } from '@/lib/api'
+import { Button, Card, ErrorMessage, Input } from '@/components/ui'
+
+export default function LoginPage() {
+  const router = useRouter()
+  const [username, setUsername] = useState('')
+  const [password, setPassword] = useState('')
+  const [error, setError] = useState<string | null>(null)
+  const [submitting, setSubmitting] = useState(false)
+
+  const handleSubmit = async (e: FormEvent) => {
+    e.preventDefault()
+    setError(null)
+    setSubmitting(true)
+    try {
+      await login(username.trim(), password)
+      router.push('/dashboard')
+    } catch (err) {
+      const message = isAxiosError(err) ? err.response?.data?.error : null
+      setError(message || 'Failed to log in')
+    } finally {
+      setSubmitting(false)
+    }
+  }
+
+  return (
+    <div className="min-h-screen flex items-center justify-center bg-gray-50 px-4">
+      <div className="w-full max-w-sm">
+        <Card title="Log in">
+          <form onSubmit={handleSubmit}>
+            <Input
+              label="Username"
+              placeholder="Username"
+              value={username}
+              onChange={(e) => setUsername(e.target.value)}
+              required
+            />
+            <Input
+              label="Password"
+              placeholder="Password"
+              type="password"
+              value={password}
+              onChange={(e) => setPassword(e.target.value)}
+              required
+            />
+            {error && <ErrorMessage message={error} className="mb-4" />}
+            <Button type="submit" disabled={submitting || !username || !password} className="w-full">
+              {submitting ? 'Logging in...' : 'Log in'}
+            </Button>
+          </form>
+        </Card>
+      </div>
+    </div>
+  )
+}
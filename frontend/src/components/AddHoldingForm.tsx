@@ -10,6 +10,10 @@ import { useEffect, useState } from 'react';
 
 import { QUERY_KEYS } from '@/types/portfolio';
 
+import { isAxiosError } from 'axios';
+
+import apiClient from '@/lib/api';
+
 import { Button, Card, LoadingSpinner } from './ui';
 
 import { UI_CONSTANTS } from './ui';
@@ -182,32 +186,22 @@ error: mutationError
 
 mutationFn: async (data: HoldingFormData) => {
 
-const response = await fetch('/api/v1/portfolio/holdings', {
+try {
 
-method: 'POST',
+const response = await apiClient.post('/portfolio/holdings', data);
 
-headers: {
+return response.data;
 
-'Content-Type': 'application/json',
+} catch (err) {
 
-},
+const message = isAxiosError(err) ? err.response?.data?.error : null;
 
-body: JSON.stringify(data),
-
-});
+console.error('API Error:', err);
 
-if (!response.ok) {
-
-const error = await response.json();
-
-console.error('API Error:', error);
-
-throw new Error(error.message || 'Failed to add holding');
+throw new Error(message || 'Failed to add holding');
 
 }
 
-return response.json();
-
 },
 
 onSuccess: () => {
@@ -23,13 +23,25 @@ export interface RiskMetrics {
     sector_value: number;
     percentage: number;
   }>;
+  // Figures are null when there isn't enough price history in the lookback window
   volatility_metrics: {
-    portfolio_beta: number;
-    sharpe_ratio: number;
-    max_drawdown: number;
-    var_95: number;
-    expected_volatility: number;
-    portfolio_return: number;
+    portfolio_beta: number | null;
+    sharpe_ratio: number | null;
+    sortino_ratio: number | null;
+    max_drawdown: number | null;
+    max_drawdown_peak: string | null;
+    max_drawdown_trough: string | null;
+    var_95: number | null;
+    diversification_ratio: number | null;
+    expected_volatility: number | null;
+    portfolio_return: number | null;
+    risk_free_rate: number;
+  };
+  lookback_window: {
+    lookback: string;
+    from: string;
+    to: string;
+    observations: number;
   };
   risk_recommendations: string[];
 }
@@ -1,12 +1,97 @@
 // This file will contain the shared API client setup using Axios.
 // Developer A will set up the base Axios instance and helper functions here.
-import axios from 'axios';
+import axios, { AxiosError, InternalAxiosRequestConfig } from 'axios';
+
+export const ACCESS_TOKEN_KEY = 'access_token';
+export const REFRESH_TOKEN_KEY = 'refresh_token';
+
+export interface AuthTokens {
+  access_token: string;
+  refresh_token: string;
+}
+
+const baseURL = process.env.NEXT_PUBLIC_API_URL || 'http://localhost:8080/api/v1';
 
 const apiClient = axios.create({
-  baseURL: process.env.NEXT_PUBLIC_API_URL || 'http://localhost:8080/api/v1',
+  baseURL,
   headers: {
     'Content-Type': 'application/json',
   },
 });
 
+export function storeTokens(tokens: AuthTokens) {
+  window.localStorage.setItem(ACCESS_TOKEN_KEY, tokens.access_token);
+  window.localStorage.setItem(REFRESH_TOKEN_KEY, tokens.refresh_token);
+}
+
+export function clearTokens() {
+  window.localStorage.removeItem(ACCESS_TOKEN_KEY);
+  window.localStorage.removeItem(REFRESH_TOKEN_KEY);
+}
+
+// Logs in against /auth/login and keeps the issued tokens for later requests
+export async function login(username: string, password: string) {
+  const { data } = await apiClient.post('/auth/login', { username, password });
+  storeTokens(data.tokens);
+  return data;
+}
+
+// Attach the JWT issued by /auth/login or /auth/register to every request
+apiClient.interceptors.request.use((config) => {
+  if (typeof window !== 'undefined') {
+    const token = window.localStorage.getItem(ACCESS_TOKEN_KEY);
+    if (token) {
+      config.headers.Authorization = `Bearer ${token}`;
+    }
+  }
+  return config;
+});
+
+// Concurrent 401s share one refresh call
+let refreshing: Promise<string> | null = null;
+
+async function refreshAccessToken(): Promise<string> {
+  const refreshToken = window.localStorage.getItem(REFRESH_TOKEN_KEY);
+  if (!refreshToken) {
+    throw new Error('No refresh token');
+  }
+  // A bare axios call so a failing refresh doesn't loop back through this interceptor
+  const { data } = await axios.post(`${baseURL}/auth/refresh`, { refresh_token: refreshToken });
+  storeTokens(data.tokens);
+  return data.tokens.access_token;
+}
+
+// On an expired access token, refresh once and retry; if that fails, send the user to log in again
+apiClient.interceptors.response.use(
+  (response) => response,
+  async (error: AxiosError) => {
+    const request = error.config as (InternalAxiosRequestConfig & { _retried?: boolean }) | undefined;
+    if (
+      typeof window === 'undefined' ||
+      error.response?.status !== 401 ||
+      !request ||
+      request._retried ||
+      request.url?.startsWith('/auth/')
+    ) {
+      return Promise.reject(error);
+    }
+    request._retried = true;
+
+    try {
+      refreshing = refreshing || refreshAccessToken();
+      const token = await refreshing;
+      request.headers.Authorization = `Bearer ${token}`;
+      return apiClient(request);
+    } catch {
+      clearTokens();
+      if (window.location.pathname !== '/login') {
+        window.location.assign('/login');
+      }
+      return Promise.reject(error);
+    } finally {
+      refreshing = null;
+    }
+  }
+);
+
 export default apiClient;
@@ -134,12 +134,12 @@ export const exportRiskCSV = (risk: RiskMetrics): string => {
     concentration_risk: risk.risk_assessment.concentration_risk,
     herfindahl_index: risk.risk_assessment.herfindahl_index.toFixed(4),
     diversification_score: risk.risk_assessment.diversification_score.toFixed(2),
-    portfolio_beta: risk.volatility_metrics.portfolio_beta.toFixed(2),
-    sharpe_ratio: risk.volatility_metrics.sharpe_ratio.toFixed(2),
-    max_drawdown: risk.volatility_metrics.max_drawdown.toFixed(2),
-    var_95: risk.volatility_metrics.var_95.toFixed(2),
-    expected_volatility: risk.volatility_metrics.expected_volatility.toFixed(2),
-    portfolio_return: risk.volatility_metrics.portfolio_return.toFixed(2)
+    portfolio_beta: risk.volatility_metrics.portfolio_beta?.toFixed(2) ?? '',
+    sharpe_ratio: risk.volatility_metrics.sharpe_ratio?.toFixed(2) ?? '',
+    max_drawdown: risk.volatility_metrics.max_drawdown?.toFixed(2) ?? '',
+    var_95: risk.volatility_metrics.var_95?.toFixed(2) ?? '',
+    expected_volatility: risk.volatility_metrics.expected_volatility?.toFixed(2) ?? '',
+    portfolio_return: risk.volatility_metrics.portfolio_return?.toFixed(2) ?? ''
   }];
   
   const headers = Object.keys(riskData[0]);
@@ -3,11 +3,13 @@
 -- Enable UUID extension
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 
--- Users table (simplified for single user system)
+-- Users table
 CREATE TABLE IF NOT EXISTS users (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     username VARCHAR(255) UNIQUE NOT NULL DEFAULT 'default_user',
     email VARCHAR(255) UNIQUE,
+    password_hash VARCHAR(255), -- bcrypt hash; NULL for users that cannot log in
+    is_admin BOOLEAN NOT NULL DEFAULT FALSE,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
@@ -16,6 +18,26 @@ CREATE TABLE IF NOT EXISTS users (
 INSERT INTO users (username, email) VALUES ('default_user', 'user@portfolio.com')
 ON CONFLICT (username) DO NOTHING;
 
+-- Portfolios table (a user can own several named portfolios)
+CREATE TABLE IF NOT EXISTS portfolios (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    base_currency VARCHAR(10) NOT NULL DEFAULT 'USD',
+    description TEXT,
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
+    cost_basis_method VARCHAR(10) NOT NULL DEFAULT 'FIFO', -- 'FIFO', 'LIFO', 'HIFO', 'SPECIFIC'
+    enforce_cash_balance BOOLEAN NOT NULL DEFAULT FALSE, -- reject buys the cash balance can't cover
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE(user_id, name)
+);
+
+-- Insert default portfolio for the default user
+INSERT INTO portfolios (user_id, name, is_default)
+SELECT id, 'Default', TRUE FROM users WHERE username = 'default_user'
+ON CONFLICT (user_id, name) DO NOTHING;
+
 -- Assets table
 CREATE TABLE IF NOT EXISTS assets (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -33,13 +55,14 @@ CREATE TABLE IF NOT EXISTS assets (
 CREATE TABLE IF NOT EXISTS portfolio_holdings (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    portfolio_id UUID NOT NULL REFERENCES portfolios(id) ON DELETE CASCADE,
     asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
     quantity DECIMAL(20, 8) NOT NULL,
     average_cost DECIMAL(20, 8) NOT NULL,
     purchase_date TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
-    UNIQUE(user_id, asset_id)
+    UNIQUE(portfolio_id, asset_id)
 );
 
 -- Market data table for real-time prices
@@ -69,29 +92,137 @@ CREATE TABLE IF NOT EXISTS price_history (
     UNIQUE(asset_id, date)
 );
 
+-- Exchange rates, refreshed from the configured FX source
+CREATE TABLE IF NOT EXISTS fx_rates (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    base_currency VARCHAR(10) NOT NULL,
+    quote_currency VARCHAR(10) NOT NULL,
+    rate DECIMAL(20, 10) NOT NULL, -- units of quote_currency per unit of base_currency
+    rate_date DATE NOT NULL,
+    source VARCHAR(50) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE(base_currency, quote_currency, rate_date)
+);
+
+-- Corporate actions applied to an asset across every portfolio
+CREATE TABLE IF NOT EXISTS corporate_actions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
+    action_type VARCHAR(20) NOT NULL, -- 'SPLIT', 'REVERSE_SPLIT', 'SYMBOL_CHANGE', 'SPINOFF', 'MERGER'
+    effective_date DATE NOT NULL, -- history before this date is restated; positions move on it
+    ratio DECIMAL(20, 8), -- new shares per old share, or shares of the new asset per share held
+    new_asset_id UUID REFERENCES assets(id), -- spun-off or acquiring asset
+    old_symbol VARCHAR(50), -- symbol changes
+    new_symbol VARCHAR(50),
+    cost_allocation DECIMAL(10, 8), -- spin-offs: fraction of the cost basis moved to the new asset
+    notes TEXT,
+    status VARCHAR(10) NOT NULL DEFAULT 'APPLIED', -- 'APPLIED', 'REVERSED'
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    reversed_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    reversed_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Rows a split restated, kept as its audit trail and undone when it is reversed
+CREATE TABLE IF NOT EXISTS corporate_action_adjustments (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    corporate_action_id UUID NOT NULL REFERENCES corporate_actions(id) ON DELETE CASCADE,
+    table_name VARCHAR(20) NOT NULL, -- 'transactions', 'price_history'
+    row_id UUID NOT NULL,
+    quantity_before DECIMAL(20, 8), -- price history: volume
+    quantity_after DECIMAL(20, 8),
+    price_before DECIMAL(20, 8), -- price history: close price
+    price_after DECIMAL(20, 8),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
 -- Portfolio snapshots for historical performance tracking
 CREATE TABLE IF NOT EXISTS portfolio_snapshots (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-    total_value DECIMAL(20, 8) NOT NULL,
+    portfolio_id UUID NOT NULL REFERENCES portfolios(id) ON DELETE CASCADE,
+    total_value DECIMAL(20, 8) NOT NULL, -- market_value + cash_value, in the portfolio's base currency
+    market_value DECIMAL(20, 8) NOT NULL DEFAULT 0,
+    cash_value DECIMAL(20, 8) NOT NULL DEFAULT 0,
     total_cost DECIMAL(20, 8) NOT NULL,
     unrealized_pnl DECIMAL(20, 8) NOT NULL,
-    realized_pnl DECIMAL(20, 8) DEFAULT 0,
-    snapshot_date TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+    realized_pnl DECIMAL(20, 8) DEFAULT 0, -- realized to date
+    net_flow DECIMAL(20, 8) NOT NULL DEFAULT 0, -- deposits less withdrawals during the day
+    snapshot_date DATE NOT NULL, -- valued at that day's close
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE(portfolio_id, snapshot_date)
+);
+
+-- Target weights a portfolio is rebalanced towards; a portfolio's targets all share one target_type
+CREATE TABLE IF NOT EXISTS target_allocations (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    portfolio_id UUID NOT NULL REFERENCES portfolios(id) ON DELETE CASCADE,
+    target_type VARCHAR(20) NOT NULL, -- 'symbol', 'sector', 'asset_type'
+    target_key VARCHAR(100) NOT NULL, -- the symbol, sector or asset type
+    target_weight DECIMAL(10, 8) NOT NULL, -- fraction of the portfolio's value, cash included
+    tolerance DECIMAL(10, 8) NOT NULL DEFAULT 0.05, -- how far the weight may drift either way
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE(portfolio_id, target_key)
+);
+
+-- What-if scenarios saved for a portfolio, run against its current holdings whenever they're opened
+CREATE TABLE IF NOT EXISTS scenarios (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    portfolio_id UUID NOT NULL REFERENCES portfolios(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    definition JSONB NOT NULL, -- the trades and price shocks: {"trades": [...], "shocks": {"symbols": {...}, "sectors": {...}}}
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE(portfolio_id, name)
 );
 
 -- Transactions table for trade history
 CREATE TABLE IF NOT EXISTS transactions (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    portfolio_id UUID NOT NULL REFERENCES portfolios(id) ON DELETE CASCADE,
     asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
-    transaction_type VARCHAR(10) NOT NULL, -- 'BUY', 'SELL'
+    transaction_type VARCHAR(20) NOT NULL, -- 'BUY', 'SELL', 'ADJUST' (restates a position), 'DIVIDEND', 'DIVIDEND_REINVEST', cash: 'DEPOSIT', 'WITHDRAWAL', 'INTEREST', 'FEE', or corporate action entries: 'TRANSFER_IN', 'TRANSFER_OUT', 'COST_ADJUST'
     quantity DECIMAL(20, 8) NOT NULL,
     price DECIMAL(20, 8) NOT NULL,
     fees DECIMAL(20, 8) DEFAULT 0,
     total_amount DECIMAL(20, 8) NOT NULL,
     transaction_date TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
-    notes TEXT
+    notes TEXT,
+    realized_pnl DECIMAL(20, 8), -- set on SELL, net of fees
+    cost_basis_method VARCHAR(10), -- SELL only; how lots were picked
+    lot_transaction_ids UUID[], -- SPECIFIC sells: the BUY transactions whose lots are consumed, in order
+    corporate_action_id UUID REFERENCES corporate_actions(id), -- set on the entries a spin-off or merger wrote
+    acquired_at TIMESTAMP WITH TIME ZONE -- TRANSFER_IN only: when the shares it moves were first acquired
+);
+
+-- Tax lots opened by BUY and ADJUST transactions
+CREATE TABLE IF NOT EXISTS tax_lots (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    portfolio_id UUID NOT NULL REFERENCES portfolios(id) ON DELETE CASCADE,
+    asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
+    transaction_id UUID NOT NULL REFERENCES transactions(id) ON DELETE CASCADE, -- lots are rebuilt from the ledger
+    quantity DECIMAL(20, 8) NOT NULL,
+    remaining_quantity DECIMAL(20, 8) NOT NULL,
+    unit_cost DECIMAL(20, 8) NOT NULL,
+    fees DECIMAL(20, 8) DEFAULT 0,
+    acquired_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    closed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Lot quantities consumed by SELL transactions
+CREATE TABLE IF NOT EXISTS lot_disposals (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    lot_id UUID NOT NULL REFERENCES tax_lots(id) ON DELETE CASCADE,
+    transaction_id UUID NOT NULL REFERENCES transactions(id) ON DELETE CASCADE,
+    quantity DECIMAL(20, 8) NOT NULL,
+    cost_basis DECIMAL(20, 8) NOT NULL,
+    proceeds DECIMAL(20, 8) NOT NULL,
+    disposed_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 
 -- Notifications table
@@ -105,13 +236,91 @@ CREATE TABLE IF NOT EXISTS notifications (
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 
+-- Upgrade a database created by an earlier version of this script. CREATE TABLE IF NOT EXISTS leaves
+-- existing tables alone, so the columns added since are added here; every statement is safe to rerun.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash VARCHAR(255);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE portfolios ADD COLUMN IF NOT EXISTS cost_basis_method VARCHAR(10) NOT NULL DEFAULT 'FIFO';
+ALTER TABLE portfolios ADD COLUMN IF NOT EXISTS enforce_cash_balance BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE transactions ALTER COLUMN transaction_type TYPE VARCHAR(20);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS portfolio_id UUID REFERENCES portfolios(id) ON DELETE CASCADE;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS realized_pnl DECIMAL(20, 8);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS cost_basis_method VARCHAR(10);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS lot_transaction_ids UUID[];
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS corporate_action_id UUID REFERENCES corporate_actions(id);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS acquired_at TIMESTAMP WITH TIME ZONE;
+
+ALTER TABLE portfolio_holdings ADD COLUMN IF NOT EXISTS portfolio_id UUID REFERENCES portfolios(id) ON DELETE CASCADE;
+
+ALTER TABLE portfolio_snapshots ADD COLUMN IF NOT EXISTS portfolio_id UUID REFERENCES portfolios(id) ON DELETE CASCADE;
+ALTER TABLE portfolio_snapshots ADD COLUMN IF NOT EXISTS market_value DECIMAL(20, 8) NOT NULL DEFAULT 0;
+ALTER TABLE portfolio_snapshots ADD COLUMN IF NOT EXISTS cash_value DECIMAL(20, 8) NOT NULL DEFAULT 0;
+ALTER TABLE portfolio_snapshots ADD COLUMN IF NOT EXISTS net_flow DECIMAL(20, 8) NOT NULL DEFAULT 0;
+ALTER TABLE portfolio_snapshots ADD COLUMN IF NOT EXISTS created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW();
+
+-- Holdings, transactions and snapshots from before portfolios belong to their user's default portfolio,
+-- created for any user that has none
+INSERT INTO portfolios (user_id, name, is_default)
+SELECT u.id, 'Default', TRUE FROM users u
+WHERE NOT EXISTS (SELECT 1 FROM portfolios p WHERE p.user_id = u.id)
+ON CONFLICT (user_id, name) DO NOTHING;
+
+UPDATE portfolio_holdings ph SET portfolio_id = p.id
+FROM portfolios p WHERE ph.portfolio_id IS NULL AND p.user_id = ph.user_id AND p.is_default;
+UPDATE transactions t SET portfolio_id = p.id
+FROM portfolios p WHERE t.portfolio_id IS NULL AND p.user_id = t.user_id AND p.is_default;
+UPDATE portfolio_snapshots ps SET portfolio_id = p.id
+FROM portfolios p WHERE ps.portfolio_id IS NULL AND p.user_id = ps.user_id AND p.is_default;
+
+ALTER TABLE portfolio_holdings ALTER COLUMN portfolio_id SET NOT NULL;
+ALTER TABLE transactions ALTER COLUMN portfolio_id SET NOT NULL;
+ALTER TABLE portfolio_snapshots ALTER COLUMN portfolio_id SET NOT NULL;
+
+DO $$
+BEGIN
+    -- Holdings are unique per portfolio rather than per user
+    ALTER TABLE portfolio_holdings DROP CONSTRAINT IF EXISTS portfolio_holdings_user_id_asset_id_key;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'portfolio_holdings_portfolio_id_asset_id_key') THEN
+        ALTER TABLE portfolio_holdings ADD CONSTRAINT portfolio_holdings_portfolio_id_asset_id_key UNIQUE (portfolio_id, asset_id);
+    END IF;
+
+    -- Snapshots used to be taken whenever performance was read, several a day and without market or
+    -- cash values. They're dropped with the switch to one per day, and the scheduler values those
+    -- days again from the ledger.
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'portfolio_snapshots' AND column_name = 'snapshot_date' AND data_type <> 'date'
+    ) THEN
+        DELETE FROM portfolio_snapshots;
+        ALTER TABLE portfolio_snapshots ALTER COLUMN snapshot_date DROP DEFAULT;
+        ALTER TABLE portfolio_snapshots ALTER COLUMN snapshot_date TYPE DATE USING snapshot_date::date;
+        ALTER TABLE portfolio_snapshots ALTER COLUMN snapshot_date SET NOT NULL;
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'portfolio_snapshots_portfolio_id_snapshot_date_key') THEN
+        ALTER TABLE portfolio_snapshots ADD CONSTRAINT portfolio_snapshots_portfolio_id_snapshot_date_key UNIQUE (portfolio_id, snapshot_date);
+    END IF;
+END $$;
+
 -- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_portfolios_user_id ON portfolios(user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_portfolios_one_default ON portfolios(user_id) WHERE is_default;
+CREATE INDEX IF NOT EXISTS idx_portfolio_holdings_portfolio_id ON portfolio_holdings(portfolio_id);
 CREATE INDEX IF NOT EXISTS idx_portfolio_holdings_user_id ON portfolio_holdings(user_id);
 CREATE INDEX IF NOT EXISTS idx_market_data_asset_id ON market_data(asset_id);
 CREATE INDEX IF NOT EXISTS idx_market_data_timestamp ON market_data(timestamp DESC);
 CREATE INDEX IF NOT EXISTS idx_price_history_asset_date ON price_history(asset_id, date DESC);
+CREATE INDEX IF NOT EXISTS idx_fx_rates_quote_date ON fx_rates(quote_currency, rate_date DESC);
 CREATE INDEX IF NOT EXISTS idx_portfolio_snapshots_user_date ON portfolio_snapshots(user_id, snapshot_date DESC);
+CREATE INDEX IF NOT EXISTS idx_portfolio_snapshots_portfolio_date ON portfolio_snapshots(portfolio_id, snapshot_date DESC);
 CREATE INDEX IF NOT EXISTS idx_transactions_user_date ON transactions(user_id, transaction_date DESC);
+CREATE INDEX IF NOT EXISTS idx_transactions_portfolio_date ON transactions(portfolio_id, transaction_date DESC);
+CREATE INDEX IF NOT EXISTS idx_tax_lots_portfolio_asset ON tax_lots(portfolio_id, asset_id, acquired_at);
+CREATE INDEX IF NOT EXISTS idx_lot_disposals_lot_id ON lot_disposals(lot_id);
+CREATE INDEX IF NOT EXISTS idx_lot_disposals_transaction_id ON lot_disposals(transaction_id);
+CREATE INDEX IF NOT EXISTS idx_corporate_actions_asset_date ON corporate_actions(asset_id, effective_date DESC);
+CREATE INDEX IF NOT EXISTS idx_corporate_action_adjustments_action ON corporate_action_adjustments(corporate_action_id);
 CREATE INDEX IF NOT EXISTS idx_notifications_user_read ON notifications(user_id, is_read);
 
 -- Insert some sample assets
@@ -2,6 +2,8 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"time"
 )
 
 type Config struct {
@@ -12,7 +14,47 @@ type Config struct {
 	Environment   string
 	LogLevel      string
 	JWTSecret     string
+	JWTAccessTTL  time.Duration
+	JWTRefreshTTL time.Duration
 	FinnhubAPIKey string
+
+	// Finnhub requests are limited to FinnhubRequestsPerMin, retried up to FinnhubMaxRetries times, and
+	// stopped for FinnhubBreakerCooldown after FinnhubBreakerThreshold consecutive failures
+	FinnhubRequestsPerMin   int
+	FinnhubMaxRetries       int
+	FinnhubBreakerThreshold int
+	FinnhubBreakerCooldown  time.Duration
+
+	// Market data comes from MarketDataProvider: "finnhub", "file" (reads MarketDataFile),
+	// "simulated" (a random walk seeded by MarketDataSeed) or "none"; empty picks "finnhub" when
+	// FinnhubAPIKey is set and "simulated" otherwise
+	MarketDataProvider string
+	MarketDataFile     string
+	MarketDataSeed     int64
+
+	// Quotes are cached in Redis for QuoteCacheTTL and served stale for up to QuoteCacheStaleTTL more
+	// while they refresh; a zero QuoteCacheTTL disables the cache
+	QuoteCacheTTL      time.Duration
+	QuoteCacheStaleTTL time.Duration
+
+	// Daily candles are ingested into price_history at CandleIngestTime (HH:MM UTC); an asset's first
+	// run backfills CandleBackfillYears of history
+	CandleIngestTime    string
+	CandleBackfillYears int
+
+	// Portfolios are snapshotted at each day's close at SnapshotTime (HH:MM UTC), after candles are ingested
+	SnapshotTime string
+
+	// Benchmark is the default benchmark of the analytics endpoints: a symbol or a weighted blend of
+	// SYMBOL:WEIGHT pairs, priced from price_history. RiskFreeRate is the annual rate, as a fraction,
+	// that Sharpe and Sortino ratios are measured against.
+	Benchmark    string
+	RiskFreeRate float64
+
+	// FX rates are loaded from FXSource ("static" or "file", which reads FXRatesFile)
+	FXSource          string
+	FXRatesFile       string
+	FXRefreshInterval time.Duration
 }
 
 func Load() *Config {
@@ -24,7 +66,33 @@ func Load() *Config {
 		Environment:   getEnv("ENVIRONMENT", "development"),
 		LogLevel:      getEnv("LOG_LEVEL", "info"),
 		JWTSecret:     getEnv("JWT_SECRET", "your-secret-key-change-in-production"),
+		JWTAccessTTL:  getDurationEnv("JWT_ACCESS_TTL", 15*time.Minute),
+		JWTRefreshTTL: getDurationEnv("JWT_REFRESH_TTL", 7*24*time.Hour),
 		FinnhubAPIKey: getEnv("FINNHUB_API_KEY", ""),
+
+		FinnhubRequestsPerMin:   int(getInt64Env("FINNHUB_RATE_LIMIT", 60)),
+		FinnhubMaxRetries:       int(getInt64Env("FINNHUB_MAX_RETRIES", 3)),
+		FinnhubBreakerThreshold: int(getInt64Env("FINNHUB_BREAKER_THRESHOLD", 5)),
+		FinnhubBreakerCooldown:  getDurationEnv("FINNHUB_BREAKER_COOLDOWN", 30*time.Second),
+
+		MarketDataProvider: getEnv("MARKET_DATA_PROVIDER", ""),
+		MarketDataFile:     getEnv("MARKET_DATA_FILE", ""),
+		MarketDataSeed:     getInt64Env("MARKET_DATA_SEED", 1),
+
+		QuoteCacheTTL:      getDurationEnv("QUOTE_CACHE_TTL", 15*time.Second),
+		QuoteCacheStaleTTL: getDurationEnv("QUOTE_CACHE_STALE_TTL", time.Minute),
+
+		CandleIngestTime:    getEnv("CANDLE_INGEST_TIME", "22:00"),
+		CandleBackfillYears: int(getInt64Env("CANDLE_BACKFILL_YEARS", 5)),
+
+		SnapshotTime: getEnv("SNAPSHOT_TIME", "22:30"),
+
+		Benchmark:    getEnv("BENCHMARK", "SPY"),
+		RiskFreeRate: getFloat64Env("RISK_FREE_RATE", 0.03),
+
+		FXSource:          getEnv("FX_SOURCE", "static"),
+		FXRatesFile:       getEnv("FX_RATES_FILE", ""),
+		FXRefreshInterval: getDurationEnv("FX_REFRESH_INTERVAL", time.Hour),
 	}
 }
 
@@ -34,3 +102,30 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil {
+			return duration
+		}
+	}
+	return defaultValue
+}
+
+func getInt64Env(key string, defaultValue int64) int64 {
+	if value := os.Getenv(key); value != "" {
+		if number, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return number
+		}
+	}
+	return defaultValue
+}
+
+func getFloat64Env(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			return number
+		}
+	}
+	return defaultValue
+}
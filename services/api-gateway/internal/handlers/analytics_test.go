@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gin-gonic/gin"
@@ -293,8 +296,8 @@ func TestGetCurrentPrice_ServiceUnavailable(t *testing.T) {
 	logger, _ := zap.NewDevelopment()
 
 	mockServices := &services.Services{
-		Finnhub: nil, // No Finnhub service
-		Logger:  logger,
+		MarketData: nil, // No market data provider
+		Logger:     logger,
 	}
 
 	handler := NewHandler(mockServices, logger)
@@ -311,24 +314,130 @@ func TestGetCurrentPrice_ServiceUnavailable(t *testing.T) {
 	assert.Contains(t, w.Body.String(), "Market data service not available")
 }
 
-// Mock Finnhub for testing
-type Quote struct {
-	CurrentPrice  float64
-	Change        float64
-	PercentChange float64
+// mockMarketData is a market data provider with fixed quotes, profiles and daily candles
+type mockMarketData struct {
+	quotes        map[string]*services.Quote
+	profiles      map[string]*services.CompanyProfile
+	candles       map[string][]services.Candle
+	splitAdjusted bool
 }
 
-type MockFinnhub struct {
-	QuoteData map[string]*Quote
+func (m *mockMarketData) Name() string {
+	return "mock"
 }
 
-func (m *MockFinnhub) GetQuote(symbol string) (*Quote, error) {
-	if quote, exists := m.QuoteData[symbol]; exists {
+func (m *mockMarketData) SplitAdjusted() bool {
+	return m.splitAdjusted
+}
+
+func (m *mockMarketData) GetQuote(symbol string) (*services.Quote, error) {
+	if quote, exists := m.quotes[symbol]; exists {
 		return quote, nil
 	}
 	return nil, fmt.Errorf("symbol not found")
 }
 
+func (m *mockMarketData) GetCompanyProfile(symbol string) (*services.CompanyProfile, error) {
+	if profile, exists := m.profiles[symbol]; exists {
+		return profile, nil
+	}
+	return nil, fmt.Errorf("symbol not found")
+}
+
+func (m *mockMarketData) GetCandles(symbol, resolution string, from, to time.Time) ([]services.Candle, error) {
+	candles, exists := m.candles[symbol]
+	if !exists {
+		return nil, fmt.Errorf("no candles for %s", symbol)
+	}
+	var inRange []services.Candle
+	for _, candle := range candles {
+		if !candle.Time.Before(from) && !candle.Time.After(to) {
+			inRange = append(inRange, candle)
+		}
+	}
+	return inRange, nil
+}
+
+func (m *mockMarketData) SearchSymbols(query string) ([]services.SymbolMatch, error) {
+	return []services.SymbolMatch{}, nil
+}
+
+func TestGetCurrentPrice(t *testing.T) {
+	// A file provider serves the latest close with the change against the previous one
+	path := filepath.Join(t.TempDir(), "prices.csv")
+	err := os.WriteFile(path, []byte("symbol,date,open,high,low,close,volume\n"+
+		"MSFT,2024-03-01,400,410,398,405,1000000\n"+
+		"MSFT,2024-03-04,405,420,404,415.5,1200000\n"), 0o600)
+	assert.NoError(t, err)
+	fileProvider, err := services.NewFileMarketDataProvider(path)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		provider       services.MarketDataProvider
+		symbol         string
+		expectedStatus int
+		expectedBody   []string
+	}{
+		{
+			name: "quote from the provider",
+			provider: &mockMarketData{quotes: map[string]*services.Quote{
+				"AAPL": {CurrentPrice: 190.5, Change: 1.5, PercentChange: 0.79, PreviousClosePrice: 189},
+			}},
+			symbol:         "AAPL",
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{`"current_price":190.5`, `"change":1.5`, `"previous_close":189`},
+		},
+		{
+			name:           "provider error",
+			provider:       &mockMarketData{},
+			symbol:         "AAPL",
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody:   []string{"Failed to fetch current price"},
+		},
+		{
+			name:           "file provider",
+			provider:       fileProvider,
+			symbol:         "MSFT",
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{`"current_price":415.5`, `"change":10.5`, `"previous_close":405`, `"high":420`},
+		},
+		{
+			name:           "symbol missing from the file",
+			provider:       fileProvider,
+			symbol:         "AAPL",
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "simulated provider",
+			provider:       services.NewSimulatedMarketDataProvider(42),
+			symbol:         "AAPL",
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{`"symbol":"AAPL"`, `"current_price":`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			logger, _ := zap.NewDevelopment()
+			handler := NewHandler(&services.Services{MarketData: tt.provider, Logger: logger}, logger)
+
+			router := gin.New()
+			router.GET("/assets/:symbol/price", handler.GetCurrentPrice)
+
+			req, _ := http.NewRequest("GET", "/assets/"+tt.symbol+"/price", nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			for _, expected := range tt.expectedBody {
+				assert.Contains(t, w.Body.String(), expected)
+			}
+		})
+	}
+}
+
 func TestGetCurrentPrice_EmptySymbol(t *testing.T) {
 	// Setup
 	gin.SetMode(gin.TestMode)
@@ -377,8 +486,8 @@ func TestGetPriceHistory_Success(t *testing.T) {
 
 	// Mock price history query
 	rows := sqlmock.NewRows([]string{"date", "open", "high", "low", "close", "volume"}).
-		AddRow("2024-01-01T00:00:00Z", 148.0, 152.0, 147.0, 150.0, 1000000).
-		AddRow("2024-01-02T00:00:00Z", 150.0, 154.0, 149.0, 152.0, 1100000)
+		AddRow(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), 148.0, 152.0, 147.0, 150.0, 1000000).
+		AddRow(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), 150.0, 154.0, 149.0, 152.0, 1100000)
 
 	mock.ExpectQuery("SELECT (.+) FROM price_history").
 		WillReturnRows(rows)
@@ -422,7 +531,7 @@ func TestGetPriceHistory_DefaultParameters(t *testing.T) {
 
 	// Mock price history query
 	rows := sqlmock.NewRows([]string{"date", "open", "high", "low", "close", "volume"}).
-		AddRow("2024-01-01T00:00:00Z", 148.0, 152.0, 147.0, 150.0, 1000000)
+		AddRow(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), 148.0, 152.0, 147.0, 150.0, 1000000)
 
 	mock.ExpectQuery("SELECT (.+) FROM price_history").
 		WillReturnRows(rows)
@@ -459,44 +568,55 @@ func TestGetPerformanceAnalytics_Success(t *testing.T) {
 
 	handler := NewHandler(mockServices, logger)
 
-	// Mock user ID query
-	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
+	expectDefaultPortfolio(mock, "user1", "portfolio1")
+	expectBaseCurrency(mock, "portfolio1", "USD")
 
 	// Mock portfolio totals query
-	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_cost, COUNT\\(\\*\\) as total_holdings FROM portfolio_holdings ph WHERE ph.user_id = \\$1").
-		WithArgs("user1").
-		WillReturnRows(sqlmock.NewRows([]string{"total_cost", "total_holdings"}).AddRow(3000.0, 2))
+	mock.ExpectQuery("SELECT COALESCE\\(a.currency, 'USD'\\) as currency, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_cost, COUNT\\(\\*\\) as total_holdings FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \\$1 GROUP BY").
+		WithArgs("portfolio1").
+		WillReturnRows(sqlmock.NewRows([]string{"currency", "total_cost", "total_holdings"}).AddRow("USD", 3000.0, 2))
 
 	// Mock holdings query for market value calculation
-	holdingsRows := sqlmock.NewRows([]string{"symbol", "quantity", "average_cost"}).
-		AddRow("AAPL", 10.0, 150.0).
-		AddRow("GOOGL", 5.0, 2500.0)
+	holdingsRows := sqlmock.NewRows([]string{"symbol", "currency", "quantity", "average_cost"}).
+		AddRow("AAPL", "USD", 10.0, 150.0).
+		AddRow("GOOGL", "USD", 5.0, 2500.0)
 
-	mock.ExpectQuery("SELECT (.+) FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.user_id = \\$1").
-		WithArgs("user1").
+	mock.ExpectQuery("SELECT (.+) FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \\$1").
+		WithArgs("portfolio1").
 		WillReturnRows(holdingsRows)
 
+	// Dividend income adds to the total return
+	mock.ExpectQuery("SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.portfolio_id = \\$1 AND t.transaction_type IN \\('DIVIDEND', 'DIVIDEND_REINVEST'\\) GROUP BY").
+		WithArgs("portfolio1").
+		WillReturnRows(sqlmock.NewRows([]string{"currency", "income"}).AddRow("USD", 120.0))
+
 	// Mock snapshots query for historical data
 	snapshotsRows := sqlmock.NewRows([]string{"snapshot_date", "total_value", "total_cost", "unrealized_pnl"}).
 		AddRow("2024-01-01", 2500.0, 2000.0, 500.0).
 		AddRow("2024-01-15", 2750.0, 2000.0, 750.0)
 
-	mock.ExpectQuery("SELECT (.+) FROM portfolio_snapshots WHERE user_id = \\$1").
-		WithArgs("user1").
+	mock.ExpectQuery("SELECT (.+) FROM portfolio_snapshots WHERE portfolio_id = \\$1").
+		WithArgs("portfolio1").
 		WillReturnRows(snapshotsRows)
 
 	// Mock top performers query
-	topPerformersRows := sqlmock.NewRows([]string{"symbol", "name", "quantity", "average_cost", "total_value"}).
-		AddRow("GOOGL", "Alphabet Inc.", 5.0, 2500.0, 12500.0).
-		AddRow("AAPL", "Apple Inc.", 10.0, 150.0, 1500.0)
+	topPerformersRows := sqlmock.NewRows([]string{"asset_id", "symbol", "name", "currency", "quantity", "average_cost", "total_value"}).
+		AddRow("asset-2", "GOOGL", "Alphabet Inc.", "USD", 5.0, 2500.0, 12500.0).
+		AddRow("asset-1", "AAPL", "Apple Inc.", "USD", 10.0, 150.0, 1500.0)
 
-	mock.ExpectQuery("SELECT (.+) FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.user_id = \\$1 ORDER BY \\(ph.quantity \\* ph.average_cost\\) DESC LIMIT 5").
-		WithArgs("user1").
+	mock.ExpectQuery("SELECT (.+) FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \\$1 ORDER BY \\(ph.quantity \\* ph.average_cost\\) DESC LIMIT 5").
+		WithArgs("portfolio1").
 		WillReturnRows(topPerformersRows)
 
+	// Returns are linked from the daily snapshots
+	mock.ExpectQuery("SELECT snapshot_date, total_value, COALESCE\\(net_flow, 0\\) FROM portfolio_snapshots WHERE portfolio_id = \\$1 ORDER BY snapshot_date ASC").
+		WithArgs("portfolio1").
+		WillReturnRows(sqlmock.NewRows([]string{"snapshot_date", "total_value", "net_flow"}).
+			AddRow(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), 2500.0, 2500.0).
+			AddRow(time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), 3125.0, 0.0))
+
 	router := gin.New()
+	router.Use(withTestUser("user1"))
 	router.GET("/analytics/performance", handler.GetPerformanceAnalytics)
 
 	req, _ := http.NewRequest("GET", "/analytics/performance?period=30d", nil)
@@ -508,6 +628,13 @@ func TestGetPerformanceAnalytics_Success(t *testing.T) {
 	assert.Contains(t, w.Body.String(), "portfolio_performance")
 	assert.Contains(t, w.Body.String(), "total_value")
 
+	// 14000 market value - 3000 cost + 120 dividends
+	assert.Contains(t, w.Body.String(), `"dividend_income":120`)
+	assert.Contains(t, w.Body.String(), `"total_gain_loss":11120`)
+	assert.Contains(t, w.Body.String(), `"fx_gain_loss":0`)
+	assert.Contains(t, w.Body.String(), `"as_of":"2024-01-15"`)
+	assert.Contains(t, w.Body.String(), `"since_inception":{"start":"2024-01-02","end":"2024-01-15","days":13,"time_weighted":{"cumulative_percent":25,"annualized_percent":null}`)
+
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
@@ -553,34 +680,45 @@ func TestGetRiskMetrics_Success(t *testing.T) {
 
 	handler := NewHandler(mockServices, logger)
 
-	// Mock user ID query
-	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
+	expectDefaultPortfolio(mock, "user1", "portfolio1")
+	expectBaseCurrency(mock, "portfolio1", "USD")
 
 	// Mock portfolio holdings for risk calculations
-	holdingsRows := sqlmock.NewRows([]string{"sector", "holdings_count", "sector_value"}).
-		AddRow("Technology", 2, 4390.0).
-		AddRow("Financial", 1, 750.0)
+	holdingsRows := sqlmock.NewRows([]string{"sector", "currency", "holdings_count", "sector_value"}).
+		AddRow("Technology", "USD", 2, 4390.0).
+		AddRow("Financial", "USD", 1, 750.0)
 
-	mock.ExpectQuery("SELECT a.sector, COUNT\\(\\*\\) as holdings_count, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as sector_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.user_id = \\$1 AND a.sector IS NOT NULL GROUP BY a.sector ORDER BY sector_value DESC").
-		WithArgs("user1").
+	mock.ExpectQuery("SELECT a.sector, COALESCE\\(a.currency, 'USD'\\) as currency, COUNT\\(\\*\\) as holdings_count, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as sector_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \\$1 AND a.sector IS NOT NULL GROUP BY a.sector, COALESCE\\(a.currency, 'USD'\\) ORDER BY sector_value DESC").
+		WithArgs("portfolio1").
 		WillReturnRows(holdingsRows)
 
 	// Mock additional query for beta calculation
-	betaRows := sqlmock.NewRows([]string{"symbol", "quantity", "average_cost", "position_value"}).
-		AddRow("AAPL", 10.0, 150.0, 1500.0).
-		AddRow("MSFT", 8.0, 300.0, 2400.0).
-		AddRow("JPM", 5.0, 140.0, 700.0)
+	betaRows := sqlmock.NewRows([]string{"symbol", "currency", "quantity", "average_cost", "position_value"}).
+		AddRow("AAPL", "USD", 10.0, 150.0, 1500.0).
+		AddRow("MSFT", "USD", 8.0, 300.0, 2400.0).
+		AddRow("JPM", "USD", 5.0, 140.0, 700.0)
 
-	mock.ExpectQuery("SELECT a.symbol, ph.quantity, ph.average_cost, \\(ph.quantity \\* ph.average_cost\\) as position_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.user_id = \\$1").
-		WithArgs("user1").
+	mock.ExpectQuery("SELECT a.symbol, COALESCE\\(a.currency, 'USD'\\) as currency, ph.quantity, ph.average_cost, \\(ph.quantity \\* ph.average_cost\\) as position_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \\$1").
+		WithArgs("portfolio1").
 		WillReturnRows(betaRows)
 
+	// Daily closes of the holdings and the default SPY benchmark; JPM has none
+	closeRows := sqlmock.NewRows([]string{"symbol", "date", "close_price"})
+	for i, day := range []string{"2024-03-04", "2024-03-05", "2024-03-06", "2024-03-07"} {
+		date, _ := time.Parse("2006-01-02", day)
+		closeRows.AddRow("AAPL", date, 150.0+float64(i%2)*3)
+		closeRows.AddRow("MSFT", date, 300.0-float64(i)*2)
+		closeRows.AddRow("SPY", date, 500.0+float64(i%2)*5)
+	}
+	mock.ExpectQuery("SELECT a.symbol, ph.date, ph.close_price FROM price_history ph JOIN assets a ON ph.asset_id = a.id WHERE a.symbol = ANY\\(\\$1\\)").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(closeRows)
+
 	router := gin.New()
+	router.Use(withTestUser("user1"))
 	router.GET("/analytics/risk", handler.GetRiskMetrics)
 
-	req, _ := http.NewRequest("GET", "/analytics/risk", nil)
+	req, _ := http.NewRequest("GET", "/analytics/risk?lookback=90d&risk_free_rate=0.04", nil)
 	w := httptest.NewRecorder()
 
 	router.ServeHTTP(w, req)
@@ -588,6 +726,10 @@ func TestGetRiskMetrics_Success(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 	assert.Contains(t, w.Body.String(), "diversification")
 	assert.Contains(t, w.Body.String(), "sector_diversification")
+	assert.Contains(t, w.Body.String(), `"observations":3`)
+	assert.Contains(t, w.Body.String(), `"lookback":"90d"`)
+	assert.Contains(t, w.Body.String(), `"risk_free_rate":4`)
+	assert.Contains(t, w.Body.String(), "No price history for JPM")
 
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
@@ -609,26 +751,25 @@ func TestGetRiskMetrics_EmptyPortfolio(t *testing.T) {
 
 	handler := NewHandler(mockServices, logger)
 
-	// Mock user ID query
-	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
+	expectDefaultPortfolio(mock, "user1", "portfolio1")
+	expectBaseCurrency(mock, "portfolio1", "USD")
 
 	// Mock empty portfolio holdings
-	holdingsRows := sqlmock.NewRows([]string{"sector", "holdings_count", "sector_value"})
+	holdingsRows := sqlmock.NewRows([]string{"sector", "currency", "holdings_count", "sector_value"})
 
-	mock.ExpectQuery("SELECT a.sector, COUNT\\(\\*\\) as holdings_count, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as sector_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.user_id = \\$1 AND a.sector IS NOT NULL GROUP BY a.sector ORDER BY sector_value DESC").
-		WithArgs("user1").
+	mock.ExpectQuery("SELECT a.sector, COALESCE\\(a.currency, 'USD'\\) as currency, COUNT\\(\\*\\) as holdings_count, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as sector_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \\$1 AND a.sector IS NOT NULL GROUP BY a.sector, COALESCE\\(a.currency, 'USD'\\) ORDER BY sector_value DESC").
+		WithArgs("portfolio1").
 		WillReturnRows(holdingsRows)
 
 	// Mock empty beta calculation query
-	betaRows := sqlmock.NewRows([]string{"symbol", "quantity", "average_cost", "position_value"})
+	betaRows := sqlmock.NewRows([]string{"symbol", "currency", "quantity", "average_cost", "position_value"})
 
-	mock.ExpectQuery("SELECT a.symbol, ph.quantity, ph.average_cost, \\(ph.quantity \\* ph.average_cost\\) as position_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.user_id = \\$1").
-		WithArgs("user1").
+	mock.ExpectQuery("SELECT a.symbol, COALESCE\\(a.currency, 'USD'\\) as currency, ph.quantity, ph.average_cost, \\(ph.quantity \\* ph.average_cost\\) as position_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \\$1").
+		WithArgs("portfolio1").
 		WillReturnRows(betaRows)
 
 	router := gin.New()
+	router.Use(withTestUser("user1"))
 	router.GET("/analytics/risk", handler.GetRiskMetrics)
 
 	req, _ := http.NewRequest("GET", "/analytics/risk", nil)
@@ -660,40 +801,42 @@ func TestGetAssetAllocation_Success(t *testing.T) {
 
 	handler := NewHandler(mockServices, logger)
 
-	// Mock user ID query
-	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
+	expectDefaultPortfolio(mock, "user1", "portfolio1")
+	expectBaseCurrency(mock, "portfolio1", "USD")
 
 	// Mock portfolio holdings for allocation
-	assetTypeRows := sqlmock.NewRows([]string{"asset_type", "count", "total_value"}).
-		AddRow("STOCK", 2, 45250.0).
-		AddRow("CRYPTO", 1, 30000.0)
+	assetTypeRows := sqlmock.NewRows([]string{"asset_type", "currency", "count", "total_value"}).
+		AddRow("STOCK", "USD", 2, 45250.0).
+		AddRow("CRYPTO", "USD", 1, 30000.0)
 
-	mock.ExpectQuery("SELECT a.asset_type, COUNT\\(\\*\\) as count, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.user_id = \\$1 GROUP BY a.asset_type ORDER BY total_value DESC").
-		WithArgs("user1").
+	mock.ExpectQuery("SELECT a.asset_type, COALESCE\\(a.currency, 'USD'\\) as currency, COUNT\\(\\*\\) as count, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \\$1 GROUP BY a.asset_type, COALESCE\\(a.currency, 'USD'\\) ORDER BY total_value DESC").
+		WithArgs("portfolio1").
 		WillReturnRows(assetTypeRows)
 
+	// Cash brings the portfolio to 100000
+	expectCashBalances(mock, "portfolio1", newCashBalanceRows().AddRow("USD", 24750.0))
+
 	// Mock sector allocation query
-	sectorRows := sqlmock.NewRows([]string{"sector", "count", "total_value"}).
-		AddRow("Technology", 2, 45250.0).
-		AddRow("Cryptocurrency", 1, 30000.0)
+	sectorRows := sqlmock.NewRows([]string{"sector", "currency", "count", "total_value"}).
+		AddRow("Technology", "USD", 2, 45250.0).
+		AddRow("Cryptocurrency", "USD", 1, 30000.0)
 
-	mock.ExpectQuery("SELECT COALESCE\\(a.sector, 'Unknown'\\) as sector, COUNT\\(\\*\\) as count, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.user_id = \\$1 GROUP BY a.sector ORDER BY total_value DESC").
-		WithArgs("user1").
+	mock.ExpectQuery("SELECT COALESCE\\(a.sector, 'Unknown'\\) as sector, COALESCE\\(a.currency, 'USD'\\) as currency, COUNT\\(\\*\\) as count, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \\$1 GROUP BY a.sector, COALESCE\\(a.currency, 'USD'\\) ORDER BY total_value DESC").
+		WithArgs("portfolio1").
 		WillReturnRows(sectorRows)
 
 	// Mock top holdings query
-	topHoldingsRows := sqlmock.NewRows([]string{"symbol", "name", "quantity", "average_cost", "total_value"}).
-		AddRow("BTC-USD", "Bitcoin", 0.5, 50000.0, 30000.0).
-		AddRow("GOOGL", "Alphabet Inc.", 5.0, 2500.0, 13500.0).
-		AddRow("AAPL", "Apple Inc.", 10.0, 150.0, 1750.0)
+	topHoldingsRows := sqlmock.NewRows([]string{"symbol", "name", "currency", "quantity", "average_cost", "total_value"}).
+		AddRow("BTC-USD", "Bitcoin", "USD", 0.5, 50000.0, 30000.0).
+		AddRow("GOOGL", "Alphabet Inc.", "USD", 5.0, 2500.0, 13500.0).
+		AddRow("AAPL", "Apple Inc.", "USD", 10.0, 150.0, 1750.0)
 
-	mock.ExpectQuery("SELECT a.symbol, a.name, ph.quantity, ph.average_cost, \\(ph.quantity \\* ph.average_cost\\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.user_id = \\$1 ORDER BY \\(ph.quantity \\* ph.average_cost\\) DESC LIMIT 10").
-		WithArgs("user1").
+	mock.ExpectQuery("SELECT a.symbol, a.name, COALESCE\\(a.currency, 'USD'\\) as currency, ph.quantity, ph.average_cost, \\(ph.quantity \\* ph.average_cost\\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \\$1 ORDER BY \\(ph.quantity \\* ph.average_cost\\) DESC").
+		WithArgs("portfolio1").
 		WillReturnRows(topHoldingsRows)
 
 	router := gin.New()
+	router.Use(withTestUser("user1"))
 	router.GET("/analytics/allocation", handler.GetAssetAllocation)
 
 	req, _ := http.NewRequest("GET", "/analytics/allocation", nil)
@@ -705,6 +848,8 @@ func TestGetAssetAllocation_Success(t *testing.T) {
 	assert.Contains(t, w.Body.String(), "by_asset_type")
 	assert.Contains(t, w.Body.String(), "by_sector")
 	assert.Contains(t, w.Body.String(), "top_holdings")
+	assert.Contains(t, w.Body.String(), `"total_portfolio_value":100000`)
+	assert.Contains(t, w.Body.String(), `"sector":"Cash"`)
 
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
@@ -727,30 +872,28 @@ func TestWhatIfAnalysis_BuyScenario(t *testing.T) {
 
 	handler := NewHandler(mockServices, logger)
 
-	// Mock user ID query
-	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
+	expectDefaultPortfolio(mock, "user1", "portfolio1")
 
 	// Mock current portfolio totals query
-	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_cost, COUNT\\(\\*\\) as total_holdings FROM portfolio_holdings ph WHERE ph.user_id = \\$1").
-		WithArgs("user1").
+	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_cost, COUNT\\(\\*\\) as total_holdings FROM portfolio_holdings ph WHERE ph.portfolio_id = \\$1").
+		WithArgs("portfolio1").
 		WillReturnRows(sqlmock.NewRows([]string{"total_cost", "total_holdings"}).AddRow(3400.0, 2))
 
 	// Mock current holding check for GOOGL
-	mock.ExpectQuery("SELECT ph.quantity, ph.average_cost FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.user_id = \\$1 AND a.symbol = \\$2").
-		WithArgs("user1", "GOOGL").
+	mock.ExpectQuery("SELECT ph.quantity, ph.average_cost FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \\$1 AND a.symbol = \\$2").
+		WithArgs("portfolio1", "GOOGL").
 		WillReturnError(sql.ErrNoRows) // No existing GOOGL position
 
 	// Mock allocation query
 	allocationRows := sqlmock.NewRows([]string{"asset_type", "total_value"}).
 		AddRow("STOCK", 3400.0)
 
-	mock.ExpectQuery("SELECT a.asset_type, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.user_id = \\$1 GROUP BY a.asset_type").
-		WithArgs("user1").
+	mock.ExpectQuery("SELECT a.asset_type, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \\$1 GROUP BY a.asset_type").
+		WithArgs("portfolio1").
 		WillReturnRows(allocationRows)
 
 	router := gin.New()
+	router.Use(withTestUser("user1"))
 	router.POST("/analytics/what-if", handler.WhatIfAnalysis)
 
 	requestBody := map[string]interface{}{
@@ -791,30 +934,28 @@ func TestWhatIfAnalysis_SellScenario(t *testing.T) {
 
 	handler := NewHandler(mockServices, logger)
 
-	// Mock user ID query
-	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
+	expectDefaultPortfolio(mock, "user1", "portfolio1")
 
 	// Mock current portfolio totals query
-	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_cost, COUNT\\(\\*\\) as total_holdings FROM portfolio_holdings ph WHERE ph.user_id = \\$1").
-		WithArgs("user1").
+	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_cost, COUNT\\(\\*\\) as total_holdings FROM portfolio_holdings ph WHERE ph.portfolio_id = \\$1").
+		WithArgs("portfolio1").
 		WillReturnRows(sqlmock.NewRows([]string{"total_cost", "total_holdings"}).AddRow(3400.0, 2))
 
 	// Mock current holding check for AAPL (existing position)
-	mock.ExpectQuery("SELECT ph.quantity, ph.average_cost FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.user_id = \\$1 AND a.symbol = \\$2").
-		WithArgs("user1", "AAPL").
+	mock.ExpectQuery("SELECT ph.quantity, ph.average_cost FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \\$1 AND a.symbol = \\$2").
+		WithArgs("portfolio1", "AAPL").
 		WillReturnRows(sqlmock.NewRows([]string{"quantity", "average_cost"}).AddRow(10.0, 150.0))
 
 	// Mock allocation query
 	allocationRows := sqlmock.NewRows([]string{"asset_type", "total_value"}).
 		AddRow("STOCK", 3400.0)
 
-	mock.ExpectQuery("SELECT a.asset_type, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.user_id = \\$1 GROUP BY a.asset_type").
-		WithArgs("user1").
+	mock.ExpectQuery("SELECT a.asset_type, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \\$1 GROUP BY a.asset_type").
+		WithArgs("portfolio1").
 		WillReturnRows(allocationRows)
 
 	router := gin.New()
+	router.Use(withTestUser("user1"))
 	router.POST("/analytics/what-if", handler.WhatIfAnalysis)
 
 	requestBody := map[string]interface{}{
@@ -836,6 +977,36 @@ func TestWhatIfAnalysis_SellScenario(t *testing.T) {
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
+func TestWhatIfAnalysis_BuyHeldSymbol(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+
+	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_cost, COUNT\\(\\*\\) as total_holdings FROM portfolio_holdings ph WHERE ph.portfolio_id = \\$1").
+		WithArgs(testPortfolioID).
+		WillReturnRows(sqlmock.NewRows([]string{"total_cost", "total_holdings"}).AddRow(3400.0, 2))
+
+	// AAPL is already held, so buying more doesn't add a holding
+	mock.ExpectQuery("SELECT ph.quantity, ph.average_cost FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \\$1 AND a.symbol = \\$2").
+		WithArgs(testPortfolioID, "AAPL").
+		WillReturnRows(sqlmock.NewRows([]string{"quantity", "average_cost"}).AddRow(10.0, 150.0))
+
+	mock.ExpectQuery("SELECT a.asset_type, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \\$1 GROUP BY a.asset_type").
+		WithArgs(testPortfolioID).
+		WillReturnRows(sqlmock.NewRows([]string{"asset_type", "total_value"}).AddRow("STOCK", 3400.0))
+
+	router := createTestRouter(handler, "POST", "/analytics/what-if", handler.WhatIfAnalysis)
+	req, _ := http.NewRequest("POST", "/analytics/what-if", bytes.NewBufferString(`{"action": "buy", "symbol": "AAPL", "quantity": 5, "price": 175}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"new_holdings":2`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestWhatIfAnalysis_ValidationError(t *testing.T) {
 	// Setup
 	gin.SetMode(gin.TestMode)
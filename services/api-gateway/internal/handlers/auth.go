@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/portfolio-management/api-gateway/internal/middleware"
+	"github.com/portfolio-management/api-gateway/internal/services"
+)
+
+// Auth handlers
+func (h *Handler) Register(c *gin.Context) {
+	var request struct {
+		Username string `json:"username" binding:"required,min=3,max=255"`
+		Email    string `json:"email" binding:"omitempty,email"`
+		Password string `json:"password" binding:"required,min=8,max=72"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
+		return
+	}
+
+	if h.services.Tokens == nil {
+		h.logger.Error("Token manager is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
+		return
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
+	if err != nil {
+		h.logger.Error("Failed to hash password", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
+		return
+	}
+
+	username := strings.TrimSpace(request.Username)
+	var email interface{}
+	if request.Email != "" {
+		email = request.Email
+	}
+
+	tx, err := h.services.DB.Begin()
+	if err != nil {
+		h.logger.Error("Failed to begin transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
+		return
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRow(`
+		INSERT INTO users (username, email, password_hash)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, username, email, string(passwordHash)).Scan(&userID)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Username or email already registered"})
+			return
+		}
+		h.logger.Error("Failed to create user", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
+		return
+	}
+
+	// Every user starts with a default portfolio
+	var portfolioID string
+	err = tx.QueryRow(`
+		INSERT INTO portfolios (user_id, name, is_default)
+		VALUES ($1, 'Default', true)
+		RETURNING id
+	`, userID).Scan(&portfolioID)
+	if err != nil {
+		h.logger.Error("Failed to create default portfolio", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		h.logger.Error("Failed to commit transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
+		return
+	}
+
+	tokens, err := h.services.Tokens.IssueTokens(userID, username, false)
+	if err != nil {
+		h.logger.Error("Failed to issue tokens", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":      "User registered successfully",
+		"user_id":      userID,
+		"username":     username,
+		"portfolio_id": portfolioID,
+		"tokens":       tokens,
+	})
+}
+
+func (h *Handler) Login(c *gin.Context) {
+	var request struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	if h.services.Tokens == nil {
+		h.logger.Error("Token manager is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	username := strings.TrimSpace(request.Username)
+
+	var userID string
+	var passwordHash sql.NullString
+	var isAdmin bool
+	err := h.services.DB.QueryRow(`
+		SELECT id, password_hash, is_admin FROM users WHERE username = $1
+	`, username).Scan(&userID, &passwordHash, &isAdmin)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+			return
+		}
+		h.logger.Error("Failed to query user", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	// Users created before authentication existed have no password and can't log in
+	if !passwordHash.Valid || bcrypt.CompareHashAndPassword([]byte(passwordHash.String), []byte(request.Password)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		return
+	}
+
+	tokens, err := h.services.Tokens.IssueTokens(userID, username, isAdmin)
+	if err != nil {
+		h.logger.Error("Failed to issue tokens", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Login successful",
+		"user_id":  userID,
+		"username": username,
+		"tokens":   tokens,
+	})
+}
+
+func (h *Handler) RefreshToken(c *gin.Context) {
+	var request struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+		return
+	}
+
+	if h.services.Tokens == nil {
+		h.logger.Error("Token manager is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+		return
+	}
+
+	claims, err := h.services.Tokens.ParseToken(request.RefreshToken, services.RefreshTokenType)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+		return
+	}
+
+	// Make sure the user still exists (and pick up role changes) before issuing new tokens
+	var username string
+	var isAdmin bool
+	err = h.services.DB.QueryRow("SELECT username, is_admin FROM users WHERE id = $1", claims.Subject).Scan(&username, &isAdmin)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+			return
+		}
+		h.logger.Error("Failed to query user", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+		return
+	}
+
+	tokens, err := h.services.Tokens.IssueTokens(claims.Subject, username, isAdmin)
+	if err != nil {
+		h.logger.Error("Failed to issue tokens", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Token refreshed successfully",
+		"tokens":  tokens,
+	})
+}
+
+// Helper function to get the authenticated user ID, responding with 401 if it is missing
+func (h *Handler) requireUserID(c *gin.Context) (string, bool) {
+	userID := middleware.GetUserID(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return "", false
+	}
+	return userID, true
+}
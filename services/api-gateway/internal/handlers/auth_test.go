@@ -0,0 +1,392 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/portfolio-management/api-gateway/internal/middleware"
+	"github.com/portfolio-management/api-gateway/internal/services"
+)
+
+const testJWTSecret = "test-secret"
+
+// Helper function to create a test handler with a mock database and token manager
+func createAuthTestHandler(t *testing.T) (*Handler, sqlmock.Sqlmock, func()) {
+	handler, mock, cleanup := createTestHandler(t)
+	handler.services.Tokens = services.NewTokenManager(testJWTSecret, 15*time.Minute, time.Hour)
+	return handler, mock, cleanup
+}
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name           string
+		requestBody    string
+		setupMock      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedBody   []string
+	}{
+		{
+			name:        "successful registration",
+			requestBody: `{"username": "alice", "email": "alice@example.com", "password": "correct-horse"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO users \(username, email, password_hash\) VALUES \(.+\) RETURNING id`).
+					WithArgs("alice", "alice@example.com", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+				mock.ExpectQuery(`INSERT INTO portfolios \(user_id, name, is_default\) VALUES \(.+\) RETURNING id`).
+					WithArgs(testUserID).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testPortfolioID))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+			expectedBody:   []string{"User registered successfully", "access_token", "refresh_token", testUserID, testPortfolioID},
+		},
+		{
+			name:        "duplicate username",
+			requestBody: `{"username": "alice", "password": "correct-horse"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO users \(username, email, password_hash\) VALUES \(.+\) RETURNING id`).
+					WillReturnError(&pq.Error{Code: "23505"})
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+			expectedBody:   []string{"already registered"},
+		},
+		{
+			name:           "password too short",
+			requestBody:    `{"username": "alice", "password": "short"}`,
+			setupMock:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"Password"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock, cleanup := createAuthTestHandler(t)
+			defer cleanup()
+
+			tt.setupMock(mock)
+
+			router := gin.New()
+			router.POST("/auth/register", handler.Register)
+
+			req, _ := http.NewRequest("POST", "/auth/register", strings.NewReader(tt.requestBody))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			for _, expected := range tt.expectedBody {
+				assert.Contains(t, w.Body.String(), expected)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestLogin(t *testing.T) {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("correct-horse"), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		requestBody    string
+		setupMock      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedBody   []string
+	}{
+		{
+			name:        "successful login",
+			requestBody: `{"username": "alice", "password": "correct-horse"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id, password_hash, is_admin FROM users WHERE username = \$1`).
+					WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash", "is_admin"}).AddRow(testUserID, string(passwordHash), false))
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{"Login successful", "access_token"},
+		},
+		{
+			name:        "surrounding whitespace in the username is ignored",
+			requestBody: `{"username": "  alice ", "password": "correct-horse"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id, password_hash, is_admin FROM users WHERE username = \$1`).
+					WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash", "is_admin"}).AddRow(testUserID, string(passwordHash), false))
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{"Login successful", `"username":"alice"`},
+		},
+		{
+			name:        "wrong password",
+			requestBody: `{"username": "alice", "password": "wrong-password"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id, password_hash, is_admin FROM users WHERE username = \$1`).
+					WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash", "is_admin"}).AddRow(testUserID, string(passwordHash), false))
+			},
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   []string{"Invalid username or password"},
+		},
+		{
+			name:        "unknown user",
+			requestBody: `{"username": "mallory", "password": "correct-horse"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id, password_hash, is_admin FROM users WHERE username = \$1`).
+					WithArgs("mallory").
+					WillReturnError(sql.ErrNoRows)
+			},
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   []string{"Invalid username or password"},
+		},
+		{
+			name:        "user without password",
+			requestBody: `{"username": "default_user", "password": "anything"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id, password_hash, is_admin FROM users WHERE username = \$1`).
+					WithArgs("default_user").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash", "is_admin"}).AddRow(testUserID, nil, false))
+			},
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   []string{"Invalid username or password"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock, cleanup := createAuthTestHandler(t)
+			defer cleanup()
+
+			tt.setupMock(mock)
+
+			router := gin.New()
+			router.POST("/auth/login", handler.Login)
+
+			req, _ := http.NewRequest("POST", "/auth/login", strings.NewReader(tt.requestBody))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			for _, expected := range tt.expectedBody {
+				assert.Contains(t, w.Body.String(), expected)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	tokens := services.NewTokenManager(testJWTSecret, 15*time.Minute, time.Hour)
+	pair, err := tokens.IssueTokens(testUserID, "alice", false)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		refreshToken   string
+		setupMock      func(sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name:         "valid refresh token",
+			refreshToken: pair.RefreshToken,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT username, is_admin FROM users WHERE id = \$1`).
+					WithArgs(testUserID).
+					WillReturnRows(sqlmock.NewRows([]string{"username", "is_admin"}).AddRow("alice", true))
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "access token rejected as refresh token",
+			refreshToken:   pair.AccessToken,
+			setupMock:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "malformed token",
+			refreshToken:   "not-a-jwt",
+			setupMock:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:         "deleted user",
+			refreshToken: pair.RefreshToken,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT username, is_admin FROM users WHERE id = \$1`).
+					WithArgs(testUserID).
+					WillReturnError(sql.ErrNoRows)
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock, cleanup := createAuthTestHandler(t)
+			defer cleanup()
+
+			tt.setupMock(mock)
+
+			router := gin.New()
+			router.POST("/auth/refresh", handler.RefreshToken)
+
+			body, _ := json.Marshal(map[string]string{"refresh_token": tt.refreshToken})
+			req, _ := http.NewRequest("POST", "/auth/refresh", strings.NewReader(string(body)))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := services.NewTokenManager(testJWTSecret, 15*time.Minute, time.Hour)
+	pair, err := tokens.IssueTokens(testUserID, "alice", false)
+	assert.NoError(t, err)
+
+	otherTokens := services.NewTokenManager("other-secret", 15*time.Minute, time.Hour)
+	forged, err := otherTokens.IssueTokens(testUserID, "alice", false)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		header         string
+		query          string
+		expectedStatus int
+	}{
+		{name: "valid bearer token", header: "Bearer " + pair.AccessToken, expectedStatus: http.StatusOK},
+		{name: "valid query token", query: "?token=" + pair.AccessToken, expectedStatus: http.StatusOK},
+		{name: "missing token", expectedStatus: http.StatusUnauthorized},
+		{name: "refresh token used as access token", header: "Bearer " + pair.RefreshToken, expectedStatus: http.StatusUnauthorized},
+		{name: "token signed with another secret", header: "Bearer " + forged.AccessToken, expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(middleware.Auth(tokens))
+			router.GET("/me", func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"user_id": middleware.GetUserID(c)})
+			})
+
+			req, _ := http.NewRequest("GET", "/me"+tt.query, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedStatus == http.StatusOK {
+				assert.Contains(t, w.Body.String(), testUserID)
+			}
+		})
+	}
+}
+
+func TestRequireAdminMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := services.NewTokenManager(testJWTSecret, 15*time.Minute, time.Hour)
+	userPair, err := tokens.IssueTokens(testUserID, "alice", false)
+	assert.NoError(t, err)
+	adminPair, err := tokens.IssueTokens(testUserID, "root", true)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		token          string
+		expectedStatus int
+	}{
+		{name: "admin token", token: adminPair.AccessToken, expectedStatus: http.StatusOK},
+		{name: "regular user token", token: userPair.AccessToken, expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(middleware.Auth(tokens), middleware.RequireAdmin())
+			router.GET("/admin", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req, _ := http.NewRequest("GET", "/admin", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+}
+
+func TestHandlers_RequireAuthenticatedUser(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	tests := []struct {
+		method  string
+		path    string
+		body    string
+		handler gin.HandlerFunc
+	}{
+		{"GET", "/portfolio", "", handler.GetPortfolio},
+		{"GET", "/portfolio/summary", "", handler.GetPortfolioSummary},
+		{"GET", "/portfolio/performance", "", handler.GetPortfolioPerformance},
+		{"GET", "/portfolio/lots", "", handler.GetTaxLots},
+		{"GET", "/portfolio/reconcile", "", handler.ReconcilePortfolio},
+		{"GET", "/portfolio/targets", "", handler.GetTargetAllocations},
+		{"PUT", "/portfolio/targets", `{"by": "symbol", "targets": []}`, handler.SetTargetAllocations},
+		{"GET", "/portfolio/rebalance", "", handler.GetRebalance},
+		{"POST", "/portfolio/holdings", `{"symbol": "AAPL", "quantity": 1, "average_cost": 100}`, handler.AddHolding},
+		{"GET", "/transactions", "", handler.GetTransactions},
+		{"GET", "/analytics/risk", "", handler.GetRiskMetrics},
+		{"GET", "/analytics/stress", "", handler.GetStressTest},
+		{"GET", "/analytics/allocation", "", handler.GetAssetAllocation},
+		{"GET", "/analytics/realized", "", handler.GetRealizedPnL},
+		{"GET", "/analytics/income", "", handler.GetIncome},
+		{"GET", "/analytics/var", "", handler.GetValueAtRisk},
+		{"GET", "/analytics/correlation", "", handler.GetCorrelation},
+		{"POST", "/analytics/optimize", `{}`, handler.OptimizePortfolio},
+		{"GET", "/analytics/scenarios", "", handler.GetScenarios},
+		{"POST", "/analytics/scenarios", `{"name": "Trim", "shocks": {"symbols": {"AAPL": -0.1}}}`, handler.SaveScenario},
+		{"POST", "/analytics/scenarios/run", `{"trades": [{"action": "buy", "symbol": "AAPL", "quantity": 1}]}`, handler.RunScenario},
+		{"GET", "/analytics/scenarios/:id", "", handler.GetScenario},
+		{"DELETE", "/analytics/scenarios/:id", "", handler.DeleteScenario},
+		{"GET", "/notifications", "", handler.GetNotifications},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			// No withTestUser middleware: the handler must refuse to guess a user
+			router := gin.New()
+			router.Handle(tt.method, tt.path, tt.handler)
+
+			req, _ := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+	}
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+
+	"github.com/portfolio-management/api-gateway/internal/services"
+)
+
+// benchmarkPoint is the cumulative return of the portfolio and its benchmark up to one close, in percent
+type benchmarkPoint struct {
+	Date      string  `json:"date"`
+	Portfolio float64 `json:"portfolio"`
+	Benchmark float64 `json:"benchmark"`
+	Excess    float64 `json:"excess"`
+}
+
+// benchmarkComparison compares a portfolio's returns with a benchmark's over the closes both have.
+// Statistics that need more observations than there are, or an up or down day, are nil.
+type benchmarkComparison struct {
+	Start                  string           `json:"start,omitempty"`
+	End                    string           `json:"end,omitempty"`
+	Observations           int              `json:"observations"`
+	PortfolioReturnPercent *float64         `json:"portfolio_return_percent"`
+	BenchmarkReturnPercent *float64         `json:"benchmark_return_percent"`
+	ExcessReturnPercent    *float64         `json:"excess_return_percent"`
+	TrackingErrorPercent   *float64         `json:"tracking_error_percent"`
+	InformationRatio       *float64         `json:"information_ratio"`
+	UpCapturePercent       *float64         `json:"up_capture_percent"`
+	DownCapturePercent     *float64         `json:"down_capture_percent"`
+	Series                 []benchmarkPoint `json:"series"`
+}
+
+// Helper function to resolve the benchmark asked for by the "benchmark" query parameter, or the
+// configured default
+func (h *Handler) requestedBenchmark(c *gin.Context) ([]services.BenchmarkComponent, bool) {
+	spec := c.Query("benchmark")
+	if spec == "" {
+		spec = h.services.Analytics.Benchmark
+	}
+	if spec == "" {
+		spec = services.DefaultBenchmark
+	}
+
+	components, err := services.ParseBenchmark(spec)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid benchmark: %v", err)})
+		return nil, false
+	}
+	return components, true
+}
+
+// Helper function to load the daily closes of symbols between two days, keyed by symbol
+func (h *Handler) loadSymbolCloses(symbols []string, from, to time.Time) (closingPrices, error) {
+	rows, err := h.services.DB.Query(`
+		SELECT a.symbol, ph.date, ph.close_price
+		FROM price_history ph
+		JOIN assets a ON ph.asset_id = a.id
+		WHERE a.symbol = ANY($1) AND ph.date >= $2 AND ph.date <= $3
+		ORDER BY a.symbol, ph.date ASC
+	`, pq.Array(symbols), from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query closing prices: %w", err)
+	}
+	defer rows.Close()
+
+	prices := closingPrices{}
+	for rows.Next() {
+		var symbol string
+		var price datedClose
+		if err := rows.Scan(&symbol, &price.Date, &price.Close); err != nil {
+			return nil, fmt.Errorf("failed to scan closing price: %w", err)
+		}
+		prices[symbol] = append(prices[symbol], price)
+	}
+	return prices, rows.Err()
+}
+
+// periodWindow returns the valuations a return period covers: from the latest close on or before its
+// start (or the first close, since inception) to the last
+func periodWindow(points []valuationPoint, period string) []valuationPoint {
+	if period == "since_inception" || len(points) == 0 {
+		return points
+	}
+	start := periodStart(period, points[len(points)-1].Date)
+	base := 0
+	for i := range points {
+		if points[i].Date.After(start) {
+			break
+		}
+		base = i
+	}
+	return points[base:]
+}
+
+// compareWithBenchmark aligns a portfolio's valuations with a benchmark's closes on the days both have,
+// and compares their returns. The portfolio is measured time-weighted, so flows don't count as
+// returns; a blend is rebalanced to its weights every day.
+func compareWithBenchmark(points []valuationPoint, components []services.BenchmarkComponent, closes closingPrices) benchmarkComparison {
+	comparison := benchmarkComparison{Series: []benchmarkPoint{}}
+
+	// Portfolio growth of one unit invested at the first close
+	daily := dailyReturns(points)
+	growth := make([]float64, len(points))
+	for i := range points {
+		growth[i] = 1 + daily[i]
+		if i > 0 {
+			growth[i] *= growth[i-1]
+		}
+	}
+
+	byDay := make([]map[string]float64, len(components))
+	for i, component := range components {
+		byDay[i] = map[string]float64{}
+		for _, price := range closes[component.Symbol] {
+			byDay[i][price.Date.Format("2006-01-02")] = price.Close
+		}
+	}
+
+	var portfolioReturns, benchmarkReturns []float64
+	first, previous := -1, -1
+	var previousCloses []float64
+	benchmarkGrowth := 1.0
+	for i, point := range points {
+		day := point.Date.Format("2006-01-02")
+		dayCloses := make([]float64, len(components))
+		aligned := true
+		for j := range components {
+			price, ok := byDay[j][day]
+			if !ok || price <= 0 {
+				aligned = false
+				break
+			}
+			dayCloses[j] = price
+		}
+		if !aligned || growth[i] <= 0 {
+			continue
+		}
+
+		if previous >= 0 {
+			portfolioReturn := growth[i]/growth[previous] - 1
+			var benchmarkReturn float64
+			for j, component := range components {
+				benchmarkReturn += component.Weight * (dayCloses[j]/previousCloses[j] - 1)
+			}
+			portfolioReturns = append(portfolioReturns, portfolioReturn)
+			benchmarkReturns = append(benchmarkReturns, benchmarkReturn)
+			benchmarkGrowth *= 1 + benchmarkReturn
+		} else {
+			comparison.Start = day
+			first = i
+		}
+
+		portfolioCumulative := (growth[i]/growth[first] - 1) * 100
+		benchmarkCumulative := (benchmarkGrowth - 1) * 100
+		comparison.Series = append(comparison.Series, benchmarkPoint{
+			Date:      day,
+			Portfolio: portfolioCumulative,
+			Benchmark: benchmarkCumulative,
+			Excess:    portfolioCumulative - benchmarkCumulative,
+		})
+		comparison.End = day
+		previous, previousCloses = i, dayCloses
+	}
+
+	comparison.Observations = len(portfolioReturns)
+	if comparison.Observations == 0 {
+		return comparison
+	}
+
+	last := comparison.Series[len(comparison.Series)-1]
+	comparison.PortfolioReturnPercent = optionalFloat(last.Portfolio)
+	comparison.BenchmarkReturnPercent = optionalFloat(last.Benchmark)
+	comparison.ExcessReturnPercent = optionalFloat(last.Excess)
+
+	// Tracking error and the information ratio are annualized from the daily active returns
+	active := make([]float64, len(portfolioReturns))
+	for i := range portfolioReturns {
+		active[i] = portfolioReturns[i] - benchmarkReturns[i]
+	}
+	if len(active) >= 2 {
+		trackingError := sampleStdDev(active) * math.Sqrt(tradingDaysPerYear)
+		comparison.TrackingErrorPercent = optionalFloat(trackingError * 100)
+		if trackingError > 0 {
+			comparison.InformationRatio = optionalFloat(mean(active) * tradingDaysPerYear / trackingError)
+		}
+	}
+
+	// Capture ratios compare the average compounded returns on the benchmark's up and down days
+	var upPortfolio, upBenchmark, downPortfolio, downBenchmark []float64
+	for i, benchmarkReturn := range benchmarkReturns {
+		switch {
+		case benchmarkReturn > 0:
+			upPortfolio = append(upPortfolio, portfolioReturns[i])
+			upBenchmark = append(upBenchmark, benchmarkReturn)
+		case benchmarkReturn < 0:
+			downPortfolio = append(downPortfolio, portfolioReturns[i])
+			downBenchmark = append(downBenchmark, benchmarkReturn)
+		}
+	}
+	if len(upBenchmark) > 0 {
+		comparison.UpCapturePercent = optionalFloat(geometricMean(upPortfolio) / geometricMean(upBenchmark) * 100)
+	}
+	if len(downBenchmark) > 0 {
+		comparison.DownCapturePercent = optionalFloat(geometricMean(downPortfolio) / geometricMean(downBenchmark) * 100)
+	}
+	return comparison
+}
+
+// GetBenchmarkComparison compares the portfolio's time-weighted returns with a benchmark's over a
+// return period
+func (h *Handler) GetBenchmarkComparison(c *gin.Context) {
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compare with benchmark"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
+		return
+	}
+
+	components, ok := h.requestedBenchmark(c)
+	if !ok {
+		return
+	}
+	symbols := make([]string, len(components))
+	for i, component := range components {
+		symbols[i] = component.Symbol
+	}
+
+	period := c.DefaultQuery("period", "1Y")
+	if !isReturnPeriod(period) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid period, expected one of %s", strings.Join(returnPeriods, ", "))})
+		return
+	}
+
+	points, err := h.loadValuationSeries(portfolioID)
+	if err != nil {
+		h.logger.Error("Failed to load portfolio valuations", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compare with benchmark"})
+		return
+	}
+	points = periodWindow(points, period)
+
+	comparison := benchmarkComparison{Series: []benchmarkPoint{}}
+	if len(points) > 0 {
+		closes, err := h.loadSymbolCloses(symbols, points[0].Date, points[len(points)-1].Date)
+		if err != nil {
+			h.logger.Error("Failed to load benchmark prices", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compare with benchmark"})
+			return
+		}
+		for _, symbol := range symbols {
+			if len(closes[symbol]) == 0 {
+				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("No price history for benchmark symbol %s", symbol)})
+				return
+			}
+		}
+		comparison = compareWithBenchmark(points, components, closes)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"benchmark":  components,
+		"period":     period,
+		"comparison": comparison,
+	})
+}
+
+// isReturnPeriod reports whether period is one of the reporting periods
+func isReturnPeriod(period string) bool {
+	for _, p := range returnPeriods {
+		if p == period {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/portfolio-management/api-gateway/internal/services"
+	"github.com/stretchr/testify/assert"
+)
+
+// benchmarkTestPoints returns a week of valuations with a mid-week deposit that earns nothing that day
+func benchmarkTestPoints() []valuationPoint {
+	return []valuationPoint{
+		{Date: testDay("2024-03-04"), Value: 1000, Flow: 1000},
+		{Date: testDay("2024-03-05"), Value: 1100},
+		{Date: testDay("2024-03-06"), Value: 2100, Flow: 1000},
+		{Date: testDay("2024-03-07"), Value: 1890},
+		{Date: testDay("2024-03-08"), Value: 2079},
+	}
+}
+
+// benchmarkTestCloses returns SPY and AGG closes for the week, with AGG missing on 2024-03-06
+func benchmarkTestCloses() closingPrices {
+	return closingPrices{
+		"SPY": {
+			{Date: testDay("2024-03-04"), Close: 100},
+			{Date: testDay("2024-03-05"), Close: 110},
+			{Date: testDay("2024-03-06"), Close: 120},
+			{Date: testDay("2024-03-07"), Close: 108},
+			{Date: testDay("2024-03-08"), Close: 118.8},
+		},
+		"AGG": {
+			{Date: testDay("2024-03-04"), Close: 50},
+			{Date: testDay("2024-03-05"), Close: 50},
+			{Date: testDay("2024-03-07"), Close: 50},
+			{Date: testDay("2024-03-08"), Close: 55},
+		},
+	}
+}
+
+// TestParseBenchmark tests parsing single-symbol and blended benchmarks
+func TestParseBenchmark(t *testing.T) {
+	components, err := services.ParseBenchmark("spy")
+	assert.NoError(t, err)
+	assert.Equal(t, []services.BenchmarkComponent{{Symbol: "SPY", Weight: 1}}, components)
+
+	components, err = services.ParseBenchmark("SPY:60, AGG:40")
+	assert.NoError(t, err)
+	if assert.Len(t, components, 2) {
+		assert.InDelta(t, 0.6, components[0].Weight, 1e-12)
+		assert.InDelta(t, 0.4, components[1].Weight, 1e-12)
+	}
+
+	for _, spec := range []string{"", "SPY:0", "SPY:abc", ":0.5", "SPY:0.5,SPY:0.5"} {
+		_, err := services.ParseBenchmark(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+// TestCompareWithBenchmark tests aligning a portfolio with a blended benchmark and comparing returns
+func TestCompareWithBenchmark(t *testing.T) {
+	components := []services.BenchmarkComponent{{Symbol: "SPY", Weight: 0.5}, {Symbol: "AGG", Weight: 0.5}}
+
+	comparison := compareWithBenchmark(benchmarkTestPoints(), components, benchmarkTestCloses())
+
+	// 2024-03-06 is dropped since AGG has no close
+	assert.Equal(t, "2024-03-04", comparison.Start)
+	assert.Equal(t, "2024-03-08", comparison.End)
+	assert.Equal(t, 3, comparison.Observations)
+	if !assert.Len(t, comparison.Series, 4) {
+		return
+	}
+	assert.Equal(t, benchmarkPoint{Date: "2024-03-04"}, comparison.Series[0])
+
+	// The deposit doesn't count as a portfolio return
+	portfolioDaily := []float64{0.1, -0.1, 0.1}
+	benchmarkDaily := []float64{0.05, 0.5 * (108.0/110 - 1), 0.1}
+	assert.InDelta(t, 100*(1.1*0.9*1.1-1), *comparison.PortfolioReturnPercent, 1e-9)
+	benchmarkGrowth := (1 + benchmarkDaily[0]) * (1 + benchmarkDaily[1]) * (1 + benchmarkDaily[2])
+	assert.InDelta(t, 100*(benchmarkGrowth-1), *comparison.BenchmarkReturnPercent, 1e-9)
+	assert.InDelta(t, *comparison.PortfolioReturnPercent-*comparison.BenchmarkReturnPercent, *comparison.ExcessReturnPercent, 1e-9)
+
+	active := make([]float64, 3)
+	for i := range active {
+		active[i] = portfolioDaily[i] - benchmarkDaily[i]
+	}
+	trackingError := sampleStdDev(active) * math.Sqrt(tradingDaysPerYear)
+	assert.InDelta(t, 100*trackingError, *comparison.TrackingErrorPercent, 1e-9)
+	assert.InDelta(t, mean(active)*tradingDaysPerYear/trackingError, *comparison.InformationRatio, 1e-9)
+
+	upBenchmark := math.Sqrt(1.05*1.1) - 1
+	assert.InDelta(t, 100*0.1/upBenchmark, *comparison.UpCapturePercent, 1e-9)
+	assert.InDelta(t, 100*-0.1/benchmarkDaily[1], *comparison.DownCapturePercent, 1e-9)
+}
+
+// TestGetBenchmarkComparison tests the benchmark endpoint
+func TestGetBenchmarkComparison(t *testing.T) {
+	expectSnapshots := func(mock sqlmock.Sqlmock) {
+		rows := sqlmock.NewRows([]string{"snapshot_date", "total_value", "net_flow"})
+		for _, point := range benchmarkTestPoints() {
+			rows.AddRow(point.Date, point.Value, point.Flow)
+		}
+		mock.ExpectQuery(`SELECT snapshot_date, total_value, COALESCE\(net_flow, 0\) FROM portfolio_snapshots WHERE portfolio_id = \$1`).
+			WithArgs(testPortfolioID).
+			WillReturnRows(rows)
+	}
+	expectCloses := func(mock sqlmock.Sqlmock, closes closingPrices, symbols ...string) {
+		rows := sqlmock.NewRows([]string{"symbol", "date", "close_price"})
+		for _, symbol := range symbols {
+			for _, price := range closes[symbol] {
+				rows.AddRow(symbol, price.Date, price.Close)
+			}
+		}
+		mock.ExpectQuery(`SELECT a.symbol, ph.date, ph.close_price FROM price_history ph JOIN assets a ON ph.asset_id = a.id WHERE a.symbol = ANY\(\$1\) AND ph.date >= \$2 AND ph.date <= \$3`).
+			WithArgs(sqlmock.AnyArg(), "2024-03-04", "2024-03-08").
+			WillReturnRows(rows)
+	}
+	get := func(handler *Handler, target string) *httptest.ResponseRecorder {
+		router := createTestRouter(handler, "GET", "/analytics/benchmark", handler.GetBenchmarkComparison)
+		req, _ := http.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("configured benchmark", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		handler.services.Analytics.Benchmark = "SPY"
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		expectSnapshots(mock)
+		expectCloses(mock, benchmarkTestCloses(), "SPY")
+
+		w := get(handler, "/analytics/benchmark?period=since_inception")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"benchmark":[{"symbol":"SPY","weight":1}]`)
+		assert.Contains(t, w.Body.String(), `"observations":4`)
+		assert.Contains(t, w.Body.String(), `"start":"2024-03-04"`)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("blend without price history", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		expectSnapshots(mock)
+		expectCloses(mock, benchmarkTestCloses(), "SPY")
+
+		w := get(handler, "/analytics/benchmark?period=since_inception&benchmark=SPY:0.6,BND:0.4")
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Contains(t, w.Body.String(), "BND")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		w := get(handler, "/analytics/benchmark?benchmark=SPY:-1")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		w = get(handler, "/analytics/benchmark?period=2W")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
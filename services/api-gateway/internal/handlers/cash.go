@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Cash movements. They reference the CASH asset named by their currency code and never affect holdings.
+const (
+	transactionDeposit    = "DEPOSIT"
+	transactionWithdrawal = "WITHDRAWAL"
+	transactionInterest   = "INTEREST"
+	transactionFee        = "FEE"
+)
+
+// cashEffect is the change in cash of one transaction. Trades settle in the currency of their asset:
+// purchases draw on cash and sales credit it, with fees already netted into total_amount. Dividends
+// are paid net of withholding; a reinvested dividend only costs its fees.
+func cashEffect(transactionType string, totalAmount, fees float64) float64 {
+	switch transactionType {
+	case transactionDeposit, transactionInterest, transactionSell, transactionDividend:
+		return totalAmount
+	case transactionDividendReinvest:
+		return -fees
+	case transactionWithdrawal, transactionFee, transactionBuy:
+		return -totalAmount
+	}
+	return 0
+}
+
+// cashLedger is a portfolio's running cash balance in each currency, applied in ledger order
+type cashLedger map[string]float64
+
+// apply adds one transaction's cash effect and returns the money it moved in from outside: deposits and
+// withdrawals, and, since cash balances aren't enforced by default, the part of a purchase or fee the
+// cash didn't cover, which counts as paid in. Live balances and snapshots both apply this rule.
+func (l cashLedger) apply(currency, transactionType string, totalAmount, fees float64) float64 {
+	effect := cashEffect(transactionType, totalAmount, fees)
+	l[currency] += effect
+	switch {
+	case transactionType == transactionDeposit || transactionType == transactionWithdrawal:
+		return effect
+	case effect < 0 && l[currency] < 0:
+		flow := math.Min(-effect, -l[currency])
+		l[currency] += flow
+		return flow
+	}
+	return 0
+}
+
+// cashBalance is a portfolio's cash in one currency
+type cashBalance struct {
+	Currency string  `json:"currency"`
+	Balance  float64 `json:"balance"`
+}
+
+// isCashTransaction reports whether a transaction type only moves cash
+func isCashTransaction(transactionType string) bool {
+	switch transactionType {
+	case transactionDeposit, transactionWithdrawal, transactionInterest, transactionFee:
+		return true
+	}
+	return false
+}
+
+// Helper function to replay a portfolio's cash from its ledger, in every currency it has used or only
+// in currency when one is given
+func (h *Handler) loadCashLedger(q sqlQuerier, portfolioID, currency string) (cashLedger, error) {
+	query := `
+		SELECT COALESCE(a.currency, 'USD'), t.transaction_type, COALESCE(t.total_amount, 0), COALESCE(t.fees, 0)
+		FROM transactions t
+		JOIN assets a ON t.asset_id = a.id
+		WHERE t.portfolio_id = $1`
+	args := []interface{}{portfolioID}
+	if currency != "" {
+		query += ` AND COALESCE(a.currency, 'USD') = $2`
+		args = append(args, currency)
+	}
+	rows, err := q.Query(query+` ORDER BY t.transaction_date ASC`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cash ledger: %w", err)
+	}
+	defer rows.Close()
+
+	cash := cashLedger{}
+	for rows.Next() {
+		var entryCurrency, transactionType string
+		var totalAmount, fees float64
+		if err := rows.Scan(&entryCurrency, &transactionType, &totalAmount, &fees); err != nil {
+			return nil, fmt.Errorf("failed to scan cash ledger entry: %w", err)
+		}
+		cash.apply(entryCurrency, transactionType, totalAmount, fees)
+	}
+	return cash, rows.Err()
+}
+
+// Helper function to get a portfolio's cash balance in each currency it has used, and their total
+// converted into the portfolio's base currency at today's rates
+func (h *Handler) getCashBalances(q sqlQuerier, portfolioID string, fx *fxConverter) ([]cashBalance, float64, error) {
+	cash, err := h.loadCashLedger(q, portfolioID, "")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	balances := []cashBalance{}
+	var total float64
+	for currency, balance := range cash {
+		converted, err := fx.convert(balance, currency)
+		if err != nil {
+			return nil, 0, err
+		}
+		balances = append(balances, cashBalance{Currency: currency, Balance: balance})
+		total += converted
+	}
+	sort.Slice(balances, func(i, j int) bool { return balances[i].Currency < balances[j].Currency })
+
+	return balances, total, nil
+}
+
+// Helper function to get a portfolio's cash balance in one currency
+func (h *Handler) getCashBalance(q sqlQuerier, portfolioID, currency string) (float64, error) {
+	cash, err := h.loadCashLedger(q, portfolioID, currency)
+	if err != nil {
+		return 0, err
+	}
+	return cash[currency], nil
+}
+
+// Helper function to get the CASH asset for a currency, creating it if needed
+func (h *Handler) getCashAssetID(tx *sql.Tx, currency string) (string, error) {
+	var assetID string
+	err := tx.QueryRow("SELECT id FROM assets WHERE symbol = $1 AND asset_type = 'CASH'", currency).Scan(&assetID)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRow(`
+			INSERT INTO assets (symbol, name, asset_type, exchange, currency, sector)
+			VALUES ($1, $2, 'CASH', 'N/A', $1, 'Currency')
+			RETURNING id
+		`, currency, currency+" Cash").Scan(&assetID)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get cash asset: %w", err)
+	}
+	return assetID, nil
+}
+
+// Helper function to append a cash movement to the ledger; returns the new transaction's ID
+func (h *Handler) recordCashEntry(tx *sql.Tx, userID, portfolioID, cashAssetID, transactionType string, amount float64, notes string) (string, error) {
+	var transactionID string
+	err := tx.QueryRow(`
+		INSERT INTO transactions (user_id, portfolio_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes)
+		VALUES ($1, $2, $3, $4, $5, 1, 0, $5, $6)
+		RETURNING id
+	`, userID, portfolioID, cashAssetID, transactionType, amount, notes).Scan(&transactionID)
+	if err != nil {
+		return "", fmt.Errorf("failed to insert cash transaction: %w", err)
+	}
+	if err := h.invalidateSnapshots(tx, portfolioID, time.Now()); err != nil {
+		return "", err
+	}
+	return transactionID, nil
+}
+
+// Helper function to check whether a portfolio's cash covers spending amount in the currency of assetID.
+// Portfolios that don't enforce their cash balance are always covered.
+func (h *Handler) cashCovers(tx *sql.Tx, portfolioID, assetID string, amount float64) (bool, float64, string, error) {
+	var enforce bool
+	err := tx.QueryRow("SELECT enforce_cash_balance FROM portfolios WHERE id = $1", portfolioID).Scan(&enforce)
+	if err != nil {
+		return false, 0, "", fmt.Errorf("failed to get portfolio cash rule: %w", err)
+	}
+	if !enforce {
+		return true, 0, "", nil
+	}
+
+	var currency string
+	err = tx.QueryRow("SELECT COALESCE(currency, 'USD') FROM assets WHERE id = $1", assetID).Scan(&currency)
+	if err != nil {
+		return false, 0, "", fmt.Errorf("failed to get asset currency: %w", err)
+	}
+
+	balance, err := h.getCashBalance(tx, portfolioID, currency)
+	if err != nil {
+		return false, 0, "", err
+	}
+	return balance+holdingTolerance >= amount, balance, currency, nil
+}
+
+// Helper function to record the deposit that pays for a holding added directly, so adding it leaves cash unchanged
+func (h *Handler) fundHolding(tx *sql.Tx, userID, portfolioID, assetID string, amount float64) error {
+	var currency string
+	err := tx.QueryRow("SELECT COALESCE(currency, 'USD') FROM assets WHERE id = $1", assetID).Scan(&currency)
+	if err != nil {
+		return fmt.Errorf("failed to get asset currency: %w", err)
+	}
+
+	cashAssetID, err := h.getCashAssetID(tx, currency)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.recordCashEntry(tx, userID, portfolioID, cashAssetID, transactionDeposit, amount, "Funding for holding added directly")
+	return err
+}
+
+// createCashTransaction records a DEPOSIT, WITHDRAWAL, INTEREST or FEE for CreateTransaction.
+// The currency defaults to the portfolio's base currency.
+func (h *Handler) createCashTransaction(c *gin.Context, userID, portfolioID, transactionType string, amount float64, currency, notes string) {
+	tx, err := h.services.DB.Begin()
+	if err != nil {
+		h.logger.Error("Failed to begin transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	currency = strings.ToUpper(currency)
+	if currency == "" {
+		err = tx.QueryRow("SELECT base_currency FROM portfolios WHERE id = $1", portfolioID).Scan(&currency)
+		if err != nil {
+			h.logger.Error("Failed to get portfolio currency", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create transaction"})
+			return
+		}
+	}
+
+	cashAssetID, err := h.getCashAssetID(tx, currency)
+	if err != nil {
+		h.logger.Error("Failed to get cash asset", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create transaction"})
+		return
+	}
+
+	// Withdrawals are held to the same rule as purchases; fees and interest are charged regardless
+	if transactionType == transactionWithdrawal {
+		covered, balance, _, err := h.cashCovers(tx, portfolioID, cashAssetID, amount)
+		if err != nil {
+			h.logger.Error("Failed to check cash balance", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create transaction"})
+			return
+		}
+		if !covered {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":        "Insufficient cash for withdrawal",
+				"currency":     currency,
+				"cash_balance": balance,
+			})
+			return
+		}
+	}
+
+	transactionID, err := h.recordCashEntry(tx, userID, portfolioID, cashAssetID, transactionType, amount, notes)
+	if err != nil {
+		h.logger.Error("Failed to insert transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create transaction"})
+		return
+	}
+
+	balance, err := h.getCashBalance(tx, portfolioID, currency)
+	if err != nil {
+		h.logger.Error("Failed to get cash balance", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create transaction"})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		h.logger.Error("Failed to commit transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create transaction"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":        "Transaction created successfully",
+		"transaction_id": transactionID,
+		"portfolio_id":   portfolioID,
+		"type":           transactionType,
+		"currency":       currency,
+		"amount":         amount,
+		"total_amount":   amount,
+		"cash_balance":   balance,
+	})
+
+	go h.broadcastPortfolioUpdate(userID, portfolioID)
+}
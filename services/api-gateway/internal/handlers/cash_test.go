@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// newCashLedgerRows returns the columns of the cash ledger query
+func newCashLedgerRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"currency", "transaction_type", "total_amount", "fees"})
+}
+
+// cashBalanceRows builds cash ledger rows that leave each currency with the balance it's added with
+type cashBalanceRows struct {
+	*sqlmock.Rows
+}
+
+// newCashBalanceRows returns an empty set of cash balances
+func newCashBalanceRows() cashBalanceRows {
+	return cashBalanceRows{newCashLedgerRows()}
+}
+
+// AddRow adds a currency's balance, as a deposit or, when negative, a withdrawal
+func (r cashBalanceRows) AddRow(currency string, balance float64) cashBalanceRows {
+	if balance < 0 {
+		r.Rows.AddRow(currency, "WITHDRAWAL", -balance, 0.0)
+	} else {
+		r.Rows.AddRow(currency, "DEPOSIT", balance, 0.0)
+	}
+	return r
+}
+
+// expectCashLedger expects a portfolio's cash ledger to be read, in one currency when currency is set
+func expectCashLedger(mock sqlmock.Sqlmock, portfolioID, currency string, rows *sqlmock.Rows) {
+	if currency == "" {
+		mock.ExpectQuery(`SELECT COALESCE\(a.currency, 'USD'\), t.transaction_type, (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.portfolio_id = \$1 ORDER BY t.transaction_date`).
+			WithArgs(portfolioID).
+			WillReturnRows(rows)
+		return
+	}
+	mock.ExpectQuery(`SELECT COALESCE\(a.currency, 'USD'\), t.transaction_type, (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.portfolio_id = \$1 AND COALESCE\(a.currency, 'USD'\) = \$2 ORDER BY t.transaction_date`).
+		WithArgs(portfolioID, currency).
+		WillReturnRows(rows)
+}
+
+// expectCashBalances expects a portfolio's cash balances to be read
+func expectCashBalances(mock sqlmock.Sqlmock, portfolioID string, rows cashBalanceRows) {
+	expectCashLedger(mock, portfolioID, "", rows.Rows)
+}
+
+// expectCashBalance expects a portfolio's cash balance in one currency to be read
+func expectCashBalance(mock sqlmock.Sqlmock, portfolioID, currency string, balance float64) {
+	expectCashLedger(mock, portfolioID, currency, newCashBalanceRows().AddRow(currency, balance).Rows)
+}
+
+// expectCashRule expects the portfolio's cash rule to be checked
+func expectCashRule(mock sqlmock.Sqlmock, portfolioID string, enforce bool) {
+	mock.ExpectQuery(`SELECT enforce_cash_balance FROM portfolios WHERE id = \$1`).
+		WithArgs(portfolioID).
+		WillReturnRows(sqlmock.NewRows([]string{"enforce_cash_balance"}).AddRow(enforce))
+}
+
+// expectCashEntry expects a cash movement to be recorded against the USD cash asset
+func expectCashEntry(mock sqlmock.Sqlmock, userID, portfolioID, transactionType string, amount float64, notes string) {
+	mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = \$1 AND asset_type = 'CASH'`).
+		WithArgs("USD").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("cash-usd"))
+	mock.ExpectQuery(`INSERT INTO transactions \(user_id, portfolio_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes\) VALUES \(\$1, \$2, \$3, \$4, \$5, 1, 0, \$5, \$6\) RETURNING id`).
+		WithArgs(userID, portfolioID, "cash-usd", transactionType, amount, notes).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("cash-tx"))
+	expectSnapshotInvalidation(mock, portfolioID, sqlmock.AnyArg())
+}
+
+// expectFundingDeposit expects a holding added directly to be funded by a USD deposit
+func expectFundingDeposit(mock sqlmock.Sqlmock, userID, portfolioID, assetID string, amount float64) {
+	mock.ExpectQuery(`SELECT COALESCE\(currency, 'USD'\) FROM assets WHERE id = \$1`).
+		WithArgs(assetID).
+		WillReturnRows(sqlmock.NewRows([]string{"currency"}).AddRow("USD"))
+	expectCashEntry(mock, userID, portfolioID, "DEPOSIT", amount, "Funding for holding added directly")
+}
+
+// TestCreateTransaction_Cash tests deposits, withdrawals and the cash rule on purchases
+func TestCreateTransaction_Cash(t *testing.T) {
+	tests := []struct {
+		name           string
+		requestBody    string
+		setupMock      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedBody   []string
+	}{
+		{
+			name:        "deposit in the portfolio's base currency",
+			requestBody: `{"transaction_type": "DEPOSIT", "amount": 1000, "notes": "Payday"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT base_currency FROM portfolios WHERE id = \$1`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"base_currency"}).AddRow("USD"))
+				expectCashEntry(mock, testUserID, testPortfolioID, "DEPOSIT", 1000.0, "Payday")
+				expectCashBalance(mock, testPortfolioID, "USD", 1500.0)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+			expectedBody:   []string{"cash-tx", `"type":"DEPOSIT"`, `"currency":"USD"`, `"cash_balance":1500`},
+		},
+		{
+			name:        "cash asset is created for a new currency",
+			requestBody: `{"transaction_type": "INTEREST", "amount": 12.5, "currency": "eur"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = \$1 AND asset_type = 'CASH'`).
+					WithArgs("EUR").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectQuery(`INSERT INTO assets \(symbol, name, asset_type, exchange, currency, sector\) VALUES \(\$1, \$2, 'CASH', 'N/A', \$1, 'Currency'\) RETURNING id`).
+					WithArgs("EUR", "EUR Cash").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("cash-eur"))
+				mock.ExpectQuery(`INSERT INTO transactions`).
+					WithArgs(testUserID, testPortfolioID, "cash-eur", "INTEREST", 12.5, "").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("cash-tx"))
+				expectSnapshotInvalidation(mock, testPortfolioID, sqlmock.AnyArg())
+				expectCashBalance(mock, testPortfolioID, "EUR", 12.5)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+			expectedBody:   []string{`"currency":"EUR"`, `"cash_balance":12.5`},
+		},
+		{
+			name:        "withdrawal the enforced balance can't cover",
+			requestBody: `{"transaction_type": "WITHDRAWAL", "amount": 500, "currency": "USD"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = \$1 AND asset_type = 'CASH'`).
+					WithArgs("USD").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("cash-usd"))
+				expectCashRule(mock, testPortfolioID, true)
+				mock.ExpectQuery(`SELECT COALESCE\(currency, 'USD'\) FROM assets WHERE id = \$1`).
+					WithArgs("cash-usd").
+					WillReturnRows(sqlmock.NewRows([]string{"currency"}).AddRow("USD"))
+				expectCashBalance(mock, testPortfolioID, "USD", 200.0)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"Insufficient cash for withdrawal", `"cash_balance":200`},
+		},
+		{
+			name:        "fee the cash can't cover counts as paid in",
+			requestBody: `{"transaction_type": "FEE", "amount": 25, "currency": "USD", "notes": "Custody fee"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				mock.ExpectBegin()
+				expectCashEntry(mock, testUserID, testPortfolioID, "FEE", 25.0, "Custody fee")
+				expectCashLedger(mock, testPortfolioID, "USD", newCashLedgerRows().
+					AddRow("USD", "DEPOSIT", 20.0, 0.0).
+					AddRow("USD", "FEE", 25.0, 0.0))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+			expectedBody:   []string{`"type":"FEE"`, `"cash_balance":0`},
+		},
+		{
+			name:        "purchase the enforced balance can't cover",
+			requestBody: `{"symbol": "AAPL", "transaction_type": "BUY", "quantity": 10, "price": 150, "fees": 1}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = \$1`).
+					WithArgs("AAPL").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testAssetID))
+				mock.ExpectBegin()
+				expectCashRule(mock, testPortfolioID, true)
+				mock.ExpectQuery(`SELECT COALESCE\(currency, 'USD'\) FROM assets WHERE id = \$1`).
+					WithArgs(testAssetID).
+					WillReturnRows(sqlmock.NewRows([]string{"currency"}).AddRow("USD"))
+				expectCashBalance(mock, testPortfolioID, "USD", 1000.0)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"Insufficient cash to cover purchase", `"cash_balance":1000`, `"total_amount":1501`},
+		},
+		{
+			name:        "cash check failure",
+			requestBody: `{"symbol": "AAPL", "transaction_type": "BUY", "quantity": 10, "price": 150}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = \$1`).
+					WithArgs("AAPL").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testAssetID))
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT enforce_cash_balance FROM portfolios WHERE id = \$1`).
+					WithArgs(testPortfolioID).
+					WillReturnError(fmt.Errorf("database error"))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody:   []string{"Failed to process buy transaction"},
+		},
+		{
+			name:           "cash movement without an amount",
+			requestBody:    `{"transaction_type": "DEPOSIT"}`,
+			setupMock:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"Amount is required for DEPOSIT transactions"},
+		},
+		{
+			name:           "cash movement with lot selection",
+			requestBody:    `{"transaction_type": "WITHDRAWAL", "amount": 100, "cost_basis_method": "FIFO"}`,
+			setupMock:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"only apply to SELL transactions"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock, cleanup := createTestHandler(t)
+			defer cleanup()
+
+			tt.setupMock(mock)
+
+			router := createTestRouter(handler, "POST", "/transactions", handler.CreateTransaction)
+
+			req, _ := http.NewRequest("POST", "/transactions", strings.NewReader(tt.requestBody))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			for _, expected := range tt.expectedBody {
+				assert.Contains(t, w.Body.String(), expected)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
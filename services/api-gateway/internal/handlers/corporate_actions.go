@@ -0,0 +1,731 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// Corporate action types. A split's ratio is the number of new shares per old share; a spin-off's or
+// merger's is the number of shares of the new asset received per share held.
+const (
+	corporateActionSplit        = "SPLIT"
+	corporateActionReverseSplit = "REVERSE_SPLIT"
+	corporateActionSymbolChange = "SYMBOL_CHANGE"
+	corporateActionSpinoff      = "SPINOFF"
+	corporateActionMerger       = "MERGER"
+)
+
+// Corporate action statuses
+const (
+	corporateActionApplied  = "APPLIED"
+	corporateActionReversed = "REVERSED"
+)
+
+// splitRestatedTypes are the position entries a split restates in post-split shares
+var splitRestatedTypes = []string{
+	transactionBuy, transactionSell, transactionAdjust, transactionDividendReinvest,
+	transactionTransferIn, transactionTransferOut,
+}
+
+// corporateAction is a recorded corporate action. Adjustments counts the rows a split restated and
+// Entries the ledger entries a spin-off or merger wrote.
+type corporateAction struct {
+	ID             string     `json:"id"`
+	AssetID        string     `json:"asset_id"`
+	Symbol         string     `json:"symbol"`
+	ActionType     string     `json:"action_type"`
+	EffectiveDate  string     `json:"effective_date"`
+	Ratio          *float64   `json:"ratio,omitempty"`
+	NewAssetID     *string    `json:"new_asset_id,omitempty"`
+	OldSymbol      *string    `json:"old_symbol,omitempty"`
+	NewSymbol      *string    `json:"new_symbol,omitempty"`
+	CostAllocation *float64   `json:"cost_allocation,omitempty"`
+	Notes          string     `json:"notes"`
+	Status         string     `json:"status"`
+	Adjustments    int        `json:"adjustments"`
+	Entries        int        `json:"entries"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ReversedAt     *time.Time `json:"reversed_at,omitempty"`
+}
+
+// ledgerScope is one asset of one portfolio whose holdings must be rebuilt
+type ledgerScope struct {
+	UserID      string
+	PortfolioID string
+	AssetID     string
+}
+
+// Helper function to list the portfolios with transactions in assetID, as scopes of that asset
+func (h *Handler) assetScopes(tx *sql.Tx, assetID string) ([]ledgerScope, error) {
+	rows, err := tx.Query(`
+		SELECT DISTINCT p.user_id, t.portfolio_id
+		FROM transactions t
+		JOIN portfolios p ON t.portfolio_id = p.id
+		WHERE t.asset_id = $1
+		ORDER BY t.portfolio_id
+	`, assetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query portfolios holding asset: %w", err)
+	}
+	defer rows.Close()
+
+	var scopes []ledgerScope
+	for rows.Next() {
+		scope := ledgerScope{AssetID: assetID}
+		if err := rows.Scan(&scope.UserID, &scope.PortfolioID); err != nil {
+			return nil, fmt.Errorf("failed to scan portfolio: %w", err)
+		}
+		scopes = append(scopes, scope)
+	}
+
+	return scopes, rows.Err()
+}
+
+// Helper function to check whether an applied corporate action on any of assetIDs takes effect after
+// the given one. Actions are applied and reversed in date order, since each was computed from the
+// history the earlier ones left behind.
+func (h *Handler) hasLaterCorporateAction(tx *sql.Tx, actionID string, assetIDs []string, effectiveDate, createdAt time.Time) (bool, error) {
+	var exists bool
+	err := tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM corporate_actions
+			WHERE status = 'APPLIED' AND id <> $1
+				AND (asset_id = ANY($2) OR new_asset_id = ANY($2))
+				AND (effective_date, created_at) > ($3, $4)
+		)
+	`, actionID, pq.Array(assetIDs), effectiveDate, createdAt).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check later corporate actions: %w", err)
+	}
+	return exists, nil
+}
+
+// Helper function to scale the history of an asset before a split by its ratio: quantities are
+// multiplied and prices divided, so amounts don't change. Every restated row is recorded in
+// corporate_action_adjustments, which is also what a reversal undoes. Returns the number of
+// transactions and prices restated.
+func (h *Handler) restateSplit(tx *sql.Tx, actionID, assetID string, effectiveDate time.Time, ratio float64) (int64, int64, error) {
+	result, err := tx.Exec(`
+		WITH restated AS (
+			UPDATE transactions
+			SET quantity = quantity * $1, price = price / $1
+			WHERE asset_id = $2 AND transaction_date < $3 AND transaction_type = ANY($4)
+			RETURNING id, quantity, price
+		)
+		INSERT INTO corporate_action_adjustments (corporate_action_id, table_name, row_id, quantity_before, quantity_after, price_before, price_after)
+		SELECT $5, 'transactions', id, quantity / $1, quantity, price * $1, price FROM restated
+	`, ratio, assetID, effectiveDate, pq.Array(splitRestatedTypes), actionID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to restate transactions: %w", err)
+	}
+	transactions, err := result.RowsAffected()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to restate transactions: %w", err)
+	}
+
+	result, err = tx.Exec(`
+		WITH restated AS (
+			UPDATE price_history
+			SET open_price = open_price / $1, high_price = high_price / $1, low_price = low_price / $1,
+				close_price = close_price / $1, volume = ROUND(volume * $1)
+			WHERE asset_id = $2 AND date < $3
+			RETURNING id, volume, close_price
+		)
+		INSERT INTO corporate_action_adjustments (corporate_action_id, table_name, row_id, quantity_before, quantity_after, price_before, price_after)
+		SELECT $4, 'price_history', id, volume / $1, volume, close_price * $1, close_price FROM restated
+	`, ratio, assetID, effectiveDate, actionID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to restate price history: %w", err)
+	}
+	prices, err := result.RowsAffected()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to restate price history: %w", err)
+	}
+
+	return transactions, prices, nil
+}
+
+// Helper function to undo restateSplit on the rows it recorded. Transactions are divided by the ratio
+// they were multiplied by, keeping any edits since. Prices go back to the close and volume recorded
+// before the split, which candle ingestion keeps up to date when it restates a day again.
+func (h *Handler) unrestateSplit(tx *sql.Tx, actionID string, ratio float64) (int64, int64, error) {
+	result, err := tx.Exec(`
+		UPDATE transactions
+		SET quantity = quantity / $1, price = price * $1
+		WHERE id IN (
+			SELECT row_id FROM corporate_action_adjustments
+			WHERE corporate_action_id = $2 AND table_name = 'transactions'
+		)
+	`, ratio, actionID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to restore transactions: %w", err)
+	}
+	transactions, err := result.RowsAffected()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to restore transactions: %w", err)
+	}
+
+	result, err = tx.Exec(`
+		UPDATE price_history ph
+		SET open_price = ph.open_price * $1, high_price = ph.high_price * $1, low_price = ph.low_price * $1,
+			close_price = caa.price_before, volume = ROUND(caa.quantity_before)
+		FROM corporate_action_adjustments caa
+		WHERE caa.corporate_action_id = $2 AND caa.table_name = 'price_history' AND caa.row_id = ph.id
+	`, ratio, actionID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to restore price history: %w", err)
+	}
+	prices, err := result.RowsAffected()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to restore price history: %w", err)
+	}
+
+	return transactions, prices, nil
+}
+
+// Helper function to write the ledger entries of a spin-off or merger for every portfolio that held
+// assetID before the effective date. Each open lot moves to the new asset at ratio shares per share,
+// keeping its cost basis (a merger) or costAllocation of it (a spin-off, which leaves the rest with the
+// parent). Received lots keep the acquisition date of the lot they came from, so their holding period
+// carries over. Returns the number of entries written
+// and the holdings to rebuild.
+func (h *Handler) transferPositions(tx *sql.Tx, actionID, actionType, assetID, newAssetID string, effectiveDate time.Time, ratio, costAllocation float64, notes string) (int, []ledgerScope, error) {
+	portfolios, err := h.assetScopes(tx, assetID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	insertEntry := func(scope ledgerScope, entryAssetID, transactionType string, quantity, price float64, acquiredAt sql.NullTime) error {
+		_, err := tx.Exec(`
+			INSERT INTO transactions (user_id, portfolio_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes, transaction_date, corporate_action_id, acquired_at)
+			VALUES ($1, $2, $3, $4, $5, $6, 0, $7, $8, $9, $10, $11)
+		`, scope.UserID, scope.PortfolioID, entryAssetID, transactionType, quantity, price, quantity*price, notes, effectiveDate, actionID, acquiredAt)
+		if err != nil {
+			return fmt.Errorf("failed to insert corporate action entry: %w", err)
+		}
+		return nil
+	}
+
+	var entries int
+	var scopes []ledgerScope
+	for _, portfolio := range portfolios {
+		ledger, err := h.loadLedger(tx, portfolio.PortfolioID, assetID)
+		if err != nil {
+			return 0, nil, err
+		}
+		var before []ledgerEntry
+		for _, entry := range ledger {
+			if entry.Date.Before(effectiveDate) {
+				before = append(before, entry)
+			}
+		}
+		state, err := replayLedger(before)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		var held float64
+		for _, lot := range state.Lots {
+			if lot.RemainingQuantity < lotQuantityEpsilon {
+				continue
+			}
+			costBasis := lot.RemainingQuantity * lot.UnitCost
+			if lot.Quantity > 0 {
+				costBasis += lot.Fees * lot.RemainingQuantity / lot.Quantity
+			}
+			if actionType == corporateActionSpinoff {
+				costBasis *= costAllocation
+			}
+			received := lot.RemainingQuantity * ratio
+			if err := insertEntry(portfolio, newAssetID, transactionTransferIn, received, costBasis/received, sql.NullTime{Time: lot.AcquiredAt, Valid: true}); err != nil {
+				return 0, nil, err
+			}
+			held += lot.RemainingQuantity
+			entries++
+		}
+		if held == 0 {
+			continue
+		}
+
+		if actionType == corporateActionMerger {
+			err = insertEntry(portfolio, assetID, transactionTransferOut, held, 0, sql.NullTime{})
+		} else {
+			err = insertEntry(portfolio, assetID, transactionCostAdjust, 0, 1-costAllocation, sql.NullTime{})
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		entries++
+
+		parent, child := portfolio, portfolio
+		child.AssetID = newAssetID
+		scopes = append(scopes, parent, child)
+	}
+
+	return entries, scopes, nil
+}
+
+// Helper function to rebuild the holdings of every scope, stopping at the first that fails to replay
+func (h *Handler) rebuildScopes(tx *sql.Tx, scopes []ledgerScope) error {
+	for _, scope := range scopes {
+		if _, _, err := h.rebuildHoldings(tx, scope.UserID, scope.PortfolioID, scope.AssetID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Helper function to invalidate the snapshots of each portfolio in scopes from the effective date
+func (h *Handler) invalidateScopes(tx *sql.Tx, scopes []ledgerScope, effectiveDate time.Time) error {
+	seen := make(map[string]bool)
+	for _, scope := range scopes {
+		if seen[scope.PortfolioID] {
+			continue
+		}
+		seen[scope.PortfolioID] = true
+		if err := h.invalidateSnapshots(tx, scope.PortfolioID, effectiveDate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Helper function to broadcast an update to each portfolio in scopes once
+func (h *Handler) broadcastScopes(scopes []ledgerScope) {
+	seen := make(map[string]bool)
+	for _, scope := range scopes {
+		if seen[scope.PortfolioID] {
+			continue
+		}
+		seen[scope.PortfolioID] = true
+		h.broadcastPortfolioUpdate(scope.UserID, scope.PortfolioID)
+	}
+}
+
+// CreateCorporateAction records a corporate action on an asset and applies it to every portfolio
+func (h *Handler) CreateCorporateAction(c *gin.Context) {
+	var request struct {
+		Symbol         string  `json:"symbol" binding:"required"`
+		ActionType     string  `json:"action_type" binding:"required,oneof=SPLIT REVERSE_SPLIT SYMBOL_CHANGE SPINOFF MERGER"`
+		EffectiveDate  string  `json:"effective_date" binding:"required"`
+		Ratio          float64 `json:"ratio" binding:"omitempty,gt=0"`
+		NewSymbol      string  `json:"new_symbol"`
+		CostAllocation float64 `json:"cost_allocation" binding:"omitempty,gt=0,lt=1"`
+		Notes          string  `json:"notes"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	effectiveDate, err := time.Parse("2006-01-02", request.EffectiveDate)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "effective_date must be formatted as YYYY-MM-DD"})
+		return
+	}
+
+	request.Symbol = strings.ToUpper(request.Symbol)
+	request.NewSymbol = strings.ToUpper(request.NewSymbol)
+
+	var invalid string
+	switch request.ActionType {
+	case corporateActionSplit:
+		if request.Ratio <= 1 {
+			invalid = "A SPLIT needs a ratio greater than 1 (new shares per old share)"
+		}
+	case corporateActionReverseSplit:
+		if request.Ratio == 0 || request.Ratio >= 1 {
+			invalid = "A REVERSE_SPLIT needs a ratio between 0 and 1 (new shares per old share)"
+		}
+	case corporateActionSymbolChange:
+		if request.NewSymbol == "" {
+			invalid = "A SYMBOL_CHANGE needs a new_symbol"
+		}
+	case corporateActionSpinoff:
+		if request.NewSymbol == "" || request.Ratio == 0 || request.CostAllocation == 0 {
+			invalid = "A SPINOFF needs the new_symbol spun off, its ratio and the cost_allocation it takes"
+		}
+	case corporateActionMerger:
+		if request.NewSymbol == "" || request.Ratio == 0 {
+			invalid = "A MERGER needs the acquirer's new_symbol and a ratio"
+		}
+	}
+	if invalid == "" && request.NewSymbol == request.Symbol {
+		invalid = "new_symbol must differ from symbol"
+	}
+	if invalid != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": invalid})
+		return
+	}
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply corporate action"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	tx, err := h.services.DB.Begin()
+	if err != nil {
+		h.logger.Error("Failed to begin transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply corporate action"})
+		return
+	}
+	defer tx.Rollback()
+
+	var assetID string
+	err = tx.QueryRow("SELECT id FROM assets WHERE symbol = $1", request.Symbol).Scan(&assetID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Asset not found"})
+			return
+		}
+		h.logger.Error("Failed to get asset", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply corporate action"})
+		return
+	}
+
+	action := corporateAction{
+		AssetID:       assetID,
+		Symbol:        request.Symbol,
+		ActionType:    request.ActionType,
+		EffectiveDate: request.EffectiveDate,
+		Notes:         request.Notes,
+		Status:        corporateActionApplied,
+	}
+	if request.Ratio > 0 {
+		action.Ratio = &request.Ratio
+	}
+	if request.CostAllocation > 0 {
+		action.CostAllocation = &request.CostAllocation
+	}
+	if request.NewSymbol != "" {
+		action.NewSymbol = &request.NewSymbol
+	}
+	involved := []string{assetID}
+
+	// A new symbol must be free; a spun-off or acquiring asset is created like its parent if needed
+	if request.NewSymbol != "" {
+		var newAssetID string
+		err = tx.QueryRow("SELECT id FROM assets WHERE symbol = $1", request.NewSymbol).Scan(&newAssetID)
+		switch {
+		case err == nil && request.ActionType == corporateActionSymbolChange:
+			c.JSON(http.StatusConflict, gin.H{"error": "Symbol " + request.NewSymbol + " is already in use"})
+			return
+		case err == sql.ErrNoRows && request.ActionType != corporateActionSymbolChange:
+			err = tx.QueryRow(`
+				INSERT INTO assets (symbol, name, asset_type, exchange, currency, sector)
+				SELECT $1, $1, asset_type, exchange, currency, sector FROM assets WHERE id = $2
+				RETURNING id
+			`, request.NewSymbol, assetID).Scan(&newAssetID)
+		case err == sql.ErrNoRows:
+			err = nil
+		}
+		if err != nil {
+			h.logger.Error("Failed to get new asset", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply corporate action"})
+			return
+		}
+		if newAssetID != "" {
+			action.NewAssetID = &newAssetID
+			involved = append(involved, newAssetID)
+		}
+	}
+	if request.ActionType == corporateActionSymbolChange {
+		action.OldSymbol = &request.Symbol
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO corporate_actions (asset_id, action_type, effective_date, ratio, new_asset_id, old_symbol, new_symbol, cost_allocation, notes, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id, created_at
+	`, assetID, request.ActionType, effectiveDate, action.Ratio, action.NewAssetID, action.OldSymbol, action.NewSymbol,
+		action.CostAllocation, request.Notes, userID).Scan(&action.ID, &action.CreatedAt)
+	if err != nil {
+		h.logger.Error("Failed to insert corporate action", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply corporate action"})
+		return
+	}
+
+	later, err := h.hasLaterCorporateAction(tx, action.ID, involved, effectiveDate, action.CreatedAt)
+	if err != nil {
+		h.logger.Error("Failed to check corporate actions", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply corporate action"})
+		return
+	}
+	if later {
+		c.JSON(http.StatusConflict, gin.H{"error": "A later corporate action on this asset is applied; reverse it first"})
+		return
+	}
+
+	var transactionsRestated, pricesRestated int64
+	var scopes []ledgerScope
+	switch request.ActionType {
+	case corporateActionSplit, corporateActionReverseSplit:
+		transactionsRestated, pricesRestated, err = h.restateSplit(tx, action.ID, assetID, effectiveDate, request.Ratio)
+		if err == nil {
+			scopes, err = h.assetScopes(tx, assetID)
+		}
+		action.Adjustments = int(transactionsRestated + pricesRestated)
+	case corporateActionSymbolChange:
+		_, err = tx.Exec("UPDATE assets SET symbol = $1, updated_at = NOW() WHERE id = $2", request.NewSymbol, assetID)
+	default:
+		action.Entries, scopes, err = h.transferPositions(tx, action.ID, request.ActionType, assetID, *action.NewAssetID,
+			effectiveDate, request.Ratio, request.CostAllocation, request.Notes)
+	}
+	if err == nil {
+		err = h.rebuildScopes(tx, scopes)
+	}
+	if err == nil {
+		err = h.invalidateScopes(tx, scopes, effectiveDate)
+	}
+	if err != nil {
+		h.respondLedgerError(c, err, "Failed to apply corporate action")
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		h.logger.Error("Failed to commit transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply corporate action"})
+		return
+	}
+
+	h.logger.Info("Applied corporate action",
+		zap.String("corporate_action_id", action.ID), zap.String("symbol", request.Symbol),
+		zap.String("action_type", request.ActionType), zap.Int("holdings_rebuilt", len(scopes)))
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":               "Corporate action applied",
+		"corporate_action":      action,
+		"transactions_restated": transactionsRestated,
+		"prices_restated":       pricesRestated,
+		"entries_created":       action.Entries,
+		"holdings_rebuilt":      len(scopes),
+	})
+
+	go h.broadcastScopes(scopes)
+}
+
+// ReverseCorporateAction undoes an applied corporate action, keeping its record and audit trail
+func (h *Handler) ReverseCorporateAction(c *gin.Context) {
+	actionID := c.Param("id")
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reverse corporate action"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	tx, err := h.services.DB.Begin()
+	if err != nil {
+		h.logger.Error("Failed to begin transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reverse corporate action"})
+		return
+	}
+	defer tx.Rollback()
+
+	var assetID, actionType, status string
+	var newAssetID, oldSymbol sql.NullString
+	var ratio sql.NullFloat64
+	var effectiveDate, createdAt time.Time
+	err = tx.QueryRow(`
+		SELECT asset_id, action_type, ratio, new_asset_id, old_symbol, status, effective_date, created_at
+		FROM corporate_actions
+		WHERE id = $1
+		FOR UPDATE
+	`, actionID).Scan(&assetID, &actionType, &ratio, &newAssetID, &oldSymbol, &status, &effectiveDate, &createdAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Corporate action not found"})
+			return
+		}
+		h.logger.Error("Failed to get corporate action", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reverse corporate action"})
+		return
+	}
+
+	if status == corporateActionReversed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Corporate action is already reversed"})
+		return
+	}
+
+	involved := []string{assetID}
+	if newAssetID.Valid {
+		involved = append(involved, newAssetID.String)
+	}
+	later, err := h.hasLaterCorporateAction(tx, actionID, involved, effectiveDate, createdAt)
+	if err != nil {
+		h.logger.Error("Failed to check corporate actions", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reverse corporate action"})
+		return
+	}
+	if later {
+		c.JSON(http.StatusConflict, gin.H{"error": "A later corporate action on this asset is applied; reverse it first"})
+		return
+	}
+
+	var transactionsRestored, pricesRestored int64
+	var entriesRemoved int
+	var scopes []ledgerScope
+	switch actionType {
+	case corporateActionSplit, corporateActionReverseSplit:
+		transactionsRestored, pricesRestored, err = h.unrestateSplit(tx, actionID, ratio.Float64)
+		if err == nil {
+			scopes, err = h.assetScopes(tx, assetID)
+		}
+	case corporateActionSymbolChange:
+		var taken bool
+		err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM assets WHERE symbol = $1 AND id <> $2)", oldSymbol.String, assetID).Scan(&taken)
+		if err == nil && taken {
+			c.JSON(http.StatusConflict, gin.H{"error": "Symbol " + oldSymbol.String + " is now used by another asset"})
+			return
+		}
+		if err == nil {
+			_, err = tx.Exec("UPDATE assets SET symbol = $1, updated_at = NOW() WHERE id = $2", oldSymbol.String, assetID)
+		}
+	default:
+		// Removing the entries the action wrote and replaying restores both assets
+		var rows *sql.Rows
+		rows, err = tx.Query(`
+			DELETE FROM transactions t
+			USING portfolios p
+			WHERE t.portfolio_id = p.id AND t.corporate_action_id = $1
+			RETURNING p.user_id, t.portfolio_id, t.asset_id
+		`, actionID)
+		if err == nil {
+			seen := make(map[ledgerScope]bool)
+			for rows.Next() {
+				var scope ledgerScope
+				if err = rows.Scan(&scope.UserID, &scope.PortfolioID, &scope.AssetID); err != nil {
+					break
+				}
+				entriesRemoved++
+				if !seen[scope] {
+					seen[scope] = true
+					scopes = append(scopes, scope)
+				}
+			}
+			rows.Close()
+		}
+	}
+	if err == nil {
+		err = h.rebuildScopes(tx, scopes)
+	}
+	if err == nil {
+		err = h.invalidateScopes(tx, scopes, effectiveDate)
+	}
+	if err != nil {
+		h.respondLedgerError(c, err, "Failed to reverse corporate action")
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE corporate_actions
+		SET status = 'REVERSED', reversed_at = NOW(), reversed_by = $1
+		WHERE id = $2
+	`, userID, actionID)
+	if err != nil {
+		h.logger.Error("Failed to update corporate action", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reverse corporate action"})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		h.logger.Error("Failed to commit transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reverse corporate action"})
+		return
+	}
+
+	h.logger.Info("Reversed corporate action",
+		zap.String("corporate_action_id", actionID), zap.Int("holdings_rebuilt", len(scopes)))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":               "Corporate action reversed",
+		"corporate_action_id":   actionID,
+		"transactions_restored": transactionsRestored,
+		"prices_restored":       pricesRestored,
+		"entries_removed":       entriesRemoved,
+		"holdings_rebuilt":      len(scopes),
+	})
+
+	go h.broadcastScopes(scopes)
+}
+
+// GetCorporateActions lists recorded corporate actions, most recent first, optionally for one symbol
+func (h *Handler) GetCorporateActions(c *gin.Context) {
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch corporate actions"})
+		return
+	}
+
+	query := `
+		SELECT
+			ca.id, ca.asset_id, a.symbol, ca.action_type, ca.effective_date, ca.ratio, ca.new_asset_id,
+			ca.old_symbol, ca.new_symbol, ca.cost_allocation, COALESCE(ca.notes, ''), ca.status,
+			(SELECT COUNT(*) FROM corporate_action_adjustments caa WHERE caa.corporate_action_id = ca.id),
+			(SELECT COUNT(*) FROM transactions t WHERE t.corporate_action_id = ca.id),
+			ca.created_at, ca.reversed_at
+		FROM corporate_actions ca
+		JOIN assets a ON ca.asset_id = a.id
+	`
+	args := []interface{}{}
+
+	// A symbol matches the asset's current symbol or any symbol it changed from or to
+	if symbol := strings.ToUpper(c.Query("symbol")); symbol != "" {
+		args = append(args, symbol)
+		query += " WHERE a.symbol = $1 OR ca.old_symbol = $1 OR ca.new_symbol = $1"
+	}
+
+	query += " ORDER BY ca.effective_date DESC, ca.created_at DESC"
+
+	rows, err := h.services.DB.Query(query, args...)
+	if err != nil {
+		h.logger.Error("Failed to query corporate actions", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch corporate actions"})
+		return
+	}
+	defer rows.Close()
+
+	actions := []corporateAction{}
+	for rows.Next() {
+		var action corporateAction
+		var effectiveDate time.Time
+		err := rows.Scan(&action.ID, &action.AssetID, &action.Symbol, &action.ActionType, &effectiveDate, &action.Ratio,
+			&action.NewAssetID, &action.OldSymbol, &action.NewSymbol, &action.CostAllocation, &action.Notes, &action.Status,
+			&action.Adjustments, &action.Entries, &action.CreatedAt, &action.ReversedAt)
+		if err != nil {
+			h.logger.Error("Failed to scan corporate action", zap.Error(err))
+			continue
+		}
+		action.EffectiveDate = effectiveDate.Format("2006-01-02")
+		actions = append(actions, action)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"corporate_actions": actions,
+		"count":             len(actions),
+	})
+}
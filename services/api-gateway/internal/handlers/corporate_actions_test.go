@@ -0,0 +1,458 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var corporateActionDate = time.Date(2024, 6, 10, 0, 0, 0, 0, time.UTC)
+
+// expectAssetScopes expects the portfolios with transactions in an asset to be listed
+func expectAssetScopes(mock sqlmock.Sqlmock, assetID string) {
+	mock.ExpectQuery(`SELECT DISTINCT p.user_id, t.portfolio_id FROM transactions t JOIN portfolios p ON t.portfolio_id = p.id WHERE t.asset_id = \$1`).
+		WithArgs(assetID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "portfolio_id"}).AddRow(testUserID, testPortfolioID))
+}
+
+// expectLaterCorporateAction expects the check for later applied corporate actions
+func expectLaterCorporateAction(mock sqlmock.Sqlmock, actionID string, later bool) {
+	mock.ExpectQuery(`SELECT EXISTS \( SELECT 1 FROM corporate_actions WHERE status = 'APPLIED' AND id <> \$1`).
+		WithArgs(actionID, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(later))
+}
+
+// expectCorporateActionInsert expects a corporate action on testAssetID to be recorded as "ca1"
+func expectCorporateActionInsert(mock sqlmock.Sqlmock, actionType string, ratio, newAssetID, oldSymbol, newSymbol, costAllocation interface{}) {
+	mock.ExpectQuery(`INSERT INTO corporate_actions \(asset_id, action_type, effective_date, ratio, new_asset_id, old_symbol, new_symbol, cost_allocation, notes, created_by\)`).
+		WithArgs(testAssetID, actionType, corporateActionDate, ratio, newAssetID, oldSymbol, newSymbol, costAllocation, "", testUserID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow("ca1", time.Now()))
+}
+
+// expectCorporateActionEntry expects a spin-off or merger ledger entry for the test portfolio
+func expectCorporateActionEntry(mock sqlmock.Sqlmock, assetID, transactionType string, quantity, price float64, acquiredAt driver.Value) {
+	mock.ExpectExec(`INSERT INTO transactions \(user_id, portfolio_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes, transaction_date, corporate_action_id, acquired_at\)`).
+		WithArgs(testUserID, testPortfolioID, assetID, transactionType, quantity, price, quantity*price, "", corporateActionDate, "ca1", acquiredAt).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// expectAssetLookup expects an asset to be looked up by symbol
+func expectAssetLookup(mock sqlmock.Sqlmock, symbol, assetID string) {
+	rows := sqlmock.NewRows([]string{"id"})
+	if assetID != "" {
+		rows.AddRow(assetID)
+	}
+	mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = \$1`).WithArgs(symbol).WillReturnRows(rows)
+}
+
+// TestCreateCorporateAction tests recording and applying corporate actions
+func TestCreateCorporateAction(t *testing.T) {
+	bought := corporateActionDate.AddDate(0, -3, 0)
+
+	tests := []struct {
+		name           string
+		requestBody    string
+		setupMock      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedBody   []string
+	}{
+		{
+			name:        "split restates history and rebuilds holdings",
+			requestBody: `{"symbol": "aapl", "action_type": "SPLIT", "effective_date": "2024-06-10", "ratio": 4}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectAssetLookup(mock, "AAPL", testAssetID)
+				expectCorporateActionInsert(mock, "SPLIT", 4.0, nil, nil, nil, nil)
+				expectLaterCorporateAction(mock, "ca1", false)
+				mock.ExpectExec(`WITH restated AS \( UPDATE transactions SET quantity = quantity \* \$1, price = price / \$1`).
+					WithArgs(4.0, testAssetID, corporateActionDate, sqlmock.AnyArg(), "ca1").
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec(`WITH restated AS \( UPDATE price_history SET open_price = open_price / \$1`).
+					WithArgs(4.0, testAssetID, corporateActionDate, "ca1").
+					WillReturnResult(sqlmock.NewResult(0, 30))
+				expectAssetScopes(mock, testAssetID)
+
+				// The restated ledger holds four times the shares at a quarter of the cost
+				expectReplay(mock, testPortfolioID, testAssetID,
+					newLedgerRows().AddRow("tx1", testAssetID, "AAPL", "BUY", 40.0, 37.5, 0.0, bought, "", nil, nil, nil),
+					newStoredHoldingRows().AddRow(testAssetID, "AAPL", 10.0, 150.0),
+					newStoredLotRows().AddRow("lot1", "tx1"))
+				expectLotInsert(mock, "tx1", 40.0, 40.0)
+				expectHoldingUpsert(mock, testAssetID, 40.0, 37.5)
+				expectSnapshotInvalidation(mock, testPortfolioID, "2024-06-10")
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+			expectedBody: []string{`"id":"ca1"`, `"status":"APPLIED"`, `"transactions_restated":2`, `"prices_restated":30`,
+				`"adjustments":32`, `"holdings_rebuilt":1`},
+		},
+		{
+			name:        "merger moves open lots into the acquirer",
+			requestBody: `{"symbol": "AAPL", "action_type": "MERGER", "effective_date": "2024-06-10", "ratio": 0.5, "new_symbol": "MSFT"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectAssetLookup(mock, "AAPL", testAssetID)
+				expectAssetLookup(mock, "MSFT", "asset-msft")
+				expectCorporateActionInsert(mock, "MERGER", 0.5, "asset-msft", nil, "MSFT", nil)
+				expectLaterCorporateAction(mock, "ca1", false)
+				expectAssetScopes(mock, testAssetID)
+
+				// Only lots open before the effective date move; a purchase on it doesn't
+				mock.ExpectQuery(`SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.portfolio_id = \$1 AND t.asset_id = \$2 ORDER BY`).
+					WithArgs(testPortfolioID, testAssetID).
+					WillReturnRows(newLedgerRows().
+						AddRow("tx1", testAssetID, "AAPL", "BUY", 10.0, 100.0, 10.0, bought, "", nil, nil, nil).
+						AddRow("tx2", testAssetID, "AAPL", "BUY", 1.0, 90.0, 0.0, corporateActionDate, "", nil, nil, nil))
+				expectCorporateActionEntry(mock, "asset-msft", "TRANSFER_IN", 5.0, 202.0, bought)
+				expectCorporateActionEntry(mock, testAssetID, "TRANSFER_OUT", 10.0, 0.0, nil)
+
+				expectReplay(mock, testPortfolioID, testAssetID,
+					newLedgerRows().
+						AddRow("tx1", testAssetID, "AAPL", "BUY", 10.0, 100.0, 10.0, bought, "", nil, nil, nil).
+						AddRow("out1", testAssetID, "AAPL", "TRANSFER_OUT", 10.0, 0.0, 0.0, corporateActionDate, "", nil, nil, nil),
+					newStoredHoldingRows().AddRow(testAssetID, "AAPL", 10.0, 100.0),
+					newStoredLotRows().AddRow("lot1", "tx1"))
+				expectLotInsert(mock, "tx1", 10.0, 0.0)
+				expectHoldingDelete(mock, testPortfolioID, testAssetID)
+				expectReplay(mock, testPortfolioID, "asset-msft",
+					newLedgerRows().AddRow("in1", "asset-msft", "MSFT", "TRANSFER_IN", 5.0, 202.0, 0.0, corporateActionDate, "", nil, nil, bought),
+					newStoredHoldingRows(),
+					newStoredLotRows())
+				expectLotInsert(mock, "in1", 5.0, 5.0)
+				expectHoldingUpsert(mock, "asset-msft", 5.0, 202.0)
+				expectSnapshotInvalidation(mock, testPortfolioID, "2024-06-10")
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+			expectedBody:   []string{`"action_type":"MERGER"`, `"new_asset_id":"asset-msft"`, `"entries_created":2`, `"holdings_rebuilt":2`},
+		},
+		{
+			name:        "spin-off creates the new asset",
+			requestBody: `{"symbol": "AAPL", "action_type": "SPINOFF", "effective_date": "2024-06-10", "ratio": 0.2, "new_symbol": "SPIN", "cost_allocation": 0.25}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectAssetLookup(mock, "AAPL", testAssetID)
+				expectAssetLookup(mock, "SPIN", "")
+				mock.ExpectQuery(`INSERT INTO assets \(symbol, name, asset_type, exchange, currency, sector\) SELECT \$1, \$1, asset_type, exchange, currency, sector FROM assets WHERE id = \$2`).
+					WithArgs("SPIN", testAssetID).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("asset-spin"))
+				expectCorporateActionInsert(mock, "SPINOFF", 0.2, "asset-spin", nil, "SPIN", 0.25)
+				expectLaterCorporateAction(mock, "ca1", false)
+				expectAssetScopes(mock, testAssetID)
+				mock.ExpectQuery(`SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.portfolio_id = \$1 AND t.asset_id = \$2 ORDER BY`).
+					WithArgs(testPortfolioID, testAssetID).
+					WillReturnRows(newLedgerRows().AddRow("tx1", testAssetID, "AAPL", "BUY", 10.0, 100.0, 0.0, bought, "", nil, nil, nil))
+
+				// 2 shares carrying a quarter of the 1000 cost basis; the parent keeps the rest
+				expectCorporateActionEntry(mock, "asset-spin", "TRANSFER_IN", 2.0, 125.0, bought)
+				expectCorporateActionEntry(mock, testAssetID, "COST_ADJUST", 0.0, 0.75, nil)
+
+				expectReplay(mock, testPortfolioID, testAssetID,
+					newLedgerRows().
+						AddRow("tx1", testAssetID, "AAPL", "BUY", 10.0, 100.0, 0.0, bought, "", nil, nil, nil).
+						AddRow("adj1", testAssetID, "AAPL", "COST_ADJUST", 0.0, 0.75, 0.0, corporateActionDate, "", nil, nil, nil),
+					newStoredHoldingRows().AddRow(testAssetID, "AAPL", 10.0, 100.0),
+					newStoredLotRows().AddRow("lot1", "tx1"))
+				expectLotInsert(mock, "tx1", 10.0, 10.0)
+				expectHoldingUpsert(mock, testAssetID, 10.0, 75.0)
+				expectReplay(mock, testPortfolioID, "asset-spin",
+					newLedgerRows().AddRow("in1", "asset-spin", "SPIN", "TRANSFER_IN", 2.0, 125.0, 0.0, corporateActionDate, "", nil, nil, nil),
+					newStoredHoldingRows(),
+					newStoredLotRows())
+				expectLotInsert(mock, "in1", 2.0, 2.0)
+				expectHoldingUpsert(mock, "asset-spin", 2.0, 125.0)
+				expectSnapshotInvalidation(mock, testPortfolioID, "2024-06-10")
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+			expectedBody:   []string{`"action_type":"SPINOFF"`, `"cost_allocation":0.25`, `"entries_created":2`},
+		},
+		{
+			name:        "symbol change renames the asset",
+			requestBody: `{"symbol": "AAPL", "action_type": "SYMBOL_CHANGE", "effective_date": "2024-06-10", "new_symbol": "APPL"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectAssetLookup(mock, "AAPL", testAssetID)
+				expectAssetLookup(mock, "APPL", "")
+				expectCorporateActionInsert(mock, "SYMBOL_CHANGE", nil, nil, "AAPL", "APPL", nil)
+				expectLaterCorporateAction(mock, "ca1", false)
+				mock.ExpectExec(`UPDATE assets SET symbol = \$1, updated_at = NOW\(\) WHERE id = \$2`).
+					WithArgs("APPL", testAssetID).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+			expectedBody:   []string{`"old_symbol":"AAPL"`, `"new_symbol":"APPL"`, `"holdings_rebuilt":0`},
+		},
+		{
+			name:        "symbol already in use",
+			requestBody: `{"symbol": "AAPL", "action_type": "SYMBOL_CHANGE", "effective_date": "2024-06-10", "new_symbol": "MSFT"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectAssetLookup(mock, "AAPL", testAssetID)
+				expectAssetLookup(mock, "MSFT", "asset-msft")
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+			expectedBody:   []string{"Symbol MSFT is already in use"},
+		},
+		{
+			name:        "a later action is already applied",
+			requestBody: `{"symbol": "AAPL", "action_type": "REVERSE_SPLIT", "effective_date": "2024-06-10", "ratio": 0.1}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectAssetLookup(mock, "AAPL", testAssetID)
+				expectCorporateActionInsert(mock, "REVERSE_SPLIT", 0.1, nil, nil, nil, nil)
+				expectLaterCorporateAction(mock, "ca1", true)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+			expectedBody:   []string{"reverse it first"},
+		},
+		{
+			name:        "asset not found",
+			requestBody: `{"symbol": "NOPE", "action_type": "SPLIT", "effective_date": "2024-06-10", "ratio": 2}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectAssetLookup(mock, "NOPE", "")
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   []string{"Asset not found"},
+		},
+		{
+			name:           "split ratio must increase shares",
+			requestBody:    `{"symbol": "AAPL", "action_type": "SPLIT", "effective_date": "2024-06-10", "ratio": 0.5}`,
+			setupMock:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"A SPLIT needs a ratio greater than 1"},
+		},
+		{
+			name:           "spin-off without a cost allocation",
+			requestBody:    `{"symbol": "AAPL", "action_type": "SPINOFF", "effective_date": "2024-06-10", "ratio": 0.2, "new_symbol": "SPIN"}`,
+			setupMock:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"A SPINOFF needs"},
+		},
+		{
+			name:           "invalid effective date",
+			requestBody:    `{"symbol": "AAPL", "action_type": "SPLIT", "effective_date": "06/10/2024", "ratio": 2}`,
+			setupMock:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"effective_date must be formatted as YYYY-MM-DD"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock, cleanup := createTestHandler(t)
+			defer cleanup()
+
+			tt.setupMock(mock)
+
+			router := createTestRouter(handler, "POST", "/admin/corporate-actions", handler.CreateCorporateAction)
+
+			req, _ := http.NewRequest("POST", "/admin/corporate-actions", strings.NewReader(tt.requestBody))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			for _, expected := range tt.expectedBody {
+				assert.Contains(t, w.Body.String(), expected)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+// TestReverseCorporateAction tests undoing applied corporate actions
+func TestReverseCorporateAction(t *testing.T) {
+	bought := corporateActionDate.AddDate(0, -3, 0)
+
+	expectAction := func(mock sqlmock.Sqlmock, actionType string, ratio, newAssetID interface{}, status string) {
+		mock.ExpectQuery(`SELECT asset_id, action_type, ratio, new_asset_id, old_symbol, status, effective_date, created_at FROM corporate_actions WHERE id = \$1 FOR UPDATE`).
+			WithArgs("ca1").
+			WillReturnRows(sqlmock.NewRows([]string{"asset_id", "action_type", "ratio", "new_asset_id", "old_symbol", "status", "effective_date", "created_at"}).
+				AddRow(testAssetID, actionType, ratio, newAssetID, nil, status, corporateActionDate, time.Now()))
+	}
+	expectReversed := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec(`UPDATE corporate_actions SET status = 'REVERSED', reversed_at = NOW\(\), reversed_by = \$1 WHERE id = \$2`).
+			WithArgs(testUserID, "ca1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	tests := []struct {
+		name           string
+		setupMock      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedBody   []string
+	}{
+		{
+			name: "split is undone on the rows it restated",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectAction(mock, "SPLIT", 4.0, nil, "APPLIED")
+				expectLaterCorporateAction(mock, "ca1", false)
+				mock.ExpectExec(`UPDATE transactions SET quantity = quantity / \$1, price = price \* \$1 WHERE id IN \( SELECT row_id FROM corporate_action_adjustments WHERE corporate_action_id = \$2 AND table_name = 'transactions' \)`).
+					WithArgs(4.0, "ca1").
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec(`UPDATE price_history ph SET (.+) close_price = caa.price_before, volume = ROUND\(caa.quantity_before\) FROM corporate_action_adjustments caa WHERE caa.corporate_action_id = \$2 AND caa.table_name = 'price_history' AND caa.row_id = ph.id`).
+					WithArgs(4.0, "ca1").
+					WillReturnResult(sqlmock.NewResult(0, 30))
+				expectAssetScopes(mock, testAssetID)
+				expectReplay(mock, testPortfolioID, testAssetID,
+					newLedgerRows().AddRow("tx1", testAssetID, "AAPL", "BUY", 10.0, 150.0, 0.0, bought, "", nil, nil, nil),
+					newStoredHoldingRows().AddRow(testAssetID, "AAPL", 40.0, 37.5),
+					newStoredLotRows().AddRow("lot1", "tx1"))
+				expectLotInsert(mock, "tx1", 10.0, 10.0)
+				expectHoldingUpsert(mock, testAssetID, 10.0, 150.0)
+				expectSnapshotInvalidation(mock, testPortfolioID, "2024-06-10")
+				expectReversed(mock)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{"Corporate action reversed", `"transactions_restored":2`, `"prices_restored":30`, `"holdings_rebuilt":1`},
+		},
+		{
+			name: "merger entries are removed",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectAction(mock, "MERGER", 0.5, "asset-msft", "APPLIED")
+				expectLaterCorporateAction(mock, "ca1", false)
+				mock.ExpectQuery(`DELETE FROM transactions t USING portfolios p WHERE t.portfolio_id = p.id AND t.corporate_action_id = \$1 RETURNING`).
+					WithArgs("ca1").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "portfolio_id", "asset_id"}).
+						AddRow(testUserID, testPortfolioID, "asset-msft").
+						AddRow(testUserID, testPortfolioID, testAssetID))
+				expectReplay(mock, testPortfolioID, "asset-msft", newLedgerRows(),
+					newStoredHoldingRows().AddRow("asset-msft", "MSFT", 5.0, 200.0),
+					newStoredLotRows())
+				expectHoldingDelete(mock, testPortfolioID, "asset-msft")
+				expectReplay(mock, testPortfolioID, testAssetID,
+					newLedgerRows().AddRow("tx1", testAssetID, "AAPL", "BUY", 10.0, 100.0, 0.0, bought, "", nil, nil, nil),
+					newStoredHoldingRows(),
+					newStoredLotRows().AddRow("lot1", "tx1"))
+				expectLotInsert(mock, "tx1", 10.0, 10.0)
+				expectHoldingUpsert(mock, testAssetID, 10.0, 100.0)
+				expectSnapshotInvalidation(mock, testPortfolioID, "2024-06-10")
+				expectReversed(mock)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{`"entries_removed":2`, `"holdings_rebuilt":2`},
+		},
+		{
+			name: "already reversed",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectAction(mock, "SPLIT", 4.0, nil, "REVERSED")
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+			expectedBody:   []string{"already reversed"},
+		},
+		{
+			name: "a later action must be reversed first",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectAction(mock, "SPLIT", 4.0, nil, "APPLIED")
+				expectLaterCorporateAction(mock, "ca1", true)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+			expectedBody:   []string{"reverse it first"},
+		},
+		{
+			name: "not found",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT (.+) FROM corporate_actions WHERE id = \$1`).
+					WithArgs("ca1").
+					WillReturnRows(sqlmock.NewRows([]string{"asset_id"}))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   []string{"Corporate action not found"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock, cleanup := createTestHandler(t)
+			defer cleanup()
+
+			tt.setupMock(mock)
+
+			router := createTestRouter(handler, "POST", "/admin/corporate-actions/:id/reverse", handler.ReverseCorporateAction)
+
+			req, _ := http.NewRequest("POST", "/admin/corporate-actions/ca1/reverse", nil)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			for _, expected := range tt.expectedBody {
+				assert.Contains(t, w.Body.String(), expected)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+// TestGetCorporateActions tests listing corporate actions with their audit counts
+func TestGetCorporateActions(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	mock.ExpectQuery(`SELECT (.+) FROM corporate_actions ca JOIN assets a ON ca.asset_id = a.id WHERE a.symbol = \$1 OR ca.old_symbol = \$1 OR ca.new_symbol = \$1 ORDER BY`).
+		WithArgs("AAPL").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"id", "asset_id", "symbol", "action_type", "effective_date", "ratio", "new_asset_id", "old_symbol", "new_symbol",
+			"cost_allocation", "notes", "status", "adjustments", "entries", "created_at", "reversed_at",
+		}).AddRow("ca1", testAssetID, "AAPL", "SPLIT", corporateActionDate, 4.0, nil, nil, nil, nil, "4-for-1", "REVERSED", 32, 0, time.Now(), time.Now()))
+
+	router := createTestRouter(handler, "GET", "/admin/corporate-actions", handler.GetCorporateActions)
+	req, _ := http.NewRequest("GET", "/admin/corporate-actions?symbol=aapl", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `"effective_date":"2024-06-10"`)
+	assert.Contains(t, body, `"ratio":4`)
+	assert.Contains(t, body, `"adjustments":32`)
+	assert.Contains(t, body, `"reversed_at"`)
+	assert.NotContains(t, body, `"new_symbol"`)
+	assert.Contains(t, body, `"count":1`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestDeleteTransaction_CorporateActionEntry tests that entries written by corporate actions can't be deleted
+func TestDeleteTransaction_CorporateActionEntry(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT t.transaction_type, t.quantity, a.symbol, t.portfolio_id, t.asset_id, t.transaction_date FROM transactions t`).
+		WithArgs("in1", testUserID).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_type", "quantity", "symbol", "portfolio_id", "asset_id", "transaction_date"}).
+			AddRow("TRANSFER_IN", 5.0, "MSFT", testPortfolioID, "asset-msft", testDay("2024-03-04")))
+	mock.ExpectRollback()
+
+	router := createTestRouter(handler, "DELETE", "/transactions/:id", handler.DeleteTransaction)
+	req, _ := http.NewRequest("DELETE", "/transactions/in1", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "undone by reversing the action")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Covariance shrinkage methods
+const (
+	shrinkageNone       = "none"
+	shrinkageLedoitWolf = "ledoit_wolf"
+)
+
+// returnCovariance is the covariance and correlation of the daily returns in a return matrix
+type returnCovariance struct {
+	Symbols     []string
+	Covariance  [][]float64 // of daily returns
+	Correlation [][]float64
+	Shrinkage   float64 // Ledoit-Wolf intensity, or 0 for the sample covariance
+}
+
+// correlatedPair is the correlation of two symbols' daily returns
+type correlatedPair struct {
+	SymbolA     string  `json:"symbol_a"`
+	SymbolB     string  `json:"symbol_b"`
+	Correlation float64 `json:"correlation"`
+}
+
+// newReturnCovariance estimates the covariance of the matrix's returns, shrunk with Ledoit-Wolf or not
+func newReturnCovariance(matrix returnMatrix, shrink bool) returnCovariance {
+	estimate := returnCovariance{Symbols: matrix.Symbols}
+	if shrink {
+		estimate.Covariance, estimate.Shrinkage = ledoitWolf(matrix.Returns)
+	} else {
+		estimate.Covariance = covarianceMatrix(matrix.Returns)
+	}
+	estimate.Correlation = correlationMatrix(estimate.Covariance)
+	return estimate
+}
+
+// portfolioVariance returns the daily variance of the symbols held at weights
+func (c returnCovariance) portfolioVariance(weights []float64) float64 {
+	var variance float64
+	for i := range weights {
+		for j := range weights {
+			variance += weights[i] * weights[j] * c.Covariance[i][j]
+		}
+	}
+	return math.Max(variance, 0)
+}
+
+// diversificationRatio returns the weighted average volatility of the symbols held at weights over the
+// volatility of the whole, which is 1 for perfectly correlated holdings and grows as they diversify.
+// It's nil when the portfolio doesn't vary.
+func (c returnCovariance) diversificationRatio(weights []float64) *float64 {
+	volatility := math.Sqrt(c.portfolioVariance(weights))
+	if volatility == 0 {
+		return nil
+	}
+	var weighted float64
+	for i, weight := range weights {
+		weighted += weight * math.Sqrt(c.Covariance[i][i])
+	}
+	return optionalFloat(weighted / volatility)
+}
+
+// mostCorrelated returns up to limit pairs of symbols, most correlated first
+func (c returnCovariance) mostCorrelated(limit int) []correlatedPair {
+	pairs := []correlatedPair{}
+	for i := range c.Symbols {
+		for j := i + 1; j < len(c.Symbols); j++ {
+			pairs = append(pairs, correlatedPair{SymbolA: c.Symbols[i], SymbolB: c.Symbols[j], Correlation: c.Correlation[i][j]})
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].Correlation > pairs[j].Correlation })
+	if len(pairs) > limit {
+		pairs = pairs[:limit]
+	}
+	return pairs
+}
+
+// annualized returns the covariance matrix scaled from daily returns to a year of trading days
+func (c returnCovariance) annualized() [][]float64 {
+	matrix := make([][]float64, len(c.Covariance))
+	for i, row := range c.Covariance {
+		matrix[i] = make([]float64, len(row))
+		for j, covariance := range row {
+			matrix[i][j] = covariance * tradingDaysPerYear
+		}
+	}
+	return matrix
+}
+
+// GetCorrelation reports how the current holdings' daily returns move together: their correlation and
+// covariance matrices, the most correlated pairs and the portfolio's diversification ratio
+func (h *Handler) GetCorrelation(c *gin.Context) {
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate correlations"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
+		return
+	}
+
+	shrinkage := c.DefaultQuery("shrinkage", shrinkageNone)
+	if shrinkage != shrinkageNone && shrinkage != shrinkageLedoitWolf {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid shrinkage %q, expected none or ledoit_wolf", shrinkage)})
+		return
+	}
+	top, err := parseBoundedInt(c, "top", 5, 1, 100)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	lookback, lookbackFrom, ok := lookbackStart(c, today)
+	if !ok {
+		return
+	}
+
+	// Holdings are weighted by their market value in the portfolio's base currency
+	fx, err := h.newFXConverter(h.services.DB, portfolioID)
+	if err != nil {
+		h.logger.Error("Failed to load base currency", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate correlations"})
+		return
+	}
+	holdings, err := h.loadRiskHoldings(portfolioID, fx)
+	if err != nil {
+		h.respondFXError(c, err, "Failed to calculate correlations")
+		return
+	}
+	matrix, pricedHoldings, warnings, err := h.loadHoldingReturns(holdings, nil, lookbackFrom, today)
+	if err != nil {
+		h.logger.Error("Failed to load price history for correlations", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate correlations"})
+		return
+	}
+
+	symbols := matrix.Symbols
+	if symbols == nil {
+		symbols = []string{}
+	}
+	response := gin.H{
+		"symbols":               symbols,
+		"shrinkage":             gin.H{"method": shrinkage, "intensity": 0.0},
+		"lookback_window":       lookbackWindow(lookback, lookbackFrom, today, matrix),
+		"correlation":           nil,
+		"covariance":            nil,
+		"most_correlated_pairs": []correlatedPair{},
+		"diversification_ratio": nil,
+	}
+	if len(matrix.Dates) >= 2 {
+		estimate := newReturnCovariance(matrix, shrinkage == shrinkageLedoitWolf)
+		weights, _ := holdingWeights(pricedHoldings, matrix.Symbols)
+		response["shrinkage"] = gin.H{"method": shrinkage, "intensity": estimate.Shrinkage}
+		response["correlation"] = estimate.Correlation
+		response["covariance"] = estimate.annualized()
+		response["most_correlated_pairs"] = estimate.mostCorrelated(int(top))
+		response["diversification_ratio"] = estimate.diversificationRatio(weights)
+	} else if len(matrix.Symbols) > 0 {
+		warnings = append(warnings, "Correlations need at least two days of returns in the lookback window")
+	}
+	if len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestReturnCovariance tests the correlation matrix, pairs and diversification ratio of return series
+func TestReturnCovariance(t *testing.T) {
+	matrix := returnMatrix{
+		Symbols: []string{"AAA", "BBB", "CCC"},
+		Returns: [][]float64{
+			{0.01, -0.02, 0.03, -0.01},
+			{0.02, -0.04, 0.06, -0.02}, // twice AAA
+			{-0.01, 0.02, -0.03, 0.01}, // the opposite of AAA
+		},
+	}
+	matrix.Dates = make([]time.Time, 4)
+
+	estimate := newReturnCovariance(matrix, false)
+
+	assert.Equal(t, 0.0, estimate.Shrinkage)
+	assert.InDelta(t, 4*estimate.Covariance[0][0], estimate.Covariance[1][1], 1e-15)
+	assert.InDelta(t, 1, estimate.Correlation[0][1], 1e-12)
+	assert.InDelta(t, -1, estimate.Correlation[0][2], 1e-12)
+	assert.InDelta(t, estimate.Covariance[0][1]*tradingDaysPerYear, estimate.annualized()[0][1], 1e-15)
+
+	pairs := estimate.mostCorrelated(2)
+	if assert.Len(t, pairs, 2) {
+		assert.Equal(t, "AAA", pairs[0].SymbolA)
+		assert.Equal(t, "BBB", pairs[0].SymbolB)
+		assert.InDelta(t, 1, pairs[0].Correlation, 1e-12)
+		assert.InDelta(t, -1, pairs[1].Correlation, 1e-12)
+	}
+
+	// Perfectly correlated holdings don't diversify; offsetting ones do, and cancel out at equal weights
+	assert.InDelta(t, 1, *estimate.diversificationRatio([]float64{0.5, 0.5, 0}), 1e-12)
+	assert.InDelta(t, 3, *estimate.diversificationRatio([]float64{2.0 / 3, 0, 1.0 / 3}), 1e-9)
+	assert.Nil(t, estimate.diversificationRatio([]float64{0.5, 0, 0.5}))
+}
+
+// TestLedoitWolf tests that shrinkage pulls the covariance towards a scaled identity matrix
+func TestLedoitWolf(t *testing.T) {
+	series := [][]float64{
+		{0.01, -0.02, 0.015, -0.04, 0.005, 0.02},
+		{0.012, -0.018, 0.01, -0.035, 0.0, 0.025},
+		{-0.005, 0.01, 0.002, 0.0, -0.01, 0.004},
+	}
+
+	shrunk, intensity := ledoitWolf(series)
+
+	assert.Greater(t, intensity, 0.0)
+	assert.LessOrEqual(t, intensity, 1.0)
+
+	// The sample covariance that Ledoit-Wolf starts from divides by n
+	n := float64(len(series[0]))
+	sample := covarianceMatrix(series)
+	var target float64
+	for i := range sample {
+		target += sample[i][i] * (n - 1) / n / 3
+	}
+	for i := range sample {
+		for j := range sample {
+			expected := (1 - intensity) * sample[i][j] * (n - 1) / n
+			if i == j {
+				expected += intensity * target
+			}
+			assert.InDelta(t, expected, shrunk[i][j], 1e-15)
+		}
+	}
+
+	// Shrinking moves correlations towards zero
+	shrunkCorrelation, sampleCorrelation := correlationMatrix(shrunk), correlationMatrix(sample)
+	assert.Less(t, math.Abs(shrunkCorrelation[0][1]), math.Abs(sampleCorrelation[0][1]))
+
+	_, intensity = ledoitWolf([][]float64{{0.01}, {0.02}})
+	assert.Equal(t, 0.0, intensity)
+}
+
+// TestGetCorrelation tests the correlation endpoint
+func TestGetCorrelation(t *testing.T) {
+	get := func(handler *Handler, target string) *httptest.ResponseRecorder {
+		router := createTestRouter(handler, "GET", "/analytics/correlation", handler.GetCorrelation)
+		req, _ := http.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("shrunk", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		expectBaseCurrency(mock, testPortfolioID, "USD")
+		mock.ExpectQuery(`SELECT a.symbol, COALESCE\(a.currency, 'USD'\) as currency, ph.quantity, ph.average_cost, \(ph.quantity \* ph.average_cost\) as position_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \$1`).
+			WithArgs(testPortfolioID).
+			WillReturnRows(sqlmock.NewRows([]string{"symbol", "currency", "quantity", "average_cost", "position_value"}).
+				AddRow("AAA", "USD", 10.0, 50.0, 500.0).
+				AddRow("BBB", "USD", 5.0, 100.0, 500.0).
+				AddRow("CCC", "USD", 1.0, 100.0, 100.0))
+
+		matrix := varTestMatrix()
+		rows := sqlmock.NewRows([]string{"symbol", "date", "close_price"})
+		for i, symbol := range matrix.Symbols {
+			price := 100.0
+			rows.AddRow(symbol, matrix.Start, price)
+			for j, r := range matrix.Returns[i] {
+				price *= 1 + r
+				rows.AddRow(symbol, matrix.Dates[j], price)
+			}
+		}
+		mock.ExpectQuery(`SELECT a.symbol, ph.date, ph.close_price FROM price_history ph JOIN assets a ON ph.asset_id = a.id WHERE a.symbol = ANY\(\$1\)`).
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(rows)
+
+		w := get(handler, "/analytics/correlation?shrinkage=ledoit_wolf&lookback=max")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Symbols              []string         `json:"symbols"`
+			Correlation          [][]float64      `json:"correlation"`
+			Covariance           [][]float64      `json:"covariance"`
+			Pairs                []correlatedPair `json:"most_correlated_pairs"`
+			DiversificationRatio *float64         `json:"diversification_ratio"`
+			Shrinkage            struct {
+				Method    string  `json:"method"`
+				Intensity float64 `json:"intensity"`
+			} `json:"shrinkage"`
+			Warnings []string `json:"warnings"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, []string{"AAA", "BBB"}, response.Symbols)
+		assert.Len(t, response.Correlation, 2)
+		assert.Len(t, response.Covariance, 2)
+		assert.Len(t, response.Pairs, 1)
+		assert.Equal(t, shrinkageLedoitWolf, response.Shrinkage.Method)
+		assert.Greater(t, response.Shrinkage.Intensity, 0.0)
+		if assert.NotNil(t, response.DiversificationRatio) {
+			assert.Greater(t, *response.DiversificationRatio, 1.0)
+		}
+		assert.Equal(t, []string{"No price history for CCC in the lookback window"}, response.Warnings)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		for _, query := range []string{"shrinkage=oas", "top=0", "lookback=2w"} {
+			expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+			w := get(handler, "/analytics/correlation?"+query)
+			assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		}
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// fxRateQuery finds the latest rate on or before $3 converting $2 into $1, i.e. units of $1 per unit
+// of $2: from the pair stored either way round, or crossed through a base both were quoted against
+const fxRateQuery = `
+	SELECT rate FROM (
+		SELECT 1 / rate AS rate, rate_date FROM fx_rates
+		WHERE base_currency = $1 AND quote_currency = $2 AND rate_date <= $3
+		UNION ALL
+		SELECT rate, rate_date FROM fx_rates
+		WHERE base_currency = $2 AND quote_currency = $1 AND rate_date <= $3
+		UNION ALL
+		SELECT b.rate / c.rate AS rate, b.rate_date FROM fx_rates b
+		JOIN fx_rates c ON c.base_currency = b.base_currency AND c.rate_date = b.rate_date
+		WHERE b.quote_currency = $1 AND c.quote_currency = $2 AND b.rate_date <= $3
+	) r
+	ORDER BY rate_date DESC
+	LIMIT 1
+`
+
+// fxRateError reports a currency that couldn't be converted into the portfolio's base currency
+type fxRateError struct {
+	From string
+	To   string
+	Date string
+}
+
+func (e *fxRateError) Error() string {
+	return fmt.Sprintf("no %s/%s exchange rate on or before %s", e.From, e.To, e.Date)
+}
+
+// foreignCost is the cost of open lots in their own currency and in the base currency at the
+// rates of the days they were acquired
+type foreignCost struct {
+	Local float64
+	Base  float64
+}
+
+// fxValuation is a holding valued in the base currency. Its unrealized gain splits into the price
+// move at today's rate and the currency move on its cost since acquisition.
+type fxValuation struct {
+	Rate          float64
+	CostBasis     float64
+	MarketValue   float64
+	PriceGainLoss float64
+	FXGainLoss    float64
+}
+
+// fxConverter converts a portfolio's amounts into its base currency. Rates are looked up once per
+// currency and day, and open lots are only read the first time a foreign holding's cost is needed.
+type fxConverter struct {
+	q           sqlQuerier
+	portfolioID string
+	base        string
+	today       time.Time
+	rates       map[string]float64
+	lotCosts    map[string]foreignCost
+}
+
+// Helper function to create a converter into a portfolio's base currency
+func (h *Handler) newFXConverter(q sqlQuerier, portfolioID string) (*fxConverter, error) {
+	var base string
+	err := q.QueryRow("SELECT base_currency FROM portfolios WHERE id = $1", portfolioID).Scan(&base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query base currency: %w", err)
+	}
+	return &fxConverter{
+		q:           q,
+		portfolioID: portfolioID,
+		base:        strings.ToUpper(base),
+		today:       time.Now(),
+		rates:       map[string]float64{},
+	}, nil
+}
+
+// rateAt returns the units of base currency per unit of currency on the given day
+func (fx *fxConverter) rateAt(currency string, date time.Time) (float64, error) {
+	currency = strings.ToUpper(currency)
+	if currency == "" || currency == fx.base {
+		return 1, nil
+	}
+
+	day := date.Format("2006-01-02")
+	key := currency + "@" + day
+	if rate, ok := fx.rates[key]; ok {
+		return rate, nil
+	}
+
+	var rate float64
+	err := fx.q.QueryRow(fxRateQuery, fx.base, currency, day).Scan(&rate)
+	if err == sql.ErrNoRows {
+		return 0, &fxRateError{From: currency, To: fx.base, Date: day}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to query %s/%s rate: %w", currency, fx.base, err)
+	}
+
+	fx.rates[key] = rate
+	return rate, nil
+}
+
+// rate returns today's units of base currency per unit of currency
+func (fx *fxConverter) rate(currency string) (float64, error) {
+	return fx.rateAt(currency, fx.today)
+}
+
+// convert converts an amount in currency into the base currency at today's rate
+func (fx *fxConverter) convert(amount float64, currency string) (float64, error) {
+	rate, err := fx.rate(currency)
+	if err != nil {
+		return 0, err
+	}
+	return amount * rate, nil
+}
+
+// loadLotCosts reads the open lots of foreign assets and converts each at its acquisition date's rate,
+// keyed by asset id and by currency
+func (fx *fxConverter) loadLotCosts() error {
+	rows, err := fx.q.Query(`
+		SELECT tl.asset_id, COALESCE(a.currency, 'USD') as currency, tl.remaining_quantity * tl.unit_cost, tl.acquired_at
+		FROM tax_lots tl
+		JOIN assets a ON tl.asset_id = a.id
+		WHERE tl.portfolio_id = $1 AND tl.remaining_quantity > 0 AND COALESCE(a.currency, 'USD') <> $2
+	`, fx.portfolioID, fx.base)
+	if err != nil {
+		return fmt.Errorf("failed to query lot costs: %w", err)
+	}
+
+	type lotCost struct {
+		assetID, currency string
+		cost              float64
+		acquiredAt        time.Time
+	}
+	var lots []lotCost
+	for rows.Next() {
+		var lot lotCost
+		if err := rows.Scan(&lot.assetID, &lot.currency, &lot.cost, &lot.acquiredAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan lot cost: %w", err)
+		}
+		lots = append(lots, lot)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Rates are looked up once the rows are closed, so the querier can be a transaction
+	fx.lotCosts = map[string]foreignCost{}
+	for _, lot := range lots {
+		rate, err := fx.rateAt(lot.currency, lot.acquiredAt)
+		if err != nil {
+			return err
+		}
+		for _, key := range []string{lot.assetID, "currency:" + strings.ToUpper(lot.currency)} {
+			cost := fx.lotCosts[key]
+			cost.Local += lot.cost
+			cost.Base += lot.cost * rate
+			fx.lotCosts[key] = cost
+		}
+	}
+	return nil
+}
+
+// historicalCost converts a cost in currency into the base currency at the rates its lots were acquired
+// at, for one asset or, when assetID is empty, for every asset in that currency. Costs without lots to
+// date them are converted at today's rate.
+func (fx *fxConverter) historicalCost(assetID, currency string, localCost float64) (float64, error) {
+	currency = strings.ToUpper(currency)
+	if currency == "" || currency == fx.base {
+		return localCost, nil
+	}
+
+	if fx.lotCosts == nil {
+		if err := fx.loadLotCosts(); err != nil {
+			return 0, err
+		}
+	}
+
+	key := assetID
+	if key == "" {
+		key = "currency:" + currency
+	}
+	if cost, ok := fx.lotCosts[key]; ok && cost.Local > 0 {
+		return localCost * cost.Base / cost.Local, nil
+	}
+	return fx.convert(localCost, currency)
+}
+
+// value converts a holding's cost and market value in currency into the base currency
+func (fx *fxConverter) value(assetID, currency string, localCost, localMarketValue float64) (fxValuation, error) {
+	rate, err := fx.rate(currency)
+	if err != nil {
+		return fxValuation{}, err
+	}
+	costBasis, err := fx.historicalCost(assetID, currency, localCost)
+	if err != nil {
+		return fxValuation{}, err
+	}
+
+	return fxValuation{
+		Rate:          rate,
+		CostBasis:     costBasis,
+		MarketValue:   localMarketValue * rate,
+		PriceGainLoss: (localMarketValue - localCost) * rate,
+		FXGainLoss:    localCost*rate - costBasis,
+	}, nil
+}
+
+// Helper function to respond to a valuation that couldn't be converted into the base currency
+func (h *Handler) respondFXError(c *gin.Context, err error, message string) {
+	var rateErr *fxRateError
+	if errors.As(err, &rateErr) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":    "Missing exchange rate: " + rateErr.Error(),
+			"currency": rateErr.From,
+		})
+		return
+	}
+	h.logger.Error("Failed to convert to base currency", zap.Error(err))
+	c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+}
+
+// RefreshFXRates loads the configured FX source's current rates into fx_rates
+func (h *Handler) RefreshFXRates(c *gin.Context) {
+	if h.services.FX == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "FX rate source is not configured"})
+		return
+	}
+
+	stored, err := h.services.FX.Refresh(c.Request.Context())
+	if err != nil {
+		h.logger.Error("Failed to refresh FX rates", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh FX rates"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"source":       h.services.FX.Source(),
+		"rates_stored": stored,
+	})
+}
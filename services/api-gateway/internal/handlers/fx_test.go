@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/portfolio-management/api-gateway/internal/services"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// newPerformanceHoldingRows returns the columns of the performance holdings query
+func newPerformanceHoldingRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "asset_id", "symbol", "name", "currency", "quantity", "average_cost", "purchase_date", "cost_basis"})
+}
+
+// expectBaseCurrency expects the portfolio's base currency to be read
+func expectBaseCurrency(mock sqlmock.Sqlmock, portfolioID, currency string) {
+	mock.ExpectQuery(`SELECT base_currency FROM portfolios WHERE id = \$1`).
+		WithArgs(portfolioID).
+		WillReturnRows(sqlmock.NewRows([]string{"base_currency"}).AddRow(currency))
+}
+
+// expectFXRate expects the rate converting currency into base on day to be looked up
+func expectFXRate(mock sqlmock.Sqlmock, base, currency, day string, rate float64) {
+	rows := sqlmock.NewRows([]string{"rate"})
+	if rate > 0 {
+		rows.AddRow(rate)
+	}
+	mock.ExpectQuery(`SELECT rate FROM \( SELECT 1 / rate AS rate, rate_date FROM fx_rates (.+) ORDER BY rate_date DESC LIMIT 1`).
+		WithArgs(base, currency, day).
+		WillReturnRows(rows)
+}
+
+// expectLotCosts expects the open lots of a portfolio's foreign assets to be read
+func expectLotCosts(mock sqlmock.Sqlmock, portfolioID, base string, rows *sqlmock.Rows) {
+	mock.ExpectQuery(`SELECT tl.asset_id, COALESCE\(a.currency, 'USD'\) as currency, (.+) FROM tax_lots tl JOIN assets a ON tl.asset_id = a.id WHERE tl.portfolio_id = \$1 AND tl.remaining_quantity > 0 AND COALESCE\(a.currency, 'USD'\) <> \$2`).
+		WithArgs(portfolioID, base).
+		WillReturnRows(rows)
+}
+
+// TestGetPortfolioPerformance_ForeignCurrency tests that a EUR holding is valued in a USD portfolio
+// with its gain split into price and currency moves
+func TestGetPortfolioPerformance_ForeignCurrency(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	today := time.Now().Format("2006-01-02")
+
+	expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+	expectBaseCurrency(mock, testPortfolioID, "USD")
+	mock.ExpectQuery(`SELECT ph\.id, ph\.asset_id, (.+) FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = \$1 ORDER BY cost_basis DESC`).
+		WithArgs(testPortfolioID).
+		WillReturnRows(newPerformanceHoldingRows().
+			AddRow("1", testAssetID, "SAP", "SAP SE", "EUR", 10.0, 100.0, "2024-01-02", 1000.0))
+
+	// The EUR lot was bought when a euro cost 1.25 dollars; it costs 1.5 today
+	expectFXRate(mock, "USD", "EUR", today, 1.5)
+	expectLotCosts(mock, testPortfolioID, "USD", sqlmock.NewRows([]string{"asset_id", "currency", "cost", "acquired_at"}).
+		AddRow(testAssetID, "EUR", 1000.0, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)))
+	expectFXRate(mock, "USD", "EUR", "2024-01-02", 1.25)
+
+	expectCashBalances(mock, testPortfolioID, newCashBalanceRows().AddRow("EUR", 500.0))
+	mock.ExpectQuery(`SELECT (.+) FROM lot_disposals ld`).
+		WithArgs(testPortfolioID).
+		WillReturnRows(sqlmock.NewRows([]string{"currency", "realized", "cost_basis"}))
+	mock.ExpectQuery(`SELECT snapshot_date, (.+) FROM portfolio_snapshots`).
+		WithArgs(testPortfolioID).
+		WillReturnRows(sqlmock.NewRows([]string{"snapshot_date", "total_value", "total_cost", "unrealized_pnl", "realized_pnl"}))
+
+	router := createTestRouter(handler, "GET", "/portfolio/performance", handler.GetPortfolioPerformance)
+	req, _ := http.NewRequest("GET", "/portfolio/performance", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	for _, expected := range []string{`"base_currency":"USD"`, `"currency":"EUR"`, `"fx_rate":1.5`,
+		`"cost_basis":1250`, `"market_value":1500`, `"fx_gain_loss":250`, `"price_gain_loss":0`, `"total_value":2250`} {
+		assert.Contains(t, w.Body.String(), expected)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestGetPortfolioSummary_MissingFXRate tests that a holding without a rate into the base currency is reported
+func TestGetPortfolioSummary_MissingFXRate(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+	expectBaseCurrency(mock, testPortfolioID, "USD")
+	mock.ExpectQuery(`SELECT COALESCE\(a\.currency, 'USD'\) as currency, COUNT\(\*\) as total_holdings, (.+) GROUP BY`).
+		WithArgs(testPortfolioID).
+		WillReturnRows(sqlmock.NewRows([]string{"currency", "total_holdings", "total_cost", "total_shares"}).
+			AddRow("CHF", 1, 1000.0, 10.0))
+	expectLotCosts(mock, testPortfolioID, "USD", sqlmock.NewRows([]string{"asset_id", "currency", "cost", "acquired_at"}))
+	expectFXRate(mock, "USD", "CHF", time.Now().Format("2006-01-02"), 0)
+
+	router := createTestRouter(handler, "GET", "/portfolio/summary", handler.GetPortfolioSummary)
+	req, _ := http.NewRequest("GET", "/portfolio/summary", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "Missing exchange rate")
+	assert.Contains(t, w.Body.String(), `"currency":"CHF"`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestRefreshFXRates tests loading rates from the configured source
+func TestRefreshFXRates(t *testing.T) {
+	t.Run("stores the file source's rates", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		path := filepath.Join(t.TempDir(), "rates.json")
+		err := os.WriteFile(path, []byte(`{"base": "EUR", "date": "2024-03-01", "rates": {"USD": 1.08, "gbp": 0.85}}`), 0o600)
+		assert.NoError(t, err)
+		handler.services.FX = services.NewFXUpdater(handler.services.DB, services.NewFileFXSource(path), time.Hour, zap.NewNop())
+
+		mock.ExpectBegin()
+		for _, rate := range []struct {
+			currency string
+			rate     float64
+		}{{"EUR", 1}, {"GBP", 0.85}, {"USD", 1.08}} {
+			mock.ExpectExec(`INSERT INTO fx_rates \(base_currency, quote_currency, rate, rate_date, source\) VALUES \(\$1, \$2, \$3, \$4, \$5\) ON CONFLICT`).
+				WithArgs("EUR", rate.currency, rate.rate, "2024-03-01", "file").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		mock.ExpectCommit()
+
+		router := createTestRouter(handler, "POST", "/admin/fx/refresh", handler.RefreshFXRates)
+		req, _ := http.NewRequest("POST", "/admin/fx/refresh", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"rates_stored":3`)
+		assert.Contains(t, w.Body.String(), `"source":"file"`)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("invalid rate file", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		path := filepath.Join(t.TempDir(), "rates.json")
+		assert.NoError(t, os.WriteFile(path, []byte(`{"rates": {"USD": 1.08}}`), 0o600))
+		handler.services.FX = services.NewFXUpdater(handler.services.DB, services.NewFileFXSource(path), time.Hour, zap.NewNop())
+
+		router := createTestRouter(handler, "POST", "/admin/fx/refresh", handler.RefreshFXRates)
+		req, _ := http.NewRequest("POST", "/admin/fx/refresh", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("no FX source", func(t *testing.T) {
+		handler, _, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		router := createTestRouter(handler, "POST", "/admin/fx/refresh", handler.RefreshFXRates)
+		req, _ := http.NewRequest("POST", "/admin/fx/refresh", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+}
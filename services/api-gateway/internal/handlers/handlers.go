@@ -2,16 +2,21 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
 	"go.uber.org/zap"
 
+	"github.com/portfolio-management/api-gateway/internal/middleware"
 	"github.com/portfolio-management/api-gateway/internal/services"
 )
 
@@ -36,11 +41,21 @@ func NewHandler(services *services.Services, logger *zap.Logger) *Handler {
 
 // HealthCheck checks the health of the service
 func (h *Handler) HealthCheck(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
+	response := gin.H{
 		"status":  "healthy",
 		"service": "api-gateway",
 		"version": "1.0.0",
-	})
+	}
+
+	// A degraded provider is reported but doesn't fail the check: prices are served from the cache
+	if h.services.MarketData != nil {
+		response["market_data"] = gin.H{
+			"provider": h.services.MarketData.Name(),
+			"degraded": services.MarketDataDegraded(h.services.MarketData),
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 // Portfolio handlers
@@ -52,7 +67,19 @@ func (h *Handler) GetPortfolio(c *gin.Context) {
 		return
 	}
 
-	// Get default user's portfolio holdings
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
+		return
+	}
+
+	// Get the user's portfolio holdings
 	query := `
 		SELECT
 			ph.id,
@@ -64,12 +91,11 @@ func (h *Handler) GetPortfolio(c *gin.Context) {
 			ph.purchase_date
 		FROM portfolio_holdings ph
 		JOIN assets a ON ph.asset_id = a.id
-		JOIN users u ON ph.user_id = u.id
-		WHERE u.username = $1
+		WHERE ph.portfolio_id = $1
 		ORDER BY ph.created_at DESC
 	`
 
-	rows, err := h.services.DB.Query(query, "default_user")
+	rows, err := h.services.DB.Query(query, portfolioID)
 	if err != nil {
 		h.logger.Error("Failed to query portfolio", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch portfolio"})
@@ -114,47 +140,92 @@ func (h *Handler) GetPortfolioSummary(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
+		return
+	}
+
+	// Holdings are valued in the portfolio's base currency
+	fx, err := h.newFXConverter(h.services.DB, portfolioID)
 	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		h.logger.Error("Failed to load base currency", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch portfolio summary"})
 		return
 	}
 
-	// Get portfolio summary data
+	// Get portfolio summary data per currency
 	query := `
 		SELECT
+			COALESCE(a.currency, 'USD') as currency,
 			COUNT(*) as total_holdings,
 			COALESCE(SUM(ph.quantity * ph.average_cost), 0) as total_cost,
 			COALESCE(SUM(ph.quantity), 0) as total_shares
 		FROM portfolio_holdings ph
-		WHERE ph.user_id = $1
+		JOIN assets a ON ph.asset_id = a.id
+		WHERE ph.portfolio_id = $1
+		GROUP BY COALESCE(a.currency, 'USD')
 	`
 
-	var totalHoldings int
-	var totalCost, totalShares float64
-	err = h.services.DB.QueryRow(query, userID).Scan(&totalHoldings, &totalCost, &totalShares)
+	totalRows, err := h.services.DB.Query(query, portfolioID)
 	if err != nil {
 		h.logger.Error("Failed to query portfolio summary", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch portfolio summary"})
 		return
 	}
+	defer totalRows.Close()
+
+	// Cost is reported at the rates holdings were bought at; the difference to their cost at
+	// today's rates is the currency gain or loss
+	var totalHoldings int
+	var totalCost, totalCostToday, totalShares float64
+	for totalRows.Next() {
+		var currency string
+		var holdingsCount int
+		var cost, shares float64
+
+		if err := totalRows.Scan(&currency, &holdingsCount, &cost, &shares); err != nil {
+			h.logger.Error("Failed to scan portfolio summary row", zap.Error(err))
+			continue
+		}
+
+		historicalCost, err := fx.historicalCost("", currency, cost)
+		if err != nil {
+			h.respondFXError(c, err, "Failed to fetch portfolio summary")
+			return
+		}
+		costToday, err := fx.convert(cost, currency)
+		if err != nil {
+			h.respondFXError(c, err, "Failed to fetch portfolio summary")
+			return
+		}
+
+		totalHoldings += holdingsCount
+		totalShares += shares
+		totalCost += historicalCost
+		totalCostToday += costToday
+	}
 
 	// Get asset allocation by type
 	allocationQuery := `
 		SELECT
 			a.asset_type,
+			COALESCE(a.currency, 'USD') as currency,
 			COUNT(*) as count,
 			COALESCE(SUM(ph.quantity * ph.average_cost), 0) as total_value
 		FROM portfolio_holdings ph
 		JOIN assets a ON ph.asset_id = a.id
-		WHERE ph.user_id = $1
-		GROUP BY a.asset_type
+		WHERE ph.portfolio_id = $1
+		GROUP BY a.asset_type, COALESCE(a.currency, 'USD')
 		ORDER BY total_value DESC
 	`
 
-	rows, err := h.services.DB.Query(allocationQuery, userID)
+	rows, err := h.services.DB.Query(allocationQuery, portfolioID)
 	if err != nil {
 		h.logger.Error("Failed to query asset allocation", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch portfolio summary"})
@@ -163,46 +234,57 @@ func (h *Handler) GetPortfolioSummary(c *gin.Context) {
 	defer rows.Close()
 
 	var allocations []map[string]interface{}
+	allocationIndex := map[string]int{}
 	for rows.Next() {
-		var assetType string
+		var assetType, currency string
 		var count int
 		var totalValue float64
 
-		err := rows.Scan(&assetType, &count, &totalValue)
+		err := rows.Scan(&assetType, &currency, &count, &totalValue)
 		if err != nil {
 			h.logger.Error("Failed to scan allocation row", zap.Error(err))
 			continue
 		}
 
-		percentage := 0.0
-		if totalCost > 0 {
-			percentage = (totalValue / totalCost) * 100
+		totalValue, err = fx.convert(totalValue, currency)
+		if err != nil {
+			h.respondFXError(c, err, "Failed to fetch portfolio summary")
+			return
 		}
 
+		// Asset types held in several currencies are merged
+		if i, ok := allocationIndex[assetType]; ok {
+			allocations[i]["count"] = allocations[i]["count"].(int) + count
+			allocations[i]["total_value"] = allocations[i]["total_value"].(float64) + totalValue
+			continue
+		}
+		allocationIndex[assetType] = len(allocations)
 		allocations = append(allocations, map[string]interface{}{
 			"asset_type":  assetType,
 			"count":       count,
 			"total_value": totalValue,
-			"percentage":  percentage,
 		})
 	}
+	sort.SliceStable(allocations, func(i, j int) bool {
+		return allocations[i]["total_value"].(float64) > allocations[j]["total_value"].(float64)
+	})
 
-	// Get top holdings
+	// Get holdings by cost
 	topHoldingsQuery := `
 		SELECT
 			a.symbol,
 			a.name,
+			COALESCE(a.currency, 'USD') as currency,
 			ph.quantity,
 			ph.average_cost,
 			(ph.quantity * ph.average_cost) as total_value
 		FROM portfolio_holdings ph
 		JOIN assets a ON ph.asset_id = a.id
-		WHERE ph.user_id = $1
+		WHERE ph.portfolio_id = $1
 		ORDER BY (ph.quantity * ph.average_cost) DESC
-		LIMIT 5
 	`
 
-	topRows, err := h.services.DB.Query(topHoldingsQuery, userID)
+	topRows, err := h.services.DB.Query(topHoldingsQuery, portfolioID)
 	if err != nil {
 		h.logger.Error("Failed to query top holdings", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch portfolio summary"})
@@ -210,67 +292,104 @@ func (h *Handler) GetPortfolioSummary(c *gin.Context) {
 	}
 	defer topRows.Close()
 
+	// Calculate portfolio market value and daily change using real-time prices, falling back to
+	// cost for holdings without a quote
 	var topHoldings []map[string]interface{}
+	var totalMarketValue float64
+	var totalDailyChange float64
+	var portfolioDailyChangePercent float64
+	var stalePrices []string
+
 	for topRows.Next() {
-		var symbol, name string
+		var symbol, name, currency string
 		var quantity, averageCost, totalValue float64
 
-		err := topRows.Scan(&symbol, &name, &quantity, &averageCost, &totalValue)
+		err := topRows.Scan(&symbol, &name, &currency, &quantity, &averageCost, &totalValue)
 		if err != nil {
 			h.logger.Error("Failed to scan top holding row", zap.Error(err))
 			continue
 		}
 
+		rate, err := fx.rate(currency)
+		if err != nil {
+			h.respondFXError(c, err, "Failed to fetch portfolio summary")
+			return
+		}
+
+		marketValue := totalValue * rate
+		if h.services.MarketData != nil {
+			if quote, priceErr := h.services.MarketData.GetQuote(symbol); priceErr == nil {
+				marketValue = quantity * quote.CurrentPrice * rate
+				totalDailyChange += quantity * quote.Change * rate
+				if quote.Stale {
+					stalePrices = append(stalePrices, symbol)
+				}
+			}
+		}
+		totalMarketValue += marketValue
+
 		topHoldings = append(topHoldings, map[string]interface{}{
 			"symbol":       symbol,
 			"name":         name,
+			"currency":     currency,
+			"fx_rate":      rate,
 			"quantity":     quantity,
 			"average_cost": averageCost,
-			"total_value":  totalValue,
+			"total_value":  totalValue * rate,
 		})
 	}
 
-	// Calculate portfolio daily change using real-time prices
-	var totalMarketValue float64
-	var totalDailyChange float64
-	var portfolioDailyChangePercent float64
-
-	if h.services.Finnhub != nil {
-		for _, holding := range topHoldings {
-			symbol := holding["symbol"].(string)
-			quantity := holding["quantity"].(float64)
-
-			if quote, priceErr := h.services.Finnhub.GetQuote(symbol); priceErr == nil {
-				currentPrice := quote.CurrentPrice
-				dailyChange := quote.Change
+	// Only the largest holdings by cost in the base currency are listed
+	sort.SliceStable(topHoldings, func(i, j int) bool {
+		return topHoldings[i]["total_value"].(float64) > topHoldings[j]["total_value"].(float64)
+	})
+	if len(topHoldings) > 5 {
+		topHoldings = topHoldings[:5]
+	}
 
-				// Add to portfolio totals
-				holdingMarketValue := quantity * currentPrice
-				holdingDailyChange := quantity * dailyChange
+	// Calculate portfolio daily change percentage
+	if totalMarketValue > 0 {
+		portfolioDailyChangePercent = (totalDailyChange / (totalMarketValue - totalDailyChange)) * 100
+	}
 
-				totalMarketValue += holdingMarketValue
-				totalDailyChange += holdingDailyChange
-			} else {
-				// Fallback to cost basis if price unavailable
-				totalMarketValue += holding["total_value"].(float64)
-			}
-		}
+	// Cash counts towards the portfolio's value and allocation
+	cashBalances, cashTotal, err := h.getCashBalances(h.services.DB, portfolioID, fx)
+	if err != nil {
+		h.logger.Warn("Failed to query cash balances", zap.Error(err))
+		// Continue with holdings only
+	}
+	if cashTotal != 0 {
+		allocations = append(allocations, map[string]interface{}{
+			"asset_type":  "CASH",
+			"count":       len(cashBalances),
+			"total_value": cashTotal,
+		})
+	}
 
-		// Calculate portfolio daily change percentage
-		if totalMarketValue > 0 {
-			portfolioDailyChangePercent = (totalDailyChange / (totalMarketValue - totalDailyChange)) * 100
+	// Calculate allocation percentages
+	var allocationTotal float64
+	for _, allocation := range allocations {
+		allocationTotal += allocation["total_value"].(float64)
+	}
+	for i := range allocations {
+		if allocationTotal > 0 {
+			value := allocations[i]["total_value"].(float64)
+			allocations[i]["percentage"] = (value / allocationTotal) * 100
+		} else {
+			allocations[i]["percentage"] = 0.0
 		}
-	} else {
-		// Finnhub not available, use cost basis
-		totalMarketValue = totalCost
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	response := gin.H{
 		"summary": map[string]interface{}{
+			"base_currency":        fx.base,
 			"total_holdings":       totalHoldings,
 			"total_cost":           totalCost,
 			"total_shares":         totalShares,
 			"total_market_value":   totalMarketValue,
+			"cash_balance":         cashTotal,
+			"cash_balances":        cashBalances,
+			"total_value":          totalMarketValue + cashTotal,
 			"daily_change":         totalDailyChange,
 			"daily_change_percent": portfolioDailyChangePercent,
 			"unrealized_gain_loss": totalMarketValue - totalCost,
@@ -280,10 +399,19 @@ func (h *Handler) GetPortfolioSummary(c *gin.Context) {
 				}
 				return 0.0
 			}(),
+			"price_gain_loss": totalMarketValue - totalCostToday,
+			"fx_gain_loss":    totalCostToday - totalCost,
 		},
 		"asset_allocation": allocations,
 		"top_holdings":     topHoldings,
-	})
+	}
+
+	// Prices served from the cache because the market data provider is unavailable
+	if len(stalePrices) > 0 {
+		response["stale_prices"] = stalePrices
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 func (h *Handler) GetPortfolioPerformance(c *gin.Context) {
@@ -295,34 +423,47 @@ func (h *Handler) GetPortfolioPerformance(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
-	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
 		return
 	}
 
 	// Get query parameters
 	period := c.DefaultQuery("period", "1d") // 1d, 7d, 30d, 90d, 1y, all
 
+	// Holdings are valued in the portfolio's base currency
+	fx, err := h.newFXConverter(h.services.DB, portfolioID)
+	if err != nil {
+		h.logger.Error("Failed to load base currency", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch portfolio performance"})
+		return
+	}
+
 	// Get all portfolio holdings with current prices
 	holdingsQuery := `
 		SELECT
 			ph.id,
+			ph.asset_id,
 			a.symbol,
 			a.name,
+			COALESCE(a.currency, 'USD') as currency,
 			ph.quantity,
 			ph.average_cost,
 			ph.purchase_date,
 			(ph.quantity * ph.average_cost) as cost_basis
 		FROM portfolio_holdings ph
 		JOIN assets a ON ph.asset_id = a.id
-		WHERE ph.user_id = $1
+		WHERE ph.portfolio_id = $1
 		ORDER BY cost_basis DESC
 	`
 
-	rows, err := h.services.DB.Query(holdingsQuery, userID)
+	rows, err := h.services.DB.Query(holdingsQuery, portfolioID)
 	if err != nil {
 		h.logger.Error("Failed to query portfolio holdings", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch portfolio performance"})
@@ -333,31 +474,38 @@ func (h *Handler) GetPortfolioPerformance(c *gin.Context) {
 	var holdings []map[string]interface{}
 	var totalCostBasis float64
 	var totalCurrentValue float64
+	var totalPriceGainLoss, totalFXGainLoss float64
 	var portfolioErrors []string
+	var stalePrices []string
 
 	// Process each holding and get real-time prices
 	for rows.Next() {
-		var id, symbol, name, purchaseDate string
+		var id, assetID, symbol, name, currency, purchaseDate string
 		var quantity, averageCost, costBasis float64
 
-		err := rows.Scan(&id, &symbol, &name, &quantity, &averageCost, &purchaseDate, &costBasis)
+		err := rows.Scan(&id, &assetID, &symbol, &name, &currency, &quantity, &averageCost, &purchaseDate, &costBasis)
 		if err != nil {
 			h.logger.Error("Failed to scan holding row", zap.Error(err))
 			continue
 		}
 
-		// Get current price from Finnhub
+		// Get current price from the market data provider
 		var currentPrice float64
 		var change float64
 		var changePercent float64
 		var marketValue float64
+		var priceStale bool
 
-		if h.services.Finnhub != nil {
-			if quote, priceErr := h.services.Finnhub.GetQuote(symbol); priceErr == nil {
+		if h.services.MarketData != nil {
+			if quote, priceErr := h.services.MarketData.GetQuote(symbol); priceErr == nil {
 				currentPrice = quote.CurrentPrice
 				change = quote.Change
 				changePercent = quote.PercentChange
 				marketValue = quantity * currentPrice
+				priceStale = quote.Stale
+				if priceStale {
+					stalePrices = append(stalePrices, symbol)
+				}
 			} else {
 				h.logger.Warn("Failed to fetch price for symbol", zap.String("symbol", symbol), zap.Error(priceErr))
 				portfolioErrors = append(portfolioErrors, fmt.Sprintf("Could not fetch price for %s", symbol))
@@ -368,34 +516,48 @@ func (h *Handler) GetPortfolioPerformance(c *gin.Context) {
 				changePercent = 0
 			}
 		} else {
-			// Finnhub not available, use cost basis
+			// Market data not available, use cost basis
 			currentPrice = averageCost
 			marketValue = costBasis
 			change = 0
 			changePercent = 0
 		}
 
+		// Prices are in the asset's currency; value and cost are converted into the base currency
+		valuation, err := fx.value(assetID, currency, costBasis, marketValue)
+		if err != nil {
+			h.respondFXError(c, err, "Failed to fetch portfolio performance")
+			return
+		}
+
 		// Calculate holding performance
-		gainLoss := marketValue - costBasis
+		gainLoss := valuation.PriceGainLoss + valuation.FXGainLoss
 		gainLossPercent := 0.0
-		if costBasis > 0 {
-			gainLossPercent = (gainLoss / costBasis) * 100
+		if valuation.CostBasis > 0 {
+			gainLossPercent = (gainLoss / valuation.CostBasis) * 100
 		}
 
-		totalCostBasis += costBasis
-		totalCurrentValue += marketValue
+		totalCostBasis += valuation.CostBasis
+		totalCurrentValue += valuation.MarketValue
+		totalPriceGainLoss += valuation.PriceGainLoss
+		totalFXGainLoss += valuation.FXGainLoss
 
 		holdings = append(holdings, map[string]interface{}{
 			"id":                           id,
 			"symbol":                       symbol,
 			"name":                         name,
+			"currency":                     currency,
+			"fx_rate":                      valuation.Rate,
 			"quantity":                     quantity,
 			"average_cost":                 averageCost,
 			"current_price":                currentPrice,
-			"cost_basis":                   costBasis,
-			"market_value":                 marketValue,
+			"price_stale":                  priceStale,
+			"cost_basis":                   valuation.CostBasis,
+			"market_value":                 valuation.MarketValue,
 			"unrealized_gain_loss":         gainLoss,
 			"unrealized_gain_loss_percent": gainLossPercent,
+			"price_gain_loss":              valuation.PriceGainLoss,
+			"fx_gain_loss":                 valuation.FXGainLoss,
 			"daily_change":                 change,
 			"daily_change_percent":         changePercent,
 			"purchase_date":                purchaseDate,
@@ -403,11 +565,19 @@ func (h *Handler) GetPortfolioPerformance(c *gin.Context) {
 		})
 	}
 
+	// Cash is part of the portfolio's value, so holdings are weighted against it too
+	cashBalances, cashTotal, err := h.getCashBalances(h.services.DB, portfolioID, fx)
+	if err != nil {
+		h.logger.Warn("Failed to query cash balances", zap.Error(err))
+		// Continue with holdings only
+	}
+	totalValue := totalCurrentValue + cashTotal
+
 	// Calculate portfolio weights
 	for i := range holdings {
-		if totalCurrentValue > 0 {
+		if totalValue > 0 {
 			marketValue := holdings[i]["market_value"].(float64)
-			holdings[i]["weight_percent"] = (marketValue / totalCurrentValue) * 100
+			holdings[i]["weight_percent"] = (marketValue / totalValue) * 100
 		}
 	}
 
@@ -418,14 +588,30 @@ func (h *Handler) GetPortfolioPerformance(c *gin.Context) {
 		totalGainLossPercent = (totalGainLoss / totalCostBasis) * 100
 	}
 
+	// Add gains and losses already realized by sales
+	realizedGainLoss, realizedCostBasis, err := h.getRealizedTotals(portfolioID, fx)
+	if err != nil {
+		h.logger.Warn("Failed to query realized P&L", zap.Error(err))
+		// Continue with unrealized returns only
+	}
+	realizedGainLossPercent := 0.0
+	if realizedCostBasis > 0 {
+		realizedGainLossPercent = (realizedGainLoss / realizedCostBasis) * 100
+	}
+	totalReturn := totalGainLoss + realizedGainLoss
+	totalReturnPercent := 0.0
+	if totalCostBasis+realizedCostBasis > 0 {
+		totalReturnPercent = (totalReturn / (totalCostBasis + realizedCostBasis)) * 100
+	}
+
 	// Get historical performance for the requested period
 	var historicalPerformance []map[string]interface{}
 
 	// Query portfolio snapshots if available
 	snapshotQuery := `
-		SELECT snapshot_date, total_value, total_cost, unrealized_pnl
+		SELECT snapshot_date, total_value, total_cost, unrealized_pnl, realized_pnl
 		FROM portfolio_snapshots
-		WHERE user_id = $1 AND snapshot_date >= CURRENT_DATE - INTERVAL '%s'
+		WHERE portfolio_id = $1 AND snapshot_date >= CURRENT_DATE - INTERVAL '%s'
 		ORDER BY snapshot_date ASC
 	`
 
@@ -445,15 +631,15 @@ func (h *Handler) GetPortfolioPerformance(c *gin.Context) {
 		intervalClause = "1 day"
 	}
 
-	histRows, err := h.services.DB.Query(fmt.Sprintf(snapshotQuery, intervalClause), userID)
+	histRows, err := h.services.DB.Query(fmt.Sprintf(snapshotQuery, intervalClause), portfolioID)
 	if err != nil {
 		h.logger.Warn("Failed to query historical snapshots", zap.Error(err))
 		// Continue without historical data
 	} else {
 		defer histRows.Close()
 		for histRows.Next() {
-			var snapshotDate, totalValue, totalCost, unrealizedPnl interface{}
-			err := histRows.Scan(&snapshotDate, &totalValue, &totalCost, &unrealizedPnl)
+			var snapshotDate, totalValue, totalCost, unrealizedPnl, realizedPnl interface{}
+			err := histRows.Scan(&snapshotDate, &totalValue, &totalCost, &unrealizedPnl, &realizedPnl)
 			if err != nil {
 				h.logger.Error("Failed to scan snapshot row", zap.Error(err))
 				continue
@@ -464,20 +650,31 @@ func (h *Handler) GetPortfolioPerformance(c *gin.Context) {
 				"portfolio_value": totalValue,
 				"cost_basis":      totalCost,
 				"unrealized_pnl":  unrealizedPnl,
+				"realized_pnl":    realizedPnl,
 			})
 		}
 	}
 
 	// Calculate additional performance metrics
 	performanceMetrics := map[string]interface{}{
-		"total_return":         totalGainLoss,
-		"total_return_percent": totalGainLossPercent,
-		"total_cost_basis":     totalCostBasis,
-		"total_market_value":   totalCurrentValue,
-		"number_of_holdings":   len(holdings),
-		"largest_holding":      "",
-		"largest_gain":         "",
-		"largest_loss":         "",
+		"total_return":              totalReturn,
+		"total_return_percent":      totalReturnPercent,
+		"unrealized_return":         totalGainLoss,
+		"unrealized_return_percent": totalGainLossPercent,
+		"price_gain_loss":           totalPriceGainLoss,
+		"fx_gain_loss":              totalFXGainLoss,
+		"realized_return":           realizedGainLoss,
+		"realized_return_percent":   realizedGainLossPercent,
+		"base_currency":             fx.base,
+		"total_cost_basis":          totalCostBasis,
+		"total_market_value":        totalCurrentValue,
+		"cash_balance":              cashTotal,
+		"cash_balances":             cashBalances,
+		"total_value":               totalValue,
+		"number_of_holdings":        len(holdings),
+		"largest_holding":           "",
+		"largest_gain":              "",
+		"largest_loss":              "",
 	}
 
 	// Find best and worst performers
@@ -517,15 +714,12 @@ func (h *Handler) GetPortfolioPerformance(c *gin.Context) {
 			largestLoss["symbol"], largestLoss["unrealized_gain_loss"], largestLoss["unrealized_gain_loss_percent"])
 	}
 
-	// Create current portfolio snapshot for tracking
-	if len(holdings) > 0 {
-		_, err = h.services.DB.Exec(`
-			INSERT INTO portfolio_snapshots (user_id, total_value, total_cost, unrealized_pnl)
-			VALUES ($1, $2, $3, $4)
-		`, userID, totalCurrentValue, totalCostBasis, totalGainLoss)
-		if err != nil {
-			h.logger.Warn("Failed to create portfolio snapshot", zap.Error(err))
-		}
+	// Time- and money-weighted returns account for deposits, withdrawals and sales, unlike the
+	// returns on cost above
+	returns, err := h.getPortfolioReturns(portfolioID)
+	if err != nil {
+		h.logger.Warn("Failed to calculate portfolio returns", zap.Error(err))
+		// Continue without them
 	}
 
 	response := gin.H{
@@ -536,18 +730,27 @@ func (h *Handler) GetPortfolioPerformance(c *gin.Context) {
 		"last_updated":           fmt.Sprintf("%d", time.Now().Unix()),
 	}
 
+	if returns != nil {
+		response["returns"] = returns
+	}
 	if len(portfolioErrors) > 0 {
 		response["warnings"] = portfolioErrors
 	}
+	if len(stalePrices) > 0 {
+		response["stale_prices"] = stalePrices
+	}
 
 	c.JSON(http.StatusOK, response)
 }
 
 func (h *Handler) AddHolding(c *gin.Context) {
 	var request struct {
+		PortfolioID string  `json:"portfolio_id"`
 		Symbol      string  `json:"symbol" binding:"required"`
 		Quantity    float64 `json:"quantity" binding:"required,gt=0"`
 		AverageCost float64 `json:"average_cost" binding:"required,gt=0"`
+		// Trading currency of a new asset; the average cost is in it
+		Currency string `json:"currency" binding:"omitempty,len=3"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -563,34 +766,29 @@ func (h *Handler) AddHolding(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
-	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, request.PortfolioID)
+	if !ok {
 		return
 	}
 
 	// Get or create asset
 	var assetID string
-	err = h.services.DB.QueryRow("SELECT id FROM assets WHERE symbol = $1", request.Symbol).Scan(&assetID)
-	if err != nil {
-		// Asset doesn't exist, create it with real company data from Finnhub
-		assetName := request.Symbol // fallback to symbol
-		if h.services.Finnhub != nil {
-			if profile, err := h.services.Finnhub.GetCompanyProfile(request.Symbol); err == nil && profile.Name != "" {
-				assetName = profile.Name
-				h.logger.Info("Fetched company name from Finnhub", zap.String("symbol", request.Symbol), zap.String("name", assetName))
-			} else {
-				h.logger.Warn("Failed to fetch company profile from Finnhub, using symbol as name", zap.String("symbol", request.Symbol), zap.Error(err))
-			}
-		}
+	err := h.services.DB.QueryRow("SELECT id FROM assets WHERE symbol = $1", request.Symbol).Scan(&assetID)
+	if err != nil {
+		// Asset doesn't exist, create it with company data from the market data provider
+		assetName, currency := h.describeNewAsset(request.Symbol, request.Currency)
 
 		err = h.services.DB.QueryRow(`
 			INSERT INTO assets (symbol, name, asset_type, currency)
-			VALUES ($1, $2, 'STOCK', 'USD')
+			VALUES ($1, $2, 'STOCK', $3)
 			RETURNING id
-		`, request.Symbol, assetName).Scan(&assetID)
+		`, request.Symbol, assetName, currency).Scan(&assetID)
 		if err != nil {
 			h.logger.Error("Failed to create asset", zap.Error(err))
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create asset"})
@@ -598,34 +796,44 @@ func (h *Handler) AddHolding(c *gin.Context) {
 		}
 	}
 
-	// Insert or update holding
-	_, err = h.services.DB.Exec(`
-		INSERT INTO portfolio_holdings (user_id, asset_id, quantity, average_cost)
-		VALUES ($1, $2, $3, $4)
-		ON CONFLICT (user_id, asset_id)
-		DO UPDATE SET
-			quantity = portfolio_holdings.quantity + EXCLUDED.quantity,
-			average_cost = ((portfolio_holdings.quantity * portfolio_holdings.average_cost) +
-							(EXCLUDED.quantity * EXCLUDED.average_cost)) /
-							(portfolio_holdings.quantity + EXCLUDED.quantity),
-			updated_at = NOW()
-	`, userID, assetID, request.Quantity, request.AverageCost)
-
-	if err != nil {
-		h.logger.Error("Failed to add holding", zap.Error(err))
+	// Holdings are derived from the ledger, so adding one records a purchase at the given cost
+	tx, err := h.services.DB.Begin()
+	if err != nil {
+		h.logger.Error("Failed to begin transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add holding"})
+		return
+	}
+	defer tx.Rollback()
+
+	// The position is funded by a matching deposit, so adding it doesn't draw on cash
+	if err = h.fundHolding(tx, userID, portfolioID, assetID, request.Quantity*request.AverageCost); err != nil {
+		h.logger.Error("Failed to fund holding", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add holding"})
+		return
+	}
+
+	err = h.recordLedgerEntry(tx, userID, portfolioID, assetID, transactionBuy, request.Quantity, request.AverageCost, "Added from holdings")
+	if err != nil {
+		h.respondLedgerError(c, err, "Failed to add holding")
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		h.logger.Error("Failed to commit transaction", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add holding"})
 		return
 	}
 
 	c.JSON(http.StatusCreated, gin.H{
 		"message":      "Holding added successfully",
+		"portfolio_id": portfolioID,
 		"symbol":       request.Symbol,
 		"quantity":     request.Quantity,
 		"average_cost": request.AverageCost,
 	})
 
 	// Broadcast portfolio update and price update via WebSocket
-	go h.broadcastPortfolioUpdate("default_user")
+	go h.broadcastPortfolioUpdate(userID, portfolioID)
 	go h.broadcastPriceUpdate(request.Symbol)
 }
 
@@ -660,23 +868,20 @@ func (h *Handler) UpdateHolding(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
-	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+	userID, ok := h.requireUserID(c)
+	if !ok {
 		return
 	}
 
 	// Check if holding exists and belongs to the user
 	var existingQuantity, existingCost float64
-	var assetSymbol string
-	err = h.services.DB.QueryRow(`
-		SELECT ph.quantity, ph.average_cost, a.symbol
+	var assetSymbol, portfolioID, assetID string
+	err := h.services.DB.QueryRow(`
+		SELECT ph.quantity, ph.average_cost, a.symbol, ph.portfolio_id, ph.asset_id
 		FROM portfolio_holdings ph
 		JOIN assets a ON ph.asset_id = a.id
 		WHERE ph.id = $1 AND ph.user_id = $2
-	`, holdingID, userID).Scan(&existingQuantity, &existingCost, &assetSymbol)
+	`, holdingID, userID).Scan(&existingQuantity, &existingCost, &assetSymbol, &portfolioID, &assetID)
 	if err != nil {
 		h.logger.Error("Failed to find holding", zap.Error(err))
 		c.JSON(http.StatusNotFound, gin.H{"error": "Holding not found"})
@@ -693,15 +898,23 @@ func (h *Handler) UpdateHolding(c *gin.Context) {
 		newCost = *request.AverageCost
 	}
 
-	// Update the holding
-	_, err = h.services.DB.Exec(`
-		UPDATE portfolio_holdings
-		SET quantity = $1, average_cost = $2, updated_at = NOW()
-		WHERE id = $3 AND user_id = $4
-	`, newQuantity, newCost, holdingID, userID)
+	// Record the edit in the ledger as a restatement of the position
+	tx, err := h.services.DB.Begin()
+	if err != nil {
+		h.logger.Error("Failed to begin transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update holding"})
+		return
+	}
+	defer tx.Rollback()
 
+	err = h.recordLedgerEntry(tx, userID, portfolioID, assetID, transactionAdjust, newQuantity, newCost, "Holding updated")
 	if err != nil {
-		h.logger.Error("Failed to update holding", zap.Error(err))
+		h.respondLedgerError(c, err, "Failed to update holding")
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		h.logger.Error("Failed to commit transaction", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update holding"})
 		return
 	}
@@ -715,7 +928,7 @@ func (h *Handler) UpdateHolding(c *gin.Context) {
 	})
 
 	// Broadcast portfolio update and price update via WebSocket
-	go h.broadcastPortfolioUpdate("default_user")
+	go h.broadcastPortfolioUpdate(userID, portfolioID)
 	go h.broadcastPriceUpdate(assetSymbol)
 }
 
@@ -734,51 +947,44 @@ func (h *Handler) RemoveHolding(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
-	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+	userID, ok := h.requireUserID(c)
+	if !ok {
 		return
 	}
 
 	// Check if holding exists and belongs to the user, and get asset symbol for response
-	var assetSymbol string
+	var assetSymbol, portfolioID, assetID string
 	var quantity float64
-	err = h.services.DB.QueryRow(`
-		SELECT a.symbol, ph.quantity
+	err := h.services.DB.QueryRow(`
+		SELECT a.symbol, ph.quantity, ph.portfolio_id, ph.asset_id
 		FROM portfolio_holdings ph
 		JOIN assets a ON ph.asset_id = a.id
 		WHERE ph.id = $1 AND ph.user_id = $2
-	`, holdingID, userID).Scan(&assetSymbol, &quantity)
+	`, holdingID, userID).Scan(&assetSymbol, &quantity, &portfolioID, &assetID)
 	if err != nil {
 		h.logger.Error("Failed to find holding", zap.Error(err))
 		c.JSON(http.StatusNotFound, gin.H{"error": "Holding not found"})
 		return
 	}
 
-	// Delete the holding
-	result, err := h.services.DB.Exec(`
-		DELETE FROM portfolio_holdings
-		WHERE id = $1 AND user_id = $2
-	`, holdingID, userID)
-
+	// Record the removal in the ledger as a restatement to zero
+	tx, err := h.services.DB.Begin()
 	if err != nil {
-		h.logger.Error("Failed to delete holding", zap.Error(err))
+		h.logger.Error("Failed to begin transaction", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove holding"})
 		return
 	}
+	defer tx.Rollback()
 
-	// Check if any rows were affected
-	rowsAffected, err := result.RowsAffected()
+	err = h.recordLedgerEntry(tx, userID, portfolioID, assetID, transactionAdjust, 0, 0, "Holding removed")
 	if err != nil {
-		h.logger.Error("Failed to get rows affected", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove holding"})
+		h.respondLedgerError(c, err, "Failed to remove holding")
 		return
 	}
 
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Holding not found"})
+	if err = tx.Commit(); err != nil {
+		h.logger.Error("Failed to commit transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove holding"})
 		return
 	}
 
@@ -790,7 +996,7 @@ func (h *Handler) RemoveHolding(c *gin.Context) {
 	})
 
 	// Broadcast portfolio update via WebSocket
-	go h.broadcastPortfolioUpdate("default_user")
+	go h.broadcastPortfolioUpdate(userID, portfolioID)
 }
 
 // Market data handlers
@@ -947,14 +1153,18 @@ func (h *Handler) GetCurrentPrice(c *gin.Context) {
 		return
 	}
 
-	if h.services.Finnhub == nil {
+	if h.services.MarketData == nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Market data service not available"})
 		return
 	}
 
-	quote, err := h.services.Finnhub.GetQuote(symbol)
+	quote, err := h.services.MarketData.GetQuote(symbol)
 	if err != nil {
-		h.logger.Error("Failed to fetch quote from Finnhub", zap.String("symbol", symbol), zap.Error(err))
+		h.logger.Error("Failed to fetch quote", zap.String("symbol", symbol), zap.Error(err))
+		if errors.Is(err, services.ErrProviderDegraded) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Market data provider is degraded"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch current price"})
 		return
 	}
@@ -969,6 +1179,7 @@ func (h *Handler) GetCurrentPrice(c *gin.Context) {
 		"open":           quote.OpenPriceOfDay,
 		"previous_close": quote.PreviousClosePrice,
 		"timestamp":      quote.Timestamp,
+		"stale":          quote.Stale,
 	})
 }
 
@@ -987,13 +1198,53 @@ func (h *Handler) GetPriceHistory(c *gin.Context) {
 	}
 
 	// Get query parameters
-	period := c.DefaultQuery("period", "30d")    // 7d, 30d, 90d, 1y, etc.
-	interval := c.DefaultQuery("interval", "1d") // 1d, 1h, etc.
-	limit := c.DefaultQuery("limit", "100")
+	period := c.DefaultQuery("period", "30d")    // 7d, 30d, 90d, 1y, ytd, 5y, max
+	interval := c.DefaultQuery("interval", "1d") // 1d, 1w, 1mo
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+
+	resolution, ok := priceHistoryResolution(interval)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid interval, expected 1d, 1w or 1mo (only daily history is stored)"})
+		return
+	}
+
+	// The period counts back from to, today by default, and an explicit from takes precedence over it
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	if value := c.Query("to"); value != "" {
+		if to, err = time.Parse("2006-01-02", value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date, expected YYYY-MM-DD"})
+			return
+		}
+	}
+	from, ok := priceHistoryStart(period, to)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid period, expected 7d, 30d, 90d, 1y, ytd, 5y or max"})
+		return
+	}
+	if value := c.Query("from"); value != "" {
+		if from, err = time.Parse("2006-01-02", value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date, expected YYYY-MM-DD"})
+			return
+		}
+	}
+	if from.After(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must not be after to"})
+		return
+	}
+
+	series, err := parseDerivedSeries(c.Query("series"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	// Get asset ID first
 	var assetID string
-	err := h.services.DB.QueryRow("SELECT id FROM assets WHERE symbol = $1", symbol).Scan(&assetID)
+	err = h.services.DB.QueryRow("SELECT id FROM assets WHERE symbol = $1", symbol).Scan(&assetID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Asset not found"})
@@ -1004,31 +1255,14 @@ func (h *Handler) GetPriceHistory(c *gin.Context) {
 		return
 	}
 
-	// Build date filter based on period
-	var dateFilter string
-	switch period {
-	case "7d":
-		dateFilter = "date >= CURRENT_DATE - INTERVAL '7 days'"
-	case "30d":
-		dateFilter = "date >= CURRENT_DATE - INTERVAL '30 days'"
-	case "90d":
-		dateFilter = "date >= CURRENT_DATE - INTERVAL '90 days'"
-	case "1y":
-		dateFilter = "date >= CURRENT_DATE - INTERVAL '1 year'"
-	default:
-		dateFilter = "date >= CURRENT_DATE - INTERVAL '30 days'"
-	}
-
-	// Query price history
-	query := fmt.Sprintf(`
+	// The whole range is read so that resampled candles and derived series are complete; the limit
+	// applies to the points returned
+	rows, err := h.services.DB.Query(`
 		SELECT date, open_price, high_price, low_price, close_price, volume
 		FROM price_history
-		WHERE asset_id = $1 AND %s
-		ORDER BY date DESC
-		LIMIT $2
-	`, dateFilter)
-
-	rows, err := h.services.DB.Query(query, assetID, limit)
+		WHERE asset_id = $1 AND date >= $2 AND date <= $3
+		ORDER BY date ASC
+	`, assetID, from.Format("2006-01-02"), to.Format("2006-01-02"))
 	if err != nil {
 		h.logger.Error("Failed to query price history", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch price history"})
@@ -1036,38 +1270,74 @@ func (h *Handler) GetPriceHistory(c *gin.Context) {
 	}
 	defer rows.Close()
 
-	var priceHistory []map[string]interface{}
+	var candles []services.Candle
 	for rows.Next() {
-		var date, openPrice, highPrice, lowPrice, closePrice, volume interface{}
+		var date time.Time
+		var openPrice, highPrice, lowPrice sql.NullFloat64
+		var closePrice float64
+		var volume sql.NullInt64
 		err := rows.Scan(&date, &openPrice, &highPrice, &lowPrice, &closePrice, &volume)
 		if err != nil {
 			h.logger.Error("Failed to scan price history row", zap.Error(err))
 			continue
 		}
 
-		priceHistory = append(priceHistory, map[string]interface{}{
-			"date":   date,
-			"open":   openPrice,
-			"high":   highPrice,
-			"low":    lowPrice,
-			"close":  closePrice,
-			"volume": volume,
-		})
+		// Days stored with only a close are treated as flat
+		candle := services.Candle{Time: date, Open: closePrice, High: closePrice, Low: closePrice, Close: closePrice, Volume: float64(volume.Int64)}
+		if openPrice.Valid {
+			candle.Open = openPrice.Float64
+		}
+		if highPrice.Valid {
+			candle.High = highPrice.Float64
+		}
+		if lowPrice.Valid {
+			candle.Low = lowPrice.Float64
+		}
+		candles = append(candles, candle)
+	}
+	if err := rows.Err(); err != nil {
+		h.logger.Error("Failed to read price history", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch price history"})
+		return
 	}
 
-	// Reverse to get chronological order
-	for i := len(priceHistory)/2 - 1; i >= 0; i-- {
-		opp := len(priceHistory) - 1 - i
-		priceHistory[i], priceHistory[opp] = priceHistory[opp], priceHistory[i]
+	candles = services.AggregateCandles(candles, resolution)
+	derived := derivedSeries(candles, series)
+
+	first := 0
+	if len(candles) > limit {
+		first = len(candles) - limit
+	}
+	priceHistory := make([]map[string]interface{}, 0, len(candles)-first)
+	for i := first; i < len(candles); i++ {
+		point := map[string]interface{}{
+			"date":   candles[i].Time.Format("2006-01-02"),
+			"open":   candles[i].Open,
+			"high":   candles[i].High,
+			"low":    candles[i].Low,
+			"close":  candles[i].Close,
+			"volume": int64(candles[i].Volume),
+		}
+		for _, name := range series {
+			point[name] = derived[name][i]
+		}
+		priceHistory = append(priceHistory, point)
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	response := gin.H{
 		"symbol":        symbol,
 		"period":        period,
 		"interval":      interval,
+		"from":          from.Format("2006-01-02"),
+		"to":            to.Format("2006-01-02"),
 		"price_history": priceHistory,
 		"total_points":  len(priceHistory),
-	})
+	}
+	if len(series) > 0 {
+		response["series"] = series
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 // Analytics handlers
@@ -1080,47 +1350,90 @@ func (h *Handler) GetPerformanceAnalytics(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
-	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
 		return
 	}
 
 	// Get period parameter
 	period := c.DefaultQuery("period", "30d")
 
-	// Calculate total portfolio value and cost
+	// Holdings are valued in the portfolio's base currency
+	fx, err := h.newFXConverter(h.services.DB, portfolioID)
+	if err != nil {
+		h.logger.Error("Failed to load base currency", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch performance analytics"})
+		return
+	}
+
+	// Calculate total portfolio cost per currency
 	portfolioQuery := `
 		SELECT
+			COALESCE(a.currency, 'USD') as currency,
 			COALESCE(SUM(ph.quantity * ph.average_cost), 0) as total_cost,
 			COUNT(*) as total_holdings
 		FROM portfolio_holdings ph
-		WHERE ph.user_id = $1
+		JOIN assets a ON ph.asset_id = a.id
+		WHERE ph.portfolio_id = $1
+		GROUP BY COALESCE(a.currency, 'USD')
 	`
 
-	var totalCost float64
-	var totalHoldings int
-	err = h.services.DB.QueryRow(portfolioQuery, userID).Scan(&totalCost, &totalHoldings)
+	totalRows, err := h.services.DB.Query(portfolioQuery, portfolioID)
 	if err != nil {
 		h.logger.Error("Failed to calculate portfolio totals", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch performance analytics"})
 		return
 	}
+	defer totalRows.Close()
+
+	// Cost is at the rates holdings were bought at, and also at today's rates to split out currency moves
+	var totalCost, totalCostToday float64
+	var totalHoldings int
+	for totalRows.Next() {
+		var currency string
+		var cost float64
+		var holdingsCount int
+
+		if err := totalRows.Scan(&currency, &cost, &holdingsCount); err != nil {
+			h.logger.Error("Failed to scan portfolio totals row", zap.Error(err))
+			continue
+		}
+
+		historicalCost, err := fx.historicalCost("", currency, cost)
+		if err != nil {
+			h.respondFXError(c, err, "Failed to fetch performance analytics")
+			return
+		}
+		costToday, err := fx.convert(cost, currency)
+		if err != nil {
+			h.respondFXError(c, err, "Failed to fetch performance analytics")
+			return
+		}
+
+		totalCost += historicalCost
+		totalCostToday += costToday
+		totalHoldings += holdingsCount
+	}
 
 	// Calculate current market value using real-time prices
 	holdingsQuery := `
 		SELECT
 			a.symbol,
+			COALESCE(a.currency, 'USD') as currency,
 			ph.quantity,
 			ph.average_cost
 		FROM portfolio_holdings ph
 		JOIN assets a ON ph.asset_id = a.id
-		WHERE ph.user_id = $1
+		WHERE ph.portfolio_id = $1
 	`
 
-	holdingsRows, err := h.services.DB.Query(holdingsQuery, userID)
+	holdingsRows, err := h.services.DB.Query(holdingsQuery, portfolioID)
 	if err != nil {
 		h.logger.Error("Failed to query holdings for market value", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch performance analytics"})
@@ -1130,36 +1443,55 @@ func (h *Handler) GetPerformanceAnalytics(c *gin.Context) {
 
 	var currentValue float64
 	var priceUpdateErrors []string
+	var stalePrices []string
 
-	// Calculate real market value using Finnhub prices
+	// Calculate real market value using market data prices
 	for holdingsRows.Next() {
-		var symbol string
+		var symbol, currency string
 		var quantity, averageCost float64
 
-		err := holdingsRows.Scan(&symbol, &quantity, &averageCost)
+		err := holdingsRows.Scan(&symbol, &currency, &quantity, &averageCost)
 		if err != nil {
 			h.logger.Error("Failed to scan holdings row", zap.Error(err))
 			continue
 		}
 
-		// Get current price from Finnhub
-		if h.services.Finnhub != nil {
-			if quote, priceErr := h.services.Finnhub.GetQuote(symbol); priceErr == nil {
-				currentValue += quantity * quote.CurrentPrice
+		rate, err := fx.rate(currency)
+		if err != nil {
+			h.respondFXError(c, err, "Failed to fetch performance analytics")
+			return
+		}
+
+		// Get current price from the market data provider
+		if h.services.MarketData != nil {
+			if quote, priceErr := h.services.MarketData.GetQuote(symbol); priceErr == nil {
+				currentValue += quantity * quote.CurrentPrice * rate
+				if quote.Stale {
+					stalePrices = append(stalePrices, symbol)
+				}
 			} else {
 				h.logger.Warn("Failed to fetch price for analytics", zap.String("symbol", symbol), zap.Error(priceErr))
 				priceUpdateErrors = append(priceUpdateErrors, fmt.Sprintf("Could not fetch price for %s", symbol))
 				// Use cost basis as fallback
-				currentValue += quantity * averageCost
+				currentValue += quantity * averageCost * rate
 			}
 		} else {
-			// Finnhub not available, use cost basis
-			currentValue += quantity * averageCost
+			// Market data not available, use cost basis
+			currentValue += quantity * averageCost * rate
 		}
 	}
 
+	// Dividend income is part of the total return
+	dividendIncome, err := h.getIncomeTotal(portfolioID, fx)
+	if err != nil {
+		h.logger.Warn("Failed to query dividend income", zap.Error(err))
+		// Continue with price returns only
+	}
+
 	// Calculate basic performance metrics
-	totalGainLoss := currentValue - totalCost
+	priceGainLoss := currentValue - totalCostToday
+	fxGainLoss := totalCostToday - totalCost
+	totalGainLoss := priceGainLoss + fxGainLoss + dividendIncome
 	totalReturnPercent := 0.0
 	if totalCost > 0 {
 		totalReturnPercent = (totalGainLoss / totalCost) * 100
@@ -1169,12 +1501,12 @@ func (h *Handler) GetPerformanceAnalytics(c *gin.Context) {
 	snapshotsQuery := `
 		SELECT snapshot_date, total_value, total_cost, unrealized_pnl
 		FROM portfolio_snapshots
-		WHERE user_id = $1 AND snapshot_date >= CURRENT_DATE - INTERVAL '30 days'
+		WHERE portfolio_id = $1 AND snapshot_date >= CURRENT_DATE - INTERVAL '30 days'
 		ORDER BY snapshot_date DESC
 		LIMIT 30
 	`
 
-	rows, err := h.services.DB.Query(snapshotsQuery, userID)
+	rows, err := h.services.DB.Query(snapshotsQuery, portfolioID)
 	if err != nil {
 		h.logger.Error("Failed to query portfolio snapshots", zap.Error(err))
 		// Continue without historical data
@@ -1203,19 +1535,21 @@ func (h *Handler) GetPerformanceAnalytics(c *gin.Context) {
 	// Get top performers
 	topPerformersQuery := `
 		SELECT
+			ph.asset_id,
 			a.symbol,
 			a.name,
+			COALESCE(a.currency, 'USD') as currency,
 			ph.quantity,
 			ph.average_cost,
 			(ph.quantity * ph.average_cost) as total_value
 		FROM portfolio_holdings ph
 		JOIN assets a ON ph.asset_id = a.id
-		WHERE ph.user_id = $1
+		WHERE ph.portfolio_id = $1
 		ORDER BY (ph.quantity * ph.average_cost) DESC
 		LIMIT 5
 	`
 
-	performerRows, err := h.services.DB.Query(topPerformersQuery, userID)
+	performerRows, err := h.services.DB.Query(topPerformersQuery, portfolioID)
 	if err != nil {
 		h.logger.Error("Failed to query top performers", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch performance analytics"})
@@ -1225,10 +1559,10 @@ func (h *Handler) GetPerformanceAnalytics(c *gin.Context) {
 
 	var topPerformers []map[string]interface{}
 	for performerRows.Next() {
-		var symbol, name string
+		var assetID, symbol, name, currency string
 		var quantity, averageCost, totalValue float64
 
-		err := performerRows.Scan(&symbol, &name, &quantity, &averageCost, &totalValue)
+		err := performerRows.Scan(&assetID, &symbol, &name, &currency, &quantity, &averageCost, &totalValue)
 		if err != nil {
 			h.logger.Error("Failed to scan performer row", zap.Error(err))
 			continue
@@ -1238,8 +1572,8 @@ func (h *Handler) GetPerformanceAnalytics(c *gin.Context) {
 		var currentPrice float64
 		var currentValue float64
 
-		if h.services.Finnhub != nil {
-			if quote, priceErr := h.services.Finnhub.GetQuote(symbol); priceErr == nil {
+		if h.services.MarketData != nil {
+			if quote, priceErr := h.services.MarketData.GetQuote(symbol); priceErr == nil {
 				currentPrice = quote.CurrentPrice
 				currentValue = quantity * currentPrice
 			} else {
@@ -1249,34 +1583,55 @@ func (h *Handler) GetPerformanceAnalytics(c *gin.Context) {
 				currentValue = totalValue
 			}
 		} else {
-			// Finnhub not available, use cost basis
+			// Market data not available, use cost basis
 			currentPrice = averageCost
 			currentValue = totalValue
 		}
 
-		gainLoss := currentValue - totalValue
+		valuation, err := fx.value(assetID, currency, totalValue, currentValue)
+		if err != nil {
+			h.respondFXError(c, err, "Failed to fetch performance analytics")
+			return
+		}
+
+		gainLoss := valuation.PriceGainLoss + valuation.FXGainLoss
 		gainLossPercent := 0.0
-		if totalValue > 0 {
-			gainLossPercent = (gainLoss / totalValue) * 100
+		if valuation.CostBasis > 0 {
+			gainLossPercent = (gainLoss / valuation.CostBasis) * 100
 		}
 
 		topPerformers = append(topPerformers, map[string]interface{}{
 			"symbol":            symbol,
 			"name":              name,
+			"currency":          currency,
 			"quantity":          quantity,
 			"average_cost":      averageCost,
 			"current_price":     currentPrice,
-			"total_cost":        totalValue,
-			"current_value":     currentValue,
+			"total_cost":        valuation.CostBasis,
+			"current_value":     valuation.MarketValue,
 			"gain_loss":         gainLoss,
 			"gain_loss_percent": gainLossPercent,
+			"price_gain_loss":   valuation.PriceGainLoss,
+			"fx_gain_loss":      valuation.FXGainLoss,
 		})
 	}
 
+	// Time- and money-weighted returns account for deposits, withdrawals and sales, unlike the
+	// return on cost above
+	returns, err := h.getPortfolioReturns(portfolioID)
+	if err != nil {
+		h.logger.Warn("Failed to calculate portfolio returns", zap.Error(err))
+		// Continue without them
+	}
+
 	response := gin.H{
 		"portfolio_performance": map[string]interface{}{
+			"base_currency":        fx.base,
 			"total_cost":           totalCost,
 			"current_value":        currentValue,
+			"price_gain_loss":      priceGainLoss,
+			"fx_gain_loss":         fxGainLoss,
+			"dividend_income":      dividendIncome,
 			"total_gain_loss":      totalGainLoss,
 			"total_return_percent": totalReturnPercent,
 			"total_holdings":       totalHoldings,
@@ -1287,9 +1642,15 @@ func (h *Handler) GetPerformanceAnalytics(c *gin.Context) {
 		"last_updated":         fmt.Sprintf("%d", time.Now().Unix()),
 	}
 
+	if returns != nil {
+		response["returns"] = returns
+	}
 	if len(priceUpdateErrors) > 0 {
 		response["warnings"] = priceUpdateErrors
 	}
+	if len(stalePrices) > 0 {
+		response["stale_prices"] = stalePrices
+	}
 
 	c.JSON(http.StatusOK, response)
 }
@@ -1303,11 +1664,37 @@ func (h *Handler) GetRiskMetrics(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
+		return
+	}
+
+	// Risk is measured over a lookback window against a benchmark and risk-free rate
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	lookback, lookbackFrom, ok := lookbackStart(c, today)
+	if !ok {
+		return
+	}
+	benchmark, ok := h.requestedBenchmark(c)
+	if !ok {
+		return
+	}
+	riskFreeRate, ok := h.requestedRiskFreeRate(c)
+	if !ok {
+		return
+	}
+
+	// Holdings are valued in the portfolio's base currency
+	fx, err := h.newFXConverter(h.services.DB, portfolioID)
 	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		h.logger.Error("Failed to load base currency", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch risk metrics"})
 		return
 	}
 
@@ -1315,16 +1702,17 @@ func (h *Handler) GetRiskMetrics(c *gin.Context) {
 	diversificationQuery := `
 		SELECT
 			a.sector,
+			COALESCE(a.currency, 'USD') as currency,
 			COUNT(*) as holdings_count,
 			COALESCE(SUM(ph.quantity * ph.average_cost), 0) as sector_value
 		FROM portfolio_holdings ph
 		JOIN assets a ON ph.asset_id = a.id
-		WHERE ph.user_id = $1 AND a.sector IS NOT NULL
-		GROUP BY a.sector
+		WHERE ph.portfolio_id = $1 AND a.sector IS NOT NULL
+		GROUP BY a.sector, COALESCE(a.currency, 'USD')
 		ORDER BY sector_value DESC
 	`
 
-	rows, err := h.services.DB.Query(diversificationQuery, userID)
+	rows, err := h.services.DB.Query(diversificationQuery, portfolioID)
 	if err != nil {
 		h.logger.Error("Failed to query diversification data", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch risk metrics"})
@@ -1334,25 +1722,42 @@ func (h *Handler) GetRiskMetrics(c *gin.Context) {
 
 	var sectorDiversification []map[string]interface{}
 	var totalPortfolioValue float64
+	sectorIndex := map[string]int{}
 
 	for rows.Next() {
-		var sector string
+		var sector, currency string
 		var holdingsCount int
 		var sectorValue float64
 
-		err := rows.Scan(&sector, &holdingsCount, &sectorValue)
+		err := rows.Scan(&sector, &currency, &holdingsCount, &sectorValue)
 		if err != nil {
 			h.logger.Error("Failed to scan diversification row", zap.Error(err))
 			continue
 		}
 
+		sectorValue, err = fx.convert(sectorValue, currency)
+		if err != nil {
+			h.respondFXError(c, err, "Failed to fetch risk metrics")
+			return
+		}
+		totalPortfolioValue += sectorValue
+
+		// Sectors held in several currencies are merged
+		if i, ok := sectorIndex[sector]; ok {
+			sectorDiversification[i]["holdings_count"] = sectorDiversification[i]["holdings_count"].(int) + holdingsCount
+			sectorDiversification[i]["sector_value"] = sectorDiversification[i]["sector_value"].(float64) + sectorValue
+			continue
+		}
+		sectorIndex[sector] = len(sectorDiversification)
 		sectorDiversification = append(sectorDiversification, map[string]interface{}{
 			"sector":         sector,
 			"holdings_count": holdingsCount,
 			"sector_value":   sectorValue,
 		})
-		totalPortfolioValue += sectorValue
 	}
+	sort.SliceStable(sectorDiversification, func(i, j int) bool {
+		return sectorDiversification[i]["sector_value"].(float64) > sectorDiversification[j]["sector_value"].(float64)
+	})
 
 	// Calculate sector concentration percentages
 	for i := range sectorDiversification {
@@ -1385,133 +1790,51 @@ func (h *Handler) GetRiskMetrics(c *gin.Context) {
 		concentrationRisk = "Well-diversified portfolio"
 	}
 
-	// Calculate enhanced volatility metrics using portfolio composition
-	// Get portfolio holdings for beta calculation
-	betaQuery := `
-		SELECT
-			a.symbol,
-			ph.quantity,
-			ph.average_cost,
-			(ph.quantity * ph.average_cost) as position_value
-		FROM portfolio_holdings ph
-		JOIN assets a ON ph.asset_id = a.id
-		WHERE ph.user_id = $1
-	`
-
-	betaRows, err := h.services.DB.Query(betaQuery, userID)
+	// Volatility, beta and drawdown come from the daily returns in price_history of the current
+	// holdings, weighted by their market value
+	holdings, err := h.loadRiskHoldings(portfolioID, fx)
 	if err != nil {
-		h.logger.Error("Failed to query holdings for beta calculation", zap.Error(err))
-	}
-
-	var weightedBeta float64
-	var portfolioValue float64
-	stockBetas := map[string]float64{
-		"AAPL": 1.24, "MSFT": 0.91, "GOOGL": 1.05, "AMZN": 1.12, "TSLA": 1.95,
-		"NVDA": 1.45, "META": 1.33, "NFLX": 1.21, "CRM": 1.18, "PYPL": 1.89,
-	}
-
-	if betaRows != nil {
-		defer betaRows.Close()
-		for betaRows.Next() {
-			var symbol string
-			var quantity, averageCost, positionValue float64
-
-			err := betaRows.Scan(&symbol, &quantity, &averageCost, &positionValue)
-			if err != nil {
-				continue
-			}
-
-			portfolioValue += positionValue
-			if beta, exists := stockBetas[symbol]; exists {
-				weightedBeta += beta * positionValue
-			} else {
-				// Default beta for unknown stocks
-				weightedBeta += 1.0 * positionValue
-			}
-		}
-	}
-
-	// Calculate portfolio beta
-	portfolioBeta := 1.0 // Default
-	if portfolioValue > 0 {
-		portfolioBeta = weightedBeta / portfolioValue
-	}
-
-	// Calculate approximate Sharpe ratio (simplified)
-	// Using portfolio return vs risk-free rate (assume 3% annual)
-	riskFreeRate := 0.03
-	portfolioReturn := 0.0
-	if totalPortfolioValue > 0 {
-		// Get current portfolio value using real prices
-		currentPortfolioValue := 0.0
-		currentValueRows, err := h.services.DB.Query(betaQuery, userID)
-		if err == nil && currentValueRows != nil {
-			defer currentValueRows.Close()
-			for currentValueRows.Next() {
-				var symbol string
-				var quantity, averageCost, positionValue float64
-
-				err := currentValueRows.Scan(&symbol, &quantity, &averageCost, &positionValue)
-				if err != nil {
-					continue
-				}
-
-				if h.services.Finnhub != nil {
-					if quote, priceErr := h.services.Finnhub.GetQuote(symbol); priceErr == nil {
-						currentPortfolioValue += quantity * quote.CurrentPrice
-					} else {
-						currentPortfolioValue += positionValue // Use cost basis as fallback
-					}
-				} else {
-					currentPortfolioValue += positionValue
-				}
-			}
-		}
-
-		if totalPortfolioValue > 0 {
-			portfolioReturn = (currentPortfolioValue - totalPortfolioValue) / totalPortfolioValue
-		}
-	}
-
-	// Estimate portfolio volatility based on sector diversification
-	portfolioVolatility := 0.20 // Base volatility 20%
-	if herfindahlIndex > 0.25 {
-		portfolioVolatility += 0.05 // Add 5% for high concentration
-	} else if herfindahlIndex < 0.10 {
-		portfolioVolatility -= 0.03 // Reduce 3% for good diversification
+		h.respondFXError(c, err, "Failed to fetch risk metrics")
+		return
 	}
-
-	// Calculate Sharpe ratio
-	sharpeRatio := 0.0
-	if portfolioVolatility > 0 {
-		sharpeRatio = (portfolioReturn - riskFreeRate) / portfolioVolatility
+	benchmarkSymbols := make([]string, len(benchmark))
+	for i, component := range benchmark {
+		benchmarkSymbols[i] = component.Symbol
 	}
-
-	// Estimate max drawdown based on beta and diversification
-	maxDrawdown := -10.0 // Base drawdown
-	if portfolioBeta > 1.5 {
-		maxDrawdown -= 10.0 // High beta increases drawdown
-	} else if portfolioBeta < 0.8 {
-		maxDrawdown += 5.0 // Low beta reduces drawdown
+	matrix, pricedHoldings, warnings, err := h.loadHoldingReturns(holdings, benchmarkSymbols, lookbackFrom, today)
+	if err != nil {
+		h.logger.Error("Failed to load price history for risk metrics", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch risk metrics"})
+		return
 	}
+	risk := calculatePortfolioRisk(pricedHoldings, benchmark, matrix, riskFreeRate)
 
-	if herfindahlIndex > 0.25 {
-		maxDrawdown -= 5.0 // Poor diversification increases drawdown
+	// One-day Value at Risk (95% confidence) from the covariance of the holdings' daily returns, as a
+	// negative return; GET /analytics/var has the other methods, horizons and confidence levels
+	var var95, diversificationRatio *float64
+	if weights, value := holdingWeights(pricedHoldings, matrix.Symbols); risk.Observations >= 2 && value > 0 {
+		covariance := newReturnCovariance(matrix, false)
+		estimate := parametricVaR(matrix.Symbols, weights, seriesMeans(matrix.Returns), covariance.Covariance, 1, 0.95, value)
+		var95 = optionalFloat(-estimate.VaRPercent)
+		diversificationRatio = covariance.diversificationRatio(weights)
 	}
 
-	// Value at Risk (95% confidence) - simplified calculation
-	var95 := portfolioVolatility * 1.645 * -100 // 95% confidence interval
-
 	volatilityMetrics := map[string]interface{}{
-		"portfolio_beta":      math.Round(portfolioBeta*100) / 100,
-		"sharpe_ratio":        math.Round(sharpeRatio*100) / 100,
-		"max_drawdown":        math.Round(maxDrawdown*100) / 100,
-		"var_95":              math.Round(var95*100) / 100,
-		"expected_volatility": math.Round(portfolioVolatility*10000) / 100, // Convert to percentage
-		"portfolio_return":    math.Round(portfolioReturn*10000) / 100,     // Convert to percentage
+		"portfolio_beta":        risk.Beta,
+		"sharpe_ratio":          risk.SharpeRatio,
+		"sortino_ratio":         risk.SortinoRatio,
+		"max_drawdown":          risk.MaxDrawdownPercent,
+		"max_drawdown_peak":     formatOptionalDate(risk.DrawdownPeak),
+		"max_drawdown_trough":   formatOptionalDate(risk.DrawdownTrough),
+		"var_95":                var95,
+		"diversification_ratio": diversificationRatio,
+		"expected_volatility":   risk.VolatilityPercent,
+		"portfolio_return":      risk.ReturnPercent,
+		"risk_free_rate":        riskFreeRate * 100,
+		"asset_risk":            risk.Assets,
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	response := gin.H{
 		"risk_assessment": map[string]interface{}{
 			"overall_risk_level":    riskLevel,
 			"concentration_risk":    concentrationRisk,
@@ -1520,12 +1843,19 @@ func (h *Handler) GetRiskMetrics(c *gin.Context) {
 		},
 		"sector_diversification": sectorDiversification,
 		"volatility_metrics":     volatilityMetrics,
+		"benchmark":              benchmark,
+		"lookback_window":        lookbackWindow(lookback, lookbackFrom, today, matrix),
 		"risk_recommendations": []string{
 			"Consider diversifying across more sectors",
 			"Monitor concentration in top holdings",
 			"Regular rebalancing recommended",
 		},
-	})
+	}
+	if len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 func (h *Handler) GetAssetAllocation(c *gin.Context) {
@@ -1537,11 +1867,22 @@ func (h *Handler) GetAssetAllocation(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
+		return
+	}
+
+	// Holdings are valued in the portfolio's base currency
+	fx, err := h.newFXConverter(h.services.DB, portfolioID)
 	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		h.logger.Error("Failed to load base currency", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch asset allocation"})
 		return
 	}
 
@@ -1549,16 +1890,17 @@ func (h *Handler) GetAssetAllocation(c *gin.Context) {
 	assetTypeQuery := `
 		SELECT
 			a.asset_type,
+			COALESCE(a.currency, 'USD') as currency,
 			COUNT(*) as count,
 			COALESCE(SUM(ph.quantity * ph.average_cost), 0) as total_value
 		FROM portfolio_holdings ph
 		JOIN assets a ON ph.asset_id = a.id
-		WHERE ph.user_id = $1
-		GROUP BY a.asset_type
+		WHERE ph.portfolio_id = $1
+		GROUP BY a.asset_type, COALESCE(a.currency, 'USD')
 		ORDER BY total_value DESC
 	`
 
-	rows, err := h.services.DB.Query(assetTypeQuery, userID)
+	rows, err := h.services.DB.Query(assetTypeQuery, portfolioID)
 	if err != nil {
 		h.logger.Error("Failed to query asset allocation", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch asset allocation"})
@@ -1568,24 +1910,56 @@ func (h *Handler) GetAssetAllocation(c *gin.Context) {
 
 	var assetTypeAllocation []map[string]interface{}
 	var totalValue float64
+	assetTypeIndex := map[string]int{}
 
 	for rows.Next() {
-		var assetType string
+		var assetType, currency string
 		var count int
 		var value float64
 
-		err := rows.Scan(&assetType, &count, &value)
+		err := rows.Scan(&assetType, &currency, &count, &value)
 		if err != nil {
 			h.logger.Error("Failed to scan asset type row", zap.Error(err))
 			continue
 		}
 
+		value, err = fx.convert(value, currency)
+		if err != nil {
+			h.respondFXError(c, err, "Failed to fetch asset allocation")
+			return
+		}
+		totalValue += value
+
+		// Asset types held in several currencies are merged
+		if i, ok := assetTypeIndex[assetType]; ok {
+			assetTypeAllocation[i]["count"] = assetTypeAllocation[i]["count"].(int) + count
+			assetTypeAllocation[i]["value"] = assetTypeAllocation[i]["value"].(float64) + value
+			continue
+		}
+		assetTypeIndex[assetType] = len(assetTypeAllocation)
 		assetTypeAllocation = append(assetTypeAllocation, map[string]interface{}{
 			"asset_type": assetType,
 			"count":      count,
 			"value":      value,
 		})
-		totalValue += value
+	}
+	sort.SliceStable(assetTypeAllocation, func(i, j int) bool {
+		return assetTypeAllocation[i]["value"].(float64) > assetTypeAllocation[j]["value"].(float64)
+	})
+
+	// Cash is allocated alongside the holdings
+	cashBalances, cashTotal, err := h.getCashBalances(h.services.DB, portfolioID, fx)
+	if err != nil {
+		h.logger.Warn("Failed to query cash balances", zap.Error(err))
+		// Continue with holdings only
+	}
+	if cashTotal != 0 {
+		assetTypeAllocation = append(assetTypeAllocation, map[string]interface{}{
+			"asset_type": "CASH",
+			"count":      len(cashBalances),
+			"value":      cashTotal,
+		})
+		totalValue += cashTotal
 	}
 
 	// Calculate percentages
@@ -1602,16 +1976,17 @@ func (h *Handler) GetAssetAllocation(c *gin.Context) {
 	sectorQuery := `
 		SELECT
 			COALESCE(a.sector, 'Unknown') as sector,
+			COALESCE(a.currency, 'USD') as currency,
 			COUNT(*) as count,
 			COALESCE(SUM(ph.quantity * ph.average_cost), 0) as total_value
 		FROM portfolio_holdings ph
 		JOIN assets a ON ph.asset_id = a.id
-		WHERE ph.user_id = $1
-		GROUP BY a.sector
+		WHERE ph.portfolio_id = $1
+		GROUP BY a.sector, COALESCE(a.currency, 'USD')
 		ORDER BY total_value DESC
 	`
 
-	sectorRows, err := h.services.DB.Query(sectorQuery, userID)
+	sectorRows, err := h.services.DB.Query(sectorQuery, portfolioID)
 	if err != nil {
 		h.logger.Error("Failed to query sector allocation", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch asset allocation"})
@@ -1620,26 +1995,57 @@ func (h *Handler) GetAssetAllocation(c *gin.Context) {
 	defer sectorRows.Close()
 
 	var sectorAllocation []map[string]interface{}
+	sectorIndex := map[string]int{}
 	for sectorRows.Next() {
-		var sector string
+		var sector, currency string
 		var count int
 		var value float64
 
-		err := sectorRows.Scan(&sector, &count, &value)
+		err := sectorRows.Scan(&sector, &currency, &count, &value)
 		if err != nil {
 			h.logger.Error("Failed to scan sector row", zap.Error(err))
 			continue
 		}
 
+		value, err = fx.convert(value, currency)
+		if err != nil {
+			h.respondFXError(c, err, "Failed to fetch asset allocation")
+			return
+		}
+
+		// Sectors held in several currencies are merged
+		if i, ok := sectorIndex[sector]; ok {
+			sectorAllocation[i]["count"] = sectorAllocation[i]["count"].(int) + count
+			sectorAllocation[i]["value"] = sectorAllocation[i]["value"].(float64) + value
+			continue
+		}
+		sectorIndex[sector] = len(sectorAllocation)
+		sectorAllocation = append(sectorAllocation, map[string]interface{}{
+			"sector": sector,
+			"count":  count,
+			"value":  value,
+		})
+	}
+	sort.SliceStable(sectorAllocation, func(i, j int) bool {
+		return sectorAllocation[i]["value"].(float64) > sectorAllocation[j]["value"].(float64)
+	})
+	for i := range sectorAllocation {
 		percentage := 0.0
 		if totalValue > 0 {
-			percentage = (value / totalValue) * 100
+			percentage = (sectorAllocation[i]["value"].(float64) / totalValue) * 100
+		}
+		sectorAllocation[i]["percentage"] = percentage
+	}
+	if cashTotal != 0 {
+		percentage := 0.0
+		if totalValue > 0 {
+			percentage = (cashTotal / totalValue) * 100
 		}
 
 		sectorAllocation = append(sectorAllocation, map[string]interface{}{
-			"sector":     sector,
-			"count":      count,
-			"value":      value,
+			"sector":     "Cash",
+			"count":      len(cashBalances),
+			"value":      cashTotal,
 			"percentage": percentage,
 		})
 	}
@@ -1649,17 +2055,17 @@ func (h *Handler) GetAssetAllocation(c *gin.Context) {
 		SELECT
 			a.symbol,
 			a.name,
+			COALESCE(a.currency, 'USD') as currency,
 			ph.quantity,
 			ph.average_cost,
 			(ph.quantity * ph.average_cost) as total_value
 		FROM portfolio_holdings ph
 		JOIN assets a ON ph.asset_id = a.id
-		WHERE ph.user_id = $1
+		WHERE ph.portfolio_id = $1
 		ORDER BY (ph.quantity * ph.average_cost) DESC
-		LIMIT 10
 	`
 
-	topRows, err := h.services.DB.Query(topHoldingsQuery, userID)
+	topRows, err := h.services.DB.Query(topHoldingsQuery, portfolioID)
 	if err != nil {
 		h.logger.Error("Failed to query top holdings", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch asset allocation"})
@@ -1669,15 +2075,21 @@ func (h *Handler) GetAssetAllocation(c *gin.Context) {
 
 	var topHoldings []map[string]interface{}
 	for topRows.Next() {
-		var symbol, name string
+		var symbol, name, currency string
 		var quantity, averageCost, value float64
 
-		err := topRows.Scan(&symbol, &name, &quantity, &averageCost, &value)
+		err := topRows.Scan(&symbol, &name, &currency, &quantity, &averageCost, &value)
 		if err != nil {
 			h.logger.Error("Failed to scan top holding row", zap.Error(err))
 			continue
 		}
 
+		value, err = fx.convert(value, currency)
+		if err != nil {
+			h.respondFXError(c, err, "Failed to fetch asset allocation")
+			return
+		}
+
 		percentage := 0.0
 		if totalValue > 0 {
 			percentage = (value / totalValue) * 100
@@ -1686,6 +2098,7 @@ func (h *Handler) GetAssetAllocation(c *gin.Context) {
 		topHoldings = append(topHoldings, map[string]interface{}{
 			"symbol":       symbol,
 			"name":         name,
+			"currency":     currency,
 			"quantity":     quantity,
 			"average_cost": averageCost,
 			"total_value":  value,
@@ -1693,10 +2106,22 @@ func (h *Handler) GetAssetAllocation(c *gin.Context) {
 		})
 	}
 
+	// Only the largest holdings by cost in the base currency are listed
+	totalHoldings := len(topHoldings)
+	sort.SliceStable(topHoldings, func(i, j int) bool {
+		return topHoldings[i]["total_value"].(float64) > topHoldings[j]["total_value"].(float64)
+	})
+	if len(topHoldings) > 10 {
+		topHoldings = topHoldings[:10]
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"allocation_summary": map[string]interface{}{
+			"base_currency":         fx.base,
 			"total_portfolio_value": totalValue,
-			"total_holdings":        len(topHoldings),
+			"total_holdings":        totalHoldings,
+			"cash_balance":          cashTotal,
+			"cash_balances":         cashBalances,
 			"allocation_date":       "current",
 		},
 		"by_asset_type": assetTypeAllocation,
@@ -1707,10 +2132,11 @@ func (h *Handler) GetAssetAllocation(c *gin.Context) {
 
 func (h *Handler) WhatIfAnalysis(c *gin.Context) {
 	var request struct {
-		Action   string  `json:"action" binding:"required,oneof=buy sell"`
-		Symbol   string  `json:"symbol" binding:"required"`
-		Quantity float64 `json:"quantity" binding:"required,gt=0"`
-		Price    float64 `json:"price" binding:"required,gt=0"`
+		PortfolioID string  `json:"portfolio_id"`
+		Action      string  `json:"action" binding:"required,oneof=buy sell"`
+		Symbol      string  `json:"symbol" binding:"required"`
+		Quantity    float64 `json:"quantity" binding:"required,gt=0"`
+		Price       float64 `json:"price" binding:"required,gt=0"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -1726,11 +2152,14 @@ func (h *Handler) WhatIfAnalysis(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
-	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, request.PortfolioID)
+	if !ok {
 		return
 	}
 
@@ -1740,12 +2169,12 @@ func (h *Handler) WhatIfAnalysis(c *gin.Context) {
 			COALESCE(SUM(ph.quantity * ph.average_cost), 0) as total_cost,
 			COUNT(*) as total_holdings
 		FROM portfolio_holdings ph
-		WHERE ph.user_id = $1
+		WHERE ph.portfolio_id = $1
 	`
 
 	var currentTotalCost float64
 	var currentHoldings int
-	err = h.services.DB.QueryRow(currentPortfolioQuery, userID).Scan(&currentTotalCost, &currentHoldings)
+	err := h.services.DB.QueryRow(currentPortfolioQuery, portfolioID).Scan(&currentTotalCost, &currentHoldings)
 	if err != nil {
 		h.logger.Error("Failed to get current portfolio", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to perform what-if analysis"})
@@ -1755,17 +2184,13 @@ func (h *Handler) WhatIfAnalysis(c *gin.Context) {
 	// Calculate impact of the proposed trade
 	tradeValue := request.Quantity * request.Price
 	var newTotalCost float64
-	var newHoldings int
-
 	if request.Action == "buy" {
 		newTotalCost = currentTotalCost + tradeValue
-		newHoldings = currentHoldings + 1 // Simplified assumption
 	} else { // sell
 		newTotalCost = currentTotalCost - tradeValue
 		if newTotalCost < 0 {
 			newTotalCost = 0
 		}
-		newHoldings = currentHoldings // Holdings count doesn't change for partial sell
 	}
 
 	// Check if asset exists in current portfolio
@@ -1775,9 +2200,9 @@ func (h *Handler) WhatIfAnalysis(c *gin.Context) {
 		SELECT ph.quantity, ph.average_cost
 		FROM portfolio_holdings ph
 		JOIN assets a ON ph.asset_id = a.id
-		WHERE ph.user_id = $1 AND a.symbol = $2
+		WHERE ph.portfolio_id = $1 AND a.symbol = $2
 	`
-	err = h.services.DB.QueryRow(holdingQuery, userID, request.Symbol).Scan(&currentQuantity, &currentAvgCost)
+	err = h.services.DB.QueryRow(holdingQuery, portfolioID, request.Symbol).Scan(&currentQuantity, &currentAvgCost)
 	if err == nil {
 		hasCurrentHolding = true
 	} else if err != sql.ErrNoRows {
@@ -1821,6 +2246,15 @@ func (h *Handler) WhatIfAnalysis(c *gin.Context) {
 		}
 	}
 
+	// A buy only adds a holding when the symbol isn't held yet, and only a sell of everything removes one
+	newHoldings := currentHoldings
+	switch positionChange {
+	case "created":
+		newHoldings++
+	case "closed":
+		newHoldings--
+	}
+
 	// Calculate portfolio allocation impact
 	currentAllocationQuery := `
 		SELECT
@@ -1828,11 +2262,11 @@ func (h *Handler) WhatIfAnalysis(c *gin.Context) {
 			COALESCE(SUM(ph.quantity * ph.average_cost), 0) as total_value
 		FROM portfolio_holdings ph
 		JOIN assets a ON ph.asset_id = a.id
-		WHERE ph.user_id = $1
+		WHERE ph.portfolio_id = $1
 		GROUP BY a.asset_type
 	`
 
-	rows, err := h.services.DB.Query(currentAllocationQuery, userID)
+	rows, err := h.services.DB.Query(currentAllocationQuery, portfolioID)
 	if err != nil {
 		h.logger.Error("Failed to query current allocation", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to perform what-if analysis"})
@@ -1968,11 +2402,8 @@ func (h *Handler) GetNotifications(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
-	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+	userID, ok := h.requireUserID(c)
+	if !ok {
 		return
 	}
 
@@ -2058,17 +2489,14 @@ func (h *Handler) MarkNotificationRead(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
-	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+	userID, ok := h.requireUserID(c)
+	if !ok {
 		return
 	}
 
 	// Check if notification exists and belongs to user
 	var isRead bool
-	err = h.services.DB.QueryRow(`
+	err := h.services.DB.QueryRow(`
 		SELECT is_read FROM notifications 
 		WHERE id = $1 AND user_id = $2
 	`, notificationID, userID).Scan(&isRead)
@@ -2133,11 +2561,8 @@ func (h *Handler) UpdateNotificationSettings(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
-	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+	userID, ok := h.requireUserID(c)
+	if !ok {
 		return
 	}
 
@@ -2196,8 +2621,8 @@ func (h *Handler) WebSocketHandler(c *gin.Context) {
 	// Create client ID
 	clientID := uuid.New().String()
 
-	// Get user ID (in a real app, this would come from authentication)
-	userID := "default_user" // For demo purposes
+	// Get user ID from the authenticated request
+	userID := middleware.GetUserID(c)
 
 	// Create new client
 	client := &services.Client{
@@ -2227,11 +2652,14 @@ func (h *Handler) GetTransactions(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
-	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
 		return
 	}
 
@@ -2246,12 +2674,12 @@ func (h *Handler) GetTransactions(c *gin.Context) {
 		SELECT 
 			t.id, t.transaction_type, t.quantity, t.price, t.fees, 
 			t.total_amount, t.transaction_date, t.notes,
-			a.symbol, a.name
+			a.symbol, a.name, t.realized_pnl
 		FROM transactions t
 		JOIN assets a ON t.asset_id = a.id
-		WHERE t.user_id = $1
+		WHERE t.portfolio_id = $1
 	`
-	args := []interface{}{userID}
+	args := []interface{}{portfolioID}
 	argCount := 1
 
 	if transactionType != "" {
@@ -2289,15 +2717,16 @@ func (h *Handler) GetTransactions(c *gin.Context) {
 	for rows.Next() {
 		var id, transactionType, notes, symbol, name, transactionDate string
 		var quantity, price, fees, totalAmount float64
+		var realizedPnL sql.NullFloat64
 
 		err := rows.Scan(&id, &transactionType, &quantity, &price, &fees,
-			&totalAmount, &transactionDate, &notes, &symbol, &name)
+			&totalAmount, &transactionDate, &notes, &symbol, &name, &realizedPnL)
 		if err != nil {
 			h.logger.Error("Failed to scan transaction row", zap.Error(err))
 			continue
 		}
 
-		transactions = append(transactions, map[string]interface{}{
+		transaction := map[string]interface{}{
 			"id":               id,
 			"transaction_type": transactionType,
 			"symbol":           symbol,
@@ -2308,7 +2737,12 @@ func (h *Handler) GetTransactions(c *gin.Context) {
 			"total_amount":     totalAmount,
 			"transaction_date": transactionDate,
 			"notes":            notes,
-		})
+			"realized_pnl":     nil,
+		}
+		if realizedPnL.Valid {
+			transaction["realized_pnl"] = realizedPnL.Float64
+		}
+		transactions = append(transactions, transaction)
 	}
 
 	// Get total count for pagination
@@ -2316,9 +2750,9 @@ func (h *Handler) GetTransactions(c *gin.Context) {
 		SELECT COUNT(*)
 		FROM transactions t
 		JOIN assets a ON t.asset_id = a.id
-		WHERE t.user_id = $1
+		WHERE t.portfolio_id = $1
 	`
-	countArgs := []interface{}{userID}
+	countArgs := []interface{}{portfolioID}
 	countArgCount := 1
 
 	if transactionType != "" {
@@ -2350,12 +2784,21 @@ func (h *Handler) GetTransactions(c *gin.Context) {
 
 func (h *Handler) CreateTransaction(c *gin.Context) {
 	var request struct {
-		Symbol          string  `json:"symbol" binding:"required"`
-		TransactionType string  `json:"transaction_type" binding:"required,oneof=BUY SELL"`
-		Quantity        float64 `json:"quantity" binding:"required,gt=0"`
-		Price           float64 `json:"price" binding:"required,gt=0"`
+		PortfolioID     string  `json:"portfolio_id"`
+		Symbol          string  `json:"symbol"`
+		TransactionType string  `json:"transaction_type" binding:"required,oneof=BUY SELL DIVIDEND DIVIDEND_REINVEST DEPOSIT WITHDRAWAL INTEREST FEE"`
+		Quantity        float64 `json:"quantity" binding:"omitempty,gt=0"`
+		Price           float64 `json:"price" binding:"omitempty,gt=0"`
 		Fees            float64 `json:"fees"`
 		Notes           string  `json:"notes"`
+		// Optional SELL-only lot selection; defaults to the portfolio's cost basis method
+		CostBasisMethod string   `json:"cost_basis_method" binding:"omitempty,oneof=FIFO LIFO HIFO SPECIFIC"`
+		LotIDs          []string `json:"lot_ids"`
+		// Cash movements and dividends take an amount; cash movements also a currency
+		// (defaults to the portfolio's base currency). A dividend's fees are tax withheld.
+		// For other types the currency is that of a new asset.
+		Amount   float64 `json:"amount" binding:"omitempty,gt=0"`
+		Currency string  `json:"currency" binding:"omitempty,len=3"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -2363,6 +2806,34 @@ func (h *Handler) CreateTransaction(c *gin.Context) {
 		return
 	}
 
+	cashMovement := isCashTransaction(request.TransactionType)
+	switch {
+	case cashMovement:
+		if request.Amount == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Amount is required for " + request.TransactionType + " transactions"})
+			return
+		}
+	case request.TransactionType == transactionDividend:
+		if request.Symbol == "" || request.Amount == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Symbol and amount are required for DIVIDEND transactions"})
+			return
+		}
+		if request.Fees >= request.Amount {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Tax withheld (fees) must be less than the dividend amount"})
+			return
+		}
+		// A cash dividend is stored as its amount at a price of 1
+		request.Quantity, request.Price = request.Amount, 1
+	case request.Symbol == "" || request.Quantity == 0 || request.Price == 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Symbol, quantity and price are required for " + request.TransactionType + " transactions"})
+		return
+	}
+
+	if request.TransactionType != "SELL" && (len(request.LotIDs) > 0 || request.CostBasisMethod != "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cost_basis_method and lot_ids only apply to SELL transactions"})
+		return
+	}
+
 	// Check if database connection is available
 	if h.services.DB == nil {
 		h.logger.Error("Database connection is nil")
@@ -2371,32 +2842,35 @@ func (h *Handler) CreateTransaction(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
-	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, request.PortfolioID)
+	if !ok {
+		return
+	}
+
+	if cashMovement {
+		h.createCashTransaction(c, userID, portfolioID, request.TransactionType, request.Amount, request.Currency, request.Notes)
 		return
 	}
 
 	// Get or create asset
 	var assetID string
-	err = h.services.DB.QueryRow("SELECT id FROM assets WHERE symbol = $1", request.Symbol).Scan(&assetID)
+	err := h.services.DB.QueryRow("SELECT id FROM assets WHERE symbol = $1", request.Symbol).Scan(&assetID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			// Asset doesn't exist, create it
-			assetName := request.Symbol
-			if h.services.Finnhub != nil {
-				if profile, err := h.services.Finnhub.GetCompanyProfile(request.Symbol); err == nil && profile.Name != "" {
-					assetName = profile.Name
-				}
-			}
+			assetName, currency := h.describeNewAsset(request.Symbol, request.Currency)
 
 			err = h.services.DB.QueryRow(`
 				INSERT INTO assets (symbol, name, asset_type, currency)
-				VALUES ($1, $2, 'STOCK', 'USD')
+				VALUES ($1, $2, 'STOCK', $3)
 				RETURNING id
-			`, request.Symbol, assetName).Scan(&assetID)
+			`, request.Symbol, assetName, currency).Scan(&assetID)
 			if err != nil {
 				h.logger.Error("Failed to create asset", zap.Error(err))
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create asset"})
@@ -2411,7 +2885,7 @@ func (h *Handler) CreateTransaction(c *gin.Context) {
 
 	// Calculate total amount
 	totalAmount := request.Quantity * request.Price
-	if request.TransactionType == "BUY" {
+	if request.TransactionType == "BUY" || request.TransactionType == transactionDividendReinvest {
 		totalAmount += request.Fees
 	} else {
 		totalAmount -= request.Fees
@@ -2426,41 +2900,34 @@ func (h *Handler) CreateTransaction(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
-	// Insert transaction record
-	var transactionID string
-	err = tx.QueryRow(`
-		INSERT INTO transactions (user_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-		RETURNING id
-	`, userID, assetID, request.TransactionType, request.Quantity, request.Price, request.Fees, totalAmount, request.Notes).Scan(&transactionID)
-
-	if err != nil {
-		h.logger.Error("Failed to insert transaction", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create transaction"})
-		return
+	// Purchases settle from the cash balance in the asset's currency
+	if request.TransactionType == "BUY" {
+		covered, balance, currency, err := h.cashCovers(tx, portfolioID, assetID, totalAmount)
+		if err != nil {
+			h.logger.Error("Failed to check cash balance", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process buy transaction"})
+			return
+		}
+		if !covered {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":        "Insufficient cash to cover purchase",
+				"currency":     currency,
+				"cash_balance": balance,
+				"total_amount": totalAmount,
+			})
+			return
+		}
 	}
 
-	// Update portfolio holdings based on transaction type
-	if request.TransactionType == "BUY" {
-		// Add to holdings
-		_, err = tx.Exec(`
-			INSERT INTO portfolio_holdings (user_id, asset_id, quantity, average_cost)
-			VALUES ($1, $2, $3, $4)
-			ON CONFLICT (user_id, asset_id)
-			DO UPDATE SET
-				quantity = portfolio_holdings.quantity + EXCLUDED.quantity,
-				average_cost = ((portfolio_holdings.quantity * portfolio_holdings.average_cost) +
-								(EXCLUDED.quantity * EXCLUDED.average_cost)) /
-								(portfolio_holdings.quantity + EXCLUDED.quantity),
-				updated_at = NOW()
-		`, userID, assetID, request.Quantity, request.Price)
-	} else {
-		// Sell from holdings
+	// Sales record how lots are picked so replaying the ledger reproduces them
+	var costBasisMethod sql.NullString
+	var lotTransactionIDs []string
+	if request.TransactionType == "SELL" {
 		var currentQuantity float64
 		err = tx.QueryRow(`
-			SELECT quantity FROM portfolio_holdings 
-			WHERE user_id = $1 AND asset_id = $2
-		`, userID, assetID).Scan(&currentQuantity)
+			SELECT quantity FROM portfolio_holdings
+			WHERE portfolio_id = $1 AND asset_id = $2
+		`, portfolioID, assetID).Scan(&currentQuantity)
 
 		if err != nil {
 			if err == sql.ErrNoRows {
@@ -2477,29 +2944,60 @@ func (h *Handler) CreateTransaction(c *gin.Context) {
 			return
 		}
 
-		newQuantity := currentQuantity - request.Quantity
-		if newQuantity == 0 {
-			// Remove holding completely
-			_, err = tx.Exec(`
-				DELETE FROM portfolio_holdings 
-				WHERE user_id = $1 AND asset_id = $2
-			`, userID, assetID)
-		} else {
-			// Update quantity
-			_, err = tx.Exec(`
-				UPDATE portfolio_holdings 
-				SET quantity = $1, updated_at = NOW()
-				WHERE user_id = $2 AND asset_id = $3
-			`, newQuantity, userID, assetID)
+		costBasisMethod.String, err = h.resolveCostBasisMethod(tx, portfolioID, request.CostBasisMethod, request.LotIDs)
+		if err != nil {
+			h.logger.Error("Failed to resolve cost basis method", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process sell transaction"})
+			return
+		}
+		costBasisMethod.Valid = true
+
+		if costBasisMethod.String == costBasisSpecific {
+			if len(request.LotIDs) == 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "lot_ids are required for the SPECIFIC cost basis method"})
+				return
+			}
+			lotTransactionIDs, err = h.lotTransactionIDs(tx, portfolioID, assetID, request.LotIDs)
+			if err != nil {
+				if errors.Is(err, errLotNotFound) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				h.logger.Error("Failed to resolve tax lots", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process sell transaction"})
+				return
+			}
 		}
 	}
 
+	// Insert transaction record
+	var transactionID string
+	err = tx.QueryRow(`
+		INSERT INTO transactions (user_id, portfolio_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes, cost_basis_method, lot_transaction_ids)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id
+	`, userID, portfolioID, assetID, request.TransactionType, request.Quantity, request.Price, request.Fees, totalAmount, request.Notes,
+		costBasisMethod, pq.Array(lotTransactionIDs)).Scan(&transactionID)
+
+	if err == nil {
+		err = h.invalidateSnapshots(tx, portfolioID, time.Now())
+	}
 	if err != nil {
-		h.logger.Error("Failed to update portfolio holdings", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update portfolio"})
+		h.logger.Error("Failed to insert transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create transaction"})
 		return
 	}
 
+	// Replay the asset's ledger to update holdings, tax lots and realized P&L
+	state := &ledgerState{}
+	if affectsHoldings(request.TransactionType) {
+		state, _, err = h.rebuildHoldings(tx, userID, portfolioID, assetID)
+		if err != nil {
+			h.respondLedgerError(c, err, "Failed to update portfolio")
+			return
+		}
+	}
+
 	// Commit transaction
 	if err = tx.Commit(); err != nil {
 		h.logger.Error("Failed to commit transaction", zap.Error(err))
@@ -2507,42 +3005,40 @@ func (h *Handler) CreateTransaction(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{
+	response := gin.H{
 		"message":        "Transaction created successfully",
 		"transaction_id": transactionID,
+		"portfolio_id":   portfolioID,
 		"symbol":         request.Symbol,
 		"type":           request.TransactionType,
 		"quantity":       request.Quantity,
 		"price":          request.Price,
 		"total_amount":   totalAmount,
-	})
+	}
+	if request.TransactionType == "SELL" {
+		response["realized_pnl"] = state.Realized[transactionID]
+	}
+	c.JSON(http.StatusCreated, response)
 
 	// Broadcast portfolio update via WebSocket after successful transaction
-	go h.broadcastPortfolioUpdate("default_user")
+	go h.broadcastPortfolioUpdate(userID, portfolioID)
 }
 
 // Helper function to calculate and broadcast portfolio updates
-func (h *Handler) broadcastPortfolioUpdate(username string) {
+func (h *Handler) broadcastPortfolioUpdate(userID, portfolioID string) {
 	if h.services.WebSocket == nil {
 		return
 	}
 
-	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&userID)
-	if err != nil {
-		h.logger.Error("Failed to get user ID for WebSocket broadcast", zap.Error(err))
-		return
-	}
-
 	// Calculate portfolio summary
-	portfolioSummary := h.calculatePortfolioSummary(userID)
+	portfolioSummary := h.calculatePortfolioSummary(portfolioID)
 	if portfolioSummary == nil {
 		return
 	}
 
 	// Broadcast portfolio update
 	update := services.PortfolioUpdate{
+		PortfolioID:               portfolioID,
 		TotalValue:                portfolioSummary["total_value"].(float64),
 		DailyChange:               portfolioSummary["daily_change"].(float64),
 		DailyChangePercent:        portfolioSummary["daily_change_percent"].(float64),
@@ -2550,29 +3046,38 @@ func (h *Handler) broadcastPortfolioUpdate(username string) {
 		UnrealizedGainLossPercent: portfolioSummary["unrealized_gain_loss_percent"].(float64),
 	}
 
-	h.services.WebSocket.BroadcastPortfolioUpdate(update)
+	h.services.WebSocket.BroadcastPortfolioUpdate(userID, update)
 	h.logger.Info("Broadcasted portfolio update via WebSocket",
-		zap.String("user", username),
+		zap.String("user_id", userID),
+		zap.String("portfolio_id", portfolioID),
 		zap.Float64("total_value", update.TotalValue))
 }
 
 // Helper function to calculate portfolio summary for WebSocket broadcasting
-func (h *Handler) calculatePortfolioSummary(userID string) map[string]interface{} {
+func (h *Handler) calculatePortfolioSummary(portfolioID string) map[string]interface{} {
+	fx, err := h.newFXConverter(h.services.DB, portfolioID)
+	if err != nil {
+		h.logger.Error("Failed to load base currency for WebSocket", zap.Error(err))
+		return nil
+	}
+
 	query := `
 		SELECT
 			ph.id,
+			ph.asset_id,
 			a.symbol,
 			a.name,
+			COALESCE(a.currency, 'USD') as currency,
 			ph.quantity,
 			ph.average_cost,
 			ph.purchase_date
 		FROM portfolio_holdings ph
 		JOIN assets a ON ph.asset_id = a.id
-		WHERE ph.user_id = $1
+		WHERE ph.portfolio_id = $1
 		ORDER BY ph.created_at DESC
 	`
 
-	rows, err := h.services.DB.Query(query, userID)
+	rows, err := h.services.DB.Query(query, portfolioID)
 	if err != nil {
 		h.logger.Error("Failed to query portfolio for WebSocket", zap.Error(err))
 		return nil
@@ -2583,35 +3088,45 @@ func (h *Handler) calculatePortfolioSummary(userID string) map[string]interface{
 	holdingCount := 0
 
 	for rows.Next() {
-		var id, symbol, name, purchaseDate string
+		var id, assetID, symbol, name, currency, purchaseDate string
 		var quantity, averageCost float64
 
-		err := rows.Scan(&id, &symbol, &name, &quantity, &averageCost, &purchaseDate)
+		err := rows.Scan(&id, &assetID, &symbol, &name, &currency, &quantity, &averageCost, &purchaseDate)
 		if err != nil {
 			h.logger.Error("Failed to scan portfolio row for WebSocket", zap.Error(err))
 			continue
 		}
 
 		holdingCount++
-		costBasis := quantity * averageCost
-		totalCost += costBasis
 
-		// Get current price from Finnhub
+		// Get current price from the market data provider
 		currentPrice := averageCost // fallback to average cost
-		if h.services.Finnhub != nil {
-			if quote, priceErr := h.services.Finnhub.GetQuote(symbol); priceErr == nil {
+		if h.services.MarketData != nil {
+			if quote, priceErr := h.services.MarketData.GetQuote(symbol); priceErr == nil {
 				currentPrice = quote.CurrentPrice
 			}
 		}
 
-		currentValue := quantity * currentPrice
-		totalValue += currentValue
-		totalGainLoss += (currentValue - costBasis)
+		valuation, err := fx.value(assetID, currency, quantity*averageCost, quantity*currentPrice)
+		if err != nil {
+			h.logger.Error("Failed to convert holding for WebSocket", zap.String("symbol", symbol), zap.Error(err))
+			return nil
+		}
+		totalCost += valuation.CostBasis
+		totalValue += valuation.MarketValue
+		totalGainLoss += valuation.PriceGainLoss + valuation.FXGainLoss
+	}
+
+	// Cash is part of the portfolio's value
+	_, cashTotal, err := h.getCashBalances(h.services.DB, portfolioID, fx)
+	if err != nil {
+		h.logger.Warn("Failed to query cash balances for WebSocket", zap.Error(err))
 	}
+	totalValue += cashTotal
 
 	if holdingCount == 0 {
 		return map[string]interface{}{
-			"total_value":                  0.0,
+			"total_value":                  totalValue,
 			"total_cost":                   0.0,
 			"daily_change":                 0.0,
 			"daily_change_percent":         0.0,
@@ -2647,11 +3162,11 @@ func (h *Handler) calculatePortfolioSummary(userID string) map[string]interface{
 
 // Helper function to broadcast price updates for specific symbols
 func (h *Handler) broadcastPriceUpdate(symbol string) {
-	if h.services.WebSocket == nil || h.services.Finnhub == nil {
+	if h.services.WebSocket == nil || h.services.MarketData == nil {
 		return
 	}
 
-	quote, err := h.services.Finnhub.GetQuote(symbol)
+	quote, err := h.services.MarketData.GetQuote(symbol)
 	if err != nil {
 		h.logger.Error("Failed to get quote for WebSocket broadcast",
 			zap.String("symbol", symbol), zap.Error(err))
@@ -2665,6 +3180,7 @@ func (h *Handler) broadcastPriceUpdate(symbol string) {
 		ChangePercent: quote.PercentChange,
 		High:          quote.HighPriceOfDay,
 		Low:           quote.LowPriceOfDay,
+		Stale:         quote.Stale,
 	}
 
 	h.services.WebSocket.BroadcastPriceUpdate(update)
@@ -2688,11 +3204,8 @@ func (h *Handler) GetTransaction(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
-	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+	userID, ok := h.requireUserID(c)
+	if !ok {
 		return
 	}
 
@@ -2701,7 +3214,7 @@ func (h *Handler) GetTransaction(c *gin.Context) {
 		SELECT 
 			t.id, t.transaction_type, t.quantity, t.price, t.fees, 
 			t.total_amount, t.transaction_date, t.notes,
-			a.symbol, a.name, a.asset_type
+			a.symbol, a.name, a.asset_type, t.realized_pnl
 		FROM transactions t
 		JOIN assets a ON t.asset_id = a.id
 		WHERE t.id = $1 AND t.user_id = $2
@@ -2709,10 +3222,11 @@ func (h *Handler) GetTransaction(c *gin.Context) {
 
 	var id, transactionType, notes, symbol, name, assetType, transactionDate string
 	var quantity, price, fees, totalAmount float64
+	var realizedPnL sql.NullFloat64
 
-	err = h.services.DB.QueryRow(query, transactionID, userID).Scan(
+	err := h.services.DB.QueryRow(query, transactionID, userID).Scan(
 		&id, &transactionType, &quantity, &price, &fees,
-		&totalAmount, &transactionDate, &notes, &symbol, &name, &assetType)
+		&totalAmount, &transactionDate, &notes, &symbol, &name, &assetType, &realizedPnL)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -2724,7 +3238,7 @@ func (h *Handler) GetTransaction(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	response := gin.H{
 		"id":               id,
 		"transaction_type": transactionType,
 		"symbol":           symbol,
@@ -2736,7 +3250,12 @@ func (h *Handler) GetTransaction(c *gin.Context) {
 		"total_amount":     totalAmount,
 		"transaction_date": transactionDate,
 		"notes":            notes,
-	})
+		"realized_pnl":     nil,
+	}
+	if realizedPnL.Valid {
+		response["realized_pnl"] = realizedPnL.Float64
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 func (h *Handler) UpdateTransaction(c *gin.Context) {
@@ -2772,22 +3291,28 @@ func (h *Handler) UpdateTransaction(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	tx, err := h.services.DB.Begin()
 	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		h.logger.Error("Failed to begin transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update transaction"})
 		return
 	}
+	defer tx.Rollback()
 
 	// Check if transaction exists and belongs to user
 	var existingQuantity, existingPrice, existingFees float64
-	var existingNotes, transactionType string
-	err = h.services.DB.QueryRow(`
-		SELECT quantity, price, fees, notes, transaction_type
+	var existingNotes, transactionType, portfolioID, assetID string
+	var transactionDate time.Time
+	err = tx.QueryRow(`
+		SELECT quantity, price, fees, notes, transaction_type, portfolio_id, asset_id, transaction_date
 		FROM transactions
 		WHERE id = $1 AND user_id = $2
-	`, transactionID, userID).Scan(&existingQuantity, &existingPrice, &existingFees, &existingNotes, &transactionType)
+	`, transactionID, userID).Scan(&existingQuantity, &existingPrice, &existingFees, &existingNotes, &transactionType, &portfolioID, &assetID, &transactionDate)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -2799,6 +3324,22 @@ func (h *Handler) UpdateTransaction(c *gin.Context) {
 		return
 	}
 
+	if isCorporateActionTransaction(transactionType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Entries written by a corporate action can only be undone by reversing the action"})
+		return
+	}
+
+	// Cash movements are stored at a price of 1 with no fees; only their amount (quantity) can change.
+	// Cash dividends are also priced at 1, but their fees (tax withheld) can be corrected.
+	if isCashTransaction(transactionType) && (request.Price != nil || request.Fees != nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only quantity and notes can be changed on " + transactionType + " transactions"})
+		return
+	}
+	if transactionType == transactionDividend && request.Price != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The price of a DIVIDEND can't be changed; update its quantity (amount) instead"})
+		return
+	}
+
 	// Prepare update values
 	newQuantity := existingQuantity
 	newPrice := existingPrice
@@ -2818,20 +3359,56 @@ func (h *Handler) UpdateTransaction(c *gin.Context) {
 		newNotes = *request.Notes
 	}
 
+	if transactionType == transactionDividend && newFees >= newQuantity {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Tax withheld (fees) must be less than the dividend amount"})
+		return
+	}
+
 	// Calculate new total amount
-	newTotalAmount := newQuantity * newPrice
-	if transactionType == "BUY" {
-		newTotalAmount += newFees
-	} else {
-		newTotalAmount -= newFees
+	totalAmount := func(quantity, price, fees float64) float64 {
+		if transactionType == "BUY" || transactionType == transactionDividendReinvest {
+			return quantity*price + fees
+		}
+		return quantity*price - fees
+	}
+	newTotalAmount := totalAmount(newQuantity, newPrice, newFees)
+
+	// A purchase or withdrawal that now spends more is held to the cash rule, against the cash it
+	// didn't already spend
+	if transactionType == "BUY" || transactionType == transactionWithdrawal {
+		existingTotalAmount := totalAmount(existingQuantity, existingPrice, existingFees)
+		if increase := newTotalAmount - existingTotalAmount; increase > 0 {
+			covered, balance, currency, err := h.cashCovers(tx, portfolioID, assetID, increase)
+			if err != nil {
+				h.logger.Error("Failed to check cash balance", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update transaction"})
+				return
+			}
+			if !covered {
+				message := "Insufficient cash to cover purchase"
+				if transactionType == transactionWithdrawal {
+					message = "Insufficient cash for withdrawal"
+				}
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":        message,
+					"currency":     currency,
+					"cash_balance": balance + existingTotalAmount,
+					"total_amount": newTotalAmount,
+				})
+				return
+			}
+		}
 	}
 
 	// Update the transaction
-	_, err = h.services.DB.Exec(`
+	_, err = tx.Exec(`
 		UPDATE transactions
 		SET quantity = $1, price = $2, fees = $3, notes = $4, total_amount = $5
 		WHERE id = $6 AND user_id = $7
 	`, newQuantity, newPrice, newFees, newNotes, newTotalAmount, transactionID, userID)
+	if err == nil {
+		err = h.invalidateSnapshots(tx, portfolioID, transactionDate)
+	}
 
 	if err != nil {
 		h.logger.Error("Failed to update transaction", zap.Error(err))
@@ -2839,6 +3416,18 @@ func (h *Handler) UpdateTransaction(c *gin.Context) {
 		return
 	}
 
+	// Replay the asset's ledger so holdings reflect the edit
+	if _, _, err = h.rebuildHoldings(tx, userID, portfolioID, assetID); err != nil {
+		h.respondLedgerError(c, err, "Failed to update transaction")
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		h.logger.Error("Failed to commit transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update transaction"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message":      "Transaction updated successfully",
 		"id":           transactionID,
@@ -2848,6 +3437,8 @@ func (h *Handler) UpdateTransaction(c *gin.Context) {
 		"notes":        newNotes,
 		"total_amount": newTotalAmount,
 	})
+
+	go h.broadcastPortfolioUpdate(userID, portfolioID)
 }
 
 func (h *Handler) DeleteTransaction(c *gin.Context) {
@@ -2865,23 +3456,29 @@ func (h *Handler) DeleteTransaction(c *gin.Context) {
 	}
 
 	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	tx, err := h.services.DB.Begin()
 	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		h.logger.Error("Failed to begin transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete transaction"})
 		return
 	}
+	defer tx.Rollback()
 
 	// Check if transaction exists and get details for response
-	var transactionType, symbol string
+	var transactionType, symbol, portfolioID, assetID string
 	var quantity float64
-	err = h.services.DB.QueryRow(`
-		SELECT t.transaction_type, t.quantity, a.symbol
+	var transactionDate time.Time
+	err = tx.QueryRow(`
+		SELECT t.transaction_type, t.quantity, a.symbol, t.portfolio_id, t.asset_id, t.transaction_date
 		FROM transactions t
 		JOIN assets a ON t.asset_id = a.id
 		WHERE t.id = $1 AND t.user_id = $2
-	`, transactionID, userID).Scan(&transactionType, &quantity, &symbol)
+	`, transactionID, userID).Scan(&transactionType, &quantity, &symbol, &portfolioID, &assetID, &transactionDate)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -2893,8 +3490,13 @@ func (h *Handler) DeleteTransaction(c *gin.Context) {
 		return
 	}
 
+	if isCorporateActionTransaction(transactionType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Entries written by a corporate action can only be undone by reversing the action"})
+		return
+	}
+
 	// Delete the transaction
-	result, err := h.services.DB.Exec(`
+	result, err := tx.Exec(`
 		DELETE FROM transactions
 		WHERE id = $1 AND user_id = $2
 	`, transactionID, userID)
@@ -2918,12 +3520,31 @@ func (h *Handler) DeleteTransaction(c *gin.Context) {
 		return
 	}
 
+	if err = h.invalidateSnapshots(tx, portfolioID, transactionDate); err != nil {
+		h.logger.Error("Failed to delete transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete transaction"})
+		return
+	}
+
+	// Replay the asset's ledger so holdings no longer include the transaction
+	if _, _, err = h.rebuildHoldings(tx, userID, portfolioID, assetID); err != nil {
+		h.respondLedgerError(c, err, "Failed to delete transaction")
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		h.logger.Error("Failed to commit transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete transaction"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message":          "Transaction deleted successfully",
 		"id":               transactionID,
 		"symbol":           symbol,
 		"transaction_type": transactionType,
 		"quantity":         quantity,
-		"note":             "Portfolio holdings may need manual adjustment after transaction deletion",
 	})
+
+	go h.broadcastPortfolioUpdate(userID, portfolioID)
 }
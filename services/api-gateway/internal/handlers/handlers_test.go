@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gin-gonic/gin"
@@ -59,8 +60,10 @@ func TestHandler_GetPortfolio(t *testing.T) {
 		AddRow("1", "AAPL", "Apple Inc.", "STOCK", 10.0, 150.0, "2024-01-01").
 		AddRow("2", "GOOGL", "Alphabet Inc.", "STOCK", 5.0, 2800.0, "2024-01-02")
 
-	mock.ExpectQuery("SELECT (.+) FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id JOIN users u ON ph.user_id = u.id WHERE u.username = (.+) ORDER BY ph.created_at DESC").
-		WithArgs("default_user").
+	expectDefaultPortfolio(mock, "user-123", "portfolio-123")
+
+	mock.ExpectQuery("SELECT (.+) FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = (.+) ORDER BY ph.created_at DESC").
+		WithArgs("portfolio-123").
 		WillReturnRows(rows)
 
 	mockServices := &services.Services{
@@ -72,6 +75,7 @@ func TestHandler_GetPortfolio(t *testing.T) {
 
 	// Create a test router
 	router := gin.New()
+	router.Use(withTestUser("user-123"))
 	router.GET("/portfolio", handler.GetPortfolio)
 
 	// Create a test request
@@ -132,17 +136,23 @@ func TestHandler_AddHolding(t *testing.T) {
 	defer db.Close()
 
 	// Set up expected queries
-	mock.ExpectQuery("SELECT id FROM users WHERE username = (.+)").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-123"))
+	expectDefaultPortfolio(mock, "user-123", "portfolio-123")
 
 	mock.ExpectQuery("SELECT id FROM assets WHERE symbol = (.+)").
 		WithArgs("AAPL").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("asset-123"))
 
-	mock.ExpectExec("INSERT INTO portfolio_holdings (.+) ON CONFLICT (.+) DO UPDATE SET (.+)").
-		WithArgs("user-123", "asset-123", 10.0, 150.0).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	// The holding is recorded as a funded purchase and rebuilt from the ledger
+	mock.ExpectBegin()
+	expectFundingDeposit(mock, "user-123", "portfolio-123", "asset-123", 1500.0)
+	expectLedgerEntry(mock, "user-123", "portfolio-123", "asset-123", "BUY", 10.0, 150.0, "Added from holdings")
+	expectReplay(mock, "portfolio-123", "asset-123",
+		newLedgerRows().AddRow("tx-1", "asset-123", "AAPL", "BUY", 10.0, 150.0, 0.0, time.Now(), "", nil, nil, nil),
+		newStoredHoldingRows(),
+		newStoredLotRows())
+	expectLotInsert(mock, "tx-1", 10.0, 10.0)
+	expectHoldingUpsert(mock, "asset-123", 10.0, 150.0)
+	mock.ExpectCommit()
 
 	mockServices := &services.Services{
 		DB:     db,
@@ -153,6 +163,7 @@ func TestHandler_AddHolding(t *testing.T) {
 
 	// Create a test router
 	router := gin.New()
+	router.Use(withTestUser("user-123"))
 	router.POST("/portfolio/holdings", handler.AddHolding)
 
 	// Create a test request with JSON body
@@ -243,17 +254,23 @@ func TestHandler_UpdateHolding(t *testing.T) {
 	defer db.Close()
 
 	// Set up expected queries
-	mock.ExpectQuery("SELECT id FROM users WHERE username = (.+)").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-123"))
-
-	mock.ExpectQuery("SELECT ph.quantity, ph.average_cost, a.symbol FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)").
+	mock.ExpectQuery("SELECT ph.quantity, ph.average_cost, a.symbol, ph.portfolio_id, ph.asset_id FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)").
 		WithArgs("holding-123", "user-123").
-		WillReturnRows(sqlmock.NewRows([]string{"quantity", "average_cost", "symbol"}).AddRow(10.0, 150.0, "AAPL"))
-
-	mock.ExpectExec("UPDATE portfolio_holdings SET quantity = (.+), average_cost = (.+), updated_at = NOW\\(\\) WHERE id = (.+) AND user_id = (.+)").
-		WithArgs(15.0, 160.0, "holding-123", "user-123").
-		WillReturnResult(sqlmock.NewResult(1, 1))
+		WillReturnRows(sqlmock.NewRows([]string{"quantity", "average_cost", "symbol", "portfolio_id", "asset_id"}).AddRow(10.0, 150.0, "AAPL", "portfolio-123", "asset-123"))
+
+	// The edit is recorded as an adjustment and rebuilt from the ledger
+	mock.ExpectBegin()
+	expectLedgerEntry(mock, "user-123", "portfolio-123", "asset-123", "ADJUST", 15.0, 160.0, "Holding updated")
+	expectReplay(mock, "portfolio-123", "asset-123",
+		newLedgerRows().
+			AddRow("tx-1", "asset-123", "AAPL", "BUY", 10.0, 150.0, 0.0, time.Now().AddDate(0, -1, 0), "", nil, nil, nil).
+			AddRow("tx-2", "asset-123", "AAPL", "ADJUST", 15.0, 160.0, 0.0, time.Now(), "", nil, nil, nil),
+		newStoredHoldingRows().AddRow("asset-123", "AAPL", 10.0, 150.0),
+		newStoredLotRows().AddRow("lot-1", "tx-1"))
+	expectLotInsert(mock, "tx-1", 10.0, 0.0)
+	expectLotInsert(mock, "tx-2", 15.0, 15.0)
+	expectHoldingUpsert(mock, "asset-123", 15.0, 160.0)
+	mock.ExpectCommit()
 
 	mockServices := &services.Services{
 		DB:     db,
@@ -264,6 +281,7 @@ func TestHandler_UpdateHolding(t *testing.T) {
 
 	// Create a test router
 	router := gin.New()
+	router.Use(withTestUser("user-123"))
 	router.PUT("/portfolio/holdings/:id", handler.UpdateHolding)
 
 	// Create a test request with JSON body
@@ -352,11 +370,7 @@ func TestHandler_UpdateHolding_NotFound(t *testing.T) {
 	defer db.Close()
 
 	// Set up expected queries
-	mock.ExpectQuery("SELECT id FROM users WHERE username = (.+)").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-123"))
-
-	mock.ExpectQuery("SELECT ph.quantity, ph.average_cost, a.symbol FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)").
+	mock.ExpectQuery("SELECT ph.quantity, ph.average_cost, a.symbol, ph.portfolio_id, ph.asset_id FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)").
 		WithArgs("nonexistent-holding", "user-123").
 		WillReturnError(sqlmock.ErrCancelled)
 
@@ -369,6 +383,7 @@ func TestHandler_UpdateHolding_NotFound(t *testing.T) {
 
 	// Create a test router
 	router := gin.New()
+	router.Use(withTestUser("user-123"))
 	router.PUT("/portfolio/holdings/:id", handler.UpdateHolding)
 
 	// Create a test request
@@ -399,17 +414,22 @@ func TestHandler_RemoveHolding(t *testing.T) {
 	defer db.Close()
 
 	// Set up expected queries
-	mock.ExpectQuery("SELECT id FROM users WHERE username = (.+)").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-123"))
-
-	mock.ExpectQuery("SELECT a.symbol, ph.quantity FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)").
+	mock.ExpectQuery("SELECT a.symbol, ph.quantity, ph.portfolio_id, ph.asset_id FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)").
 		WithArgs("holding-123", "user-123").
-		WillReturnRows(sqlmock.NewRows([]string{"symbol", "quantity"}).AddRow("AAPL", 10.0))
-
-	mock.ExpectExec("DELETE FROM portfolio_holdings WHERE id = (.+) AND user_id = (.+)").
-		WithArgs("holding-123", "user-123").
-		WillReturnResult(sqlmock.NewResult(1, 1))
+		WillReturnRows(sqlmock.NewRows([]string{"symbol", "quantity", "portfolio_id", "asset_id"}).AddRow("AAPL", 10.0, "portfolio-123", "asset-123"))
+
+	// The removal is recorded as an adjustment to zero
+	mock.ExpectBegin()
+	expectLedgerEntry(mock, "user-123", "portfolio-123", "asset-123", "ADJUST", 0.0, 0.0, "Holding removed")
+	expectReplay(mock, "portfolio-123", "asset-123",
+		newLedgerRows().
+			AddRow("tx-1", "asset-123", "AAPL", "BUY", 10.0, 150.0, 0.0, time.Now().AddDate(0, -1, 0), "", nil, nil, nil).
+			AddRow("tx-2", "asset-123", "AAPL", "ADJUST", 0.0, 0.0, 0.0, time.Now(), "", nil, nil, nil),
+		newStoredHoldingRows().AddRow("asset-123", "AAPL", 10.0, 150.0),
+		newStoredLotRows().AddRow("lot-1", "tx-1"))
+	expectLotInsert(mock, "tx-1", 10.0, 0.0)
+	expectHoldingDelete(mock, "portfolio-123", "asset-123")
+	mock.ExpectCommit()
 
 	mockServices := &services.Services{
 		DB:     db,
@@ -420,6 +440,7 @@ func TestHandler_RemoveHolding(t *testing.T) {
 
 	// Create a test router
 	router := gin.New()
+	router.Use(withTestUser("user-123"))
 	router.DELETE("/portfolio/holdings/:id", handler.RemoveHolding)
 
 	// Create a test request
@@ -475,11 +496,7 @@ func TestHandler_RemoveHolding_NotFound(t *testing.T) {
 	defer db.Close()
 
 	// Set up expected queries
-	mock.ExpectQuery("SELECT id FROM users WHERE username = (.+)").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-123"))
-
-	mock.ExpectQuery("SELECT a.symbol, ph.quantity FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)").
+	mock.ExpectQuery("SELECT a.symbol, ph.quantity, ph.portfolio_id, ph.asset_id FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)").
 		WithArgs("nonexistent-holding", "user-123").
 		WillReturnError(sqlmock.ErrCancelled)
 
@@ -492,6 +509,7 @@ func TestHandler_RemoveHolding_NotFound(t *testing.T) {
 
 	// Create a test router
 	router := gin.New()
+	router.Use(withTestUser("user-123"))
 	router.DELETE("/portfolio/holdings/:id", handler.RemoveHolding)
 
 	// Create a test request
@@ -520,30 +538,32 @@ func TestHandler_GetPortfolioSummary(t *testing.T) {
 	defer db.Close()
 
 	// Set up expected queries
-	mock.ExpectQuery("SELECT id FROM users WHERE username = (.+)").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-123"))
-
 	// Portfolio summary query
-	mock.ExpectQuery("SELECT COUNT\\(\\*\\) as total_holdings, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_cost, COALESCE\\(SUM\\(ph.quantity\\), 0\\) as total_shares FROM portfolio_holdings ph WHERE ph.user_id = (.+)").
-		WithArgs("user-123").
-		WillReturnRows(sqlmock.NewRows([]string{"total_holdings", "total_cost", "total_shares"}).AddRow(2, 15500.0, 15.0))
+	expectDefaultPortfolio(mock, "user-123", "portfolio-123")
+	expectBaseCurrency(mock, "portfolio-123", "USD")
+
+	mock.ExpectQuery("SELECT COALESCE\\(a.currency, 'USD'\\) as currency, COUNT\\(\\*\\) as total_holdings, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_cost, COALESCE\\(SUM\\(ph.quantity\\), 0\\) as total_shares FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = (.+) GROUP BY").
+		WithArgs("portfolio-123").
+		WillReturnRows(sqlmock.NewRows([]string{"currency", "total_holdings", "total_cost", "total_shares"}).AddRow("USD", 2, 15500.0, 15.0))
 
 	// Asset allocation query
-	allocationRows := sqlmock.NewRows([]string{"asset_type", "count", "total_value"}).
-		AddRow("STOCK", 2, 15500.0)
-	mock.ExpectQuery("SELECT a.asset_type, COUNT\\(\\*\\) as count, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.user_id = (.+) GROUP BY a.asset_type ORDER BY total_value DESC").
-		WithArgs("user-123").
+	allocationRows := sqlmock.NewRows([]string{"asset_type", "currency", "count", "total_value"}).
+		AddRow("STOCK", "USD", 2, 15500.0)
+	mock.ExpectQuery("SELECT a.asset_type, COALESCE\\(a.currency, 'USD'\\) as currency, COUNT\\(\\*\\) as count, COALESCE\\(SUM\\(ph.quantity \\* ph.average_cost\\), 0\\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = (.+) GROUP BY a.asset_type, COALESCE\\(a.currency, 'USD'\\) ORDER BY total_value DESC").
+		WithArgs("portfolio-123").
 		WillReturnRows(allocationRows)
 
 	// Top holdings query
-	topHoldingsRows := sqlmock.NewRows([]string{"symbol", "name", "quantity", "average_cost", "total_value"}).
-		AddRow("AAPL", "Apple Inc.", 10.0, 150.0, 1500.0).
-		AddRow("GOOGL", "Alphabet Inc.", 5.0, 2800.0, 14000.0)
-	mock.ExpectQuery("SELECT a.symbol, a.name, ph.quantity, ph.average_cost, \\(ph.quantity \\* ph.average_cost\\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.user_id = (.+) ORDER BY \\(ph.quantity \\* ph.average_cost\\) DESC LIMIT 5").
-		WithArgs("user-123").
+	topHoldingsRows := sqlmock.NewRows([]string{"symbol", "name", "currency", "quantity", "average_cost", "total_value"}).
+		AddRow("AAPL", "Apple Inc.", "USD", 10.0, 150.0, 1500.0).
+		AddRow("GOOGL", "Alphabet Inc.", "USD", 5.0, 2800.0, 14000.0)
+	mock.ExpectQuery("SELECT a.symbol, a.name, COALESCE\\(a.currency, 'USD'\\) as currency, ph.quantity, ph.average_cost, \\(ph.quantity \\* ph.average_cost\\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = (.+) ORDER BY \\(ph.quantity \\* ph.average_cost\\) DESC").
+		WithArgs("portfolio-123").
 		WillReturnRows(topHoldingsRows)
 
+	// Cash balances
+	expectCashBalances(mock, "portfolio-123", newCashBalanceRows())
+
 	mockServices := &services.Services{
 		DB:     db,
 		Logger: logger,
@@ -553,6 +573,7 @@ func TestHandler_GetPortfolioSummary(t *testing.T) {
 
 	// Create a test router
 	router := gin.New()
+	router.Use(withTestUser("user-123"))
 	router.GET("/portfolio/summary", handler.GetPortfolioSummary)
 
 	// Create a test request
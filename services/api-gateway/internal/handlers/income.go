@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// incomeBucket accumulates dividend income for one group of payments
+type incomeBucket struct {
+	Income      float64 `json:"income"` // gross, before tax withheld
+	Withholding float64 `json:"withholding"`
+	NetIncome   float64 `json:"net_income"`
+	Reinvested  float64 `json:"reinvested"`
+	Payments    int     `json:"payments"`
+}
+
+func (b *incomeBucket) add(gross, withheld float64, reinvested bool) {
+	b.Income += gross
+	b.Withholding += withheld
+	b.NetIncome += gross - withheld
+	if reinvested {
+		b.Reinvested += gross
+	}
+	b.Payments++
+}
+
+// Helper function to get the dividend income of a portfolio, net of tax withheld, converted into its
+// base currency at today's rates
+func (h *Handler) getIncomeTotal(portfolioID string, fx *fxConverter) (float64, error) {
+	rows, err := h.services.DB.Query(`
+		SELECT COALESCE(a.currency, 'USD') as currency, COALESCE(SUM(CASE t.transaction_type
+			WHEN 'DIVIDEND' THEN t.total_amount
+			ELSE t.quantity * t.price
+		END), 0)
+		FROM transactions t
+		JOIN assets a ON t.asset_id = a.id
+		WHERE t.portfolio_id = $1 AND t.transaction_type IN ('DIVIDEND', 'DIVIDEND_REINVEST')
+		GROUP BY COALESCE(a.currency, 'USD')
+	`, portfolioID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var income float64
+	for rows.Next() {
+		var currency string
+		var currencyIncome float64
+		if err := rows.Scan(&currency, &currencyIncome); err != nil {
+			return 0, err
+		}
+		converted, err := fx.convert(currencyIncome, currency)
+		if err != nil {
+			return 0, err
+		}
+		income += converted
+	}
+	return income, rows.Err()
+}
+
+// GetIncome reports dividend income by symbol and month, with trailing-12-month yield and yield on cost
+func (h *Handler) GetIncome(c *gin.Context) {
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch income"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
+		return
+	}
+
+	// Get query parameters
+	year := c.Query("year")
+	if year != "" {
+		if _, err := strconv.Atoi(year); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid year"})
+			return
+		}
+	}
+	assetSymbol := strings.ToUpper(c.Query("symbol"))
+
+	// The year filter is applied below, since trailing yields always look at the last 12 months
+	query := `
+		SELECT
+			a.symbol,
+			t.transaction_type,
+			t.quantity * t.price as gross,
+			CASE WHEN t.transaction_type = 'DIVIDEND' THEN COALESCE(t.fees, 0) ELSE 0 END as withholding,
+			t.transaction_date
+		FROM transactions t
+		JOIN assets a ON t.asset_id = a.id
+		WHERE t.portfolio_id = $1 AND t.transaction_type IN ('DIVIDEND', 'DIVIDEND_REINVEST')
+	`
+	args := []interface{}{portfolioID}
+
+	if assetSymbol != "" {
+		args = append(args, assetSymbol)
+		query += fmt.Sprintf(" AND a.symbol = $%d", len(args))
+	}
+
+	query += " ORDER BY t.transaction_date ASC"
+
+	rows, err := h.services.DB.Query(query, args...)
+	if err != nil {
+		h.logger.Error("Failed to query dividend income", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch income"})
+		return
+	}
+	defer rows.Close()
+
+	total := &incomeBucket{}
+	bySymbol := make(map[string]*incomeBucket)
+	byMonth := make(map[string]*incomeBucket)
+	trailing := make(map[string]float64) // symbol -> gross income over the last 12 months
+	var trailingTotal float64
+	trailingStart := time.Now().AddDate(-1, 0, 0)
+
+	bucket := func(groups map[string]*incomeBucket, key string) *incomeBucket {
+		if groups[key] == nil {
+			groups[key] = &incomeBucket{}
+		}
+		return groups[key]
+	}
+
+	for rows.Next() {
+		var symbol, transactionType string
+		var gross, withheld float64
+		var paidAt time.Time
+
+		err := rows.Scan(&symbol, &transactionType, &gross, &withheld, &paidAt)
+		if err != nil {
+			h.logger.Error("Failed to scan dividend row", zap.Error(err))
+			continue
+		}
+
+		if paidAt.After(trailingStart) {
+			trailing[symbol] += gross
+			trailingTotal += gross
+		}
+
+		if year != "" && paidAt.Format("2006") != year {
+			continue
+		}
+
+		reinvested := transactionType == transactionDividendReinvest
+		total.add(gross, withheld, reinvested)
+		bucket(bySymbol, symbol).add(gross, withheld, reinvested)
+		bucket(byMonth, paidAt.Format("2006-01")).add(gross, withheld, reinvested)
+	}
+
+	// Yields compare trailing income with what is held now, at market value and at cost
+	holdingsQuery := `
+		SELECT
+			a.symbol,
+			ph.quantity,
+			ph.average_cost
+		FROM portfolio_holdings ph
+		JOIN assets a ON ph.asset_id = a.id
+		WHERE ph.portfolio_id = $1
+	`
+	holdingsArgs := []interface{}{portfolioID}
+	if assetSymbol != "" {
+		holdingsArgs = append(holdingsArgs, assetSymbol)
+		holdingsQuery += " AND a.symbol = $2"
+	}
+
+	holdingsRows, err := h.services.DB.Query(holdingsQuery, holdingsArgs...)
+	if err != nil {
+		h.logger.Error("Failed to query holdings for yield", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch income"})
+		return
+	}
+	defer holdingsRows.Close()
+
+	marketValues := make(map[string]float64)
+	costBases := make(map[string]float64)
+	var totalMarketValue, totalCostBasis float64
+	for holdingsRows.Next() {
+		var symbol string
+		var quantity, averageCost float64
+
+		err := holdingsRows.Scan(&symbol, &quantity, &averageCost)
+		if err != nil {
+			h.logger.Error("Failed to scan holdings row", zap.Error(err))
+			continue
+		}
+
+		currentPrice := averageCost // fallback to average cost
+		if h.services.MarketData != nil {
+			if quote, priceErr := h.services.MarketData.GetQuote(symbol); priceErr == nil {
+				currentPrice = quote.CurrentPrice
+			}
+		}
+
+		marketValues[symbol] = quantity * currentPrice
+		costBases[symbol] = quantity * averageCost
+		totalMarketValue += quantity * currentPrice
+		totalCostBasis += quantity * averageCost
+	}
+
+	symbols := make([]string, 0, len(bySymbol))
+	for symbol := range bySymbol {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	bySymbolResult := make([]map[string]interface{}, 0, len(symbols))
+	for _, symbol := range symbols {
+		b := bySymbol[symbol]
+		bySymbolResult = append(bySymbolResult, map[string]interface{}{
+			"symbol":              symbol,
+			"income":              b.Income,
+			"withholding":         b.Withholding,
+			"net_income":          b.NetIncome,
+			"reinvested":          b.Reinvested,
+			"payments":            b.Payments,
+			"trailing_12m_income": trailing[symbol],
+			"market_value":        marketValues[symbol],
+			"cost_basis":          costBases[symbol],
+			"trailing_12m_yield":  percentOf(trailing[symbol], marketValues[symbol]),
+			"yield_on_cost":       percentOf(trailing[symbol], costBases[symbol]),
+		})
+	}
+
+	months := make([]string, 0, len(byMonth))
+	for month := range byMonth {
+		months = append(months, month)
+	}
+	sort.Strings(months)
+
+	byMonthResult := make([]map[string]interface{}, 0, len(months))
+	for _, month := range months {
+		b := byMonth[month]
+		byMonthResult = append(byMonthResult, map[string]interface{}{
+			"month":       month,
+			"income":      b.Income,
+			"withholding": b.Withholding,
+			"net_income":  b.NetIncome,
+			"reinvested":  b.Reinvested,
+			"payments":    b.Payments,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"portfolio_id": portfolioID,
+		"summary": gin.H{
+			"income":              total.Income,
+			"withholding":         total.Withholding,
+			"net_income":          total.NetIncome,
+			"reinvested":          total.Reinvested,
+			"payments":            total.Payments,
+			"trailing_12m_income": trailingTotal,
+			"market_value":        totalMarketValue,
+			"cost_basis":          totalCostBasis,
+			"trailing_12m_yield":  percentOf(trailingTotal, totalMarketValue),
+			"yield_on_cost":       percentOf(trailingTotal, totalCostBasis),
+		},
+		"by_symbol": bySymbolResult,
+		"by_month":  byMonthResult,
+	})
+}
+
+// percentOf returns part as a percentage of whole, or 0 when whole isn't positive
+func percentOf(part, whole float64) float64 {
+	if whole <= 0 {
+		return 0
+	}
+	return (part / whole) * 100
+}
@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectIncomeReads expects the dividend and holdings reads of an income report: AAPL paid a
+// dividend with tax withheld and a reinvested one within the last year, MSFT paid one in 2020
+func expectIncomeReads(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.portfolio_id = \$1 AND t.transaction_type IN \('DIVIDEND', 'DIVIDEND_REINVEST'\) ORDER BY t.transaction_date ASC`).
+		WithArgs(testPortfolioID).
+		WillReturnRows(sqlmock.NewRows([]string{"symbol", "transaction_type", "gross", "withholding", "transaction_date"}).
+			AddRow("MSFT", "DIVIDEND", 40.0, 0.0, time.Date(2020, 3, 15, 0, 0, 0, 0, time.UTC)).
+			AddRow("AAPL", "DIVIDEND", 100.0, 15.0, time.Now().AddDate(0, -2, 0)).
+			AddRow("AAPL", "DIVIDEND_REINVEST", 50.0, 0.0, time.Now().AddDate(0, -1, 0)))
+	mock.ExpectQuery(`SELECT a.symbol, ph.quantity, ph.average_cost FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \$1`).
+		WithArgs(testPortfolioID).
+		WillReturnRows(sqlmock.NewRows([]string{"symbol", "quantity", "average_cost"}).
+			AddRow("AAPL", 10.0, 100.0))
+}
+
+type incomeResponse struct {
+	Summary struct {
+		Income            float64 `json:"income"`
+		Withholding       float64 `json:"withholding"`
+		NetIncome         float64 `json:"net_income"`
+		Reinvested        float64 `json:"reinvested"`
+		Payments          int     `json:"payments"`
+		Trailing12mIncome float64 `json:"trailing_12m_income"`
+		Trailing12mYield  float64 `json:"trailing_12m_yield"`
+		YieldOnCost       float64 `json:"yield_on_cost"`
+	} `json:"summary"`
+	BySymbol []struct {
+		Symbol            string  `json:"symbol"`
+		Income            float64 `json:"income"`
+		Trailing12mIncome float64 `json:"trailing_12m_income"`
+		YieldOnCost       float64 `json:"yield_on_cost"`
+	} `json:"by_symbol"`
+	ByMonth []struct {
+		Month  string  `json:"month"`
+		Income float64 `json:"income"`
+	} `json:"by_month"`
+}
+
+// TestGetIncome tests the dividend income report
+func TestGetIncome(t *testing.T) {
+	t.Run("income by symbol and month with yields", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		expectIncomeReads(mock)
+
+		router := createTestRouter(handler, "GET", "/analytics/income", handler.GetIncome)
+		req, _ := http.NewRequest("GET", "/analytics/income", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response incomeResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, 190.0, response.Summary.Income)
+		assert.Equal(t, 15.0, response.Summary.Withholding)
+		assert.Equal(t, 175.0, response.Summary.NetIncome)
+		assert.Equal(t, 50.0, response.Summary.Reinvested)
+		assert.Equal(t, 3, response.Summary.Payments)
+
+		// Only AAPL paid within the last year; without quotes its value is its cost of 1000
+		assert.Equal(t, 150.0, response.Summary.Trailing12mIncome)
+		assert.Equal(t, 15.0, response.Summary.Trailing12mYield)
+		assert.Equal(t, 15.0, response.Summary.YieldOnCost)
+
+		if assert.Len(t, response.BySymbol, 2) {
+			assert.Equal(t, "AAPL", response.BySymbol[0].Symbol)
+			assert.Equal(t, 150.0, response.BySymbol[0].Income)
+			assert.Equal(t, 15.0, response.BySymbol[0].YieldOnCost)
+			assert.Equal(t, "MSFT", response.BySymbol[1].Symbol)
+			assert.Equal(t, 0.0, response.BySymbol[1].Trailing12mIncome)
+			assert.Equal(t, 0.0, response.BySymbol[1].YieldOnCost)
+		}
+		if assert.Len(t, response.ByMonth, 3) {
+			assert.Equal(t, "2020-03", response.ByMonth[0].Month)
+			assert.Equal(t, 40.0, response.ByMonth[0].Income)
+		}
+
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("year filter keeps trailing yields", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		expectIncomeReads(mock)
+
+		router := createTestRouter(handler, "GET", "/analytics/income", handler.GetIncome)
+		req, _ := http.NewRequest("GET", "/analytics/income?year=2020", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response incomeResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, 40.0, response.Summary.Income)
+		assert.Equal(t, 1, response.Summary.Payments)
+		assert.Equal(t, 150.0, response.Summary.Trailing12mIncome)
+		assert.Len(t, response.BySymbol, 1)
+		assert.Len(t, response.ByMonth, 1)
+
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("invalid year", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+
+		router := createTestRouter(handler, "GET", "/analytics/income", handler.GetIncome)
+		req, _ := http.NewRequest("GET", "/analytics/income?year=last", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "Invalid year")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+// TestCreateTransaction_Dividends tests recording cash and reinvested dividends
+func TestCreateTransaction_Dividends(t *testing.T) {
+	tests := []struct {
+		name           string
+		requestBody    string
+		setupMock      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedBody   []string
+	}{
+		{
+			name:        "cash dividend net of tax withheld",
+			requestBody: `{"symbol": "AAPL", "transaction_type": "DIVIDEND", "amount": 24, "fees": 3.6}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = \$1`).
+					WithArgs("AAPL").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testAssetID))
+				mock.ExpectBegin()
+				// Stored as the amount at a price of 1; holdings aren't replayed
+				mock.ExpectQuery(`INSERT INTO transactions`).
+					WithArgs(testUserID, testPortfolioID, testAssetID, "DIVIDEND", 24.0, 1.0, 3.6, 20.4, "", nil, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("div1"))
+				expectSnapshotInvalidation(mock, testPortfolioID, sqlmock.AnyArg())
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+			expectedBody:   []string{"div1", `"type":"DIVIDEND"`, `"total_amount":20.4`},
+		},
+		{
+			name:        "reinvested dividend opens a fractional lot",
+			requestBody: `{"symbol": "AAPL", "transaction_type": "DIVIDEND_REINVEST", "quantity": 0.16, "price": 150}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = \$1`).
+					WithArgs("AAPL").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testAssetID))
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO transactions`).
+					WithArgs(testUserID, testPortfolioID, testAssetID, "DIVIDEND_REINVEST", 0.16, 150.0, 0.0, 24.0, "", nil, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("drip1"))
+				expectSnapshotInvalidation(mock, testPortfolioID, sqlmock.AnyArg())
+				expectReplay(mock, testPortfolioID, testAssetID,
+					newLedgerRows().
+						AddRow("tx1", testAssetID, "AAPL", "BUY", 10.0, 150.0, 0.0, time.Now().AddDate(0, -3, 0), "", nil, nil, nil).
+						AddRow("drip1", testAssetID, "AAPL", "DIVIDEND_REINVEST", 0.16, 150.0, 0.0, time.Now(), "", nil, nil, nil),
+					newStoredHoldingRows().AddRow(testAssetID, "AAPL", 10.0, 150.0),
+					newStoredLotRows().AddRow("lot1", "tx1"))
+				expectLotInsert(mock, "tx1", 10.0, 10.0)
+				expectLotInsert(mock, "drip1", 0.16, 0.16)
+				expectHoldingUpsert(mock, testAssetID, 10.16, 150.0)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+			expectedBody:   []string{"drip1", `"type":"DIVIDEND_REINVEST"`, `"total_amount":24`},
+		},
+		{
+			name:           "dividend without an amount",
+			requestBody:    `{"symbol": "AAPL", "transaction_type": "DIVIDEND"}`,
+			setupMock:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"Symbol and amount are required for DIVIDEND transactions"},
+		},
+		{
+			name:           "tax withheld exceeds the dividend",
+			requestBody:    `{"symbol": "AAPL", "transaction_type": "DIVIDEND", "amount": 10, "fees": 10}`,
+			setupMock:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"Tax withheld (fees) must be less than the dividend amount"},
+		},
+		{
+			name:           "reinvestment without a price",
+			requestBody:    `{"symbol": "AAPL", "transaction_type": "DIVIDEND_REINVEST", "quantity": 0.16}`,
+			setupMock:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"Symbol, quantity and price are required for DIVIDEND_REINVEST transactions"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock, cleanup := createTestHandler(t)
+			defer cleanup()
+
+			tt.setupMock(mock)
+
+			router := createTestRouter(handler, "POST", "/transactions", handler.CreateTransaction)
+
+			req, _ := http.NewRequest("POST", "/transactions", strings.NewReader(tt.requestBody))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			for _, expected := range tt.expectedBody {
+				assert.Contains(t, w.Body.String(), expected)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
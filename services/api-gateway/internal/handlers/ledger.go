@@ -0,0 +1,648 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// Ledger transaction types. ADJUST restates a position (written when holdings are edited directly).
+// DIVIDEND_REINVEST buys shares with a dividend and opens a lot like a BUY; a cash DIVIDEND doesn't
+// change the position. Cash movements (see cash.go) share the ledger but are skipped by replay.
+const (
+	transactionBuy              = "BUY"
+	transactionSell             = "SELL"
+	transactionAdjust           = "ADJUST"
+	transactionDividend         = "DIVIDEND"
+	transactionDividendReinvest = "DIVIDEND_REINVEST"
+)
+
+// Entries written by corporate actions (see corporate_actions.go). They move positions without moving
+// cash: TRANSFER_IN opens a lot, TRANSFER_OUT closes every open lot without realizing a gain or loss
+// and COST_ADJUST scales the cost of every open lot by its price.
+const (
+	transactionTransferIn  = "TRANSFER_IN"
+	transactionTransferOut = "TRANSFER_OUT"
+	transactionCostAdjust  = "COST_ADJUST"
+)
+
+// affectsHoldings reports whether replaying a transaction type changes the position in its asset
+func affectsHoldings(transactionType string) bool {
+	switch transactionType {
+	case transactionBuy, transactionSell, transactionAdjust, transactionDividendReinvest,
+		transactionTransferIn, transactionTransferOut, transactionCostAdjust:
+		return true
+	}
+	return false
+}
+
+// isCorporateActionTransaction reports whether a transaction type is only written by corporate actions
+func isCorporateActionTransaction(transactionType string) bool {
+	switch transactionType {
+	case transactionTransferIn, transactionTransferOut, transactionCostAdjust:
+		return true
+	}
+	return false
+}
+
+// Holdings whose quantity or average cost differ by less than this match the ledger
+const holdingTolerance = 1e-6
+
+// ledgerError reports the transaction at which a replay became inconsistent, e.g. a sale
+// of more than was held at the time
+type ledgerError struct {
+	TransactionID string
+	Err           error
+}
+
+func (e *ledgerError) Error() string {
+	return fmt.Sprintf("transaction %s: %v", e.TransactionID, e.Err)
+}
+
+func (e *ledgerError) Unwrap() error {
+	return e.Err
+}
+
+// ledgerEntry is a transaction as read by the replay engine
+type ledgerEntry struct {
+	ID                string
+	AssetID           string
+	Symbol            string
+	Type              string
+	Quantity          float64
+	Price             float64
+	Fees              float64
+	Date              time.Time
+	CostBasisMethod   string
+	LotTransactionIDs []string
+	RealizedPnL       sql.NullFloat64
+	AcquiredAt        sql.NullTime // a TRANSFER_IN's lot keeps the holding period of the lot it moved
+}
+
+// ledgerLot is a tax lot produced by replay; its ID is the transaction that opened it
+type ledgerLot struct {
+	taxLot
+	AssetID  string
+	ClosedAt *time.Time
+}
+
+// ledgerDisposal is the part of a lot consumed by a SELL
+type ledgerDisposal struct {
+	LotTransactionID string
+	TransactionID    string
+	Quantity         float64
+	CostBasis        float64
+	Proceeds         float64
+	DisposedAt       time.Time
+}
+
+// ledgerHolding is a position derived from the open lots of one asset
+type ledgerHolding struct {
+	AssetID      string
+	Symbol       string
+	Quantity     float64
+	AverageCost  float64
+	PurchaseDate time.Time
+}
+
+// invalidSell is a SELL that couldn't be matched against open lots, recorded by a lenient replay
+type invalidSell struct {
+	TransactionID     string    `json:"transaction_id"`
+	AssetID           string    `json:"asset_id"`
+	Symbol            string    `json:"symbol"`
+	TransactionDate   time.Time `json:"transaction_date"`
+	Quantity          float64   `json:"quantity"`
+	AvailableQuantity float64   `json:"available_quantity"`
+	Reason            string    `json:"reason"`
+}
+
+// ledgerState is everything derived from replaying a ledger
+type ledgerState struct {
+	Lots         []*ledgerLot
+	Disposals    []ledgerDisposal
+	Realized     map[string]float64 // SELL transaction ID -> realized gain or loss
+	Holdings     map[string]*ledgerHolding
+	InvalidSells []invalidSell
+}
+
+// holdingDiscrepancy is a stored holding that didn't match the ledger
+type holdingDiscrepancy struct {
+	AssetID           string  `json:"asset_id"`
+	Symbol            string  `json:"symbol"`
+	Action            string  `json:"action"` // created, updated, removed
+	QuantityBefore    float64 `json:"quantity_before"`
+	QuantityAfter     float64 `json:"quantity_after"`
+	AverageCostBefore float64 `json:"average_cost_before"`
+	AverageCostAfter  float64 `json:"average_cost_after"`
+}
+
+// ledgerTypeOrder orders same-timestamp transactions so purchases are available to sales
+var ledgerTypeOrder = map[string]int{
+	transactionBuy:              0,
+	transactionDividendReinvest: 0,
+	transactionTransferIn:       0,
+	transactionAdjust:           1,
+	transactionTransferOut:      1,
+	transactionCostAdjust:       1,
+	transactionSell:             2,
+}
+
+// replayLedger rebuilds lots, disposals, realized P&L and holdings from ledger entries.
+// Entries are replayed by date, then type, then ID, so the result doesn't depend on their order.
+func replayLedger(entries []ledgerEntry) (*ledgerState, error) {
+	return replay(entries, false)
+}
+
+// replayLedgerLenient replays past SELLs that can't be matched against open lots, recording them
+// in InvalidSells and selling whatever was available instead
+func replayLedgerLenient(entries []ledgerEntry) *ledgerState {
+	state, _ := replay(entries, true)
+	return state
+}
+
+func replay(entries []ledgerEntry, lenient bool) (*ledgerState, error) {
+	sorted := append([]ledgerEntry(nil), entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if !a.Date.Equal(b.Date) {
+			return a.Date.Before(b.Date)
+		}
+		if ledgerTypeOrder[a.Type] != ledgerTypeOrder[b.Type] {
+			return ledgerTypeOrder[a.Type] < ledgerTypeOrder[b.Type]
+		}
+		return a.ID < b.ID
+	})
+
+	state := &ledgerState{
+		Realized: make(map[string]float64),
+		Holdings: make(map[string]*ledgerHolding),
+	}
+	symbols := make(map[string]string)
+	open := make(map[string][]*ledgerLot) // asset ID -> open lots in the order they were opened
+
+	openLot := func(entry ledgerEntry) {
+		acquiredAt := entry.Date
+		if entry.AcquiredAt.Valid {
+			acquiredAt = entry.AcquiredAt.Time
+		}
+		lot := &ledgerLot{
+			taxLot: taxLot{
+				ID:                entry.ID,
+				Quantity:          entry.Quantity,
+				RemainingQuantity: entry.Quantity,
+				UnitCost:          entry.Price,
+				Fees:              entry.Fees,
+				AcquiredAt:        acquiredAt,
+			},
+			AssetID: entry.AssetID,
+		}
+		state.Lots = append(state.Lots, lot)
+		open[entry.AssetID] = append(open[entry.AssetID], lot)
+	}
+
+	for _, entry := range sorted {
+		symbols[entry.AssetID] = entry.Symbol
+
+		switch entry.Type {
+		case transactionBuy, transactionDividendReinvest, transactionTransferIn:
+			openLot(entry)
+
+		case transactionAdjust, transactionTransferOut:
+			// A restatement closes every open lot and reopens the position at the stated cost
+			for _, lot := range open[entry.AssetID] {
+				closedAt := entry.Date
+				lot.RemainingQuantity = 0
+				lot.ClosedAt = &closedAt
+			}
+			open[entry.AssetID] = nil
+			if entry.Type == transactionAdjust && entry.Quantity > lotQuantityEpsilon {
+				openLot(entry)
+			}
+
+		case transactionCostAdjust:
+			for _, lot := range open[entry.AssetID] {
+				lot.UnitCost *= entry.Price
+				lot.Fees *= entry.Price
+			}
+
+		case transactionSell:
+			method := entry.CostBasisMethod
+			if method == "" {
+				method = costBasisFIFO
+			}
+
+			lots := make([]taxLot, 0, len(open[entry.AssetID]))
+			byID := make(map[string]*ledgerLot, len(open[entry.AssetID]))
+			for _, lot := range open[entry.AssetID] {
+				lots = append(lots, lot.taxLot)
+				byID[lot.ID] = lot
+			}
+
+			allocations, err := selectLots(lots, method, entry.Quantity, entry.LotTransactionIDs)
+			if err != nil {
+				if !lenient {
+					return nil, &ledgerError{TransactionID: entry.ID, Err: err}
+				}
+				var available float64
+				for _, lot := range lots {
+					available += lot.RemainingQuantity
+				}
+				state.InvalidSells = append(state.InvalidSells, invalidSell{
+					TransactionID:     entry.ID,
+					AssetID:           entry.AssetID,
+					Symbol:            entry.Symbol,
+					TransactionDate:   entry.Date,
+					Quantity:          entry.Quantity,
+					AvailableQuantity: available,
+					Reason:            err.Error(),
+				})
+				// FIFO over what's available can't fail
+				allocations, _ = selectLots(lots, costBasisFIFO, math.Min(entry.Quantity, available), nil)
+			}
+
+			var realized float64
+			for _, allocation := range allocations {
+				lot := byID[allocation.Lot.ID]
+
+				// Buy and sell fees are allocated pro rata to the quantity disposed
+				costBasis := allocation.Quantity * lot.UnitCost
+				if lot.Quantity > 0 {
+					costBasis += lot.Fees * allocation.Quantity / lot.Quantity
+				}
+				proceeds := allocation.Quantity * entry.Price
+				if entry.Quantity > 0 {
+					proceeds -= entry.Fees * allocation.Quantity / entry.Quantity
+				}
+
+				state.Disposals = append(state.Disposals, ledgerDisposal{
+					LotTransactionID: lot.ID,
+					TransactionID:    entry.ID,
+					Quantity:         allocation.Quantity,
+					CostBasis:        costBasis,
+					Proceeds:         proceeds,
+					DisposedAt:       entry.Date,
+				})
+				realized += proceeds - costBasis
+
+				lot.RemainingQuantity -= allocation.Quantity
+				if lot.RemainingQuantity < lotQuantityEpsilon {
+					closedAt := entry.Date
+					lot.RemainingQuantity = 0
+					lot.ClosedAt = &closedAt
+				}
+			}
+			state.Realized[entry.ID] = realized
+
+			remaining := open[entry.AssetID][:0]
+			for _, lot := range open[entry.AssetID] {
+				if lot.ClosedAt == nil {
+					remaining = append(remaining, lot)
+				}
+			}
+			open[entry.AssetID] = remaining
+		}
+	}
+
+	// Holdings are the open lots of each asset at their weighted average cost
+	for assetID, lots := range open {
+		holding := &ledgerHolding{AssetID: assetID, Symbol: symbols[assetID]}
+		var cost float64
+		for _, lot := range lots {
+			holding.Quantity += lot.RemainingQuantity
+			cost += lot.RemainingQuantity * lot.UnitCost
+			if holding.PurchaseDate.IsZero() || lot.AcquiredAt.Before(holding.PurchaseDate) {
+				holding.PurchaseDate = lot.AcquiredAt
+			}
+		}
+		if holding.Quantity > lotQuantityEpsilon {
+			holding.AverageCost = cost / holding.Quantity
+			state.Holdings[assetID] = holding
+		}
+	}
+
+	return state, nil
+}
+
+// Helper function to load a portfolio's ledger, optionally limited to one asset, locking its transactions
+func (h *Handler) loadLedger(tx *sql.Tx, portfolioID, assetID string) ([]ledgerEntry, error) {
+	query := `
+		SELECT
+			t.id, t.asset_id, a.symbol, t.transaction_type, t.quantity, t.price,
+			COALESCE(t.fees, 0), t.transaction_date, COALESCE(t.cost_basis_method, ''),
+			t.lot_transaction_ids, t.realized_pnl, t.acquired_at
+		FROM transactions t
+		JOIN assets a ON t.asset_id = a.id
+		WHERE t.portfolio_id = $1
+	`
+	args := []interface{}{portfolioID}
+	if assetID != "" {
+		args = append(args, assetID)
+		query += " AND t.asset_id = $2"
+	}
+	query += " ORDER BY t.transaction_date ASC FOR UPDATE OF t"
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ledger: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []ledgerEntry
+	for rows.Next() {
+		var entry ledgerEntry
+		var lotTransactionIDs pq.StringArray
+		err := rows.Scan(&entry.ID, &entry.AssetID, &entry.Symbol, &entry.Type, &entry.Quantity, &entry.Price,
+			&entry.Fees, &entry.Date, &entry.CostBasisMethod, &lotTransactionIDs, &entry.RealizedPnL, &entry.AcquiredAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan ledger entry: %w", err)
+		}
+		entry.LotTransactionIDs = lotTransactionIDs
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// Helper function to load the stored holdings of a portfolio (or one of its assets), keyed by asset ID
+func (h *Handler) loadStoredHoldings(tx *sql.Tx, portfolioID, assetID string) (map[string]holdingDiscrepancy, error) {
+	query := `
+		SELECT ph.asset_id, a.symbol, ph.quantity, ph.average_cost
+		FROM portfolio_holdings ph
+		JOIN assets a ON ph.asset_id = a.id
+		WHERE ph.portfolio_id = $1
+	`
+	args := []interface{}{portfolioID}
+	if assetID != "" {
+		args = append(args, assetID)
+		query += " AND ph.asset_id = $2"
+	}
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query holdings: %w", err)
+	}
+	defer rows.Close()
+
+	stored := make(map[string]holdingDiscrepancy)
+	for rows.Next() {
+		var d holdingDiscrepancy
+		if err := rows.Scan(&d.AssetID, &d.Symbol, &d.QuantityBefore, &d.AverageCostBefore); err != nil {
+			return nil, fmt.Errorf("failed to scan holding: %w", err)
+		}
+		stored[d.AssetID] = d
+	}
+
+	return stored, rows.Err()
+}
+
+// diffHoldings compares stored holdings with replayed ones and returns the ones that differ, by symbol
+func diffHoldings(state *ledgerState, stored map[string]holdingDiscrepancy) []holdingDiscrepancy {
+	var discrepancies []holdingDiscrepancy
+	for id, holding := range state.Holdings {
+		d, exists := stored[id]
+		d.AssetID, d.Symbol = id, holding.Symbol
+		d.QuantityAfter, d.AverageCostAfter = holding.Quantity, holding.AverageCost
+		switch {
+		case !exists:
+			d.Action = "created"
+		case math.Abs(d.QuantityBefore-d.QuantityAfter) > holdingTolerance ||
+			math.Abs(d.AverageCostBefore-d.AverageCostAfter) > holdingTolerance:
+			d.Action = "updated"
+		default:
+			continue
+		}
+		discrepancies = append(discrepancies, d)
+	}
+	for id, d := range stored {
+		if _, ok := state.Holdings[id]; !ok {
+			d.Action = "removed"
+			discrepancies = append(discrepancies, d)
+		}
+	}
+	sort.Slice(discrepancies, func(i, j int) bool { return discrepancies[i].Symbol < discrepancies[j].Symbol })
+	return discrepancies
+}
+
+// Helper function to rebuild holdings, tax lots, lot disposals and realized P&L from the ledger.
+// An empty assetID rebuilds the whole portfolio. Returns the holdings that had to be corrected.
+func (h *Handler) rebuildHoldings(tx *sql.Tx, userID, portfolioID, assetID string) (*ledgerState, []holdingDiscrepancy, error) {
+	entries, err := h.loadLedger(tx, portfolioID, assetID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state, err := replayLedger(entries)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stored, err := h.loadStoredHoldings(tx, portfolioID, assetID)
+	if err != nil {
+		return nil, nil, err
+	}
+	discrepancies := diffHoldings(state, stored)
+
+	lotsQuery := "SELECT id, transaction_id FROM tax_lots WHERE portfolio_id = $1"
+	deleteLotsQuery := "DELETE FROM tax_lots WHERE portfolio_id = $1"
+	scope := []interface{}{portfolioID}
+	if assetID != "" {
+		lotsQuery += " AND asset_id = $2"
+		deleteLotsQuery += " AND asset_id = $2"
+		scope = append(scope, assetID)
+	}
+
+	// Keep lot IDs stable across rebuilds so clients can keep referring to them
+	rows, err := tx.Query(lotsQuery, scope...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query tax lots: %w", err)
+	}
+	lotIDs := make(map[string]string)
+	for rows.Next() {
+		var lotID, transactionID string
+		if err := rows.Scan(&lotID, &transactionID); err != nil {
+			rows.Close()
+			return nil, nil, fmt.Errorf("failed to scan tax lot: %w", err)
+		}
+		lotIDs[transactionID] = lotID
+	}
+	rows.Close()
+
+	if _, err = tx.Exec(deleteLotsQuery, scope...); err != nil {
+		return nil, nil, fmt.Errorf("failed to clear tax lots: %w", err)
+	}
+
+	for _, lot := range state.Lots {
+		lotID, ok := lotIDs[lot.ID]
+		if !ok {
+			lotID = uuid.New().String()
+			lotIDs[lot.ID] = lotID
+		}
+		_, err = tx.Exec(`
+			INSERT INTO tax_lots (id, user_id, portfolio_id, asset_id, transaction_id, quantity, remaining_quantity, unit_cost, fees, acquired_at, closed_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		`, lotID, userID, portfolioID, lot.AssetID, lot.ID, lot.Quantity, lot.RemainingQuantity, lot.UnitCost, lot.Fees, lot.AcquiredAt, lot.ClosedAt)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to insert tax lot: %w", err)
+		}
+	}
+
+	for _, disposal := range state.Disposals {
+		_, err = tx.Exec(`
+			INSERT INTO lot_disposals (lot_id, transaction_id, quantity, cost_basis, proceeds, disposed_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, lotIDs[disposal.LotTransactionID], disposal.TransactionID, disposal.Quantity, disposal.CostBasis, disposal.Proceeds, disposal.DisposedAt)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to insert lot disposal: %w", err)
+		}
+	}
+
+	// Only rewrite realized P&L that changed
+	for _, entry := range entries {
+		realized, ok := state.Realized[entry.ID]
+		if !ok || (entry.RealizedPnL.Valid && math.Abs(entry.RealizedPnL.Float64-realized) <= holdingTolerance) {
+			continue
+		}
+		_, err = tx.Exec("UPDATE transactions SET realized_pnl = $1 WHERE id = $2", realized, entry.ID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to update realized P&L: %w", err)
+		}
+	}
+
+	for _, d := range discrepancies {
+		if d.Action == "removed" {
+			_, err = tx.Exec("DELETE FROM portfolio_holdings WHERE portfolio_id = $1 AND asset_id = $2", portfolioID, d.AssetID)
+		} else {
+			holding := state.Holdings[d.AssetID]
+			_, err = tx.Exec(`
+				INSERT INTO portfolio_holdings (user_id, portfolio_id, asset_id, quantity, average_cost, purchase_date)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				ON CONFLICT (portfolio_id, asset_id)
+				DO UPDATE SET
+					quantity = EXCLUDED.quantity,
+					average_cost = EXCLUDED.average_cost,
+					purchase_date = EXCLUDED.purchase_date,
+					updated_at = NOW()
+			`, userID, portfolioID, d.AssetID, holding.Quantity, holding.AverageCost, holding.PurchaseDate)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to update holding: %w", err)
+		}
+	}
+
+	return state, discrepancies, nil
+}
+
+// Helper function to append a fee-free entry to the ledger and replay the asset it affects
+func (h *Handler) recordLedgerEntry(tx *sql.Tx, userID, portfolioID, assetID, transactionType string, quantity, price float64, notes string) error {
+	_, err := tx.Exec(`
+		INSERT INTO transactions (user_id, portfolio_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes)
+		VALUES ($1, $2, $3, $4, $5, $6, 0, $7, $8)
+	`, userID, portfolioID, assetID, transactionType, quantity, price, quantity*price, notes)
+	if err != nil {
+		return fmt.Errorf("failed to insert transaction: %w", err)
+	}
+	if err = h.invalidateSnapshots(tx, portfolioID, time.Now()); err != nil {
+		return err
+	}
+
+	_, _, err = h.rebuildHoldings(tx, userID, portfolioID, assetID)
+	return err
+}
+
+// Helper function to respond to a ledger change that failed to replay
+func (h *Handler) respondLedgerError(c *gin.Context, err error, message string) {
+	var ledgerErr *ledgerError
+	if errors.As(err, &ledgerErr) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":          "Ledger would become inconsistent: " + ledgerErr.Err.Error(),
+			"transaction_id": ledgerErr.TransactionID,
+		})
+		return
+	}
+	h.logger.Error("Failed to update ledger", zap.Error(err))
+	c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+}
+
+// RebuildPortfolio replays a portfolio's ledger and reports the holdings it corrected
+func (h *Handler) RebuildPortfolio(c *gin.Context) {
+	portfolioID, ok := portfolioIDParam(c)
+	if !ok {
+		return
+	}
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rebuild portfolio"})
+		return
+	}
+
+	tx, err := h.services.DB.Begin()
+	if err != nil {
+		h.logger.Error("Failed to begin transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rebuild portfolio"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Rebuilt holdings and lots belong to the portfolio's owner
+	var ownerID string
+	err = tx.QueryRow("SELECT user_id FROM portfolios WHERE id = $1", portfolioID).Scan(&ownerID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Portfolio not found"})
+			return
+		}
+		h.logger.Error("Failed to get portfolio", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rebuild portfolio"})
+		return
+	}
+
+	state, discrepancies, err := h.rebuildHoldings(tx, ownerID, portfolioID, "")
+	if err != nil {
+		var ledgerErr *ledgerError
+		if errors.As(err, &ledgerErr) {
+			// The ledger itself is inconsistent; nothing can be rebuilt until it's corrected
+			c.JSON(http.StatusConflict, gin.H{
+				"error":          "Ledger is inconsistent: " + ledgerErr.Err.Error(),
+				"transaction_id": ledgerErr.TransactionID,
+			})
+			return
+		}
+		h.logger.Error("Failed to rebuild portfolio", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rebuild portfolio"})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		h.logger.Error("Failed to commit transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rebuild portfolio"})
+		return
+	}
+
+	if discrepancies == nil {
+		discrepancies = []holdingDiscrepancy{}
+	}
+
+	h.logger.Info("Rebuilt portfolio from ledger",
+		zap.String("portfolio_id", portfolioID), zap.Int("discrepancies", len(discrepancies)))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Portfolio rebuilt from ledger",
+		"portfolio_id":  portfolioID,
+		"holdings":      len(state.Holdings),
+		"tax_lots":      len(state.Lots),
+		"discrepancies": discrepancies,
+	})
+
+	go h.broadcastPortfolioUpdate(ownerID, portfolioID)
+}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+var ledgerColumns = []string{
+	"id", "asset_id", "symbol", "transaction_type", "quantity", "price",
+	"fees", "transaction_date", "cost_basis_method", "lot_transaction_ids", "realized_pnl", "acquired_at",
+}
+
+// newLedgerRows returns an empty ledger result for expectReplay
+func newLedgerRows() *sqlmock.Rows {
+	return sqlmock.NewRows(ledgerColumns)
+}
+
+// newStoredHoldingRows returns an empty stored holdings result for expectReplay
+func newStoredHoldingRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"asset_id", "symbol", "quantity", "average_cost"})
+}
+
+// newStoredLotRows returns an empty stored tax lots result for expectReplay
+func newStoredLotRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "transaction_id"})
+}
+
+// expectReplay expects the reads and lot reset of a ledger replay scoped to one asset
+// (or the whole portfolio when assetID is empty). Callers expect the writes that follow.
+func expectReplay(mock sqlmock.Sqlmock, portfolioID, assetID string, ledger, holdings, lots *sqlmock.Rows) {
+	args := []driver.Value{portfolioID}
+	ledgerQuery := `SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.portfolio_id = \$1 ORDER BY`
+	holdingsQuery := `SELECT ph.asset_id, a.symbol, ph.quantity, ph.average_cost FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \$1$`
+	lotsQuery := `SELECT id, transaction_id FROM tax_lots WHERE portfolio_id = \$1$`
+	deleteQuery := `DELETE FROM tax_lots WHERE portfolio_id = \$1$`
+	if assetID != "" {
+		args = append(args, assetID)
+		ledgerQuery = `SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.portfolio_id = \$1 AND t.asset_id = \$2 ORDER BY`
+		holdingsQuery = `SELECT ph.asset_id, a.symbol, ph.quantity, ph.average_cost FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \$1 AND ph.asset_id = \$2`
+		lotsQuery = `SELECT id, transaction_id FROM tax_lots WHERE portfolio_id = \$1 AND asset_id = \$2`
+		deleteQuery = `DELETE FROM tax_lots WHERE portfolio_id = \$1 AND asset_id = \$2`
+	}
+
+	mock.ExpectQuery(ledgerQuery).WithArgs(args...).WillReturnRows(ledger)
+	mock.ExpectQuery(holdingsQuery).WithArgs(args...).WillReturnRows(holdings)
+	mock.ExpectQuery(lotsQuery).WithArgs(args...).WillReturnRows(lots)
+	mock.ExpectExec(deleteQuery).WithArgs(args...).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+// expectLotInsert expects a rebuilt tax lot opened by transactionID
+func expectLotInsert(mock sqlmock.Sqlmock, transactionID string, quantity, remaining float64) {
+	mock.ExpectExec(`INSERT INTO tax_lots \(id, user_id, portfolio_id, asset_id, transaction_id, quantity, remaining_quantity, unit_cost, fees, acquired_at, closed_at\)`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), transactionID, quantity, remaining,
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// expectHoldingUpsert expects a holding to be written with the replayed quantity and cost
+func expectHoldingUpsert(mock sqlmock.Sqlmock, assetID string, quantity, averageCost float64) {
+	mock.ExpectExec(`INSERT INTO portfolio_holdings \(user_id, portfolio_id, asset_id, quantity, average_cost, purchase_date\)`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), assetID, quantity, averageCost, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// expectHoldingDelete expects a holding the ledger no longer supports to be removed
+func expectHoldingDelete(mock sqlmock.Sqlmock, portfolioID, assetID string) {
+	mock.ExpectExec(`DELETE FROM portfolio_holdings WHERE portfolio_id = \$1 AND asset_id = \$2`).
+		WithArgs(portfolioID, assetID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// expectLedgerEntry expects a holdings edit to be recorded as a ledger transaction
+func expectLedgerEntry(mock sqlmock.Sqlmock, userID, portfolioID, assetID, transactionType string, quantity, price float64, notes string) {
+	mock.ExpectExec(`INSERT INTO transactions \(user_id, portfolio_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes\)`).
+		WithArgs(userID, portfolioID, assetID, transactionType, quantity, price, quantity*price, notes).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectSnapshotInvalidation(mock, portfolioID, sqlmock.AnyArg())
+}
+
+// TestReplayLedger tests rebuilding lots and holdings from ledger entries
+func TestReplayLedger(t *testing.T) {
+	day := func(n int) time.Time { return time.Date(2024, 1, n, 0, 0, 0, 0, time.UTC) }
+
+	t.Run("buys and a FIFO sell", func(t *testing.T) {
+		// Deliberately out of order: replay sorts by date
+		state, err := replayLedger([]ledgerEntry{
+			{ID: "sell", AssetID: "a1", Symbol: "AAPL", Type: transactionSell, Quantity: 15, Price: 200, Fees: 3, Date: day(3)},
+			{ID: "buy1", AssetID: "a1", Symbol: "AAPL", Type: transactionBuy, Quantity: 10, Price: 100, Fees: 1, Date: day(1)},
+			{ID: "buy2", AssetID: "a1", Symbol: "AAPL", Type: transactionBuy, Quantity: 10, Price: 150, Date: day(2)},
+		})
+		assert.NoError(t, err)
+
+		holding := state.Holdings["a1"]
+		if assert.NotNil(t, holding) {
+			assert.Equal(t, 5.0, holding.Quantity)
+			assert.Equal(t, 150.0, holding.AverageCost)
+			assert.Equal(t, day(2), holding.PurchaseDate)
+		}
+
+		if assert.Len(t, state.Disposals, 2) {
+			assert.Equal(t, "buy1", state.Disposals[0].LotTransactionID)
+			assert.Equal(t, 10.0, state.Disposals[0].Quantity)
+			assert.Equal(t, 1001.0, state.Disposals[0].CostBasis)
+			assert.Equal(t, 1998.0, state.Disposals[0].Proceeds)
+			assert.Equal(t, "buy2", state.Disposals[1].LotTransactionID)
+		}
+		// (1998 - 1001) + (999 - 750)
+		assert.InDelta(t, 1246.0, state.Realized["sell"], 1e-9)
+	})
+
+	t.Run("specific lots", func(t *testing.T) {
+		state, err := replayLedger([]ledgerEntry{
+			{ID: "buy1", AssetID: "a1", Type: transactionBuy, Quantity: 10, Price: 100, Date: day(1)},
+			{ID: "buy2", AssetID: "a1", Type: transactionBuy, Quantity: 10, Price: 150, Date: day(2)},
+			{ID: "sell", AssetID: "a1", Type: transactionSell, Quantity: 4, Price: 120, Date: day(3),
+				CostBasisMethod: costBasisSpecific, LotTransactionIDs: []string{"buy2"}},
+		})
+		assert.NoError(t, err)
+		assert.InDelta(t, -120.0, state.Realized["sell"], 1e-9)
+		assert.Equal(t, 16.0, state.Holdings["a1"].Quantity)
+	})
+
+	t.Run("adjustment restates the position", func(t *testing.T) {
+		state, err := replayLedger([]ledgerEntry{
+			{ID: "buy1", AssetID: "a1", Type: transactionBuy, Quantity: 10, Price: 100, Date: day(1)},
+			{ID: "adjust", AssetID: "a1", Type: transactionAdjust, Quantity: 4, Price: 90, Date: day(2)},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 4.0, state.Holdings["a1"].Quantity)
+		assert.Equal(t, 90.0, state.Holdings["a1"].AverageCost)
+		assert.Empty(t, state.Disposals)
+		if assert.Len(t, state.Lots, 2) {
+			assert.NotNil(t, state.Lots[0].ClosedAt)
+			assert.Nil(t, state.Lots[1].ClosedAt)
+		}
+	})
+
+	t.Run("adjustment to zero removes the holding", func(t *testing.T) {
+		state, err := replayLedger([]ledgerEntry{
+			{ID: "buy1", AssetID: "a1", Type: transactionBuy, Quantity: 10, Price: 100, Date: day(1)},
+			{ID: "adjust", AssetID: "a1", Type: transactionAdjust, Date: day(2)},
+		})
+		assert.NoError(t, err)
+		assert.Empty(t, state.Holdings)
+	})
+
+	t.Run("corporate action entries move positions", func(t *testing.T) {
+		state, err := replayLedger([]ledgerEntry{
+			{ID: "buy1", AssetID: "a1", Type: transactionBuy, Quantity: 10, Price: 100, Fees: 10, Date: day(1)},
+			{ID: "spinoff", AssetID: "a1", Type: transactionCostAdjust, Price: 0.8, Date: day(2)},
+			{ID: "received", AssetID: "a2", Type: transactionTransferIn, Quantity: 5, Price: 40.4, Date: day(2),
+				AcquiredAt: sql.NullTime{Time: day(1), Valid: true}},
+			{ID: "merger", AssetID: "a1", Type: transactionTransferOut, Quantity: 10, Date: day(3)},
+		})
+		assert.NoError(t, err)
+
+		// The spin-off kept 80% of the parent's cost until the merger closed its lot without a gain
+		assert.NotContains(t, state.Holdings, "a1")
+		assert.Empty(t, state.Disposals)
+		if assert.Len(t, state.Lots, 2) {
+			assert.Equal(t, 80.0, state.Lots[0].UnitCost)
+			assert.Equal(t, 8.0, state.Lots[0].Fees)
+			assert.NotNil(t, state.Lots[0].ClosedAt)
+		}
+		if assert.NotNil(t, state.Holdings["a2"]) {
+			assert.Equal(t, 5.0, state.Holdings["a2"].Quantity)
+			assert.Equal(t, 40.4, state.Holdings["a2"].AverageCost)
+			// The received shares keep the holding period of the parent's lot
+			assert.Equal(t, day(1), state.Holdings["a2"].PurchaseDate)
+		}
+	})
+
+	t.Run("selling more than was held", func(t *testing.T) {
+		_, err := replayLedger([]ledgerEntry{
+			{ID: "sell", AssetID: "a1", Type: transactionSell, Quantity: 5, Price: 100, Date: day(1)},
+			{ID: "buy1", AssetID: "a1", Type: transactionBuy, Quantity: 10, Price: 100, Date: day(2)},
+		})
+		var ledgerErr *ledgerError
+		if assert.ErrorAs(t, err, &ledgerErr) {
+			assert.Equal(t, "sell", ledgerErr.TransactionID)
+			assert.ErrorIs(t, err, errInsufficientLots)
+		}
+	})
+}
+
+// TestRebuildPortfolio tests the admin RebuildPortfolio handler
+func TestRebuildPortfolio(t *testing.T) {
+	tests := []struct {
+		name           string
+		setupMock      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedBody   []string
+	}{
+		{
+			name: "fixes drifted holdings",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT user_id FROM portfolios WHERE id = \$1`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(testUserID))
+
+				// AAPL's holding drifted from its ledger; MSFT has no transactions at all
+				expectReplay(mock, testPortfolioID, "",
+					newLedgerRows().
+						AddRow("tx1", "asset-aapl", "AAPL", "BUY", 10.0, 100.0, 0.0, time.Now().AddDate(0, -1, 0), "", nil, nil, nil),
+					newStoredHoldingRows().
+						AddRow("asset-aapl", "AAPL", 12.0, 100.0).
+						AddRow("asset-msft", "MSFT", 3.0, 300.0),
+					newStoredLotRows().AddRow("lot1", "tx1"))
+				mock.ExpectExec(`INSERT INTO tax_lots`).
+					WithArgs("lot1", testUserID, testPortfolioID, "asset-aapl", "tx1", 10.0, 10.0, 100.0, 0.0, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectHoldingUpsert(mock, "asset-aapl", 10.0, 100.0)
+				mock.ExpectExec(`DELETE FROM portfolio_holdings WHERE portfolio_id = \$1 AND asset_id = \$2`).
+					WithArgs(testPortfolioID, "asset-msft").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{`"action":"updated"`, `"quantity_before":12`, `"action":"removed"`, "MSFT"},
+		},
+		{
+			name: "inconsistent ledger",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT user_id FROM portfolios WHERE id = \$1`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(testUserID))
+				mock.ExpectQuery(`SELECT (.+) FROM transactions t`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(newLedgerRows().
+						AddRow("tx1", "asset-aapl", "AAPL", "SELL", 10.0, 100.0, 0.0, time.Now(), "FIFO", nil, nil, nil))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+			expectedBody:   []string{"Ledger is inconsistent", "tx1"},
+		},
+		{
+			name: "portfolio not found",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT user_id FROM portfolios WHERE id = \$1`).
+					WithArgs(testPortfolioID).
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   []string{"Portfolio not found"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock, cleanup := createTestHandler(t)
+			defer cleanup()
+
+			tt.setupMock(mock)
+
+			router := gin.New()
+			router.POST("/admin/portfolios/:id/rebuild", handler.RebuildPortfolio)
+
+			req, _ := http.NewRequest("POST", "/admin/portfolios/"+testPortfolioID+"/rebuild", nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			for _, expected := range tt.expectedBody {
+				assert.Contains(t, w.Body.String(), expected)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
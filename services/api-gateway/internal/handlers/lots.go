@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Cost basis methods a portfolio (or a single SELL) can use to pick tax lots
+const (
+	costBasisFIFO     = "FIFO"
+	costBasisLIFO     = "LIFO"
+	costBasisHIFO     = "HIFO"
+	costBasisSpecific = "SPECIFIC"
+)
+
+// Quantities closer than this are treated as equal when consuming lots
+const lotQuantityEpsilon = 1e-9
+
+var (
+	errInsufficientLots = errors.New("insufficient open lots to cover sale")
+	errLotNotFound      = errors.New("tax lot not found or already closed")
+)
+
+// taxLot is an open tax lot as loaded for a SELL
+type taxLot struct {
+	ID                string
+	Quantity          float64
+	RemainingQuantity float64
+	UnitCost          float64
+	Fees              float64
+	AcquiredAt        time.Time
+}
+
+// lotAllocation is the part of a lot consumed by a SELL
+type lotAllocation struct {
+	Lot      taxLot
+	Quantity float64
+}
+
+// selectLots picks the lots a sale of quantity consumes according to method.
+// For SPECIFIC, lotIDs gives the lots to use in order of consumption.
+func selectLots(lots []taxLot, method string, quantity float64, lotIDs []string) ([]lotAllocation, error) {
+	ordered := make([]taxLot, 0, len(lots))
+
+	switch method {
+	case costBasisSpecific:
+		byID := make(map[string]taxLot, len(lots))
+		for _, lot := range lots {
+			byID[lot.ID] = lot
+		}
+		seen := make(map[string]bool, len(lotIDs))
+		for _, id := range lotIDs {
+			lot, ok := byID[id]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s", errLotNotFound, id)
+			}
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			ordered = append(ordered, lot)
+		}
+	case costBasisFIFO, costBasisLIFO, costBasisHIFO:
+		ordered = append(ordered, lots...)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			a, b := ordered[i], ordered[j]
+			switch method {
+			case costBasisLIFO:
+				return a.AcquiredAt.After(b.AcquiredAt)
+			case costBasisHIFO:
+				if a.UnitCost != b.UnitCost {
+					return a.UnitCost > b.UnitCost
+				}
+			}
+			return a.AcquiredAt.Before(b.AcquiredAt)
+		})
+	default:
+		return nil, fmt.Errorf("unsupported cost basis method: %s", method)
+	}
+
+	var allocations []lotAllocation
+	remaining := quantity
+	for _, lot := range ordered {
+		if remaining <= lotQuantityEpsilon {
+			break
+		}
+		take := lot.RemainingQuantity
+		if take > remaining {
+			take = remaining
+		}
+		if take <= 0 {
+			continue
+		}
+		allocations = append(allocations, lotAllocation{Lot: lot, Quantity: take})
+		remaining -= take
+	}
+
+	if remaining > lotQuantityEpsilon {
+		return nil, errInsufficientLots
+	}
+
+	return allocations, nil
+}
+
+// Helper function to resolve the cost basis method for a SELL. Explicit lot IDs always mean SPECIFIC;
+// otherwise a per-request override wins over the portfolio's setting.
+func (h *Handler) resolveCostBasisMethod(tx *sql.Tx, portfolioID, requested string, lotIDs []string) (string, error) {
+	if len(lotIDs) > 0 {
+		return costBasisSpecific, nil
+	}
+	if requested != "" {
+		return requested, nil
+	}
+
+	var method string
+	err := tx.QueryRow("SELECT cost_basis_method FROM portfolios WHERE id = $1", portfolioID).Scan(&method)
+	if err != nil {
+		return "", fmt.Errorf("failed to get cost basis method: %w", err)
+	}
+	return method, nil
+}
+
+// Helper function to map the tax lots picked for a SPECIFIC sale to the transactions that opened them.
+// The ledger stores the transactions so the selection survives lots being rebuilt.
+func (h *Handler) lotTransactionIDs(tx *sql.Tx, portfolioID, assetID string, lotIDs []string) ([]string, error) {
+	rows, err := tx.Query(`
+		SELECT id, transaction_id
+		FROM tax_lots
+		WHERE portfolio_id = $1 AND asset_id = $2 AND remaining_quantity > 0
+	`, portfolioID, assetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query open lots: %w", err)
+	}
+	defer rows.Close()
+
+	openLots := make(map[string]string)
+	for rows.Next() {
+		var lotID, transactionID string
+		if err := rows.Scan(&lotID, &transactionID); err != nil {
+			return nil, fmt.Errorf("failed to scan lot: %w", err)
+		}
+		openLots[lotID] = transactionID
+	}
+
+	transactionIDs := make([]string, 0, len(lotIDs))
+	for _, lotID := range lotIDs {
+		transactionID, ok := openLots[lotID]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errLotNotFound, lotID)
+		}
+		transactionIDs = append(transactionIDs, transactionID)
+	}
+	return transactionIDs, nil
+}
+
+// GetTaxLots lists tax lots for a portfolio
+func (h *Handler) GetTaxLots(c *gin.Context) {
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tax lots"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
+		return
+	}
+
+	// Get query parameters
+	status := c.DefaultQuery("status", "open") // open, closed, all
+	assetSymbol := strings.ToUpper(c.Query("symbol"))
+
+	query := `
+		SELECT
+			tl.id,
+			a.symbol,
+			tl.transaction_id,
+			tl.quantity,
+			tl.remaining_quantity,
+			tl.unit_cost,
+			tl.fees,
+			tl.acquired_at,
+			tl.closed_at
+		FROM tax_lots tl
+		JOIN assets a ON tl.asset_id = a.id
+		WHERE tl.portfolio_id = $1
+	`
+	args := []interface{}{portfolioID}
+
+	switch status {
+	case "open":
+		query += " AND tl.remaining_quantity > 0"
+	case "closed":
+		query += " AND tl.remaining_quantity = 0"
+	case "all":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status. Use open, closed or all"})
+		return
+	}
+
+	if assetSymbol != "" {
+		args = append(args, assetSymbol)
+		query += fmt.Sprintf(" AND a.symbol = $%d", len(args))
+	}
+
+	query += " ORDER BY a.symbol, tl.acquired_at ASC"
+
+	rows, err := h.services.DB.Query(query, args...)
+	if err != nil {
+		h.logger.Error("Failed to query tax lots", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tax lots"})
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var lots []map[string]interface{}
+	var totalCostBasis float64
+	for rows.Next() {
+		var id, symbol string
+		var transactionID sql.NullString
+		var quantity, remainingQuantity, unitCost, fees float64
+		var acquiredAt time.Time
+		var closedAt sql.NullTime
+
+		err := rows.Scan(&id, &symbol, &transactionID, &quantity, &remainingQuantity, &unitCost, &fees, &acquiredAt, &closedAt)
+		if err != nil {
+			h.logger.Error("Failed to scan tax lot row", zap.Error(err))
+			continue
+		}
+
+		// Remaining cost basis includes the unconsumed share of the buy fees
+		costBasis := remainingQuantity * unitCost
+		if quantity > 0 {
+			costBasis += fees * remainingQuantity / quantity
+		}
+		totalCostBasis += costBasis
+
+		lot := map[string]interface{}{
+			"id":                 id,
+			"symbol":             symbol,
+			"transaction_id":     nil,
+			"quantity":           quantity,
+			"remaining_quantity": remainingQuantity,
+			"unit_cost":          unitCost,
+			"fees":               fees,
+			"cost_basis":         costBasis,
+			"acquired_at":        acquiredAt,
+			"closed_at":          nil,
+			"holding_period":     holdingPeriod(acquiredAt, now),
+		}
+		if transactionID.Valid {
+			lot["transaction_id"] = transactionID.String
+		}
+		if closedAt.Valid {
+			lot["closed_at"] = closedAt.Time
+		}
+		lots = append(lots, lot)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"portfolio_id":     portfolioID,
+		"lots":             lots,
+		"total_lots":       len(lots),
+		"total_cost_basis": totalCostBasis,
+		"status":           status,
+	})
+}
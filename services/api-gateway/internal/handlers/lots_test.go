@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSelectLots tests lot selection for each cost basis method
+func TestSelectLots(t *testing.T) {
+	now := time.Now()
+	lots := []taxLot{
+		{ID: "old-cheap", RemainingQuantity: 10, UnitCost: 100, AcquiredAt: now.AddDate(0, -3, 0)},
+		{ID: "mid-expensive", RemainingQuantity: 5, UnitCost: 200, AcquiredAt: now.AddDate(0, -2, 0)},
+		{ID: "new-mid", RemainingQuantity: 8, UnitCost: 150, AcquiredAt: now.AddDate(0, -1, 0)},
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		quantity    float64
+		lotIDs      []string
+		expected    []lotAllocation
+		expectedErr error
+	}{
+		{
+			name:     "FIFO consumes oldest first",
+			method:   costBasisFIFO,
+			quantity: 12,
+			expected: []lotAllocation{{Lot: lots[0], Quantity: 10}, {Lot: lots[1], Quantity: 2}},
+		},
+		{
+			name:     "LIFO consumes newest first",
+			method:   costBasisLIFO,
+			quantity: 12,
+			expected: []lotAllocation{{Lot: lots[2], Quantity: 8}, {Lot: lots[1], Quantity: 4}},
+		},
+		{
+			name:     "HIFO consumes highest cost first",
+			method:   costBasisHIFO,
+			quantity: 7,
+			expected: []lotAllocation{{Lot: lots[1], Quantity: 5}, {Lot: lots[2], Quantity: 2}},
+		},
+		{
+			name:     "SPECIFIC follows the requested lot order",
+			method:   costBasisSpecific,
+			quantity: 9,
+			lotIDs:   []string{"new-mid", "old-cheap"},
+			expected: []lotAllocation{{Lot: lots[2], Quantity: 8}, {Lot: lots[0], Quantity: 1}},
+		},
+		{
+			name:        "SPECIFIC with unknown lot",
+			method:      costBasisSpecific,
+			quantity:    1,
+			lotIDs:      []string{"missing"},
+			expectedErr: errLotNotFound,
+		},
+		{
+			name:        "SPECIFIC lots don't cover the sale",
+			method:      costBasisSpecific,
+			quantity:    6,
+			lotIDs:      []string{"mid-expensive"},
+			expectedErr: errInsufficientLots,
+		},
+		{
+			name:        "sale larger than all open lots",
+			method:      costBasisFIFO,
+			quantity:    30,
+			expectedErr: errInsufficientLots,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allocations, err := selectLots(lots, tt.method, tt.quantity, tt.lotIDs)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, allocations)
+		})
+	}
+}
+
+// TestGetTaxLots tests the GetTaxLots handler
+func TestGetTaxLots(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+
+	rows := sqlmock.NewRows([]string{"id", "symbol", "transaction_id", "quantity", "remaining_quantity", "unit_cost", "fees", "acquired_at", "closed_at"}).
+		AddRow("lot1", "AAPL", "tx1", 10.0, 4.0, 150.0, 5.0, time.Now().AddDate(-2, 0, 0), nil).
+		AddRow("lot2", "AAPL", nil, 5.0, 5.0, 180.0, 0.0, time.Now().AddDate(0, -1, 0), nil)
+
+	mock.ExpectQuery(`SELECT (.+) FROM tax_lots tl JOIN assets a ON tl.asset_id = a.id WHERE tl.portfolio_id = \$1 AND tl.remaining_quantity > 0 AND a.symbol = \$2 ORDER BY a.symbol, tl.acquired_at ASC`).
+		WithArgs(testPortfolioID, "AAPL").
+		WillReturnRows(rows)
+
+	router := createTestRouter(handler, "GET", "/portfolio/lots", handler.GetTaxLots)
+
+	req, _ := http.NewRequest("GET", "/portfolio/lots?symbol=aapl", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `"total_lots":2`)
+	assert.Contains(t, body, "long_term")
+	assert.Contains(t, body, "short_term")
+	// 4 * 150 + 5 * 4/10 = 602, plus 5 * 180 = 900
+	assert.Contains(t, body, `"total_cost_basis":1502`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetTaxLots_InvalidStatus(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+
+	router := createTestRouter(handler, "GET", "/portfolio/lots", handler.GetTaxLots)
+
+	req, _ := http.NewRequest("GET", "/portfolio/lots?status=sold", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestCreateTransaction_SellLots tests how sales pick lots
+func TestCreateTransaction_SellLots(t *testing.T) {
+	tests := []struct {
+		name           string
+		requestBody    string
+		setupMock      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedBody   []string
+	}{
+		{
+			name:        "specific lot IDs",
+			requestBody: `{"symbol": "AAPL", "transaction_type": "SELL", "quantity": 2, "price": 200, "lot_ids": ["lot2"]}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id, transaction_id FROM tax_lots WHERE portfolio_id = \$1 AND asset_id = \$2 AND remaining_quantity > 0`).
+					WithArgs(testPortfolioID, testAssetID).
+					WillReturnRows(newStoredLotRows().AddRow("lot1", "tx0").AddRow("lot2", "tx1"))
+				// The selection is stored as the transactions that opened the lots
+				mock.ExpectQuery(`INSERT INTO transactions (.+) RETURNING id`).
+					WithArgs(testUserID, testPortfolioID, testAssetID, "SELL", 2.0, 200.0, 0.0, 400.0, "", "SPECIFIC", `{"tx1"}`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("tx2"))
+				expectSnapshotInvalidation(mock, testPortfolioID, sqlmock.AnyArg())
+				expectReplay(mock, testPortfolioID, testAssetID,
+					newLedgerRows().
+						AddRow("tx0", testAssetID, "AAPL", "BUY", 6.0, 100.0, 0.0, time.Now().AddDate(0, -6, 0), "", nil, nil, nil).
+						AddRow("tx1", testAssetID, "AAPL", "BUY", 4.0, 225.0, 4.0, time.Now().AddDate(0, -3, 0), "", nil, nil, nil).
+						AddRow("tx2", testAssetID, "AAPL", "SELL", 2.0, 200.0, 0.0, time.Now(), "SPECIFIC", `{"tx1"}`, nil, nil),
+					newStoredHoldingRows().AddRow(testAssetID, "AAPL", 10.0, 150.0),
+					newStoredLotRows().AddRow("lot1", "tx0").AddRow("lot2", "tx1"))
+				expectLotInsert(mock, "tx0", 6.0, 6.0)
+				expectLotInsert(mock, "tx1", 4.0, 2.0)
+				// cost basis 2 * 225 + 4 * 2/4 = 452
+				mock.ExpectExec(`INSERT INTO lot_disposals`).
+					WithArgs("lot2", "tx2", 2.0, 452.0, 400.0, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(`UPDATE transactions SET realized_pnl = \$1 WHERE id = \$2`).
+					WithArgs(-52.0, "tx2").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				// remaining: 6 @ 100 and 2 @ 225 -> 131.25
+				expectHoldingUpsert(mock, testAssetID, 8.0, 131.25)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+			expectedBody:   []string{"Transaction created successfully", `"realized_pnl":-52`},
+		},
+		{
+			name:        "method override on the sale",
+			requestBody: `{"symbol": "AAPL", "transaction_type": "SELL", "quantity": 5, "price": 130, "cost_basis_method": "HIFO"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO transactions (.+) RETURNING id`).
+					WithArgs(testUserID, testPortfolioID, testAssetID, "SELL", 5.0, 130.0, 0.0, 650.0, "", "HIFO", nil).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("tx2"))
+				expectSnapshotInvalidation(mock, testPortfolioID, sqlmock.AnyArg())
+				expectReplay(mock, testPortfolioID, testAssetID,
+					newLedgerRows().
+						AddRow("tx0", testAssetID, "AAPL", "BUY", 5.0, 100.0, 0.0, time.Now().AddDate(0, -2, 0), "", nil, nil, nil).
+						AddRow("tx1", testAssetID, "AAPL", "BUY", 5.0, 120.0, 0.0, time.Now().AddDate(0, -1, 0), "", nil, nil, nil).
+						AddRow("tx2", testAssetID, "AAPL", "SELL", 5.0, 130.0, 0.0, time.Now(), "HIFO", nil, nil, nil),
+					newStoredHoldingRows().AddRow(testAssetID, "AAPL", 10.0, 110.0),
+					newStoredLotRows())
+				expectLotInsert(mock, "tx0", 5.0, 5.0)
+				expectLotInsert(mock, "tx1", 5.0, 0.0)
+				// HIFO sells the 120 lot
+				mock.ExpectExec(`INSERT INTO lot_disposals`).
+					WithArgs(sqlmock.AnyArg(), "tx2", 5.0, 600.0, 650.0, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(`UPDATE transactions SET realized_pnl = \$1 WHERE id = \$2`).
+					WithArgs(50.0, "tx2").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectHoldingUpsert(mock, testAssetID, 5.0, 100.0)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+			expectedBody:   []string{"Transaction created successfully", `"realized_pnl":50`},
+		},
+		{
+			name:        "unknown lot ID",
+			requestBody: `{"symbol": "AAPL", "transaction_type": "SELL", "quantity": 2, "price": 200, "lot_ids": ["nope"]}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id, transaction_id FROM tax_lots`).
+					WithArgs(testPortfolioID, testAssetID).
+					WillReturnRows(newStoredLotRows().AddRow("lot1", "tx0"))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"tax lot not found"},
+		},
+		{
+			name:        "SPECIFIC portfolio requires lot IDs",
+			requestBody: `{"symbol": "AAPL", "transaction_type": "SELL", "quantity": 2, "price": 200}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT cost_basis_method FROM portfolios WHERE id = \$1`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"cost_basis_method"}).AddRow("SPECIFIC"))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"lot_ids are required"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock, cleanup := createTestHandler(t)
+			defer cleanup()
+
+			expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+			mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = \$1`).
+				WithArgs("AAPL").
+				WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testAssetID))
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT quantity FROM portfolio_holdings`).
+				WithArgs(testPortfolioID, testAssetID).
+				WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(10.0))
+			tt.setupMock(mock)
+
+			router := createTestRouter(handler, "POST", "/transactions", handler.CreateTransaction)
+
+			req, _ := http.NewRequest("POST", "/transactions", strings.NewReader(tt.requestBody))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			for _, expected := range tt.expectedBody {
+				assert.Contains(t, w.Body.String(), expected)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestCreateTransaction_BuyRejectsLotSelection(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	router := createTestRouter(handler, "POST", "/transactions", handler.CreateTransaction)
+
+	requestBody := `{"symbol": "AAPL", "transaction_type": "BUY", "quantity": 2, "price": 200, "lot_ids": ["lot1"]}`
+	req, _ := http.NewRequest("POST", "/transactions", strings.NewReader(requestBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "only apply to SELL")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/portfolio-management/api-gateway/internal/services"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// failingMarketData fails every quote request, like a provider whose circuit breaker is open
+type failingMarketData struct {
+	mockMarketData
+}
+
+func (m *failingMarketData) GetQuote(symbol string) (*services.Quote, error) {
+	return nil, services.ErrProviderDegraded
+}
+
+func (m *failingMarketData) Degraded() bool {
+	return true
+}
+
+// TestMarketDataDegraded tests that a failing provider is reported by the health check and that the
+// last known quote is served while it fails
+func TestMarketDataDegraded(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger := zap.NewNop()
+
+	t.Run("health check reports the degraded provider", func(t *testing.T) {
+		handler := NewHandler(&services.Services{MarketData: &failingMarketData{}, Logger: logger}, logger)
+		router := gin.New()
+		router.GET("/health", handler.HealthCheck)
+		req, _ := http.NewRequest("GET", "/health", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"degraded":true`)
+		assert.Contains(t, w.Body.String(), `"provider":"mock"`)
+	})
+
+	t.Run("last known quote is served stale while the provider fails", func(t *testing.T) {
+		store := newMemoryQuoteStore()
+		old, _ := json.Marshal(map[string]interface{}{
+			"quote":      services.Quote{CurrentPrice: 100},
+			"fetched_at": time.Now().Add(-time.Hour),
+		})
+		store.values[services.QuoteCacheKey("mock", "AAPL")] = old
+		cache := services.NewQuoteCache(&failingMarketData{}, store, time.Minute, time.Minute, logger)
+		handler := NewHandler(&services.Services{MarketData: cache, Logger: logger}, logger)
+
+		w := getPrice(handler, "AAPL")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"current_price":100`)
+		assert.Contains(t, w.Body.String(), `"stale":true`)
+
+		w = getPrice(handler, "MSFT")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+}
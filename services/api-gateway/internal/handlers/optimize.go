@@ -0,0 +1,701 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// quadraticProgram is the problem of minimizing ½xᵀPx + qᵀx subject to lower ≤ Ax ≤ upper. Bounds may
+// be infinite, and equal for an equality. P may be nil for a linear objective.
+type quadraticProgram struct {
+	P            [][]float64
+	Q            []float64
+	A            [][]float64
+	Lower, Upper []float64
+}
+
+// addConstraint adds the constraint lower ≤ row·x ≤ upper
+func (qp *quadraticProgram) addConstraint(row []float64, lower, upper float64) {
+	qp.A = append(qp.A, row)
+	qp.Lower = append(qp.Lower, lower)
+	qp.Upper = append(qp.Upper, upper)
+}
+
+// solve minimizes the program with the alternating direction method of multipliers, as OSQP does,
+// adapting the step size to balance the primal and dual residuals. It reports false when the
+// constraints can't be met, or the iterations run out or ctx is done first.
+func (qp quadraticProgram) solve(ctx context.Context) ([]float64, bool) {
+	const (
+		sigma             = 1e-6
+		alpha             = 1.6
+		absoluteTolerance = 1e-9
+		relativeTolerance = 1e-7
+		maxIterations     = 50000
+	)
+	n, m := len(qp.Q), len(qp.A)
+
+	stepSize := 0.1
+	rho := make([]float64, m)
+	factor := func() ([][]float64, bool) {
+		for i := range rho {
+			rho[i] = stepSize
+			if qp.Lower[i] == qp.Upper[i] {
+				rho[i] = 1e3 * stepSize
+			}
+		}
+		kkt := make([][]float64, n)
+		for i := range kkt {
+			kkt[i] = make([]float64, n)
+			if qp.P != nil {
+				copy(kkt[i], qp.P[i])
+			}
+			kkt[i][i] += sigma
+		}
+		for r, row := range qp.A {
+			for i := range row {
+				if row[i] == 0 {
+					continue
+				}
+				for j := range row {
+					kkt[i][j] += rho[r] * row[i] * row[j]
+				}
+			}
+		}
+		return cholesky(kkt)
+	}
+	lower, ok := factor()
+	if !ok {
+		return nil, false
+	}
+
+	x, rhs := make([]float64, n), make([]float64, n)
+	z, y := make([]float64, m), make([]float64, m)
+	var primal float64
+	for iteration := 1; iteration <= maxIterations; iteration++ {
+		for j := range rhs {
+			rhs[j] = sigma*x[j] - qp.Q[j]
+		}
+		for r, row := range qp.A {
+			coefficient := rho[r]*z[r] - y[r]
+			for j := range row {
+				rhs[j] += row[j] * coefficient
+			}
+		}
+		step := choleskySolve(lower, rhs)
+		for j := range x {
+			x[j] = alpha*step[j] + (1-alpha)*x[j]
+		}
+		for r, row := range qp.A {
+			var projected float64
+			for j := range row {
+				projected += row[j] * step[j]
+			}
+			relaxed := alpha*projected + (1-alpha)*z[r]
+			next := math.Min(math.Max(relaxed+y[r]/rho[r], qp.Lower[r]), qp.Upper[r])
+			y[r] += rho[r] * (relaxed - next)
+			z[r] = next
+		}
+		if iteration%25 != 0 {
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil, false
+		}
+
+		// Residuals of the constraints and of the optimality conditions
+		var primalScale, dual, dualScale float64
+		primal = 0
+		for r, row := range qp.A {
+			var ax float64
+			for j := range row {
+				ax += row[j] * x[j]
+			}
+			primal = math.Max(primal, math.Abs(ax-z[r]))
+			primalScale = math.Max(primalScale, math.Max(math.Abs(ax), math.Abs(z[r])))
+		}
+		for j := 0; j < n; j++ {
+			var px, aty float64
+			if qp.P != nil {
+				for k := 0; k < n; k++ {
+					px += qp.P[j][k] * x[k]
+				}
+			}
+			for r, row := range qp.A {
+				aty += row[j] * y[r]
+			}
+			dual = math.Max(dual, math.Abs(px+qp.Q[j]+aty))
+			dualScale = math.Max(dualScale, math.Max(math.Abs(px), math.Max(math.Abs(aty), math.Abs(qp.Q[j]))))
+		}
+		if primal <= absoluteTolerance+relativeTolerance*primalScale && dual <= absoluteTolerance+relativeTolerance*dualScale {
+			return x, true
+		}
+
+		if iteration%100 == 0 {
+			ratio := math.Sqrt((primal / (primalScale + 1e-12)) / (dual/(dualScale+1e-12) + 1e-12))
+			if ratio > 5 || ratio < 0.2 {
+				stepSize = math.Min(math.Max(stepSize*ratio, 1e-6), 1e6)
+				if lower, ok = factor(); !ok {
+					return nil, false
+				}
+			}
+		}
+	}
+
+	// Accept a solution that meets the constraints closely enough even if it isn't quite optimal
+	return x, primal <= 1e-6
+}
+
+// weightGroup bounds the total weight of several assets, such as a sector's
+type weightGroup struct {
+	Name     string
+	Members  []int
+	Min, Max float64
+}
+
+// meanVarianceProblem is a set of assets' expected annual returns and covariance, and the bounds on a
+// fully invested portfolio of them
+type meanVarianceProblem struct {
+	Symbols      []string
+	Returns      []float64
+	Covariance   [][]float64
+	Lower, Upper []float64
+	Groups       []weightGroup
+	RiskFreeRate float64
+}
+
+// optimizedPortfolio is a portfolio's weights, in percent, with its expected annual return and risk
+type optimizedPortfolio struct {
+	ExpectedReturnPercent float64            `json:"expected_return_percent"`
+	VolatilityPercent     float64            `json:"volatility_percent"`
+	SharpeRatio           *float64           `json:"sharpe_ratio"`
+	Weights               map[string]float64 `json:"weights"`
+}
+
+// expectedReturn returns the expected annual return of weights
+func (p meanVarianceProblem) expectedReturn(weights []float64) float64 {
+	var total float64
+	for i, weight := range weights {
+		total += weight * p.Returns[i]
+	}
+	return total
+}
+
+// volatility returns the annual volatility of weights
+func (p meanVarianceProblem) volatility(weights []float64) float64 {
+	var variance float64
+	for i := range weights {
+		for j := range weights {
+			variance += weights[i] * weights[j] * p.Covariance[i][j]
+		}
+	}
+	return math.Sqrt(math.Max(variance, 0))
+}
+
+// portfolio describes weights, reporting weights within rounding of zero as zero
+func (p meanVarianceProblem) portfolio(weights []float64) *optimizedPortfolio {
+	expected, volatility := p.expectedReturn(weights), p.volatility(weights)
+	portfolio := &optimizedPortfolio{
+		ExpectedReturnPercent: expected * 100,
+		VolatilityPercent:     volatility * 100,
+		Weights:               make(map[string]float64, len(weights)),
+	}
+	if volatility > 0 {
+		portfolio.SharpeRatio = optionalFloat((expected - p.RiskFreeRate) / volatility)
+	}
+	for i, symbol := range p.Symbols {
+		weight := weights[i]
+		if math.Abs(weight) < 1e-6 {
+			weight = 0
+		}
+		portfolio.Weights[symbol] = weight * 100
+	}
+	return portfolio
+}
+
+// weightProgram returns the program over portfolio weights with the objective ½xᵀPx + qᵀx, subject to
+// full investment and the bounds
+func (p meanVarianceProblem) weightProgram(objective [][]float64, linear []float64) quadraticProgram {
+	n := len(p.Symbols)
+	qp := quadraticProgram{P: objective, Q: linear}
+	ones := make([]float64, n)
+	for i := range ones {
+		ones[i] = 1
+	}
+	qp.addConstraint(ones, 1, 1)
+	for i := 0; i < n; i++ {
+		row := make([]float64, n)
+		row[i] = 1
+		qp.addConstraint(row, p.Lower[i], p.Upper[i])
+	}
+	for _, group := range p.Groups {
+		row := make([]float64, n)
+		for _, i := range group.Members {
+			row[i] = 1
+		}
+		qp.addConstraint(row, group.Min, group.Max)
+	}
+	return qp
+}
+
+// minimumVariance returns the least risky weights expected to return at least minReturn; pass -Inf
+// for the global minimum
+func (p meanVarianceProblem) minimumVariance(ctx context.Context, minReturn float64) ([]float64, bool) {
+	qp := p.weightProgram(p.Covariance, make([]float64, len(p.Symbols)))
+	if !math.IsInf(minReturn, -1) {
+		qp.addConstraint(append([]float64(nil), p.Returns...), minReturn, math.Inf(1))
+	}
+	return qp.solve(ctx)
+}
+
+// maximumReturn returns the weights with the highest expected return, the least risky among equals
+func (p meanVarianceProblem) maximumReturn(ctx context.Context) ([]float64, bool) {
+	objective := make([][]float64, len(p.Covariance))
+	linear := make([]float64, len(p.Returns))
+	for i := range objective {
+		objective[i] = make([]float64, len(p.Covariance[i]))
+		for j := range objective[i] {
+			objective[i][j] = 1e-6 * p.Covariance[i][j]
+		}
+		linear[i] = -p.Returns[i]
+	}
+	return p.weightProgram(objective, linear).solve(ctx)
+}
+
+// maximumSharpe returns the weights with the highest Sharpe ratio. Scaling the weights by κ > 0 so the
+// excess return is one turns the ratio into a quadratic program over y = κw (Cornuejols and Tütüncü,
+// 2007). It reports false when no portfolio is expected to beat the risk-free rate.
+func (p meanVarianceProblem) maximumSharpe(ctx context.Context) ([]float64, bool) {
+	n := len(p.Symbols)
+	objective := make([][]float64, n+1)
+	for i := range objective {
+		objective[i] = make([]float64, n+1)
+		if i < n {
+			copy(objective[i], p.Covariance[i])
+		}
+	}
+	qp := quadraticProgram{P: objective, Q: make([]float64, n+1)}
+
+	excess := make([]float64, n+1)
+	for i := 0; i < n; i++ {
+		excess[i] = p.Returns[i] - p.RiskFreeRate
+	}
+	qp.addConstraint(excess, 1, 1)
+	invested := make([]float64, n+1)
+	for i := 0; i < n; i++ {
+		invested[i] = 1
+	}
+	invested[n] = -1
+	qp.addConstraint(invested, 0, 0)
+	for i := 0; i < n; i++ {
+		atLeast := make([]float64, n+1)
+		atLeast[i], atLeast[n] = 1, -p.Lower[i]
+		qp.addConstraint(atLeast, 0, math.Inf(1))
+		atMost := make([]float64, n+1)
+		atMost[i], atMost[n] = 1, -p.Upper[i]
+		qp.addConstraint(atMost, math.Inf(-1), 0)
+	}
+	for _, group := range p.Groups {
+		atLeast, atMost := make([]float64, n+1), make([]float64, n+1)
+		for _, i := range group.Members {
+			atLeast[i], atMost[i] = 1, 1
+		}
+		atLeast[n], atMost[n] = -group.Min, -group.Max
+		if !math.IsInf(group.Min, -1) {
+			qp.addConstraint(atLeast, 0, math.Inf(1))
+		}
+		if !math.IsInf(group.Max, 1) {
+			qp.addConstraint(atMost, math.Inf(-1), 0)
+		}
+	}
+	scale := make([]float64, n+1)
+	scale[n] = 1
+	qp.addConstraint(scale, 0, math.Inf(1))
+
+	solution, ok := qp.solve(ctx)
+	if !ok || solution[n] <= 1e-9 {
+		return nil, false
+	}
+	weights := make([]float64, n)
+	for i := range weights {
+		weights[i] = solution[i] / solution[n]
+	}
+	return weights, true
+}
+
+// efficientFrontier returns the least risky weights at evenly spaced expected returns from the
+// minimum-variance portfolio's to the highest, stopping early when ctx is done
+func (p meanVarianceProblem) efficientFrontier(ctx context.Context, points int, minimum, maximum []float64) [][]float64 {
+	from, to := p.expectedReturn(minimum), p.expectedReturn(maximum)
+	frontier := [][]float64{minimum}
+	if to-from < 1e-9 {
+		return frontier
+	}
+	for k := 1; k < points && ctx.Err() == nil; k++ {
+		weights, ok := p.minimumVariance(ctx, from+(to-from)*float64(k)/float64(points-1))
+		if ok {
+			frontier = append(frontier, weights)
+		}
+	}
+	return frontier
+}
+
+// forVolatility returns the efficient weights with the highest expected return at no more than the
+// target volatility, searching between the minimum-variance and highest-return portfolios until ctx
+// is done
+func (p meanVarianceProblem) forVolatility(ctx context.Context, target float64, minimum, maximum []float64) ([]float64, bool) {
+	if p.volatility(minimum) > target*(1+1e-6) {
+		return nil, false
+	}
+	if p.volatility(maximum) <= target {
+		return maximum, true
+	}
+	best := minimum
+	low, high := p.expectedReturn(minimum), p.expectedReturn(maximum)
+	for i := 0; i < 40 && high-low > 1e-7 && ctx.Err() == nil; i++ {
+		middle := (low + high) / 2
+		weights, ok := p.minimumVariance(ctx, middle)
+		if ok && p.volatility(weights) <= target {
+			best, low = weights, middle
+		} else {
+			high = middle
+		}
+	}
+	return best, true
+}
+
+// weightBounds are the least and most of a portfolio an asset or sector may make up, as fractions
+type weightBounds struct {
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+}
+
+// optimizerAsset is an asset's expected annual return and volatility, and its current weight
+type optimizerAsset struct {
+	Symbol                string  `json:"symbol"`
+	Sector                string  `json:"sector,omitempty"`
+	ExpectedReturnPercent float64 `json:"expected_return_percent"`
+	VolatilityPercent     float64 `json:"volatility_percent"`
+	CurrentWeightPercent  float64 `json:"current_weight_percent"`
+}
+
+// Helper function to load the sector of each symbol that has one
+func (h *Handler) loadSymbolSectors(symbols []string) (map[string]string, error) {
+	rows, err := h.services.DB.Query(`
+		SELECT symbol, sector
+		FROM assets
+		WHERE symbol = ANY($1) AND sector IS NOT NULL
+	`, pq.Array(symbols))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sectors: %w", err)
+	}
+	defer rows.Close()
+
+	sectors := map[string]string{}
+	for rows.Next() {
+		var symbol, sector string
+		if err := rows.Scan(&symbol, &sector); err != nil {
+			return nil, fmt.Errorf("failed to scan sector: %w", err)
+		}
+		sectors[symbol] = sector
+	}
+	return sectors, rows.Err()
+}
+
+// OptimizePortfolio finds the minimum-variance and maximum-Sharpe portfolios of the current holdings
+// and candidate symbols, and the efficient frontier between them, from their historical returns
+func (h *Handler) OptimizePortfolio(c *gin.Context) {
+	var request struct {
+		PortfolioID      string                  `json:"portfolio_id"`
+		Candidates       []string                `json:"candidates" binding:"max=50"`
+		LongOnly         *bool                   `json:"long_only"`
+		AssetBounds      map[string]weightBounds `json:"asset_bounds"`
+		SectorBounds     map[string]weightBounds `json:"sector_bounds"`
+		TargetReturn     *float64                `json:"target_return"`
+		TargetVolatility *float64                `json:"target_volatility" binding:"omitempty,gt=0"`
+		Lookback         string                  `json:"lookback"`
+		Shrinkage        string                  `json:"shrinkage" binding:"omitempty,oneof=none ledoit_wolf"`
+		RiskFreeRate     *float64                `json:"risk_free_rate"`
+		FrontierPoints   int                     `json:"frontier_points" binding:"omitempty,min=2,max=50"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to optimize portfolio"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, request.PortfolioID)
+	if !ok {
+		return
+	}
+
+	if request.TargetReturn != nil && request.TargetVolatility != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Give a target_return or a target_volatility, not both"})
+		return
+	}
+	longOnly := request.LongOnly == nil || *request.LongOnly
+	for name, bounds := range map[string]map[string]weightBounds{"asset_bounds": request.AssetBounds, "sector_bounds": request.SectorBounds} {
+		for key, bound := range bounds {
+			if (bound.Min != nil && bound.Max != nil && *bound.Min > *bound.Max) || (longOnly && bound.Min != nil && *bound.Min < 0) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %s for %s, expected min no more than max, and no negative weights when long-only", name, key)})
+				return
+			}
+		}
+	}
+	riskFreeRate := h.services.Analytics.RiskFreeRate
+	if request.RiskFreeRate != nil {
+		riskFreeRate = *request.RiskFreeRate
+		if math.Abs(riskFreeRate) >= 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid risk_free_rate, expected an annual rate as a fraction such as 0.04"})
+			return
+		}
+	}
+	lookback := request.Lookback
+	if lookback == "" {
+		lookback = "1y"
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	lookbackFrom, ok := priceHistoryStart(lookback, today)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid lookback %q, expected 7d, 30d, 90d, 1y, ytd, 5y or max", lookback)})
+		return
+	}
+	shrinkage := request.Shrinkage
+	if shrinkage == "" {
+		shrinkage = shrinkageNone
+	}
+	frontierPoints := request.FrontierPoints
+	if frontierPoints == 0 {
+		frontierPoints = 10
+	}
+
+	// Holdings are weighted by their market value in the portfolio's base currency
+	fx, err := h.newFXConverter(h.services.DB, portfolioID)
+	if err != nil {
+		h.logger.Error("Failed to load base currency", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to optimize portfolio"})
+		return
+	}
+	holdings, err := h.loadRiskHoldings(portfolioID, fx)
+	if err != nil {
+		h.respondFXError(c, err, "Failed to optimize portfolio")
+		return
+	}
+
+	// The universe is the holdings and the candidates
+	var symbols []string
+	seen := map[string]bool{}
+	for _, holding := range holdings {
+		if !seen[holding.Symbol] {
+			seen[holding.Symbol] = true
+			symbols = append(symbols, holding.Symbol)
+		}
+	}
+	for _, candidate := range request.Candidates {
+		symbol := strings.ToUpper(strings.TrimSpace(candidate))
+		if symbol != "" && !seen[symbol] {
+			seen[symbol] = true
+			symbols = append(symbols, symbol)
+		}
+	}
+	if len(symbols) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to optimize: the portfolio has no holdings and no candidates were given"})
+		return
+	}
+	for symbol := range request.AssetBounds {
+		if !seen[strings.ToUpper(symbol)] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("asset_bounds names %s, which is neither held nor a candidate", symbol)})
+			return
+		}
+	}
+
+	matrix, warnings, err := h.loadAlignedReturns(symbols, lookbackFrom, today)
+	if err != nil {
+		h.logger.Error("Failed to load price history for optimization", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to optimize portfolio"})
+		return
+	}
+	if len(matrix.Dates) < 2 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Optimizing needs at least two days of returns in the lookback window", "warnings": warnings})
+		return
+	}
+
+	sectors := map[string]string{}
+	if len(request.SectorBounds) > 0 {
+		if sectors, err = h.loadSymbolSectors(matrix.Symbols); err != nil {
+			h.logger.Error("Failed to load sectors for optimization", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to optimize portfolio"})
+			return
+		}
+	}
+
+	// Expected returns and covariance are annualized from the daily returns
+	covariance := newReturnCovariance(matrix, shrinkage == shrinkageLedoitWolf)
+	problem := meanVarianceProblem{
+		Symbols:      matrix.Symbols,
+		Covariance:   covariance.annualized(),
+		RiskFreeRate: riskFreeRate,
+	}
+	for i, symbol := range matrix.Symbols {
+		problem.Returns = append(problem.Returns, mean(matrix.Returns[i])*tradingDaysPerYear)
+		lower, upper := 0.0, 1.0
+		if !longOnly {
+			lower = -1
+		}
+		for key, bound := range request.AssetBounds {
+			if strings.EqualFold(key, symbol) {
+				if bound.Min != nil {
+					lower = *bound.Min
+				}
+				if bound.Max != nil {
+					upper = *bound.Max
+				}
+			}
+		}
+		problem.Lower = append(problem.Lower, lower)
+		problem.Upper = append(problem.Upper, upper)
+	}
+	sectorNames := make([]string, 0, len(request.SectorBounds))
+	for sector := range request.SectorBounds {
+		sectorNames = append(sectorNames, sector)
+	}
+	sort.Strings(sectorNames)
+	for _, sector := range sectorNames {
+		bound := request.SectorBounds[sector]
+		group := weightGroup{Name: sector, Min: math.Inf(-1), Max: math.Inf(1)}
+		for i, symbol := range matrix.Symbols {
+			if strings.EqualFold(sectors[symbol], sector) {
+				group.Members = append(group.Members, i)
+			}
+		}
+		if len(group.Members) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("sector_bounds names %s, which none of the holdings or candidates with price history are in", sector)})
+			return
+		}
+		if bound.Min != nil {
+			group.Min = *bound.Min
+		}
+		if bound.Max != nil {
+			group.Max = *bound.Max
+		}
+		problem.Groups = append(problem.Groups, group)
+	}
+
+	// Solving stops once the client goes away
+	ctx := c.Request.Context()
+	cancelled := func() bool {
+		if err := ctx.Err(); err != nil {
+			h.logger.Warn("Portfolio optimization cancelled", zap.Error(err))
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Portfolio optimization was cancelled"})
+			return true
+		}
+		return false
+	}
+
+	minimum, ok := problem.minimumVariance(ctx, math.Inf(-1))
+	if cancelled() {
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "No fully invested portfolio meets the weight bounds", "warnings": warnings})
+		return
+	}
+	maximum, ok := problem.maximumReturn(ctx)
+	if !ok {
+		maximum = minimum
+	}
+
+	assets := make([]optimizerAsset, len(matrix.Symbols))
+	// Holdings without price history are left out of the current weights, like the others
+	currentWeights, currentValue := holdingWeights(holdings, matrix.Symbols)
+	var pricedWeight float64
+	for _, weight := range currentWeights {
+		pricedWeight += weight
+	}
+	for i := range currentWeights {
+		if pricedWeight > 0 {
+			currentWeights[i] /= pricedWeight
+		}
+	}
+	for i, symbol := range matrix.Symbols {
+		assets[i] = optimizerAsset{
+			Symbol:                symbol,
+			Sector:                sectors[symbol],
+			ExpectedReturnPercent: problem.Returns[i] * 100,
+			VolatilityPercent:     math.Sqrt(problem.Covariance[i][i]) * 100,
+			CurrentWeightPercent:  currentWeights[i] * 100,
+		}
+	}
+
+	frontier := []*optimizedPortfolio{}
+	for _, weights := range problem.efficientFrontier(ctx, frontierPoints, minimum, maximum) {
+		frontier = append(frontier, problem.portfolio(weights))
+	}
+
+	response := gin.H{
+		"symbols":            matrix.Symbols,
+		"long_only":          longOnly,
+		"risk_free_rate":     riskFreeRate * 100,
+		"shrinkage":          gin.H{"method": shrinkage, "intensity": covariance.Shrinkage},
+		"lookback_window":    lookbackWindow(lookback, lookbackFrom, today, matrix),
+		"assets":             assets,
+		"current":            nil,
+		"min_variance":       problem.portfolio(minimum),
+		"max_sharpe":         nil,
+		"efficient_frontier": frontier,
+	}
+	if currentValue > 0 && pricedWeight > 0 {
+		response["current"] = problem.portfolio(currentWeights)
+	}
+	if weights, ok := problem.maximumSharpe(ctx); ok {
+		response["max_sharpe"] = problem.portfolio(weights)
+	} else {
+		warnings = append(warnings, "No portfolio within the bounds is expected to beat the risk-free rate, so there is no maximum-Sharpe portfolio")
+	}
+	switch {
+	case request.TargetReturn != nil:
+		response["target"] = nil
+		if weights, ok := problem.minimumVariance(ctx, *request.TargetReturn); ok {
+			response["target"] = problem.portfolio(weights)
+		} else {
+			warnings = append(warnings, fmt.Sprintf("No portfolio within the bounds is expected to return %.2f%%", *request.TargetReturn*100))
+		}
+	case request.TargetVolatility != nil:
+		response["target"] = nil
+		if weights, ok := problem.forVolatility(ctx, *request.TargetVolatility, minimum, maximum); ok {
+			response["target"] = problem.portfolio(weights)
+		} else {
+			warnings = append(warnings, fmt.Sprintf("No portfolio within the bounds is as little as %.2f%% volatile", *request.TargetVolatility*100))
+		}
+	}
+	if cancelled() {
+		return
+	}
+	if len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// optimizeTestProblem returns three uncorrelated assets with 20%, 30% and 40% volatility
+func optimizeTestProblem() meanVarianceProblem {
+	return meanVarianceProblem{
+		Symbols:      []string{"AAA", "BBB", "CCC"},
+		Returns:      []float64{0.08, 0.10, 0.12},
+		Covariance:   [][]float64{{0.04, 0, 0}, {0, 0.09, 0}, {0, 0, 0.16}},
+		Lower:        []float64{0, 0, 0},
+		Upper:        []float64{1, 1, 1},
+		RiskFreeRate: 0.02,
+	}
+}
+
+// normalized returns values scaled to sum to one
+func normalized(values ...float64) []float64 {
+	var total float64
+	for _, v := range values {
+		total += v
+	}
+	weights := make([]float64, len(values))
+	for i, v := range values {
+		weights[i] = v / total
+	}
+	return weights
+}
+
+// TestQuadraticProgram tests the solver on a problem with an equality and a binding bound
+func TestQuadraticProgram(t *testing.T) {
+	qp := quadraticProgram{P: [][]float64{{1, 0}, {0, 1}}, Q: []float64{0, 0}}
+	qp.addConstraint([]float64{1, 1}, 1, 1)
+	qp.addConstraint([]float64{1, 0}, 0, 0.3)
+
+	x, ok := qp.solve(context.Background())
+
+	assert.True(t, ok)
+	assert.InDeltaSlice(t, []float64{0.3, 0.7}, x, 1e-6)
+
+	// Constraints that contradict each other can't be met
+	qp.addConstraint([]float64{0, 1}, 0, 0.5)
+	_, ok = qp.solve(context.Background())
+	assert.False(t, ok)
+
+	// Solving stops once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, ok = quadraticProgram{P: [][]float64{{1, 0}, {0, 1}}, Q: []float64{-1, -1}}.solve(ctx)
+	assert.False(t, ok)
+}
+
+// TestMeanVarianceProblem tests the minimum-variance, maximum-Sharpe and highest-return portfolios
+func TestMeanVarianceProblem(t *testing.T) {
+	problem := optimizeTestProblem()
+
+	// Uncorrelated assets are held in inverse proportion to their variance
+	minimum, ok := problem.minimumVariance(context.Background(), math.Inf(-1))
+	assert.True(t, ok)
+	assert.InDeltaSlice(t, normalized(1/0.04, 1/0.09, 1/0.16), minimum, 1e-5)
+
+	// and in proportion to their excess return over their variance for the best Sharpe ratio
+	sharpe, ok := problem.maximumSharpe(context.Background())
+	assert.True(t, ok)
+	assert.InDeltaSlice(t, normalized(0.06/0.04, 0.08/0.09, 0.10/0.16), sharpe, 1e-5)
+
+	maximum, ok := problem.maximumReturn(context.Background())
+	assert.True(t, ok)
+	assert.InDeltaSlice(t, []float64{0, 0, 1}, maximum, 1e-5)
+
+	frontier := problem.efficientFrontier(context.Background(), 5, minimum, maximum)
+	if assert.Len(t, frontier, 5) {
+		for i := 1; i < len(frontier); i++ {
+			assert.Greater(t, problem.expectedReturn(frontier[i]), problem.expectedReturn(frontier[i-1]))
+			assert.Greater(t, problem.volatility(frontier[i]), problem.volatility(frontier[i-1]))
+		}
+		assert.InDelta(t, 0.12, problem.expectedReturn(frontier[4]), 1e-6)
+	}
+
+	target, ok := problem.forVolatility(context.Background(), 0.25, minimum, maximum)
+	assert.True(t, ok)
+	assert.InDelta(t, 0.25, problem.volatility(target), 1e-4)
+	_, ok = problem.forVolatility(context.Background(), 0.1, minimum, maximum)
+	assert.False(t, ok)
+
+	// A cancelled request keeps only the frontier's first point and the search's starting point
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Len(t, problem.efficientFrontier(ctx, 5, minimum, maximum), 1)
+	target, ok = problem.forVolatility(ctx, 0.25, minimum, maximum)
+	assert.True(t, ok)
+	assert.Equal(t, minimum, target)
+
+	t.Run("bounds", func(t *testing.T) {
+		problem := optimizeTestProblem()
+		problem.Upper[0] = 0.4
+		problem.Groups = []weightGroup{{Name: "Technology", Members: []int{1, 2}, Min: 0.7, Max: math.Inf(1)}}
+
+		// AAA is capped by the sector minimum; the rest stays in inverse proportion to variance
+		minimum, ok := problem.minimumVariance(context.Background(), math.Inf(-1))
+		assert.True(t, ok)
+		rest := normalized(1/0.09, 1/0.16)
+		assert.InDeltaSlice(t, []float64{0.3, 0.7 * rest[0], 0.7 * rest[1]}, minimum, 1e-5)
+
+		sharpe, ok := problem.maximumSharpe(context.Background())
+		assert.True(t, ok)
+		assert.InDelta(t, 0.3, sharpe[0], 1e-5)
+
+		problem.Groups[0].Max = 0.5
+		_, ok = problem.minimumVariance(context.Background(), math.Inf(-1))
+		assert.False(t, ok)
+	})
+
+	t.Run("nothing beats the risk-free rate", func(t *testing.T) {
+		problem := optimizeTestProblem()
+		problem.RiskFreeRate = 0.2
+
+		_, ok := problem.maximumSharpe(context.Background())
+		assert.False(t, ok)
+	})
+}
+
+// TestOptimizePortfolio tests the optimizer endpoint
+func TestOptimizePortfolio(t *testing.T) {
+	post := func(handler *Handler, body string) *httptest.ResponseRecorder {
+		router := createTestRouter(handler, "POST", "/analytics/optimize", handler.OptimizePortfolio)
+		req, _ := http.NewRequest("POST", "/analytics/optimize", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("holdings and candidates", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		expectBaseCurrency(mock, testPortfolioID, "USD")
+		mock.ExpectQuery(`SELECT a.symbol, COALESCE\(a.currency, 'USD'\) as currency, ph.quantity, ph.average_cost, \(ph.quantity \* ph.average_cost\) as position_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \$1`).
+			WithArgs(testPortfolioID).
+			WillReturnRows(sqlmock.NewRows([]string{"symbol", "currency", "quantity", "average_cost", "position_value"}).
+				AddRow("AAA", "USD", 10.0, 75.0, 750.0))
+
+		matrix := varTestMatrix()
+		rows := sqlmock.NewRows([]string{"symbol", "date", "close_price"})
+		for i, symbol := range matrix.Symbols {
+			price := 100.0
+			rows.AddRow(symbol, matrix.Start, price)
+			for j, r := range matrix.Returns[i] {
+				price *= 1 + r
+				rows.AddRow(symbol, matrix.Dates[j], price)
+			}
+		}
+		mock.ExpectQuery(`SELECT a.symbol, ph.date, ph.close_price FROM price_history ph JOIN assets a ON ph.asset_id = a.id WHERE a.symbol = ANY\(\$1\)`).
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(rows)
+		mock.ExpectQuery(`SELECT symbol, sector FROM assets WHERE symbol = ANY\(\$1\) AND sector IS NOT NULL`).
+			WithArgs(sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"symbol", "sector"}).
+				AddRow("AAA", "Technology").
+				AddRow("BBB", "Utilities"))
+
+		w := post(handler, `{"candidates": ["bbb", "CCC"], "lookback": "max", "sector_bounds": {"Technology": {"max": 0.6}}, "target_volatility": 0.2, "frontier_points": 3}`)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Symbols     []string              `json:"symbols"`
+			Assets      []optimizerAsset      `json:"assets"`
+			Current     *optimizedPortfolio   `json:"current"`
+			MinVariance *optimizedPortfolio   `json:"min_variance"`
+			Frontier    []*optimizedPortfolio `json:"efficient_frontier"`
+			Target      *optimizedPortfolio   `json:"target"`
+			Warnings    []string              `json:"warnings"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, []string{"AAA", "BBB"}, response.Symbols)
+		if assert.Len(t, response.Assets, 2) {
+			assert.Equal(t, "Technology", response.Assets[0].Sector)
+			assert.Equal(t, 100.0, response.Assets[0].CurrentWeightPercent)
+		}
+		if assert.NotNil(t, response.Current) {
+			assert.Equal(t, 100.0, response.Current.Weights["AAA"])
+		}
+		if assert.NotNil(t, response.MinVariance) {
+			assert.LessOrEqual(t, response.MinVariance.Weights["AAA"], 60.0+1e-3)
+			assert.InDelta(t, 100, response.MinVariance.Weights["AAA"]+response.MinVariance.Weights["BBB"], 1e-3)
+		}
+		assert.NotEmpty(t, response.Frontier)
+		assert.NotNil(t, response.Target)
+		assert.Contains(t, response.Warnings, "No price history for CCC in the lookback window")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		for _, body := range []string{
+			`{"target_return": 0.1, "target_volatility": 0.1}`,
+			`{"asset_bounds": {"AAA": {"min": 0.5, "max": 0.2}}}`,
+			`{"asset_bounds": {"AAA": {"min": -0.1}}}`,
+			`{"lookback": "2w"}`,
+			`{"risk_free_rate": 3}`,
+		} {
+			expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+			w := post(handler, body)
+			assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		}
+
+		candidates, _ := json.Marshal(make([]string, 51))
+		for _, body := range []string{`{"shrinkage": "oas"}`, `{"frontier_points": 1}`, `{"target_volatility": -0.1}`, `{"candidates": ` + string(candidates) + `}`} {
+			w := post(handler, body)
+			assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		}
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
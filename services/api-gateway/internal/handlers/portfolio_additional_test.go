@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gin-gonic/gin"
@@ -30,20 +31,23 @@ func TestRemoveHolding(t *testing.T) {
 			name:      "successful holding removal",
 			holdingID: testHoldingID,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
-
 				// Check holding exists and get asset info
-				mock.ExpectQuery(`SELECT a.symbol, ph.quantity FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
-					WithArgs(testHoldingID, testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"symbol", "quantity"}).AddRow("AAPL", 10.0))
-
-				// Delete holding
-				mock.ExpectExec(`DELETE FROM portfolio_holdings WHERE id = (.+) AND user_id = (.+)`).
+				mock.ExpectQuery(`SELECT a.symbol, ph.quantity, ph.portfolio_id, ph.asset_id FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
 					WithArgs(testHoldingID, testUserID).
-					WillReturnResult(sqlmock.NewResult(1, 1))
+					WillReturnRows(sqlmock.NewRows([]string{"symbol", "quantity", "portfolio_id", "asset_id"}).AddRow("AAPL", 10.0, testPortfolioID, testAssetID))
+
+				// The removal is recorded as an adjustment to zero
+				mock.ExpectBegin()
+				expectLedgerEntry(mock, testUserID, testPortfolioID, testAssetID, "ADJUST", 0.0, 0.0, "Holding removed")
+				expectReplay(mock, testPortfolioID, testAssetID,
+					newLedgerRows().
+						AddRow("tx-1", testAssetID, "AAPL", "BUY", 10.0, 150.0, 0.0, time.Now().AddDate(0, -1, 0), "", nil, nil, nil).
+						AddRow("tx-2", testAssetID, "AAPL", "ADJUST", 0.0, 0.0, 0.0, time.Now(), "", nil, nil, nil),
+					newStoredHoldingRows().AddRow(testAssetID, "AAPL", 10.0, 150.0),
+					newStoredLotRows().AddRow("lot-1", "tx-1"))
+				expectLotInsert(mock, "tx-1", 10.0, 0.0)
+				expectHoldingDelete(mock, testPortfolioID, testAssetID)
+				mock.ExpectCommit()
 			},
 			expectedStatus: http.StatusOK,
 			expectedBody:   []string{"Holding removed successfully", "AAPL", "10"},
@@ -59,13 +63,8 @@ func TestRemoveHolding(t *testing.T) {
 			name:      "holding not found",
 			holdingID: "non-existent-id",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
-
 				// Check holding exists (not found)
-				mock.ExpectQuery(`SELECT a.symbol, ph.quantity FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
+				mock.ExpectQuery(`SELECT a.symbol, ph.quantity, ph.portfolio_id, ph.asset_id FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
 					WithArgs("non-existent-id", testUserID).
 					WillReturnError(sql.ErrNoRows)
 			},
@@ -76,13 +75,8 @@ func TestRemoveHolding(t *testing.T) {
 			name:      "user authorization failure",
 			holdingID: testHoldingID,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
-
 				// Check holding exists but belongs to different user
-				mock.ExpectQuery(`SELECT a.symbol, ph.quantity FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
+				mock.ExpectQuery(`SELECT a.symbol, ph.quantity, ph.portfolio_id, ph.asset_id FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
 					WithArgs(testHoldingID, testUserID).
 					WillReturnError(sql.ErrNoRows)
 			},
@@ -93,45 +87,40 @@ func TestRemoveHolding(t *testing.T) {
 			name:      "database deletion failure",
 			holdingID: testHoldingID,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
-
 				// Check holding exists and get asset info
-				mock.ExpectQuery(`SELECT a.symbol, ph.quantity FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
+				mock.ExpectQuery(`SELECT a.symbol, ph.quantity, ph.portfolio_id, ph.asset_id FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
 					WithArgs(testHoldingID, testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"symbol", "quantity"}).AddRow("AAPL", 10.0))
+					WillReturnRows(sqlmock.NewRows([]string{"symbol", "quantity", "portfolio_id", "asset_id"}).AddRow("AAPL", 10.0, testPortfolioID, testAssetID))
 
-				// Delete fails
-				mock.ExpectExec(`DELETE FROM portfolio_holdings WHERE id = (.+) AND user_id = (.+)`).
-					WithArgs(testHoldingID, testUserID).
+				// Recording the adjustment fails
+				mock.ExpectBegin()
+				mock.ExpectExec(`INSERT INTO transactions`).
+					WithArgs(testUserID, testPortfolioID, testAssetID, "ADJUST", 0.0, 0.0, 0.0, "Holding removed").
 					WillReturnError(fmt.Errorf("database error"))
+				mock.ExpectRollback()
 			},
 			expectedStatus: http.StatusInternalServerError,
 			expectedBody:   []string{"Failed to remove holding"},
 		},
 		{
-			name:      "no rows affected after delete",
+			name:      "ledger replay failure",
 			holdingID: testHoldingID,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
-
 				// Check holding exists and get asset info
-				mock.ExpectQuery(`SELECT a.symbol, ph.quantity FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
+				mock.ExpectQuery(`SELECT a.symbol, ph.quantity, ph.portfolio_id, ph.asset_id FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
 					WithArgs(testHoldingID, testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"symbol", "quantity"}).AddRow("AAPL", 10.0))
+					WillReturnRows(sqlmock.NewRows([]string{"symbol", "quantity", "portfolio_id", "asset_id"}).AddRow("AAPL", 10.0, testPortfolioID, testAssetID))
 
-				// Delete returns 0 rows affected
-				mock.ExpectExec(`DELETE FROM portfolio_holdings WHERE id = (.+) AND user_id = (.+)`).
-					WithArgs(testHoldingID, testUserID).
-					WillReturnResult(sqlmock.NewResult(1, 0))
+				// The adjustment is recorded but the ledger can't be read back
+				mock.ExpectBegin()
+				expectLedgerEntry(mock, testUserID, testPortfolioID, testAssetID, "ADJUST", 0.0, 0.0, "Holding removed")
+				mock.ExpectQuery(`SELECT (.+) FROM transactions t JOIN assets a`).
+					WithArgs(testPortfolioID, testAssetID).
+					WillReturnError(fmt.Errorf("database error"))
+				mock.ExpectRollback()
 			},
-			expectedStatus: http.StatusNotFound,
-			expectedBody:   []string{"Holding not found"},
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody:   []string{"Failed to remove holding"},
 		},
 		{
 			name:           "nil database connection",
@@ -155,6 +144,7 @@ func TestRemoveHolding(t *testing.T) {
 			}
 
 			router := gin.New()
+			router.Use(withTestUser(testUserID))
 			router.DELETE("/portfolio/holdings/:id", handler.RemoveHolding)
 
 			url := "/portfolio/holdings/" + tt.holdingID
@@ -282,18 +272,27 @@ func TestAddHolding_CostAveraging(t *testing.T) {
 
 	// Test case: Adding 5 shares at $200 to existing 10 shares at $150
 	// Expected: 15 shares at average cost of $166.67
-	mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-		WithArgs(defaultUser).
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+
+	expectDefaultPortfolio(mock, testUserID, testPortfolioID)
 
 	mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = (.+)`).
 		WithArgs("AAPL").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testAssetID))
 
-	// The ON CONFLICT DO UPDATE handles cost averaging
-	mock.ExpectExec(`INSERT INTO portfolio_holdings \(user_id, asset_id, quantity, average_cost\) VALUES \(.+\) ON CONFLICT \(user_id, asset_id\) DO UPDATE SET (.+)`).
-		WithArgs(testUserID, testAssetID, 5.0, 200.0).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	// Replaying both purchases averages the cost across the open lots
+	mock.ExpectBegin()
+	expectFundingDeposit(mock, testUserID, testPortfolioID, testAssetID, 1000.0)
+	expectLedgerEntry(mock, testUserID, testPortfolioID, testAssetID, "BUY", 5.0, 200.0, "Added from holdings")
+	expectReplay(mock, testPortfolioID, testAssetID,
+		newLedgerRows().
+			AddRow("tx-1", testAssetID, "AAPL", "BUY", 10.0, 150.0, 0.0, time.Now().AddDate(0, -1, 0), "", nil, nil, nil).
+			AddRow("tx-2", testAssetID, "AAPL", "BUY", 5.0, 200.0, 0.0, time.Now(), "", nil, nil, nil),
+		newStoredHoldingRows().AddRow(testAssetID, "AAPL", 10.0, 150.0),
+		newStoredLotRows().AddRow("lot-1", "tx-1"))
+	expectLotInsert(mock, "tx-1", 10.0, 10.0)
+	expectLotInsert(mock, "tx-2", 5.0, 5.0)
+	expectHoldingUpsert(mock, testAssetID, 15.0, 2500.0/15.0)
+	mock.ExpectCommit()
 
 	router := createTestRouter(handler, "POST", "/portfolio/holdings", handler.AddHolding)
 
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
@@ -23,83 +24,107 @@ func TestGetPortfolioSummary(t *testing.T) {
 		{
 			name: "successful portfolio summary",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				expectBaseCurrency(mock, testPortfolioID, "USD")
 
 				// Portfolio summary query
-				mock.ExpectQuery(`SELECT COUNT\(\*\) as total_holdings, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_cost, COALESCE\(SUM\(ph\.quantity\), 0\) as total_shares FROM portfolio_holdings ph WHERE ph\.user_id = (.+)`).
-					WithArgs(testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"total_holdings", "total_cost", "total_shares"}).
-						AddRow(3, 15000.0, 50.0))
+				mock.ExpectQuery(`SELECT COALESCE\(a\.currency, 'USD'\) as currency, COUNT\(\*\) as total_holdings, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_cost, COALESCE\(SUM\(ph\.quantity\), 0\) as total_shares FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = \$1 GROUP BY`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"currency", "total_holdings", "total_cost", "total_shares"}).
+						AddRow("USD", 3, 15000.0, 50.0))
 
 				// Asset allocation query
-				mock.ExpectQuery(`SELECT a\.asset_type, COUNT\(\*\) as count, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.user_id = (.+) GROUP BY a\.asset_type ORDER BY total_value DESC`).
-					WithArgs(testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"asset_type", "count", "total_value"}).
-						AddRow("STOCK", 2, 12000.0).
-						AddRow("ETF", 1, 3000.0))
+				mock.ExpectQuery(`SELECT a\.asset_type, COALESCE\(a\.currency, 'USD'\) as currency, COUNT\(\*\) as count, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = (.+) GROUP BY a\.asset_type, COALESCE\(a\.currency, 'USD'\) ORDER BY total_value DESC`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"asset_type", "currency", "count", "total_value"}).
+						AddRow("STOCK", "USD", 2, 12000.0).
+						AddRow("ETF", "USD", 1, 3000.0))
 
 				// Top holdings query
-				mock.ExpectQuery(`SELECT a\.symbol, a\.name, ph\.quantity, ph\.average_cost, \(ph\.quantity \* ph\.average_cost\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.user_id = (.+) ORDER BY \(ph\.quantity \* ph\.average_cost\) DESC LIMIT 5`).
-					WithArgs(testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"symbol", "name", "quantity", "average_cost", "total_value"}).
-						AddRow("AAPL", "Apple Inc.", 10.0, 800.0, 8000.0).
-						AddRow("GOOGL", "Alphabet Inc.", 2.0, 2000.0, 4000.0).
-						AddRow("SPY", "SPDR S&P 500 ETF", 10.0, 300.0, 3000.0))
+				mock.ExpectQuery(`SELECT a\.symbol, a\.name, COALESCE\(a\.currency, 'USD'\) as currency, ph\.quantity, ph\.average_cost, \(ph\.quantity \* ph\.average_cost\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = (.+) ORDER BY \(ph\.quantity \* ph\.average_cost\) DESC`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"symbol", "name", "currency", "quantity", "average_cost", "total_value"}).
+						AddRow("AAPL", "Apple Inc.", "USD", 10.0, 800.0, 8000.0).
+						AddRow("GOOGL", "Alphabet Inc.", "USD", 2.0, 2000.0, 4000.0).
+						AddRow("SPY", "SPDR S&P 500 ETF", "USD", 10.0, 300.0, 3000.0))
+
+				// Cash adds to the portfolio's value and allocation
+				expectCashBalances(mock, testPortfolioID, newCashBalanceRows().AddRow("USD", 5000.0))
 			},
 			expectedStatus: http.StatusOK,
-			expectedBody:   []string{"summary", "asset_allocation", "top_holdings", "total_holdings", "AAPL", "GOOGL", "SPY"},
+			expectedBody: []string{"summary", "asset_allocation", "top_holdings", "total_holdings", "AAPL", "GOOGL", "SPY",
+				`"cash_balance":5000`, `"total_value":20000`, `"asset_type":"CASH"`, `"percentage":25`},
 		},
 		{
-			name: "empty portfolio summary",
+			name: "purchases the cash didn't cover count as paid in",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				expectBaseCurrency(mock, testPortfolioID, "USD")
 
-				// Portfolio summary query - empty portfolio
-				mock.ExpectQuery(`SELECT COUNT\(\*\) as total_holdings, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_cost, COALESCE\(SUM\(ph\.quantity\), 0\) as total_shares FROM portfolio_holdings ph WHERE ph\.user_id = (.+)`).
-					WithArgs(testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"total_holdings", "total_cost", "total_shares"}).
-						AddRow(0, 0.0, 0.0))
+				// Portfolio summary query
+				mock.ExpectQuery(`SELECT COALESCE\(a\.currency, 'USD'\) as currency, COUNT\(\*\) as total_holdings, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_cost, COALESCE\(SUM\(ph\.quantity\), 0\) as total_shares FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = \$1 GROUP BY`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"currency", "total_holdings", "total_cost", "total_shares"}).
+						AddRow("USD", 3, 15000.0, 50.0))
 
-				// Asset allocation query - empty
-				mock.ExpectQuery(`SELECT a\.asset_type, COUNT\(\*\) as count, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.user_id = (.+) GROUP BY a\.asset_type ORDER BY total_value DESC`).
-					WithArgs(testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"asset_type", "count", "total_value"}))
+				// Asset allocation query
+				mock.ExpectQuery(`SELECT a\.asset_type, COALESCE\(a\.currency, 'USD'\) as currency, COUNT\(\*\) as count, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = (.+) GROUP BY a\.asset_type, COALESCE\(a\.currency, 'USD'\) ORDER BY total_value DESC`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"asset_type", "currency", "count", "total_value"}).
+						AddRow("STOCK", "USD", 2, 12000.0).
+						AddRow("ETF", "USD", 1, 3000.0))
 
-				// Top holdings query - empty
-				mock.ExpectQuery(`SELECT a\.symbol, a\.name, ph\.quantity, ph\.average_cost, \(ph\.quantity \* ph\.average_cost\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.user_id = (.+) ORDER BY \(ph\.quantity \* ph\.average_cost\) DESC LIMIT 5`).
-					WithArgs(testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"symbol", "name", "quantity", "average_cost", "total_value"}))
+				// Top holdings query
+				mock.ExpectQuery(`SELECT a\.symbol, a\.name, COALESCE\(a\.currency, 'USD'\) as currency, ph\.quantity, ph\.average_cost, \(ph\.quantity \* ph\.average_cost\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = (.+) ORDER BY \(ph\.quantity \* ph\.average_cost\) DESC`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"symbol", "name", "currency", "quantity", "average_cost", "total_value"}).
+						AddRow("AAPL", "Apple Inc.", "USD", 10.0, 800.0, 8000.0).
+						AddRow("GOOGL", "Alphabet Inc.", "USD", 2.0, 2000.0, 4000.0).
+						AddRow("SPY", "SPDR S&P 500 ETF", "USD", 10.0, 300.0, 3000.0))
+
+				// Nothing was deposited, so the buys were paid for from outside and leave no overdraft
+				expectCashLedger(mock, testPortfolioID, "", newCashLedgerRows().
+					AddRow("USD", "BUY", 12000.0, 0.0).
+					AddRow("USD", "BUY", 3000.0, 0.0))
 			},
 			expectedStatus: http.StatusOK,
-			expectedBody:   []string{"summary", "asset_allocation", "top_holdings", `"total_holdings":0`},
+			expectedBody:   []string{`"cash_balance":0`, `"total_value":15000`},
 		},
 		{
-			name: "user not found error",
+			name: "empty portfolio summary",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnError(sql.ErrNoRows)
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				expectBaseCurrency(mock, testPortfolioID, "USD")
+
+				// Portfolio summary query - empty portfolio
+				mock.ExpectQuery(`SELECT COALESCE\(a\.currency, 'USD'\) as currency, COUNT\(\*\) as total_holdings, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_cost, COALESCE\(SUM\(ph\.quantity\), 0\) as total_shares FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = \$1 GROUP BY`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"currency", "total_holdings", "total_cost", "total_shares"}))
+
+				// Asset allocation query - empty
+				mock.ExpectQuery(`SELECT a\.asset_type, COALESCE\(a\.currency, 'USD'\) as currency, COUNT\(\*\) as count, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = (.+) GROUP BY a\.asset_type, COALESCE\(a\.currency, 'USD'\) ORDER BY total_value DESC`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"asset_type", "currency", "count", "total_value"}))
+
+				// Top holdings query - empty
+				mock.ExpectQuery(`SELECT a\.symbol, a\.name, COALESCE\(a\.currency, 'USD'\) as currency, ph\.quantity, ph\.average_cost, \(ph\.quantity \* ph\.average_cost\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = (.+) ORDER BY \(ph\.quantity \* ph\.average_cost\) DESC`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"symbol", "name", "currency", "quantity", "average_cost", "total_value"}))
+
+				expectCashBalances(mock, testPortfolioID, newCashBalanceRows())
 			},
-			expectedStatus: http.StatusInternalServerError,
-			expectedBody:   []string{"Failed to get user"},
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{"summary", "asset_allocation", "top_holdings", `"total_holdings":0`, `"cash_balance":0`},
 		},
 		{
 			name: "portfolio summary query error",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				expectBaseCurrency(mock, testPortfolioID, "USD")
 
 				// Portfolio summary query fails
-				mock.ExpectQuery(`SELECT COUNT\(\*\) as total_holdings, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_cost, COALESCE\(SUM\(ph\.quantity\), 0\) as total_shares FROM portfolio_holdings ph WHERE ph\.user_id = (.+)`).
-					WithArgs(testUserID).
+				mock.ExpectQuery(`SELECT COALESCE\(a\.currency, 'USD'\) as currency, COUNT\(\*\) as total_holdings, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_cost, COALESCE\(SUM\(ph\.quantity\), 0\) as total_shares FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = \$1 GROUP BY`).
+					WithArgs(testPortfolioID).
 					WillReturnError(fmt.Errorf("database error"))
 			},
 			expectedStatus: http.StatusInternalServerError,
@@ -108,20 +133,18 @@ func TestGetPortfolioSummary(t *testing.T) {
 		{
 			name: "asset allocation query error",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				expectBaseCurrency(mock, testPortfolioID, "USD")
 
 				// Portfolio summary query
-				mock.ExpectQuery(`SELECT COUNT\(\*\) as total_holdings, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_cost, COALESCE\(SUM\(ph\.quantity\), 0\) as total_shares FROM portfolio_holdings ph WHERE ph\.user_id = (.+)`).
-					WithArgs(testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"total_holdings", "total_cost", "total_shares"}).
-						AddRow(3, 15000.0, 50.0))
+				mock.ExpectQuery(`SELECT COALESCE\(a\.currency, 'USD'\) as currency, COUNT\(\*\) as total_holdings, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_cost, COALESCE\(SUM\(ph\.quantity\), 0\) as total_shares FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = \$1 GROUP BY`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"currency", "total_holdings", "total_cost", "total_shares"}).
+						AddRow("USD", 3, 15000.0, 50.0))
 
 				// Asset allocation query fails
-				mock.ExpectQuery(`SELECT a\.asset_type, COUNT\(\*\) as count, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.user_id = (.+) GROUP BY a\.asset_type ORDER BY total_value DESC`).
-					WithArgs(testUserID).
+				mock.ExpectQuery(`SELECT a\.asset_type, COALESCE\(a\.currency, 'USD'\) as currency, COUNT\(\*\) as count, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = (.+) GROUP BY a\.asset_type, COALESCE\(a\.currency, 'USD'\) ORDER BY total_value DESC`).
+					WithArgs(testPortfolioID).
 					WillReturnError(fmt.Errorf("database error"))
 			},
 			expectedStatus: http.StatusInternalServerError,
@@ -130,26 +153,24 @@ func TestGetPortfolioSummary(t *testing.T) {
 		{
 			name: "top holdings query error",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				expectBaseCurrency(mock, testPortfolioID, "USD")
 
 				// Portfolio summary query
-				mock.ExpectQuery(`SELECT COUNT\(\*\) as total_holdings, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_cost, COALESCE\(SUM\(ph\.quantity\), 0\) as total_shares FROM portfolio_holdings ph WHERE ph\.user_id = (.+)`).
-					WithArgs(testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"total_holdings", "total_cost", "total_shares"}).
-						AddRow(3, 15000.0, 50.0))
+				mock.ExpectQuery(`SELECT COALESCE\(a\.currency, 'USD'\) as currency, COUNT\(\*\) as total_holdings, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_cost, COALESCE\(SUM\(ph\.quantity\), 0\) as total_shares FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = \$1 GROUP BY`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"currency", "total_holdings", "total_cost", "total_shares"}).
+						AddRow("USD", 3, 15000.0, 50.0))
 
 				// Asset allocation query
-				mock.ExpectQuery(`SELECT a\.asset_type, COUNT\(\*\) as count, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.user_id = (.+) GROUP BY a\.asset_type ORDER BY total_value DESC`).
-					WithArgs(testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"asset_type", "count", "total_value"}).
-						AddRow("STOCK", 2, 12000.0))
+				mock.ExpectQuery(`SELECT a\.asset_type, COALESCE\(a\.currency, 'USD'\) as currency, COUNT\(\*\) as count, COALESCE\(SUM\(ph\.quantity \* ph\.average_cost\), 0\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = (.+) GROUP BY a\.asset_type, COALESCE\(a\.currency, 'USD'\) ORDER BY total_value DESC`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"asset_type", "currency", "count", "total_value"}).
+						AddRow("STOCK", "USD", 2, 12000.0))
 
 				// Top holdings query fails
-				mock.ExpectQuery(`SELECT a\.symbol, a\.name, ph\.quantity, ph\.average_cost, \(ph\.quantity \* ph\.average_cost\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.user_id = (.+) ORDER BY \(ph\.quantity \* ph\.average_cost\) DESC LIMIT 5`).
-					WithArgs(testUserID).
+				mock.ExpectQuery(`SELECT a\.symbol, a\.name, COALESCE\(a\.currency, 'USD'\) as currency, ph\.quantity, ph\.average_cost, \(ph\.quantity \* ph\.average_cost\) as total_value FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = (.+) ORDER BY \(ph\.quantity \* ph\.average_cost\) DESC`).
+					WithArgs(testPortfolioID).
 					WillReturnError(fmt.Errorf("database error"))
 			},
 			expectedStatus: http.StatusInternalServerError,
@@ -207,68 +228,67 @@ func TestGetPortfolioPerformance(t *testing.T) {
 		{
 			name: "successful portfolio performance",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				expectBaseCurrency(mock, testPortfolioID, "USD")
 
 				// Portfolio holdings query for performance calculation
-				mock.ExpectQuery(`SELECT ph\.id, a\.symbol, a\.name, ph\.quantity, ph\.average_cost, ph\.purchase_date, \(ph\.quantity \* ph\.average_cost\) as cost_basis FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.user_id = (.+) ORDER BY cost_basis DESC`).
-					WithArgs(testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"id", "symbol", "name", "quantity", "average_cost", "purchase_date", "cost_basis"}).
-						AddRow("1", "AAPL", "Apple Inc.", 10.0, 150.0, "2024-01-01", 1500.0).
-						AddRow("2", "GOOGL", "Alphabet Inc.", 5.0, 2800.0, "2024-01-02", 14000.0))
+				mock.ExpectQuery(`SELECT ph\.id, ph\.asset_id, a\.symbol, a\.name, COALESCE\(a\.currency, 'USD'\) as currency, ph\.quantity, ph\.average_cost, ph\.purchase_date, \(ph\.quantity \* ph\.average_cost\) as cost_basis FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = (.+) ORDER BY cost_basis DESC`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(newPerformanceHoldingRows().
+						AddRow("1", "asset-1", "AAPL", "Apple Inc.", "USD", 10.0, 150.0, "2024-01-01", 1500.0).
+						AddRow("2", "asset-2", "GOOGL", "Alphabet Inc.", "USD", 5.0, 2800.0, "2024-01-02", 14000.0))
+
+				// Holdings are weighted against their value plus cash
+				expectCashBalances(mock, testPortfolioID, newCashBalanceRows().AddRow("USD", 500.0))
+
+				// Realized P&L from past sales
+				mock.ExpectQuery(`SELECT COALESCE\(a\.currency, 'USD'\) as currency, COALESCE\(SUM\(ld\.proceeds - ld\.cost_basis\), 0\), COALESCE\(SUM\(ld\.cost_basis\), 0\) FROM lot_disposals ld JOIN tax_lots tl ON ld\.lot_id = tl\.id JOIN assets a ON tl\.asset_id = a\.id WHERE tl\.portfolio_id = \$1 GROUP BY`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"currency", "realized", "cost_basis"}).AddRow("USD", 250.0, 1000.0))
 
 				// Historical snapshots query (mocked to return empty for now)
-				mock.ExpectQuery(`SELECT snapshot_date, total_value, total_cost, unrealized_pnl FROM portfolio_snapshots WHERE user_id = (.+) AND snapshot_date >= CURRENT_DATE - INTERVAL (.+) ORDER BY snapshot_date ASC`).
-					WithArgs(testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"snapshot_date", "total_value", "total_cost", "unrealized_pnl"}))
+				mock.ExpectQuery(`SELECT snapshot_date, total_value, total_cost, unrealized_pnl, realized_pnl FROM portfolio_snapshots WHERE portfolio_id = (.+) AND snapshot_date >= CURRENT_DATE - INTERVAL (.+) ORDER BY snapshot_date ASC`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"snapshot_date", "total_value", "total_cost", "unrealized_pnl", "realized_pnl"}))
 			},
 			expectedStatus: http.StatusOK,
-			expectedBody:   []string{"performance", "total_return", "holdings_performance"},
+			expectedBody: []string{"performance", "total_return", "holdings_performance", `"realized_return":250`, `"realized_return_percent":25`,
+				`"cash_balance":500`, `"total_value":16000`},
 		},
 		{
 			name: "empty portfolio performance",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				expectBaseCurrency(mock, testPortfolioID, "USD")
 
 				// Empty portfolio holdings
-				mock.ExpectQuery(`SELECT ph\.id, a\.symbol, a\.name, ph\.quantity, ph\.average_cost, ph\.purchase_date, \(ph\.quantity \* ph\.average_cost\) as cost_basis FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.user_id = (.+) ORDER BY cost_basis DESC`).
-					WithArgs(testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"id", "symbol", "name", "quantity", "average_cost", "purchase_date", "cost_basis"}))
+				mock.ExpectQuery(`SELECT ph\.id, ph\.asset_id, a\.symbol, a\.name, COALESCE\(a\.currency, 'USD'\) as currency, ph\.quantity, ph\.average_cost, ph\.purchase_date, \(ph\.quantity \* ph\.average_cost\) as cost_basis FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = (.+) ORDER BY cost_basis DESC`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(newPerformanceHoldingRows())
+
+				expectCashBalances(mock, testPortfolioID, newCashBalanceRows())
+
+				mock.ExpectQuery(`SELECT (.+) FROM lot_disposals ld`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"currency", "realized", "cost_basis"}))
 
 				// Historical snapshots query (empty result)
-				mock.ExpectQuery(`SELECT snapshot_date, total_value, total_cost, unrealized_pnl FROM portfolio_snapshots WHERE user_id = (.+) AND snapshot_date >= CURRENT_DATE - INTERVAL (.+) ORDER BY snapshot_date ASC`).
-					WithArgs(testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"snapshot_date", "total_value", "total_cost", "unrealized_pnl"}))
+				mock.ExpectQuery(`SELECT snapshot_date, total_value, total_cost, unrealized_pnl, realized_pnl FROM portfolio_snapshots WHERE portfolio_id = (.+) AND snapshot_date >= CURRENT_DATE - INTERVAL (.+) ORDER BY snapshot_date ASC`).
+					WithArgs(testPortfolioID).
+					WillReturnRows(sqlmock.NewRows([]string{"snapshot_date", "total_value", "total_cost", "unrealized_pnl", "realized_pnl"}))
 			},
 			expectedStatus: http.StatusOK,
 			expectedBody:   []string{"performance", "total_return", "holdings_performance"},
 		},
-		{
-			name: "user not found error",
-			setupMock: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnError(sql.ErrNoRows)
-			},
-			expectedStatus: http.StatusInternalServerError,
-			expectedBody:   []string{"Failed to get user"},
-		},
 		{
 			name: "portfolio holdings query error",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+				expectBaseCurrency(mock, testPortfolioID, "USD")
 
 				// Portfolio holdings query fails
-				mock.ExpectQuery(`SELECT ph\.id, a\.symbol, a\.name, ph\.quantity, ph\.average_cost, ph\.purchase_date, \(ph\.quantity \* ph\.average_cost\) as cost_basis FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.user_id = (.+) ORDER BY cost_basis DESC`).
-					WithArgs(testUserID).
+				mock.ExpectQuery(`SELECT ph\.id, ph\.asset_id, a\.symbol, a\.name, COALESCE\(a\.currency, 'USD'\) as currency, ph\.quantity, ph\.average_cost, ph\.purchase_date, \(ph\.quantity \* ph\.average_cost\) as cost_basis FROM portfolio_holdings ph JOIN assets a ON ph\.asset_id = a\.id WHERE ph\.portfolio_id = (.+) ORDER BY cost_basis DESC`).
+					WithArgs(testPortfolioID).
 					WillReturnError(fmt.Errorf("database error"))
 			},
 			expectedStatus: http.StatusInternalServerError,
@@ -321,17 +341,16 @@ func TestGetPortfolioPerformance(t *testing.T) {
 func TestCreateSampleData(t *testing.T) {
 	tests := []struct {
 		name        string
+		userID      string
 		setupMock   func(sqlmock.Sqlmock)
 		expectedErr bool
 		dbNil       bool
 	}{
 		{
-			name: "successful sample data creation",
+			name:   "successful sample data creation",
+			userID: testUserID,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
 
 				// Begin transaction
 				mock.ExpectBegin()
@@ -342,31 +361,13 @@ func TestCreateSampleData(t *testing.T) {
 						WillReturnResult(sqlmock.NewResult(int64(i+1), 1))
 				}
 
-				// Clear existing holdings first
-				mock.ExpectExec(`DELETE FROM portfolio_holdings WHERE user_id = (.+)`).
-					WithArgs(testUserID).
-					WillReturnResult(sqlmock.NewResult(0, 0))
-
-				// Interleaved asset lookups and holdings insertions (5 holdings: AAPL, GOOGL, MSFT, TSLA, AMZN)
-				holdings := []string{"AAPL", "GOOGL", "MSFT", "TSLA", "AMZN"}
-				for i, symbol := range holdings {
-					// Asset ID lookup for this holding
-					mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = (.+)`).
-						WithArgs(symbol).
-						WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(fmt.Sprintf("asset-%d", i+1)))
-
-					// Holdings insertion for this holding
-					mock.ExpectExec(`INSERT INTO portfolio_holdings \(user_id, asset_id, quantity, average_cost\) VALUES \(.+\)`).
-						WillReturnResult(sqlmock.NewResult(int64(i+1), 1))
-				}
-
 				// Clear existing transactions
-				mock.ExpectExec(`DELETE FROM transactions WHERE user_id = (.+)`).
-					WithArgs(testUserID).
+				mock.ExpectExec(`DELETE FROM transactions WHERE portfolio_id = (.+)`).
+					WithArgs(testPortfolioID).
 					WillReturnResult(sqlmock.NewResult(0, 0))
 
-				// Interleaved asset lookups and transactions insertions (7 transactions with some symbols repeating)
-				transactions := []string{"AAPL", "AAPL", "GOOGL", "MSFT", "MSFT", "TSLA", "AMZN"}
+				// Interleaved asset lookups and transactions insertions (a cash deposit, then 7 purchases with some symbols repeating)
+				transactions := []string{"USD", "AAPL", "AAPL", "GOOGL", "MSFT", "MSFT", "TSLA", "AMZN"}
 				for i, symbol := range transactions {
 					// Asset ID lookup for this transaction
 					mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = (.+)`).
@@ -374,10 +375,25 @@ func TestCreateSampleData(t *testing.T) {
 						WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(fmt.Sprintf("asset-%d", (i%5)+1)))
 
 					// Transaction insertion for this transaction
-					mock.ExpectExec(`INSERT INTO transactions \(user_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes, transaction_date\) VALUES \(.+\)`).
+					mock.ExpectExec(`INSERT INTO transactions \(user_id, portfolio_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes, transaction_date\) VALUES \(.+\)`).
 						WillReturnResult(sqlmock.NewResult(int64(i+1), 1))
 				}
 
+				// The replaced ledger invalidates every snapshot
+				expectSnapshotInvalidation(mock, testPortfolioID, "0001-01-01")
+
+				// Holdings are rebuilt from the whole portfolio's ledger
+				expectReplay(mock, testPortfolioID, "",
+					newLedgerRows().
+						AddRow("tx-0", "asset-usd", "USD", "DEPOSIT", 40000.0, 1.0, 0.0, time.Now().AddDate(0, 0, -35), "", nil, nil, nil).
+						AddRow("tx-1", "asset-1", "AAPL", "BUY", 5.0, 170.0, 2.5, time.Now().AddDate(0, 0, -30), "", nil, nil, nil).
+						AddRow("tx-2", "asset-1", "AAPL", "BUY", 5.0, 181.0, 2.5, time.Now().AddDate(0, 0, -15), "", nil, nil, nil),
+					newStoredHoldingRows(),
+					newStoredLotRows())
+				expectLotInsert(mock, "tx-1", 5.0, 5.0)
+				expectLotInsert(mock, "tx-2", 5.0, 5.0)
+				expectHoldingUpsert(mock, "asset-1", 10.0, 175.5)
+
 				// Clear existing notifications
 				mock.ExpectExec(`DELETE FROM notifications WHERE user_id = (.+)`).
 					WithArgs(testUserID).
@@ -395,21 +411,26 @@ func TestCreateSampleData(t *testing.T) {
 			expectedErr: false,
 		},
 		{
-			name: "user not found error",
+			name:        "missing user ID",
+			userID:      "",
+			setupMock:   func(mock sqlmock.Sqlmock) {},
+			expectedErr: true,
+		},
+		{
+			name:   "no default portfolio",
+			userID: testUserID,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
+				mock.ExpectQuery(`SELECT id FROM portfolios WHERE user_id = \$1`).
+					WithArgs(testUserID).
 					WillReturnError(sql.ErrNoRows)
 			},
 			expectedErr: true,
 		},
 		{
-			name: "transaction begin failure",
+			name:   "transaction begin failure",
+			userID: testUserID,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
 
 				// Begin transaction fails
 				mock.ExpectBegin().WillReturnError(fmt.Errorf("transaction error"))
@@ -418,6 +439,7 @@ func TestCreateSampleData(t *testing.T) {
 		},
 		{
 			name:        "nil database connection",
+			userID:      testUserID,
 			setupMock:   func(mock sqlmock.Sqlmock) {},
 			dbNil:       true,
 			expectedErr: true,
@@ -435,7 +457,7 @@ func TestCreateSampleData(t *testing.T) {
 				tt.setupMock(mock)
 			}
 
-			err := handler.CreateSampleData()
+			err := handler.CreateSampleData(tt.userID)
 
 			if tt.expectedErr {
 				assert.Error(t, err)
@@ -7,21 +7,23 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 
+	"github.com/portfolio-management/api-gateway/internal/middleware"
 	"github.com/portfolio-management/api-gateway/internal/services"
 )
 
 // Test data constants for consistent testing
 var (
-	testUserID    = "test-user-123"
-	testAssetID   = "test-asset-456"
-	testHoldingID = "test-holding-789"
-	defaultUser   = "default_user"
+	testUserID      = "test-user-123"
+	testPortfolioID = "3d6f0a52-9c1e-4b7a-8f2d-5e4c3b2a1f09"
+	testAssetID     = "test-asset-456"
+	testHoldingID   = "test-holding-789"
 )
 
 // Helper function to create a test handler with mock database
@@ -33,9 +35,9 @@ func createTestHandler(t *testing.T) (*Handler, sqlmock.Sqlmock, func()) {
 	assert.NoError(t, err)
 
 	mockServices := &services.Services{
-		DB:      db,
-		Finnhub: nil, // We'll set this when needed in specific tests
-		Logger:  logger,
+		DB:         db,
+		MarketData: nil, // We'll set this when needed in specific tests
+		Logger:     logger,
 	}
 
 	handler := NewHandler(mockServices, logger)
@@ -47,9 +49,25 @@ func createTestHandler(t *testing.T) (*Handler, sqlmock.Sqlmock, func()) {
 	return handler, mock, cleanup
 }
 
-// Helper function to create test router with handler
+// Helper middleware that authenticates every request as the given user
+func withTestUser(userID string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(middleware.UserIDKey, userID)
+		c.Next()
+	}
+}
+
+// Helper function to expect the lookup of a user's default portfolio
+func expectDefaultPortfolio(mock sqlmock.Sqlmock, userID, portfolioID string) {
+	mock.ExpectQuery(`SELECT id FROM portfolios WHERE user_id = \$1`).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(portfolioID))
+}
+
+// Helper function to create test router with handler, authenticated as testUserID
 func createTestRouter(handler *Handler, method, path string, handlerFunc gin.HandlerFunc) *gin.Engine {
 	router := gin.New()
+	router.Use(withTestUser(testUserID))
 	switch method {
 	case "GET":
 		router.GET(path, handlerFunc)
@@ -75,12 +93,14 @@ func TestGetPortfolio(t *testing.T) {
 		{
 			name: "successful portfolio fetch",
 			setupMock: func(mock sqlmock.Sqlmock) {
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+
 				rows := sqlmock.NewRows([]string{"id", "symbol", "name", "asset_type", "quantity", "average_cost", "purchase_date"}).
 					AddRow("1", "AAPL", "Apple Inc.", "STOCK", 10.0, 150.0, "2024-01-01").
 					AddRow("2", "GOOGL", "Alphabet Inc.", "STOCK", 5.0, 2800.0, "2024-01-02")
 
-				mock.ExpectQuery(`SELECT (.+) FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id JOIN users u ON ph.user_id = u.id WHERE u.username = (.+) ORDER BY ph.created_at DESC`).
-					WithArgs(defaultUser).
+				mock.ExpectQuery(`SELECT (.+) FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = (.+) ORDER BY ph.created_at DESC`).
+					WithArgs(testPortfolioID).
 					WillReturnRows(rows)
 			},
 			expectedStatus: http.StatusOK,
@@ -89,9 +109,11 @@ func TestGetPortfolio(t *testing.T) {
 		{
 			name: "empty portfolio",
 			setupMock: func(mock sqlmock.Sqlmock) {
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+
 				rows := sqlmock.NewRows([]string{"id", "symbol", "name", "asset_type", "quantity", "average_cost", "purchase_date"})
-				mock.ExpectQuery(`SELECT (.+) FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id JOIN users u ON ph.user_id = u.id WHERE u.username = (.+) ORDER BY ph.created_at DESC`).
-					WithArgs(defaultUser).
+				mock.ExpectQuery(`SELECT (.+) FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = (.+) ORDER BY ph.created_at DESC`).
+					WithArgs(testPortfolioID).
 					WillReturnRows(rows)
 			},
 			expectedStatus: http.StatusOK,
@@ -100,8 +122,10 @@ func TestGetPortfolio(t *testing.T) {
 		{
 			name: "database query error",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery(`SELECT (.+) FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id JOIN users u ON ph.user_id = u.id WHERE u.username = (.+) ORDER BY ph.created_at DESC`).
-					WithArgs(defaultUser).
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+
+				mock.ExpectQuery(`SELECT (.+) FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = (.+) ORDER BY ph.created_at DESC`).
+					WithArgs(testPortfolioID).
 					WillReturnError(fmt.Errorf("database error"))
 			},
 			expectedStatus: http.StatusInternalServerError,
@@ -160,20 +184,24 @@ func TestAddHolding(t *testing.T) {
 			name:        "successful holding addition with existing asset",
 			requestBody: `{"symbol": "AAPL", "quantity": 10.0, "average_cost": 150.0}`,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
 
 				// Asset lookup (exists)
 				mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = (.+)`).
 					WithArgs("AAPL").
 					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testAssetID))
 
-				// Insert/update holding with cost averaging
-				mock.ExpectExec(`INSERT INTO portfolio_holdings \(user_id, asset_id, quantity, average_cost\) VALUES \(.+\) ON CONFLICT \(user_id, asset_id\) DO UPDATE SET (.+)`).
-					WithArgs(testUserID, testAssetID, 10.0, 150.0).
-					WillReturnResult(sqlmock.NewResult(1, 1))
+				// The holding is recorded as a funded purchase and rebuilt from the ledger
+				mock.ExpectBegin()
+				expectFundingDeposit(mock, testUserID, testPortfolioID, testAssetID, 1500.0)
+				expectLedgerEntry(mock, testUserID, testPortfolioID, testAssetID, "BUY", 10.0, 150.0, "Added from holdings")
+				expectReplay(mock, testPortfolioID, testAssetID,
+					newLedgerRows().AddRow("tx-1", testAssetID, "AAPL", "BUY", 10.0, 150.0, 0.0, time.Now(), "", nil, nil, nil),
+					newStoredHoldingRows(),
+					newStoredLotRows())
+				expectLotInsert(mock, "tx-1", 10.0, 10.0)
+				expectHoldingUpsert(mock, testAssetID, 10.0, 150.0)
+				mock.ExpectCommit()
 			},
 			expectedStatus: http.StatusCreated,
 			expectedBody:   []string{"Holding added successfully", "AAPL", "10", "150"},
@@ -182,25 +210,29 @@ func TestAddHolding(t *testing.T) {
 			name:        "successful holding addition with new asset creation",
 			requestBody: `{"symbol": "TSLA", "quantity": 5.0, "average_cost": 200.0}`,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
 
 				// Asset lookup (doesn't exist)
 				mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = (.+)`).
 					WithArgs("TSLA").
 					WillReturnError(sql.ErrNoRows)
 
-				// Create new asset (2 parameters: symbol and name, asset_type and currency are hardcoded)
+				// Create new asset; without market data it's named by its symbol and trades in USD
 				mock.ExpectQuery(`INSERT INTO assets \(symbol, name, asset_type, currency\) VALUES \(.+\) RETURNING id`).
-					WithArgs("TSLA", "TSLA").
+					WithArgs("TSLA", "TSLA", "USD").
 					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testAssetID))
 
-				// Insert holding
-				mock.ExpectExec(`INSERT INTO portfolio_holdings \(user_id, asset_id, quantity, average_cost\) VALUES \(.+\) ON CONFLICT \(user_id, asset_id\) DO UPDATE SET (.+)`).
-					WithArgs(testUserID, testAssetID, 5.0, 200.0).
-					WillReturnResult(sqlmock.NewResult(1, 1))
+				// The holding is recorded as a funded purchase and rebuilt from the ledger
+				mock.ExpectBegin()
+				expectFundingDeposit(mock, testUserID, testPortfolioID, testAssetID, 1000.0)
+				expectLedgerEntry(mock, testUserID, testPortfolioID, testAssetID, "BUY", 5.0, 200.0, "Added from holdings")
+				expectReplay(mock, testPortfolioID, testAssetID,
+					newLedgerRows().AddRow("tx-1", testAssetID, "TSLA", "BUY", 5.0, 200.0, 0.0, time.Now(), "", nil, nil, nil),
+					newStoredHoldingRows(),
+					newStoredLotRows())
+				expectLotInsert(mock, "tx-1", 5.0, 5.0)
+				expectHoldingUpsert(mock, testAssetID, 5.0, 200.0)
+				mock.ExpectCommit()
 			},
 			expectedStatus: http.StatusCreated,
 			expectedBody:   []string{"Holding added successfully", "TSLA", "5", "200"},
@@ -220,33 +252,36 @@ func TestAddHolding(t *testing.T) {
 			expectedBody:   []string{"Field validation", "required"},
 		},
 		{
-			name:        "user not found error",
-			requestBody: `{"symbol": "AAPL", "quantity": 10.0, "average_cost": 150.0}`,
+			name:        "asset creation failure",
+			requestBody: `{"symbol": "INVALID", "quantity": 10.0, "average_cost": 150.0}`,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+
+				// Asset lookup (doesn't exist)
+				mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = (.+)`).
+					WithArgs("INVALID").
 					WillReturnError(sql.ErrNoRows)
+
+				// Asset creation fails
+				mock.ExpectQuery(`INSERT INTO assets \(symbol, name, asset_type, currency\) VALUES \(.+\) RETURNING id`).
+					WithArgs("INVALID", "INVALID", "USD").
+					WillReturnError(fmt.Errorf("database error"))
 			},
 			expectedStatus: http.StatusInternalServerError,
-			expectedBody:   []string{"Failed to get user"},
+			expectedBody:   []string{"Failed to create asset"},
 		},
 		{
-			name:        "asset creation failure",
-			requestBody: `{"symbol": "INVALID", "quantity": 10.0, "average_cost": 150.0}`,
+			name:        "new asset in the requested currency",
+			requestBody: `{"symbol": "SAP", "quantity": 10.0, "average_cost": 120.0, "currency": "eur"}`,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
 
-				// Asset lookup (doesn't exist)
 				mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = (.+)`).
-					WithArgs("INVALID").
+					WithArgs("SAP").
 					WillReturnError(sql.ErrNoRows)
 
-				// Asset creation fails
 				mock.ExpectQuery(`INSERT INTO assets \(symbol, name, asset_type, currency\) VALUES \(.+\) RETURNING id`).
-					WithArgs("INVALID", "INVALID").
+					WithArgs("SAP", "SAP", "EUR").
 					WillReturnError(fmt.Errorf("database error"))
 			},
 			expectedStatus: http.StatusInternalServerError,
@@ -256,20 +291,20 @@ func TestAddHolding(t *testing.T) {
 			name:        "holding insertion failure",
 			requestBody: `{"symbol": "AAPL", "quantity": 10.0, "average_cost": 150.0}`,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+				expectDefaultPortfolio(mock, testUserID, testPortfolioID)
 
 				// Asset lookup (exists)
 				mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = (.+)`).
 					WithArgs("AAPL").
 					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testAssetID))
 
-				// Insert holding fails
-				mock.ExpectExec(`INSERT INTO portfolio_holdings \(user_id, asset_id, quantity, average_cost\) VALUES \(.+\) ON CONFLICT \(user_id, asset_id\) DO UPDATE SET (.+)`).
-					WithArgs(testUserID, testAssetID, 10.0, 150.0).
+				// Recording the purchase fails
+				mock.ExpectBegin()
+				expectFundingDeposit(mock, testUserID, testPortfolioID, testAssetID, 1500.0)
+				mock.ExpectExec(`INSERT INTO transactions`).
+					WithArgs(testUserID, testPortfolioID, testAssetID, "BUY", 10.0, 150.0, 1500.0, "Added from holdings").
 					WillReturnError(fmt.Errorf("database error"))
+				mock.ExpectRollback()
 			},
 			expectedStatus: http.StatusInternalServerError,
 			expectedBody:   []string{"Failed to add holding"},
@@ -331,20 +366,24 @@ func TestUpdateHolding(t *testing.T) {
 			holdingID:   testHoldingID,
 			requestBody: `{"quantity": 15.0}`,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
-
 				// Check holding exists and get current values
-				mock.ExpectQuery(`SELECT ph.quantity, ph.average_cost, a.symbol FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
+				mock.ExpectQuery(`SELECT ph.quantity, ph.average_cost, a.symbol, ph.portfolio_id, ph.asset_id FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
 					WithArgs(testHoldingID, testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"quantity", "average_cost", "symbol"}).AddRow(10.0, 150.0, "AAPL"))
-
-				// Update holding
-				mock.ExpectExec(`UPDATE portfolio_holdings SET quantity = (.+), average_cost = (.+), updated_at = NOW\(\) WHERE id = (.+) AND user_id = (.+)`).
-					WithArgs(15.0, 150.0, testHoldingID, testUserID).
-					WillReturnResult(sqlmock.NewResult(1, 1))
+					WillReturnRows(sqlmock.NewRows([]string{"quantity", "average_cost", "symbol", "portfolio_id", "asset_id"}).AddRow(10.0, 150.0, "AAPL", testPortfolioID, testAssetID))
+
+				// The edit is recorded as an adjustment and rebuilt from the ledger
+				mock.ExpectBegin()
+				expectLedgerEntry(mock, testUserID, testPortfolioID, testAssetID, "ADJUST", 15.0, 150.0, "Holding updated")
+				expectReplay(mock, testPortfolioID, testAssetID,
+					newLedgerRows().
+						AddRow("tx-1", testAssetID, "AAPL", "BUY", 10.0, 150.0, 0.0, time.Now().AddDate(0, -1, 0), "", nil, nil, nil).
+						AddRow("tx-2", testAssetID, "AAPL", "ADJUST", 15.0, 150.0, 0.0, time.Now(), "", nil, nil, nil),
+					newStoredHoldingRows().AddRow(testAssetID, "AAPL", 10.0, 150.0),
+					newStoredLotRows().AddRow("lot-1", "tx-1"))
+				expectLotInsert(mock, "tx-1", 10.0, 0.0)
+				expectLotInsert(mock, "tx-2", 15.0, 15.0)
+				expectHoldingUpsert(mock, testAssetID, 15.0, 150.0)
+				mock.ExpectCommit()
 			},
 			expectedStatus: http.StatusOK,
 			expectedBody:   []string{"Holding updated successfully", "AAPL", "15"},
@@ -354,20 +393,24 @@ func TestUpdateHolding(t *testing.T) {
 			holdingID:   testHoldingID,
 			requestBody: `{"average_cost": 175.0}`,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
-
 				// Check holding exists and get current values
-				mock.ExpectQuery(`SELECT ph.quantity, ph.average_cost, a.symbol FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
+				mock.ExpectQuery(`SELECT ph.quantity, ph.average_cost, a.symbol, ph.portfolio_id, ph.asset_id FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
 					WithArgs(testHoldingID, testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"quantity", "average_cost", "symbol"}).AddRow(10.0, 150.0, "AAPL"))
-
-				// Update holding
-				mock.ExpectExec(`UPDATE portfolio_holdings SET quantity = (.+), average_cost = (.+), updated_at = NOW\(\) WHERE id = (.+) AND user_id = (.+)`).
-					WithArgs(10.0, 175.0, testHoldingID, testUserID).
-					WillReturnResult(sqlmock.NewResult(1, 1))
+					WillReturnRows(sqlmock.NewRows([]string{"quantity", "average_cost", "symbol", "portfolio_id", "asset_id"}).AddRow(10.0, 150.0, "AAPL", testPortfolioID, testAssetID))
+
+				// The edit is recorded as an adjustment and rebuilt from the ledger
+				mock.ExpectBegin()
+				expectLedgerEntry(mock, testUserID, testPortfolioID, testAssetID, "ADJUST", 10.0, 175.0, "Holding updated")
+				expectReplay(mock, testPortfolioID, testAssetID,
+					newLedgerRows().
+						AddRow("tx-1", testAssetID, "AAPL", "BUY", 10.0, 150.0, 0.0, time.Now().AddDate(0, -1, 0), "", nil, nil, nil).
+						AddRow("tx-2", testAssetID, "AAPL", "ADJUST", 10.0, 175.0, 0.0, time.Now(), "", nil, nil, nil),
+					newStoredHoldingRows().AddRow(testAssetID, "AAPL", 10.0, 150.0),
+					newStoredLotRows().AddRow("lot-1", "tx-1"))
+				expectLotInsert(mock, "tx-1", 10.0, 0.0)
+				expectLotInsert(mock, "tx-2", 10.0, 10.0)
+				expectHoldingUpsert(mock, testAssetID, 10.0, 175.0)
+				mock.ExpectCommit()
 			},
 			expectedStatus: http.StatusOK,
 			expectedBody:   []string{"Holding updated successfully", "AAPL", "175"},
@@ -377,20 +420,24 @@ func TestUpdateHolding(t *testing.T) {
 			holdingID:   testHoldingID,
 			requestBody: `{"quantity": 20.0, "average_cost": 160.0}`,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
-
 				// Check holding exists and get current values
-				mock.ExpectQuery(`SELECT ph.quantity, ph.average_cost, a.symbol FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
+				mock.ExpectQuery(`SELECT ph.quantity, ph.average_cost, a.symbol, ph.portfolio_id, ph.asset_id FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
 					WithArgs(testHoldingID, testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"quantity", "average_cost", "symbol"}).AddRow(10.0, 150.0, "AAPL"))
-
-				// Update holding
-				mock.ExpectExec(`UPDATE portfolio_holdings SET quantity = (.+), average_cost = (.+), updated_at = NOW\(\) WHERE id = (.+) AND user_id = (.+)`).
-					WithArgs(20.0, 160.0, testHoldingID, testUserID).
-					WillReturnResult(sqlmock.NewResult(1, 1))
+					WillReturnRows(sqlmock.NewRows([]string{"quantity", "average_cost", "symbol", "portfolio_id", "asset_id"}).AddRow(10.0, 150.0, "AAPL", testPortfolioID, testAssetID))
+
+				// The edit is recorded as an adjustment and rebuilt from the ledger
+				mock.ExpectBegin()
+				expectLedgerEntry(mock, testUserID, testPortfolioID, testAssetID, "ADJUST", 20.0, 160.0, "Holding updated")
+				expectReplay(mock, testPortfolioID, testAssetID,
+					newLedgerRows().
+						AddRow("tx-1", testAssetID, "AAPL", "BUY", 10.0, 150.0, 0.0, time.Now().AddDate(0, -1, 0), "", nil, nil, nil).
+						AddRow("tx-2", testAssetID, "AAPL", "ADJUST", 20.0, 160.0, 0.0, time.Now(), "", nil, nil, nil),
+					newStoredHoldingRows().AddRow(testAssetID, "AAPL", 10.0, 150.0),
+					newStoredLotRows().AddRow("lot-1", "tx-1"))
+				expectLotInsert(mock, "tx-1", 10.0, 0.0)
+				expectLotInsert(mock, "tx-2", 20.0, 20.0)
+				expectHoldingUpsert(mock, testAssetID, 20.0, 160.0)
+				mock.ExpectCommit()
 			},
 			expectedStatus: http.StatusOK,
 			expectedBody:   []string{"Holding updated successfully", "AAPL", "20", "160"},
@@ -424,13 +471,8 @@ func TestUpdateHolding(t *testing.T) {
 			holdingID:   "non-existent-id",
 			requestBody: `{"quantity": 15.0}`,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
-
 				// Check holding exists (not found)
-				mock.ExpectQuery(`SELECT ph.quantity, ph.average_cost, a.symbol FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
+				mock.ExpectQuery(`SELECT ph.quantity, ph.average_cost, a.symbol, ph.portfolio_id, ph.asset_id FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
 					WithArgs("non-existent-id", testUserID).
 					WillReturnError(sql.ErrNoRows)
 			},
@@ -442,13 +484,8 @@ func TestUpdateHolding(t *testing.T) {
 			holdingID:   testHoldingID,
 			requestBody: `{"quantity": 15.0}`,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
-
 				// Check holding exists but belongs to different user
-				mock.ExpectQuery(`SELECT ph.quantity, ph.average_cost, a.symbol FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
+				mock.ExpectQuery(`SELECT ph.quantity, ph.average_cost, a.symbol, ph.portfolio_id, ph.asset_id FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
 					WithArgs(testHoldingID, testUserID).
 					WillReturnError(sql.ErrNoRows)
 			},
@@ -460,20 +497,17 @@ func TestUpdateHolding(t *testing.T) {
 			holdingID:   testHoldingID,
 			requestBody: `{"quantity": 15.0}`,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// User ID lookup
-				mock.ExpectQuery(`SELECT id FROM users WHERE username = (.+)`).
-					WithArgs(defaultUser).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
-
 				// Check holding exists and get current values
-				mock.ExpectQuery(`SELECT ph.quantity, ph.average_cost, a.symbol FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
+				mock.ExpectQuery(`SELECT ph.quantity, ph.average_cost, a.symbol, ph.portfolio_id, ph.asset_id FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.id = (.+) AND ph.user_id = (.+)`).
 					WithArgs(testHoldingID, testUserID).
-					WillReturnRows(sqlmock.NewRows([]string{"quantity", "average_cost", "symbol"}).AddRow(10.0, 150.0, "AAPL"))
+					WillReturnRows(sqlmock.NewRows([]string{"quantity", "average_cost", "symbol", "portfolio_id", "asset_id"}).AddRow(10.0, 150.0, "AAPL", testPortfolioID, testAssetID))
 
-				// Update fails
-				mock.ExpectExec(`UPDATE portfolio_holdings SET quantity = (.+), average_cost = (.+), updated_at = NOW\(\) WHERE id = (.+) AND user_id = (.+)`).
-					WithArgs(15.0, 150.0, testHoldingID, testUserID).
+				// Recording the adjustment fails
+				mock.ExpectBegin()
+				mock.ExpectExec(`INSERT INTO transactions`).
+					WithArgs(testUserID, testPortfolioID, testAssetID, "ADJUST", 15.0, 150.0, 2250.0, "Holding updated").
 					WillReturnError(fmt.Errorf("database error"))
+				mock.ExpectRollback()
 			},
 			expectedStatus: http.StatusInternalServerError,
 			expectedBody:   []string{"Failed to update holding"},
@@ -501,6 +535,7 @@ func TestUpdateHolding(t *testing.T) {
 			}
 
 			router := gin.New()
+			router.Use(withTestUser(testUserID))
 			router.PUT("/portfolio/holdings/:id", handler.UpdateHolding)
 
 			url := "/portfolio/holdings/" + tt.holdingID
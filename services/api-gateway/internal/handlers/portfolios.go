@@ -0,0 +1,524 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// Portfolio management handlers
+func (h *Handler) GetPortfolios(c *gin.Context) {
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch portfolios"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	query := `
+		SELECT
+			p.id,
+			p.name,
+			p.base_currency,
+			COALESCE(p.description, '') as description,
+			p.is_default,
+			p.cost_basis_method,
+			p.enforce_cash_balance,
+			COUNT(ph.id) as holdings_count,
+			p.created_at,
+			p.updated_at
+		FROM portfolios p
+		LEFT JOIN portfolio_holdings ph ON ph.portfolio_id = p.id
+		WHERE p.user_id = $1
+		GROUP BY p.id
+		ORDER BY p.is_default DESC, p.created_at ASC
+	`
+
+	rows, err := h.services.DB.Query(query, userID)
+	if err != nil {
+		h.logger.Error("Failed to query portfolios", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch portfolios"})
+		return
+	}
+	defer rows.Close()
+
+	var portfolios []map[string]interface{}
+	for rows.Next() {
+		var id, name, baseCurrency, description, costBasisMethod, createdAt, updatedAt string
+		var isDefault, enforceCashBalance bool
+		var holdingsCount int
+
+		err := rows.Scan(&id, &name, &baseCurrency, &description, &isDefault, &costBasisMethod, &enforceCashBalance, &holdingsCount, &createdAt, &updatedAt)
+		if err != nil {
+			h.logger.Error("Failed to scan portfolio row", zap.Error(err))
+			continue
+		}
+
+		portfolios = append(portfolios, map[string]interface{}{
+			"id":                   id,
+			"name":                 name,
+			"base_currency":        baseCurrency,
+			"description":          description,
+			"is_default":           isDefault,
+			"cost_basis_method":    costBasisMethod,
+			"enforce_cash_balance": enforceCashBalance,
+			"holdings_count":       holdingsCount,
+			"created_at":           createdAt,
+			"updated_at":           updatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"portfolios": portfolios,
+		"total":      len(portfolios),
+	})
+}
+
+func (h *Handler) CreatePortfolio(c *gin.Context) {
+	var request struct {
+		Name         string `json:"name" binding:"required,max=255"`
+		BaseCurrency string `json:"base_currency" binding:"omitempty,len=3"`
+		Description  string `json:"description"`
+		IsDefault    bool   `json:"is_default"`
+		// CostBasisMethod selects which tax lots a SELL consumes; defaults to FIFO
+		CostBasisMethod string `json:"cost_basis_method" binding:"omitempty,oneof=FIFO LIFO HIFO SPECIFIC"`
+		// EnforceCashBalance rejects buys the portfolio's cash can't cover
+		EnforceCashBalance bool `json:"enforce_cash_balance"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create portfolio"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	baseCurrency := strings.ToUpper(request.BaseCurrency)
+	if baseCurrency == "" {
+		baseCurrency = "USD"
+	}
+	costBasisMethod := request.CostBasisMethod
+	if costBasisMethod == "" {
+		costBasisMethod = costBasisFIFO
+	}
+
+	tx, err := h.services.DB.Begin()
+	if err != nil {
+		h.logger.Error("Failed to begin transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create portfolio"})
+		return
+	}
+	defer tx.Rollback()
+
+	// The first portfolio a user creates is always the default
+	var existingCount int
+	err = tx.QueryRow("SELECT COUNT(*) FROM portfolios WHERE user_id = $1", userID).Scan(&existingCount)
+	if err != nil {
+		h.logger.Error("Failed to count portfolios", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create portfolio"})
+		return
+	}
+	isDefault := request.IsDefault || existingCount == 0
+
+	if isDefault {
+		_, err = tx.Exec("UPDATE portfolios SET is_default = false, updated_at = NOW() WHERE user_id = $1 AND is_default", userID)
+		if err != nil {
+			h.logger.Error("Failed to clear default portfolio", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create portfolio"})
+			return
+		}
+	}
+
+	var portfolioID string
+	err = tx.QueryRow(`
+		INSERT INTO portfolios (user_id, name, base_currency, description, is_default, cost_basis_method, enforce_cash_balance)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, userID, request.Name, baseCurrency, request.Description, isDefault, costBasisMethod, request.EnforceCashBalance).Scan(&portfolioID)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "A portfolio with this name already exists"})
+			return
+		}
+		h.logger.Error("Failed to insert portfolio", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create portfolio"})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		h.logger.Error("Failed to commit transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create portfolio"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":              "Portfolio created successfully",
+		"id":                   portfolioID,
+		"name":                 request.Name,
+		"base_currency":        baseCurrency,
+		"description":          request.Description,
+		"is_default":           isDefault,
+		"cost_basis_method":    costBasisMethod,
+		"enforce_cash_balance": request.EnforceCashBalance,
+	})
+}
+
+func (h *Handler) GetPortfolioByID(c *gin.Context) {
+	portfolioID, ok := portfolioIDParam(c)
+	if !ok {
+		return
+	}
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch portfolio"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	query := `
+		SELECT
+			p.id,
+			p.name,
+			p.base_currency,
+			COALESCE(p.description, '') as description,
+			p.is_default,
+			p.cost_basis_method,
+			p.enforce_cash_balance,
+			(SELECT COUNT(*) FROM portfolio_holdings ph WHERE ph.portfolio_id = p.id) as holdings_count,
+			(SELECT COALESCE(SUM(ph.quantity * ph.average_cost), 0) FROM portfolio_holdings ph WHERE ph.portfolio_id = p.id) as total_cost,
+			p.created_at,
+			p.updated_at
+		FROM portfolios p
+		WHERE p.id = $1 AND p.user_id = $2
+	`
+
+	var id, name, baseCurrency, description, costBasisMethod, createdAt, updatedAt string
+	var isDefault, enforceCashBalance bool
+	var holdingsCount int
+	var totalCost float64
+	err := h.services.DB.QueryRow(query, portfolioID, userID).Scan(
+		&id, &name, &baseCurrency, &description, &isDefault, &costBasisMethod, &enforceCashBalance,
+		&holdingsCount, &totalCost, &createdAt, &updatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Portfolio not found"})
+			return
+		}
+		h.logger.Error("Failed to query portfolio", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch portfolio"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":                   id,
+		"name":                 name,
+		"base_currency":        baseCurrency,
+		"description":          description,
+		"is_default":           isDefault,
+		"cost_basis_method":    costBasisMethod,
+		"enforce_cash_balance": enforceCashBalance,
+		"holdings_count":       holdingsCount,
+		"total_cost":           totalCost,
+		"created_at":           createdAt,
+		"updated_at":           updatedAt,
+	})
+}
+
+func (h *Handler) UpdatePortfolio(c *gin.Context) {
+	portfolioID, ok := portfolioIDParam(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Name               *string `json:"name" binding:"omitempty,min=1,max=255"`
+		BaseCurrency       *string `json:"base_currency" binding:"omitempty,len=3"`
+		Description        *string `json:"description"`
+		IsDefault          *bool   `json:"is_default"`
+		CostBasisMethod    *string `json:"cost_basis_method" binding:"omitempty,oneof=FIFO LIFO HIFO SPECIFIC"`
+		EnforceCashBalance *bool   `json:"enforce_cash_balance"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check if at least one field is provided for update
+	if request.Name == nil && request.BaseCurrency == nil && request.Description == nil &&
+		request.IsDefault == nil && request.CostBasisMethod == nil && request.EnforceCashBalance == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one field must be provided for update"})
+		return
+	}
+
+	if request.IsDefault != nil && !*request.IsDefault {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Set another portfolio as default instead of unsetting this one"})
+		return
+	}
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update portfolio"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Check if portfolio exists and belongs to user
+	var name, baseCurrency, description, costBasisMethod string
+	var isDefault, enforceCashBalance bool
+	err := h.services.DB.QueryRow(`
+		SELECT name, base_currency, COALESCE(description, ''), is_default, cost_basis_method, enforce_cash_balance
+		FROM portfolios
+		WHERE id = $1 AND user_id = $2
+	`, portfolioID, userID).Scan(&name, &baseCurrency, &description, &isDefault, &costBasisMethod, &enforceCashBalance)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Portfolio not found"})
+			return
+		}
+		h.logger.Error("Failed to find portfolio", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update portfolio"})
+		return
+	}
+
+	// Prepare update values
+	if request.Name != nil {
+		name = *request.Name
+	}
+	currencyChanged := false
+	if request.BaseCurrency != nil {
+		currencyChanged = strings.ToUpper(*request.BaseCurrency) != baseCurrency
+		baseCurrency = strings.ToUpper(*request.BaseCurrency)
+	}
+	if request.Description != nil {
+		description = *request.Description
+	}
+	if request.CostBasisMethod != nil {
+		costBasisMethod = *request.CostBasisMethod
+	}
+	if request.EnforceCashBalance != nil {
+		enforceCashBalance = *request.EnforceCashBalance
+	}
+	makeDefault := request.IsDefault != nil && *request.IsDefault && !isDefault
+
+	tx, err := h.services.DB.Begin()
+	if err != nil {
+		h.logger.Error("Failed to begin transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update portfolio"})
+		return
+	}
+	defer tx.Rollback()
+
+	if makeDefault {
+		_, err = tx.Exec("UPDATE portfolios SET is_default = false, updated_at = NOW() WHERE user_id = $1 AND is_default", userID)
+		if err != nil {
+			h.logger.Error("Failed to clear default portfolio", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update portfolio"})
+			return
+		}
+		isDefault = true
+	}
+
+	_, err = tx.Exec(`
+		UPDATE portfolios
+		SET name = $1, base_currency = $2, description = $3, is_default = $4, cost_basis_method = $5,
+			enforce_cash_balance = $6, updated_at = NOW()
+		WHERE id = $7 AND user_id = $8
+	`, name, baseCurrency, description, isDefault, costBasisMethod, enforceCashBalance, portfolioID, userID)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "A portfolio with this name already exists"})
+			return
+		}
+		h.logger.Error("Failed to update portfolio", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update portfolio"})
+		return
+	}
+
+	// Snapshots are valued in the base currency, so a new one values the whole history again
+	if currencyChanged {
+		if err = h.invalidateSnapshots(tx, portfolioID, time.Time{}); err != nil {
+			h.logger.Error("Failed to update portfolio", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update portfolio"})
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		h.logger.Error("Failed to commit transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update portfolio"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":              "Portfolio updated successfully",
+		"id":                   portfolioID,
+		"name":                 name,
+		"base_currency":        baseCurrency,
+		"description":          description,
+		"is_default":           isDefault,
+		"cost_basis_method":    costBasisMethod,
+		"enforce_cash_balance": enforceCashBalance,
+	})
+}
+
+func (h *Handler) DeletePortfolio(c *gin.Context) {
+	portfolioID, ok := portfolioIDParam(c)
+	if !ok {
+		return
+	}
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete portfolio"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Check if portfolio exists and belongs to user
+	var name string
+	var isDefault bool
+	err := h.services.DB.QueryRow(`
+		SELECT name, is_default FROM portfolios
+		WHERE id = $1 AND user_id = $2
+	`, portfolioID, userID).Scan(&name, &isDefault)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Portfolio not found"})
+			return
+		}
+		h.logger.Error("Failed to find portfolio", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete portfolio"})
+		return
+	}
+
+	if isDefault {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot delete the default portfolio; set another portfolio as default first"})
+		return
+	}
+
+	// Holdings, transactions and snapshots are removed by ON DELETE CASCADE
+	_, err = h.services.DB.Exec(`
+		DELETE FROM portfolios
+		WHERE id = $1 AND user_id = $2
+	`, portfolioID, userID)
+	if err != nil {
+		h.logger.Error("Failed to delete portfolio", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete portfolio"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Portfolio deleted successfully",
+		"id":      portfolioID,
+		"name":    name,
+	})
+}
+
+// Helper function to read a portfolio ID from the path. Responds with 400 and returns false when it isn't a UUID.
+func portfolioIDParam(c *gin.Context) (string, bool) {
+	portfolioID := c.Param("id")
+	if _, err := uuid.Parse(portfolioID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid portfolio ID, expected a UUID"})
+		return "", false
+	}
+	return portfolioID, true
+}
+
+// Helper function to resolve which of the user's portfolios a request targets.
+// An explicit ID (from the body or the portfolio_id query parameter) must belong to the user;
+// otherwise the user's default portfolio is used. Responds with 400/404/500 and returns false on failure.
+func (h *Handler) resolvePortfolioID(c *gin.Context, userID, requestedID string) (string, bool) {
+	if requestedID == "" {
+		requestedID = c.Query("portfolio_id")
+	}
+	if requestedID != "" {
+		if _, err := uuid.Parse(requestedID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid portfolio_id, expected a UUID"})
+			return "", false
+		}
+	}
+
+	var portfolioID string
+	var err error
+	if requestedID != "" {
+		err = h.services.DB.QueryRow(`
+			SELECT id FROM portfolios WHERE id = $1 AND user_id = $2
+		`, requestedID, userID).Scan(&portfolioID)
+	} else {
+		err = h.services.DB.QueryRow(`
+			SELECT id FROM portfolios WHERE user_id = $1
+			ORDER BY is_default DESC, created_at ASC
+			LIMIT 1
+		`, userID).Scan(&portfolioID)
+	}
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Portfolio not found"})
+			return "", false
+		}
+		h.logger.Error("Failed to resolve portfolio", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve portfolio"})
+		return "", false
+	}
+
+	return portfolioID, true
+}
+
+// Helper function to get a user's default portfolio ID outside of a request
+func (h *Handler) getDefaultPortfolioID(userID string) (string, error) {
+	var portfolioID string
+	err := h.services.DB.QueryRow(`
+		SELECT id FROM portfolios WHERE user_id = $1
+		ORDER BY is_default DESC, created_at ASC
+		LIMIT 1
+	`, userID).Scan(&portfolioID)
+	if err != nil {
+		return "", fmt.Errorf("failed to find default portfolio: %w", err)
+	}
+	return portfolioID, nil
+}
@@ -0,0 +1,419 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGetPortfolios tests the GetPortfolios handler
+func TestGetPortfolios(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	rows := sqlmock.NewRows([]string{"id", "name", "base_currency", "description", "is_default", "cost_basis_method", "enforce_cash_balance", "holdings_count", "created_at", "updated_at"}).
+		AddRow(testPortfolioID, "Default", "USD", "", true, "FIFO", false, 3, "2024-01-01", "2024-01-01").
+		AddRow("portfolio-2", "Retirement", "EUR", "Long term", false, "HIFO", true, 0, "2024-02-01", "2024-02-01")
+
+	mock.ExpectQuery(`SELECT (.+) FROM portfolios p LEFT JOIN portfolio_holdings ph ON ph.portfolio_id = p.id WHERE p.user_id = \$1`).
+		WithArgs(testUserID).
+		WillReturnRows(rows)
+
+	router := createTestRouter(handler, "GET", "/portfolios", handler.GetPortfolios)
+
+	req, _ := http.NewRequest("GET", "/portfolios", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Default")
+	assert.Contains(t, w.Body.String(), "Retirement")
+	assert.Contains(t, w.Body.String(), "HIFO")
+	assert.Contains(t, w.Body.String(), `"enforce_cash_balance":true`)
+	assert.Contains(t, w.Body.String(), `"total":2`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestCreatePortfolio tests the CreatePortfolio handler
+func TestCreatePortfolio(t *testing.T) {
+	tests := []struct {
+		name           string
+		requestBody    string
+		setupMock      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedBody   []string
+	}{
+		{
+			name:        "additional portfolio",
+			requestBody: `{"name": "Retirement", "base_currency": "eur", "cost_basis_method": "HIFO", "enforce_cash_balance": true}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT COUNT\(\*\) FROM portfolios WHERE user_id = \$1`).
+					WithArgs(testUserID).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				mock.ExpectQuery(`INSERT INTO portfolios \(user_id, name, base_currency, description, is_default, cost_basis_method, enforce_cash_balance\) VALUES \(.+\) RETURNING id`).
+					WithArgs(testUserID, "Retirement", "EUR", "", false, "HIFO", true).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("portfolio-2"))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+			expectedBody:   []string{"Portfolio created successfully", "portfolio-2", "EUR", `"is_default":false`, "HIFO", `"enforce_cash_balance":true`},
+		},
+		{
+			name:        "first portfolio becomes default",
+			requestBody: `{"name": "Main"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT COUNT\(\*\) FROM portfolios WHERE user_id = \$1`).
+					WithArgs(testUserID).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectExec(`UPDATE portfolios SET is_default = false, updated_at = NOW\(\) WHERE user_id = \$1 AND is_default`).
+					WithArgs(testUserID).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(`INSERT INTO portfolios (.+) RETURNING id`).
+					WithArgs(testUserID, "Main", "USD", "", true, "FIFO", false).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testPortfolioID))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+			expectedBody:   []string{`"is_default":true`, "USD", "FIFO"},
+		},
+		{
+			name:        "duplicate name",
+			requestBody: `{"name": "Default"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT COUNT\(\*\) FROM portfolios WHERE user_id = \$1`).
+					WithArgs(testUserID).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				mock.ExpectQuery(`INSERT INTO portfolios (.+) RETURNING id`).
+					WillReturnError(&pq.Error{Code: "23505"})
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+			expectedBody:   []string{"already exists"},
+		},
+		{
+			name:           "invalid cost basis method",
+			requestBody:    `{"name": "Retirement", "cost_basis_method": "AVERAGE"}`,
+			setupMock:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"CostBasisMethod"},
+		},
+		{
+			name:           "invalid base currency",
+			requestBody:    `{"name": "Retirement", "base_currency": "EURO"}`,
+			setupMock:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"BaseCurrency"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock, cleanup := createTestHandler(t)
+			defer cleanup()
+
+			tt.setupMock(mock)
+
+			router := createTestRouter(handler, "POST", "/portfolios", handler.CreatePortfolio)
+
+			req, _ := http.NewRequest("POST", "/portfolios", strings.NewReader(tt.requestBody))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			for _, expected := range tt.expectedBody {
+				assert.Contains(t, w.Body.String(), expected)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+// TestUpdatePortfolio tests the UpdatePortfolio handler
+func TestUpdatePortfolio(t *testing.T) {
+	tests := []struct {
+		name           string
+		requestBody    string
+		setupMock      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedBody   []string
+	}{
+		{
+			name:        "make portfolio the default",
+			requestBody: `{"is_default": true}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT name, base_currency, COALESCE\(description, ''\), is_default, cost_basis_method, enforce_cash_balance FROM portfolios WHERE id = \$1 AND user_id = \$2`).
+					WithArgs(testPortfolioID, testUserID).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "base_currency", "description", "is_default", "cost_basis_method", "enforce_cash_balance"}).
+						AddRow("Retirement", "EUR", "", false, "FIFO", false))
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE portfolios SET is_default = false, updated_at = NOW\(\) WHERE user_id = \$1 AND is_default`).
+					WithArgs(testUserID).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`UPDATE portfolios SET name = \$1, base_currency = \$2, description = \$3, is_default = \$4, cost_basis_method = \$5, enforce_cash_balance = \$6, updated_at = NOW\(\) WHERE id = \$7 AND user_id = \$8`).
+					WithArgs("Retirement", "EUR", "", true, "FIFO", false, testPortfolioID, testUserID).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{"Portfolio updated successfully", `"is_default":true`},
+		},
+		{
+			name:        "rename portfolio, switch to LIFO and enforce the cash balance",
+			requestBody: `{"name": "Pension", "cost_basis_method": "LIFO", "enforce_cash_balance": true}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT name, base_currency, COALESCE\(description, ''\), is_default, cost_basis_method, enforce_cash_balance FROM portfolios`).
+					WithArgs(testPortfolioID, testUserID).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "base_currency", "description", "is_default", "cost_basis_method", "enforce_cash_balance"}).
+						AddRow("Retirement", "EUR", "", false, "FIFO", false))
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE portfolios SET name = \$1`).
+					WithArgs("Pension", "EUR", "", false, "LIFO", true, testPortfolioID, testUserID).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{"Pension", "LIFO", `"enforce_cash_balance":true`},
+		},
+		{
+			name:        "change the base currency",
+			requestBody: `{"base_currency": "usd"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT name, base_currency, COALESCE\(description, ''\), is_default, cost_basis_method, enforce_cash_balance FROM portfolios`).
+					WithArgs(testPortfolioID, testUserID).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "base_currency", "description", "is_default", "cost_basis_method", "enforce_cash_balance"}).
+						AddRow("Retirement", "EUR", "", false, "FIFO", false))
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE portfolios SET name = \$1`).
+					WithArgs("Retirement", "USD", "", false, "FIFO", false, testPortfolioID, testUserID).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				// Every snapshot was valued in euros
+				expectSnapshotInvalidation(mock, testPortfolioID, "0001-01-01")
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{`"base_currency":"USD"`},
+		},
+		{
+			name:           "unsetting default is rejected",
+			requestBody:    `{"is_default": false}`,
+			setupMock:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"Set another portfolio as default"},
+		},
+		{
+			name:        "portfolio not found",
+			requestBody: `{"name": "Pension"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT name, base_currency, COALESCE\(description, ''\), is_default, cost_basis_method, enforce_cash_balance FROM portfolios`).
+					WithArgs(testPortfolioID, testUserID).
+					WillReturnError(sql.ErrNoRows)
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   []string{"Portfolio not found"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock, cleanup := createTestHandler(t)
+			defer cleanup()
+
+			tt.setupMock(mock)
+
+			router := createTestRouter(handler, "PUT", "/portfolios/:id", handler.UpdatePortfolio)
+
+			req, _ := http.NewRequest("PUT", "/portfolios/"+testPortfolioID, strings.NewReader(tt.requestBody))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			for _, expected := range tt.expectedBody {
+				assert.Contains(t, w.Body.String(), expected)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+// TestPortfolioIDs tests that portfolio routes reject an ID that isn't a UUID before querying
+func TestPortfolioIDs(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	routes := []struct {
+		method, path string
+		handler      gin.HandlerFunc
+	}{
+		{"GET", "/portfolios/:id", handler.GetPortfolioByID},
+		{"PUT", "/portfolios/:id", handler.UpdatePortfolio},
+		{"DELETE", "/portfolios/:id", handler.DeletePortfolio},
+		{"POST", "/admin/portfolios/:id/rebuild", handler.RebuildPortfolio},
+	}
+	for _, route := range routes {
+		router := createTestRouter(handler, route.method, route.path, route.handler)
+
+		target := strings.Replace(route.path, ":id", "portfolio-2", 1)
+		req, _ := http.NewRequest(route.method, target, strings.NewReader(`{"name": "Pension"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, route.method+" "+route.path)
+		assert.Contains(t, w.Body.String(), "Invalid portfolio ID")
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestDeletePortfolio tests the DeletePortfolio handler
+func TestDeletePortfolio(t *testing.T) {
+	tests := []struct {
+		name           string
+		setupMock      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedBody   []string
+	}{
+		{
+			name: "successful deletion",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT name, is_default FROM portfolios WHERE id = \$1 AND user_id = \$2`).
+					WithArgs(testPortfolioID, testUserID).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "is_default"}).AddRow("Retirement", false))
+				mock.ExpectExec(`DELETE FROM portfolios WHERE id = \$1 AND user_id = \$2`).
+					WithArgs(testPortfolioID, testUserID).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{"Portfolio deleted successfully", "Retirement"},
+		},
+		{
+			name: "default portfolio cannot be deleted",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT name, is_default FROM portfolios WHERE id = \$1 AND user_id = \$2`).
+					WithArgs(testPortfolioID, testUserID).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "is_default"}).AddRow("Default", true))
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"Cannot delete the default portfolio"},
+		},
+		{
+			name: "portfolio owned by another user",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT name, is_default FROM portfolios WHERE id = \$1 AND user_id = \$2`).
+					WithArgs(testPortfolioID, testUserID).
+					WillReturnError(sql.ErrNoRows)
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   []string{"Portfolio not found"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock, cleanup := createTestHandler(t)
+			defer cleanup()
+
+			tt.setupMock(mock)
+
+			router := createTestRouter(handler, "DELETE", "/portfolios/:id", handler.DeletePortfolio)
+
+			req, _ := http.NewRequest("DELETE", "/portfolios/"+testPortfolioID, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			for _, expected := range tt.expectedBody {
+				assert.Contains(t, w.Body.String(), expected)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+// TestResolvePortfolioID tests portfolio scoping via the portfolio_id query parameter
+func TestResolvePortfolioID(t *testing.T) {
+	tests := []struct {
+		name           string
+		queryParams    string
+		setupMock      func(sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name:        "explicit portfolio owned by user",
+			queryParams: "?portfolio_id=6f1c2d3e-4b5a-4c6d-8e7f-9a0b1c2d3e4f",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id FROM portfolios WHERE id = \$1 AND user_id = \$2`).
+					WithArgs("6f1c2d3e-4b5a-4c6d-8e7f-9a0b1c2d3e4f", testUserID).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("6f1c2d3e-4b5a-4c6d-8e7f-9a0b1c2d3e4f"))
+				mock.ExpectQuery(`SELECT (.+) FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \$1`).
+					WithArgs("6f1c2d3e-4b5a-4c6d-8e7f-9a0b1c2d3e4f").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "symbol", "name", "asset_type", "quantity", "average_cost", "purchase_date"}))
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:        "explicit portfolio owned by another user",
+			queryParams: "?portfolio_id=0a9b8c7d-6e5f-4a3b-9c1d-0e1f2a3b4c5d",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id FROM portfolios WHERE id = \$1 AND user_id = \$2`).
+					WithArgs("0a9b8c7d-6e5f-4a3b-9c1d-0e1f2a3b4c5d", testUserID).
+					WillReturnError(sql.ErrNoRows)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "portfolio_id that isn't a UUID",
+			queryParams:    "?portfolio_id=portfolio-2",
+			setupMock:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "user without portfolios",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id FROM portfolios WHERE user_id = \$1`).
+					WithArgs(testUserID).
+					WillReturnError(sql.ErrNoRows)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name: "lookup failure",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id FROM portfolios WHERE user_id = \$1`).
+					WithArgs(testUserID).
+					WillReturnError(fmt.Errorf("database error"))
+			},
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock, cleanup := createTestHandler(t)
+			defer cleanup()
+
+			tt.setupMock(mock)
+
+			router := createTestRouter(handler, "GET", "/portfolio", handler.GetPortfolio)
+
+			req, _ := http.NewRequest("GET", "/portfolio"+tt.queryParams, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
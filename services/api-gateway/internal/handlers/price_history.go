@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/portfolio-management/api-gateway/internal/services"
+	"go.uber.org/zap"
+)
+
+// maxMovingAverageWindow bounds the window of the sma_N and ema_N series
+const maxMovingAverageWindow = 500
+
+// priceHistoryResolution maps a price history interval to the candle resolution it's resampled to
+func priceHistoryResolution(interval string) (string, bool) {
+	switch interval {
+	case "1d", "D":
+		return "D", true
+	case "1w", "1wk", "W":
+		return "W", true
+	case "1mo", "1M", "M":
+		return "M", true
+	}
+	return "", false
+}
+
+// priceHistoryStart returns the first day of a price history period ending on to
+func priceHistoryStart(period string, to time.Time) (time.Time, bool) {
+	switch period {
+	case "7d":
+		return to.AddDate(0, 0, -7), true
+	case "30d":
+		return to.AddDate(0, 0, -30), true
+	case "90d":
+		return to.AddDate(0, 0, -90), true
+	case "1y":
+		return to.AddDate(-1, 0, 0), true
+	case "ytd":
+		return time.Date(to.Year(), 1, 1, 0, 0, 0, 0, time.UTC), true
+	case "5y":
+		return to.AddDate(-5, 0, 0), true
+	case "max":
+		return time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC), true
+	}
+	return time.Time{}, false
+}
+
+// parseDerivedSeries parses a comma-separated list of derived series: returns, log_returns, sma_N and ema_N
+func parseDerivedSeries(value string) ([]string, error) {
+	var series []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+
+		switch {
+		case name == "returns" || name == "log_returns":
+		case strings.HasPrefix(name, "sma_") || strings.HasPrefix(name, "ema_"):
+			window, err := strconv.Atoi(name[4:])
+			if err != nil || window < 2 || window > maxMovingAverageWindow {
+				return nil, fmt.Errorf("Invalid series %q, moving average windows must be between 2 and %d", name, maxMovingAverageWindow)
+			}
+		default:
+			return nil, fmt.Errorf("Invalid series %q, expected returns, log_returns, sma_N or ema_N", name)
+		}
+		seen[name] = true
+		series = append(series, name)
+	}
+	return series, nil
+}
+
+// derivedSeries computes each named series over the candles' closes, aligned with the candles. Points
+// without enough history (the first return, the first N-1 moving averages) are nil.
+func derivedSeries(candles []services.Candle, names []string) map[string][]interface{} {
+	derived := make(map[string][]interface{}, len(names))
+	for _, name := range names {
+		values := make([]interface{}, len(candles))
+		switch {
+		case name == "returns" || name == "log_returns":
+			for i := 1; i < len(candles); i++ {
+				previous := candles[i-1].Close
+				if previous <= 0 || candles[i].Close <= 0 {
+					continue
+				}
+				if name == "returns" {
+					values[i] = candles[i].Close/previous - 1
+				} else {
+					values[i] = math.Log(candles[i].Close / previous)
+				}
+			}
+		default:
+			window, _ := strconv.Atoi(name[4:])
+			var sum, ema float64
+			for i, candle := range candles {
+				sum += candle.Close
+				if i >= window {
+					sum -= candles[i-window].Close
+				}
+				if i < window-1 {
+					continue
+				}
+				if strings.HasPrefix(name, "sma_") {
+					values[i] = sum / float64(window)
+					continue
+				}
+				// The EMA is seeded with the SMA of its first window
+				if i == window-1 {
+					ema = sum / float64(window)
+				} else {
+					alpha := 2 / float64(window+1)
+					ema = alpha*candle.Close + (1-alpha)*ema
+				}
+				values[i] = ema
+			}
+		}
+		derived[name] = values
+	}
+	return derived
+}
+
+// BackfillPriceHistory loads one asset's daily candles into price_history, from the "from" query
+// parameter (YYYY-MM-DD) or the configured backfill start up to today
+func (h *Handler) BackfillPriceHistory(c *gin.Context) {
+	if h.services.DB == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection not available"})
+		return
+	}
+	if h.services.Candles == nil || h.services.MarketData == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Market data service not available"})
+		return
+	}
+
+	symbol := strings.ToUpper(c.Param("symbol"))
+	from := h.services.Candles.BackfillStart()
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date, expected YYYY-MM-DD"})
+			return
+		}
+		from = parsed
+	}
+	to := time.Now().UTC()
+	if from.After(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must not be in the future"})
+		return
+	}
+
+	var assetID string
+	err := h.services.DB.QueryRow("SELECT id FROM assets WHERE symbol = $1", symbol).Scan(&assetID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Asset not found"})
+			return
+		}
+		h.logger.Error("Failed to get asset ID", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to backfill price history"})
+		return
+	}
+
+	stored, err := h.services.Candles.Ingest(c.Request.Context(), assetID, symbol, from, to)
+	if err != nil {
+		h.logger.Error("Failed to backfill price history", zap.String("symbol", symbol), zap.Error(err))
+		switch {
+		case errors.Is(err, services.ErrSymbolNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Symbol not found at the market data provider"})
+		case errors.Is(err, services.ErrProviderDegraded):
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Market data provider is degraded"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to backfill price history"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"symbol":         symbol,
+		"provider":       h.services.MarketData.Name(),
+		"from":           from.Format("2006-01-02"),
+		"to":             to.Format("2006-01-02"),
+		"candles_stored": stored,
+	})
+}
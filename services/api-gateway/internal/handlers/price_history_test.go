@@ -0,0 +1,391 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/portfolio-management/api-gateway/internal/services"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// testCandles returns daily candles for the given days
+func testCandles(days ...string) []services.Candle {
+	candles := make([]services.Candle, 0, len(days))
+	for i, day := range days {
+		date, _ := time.Parse("2006-01-02", day)
+		price := 100 + float64(i)
+		candles = append(candles, services.Candle{Time: date, Open: price, High: price + 2, Low: price - 1, Close: price + 1, Volume: 1000})
+	}
+	return candles
+}
+
+// expectRecordedSplits expects the query for the splits applied to assetID
+func expectRecordedSplits(mock sqlmock.Sqlmock, assetID string, rows *sqlmock.Rows) {
+	mock.ExpectQuery(`SELECT id, ratio, effective_date FROM corporate_actions WHERE asset_id = \$1 AND action_type IN \('SPLIT', 'REVERSE_SPLIT'\) AND status = 'APPLIED'`).
+		WithArgs(assetID).
+		WillReturnRows(rows)
+}
+
+// newRecordedSplitRows returns the columns of the recorded splits query
+func newRecordedSplitRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "ratio", "effective_date"})
+}
+
+// expectCandleUpserts expects a transaction storing candles for an assetID without splits
+func expectCandleUpserts(mock sqlmock.Sqlmock, assetID string, candles []services.Candle) {
+	mock.ExpectBegin()
+	expectRecordedSplits(mock, assetID, newRecordedSplitRows())
+	for _, candle := range candles {
+		mock.ExpectExec(`INSERT INTO price_history \(asset_id, open_price, high_price, low_price, close_price, volume, date\) (.+) ON CONFLICT \(asset_id, date\) DO UPDATE`).
+			WithArgs(assetID, candle.Open, candle.High, candle.Low, candle.Close, int64(candle.Volume), candle.Time.Format("2006-01-02")).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+}
+
+// TestBackfillPriceHistory tests backfilling one asset's daily candles on demand
+func TestBackfillPriceHistory(t *testing.T) {
+	candles := testCandles("2024-03-01", "2024-03-04", "2024-03-05")
+	newHandler := func(t *testing.T) (*Handler, sqlmock.Sqlmock, func()) {
+		handler, mock, cleanup := createTestHandler(t)
+		provider := &mockMarketData{candles: map[string][]services.Candle{"AAPL": candles}}
+		handler.services.MarketData = provider
+		handler.services.Candles = services.NewCandleIngester(handler.services.DB, provider, 5, 22*time.Hour, zap.NewNop())
+		return handler, mock, cleanup
+	}
+	backfill := func(handler *Handler, target string) *httptest.ResponseRecorder {
+		router := createTestRouter(handler, "POST", "/admin/price-history/:symbol/backfill", handler.BackfillPriceHistory)
+		req, _ := http.NewRequest("POST", target, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("stores candles from the requested day", func(t *testing.T) {
+		handler, mock, cleanup := newHandler(t)
+		defer cleanup()
+
+		mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = \$1`).
+			WithArgs("AAPL").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("asset-1"))
+		expectCandleUpserts(mock, "asset-1", candles[1:])
+
+		w := backfill(handler, "/admin/price-history/aapl/backfill?from=2024-03-02")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"candles_stored":2`)
+		assert.Contains(t, w.Body.String(), `"from":"2024-03-02"`)
+		assert.Contains(t, w.Body.String(), `"provider":"mock"`)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("unknown asset", func(t *testing.T) {
+		handler, mock, cleanup := newHandler(t)
+		defer cleanup()
+
+		mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = \$1`).
+			WithArgs("NOPE").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+		w := backfill(handler, "/admin/price-history/NOPE/backfill")
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("invalid from date", func(t *testing.T) {
+		handler, mock, cleanup := newHandler(t)
+		defer cleanup()
+
+		w := backfill(handler, "/admin/price-history/AAPL/backfill?from=March")
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("no market data provider", func(t *testing.T) {
+		handler, _, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		w := backfill(handler, "/admin/price-history/AAPL/backfill")
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+}
+
+// TestCandleIngesterIngestAll tests that each asset is fetched from its latest stored day, or
+// backfilled when it has no history
+func TestCandleIngesterIngestAll(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	recent := time.Now().UTC().Truncate(24 * time.Hour)
+	old := recent.AddDate(-4, 0, 0)
+	aapl := testCandles(recent.AddDate(0, 0, -2).Format("2006-01-02"), recent.AddDate(0, 0, -1).Format("2006-01-02"), recent.Format("2006-01-02"))
+	msft := testCandles(recent.AddDate(-6, 0, 0).Format("2006-01-02"), old.Format("2006-01-02"))
+	provider := &mockMarketData{candles: map[string][]services.Candle{"AAPL": aapl, "MSFT": msft}}
+	ingester := services.NewCandleIngester(handler.services.DB, provider, 5, 22*time.Hour, zap.NewNop())
+
+	mock.ExpectQuery(`SELECT a.id, a.symbol, MAX\(ph.date\) FROM assets a LEFT JOIN price_history ph (.+) WHERE a.asset_type <> 'CASH'`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "symbol", "max"}).
+			AddRow("asset-1", "AAPL", aapl[1].Time).
+			AddRow("asset-2", "MSFT", nil).
+			AddRow("asset-3", "GONE", nil))
+	expectCandleUpserts(mock, "asset-1", aapl[1:])
+	expectCandleUpserts(mock, "asset-2", msft[1:])
+
+	result, err := ingester.IngestAll(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Assets)
+	assert.Equal(t, 3, result.Candles)
+	assert.Equal(t, []string{"GONE"}, result.Failed)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestCandleIngesterRestatesSplits tests that candles from before a recorded split are stored on the
+// restated basis of the history around them, and recorded so reversing the split restores them
+func TestCandleIngesterRestatesSplits(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	candles := testCandles("2024-06-07", "2024-06-10")
+	provider := &mockMarketData{candles: map[string][]services.Candle{"AAPL": candles}}
+	ingester := services.NewCandleIngester(handler.services.DB, provider, 5, 22*time.Hour, zap.NewNop())
+
+	mock.ExpectBegin()
+	expectRecordedSplits(mock, "asset-1", newRecordedSplitRows().
+		AddRow("ca1", 2.0, testDay("2024-06-10")).
+		AddRow("ca2", 4.0, testDay("2024-06-12")))
+	// 2024-06-07 comes before both splits, so it's restated by one and then the other
+	mock.ExpectQuery(`INSERT INTO price_history (.+) ON CONFLICT \(asset_id, date\) DO UPDATE (.+) RETURNING id`).
+		WithArgs("asset-1", 12.5, 102.0/8, 99.0/8, 101.0/8, int64(8000), "2024-06-07").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("ph1"))
+	adjustment := `WITH updated AS \( UPDATE corporate_action_adjustments SET (.+) INSERT INTO corporate_action_adjustments (.+) WHERE NOT EXISTS`
+	mock.ExpectExec(adjustment).
+		WithArgs("ca1", "ph1", 1000.0, 2000.0, 101.0, 50.5).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(adjustment).
+		WithArgs("ca2", "ph1", 2000.0, 8000.0, 50.5, 12.625).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	// 2024-06-10 is the first split's effective date, so only the second restates it
+	mock.ExpectQuery(`INSERT INTO price_history (.+) RETURNING id`).
+		WithArgs("asset-1", 101.0/4, 103.0/4, 100.0/4, 102.0/4, int64(4000), "2024-06-10").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("ph2"))
+	mock.ExpectExec(adjustment).
+		WithArgs("ca2", "ph2", 1000.0, 4000.0, 102.0, 25.5).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	stored, err := ingester.Ingest(context.Background(), "asset-1", "AAPL", testDay("2024-06-07"), testDay("2024-06-10"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stored)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestCandleIngesterKeepsAdjustedCandles tests that a backfill across a split from a provider that
+// adjusts for splits is stored as given
+func TestCandleIngesterKeepsAdjustedCandles(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	// A 2:1 split took effect on 2024-06-10, and the provider already halved the price before it
+	candles := testCandles("2024-06-07", "2024-06-10")
+	candles[0].Open, candles[0].High, candles[0].Low, candles[0].Close = 50, 51, 49.5, 50.5
+	provider := &mockMarketData{candles: map[string][]services.Candle{"AAPL": candles}, splitAdjusted: true}
+	ingester := services.NewCandleIngester(handler.services.DB, provider, 5, 22*time.Hour, zap.NewNop())
+
+	mock.ExpectBegin()
+	for _, candle := range candles {
+		mock.ExpectExec(`INSERT INTO price_history (.+) ON CONFLICT \(asset_id, date\) DO UPDATE`).
+			WithArgs("asset-1", candle.Open, candle.High, candle.Low, candle.Close, int64(candle.Volume), candle.Time.Format("2006-01-02")).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	stored, err := ingester.Ingest(context.Background(), "asset-1", "AAPL", testDay("2024-06-07"), testDay("2024-06-10"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stored)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// newPriceHistoryRows returns the columns of the price history query with a row per candle
+func newPriceHistoryRows(candles []services.Candle) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"date", "open_price", "high_price", "low_price", "close_price", "volume"})
+	for _, candle := range candles {
+		rows.AddRow(candle.Time, candle.Open, candle.High, candle.Low, candle.Close, int64(candle.Volume))
+	}
+	return rows
+}
+
+// TestGetPriceHistory_Resampling tests date ranges, resampling to weekly and monthly candles and derived series
+func TestGetPriceHistory_Resampling(t *testing.T) {
+	// Mon 4 - Fri 8 March and Mon 11 - Tue 12 March 2024
+	daily := []services.Candle{
+		{Time: time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), Open: 100, High: 104, Low: 99, Close: 102, Volume: 10},
+		{Time: time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC), Open: 102, High: 110, Low: 101, Close: 108, Volume: 20},
+		{Time: time.Date(2024, 3, 8, 0, 0, 0, 0, time.UTC), Open: 108, High: 109, Low: 95, Close: 96, Volume: 30},
+		{Time: time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC), Open: 97, High: 100, Low: 96, Close: 99, Volume: 40},
+		{Time: time.Date(2024, 3, 12, 0, 0, 0, 0, time.UTC), Open: 99, High: 103, Low: 98, Close: 101, Volume: 50},
+	}
+	getHistory := func(handler *Handler, target string) map[string]interface{} {
+		router := createTestRouter(handler, "GET", "/market/prices/:symbol/history", handler.GetPriceHistory)
+		req, _ := http.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		response["status"] = w.Code
+		return response
+	}
+	expectHistory := func(mock sqlmock.Sqlmock, from, to string) {
+		mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = \$1`).
+			WithArgs("AAPL").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("asset-1"))
+		mock.ExpectQuery(`SELECT date, open_price, high_price, low_price, close_price, volume FROM price_history WHERE asset_id = \$1 AND date >= \$2 AND date <= \$3`).
+			WithArgs("asset-1", from, to).
+			WillReturnRows(newPriceHistoryRows(daily))
+	}
+
+	t.Run("weekly candles aggregate OHLCV", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		expectHistory(mock, "2024-03-01", "2024-03-31")
+
+		response := getHistory(handler, "/market/prices/AAPL/history?interval=1w&from=2024-03-01&to=2024-03-31")
+
+		assert.Equal(t, http.StatusOK, response["status"])
+		points := response["price_history"].([]interface{})
+		assert.Len(t, points, 2)
+		assert.Equal(t, map[string]interface{}{"date": "2024-03-04", "open": 100.0, "high": 110.0, "low": 95.0, "close": 96.0, "volume": 60.0}, points[0])
+		assert.Equal(t, map[string]interface{}{"date": "2024-03-11", "open": 97.0, "high": 103.0, "low": 96.0, "close": 101.0, "volume": 90.0}, points[1])
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("monthly candles", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		expectHistory(mock, "2024-03-01", "2024-03-31")
+
+		response := getHistory(handler, "/market/prices/AAPL/history?interval=1mo&from=2024-03-01&to=2024-03-31")
+
+		points := response["price_history"].([]interface{})
+		assert.Len(t, points, 1)
+		assert.Equal(t, map[string]interface{}{"date": "2024-03-01", "open": 100.0, "high": 110.0, "low": 95.0, "close": 101.0, "volume": 150.0}, points[0])
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("derived series are computed before the limit", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		expectHistory(mock, "2024-03-01", "2024-03-31")
+
+		response := getHistory(handler, "/market/prices/AAPL/history?from=2024-03-01&to=2024-03-31&limit=3&series=returns,log_returns,sma_3,ema_2")
+
+		assert.Equal(t, http.StatusOK, response["status"])
+		assert.Equal(t, []interface{}{"returns", "log_returns", "sma_3", "ema_2"}, response["series"])
+		points := response["price_history"].([]interface{})
+		assert.Len(t, points, 3)
+
+		first := points[0].(map[string]interface{})
+		assert.Equal(t, "2024-03-08", first["date"])
+		assert.InDelta(t, 96.0/108-1, first["returns"], 1e-9)
+		assert.InDelta(t, math.Log(96.0/108), first["log_returns"], 1e-9)
+		assert.InDelta(t, (102.0+108+96)/3, first["sma_3"], 1e-9)
+		// ema_2 is seeded at (102+108)/2 = 105, then 96*2/3 + 105/3 = 99
+		assert.InDelta(t, 99.0, first["ema_2"], 1e-9)
+
+		last := points[2].(map[string]interface{})
+		assert.InDelta(t, (96.0+99+101)/3, last["sma_3"], 1e-9)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("moving averages are null without enough history", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		expectHistory(mock, "2024-03-01", "2024-03-31")
+
+		response := getHistory(handler, "/market/prices/AAPL/history?from=2024-03-01&to=2024-03-31&series=returns,sma_3")
+
+		points := response["price_history"].([]interface{})
+		assert.Nil(t, points[0].(map[string]interface{})["returns"])
+		assert.Nil(t, points[1].(map[string]interface{})["sma_3"])
+		assert.NotNil(t, points[2].(map[string]interface{})["sma_3"])
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("ytd period starts on January 1st", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		today := time.Now().UTC()
+		expectHistory(mock, fmt.Sprintf("%d-01-01", today.Year()), today.Format("2006-01-02"))
+
+		response := getHistory(handler, "/market/prices/AAPL/history?period=ytd")
+
+		assert.Equal(t, http.StatusOK, response["status"])
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("period counts back from to", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		expectHistory(mock, "2020-12-31", "2021-12-31")
+		expectHistory(mock, "2020-05-31", "2020-06-30")
+
+		response := getHistory(handler, "/market/prices/AAPL/history?period=1y&to=2021-12-31")
+		assert.Equal(t, http.StatusOK, response["status"])
+
+		// The default period is 30 days
+		response = getHistory(handler, "/market/prices/AAPL/history?to=2020-06-30")
+		assert.Equal(t, http.StatusOK, response["status"])
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("failed read", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		mock.ExpectQuery(`SELECT id FROM assets WHERE symbol = \$1`).
+			WithArgs("AAPL").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("asset-1"))
+		mock.ExpectQuery(`SELECT date, open_price, high_price, low_price, close_price, volume FROM price_history`).
+			WithArgs("asset-1", "2024-03-01", "2024-03-31").
+			WillReturnRows(newPriceHistoryRows(daily).RowError(1, fmt.Errorf("connection reset")))
+
+		response := getHistory(handler, "/market/prices/AAPL/history?from=2024-03-01&to=2024-03-31")
+
+		assert.Equal(t, http.StatusInternalServerError, response["status"])
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	for name, target := range map[string]string{
+		"intraday interval": "/market/prices/AAPL/history?interval=1h",
+		"unknown period":    "/market/prices/AAPL/history?period=2w",
+		"invalid date":      "/market/prices/AAPL/history?from=yesterday",
+		"invalid to date":   "/market/prices/AAPL/history?to=2024-13-01",
+		"reversed range":    "/market/prices/AAPL/history?from=2024-03-31&to=2024-03-01",
+		"unknown series":    "/market/prices/AAPL/history?series=rsi_14",
+		"invalid window":    "/market/prices/AAPL/history?series=sma_1",
+		"invalid limit":     "/market/prices/AAPL/history?limit=0",
+	} {
+		t.Run(name, func(t *testing.T) {
+			handler, mock, cleanup := createTestHandler(t)
+			defer cleanup()
+
+			response := getHistory(handler, target)
+
+			assert.Equal(t, http.StatusBadRequest, response["status"])
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/portfolio-management/api-gateway/internal/services"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// memoryQuoteStore is an in-process QuoteStore
+type memoryQuoteStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func newMemoryQuoteStore() *memoryQuoteStore {
+	return &memoryQuoteStore{values: map[string][]byte{}}
+}
+
+func (s *memoryQuoteStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[key]
+	if !ok {
+		return nil, services.ErrCacheMiss
+	}
+	return value, nil
+}
+
+func (s *memoryQuoteStore) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	return nil
+}
+
+// countingMarketData counts upstream quote requests
+type countingMarketData struct {
+	mockMarketData
+	calls int32
+	price float64
+}
+
+func (m *countingMarketData) GetQuote(symbol string) (*services.Quote, error) {
+	atomic.AddInt32(&m.calls, 1)
+	return &services.Quote{CurrentPrice: m.price}, nil
+}
+
+// getPrice requests a symbol's current price through a handler using the given provider
+func getPrice(handler *Handler, symbol string) *httptest.ResponseRecorder {
+	router := gin.New()
+	router.GET("/market/prices/:symbol", handler.GetCurrentPrice)
+	req, _ := http.NewRequest("GET", "/market/prices/"+symbol, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// TestGetCurrentPrice_QuoteCache tests that the price endpoint is served through the quote cache,
+// whose behaviour is tested in the services package
+func TestGetCurrentPrice_QuoteCache(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger := zap.NewNop()
+	provider := &countingMarketData{price: 190.5}
+	cache := services.NewQuoteCache(provider, newMemoryQuoteStore(), time.Minute, time.Minute, logger)
+	handler := NewHandler(&services.Services{MarketData: cache, Logger: logger}, logger)
+
+	for i := 0; i < 3; i++ {
+		w := getPrice(handler, "AAPL")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"current_price":190.5`)
+		assert.Contains(t, w.Body.String(), `"stale":false`)
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&provider.calls))
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Holding period labels; lots held for more than a year are long-term
+const (
+	holdingPeriodShortTerm = "short_term"
+	holdingPeriodLongTerm  = "long_term"
+)
+
+// holdingPeriod classifies a lot acquired at acquiredAt and disposed of at disposedAt
+func holdingPeriod(acquiredAt, disposedAt time.Time) string {
+	if acquiredAt.AddDate(1, 0, 0).Before(disposedAt) {
+		return holdingPeriodLongTerm
+	}
+	return holdingPeriodShortTerm
+}
+
+// realizedBucket accumulates realized results for one group of disposals
+type realizedBucket struct {
+	Proceeds  float64 `json:"proceeds"`
+	CostBasis float64 `json:"cost_basis"`
+	Realized  float64 `json:"realized_pnl"`
+	ShortTerm float64 `json:"short_term"`
+	LongTerm  float64 `json:"long_term"`
+	Quantity  float64 `json:"quantity"`
+	Disposals int     `json:"disposals"`
+}
+
+func (b *realizedBucket) add(quantity, costBasis, proceeds float64, period string) {
+	realized := proceeds - costBasis
+	b.Proceeds += proceeds
+	b.CostBasis += costBasis
+	b.Realized += realized
+	b.Quantity += quantity
+	b.Disposals++
+	if period == holdingPeriodLongTerm {
+		b.LongTerm += realized
+	} else {
+		b.ShortTerm += realized
+	}
+}
+
+// Helper function to get the realized gain or loss of a portfolio and the cost basis of what was sold,
+// converted into its base currency at today's rates
+func (h *Handler) getRealizedTotals(portfolioID string, fx *fxConverter) (float64, float64, error) {
+	rows, err := h.services.DB.Query(`
+		SELECT COALESCE(a.currency, 'USD') as currency, COALESCE(SUM(ld.proceeds - ld.cost_basis), 0), COALESCE(SUM(ld.cost_basis), 0)
+		FROM lot_disposals ld
+		JOIN tax_lots tl ON ld.lot_id = tl.id
+		JOIN assets a ON tl.asset_id = a.id
+		WHERE tl.portfolio_id = $1
+		GROUP BY COALESCE(a.currency, 'USD')
+	`, portfolioID)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	var realized, costBasis float64
+	for rows.Next() {
+		var currency string
+		var currencyRealized, currencyCostBasis float64
+		if err := rows.Scan(&currency, &currencyRealized, &currencyCostBasis); err != nil {
+			return 0, 0, err
+		}
+		rate, err := fx.rate(currency)
+		if err != nil {
+			return 0, 0, err
+		}
+		realized += currencyRealized * rate
+		costBasis += currencyCostBasis * rate
+	}
+	return realized, costBasis, rows.Err()
+}
+
+// GetRealizedPnL reports realized gains and losses grouped by symbol, month and year
+func (h *Handler) GetRealizedPnL(c *gin.Context) {
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch realized P&L"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
+		return
+	}
+
+	// Get query parameters
+	year := c.Query("year")
+	assetSymbol := strings.ToUpper(c.Query("symbol"))
+
+	query := `
+		SELECT
+			a.symbol,
+			ld.quantity,
+			ld.cost_basis,
+			ld.proceeds,
+			tl.acquired_at,
+			t.transaction_date
+		FROM lot_disposals ld
+		JOIN tax_lots tl ON ld.lot_id = tl.id
+		JOIN transactions t ON ld.transaction_id = t.id
+		JOIN assets a ON tl.asset_id = a.id
+		WHERE tl.portfolio_id = $1
+	`
+	args := []interface{}{portfolioID}
+
+	if year != "" {
+		if _, err := strconv.Atoi(year); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid year"})
+			return
+		}
+		args = append(args, year)
+		query += fmt.Sprintf(" AND EXTRACT(YEAR FROM t.transaction_date) = $%d", len(args))
+	}
+
+	if assetSymbol != "" {
+		args = append(args, assetSymbol)
+		query += fmt.Sprintf(" AND a.symbol = $%d", len(args))
+	}
+
+	query += " ORDER BY t.transaction_date ASC"
+
+	rows, err := h.services.DB.Query(query, args...)
+	if err != nil {
+		h.logger.Error("Failed to query lot disposals", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch realized P&L"})
+		return
+	}
+	defer rows.Close()
+
+	total := &realizedBucket{}
+	bySymbol := make(map[string]*realizedBucket)
+	byMonth := make(map[string]*realizedBucket)
+	byYear := make(map[string]*realizedBucket)
+
+	bucket := func(groups map[string]*realizedBucket, key string) *realizedBucket {
+		if groups[key] == nil {
+			groups[key] = &realizedBucket{}
+		}
+		return groups[key]
+	}
+
+	for rows.Next() {
+		var symbol string
+		var quantity, costBasis, proceeds float64
+		var acquiredAt, disposedAt time.Time
+
+		err := rows.Scan(&symbol, &quantity, &costBasis, &proceeds, &acquiredAt, &disposedAt)
+		if err != nil {
+			h.logger.Error("Failed to scan lot disposal row", zap.Error(err))
+			continue
+		}
+
+		period := holdingPeriod(acquiredAt, disposedAt)
+		total.add(quantity, costBasis, proceeds, period)
+		bucket(bySymbol, symbol).add(quantity, costBasis, proceeds, period)
+		bucket(byMonth, disposedAt.Format("2006-01")).add(quantity, costBasis, proceeds, period)
+		bucket(byYear, disposedAt.Format("2006")).add(quantity, costBasis, proceeds, period)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"portfolio_id": portfolioID,
+		"summary":      total,
+		"by_symbol":    groupRealized(bySymbol, "symbol"),
+		"by_month":     groupRealized(byMonth, "month"),
+		"by_year":      groupRealized(byYear, "year"),
+	})
+}
+
+// groupRealized flattens realized buckets into a list sorted by key
+func groupRealized(groups map[string]*realizedBucket, keyName string) []map[string]interface{} {
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		b := groups[key]
+		result = append(result, map[string]interface{}{
+			keyName:        key,
+			"proceeds":     b.Proceeds,
+			"cost_basis":   b.CostBasis,
+			"realized_pnl": b.Realized,
+			"short_term":   b.ShortTerm,
+			"long_term":    b.LongTerm,
+			"quantity":     b.Quantity,
+			"disposals":    b.Disposals,
+		})
+	}
+	return result
+}
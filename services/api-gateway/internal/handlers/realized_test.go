@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGetRealizedPnL tests the GetRealizedPnL handler
+func TestGetRealizedPnL(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+
+	jan := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	mar := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	rows := sqlmock.NewRows([]string{"symbol", "quantity", "cost_basis", "proceeds", "acquired_at", "transaction_date"}).
+		AddRow("AAPL", 5.0, 500.0, 800.0, jan.AddDate(-2, 0, 0), jan). // long-term gain 300
+		AddRow("MSFT", 2.0, 600.0, 500.0, jan.AddDate(0, -3, 0), jan). // short-term loss 100
+		AddRow("AAPL", 1.0, 100.0, 150.0, mar.AddDate(0, -1, 0), mar)  // short-term gain 50
+
+	mock.ExpectQuery(`SELECT (.+) FROM lot_disposals ld JOIN tax_lots tl ON ld.lot_id = tl.id JOIN transactions t ON ld.transaction_id = t.id JOIN assets a ON tl.asset_id = a.id WHERE tl.portfolio_id = \$1 AND EXTRACT\(YEAR FROM t.transaction_date\) = \$2 ORDER BY t.transaction_date ASC`).
+		WithArgs(testPortfolioID, "2024").
+		WillReturnRows(rows)
+
+	router := createTestRouter(handler, "GET", "/analytics/realized", handler.GetRealizedPnL)
+
+	req, _ := http.NewRequest("GET", "/analytics/realized?year=2024", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Summary  realizedBucket           `json:"summary"`
+		BySymbol []map[string]interface{} `json:"by_symbol"`
+		ByMonth  []map[string]interface{} `json:"by_month"`
+		ByYear   []map[string]interface{} `json:"by_year"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+	assert.Equal(t, 250.0, response.Summary.Realized)
+	assert.Equal(t, 300.0, response.Summary.LongTerm)
+	assert.Equal(t, -50.0, response.Summary.ShortTerm)
+	assert.Equal(t, 3, response.Summary.Disposals)
+
+	if assert.Len(t, response.BySymbol, 2) {
+		assert.Equal(t, "AAPL", response.BySymbol[0]["symbol"])
+		assert.Equal(t, 350.0, response.BySymbol[0]["realized_pnl"])
+		assert.Equal(t, "MSFT", response.BySymbol[1]["symbol"])
+		assert.Equal(t, -100.0, response.BySymbol[1]["realized_pnl"])
+	}
+	if assert.Len(t, response.ByMonth, 2) {
+		assert.Equal(t, "2024-01", response.ByMonth[0]["month"])
+		assert.Equal(t, 200.0, response.ByMonth[0]["realized_pnl"])
+		assert.Equal(t, "2024-03", response.ByMonth[1]["month"])
+	}
+	if assert.Len(t, response.ByYear, 1) {
+		assert.Equal(t, "2024", response.ByYear[0]["year"])
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetRealizedPnL_InvalidYear(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+
+	router := createTestRouter(handler, "GET", "/analytics/realized", handler.GetRealizedPnL)
+
+	req, _ := http.NewRequest("GET", "/analytics/realized?year=last", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,657 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// What target allocations are set by
+const (
+	targetBySymbol    = "symbol"
+	targetBySector    = "sector"
+	targetByAssetType = "asset_type"
+)
+
+// defaultTolerance is how far a weight may drift from its target, either way, unless set otherwise
+const defaultTolerance = 0.05
+
+// targetAllocation is a portfolio's target weight for one symbol, sector or asset type, and how far the
+// weight may drift from it before it's rebalanced. Both are fractions of the portfolio's value.
+type targetAllocation struct {
+	Key       string  `json:"key"`
+	Weight    float64 `json:"weight"`
+	Tolerance float64 `json:"tolerance"`
+}
+
+// rebalanceHolding is a holding and its price, or a targeted symbol that isn't held yet
+type rebalanceHolding struct {
+	Symbol      string
+	AssetType   string
+	Sector      string
+	Currency    string
+	Quantity    float64
+	AverageCost float64 // in Currency
+	Price       float64 // in Currency
+	Rate        float64 // base currency per unit of Currency
+}
+
+// value returns the holding's market value in the base currency
+func (r rebalanceHolding) value() float64 {
+	return r.Quantity * r.Price * r.Rate
+}
+
+// key returns what the holding is grouped by when targets are set by by
+func (r rebalanceHolding) key(by string) string {
+	switch by {
+	case targetBySector:
+		return r.Sector
+	case targetByAssetType:
+		return r.AssetType
+	}
+	return r.Symbol
+}
+
+// rebalanceOptions are the limits on rebalancing orders
+type rebalanceOptions struct {
+	MinTrade    float64 // smallest order, in the base currency
+	WholeShares bool
+	AvoidGains  bool // don't sell holdings priced above their average cost
+}
+
+// allocationDrift compares the weight of a symbol, sector or asset type with its target, in percent
+type allocationDrift struct {
+	Key              string  `json:"key"`
+	Targeted         bool    `json:"targeted"`
+	CurrentValue     float64 `json:"current_value"`
+	CurrentPercent   float64 `json:"current_percent"`
+	TargetPercent    float64 `json:"target_percent"`
+	DriftPercent     float64 `json:"drift_percent"`
+	TolerancePercent float64 `json:"tolerance_percent"`
+	OutOfBand        bool    `json:"out_of_band"`
+	AfterPercent     float64 `json:"after_percent"` // once the orders are filled
+}
+
+// rebalanceOrder is one trade towards the targets
+type rebalanceOrder struct {
+	Symbol        string   `json:"symbol"`
+	Action        string   `json:"action"`
+	Quantity      float64  `json:"quantity"`
+	Price         float64  `json:"price"`
+	Currency      string   `json:"currency"`
+	Value         float64  `json:"value"`                    // in the base currency
+	EstimatedGain *float64 `json:"estimated_gain,omitempty"` // sells, from the average cost, in the base currency
+}
+
+// rebalancePlan is the drift of a portfolio from its targets and the orders that restore them
+type rebalancePlan struct {
+	TotalValue        float64
+	CashValue         float64
+	CashTargetPercent float64
+	CashAfter         float64
+	Drift             []allocationDrift
+	Orders            []rebalanceOrder
+	Warnings          []string
+}
+
+// normalizeTargetKey returns the form keys are matched in: symbols and asset types are upper case, and
+// sectors are matched regardless of case
+func normalizeTargetKey(key string) string {
+	return strings.ToUpper(strings.TrimSpace(key))
+}
+
+// planRebalance compares the holdings and cash with the targets, and plans the orders that bring every
+// symbol, sector or asset type outside its tolerance band back to its target. Cash has the default
+// tolerance band. Holdings outside the
+// targets have a target of zero; whatever the targets leave unallocated is the cash target. Sells are
+// spread over a group's holdings by value, and buys too unless targets are set by symbol. Buys are
+// funded by the cash above its target and the sells, and scaled down together when that falls short.
+func planRebalance(holdings []rebalanceHolding, targets []targetAllocation, by string, cash float64, options rebalanceOptions) rebalancePlan {
+	plan := rebalancePlan{CashValue: cash, Drift: []allocationDrift{}, Orders: []rebalanceOrder{}}
+	plan.TotalValue = cash
+	for _, holding := range holdings {
+		plan.TotalValue += holding.value()
+	}
+
+	// Group the holdings by target key, with the targets first in their own order
+	type group struct {
+		drift   allocationDrift
+		target  float64
+		members []int
+	}
+	var groups []*group
+	byKey := map[string]*group{}
+	targeted := 0.0
+	for _, target := range targets {
+		g := &group{drift: allocationDrift{Key: target.Key, Targeted: true, TolerancePercent: target.Tolerance * 100}, target: target.Weight}
+		groups = append(groups, g)
+		byKey[normalizeTargetKey(target.Key)] = g
+		targeted += target.Weight
+	}
+	for i, holding := range holdings {
+		key := holding.key(by)
+		g, ok := byKey[normalizeTargetKey(key)]
+		if !ok {
+			if key == "" {
+				key = "Unclassified"
+			}
+			g = &group{drift: allocationDrift{Key: key}}
+			groups = append(groups, g)
+			byKey[normalizeTargetKey(key)] = g
+		}
+		g.members = append(g.members, i)
+		g.drift.CurrentValue += holding.value()
+	}
+	plan.CashTargetPercent = math.Max(1-targeted, 0) * 100
+	if plan.TotalValue <= 0 {
+		return plan
+	}
+
+	// Cash that has drifted out of its band brings every group short of its target, or over it, along
+	cashDrift := cash/plan.TotalValue - plan.CashTargetPercent/100
+	excessCash, shortCash := cashDrift > defaultTolerance, cashDrift < -defaultTolerance
+
+	sold := make([]float64, len(holdings))
+	bought := make([]float64, len(holdings))
+	wanted := make([]float64, len(holdings)) // buy value per holding before funding
+	var proceeds float64
+	for _, g := range groups {
+		current := g.drift.CurrentValue / plan.TotalValue
+		g.drift.CurrentPercent = current * 100
+		g.drift.TargetPercent = g.target * 100
+		g.drift.DriftPercent = (current - g.target) * 100
+		g.drift.OutOfBand = math.Abs(current-g.target) > g.drift.TolerancePercent/100+1e-9
+		delta := g.target*plan.TotalValue - g.drift.CurrentValue
+		if !g.drift.OutOfBand && !(excessCash && delta > 0) && !(shortCash && delta < 0) {
+			continue
+		}
+
+		switch {
+		case delta < 0:
+			for _, i := range g.members {
+				holding := holdings[i]
+				if holding.value() <= 0 {
+					continue
+				}
+				if options.AvoidGains && holding.Price > holding.AverageCost {
+					plan.Warnings = append(plan.Warnings, fmt.Sprintf("Not selling %s, which would realize a gain", holding.Symbol))
+					continue
+				}
+				quantity := -delta * holding.value() / g.drift.CurrentValue / (holding.Price * holding.Rate)
+				if options.WholeShares {
+					quantity = math.Floor(quantity + 1e-9)
+				}
+				sold[i] = math.Min(quantity, holding.Quantity)
+				proceeds += sold[i] * holding.Price * holding.Rate
+			}
+		case len(g.members) == 0:
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("Nothing held in %s to buy more of; hold one of its assets or target a symbol", g.drift.Key))
+		default:
+			for _, i := range g.members {
+				share := 1 / float64(len(g.members))
+				if g.drift.CurrentValue > 0 {
+					share = holdings[i].value() / g.drift.CurrentValue
+				}
+				wanted[i] = delta * share
+			}
+		}
+	}
+
+	// Sells smaller than the minimum trade are dropped, and their proceeds with them
+	for i, holding := range holdings {
+		if value := sold[i] * holding.Price * holding.Rate; sold[i] > 0 && value < options.MinTrade {
+			proceeds -= value
+			sold[i] = 0
+		}
+	}
+
+	// Buys spend the cash above its target, and are scaled down together if it falls short
+	var wantedTotal float64
+	for _, value := range wanted {
+		wantedTotal += value
+	}
+	spendable := math.Max(cash+proceeds-plan.CashTargetPercent/100*plan.TotalValue, 0)
+	scale := 1.0
+	if wantedTotal > spendable {
+		scale = spendable / wantedTotal
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("Buys are scaled to %.1f%% to stay within the cash available", scale*100))
+	}
+	var spent float64
+	for i, holding := range holdings {
+		if wanted[i] <= 0 {
+			continue
+		}
+		if holding.Price <= 0 {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("No price for %s, so it can't be bought", holding.Symbol))
+			continue
+		}
+		quantity := wanted[i] * scale / (holding.Price * holding.Rate)
+		if options.WholeShares {
+			quantity = math.Floor(quantity + 1e-9)
+		}
+		if value := quantity * holding.Price * holding.Rate; quantity > 0 && value >= options.MinTrade {
+			bought[i] = quantity
+			spent += value
+		}
+	}
+	plan.CashAfter = cash + proceeds - spent
+
+	for i, holding := range holdings {
+		price := holding.Price * holding.Rate
+		if sold[i] > 0 {
+			gain := sold[i] * (holding.Price - holding.AverageCost) * holding.Rate
+			plan.Orders = append(plan.Orders, rebalanceOrder{
+				Symbol: holding.Symbol, Action: transactionSell, Quantity: sold[i], Price: holding.Price,
+				Currency: holding.Currency, Value: sold[i] * price, EstimatedGain: &gain,
+			})
+		}
+		if bought[i] > 0 {
+			plan.Orders = append(plan.Orders, rebalanceOrder{
+				Symbol: holding.Symbol, Action: transactionBuy, Quantity: bought[i], Price: holding.Price,
+				Currency: holding.Currency, Value: bought[i] * price,
+			})
+		}
+	}
+	sort.SliceStable(plan.Orders, func(i, j int) bool {
+		if plan.Orders[i].Action != plan.Orders[j].Action {
+			return plan.Orders[i].Action == transactionSell
+		}
+		return plan.Orders[i].Symbol < plan.Orders[j].Symbol
+	})
+
+	for _, g := range groups {
+		after := g.drift.CurrentValue
+		for _, i := range g.members {
+			after += (bought[i] - sold[i]) * holdings[i].Price * holdings[i].Rate
+		}
+		g.drift.AfterPercent = after / plan.TotalValue * 100
+		plan.Drift = append(plan.Drift, g.drift)
+	}
+	return plan
+}
+
+// Helper function to load a portfolio's target allocations and what they're set by
+func (h *Handler) loadTargetAllocations(portfolioID string) (string, []targetAllocation, error) {
+	rows, err := h.services.DB.Query(`
+		SELECT target_type, target_key, target_weight, tolerance
+		FROM target_allocations
+		WHERE portfolio_id = $1
+		ORDER BY target_weight DESC, target_key
+	`, portfolioID)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to query target allocations: %w", err)
+	}
+	defer rows.Close()
+
+	var by string
+	targets := []targetAllocation{}
+	for rows.Next() {
+		var target targetAllocation
+		if err := rows.Scan(&by, &target.Key, &target.Weight, &target.Tolerance); err != nil {
+			return "", nil, fmt.Errorf("failed to scan target allocation: %w", err)
+		}
+		targets = append(targets, target)
+	}
+	return by, targets, rows.Err()
+}
+
+// GetTargetAllocations returns the portfolio's target allocations
+func (h *Handler) GetTargetAllocations(c *gin.Context) {
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch target allocations"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
+		return
+	}
+
+	by, targets, err := h.loadTargetAllocations(portfolioID)
+	if err != nil {
+		h.logger.Error("Failed to load target allocations", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch target allocations"})
+		return
+	}
+
+	var targeted float64
+	for _, target := range targets {
+		targeted += target.Weight
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"portfolio_id": portfolioID,
+		"by":           by,
+		"targets":      targets,
+		"cash_weight":  math.Max(1-targeted, 0),
+	})
+}
+
+// SetTargetAllocations replaces the portfolio's target allocations. An empty list clears them.
+func (h *Handler) SetTargetAllocations(c *gin.Context) {
+	var request struct {
+		PortfolioID string `json:"portfolio_id"`
+		By          string `json:"by" binding:"required,oneof=symbol sector asset_type"`
+		Targets     []struct {
+			Key       string   `json:"key" binding:"required"`
+			Weight    float64  `json:"weight" binding:"gte=0,lte=1"`
+			Tolerance *float64 `json:"tolerance" binding:"omitempty,gte=0,lte=1"`
+		} `json:"targets" binding:"dive"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	targets := make([]targetAllocation, 0, len(request.Targets))
+	seen := map[string]bool{}
+	var total float64
+	for _, target := range request.Targets {
+		key := strings.TrimSpace(target.Key)
+		if request.By != targetBySector {
+			key = normalizeTargetKey(key)
+		}
+		if seen[normalizeTargetKey(key)] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s is targeted more than once", key)})
+			return
+		}
+		seen[normalizeTargetKey(key)] = true
+		tolerance := defaultTolerance
+		if target.Tolerance != nil {
+			tolerance = *target.Tolerance
+		}
+		targets = append(targets, targetAllocation{Key: key, Weight: target.Weight, Tolerance: tolerance})
+		total += target.Weight
+	}
+	if total > 1+1e-9 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Target weights add up to %.4g, more than 1", total)})
+		return
+	}
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save target allocations"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, request.PortfolioID)
+	if !ok {
+		return
+	}
+
+	tx, err := h.services.DB.Begin()
+	if err != nil {
+		h.logger.Error("Failed to begin transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save target allocations"})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("DELETE FROM target_allocations WHERE portfolio_id = $1", portfolioID); err != nil {
+		h.logger.Error("Failed to clear target allocations", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save target allocations"})
+		return
+	}
+	for _, target := range targets {
+		_, err = tx.Exec(`
+			INSERT INTO target_allocations (portfolio_id, target_type, target_key, target_weight, tolerance)
+			VALUES ($1, $2, $3, $4, $5)
+		`, portfolioID, request.By, target.Key, target.Weight, target.Tolerance)
+		if err != nil {
+			h.logger.Error("Failed to insert target allocation", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save target allocations"})
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		h.logger.Error("Failed to commit transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save target allocations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Target allocations saved successfully",
+		"portfolio_id": portfolioID,
+		"by":           request.By,
+		"targets":      targets,
+		"cash_weight":  math.Max(1-total, 0),
+	})
+}
+
+// Helper function to load a portfolio's holdings with their current prices, in their own currency and
+// the rate to the base currency. Holdings without a quote are priced at their average cost.
+func (h *Handler) loadRebalanceHoldings(portfolioID string, fx *fxConverter) ([]rebalanceHolding, []string, error) {
+	rows, err := h.services.DB.Query(`
+		SELECT a.symbol, a.asset_type, COALESCE(a.sector, ''), COALESCE(a.currency, 'USD'), ph.quantity, ph.average_cost
+		FROM portfolio_holdings ph
+		JOIN assets a ON ph.asset_id = a.id
+		WHERE ph.portfolio_id = $1 AND ph.quantity > 0
+		ORDER BY a.symbol
+	`, portfolioID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query holdings: %w", err)
+	}
+	defer rows.Close()
+
+	var holdings []rebalanceHolding
+	for rows.Next() {
+		var holding rebalanceHolding
+		if err := rows.Scan(&holding.Symbol, &holding.AssetType, &holding.Sector, &holding.Currency, &holding.Quantity, &holding.AverageCost); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan holding: %w", err)
+		}
+		holdings = append(holdings, holding)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var warnings []string
+	for i := range holdings {
+		if holdings[i].Rate, err = fx.rate(holdings[i].Currency); err != nil {
+			return nil, nil, err
+		}
+		holdings[i].Price = holdings[i].AverageCost
+		if price, ok := h.rebalancePrice(holdings[i].Symbol); ok {
+			holdings[i].Price = price
+		} else {
+			warnings = append(warnings, fmt.Sprintf("No current price for %s, so it's valued at its average cost", holdings[i].Symbol))
+		}
+	}
+	return holdings, warnings, nil
+}
+
+// Helper function to load assets that aren't held, priced so they can be bought, and the symbols that
+// aren't known assets
+func (h *Handler) loadPricedAssets(symbols []string, fx *fxConverter) ([]rebalanceHolding, []string, error) {
+	rows, err := h.services.DB.Query(`
+		SELECT symbol, asset_type, COALESCE(sector, ''), COALESCE(currency, 'USD')
+		FROM assets
+		WHERE symbol = ANY($1)
+	`, pq.Array(symbols))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query assets: %w", err)
+	}
+	defer rows.Close()
+
+	found := map[string]rebalanceHolding{}
+	for rows.Next() {
+		var asset rebalanceHolding
+		if err := rows.Scan(&asset.Symbol, &asset.AssetType, &asset.Sector, &asset.Currency); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan asset: %w", err)
+		}
+		found[asset.Symbol] = asset
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var assets []rebalanceHolding
+	var unknown []string
+	for _, symbol := range symbols {
+		asset, ok := found[symbol]
+		if !ok {
+			unknown = append(unknown, symbol)
+			continue
+		}
+		if asset.Rate, err = fx.rate(asset.Currency); err != nil {
+			return nil, nil, err
+		}
+		if price, ok := h.rebalancePrice(symbol); ok {
+			asset.Price = price
+		}
+		assets = append(assets, asset)
+	}
+	return assets, unknown, nil
+}
+
+// Helper function to get a symbol's current price from the market data provider
+func (h *Handler) rebalancePrice(symbol string) (float64, bool) {
+	if h.services.MarketData == nil {
+		return 0, false
+	}
+	quote, err := h.services.MarketData.GetQuote(symbol)
+	if err != nil || quote.CurrentPrice <= 0 {
+		if err != nil {
+			h.logger.Warn("Failed to fetch current price", zap.String("symbol", symbol), zap.Error(err))
+		}
+		return 0, false
+	}
+	return quote.CurrentPrice, true
+}
+
+// GetRebalance reports how far the portfolio has drifted from its target allocations, and the orders
+// that restore them
+func (h *Handler) GetRebalance(c *gin.Context) {
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to plan rebalance"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
+		return
+	}
+
+	options := rebalanceOptions{
+		WholeShares: c.DefaultQuery("whole_shares", "true") != "false",
+		AvoidGains:  c.Query("avoid_gains") == "true",
+	}
+	if value := c.Query("min_trade"); value != "" {
+		minTrade, err := strconv.ParseFloat(value, 64)
+		if err != nil || minTrade < 0 || math.IsInf(minTrade, 0) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid min_trade, expected an amount in the base currency"})
+			return
+		}
+		options.MinTrade = minTrade
+	}
+
+	by, targets, err := h.loadTargetAllocations(portfolioID)
+	if err != nil {
+		h.logger.Error("Failed to load target allocations", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to plan rebalance"})
+		return
+	}
+	if len(targets) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No target allocations are set for this portfolio"})
+		return
+	}
+
+	// Everything is valued in the portfolio's base currency
+	fx, err := h.newFXConverter(h.services.DB, portfolioID)
+	if err != nil {
+		h.logger.Error("Failed to load base currency", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to plan rebalance"})
+		return
+	}
+	holdings, warnings, err := h.loadRebalanceHoldings(portfolioID, fx)
+	if err != nil {
+		h.respondFXError(c, err, "Failed to plan rebalance")
+		return
+	}
+	if by == targetBySymbol {
+		held := map[string]bool{}
+		for _, holding := range holdings {
+			held[holding.Symbol] = true
+		}
+		var missing []string
+		for _, target := range targets {
+			if !held[target.Key] && target.Weight > 0 {
+				missing = append(missing, target.Key)
+			}
+		}
+		if len(missing) > 0 {
+			assets, unknown, err := h.loadPricedAssets(missing, fx)
+			if err != nil {
+				h.respondFXError(c, err, "Failed to plan rebalance")
+				return
+			}
+			holdings = append(holdings, assets...)
+			for _, symbol := range unknown {
+				warnings = append(warnings, fmt.Sprintf("%s is targeted but isn't a known asset", symbol))
+			}
+		}
+	}
+	_, cash, err := h.getCashBalances(h.services.DB, portfolioID, fx)
+	if err != nil {
+		h.respondFXError(c, err, "Failed to plan rebalance")
+		return
+	}
+
+	plan := planRebalance(holdings, targets, by, cash, options)
+	warnings = append(warnings, plan.Warnings...)
+
+	response := gin.H{
+		"base_currency":       fx.base,
+		"by":                  by,
+		"total_value":         plan.TotalValue,
+		"cash_value":          plan.CashValue,
+		"cash_target_percent": plan.CashTargetPercent,
+		"cash_after":          plan.CashAfter,
+		"drift":               plan.Drift,
+		"orders":              plan.Orders,
+		"options": gin.H{
+			"min_trade":    options.MinTrade,
+			"whole_shares": options.WholeShares,
+			"avoid_gains":  options.AvoidGains,
+		},
+	}
+	if len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+
+	c.JSON(http.StatusOK, response)
+}
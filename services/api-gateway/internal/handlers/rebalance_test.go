@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/portfolio-management/api-gateway/internal/services"
+	"github.com/stretchr/testify/assert"
+)
+
+// rebalanceTestHoldings returns 70% in technology, one holding at a gain and one at a loss, and 20% in
+// fixed income, out of 10,000 with 1,000 in cash
+func rebalanceTestHoldings() []rebalanceHolding {
+	return []rebalanceHolding{
+		{Symbol: "AAA", AssetType: "STOCK", Sector: "Technology", Currency: "USD", Quantity: 60, AverageCost: 50, Price: 100, Rate: 1},
+		{Symbol: "BBB", AssetType: "STOCK", Sector: "Technology", Currency: "USD", Quantity: 10, AverageCost: 120, Price: 100, Rate: 1},
+		{Symbol: "CCC", AssetType: "BOND", Sector: "Fixed Income", Currency: "USD", Quantity: 20, AverageCost: 100, Price: 100, Rate: 1},
+	}
+}
+
+// rebalanceTestTargets returns half in technology and 40% in fixed income, leaving 10% in cash
+func rebalanceTestTargets() []targetAllocation {
+	return []targetAllocation{
+		{Key: "technology", Weight: 0.5, Tolerance: 0.05},
+		{Key: "Fixed Income", Weight: 0.4, Tolerance: 0.05},
+	}
+}
+
+// orderSummary returns each order as its action, symbol and quantity
+func orderSummary(orders []rebalanceOrder) []string {
+	summary := []string{}
+	for _, order := range orders {
+		summary = append(summary, order.Action+" "+order.Symbol+" "+formatQuantity(order.Quantity))
+	}
+	return summary
+}
+
+// formatQuantity formats a quantity without trailing zeros
+func formatQuantity(quantity float64) string {
+	data, _ := json.Marshal(quantity)
+	return string(data)
+}
+
+// TestPlanRebalance tests drift, whole-share orders and funding the buys from cash and sells
+func TestPlanRebalance(t *testing.T) {
+	plan := planRebalance(rebalanceTestHoldings(), rebalanceTestTargets(), targetBySector, 1000, rebalanceOptions{WholeShares: true})
+
+	assert.Equal(t, 10000.0, plan.TotalValue)
+	assert.InDelta(t, 10, plan.CashTargetPercent, 1e-9)
+	if assert.Len(t, plan.Drift, 2) {
+		assert.Equal(t, "technology", plan.Drift[0].Key)
+		assert.InDelta(t, 70, plan.Drift[0].CurrentPercent, 1e-9)
+		assert.InDelta(t, 20, plan.Drift[0].DriftPercent, 1e-9)
+		assert.True(t, plan.Drift[0].OutOfBand)
+		assert.InDelta(t, 51, plan.Drift[0].AfterPercent, 1e-9)
+		assert.InDelta(t, 39, plan.Drift[1].AfterPercent, 1e-9)
+	}
+
+	// 2,000 of technology is sold by value, and the 1,900 raised buys 95% of the 2,000 of bonds wanted
+	assert.Equal(t, []string{"SELL AAA 17", "SELL BBB 2", "BUY CCC 19"}, orderSummary(plan.Orders))
+	assert.InDelta(t, 17*50, *plan.Orders[0].EstimatedGain, 1e-9)
+	assert.InDelta(t, -2*20, *plan.Orders[1].EstimatedGain, 1e-9)
+	assert.Nil(t, plan.Orders[2].EstimatedGain)
+	assert.InDelta(t, 1000, plan.CashAfter, 1e-9)
+	assert.Contains(t, plan.Warnings, "Buys are scaled to 95.0% to stay within the cash available")
+
+	t.Run("avoid gains", func(t *testing.T) {
+		plan := planRebalance(rebalanceTestHoldings(), rebalanceTestTargets(), targetBySector, 1000, rebalanceOptions{WholeShares: true, AvoidGains: true})
+
+		assert.Equal(t, []string{"SELL BBB 2", "BUY CCC 2"}, orderSummary(plan.Orders))
+		assert.Contains(t, plan.Warnings, "Not selling AAA, which would realize a gain")
+	})
+
+	t.Run("minimum trade", func(t *testing.T) {
+		plan := planRebalance(rebalanceTestHoldings(), rebalanceTestTargets(), targetBySector, 1000, rebalanceOptions{WholeShares: true, MinTrade: 500})
+
+		assert.Equal(t, []string{"SELL AAA 17", "BUY CCC 17"}, orderSummary(plan.Orders))
+	})
+
+	t.Run("within tolerance", func(t *testing.T) {
+		targets := rebalanceTestTargets()
+		targets[0].Weight, targets[0].Tolerance = 0.68, 0.05
+		targets[1].Weight, targets[1].Tolerance = 0.22, 0.05
+
+		plan := planRebalance(rebalanceTestHoldings(), targets, targetBySector, 1000, rebalanceOptions{WholeShares: true})
+
+		assert.Empty(t, plan.Orders)
+		assert.False(t, plan.Drift[0].OutOfBand)
+	})
+
+	t.Run("by symbol from cash", func(t *testing.T) {
+		holdings := []rebalanceHolding{
+			{Symbol: "VTI", Currency: "USD", Price: 300, Rate: 1},
+			{Symbol: "BND", Currency: "EUR", Price: 70, Rate: 1.1},
+		}
+		targets := []targetAllocation{{Key: "VTI", Weight: 0.6, Tolerance: 0.05}, {Key: "BND", Weight: 0.4, Tolerance: 0.05}}
+
+		plan := planRebalance(holdings, targets, targetBySymbol, 10000, rebalanceOptions{WholeShares: true})
+		assert.Equal(t, []string{"BUY BND 51", "BUY VTI 20"}, orderSummary(plan.Orders))
+		assert.InDelta(t, 10000-51*77-20*300, plan.CashAfter, 1e-9)
+
+		plan = planRebalance(holdings, targets, targetBySymbol, 10000, rebalanceOptions{})
+		if assert.Len(t, plan.Orders, 2) {
+			assert.InDelta(t, 4000/77.0, plan.Orders[0].Quantity, 1e-9)
+			assert.InDelta(t, 0, plan.CashAfter, 1e-9)
+		}
+	})
+}
+
+// TestSetTargetAllocations tests validating and replacing a portfolio's targets
+func TestSetTargetAllocations(t *testing.T) {
+	put := func(handler *Handler, body string) *httptest.ResponseRecorder {
+		router := createTestRouter(handler, "PUT", "/portfolio/targets", handler.SetTargetAllocations)
+		req, _ := http.NewRequest("PUT", "/portfolio/targets", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("replaces the targets", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		mock.ExpectBegin()
+		mock.ExpectExec(`DELETE FROM target_allocations WHERE portfolio_id = \$1`).
+			WithArgs(testPortfolioID).
+			WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectExec(`INSERT INTO target_allocations`).
+			WithArgs(testPortfolioID, targetBySymbol, "VTI", 0.6, 0.05).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`INSERT INTO target_allocations`).
+			WithArgs(testPortfolioID, targetBySymbol, "BND", 0.3, 0.1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		w := put(handler, `{"by": "symbol", "targets": [{"key": "vti", "weight": 0.6}, {"key": "BND", "weight": 0.3, "tolerance": 0.1}]}`)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"cash_weight":0.1`)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("invalid targets", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		for _, body := range []string{
+			`{"by": "industry", "targets": []}`,
+			`{"by": "symbol", "targets": [{"key": "VTI", "weight": 1.5}]}`,
+			`{"by": "symbol", "targets": [{"key": "VTI", "weight": 0.6}, {"key": "BND", "weight": 0.6}]}`,
+			`{"by": "sector", "targets": [{"key": "Energy", "weight": 0.2}, {"key": "energy", "weight": 0.2}]}`,
+			`{"by": "symbol", "targets": [{"weight": 0.2}]}`,
+		} {
+			w := put(handler, body)
+			assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		}
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+// TestGetRebalance tests the rebalance endpoint
+func TestGetRebalance(t *testing.T) {
+	expectTargets := func(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+		mock.ExpectQuery(`SELECT target_type, target_key, target_weight, tolerance FROM target_allocations WHERE portfolio_id = \$1`).
+			WithArgs(testPortfolioID).
+			WillReturnRows(rows)
+	}
+	get := func(handler *Handler, target string) *httptest.ResponseRecorder {
+		router := createTestRouter(handler, "GET", "/portfolio/rebalance", handler.GetRebalance)
+		req, _ := http.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("orders", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		handler.services.MarketData = &mockMarketData{quotes: map[string]*services.Quote{
+			"AAA": {CurrentPrice: 100},
+			"BBB": {CurrentPrice: 100},
+		}}
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		expectTargets(mock, sqlmock.NewRows([]string{"target_type", "target_key", "target_weight", "tolerance"}).
+			AddRow("symbol", "AAA", 0.5, 0.05).
+			AddRow("symbol", "BBB", 0.5, 0.05))
+		expectBaseCurrency(mock, testPortfolioID, "USD")
+		mock.ExpectQuery(`SELECT a.symbol, a.asset_type, COALESCE\(a.sector, ''\), COALESCE\(a.currency, 'USD'\), ph.quantity, ph.average_cost FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \$1 AND ph.quantity > 0`).
+			WithArgs(testPortfolioID).
+			WillReturnRows(sqlmock.NewRows([]string{"symbol", "asset_type", "sector", "currency", "quantity", "average_cost"}).
+				AddRow("AAA", "STOCK", "Technology", "USD", 80.0, 50.0))
+		mock.ExpectQuery(`SELECT symbol, asset_type, COALESCE\(sector, ''\), COALESCE\(currency, 'USD'\) FROM assets WHERE symbol = ANY\(\$1\)`).
+			WithArgs(sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"symbol", "asset_type", "sector", "currency"}).
+				AddRow("BBB", "STOCK", "Technology", "USD"))
+		expectCashBalances(mock, testPortfolioID, newCashBalanceRows().AddRow("USD", 2000.0))
+
+		w := get(handler, "/portfolio/rebalance?min_trade=100")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			TotalValue float64           `json:"total_value"`
+			Orders     []rebalanceOrder  `json:"orders"`
+			Drift      []allocationDrift `json:"drift"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, 10000.0, response.TotalValue)
+		assert.Equal(t, []string{"SELL AAA 30", "BUY BBB 50"}, orderSummary(response.Orders))
+		assert.Len(t, response.Drift, 2)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("no targets", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		expectTargets(mock, sqlmock.NewRows([]string{"target_type", "target_key", "target_weight", "tolerance"}))
+
+		w := get(handler, "/portfolio/rebalance")
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("invalid minimum trade", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+
+		w := get(handler, "/portfolio/rebalance?min_trade=-5")
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// How a reconciliation resolves (or would resolve) a holding that doesn't match the ledger
+const (
+	resolutionRewriteHolding = "rewrite_holding" // the holding is rewritten from the ledger
+	resolutionBackfillLedger = "backfill_ledger" // an ADJUST is recorded so the ledger carries the holding
+	resolutionFixLedger      = "fix_ledger"      // the asset has invalid sells that must be corrected by hand
+)
+
+// reconcileItem is a holding that doesn't match the ledger and how it is resolved
+type reconcileItem struct {
+	holdingDiscrepancy
+	Resolution string `json:"resolution"`
+	Applied    bool   `json:"applied"`
+}
+
+// ReconcilePortfolio compares stored holdings with what the transaction ledger implies.
+// GET only reports; POST also writes the corrections unless dry_run=true.
+func (h *Handler) ReconcilePortfolio(c *gin.Context) {
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reconcile portfolio"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
+		return
+	}
+
+	dryRun := c.Request.Method != http.MethodPost || c.Query("dry_run") == "true"
+
+	// A dry run reads inside a transaction too, so the report matches what an apply would see
+	tx, err := h.services.DB.Begin()
+	if err != nil {
+		h.logger.Error("Failed to begin transaction", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reconcile portfolio"})
+		return
+	}
+	defer tx.Rollback()
+
+	entries, err := h.loadLedger(tx, portfolioID, "")
+	if err != nil {
+		h.logger.Error("Failed to load ledger", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reconcile portfolio"})
+		return
+	}
+
+	state := replayLedgerLenient(entries)
+
+	stored, err := h.loadStoredHoldings(tx, portfolioID, "")
+	if err != nil {
+		h.logger.Error("Failed to load holdings", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reconcile portfolio"})
+		return
+	}
+
+	assets := make(map[string]bool)
+	ledgerAssets := make(map[string]bool)
+	for _, entry := range entries {
+		if !affectsHoldings(entry.Type) {
+			continue
+		}
+		assets[entry.AssetID] = true
+		ledgerAssets[entry.AssetID] = true
+	}
+	for assetID := range stored {
+		assets[assetID] = true
+	}
+	invalidAssets := make(map[string]bool)
+	for _, sell := range state.InvalidSells {
+		invalidAssets[sell.AssetID] = true
+	}
+
+	// Holdings with no transactions at all predate the ledger; everything else is rewritten from it
+	mismatches := []reconcileItem{}
+	orphans := []reconcileItem{}
+	for _, d := range diffHoldings(state, stored) {
+		switch {
+		case !ledgerAssets[d.AssetID]:
+			orphans = append(orphans, reconcileItem{holdingDiscrepancy: d, Resolution: resolutionBackfillLedger})
+		case invalidAssets[d.AssetID]:
+			mismatches = append(mismatches, reconcileItem{holdingDiscrepancy: d, Resolution: resolutionFixLedger})
+		default:
+			mismatches = append(mismatches, reconcileItem{holdingDiscrepancy: d, Resolution: resolutionRewriteHolding})
+		}
+	}
+
+	invalidSells := state.InvalidSells
+	if invalidSells == nil {
+		invalidSells = []invalidSell{}
+	}
+
+	corrected := 0
+	if !dryRun {
+		for i := range orphans {
+			if err := h.backfillOrphanHolding(tx, userID, portfolioID, orphans[i].AssetID); err != nil {
+				h.respondLedgerError(c, err, "Failed to reconcile portfolio")
+				return
+			}
+			orphans[i].Applied = true
+			corrected++
+		}
+
+		for i := range mismatches {
+			if mismatches[i].Resolution != resolutionRewriteHolding {
+				continue
+			}
+			if _, _, err := h.rebuildHoldings(tx, userID, portfolioID, mismatches[i].AssetID); err != nil {
+				h.respondLedgerError(c, err, "Failed to reconcile portfolio")
+				return
+			}
+			mismatches[i].Applied = true
+			corrected++
+		}
+
+		if err = tx.Commit(); err != nil {
+			h.logger.Error("Failed to commit transaction", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reconcile portfolio"})
+			return
+		}
+
+		if corrected > 0 {
+			h.logger.Info("Reconciled portfolio holdings",
+				zap.String("portfolio_id", portfolioID), zap.Int("corrected", corrected))
+			go h.broadcastPortfolioUpdate(userID, portfolioID)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"portfolio_id": portfolioID,
+		"dry_run":      dryRun,
+		"summary": gin.H{
+			"assets_checked":  len(assets),
+			"mismatches":      len(mismatches),
+			"orphan_holdings": len(orphans),
+			"invalid_sells":   len(invalidSells),
+			"corrected":       corrected,
+		},
+		"mismatches":      mismatches,
+		"orphan_holdings": orphans,
+		"invalid_sells":   invalidSells,
+	})
+}
+
+// Helper function to bring a holding that has no transactions into the ledger as an ADJUST
+// dated at its purchase date, then replay the asset
+func (h *Handler) backfillOrphanHolding(tx *sql.Tx, userID, portfolioID, assetID string) error {
+	var quantity, averageCost float64
+	var purchaseDate time.Time
+	err := tx.QueryRow(`
+		SELECT quantity, average_cost, COALESCE(purchase_date, created_at, NOW())
+		FROM portfolio_holdings
+		WHERE portfolio_id = $1 AND asset_id = $2
+	`, portfolioID, assetID).Scan(&quantity, &averageCost, &purchaseDate)
+	if err != nil {
+		return fmt.Errorf("failed to get holding: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO transactions (user_id, portfolio_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes, transaction_date)
+		VALUES ($1, $2, $3, $4, $5, $6, 0, $7, $8, $9)
+	`, userID, portfolioID, assetID, transactionAdjust, quantity, averageCost, quantity*averageCost,
+		"Backfilled by reconciliation", purchaseDate)
+	if err != nil {
+		return fmt.Errorf("failed to insert transaction: %w", err)
+	}
+	if err = h.invalidateSnapshots(tx, portfolioID, purchaseDate); err != nil {
+		return err
+	}
+
+	_, _, err = h.rebuildHoldings(tx, userID, portfolioID, assetID)
+	return err
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectReconcileReads expects the ledger and holdings reads of a reconciliation:
+// AAPL has drifted from its ledger, MSFT has a sale of more than was bought and TSLA has no transactions
+func expectReconcileReads(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.portfolio_id = \$1 ORDER BY`).
+		WithArgs(testPortfolioID).
+		WillReturnRows(newLedgerRows().
+			AddRow("tx1", "a1", "AAPL", "BUY", 10.0, 100.0, 0.0, time.Now().AddDate(0, -2, 0), "", nil, nil, nil).
+			AddRow("tx2", "a2", "MSFT", "BUY", 5.0, 200.0, 0.0, time.Now().AddDate(0, -2, 0), "", nil, nil, nil).
+			AddRow("tx3", "a2", "MSFT", "SELL", 8.0, 250.0, 0.0, time.Now().AddDate(0, -1, 0), "FIFO", nil, nil, nil))
+	mock.ExpectQuery(`SELECT ph.asset_id, a.symbol, ph.quantity, ph.average_cost FROM portfolio_holdings ph`).
+		WithArgs(testPortfolioID).
+		WillReturnRows(newStoredHoldingRows().
+			AddRow("a1", "AAPL", 8.0, 100.0).
+			AddRow("a2", "MSFT", 5.0, 200.0).
+			AddRow("a3", "TSLA", 3.0, 300.0))
+}
+
+type reconcileResponse struct {
+	DryRun  bool `json:"dry_run"`
+	Summary struct {
+		AssetsChecked  int `json:"assets_checked"`
+		Mismatches     int `json:"mismatches"`
+		OrphanHoldings int `json:"orphan_holdings"`
+		InvalidSells   int `json:"invalid_sells"`
+		Corrected      int `json:"corrected"`
+	} `json:"summary"`
+	Mismatches     []reconcileItem `json:"mismatches"`
+	OrphanHoldings []reconcileItem `json:"orphan_holdings"`
+	InvalidSells   []invalidSell   `json:"invalid_sells"`
+}
+
+// TestReconcilePortfolio tests reporting and applying holdings/ledger reconciliation
+func TestReconcilePortfolio(t *testing.T) {
+	t.Run("dry run reports without writing", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		mock.ExpectBegin()
+		expectReconcileReads(mock)
+		mock.ExpectRollback()
+
+		router := createTestRouter(handler, "GET", "/portfolio/reconcile", handler.ReconcilePortfolio)
+		req, _ := http.NewRequest("GET", "/portfolio/reconcile", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response reconcileResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.True(t, response.DryRun)
+		assert.Equal(t, 3, response.Summary.AssetsChecked)
+		assert.Equal(t, 0, response.Summary.Corrected)
+
+		if assert.Len(t, response.Mismatches, 2) {
+			assert.Equal(t, "AAPL", response.Mismatches[0].Symbol)
+			assert.Equal(t, "updated", response.Mismatches[0].Action)
+			assert.Equal(t, 8.0, response.Mismatches[0].QuantityBefore)
+			assert.Equal(t, 10.0, response.Mismatches[0].QuantityAfter)
+			assert.Equal(t, resolutionRewriteHolding, response.Mismatches[0].Resolution)
+
+			// The oversold asset can't be fixed from the ledger
+			assert.Equal(t, "MSFT", response.Mismatches[1].Symbol)
+			assert.Equal(t, "removed", response.Mismatches[1].Action)
+			assert.Equal(t, resolutionFixLedger, response.Mismatches[1].Resolution)
+		}
+		if assert.Len(t, response.OrphanHoldings, 1) {
+			assert.Equal(t, "TSLA", response.OrphanHoldings[0].Symbol)
+			assert.Equal(t, resolutionBackfillLedger, response.OrphanHoldings[0].Resolution)
+			assert.False(t, response.OrphanHoldings[0].Applied)
+		}
+		if assert.Len(t, response.InvalidSells, 1) {
+			assert.Equal(t, "tx3", response.InvalidSells[0].TransactionID)
+			assert.Equal(t, 8.0, response.InvalidSells[0].Quantity)
+			assert.Equal(t, 5.0, response.InvalidSells[0].AvailableQuantity)
+		}
+
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("apply writes corrections", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		mock.ExpectBegin()
+		expectReconcileReads(mock)
+
+		// The orphan is backfilled into the ledger at its purchase date
+		purchased := time.Now().AddDate(-1, 0, 0)
+		mock.ExpectQuery(`SELECT quantity, average_cost, COALESCE\(purchase_date, created_at, NOW\(\)\) FROM portfolio_holdings WHERE portfolio_id = \$1 AND asset_id = \$2`).
+			WithArgs(testPortfolioID, "a3").
+			WillReturnRows(sqlmock.NewRows([]string{"quantity", "average_cost", "purchase_date"}).AddRow(3.0, 300.0, purchased))
+		mock.ExpectExec(`INSERT INTO transactions \(user_id, portfolio_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes, transaction_date\)`).
+			WithArgs(testUserID, testPortfolioID, "a3", "ADJUST", 3.0, 300.0, 900.0, "Backfilled by reconciliation", purchased).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSnapshotInvalidation(mock, testPortfolioID, purchased.UTC().Format("2006-01-02"))
+		expectReplay(mock, testPortfolioID, "a3",
+			newLedgerRows().AddRow("tx4", "a3", "TSLA", "ADJUST", 3.0, 300.0, 0.0, purchased, "", nil, nil, nil),
+			newStoredHoldingRows().AddRow("a3", "TSLA", 3.0, 300.0),
+			newStoredLotRows())
+		expectLotInsert(mock, "tx4", 3.0, 3.0)
+
+		// The drifted holding is rewritten from its ledger
+		expectReplay(mock, testPortfolioID, "a1",
+			newLedgerRows().AddRow("tx1", "a1", "AAPL", "BUY", 10.0, 100.0, 0.0, time.Now().AddDate(0, -2, 0), "", nil, nil, nil),
+			newStoredHoldingRows().AddRow("a1", "AAPL", 8.0, 100.0),
+			newStoredLotRows().AddRow("lot1", "tx1"))
+		expectLotInsert(mock, "tx1", 10.0, 10.0)
+		expectHoldingUpsert(mock, "a1", 10.0, 100.0)
+		mock.ExpectCommit()
+
+		router := createTestRouter(handler, "POST", "/portfolio/reconcile", handler.ReconcilePortfolio)
+		req, _ := http.NewRequest("POST", "/portfolio/reconcile", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response reconcileResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.False(t, response.DryRun)
+		assert.Equal(t, 2, response.Summary.Corrected)
+		if assert.Len(t, response.Mismatches, 2) {
+			assert.True(t, response.Mismatches[0].Applied)
+			assert.False(t, response.Mismatches[1].Applied)
+		}
+		if assert.Len(t, response.OrphanHoldings, 1) {
+			assert.True(t, response.OrphanHoldings[0].Applied)
+		}
+
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("POST with dry_run only reports", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		mock.ExpectBegin()
+		expectReconcileReads(mock)
+		mock.ExpectRollback()
+
+		router := gin.New()
+		router.Use(withTestUser(testUserID))
+		router.POST("/portfolio/reconcile", handler.ReconcilePortfolio)
+		req, _ := http.NewRequest("POST", "/portfolio/reconcile?dry_run=true", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"dry_run":true`)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Return periods reported by the performance endpoints, in display order
+var returnPeriods = []string{"1M", "3M", "YTD", "1Y", "3Y", "since_inception"}
+
+// daysPerYear is the year length returns are annualized over
+const daysPerYear = 365.25
+
+// valuationPoint is a portfolio's value at one day's close and its net deposits since the previous close
+type valuationPoint struct {
+	Date  time.Time
+	Value float64
+	Flow  float64
+}
+
+// returnFigures is a return over one period, in percent. Annualized is nil for periods shorter than a
+// year, which aren't annualized.
+type returnFigures struct {
+	CumulativePercent *float64 `json:"cumulative_percent"`
+	AnnualizedPercent *float64 `json:"annualized_percent"`
+}
+
+// periodReturn is the time- and money-weighted return between two closes
+type periodReturn struct {
+	Start         string        `json:"start"`
+	End           string        `json:"end"`
+	Days          int           `json:"days"`
+	TimeWeighted  returnFigures `json:"time_weighted"`
+	MoneyWeighted returnFigures `json:"money_weighted"`
+}
+
+// portfolioReturns are a portfolio's returns for each reporting period, as of its latest snapshot.
+// Periods longer than the portfolio's history are nil.
+type portfolioReturns struct {
+	AsOf    string                   `json:"as_of"`
+	Periods map[string]*periodReturn `json:"periods"`
+}
+
+// Helper function to load a portfolio's daily valuations from its snapshots, in date order
+func (h *Handler) loadValuationSeries(portfolioID string) ([]valuationPoint, error) {
+	rows, err := h.services.DB.Query(`
+		SELECT snapshot_date, total_value, COALESCE(net_flow, 0)
+		FROM portfolio_snapshots
+		WHERE portfolio_id = $1
+		ORDER BY snapshot_date ASC
+	`, portfolioID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query snapshots: %w", err)
+	}
+	defer rows.Close()
+
+	var points []valuationPoint
+	for rows.Next() {
+		var point valuationPoint
+		if err := rows.Scan(&point.Date, &point.Value, &point.Flow); err != nil {
+			return nil, fmt.Errorf("failed to scan snapshot: %w", err)
+		}
+		points = append(points, point)
+	}
+	return points, rows.Err()
+}
+
+// Helper function to get a portfolio's time- and money-weighted returns from its daily snapshots. It
+// returns nil when the portfolio has no snapshots yet.
+func (h *Handler) getPortfolioReturns(portfolioID string) (*portfolioReturns, error) {
+	points, err := h.loadValuationSeries(portfolioID)
+	if err != nil {
+		return nil, err
+	}
+	if len(points) == 0 {
+		return nil, nil
+	}
+	return calculateReturns(points), nil
+}
+
+// dailyReturns links each close to the previous one. Flows are taken as arriving at the start of the
+// day, so a day's return is its close over the previous close plus the day's flows; the first day
+// starts from nothing. Days that start with nothing invested return 0.
+func dailyReturns(points []valuationPoint) []float64 {
+	returns := make([]float64, len(points))
+	previous := 0.0
+	for i, point := range points {
+		invested := previous + point.Flow
+		if invested > 0 {
+			returns[i] = point.Value/invested - 1
+		}
+		previous = point.Value
+	}
+	return returns
+}
+
+// periodStart returns the day before the first day of a return period ending on end
+func periodStart(period string, end time.Time) time.Time {
+	switch period {
+	case "1M":
+		return end.AddDate(0, -1, 0)
+	case "3M":
+		return end.AddDate(0, -3, 0)
+	case "YTD":
+		return time.Date(end.Year()-1, 12, 31, 0, 0, 0, 0, time.UTC)
+	case "1Y":
+		return end.AddDate(-1, 0, 0)
+	case "3Y":
+		return end.AddDate(-3, 0, 0)
+	}
+	return time.Time{}
+}
+
+// calculateReturns computes the returns of every reporting period from a portfolio's daily valuations.
+// A period starts from the latest close on or before its start; since inception starts before the
+// first flow.
+func calculateReturns(points []valuationPoint) *portfolioReturns {
+	end := points[len(points)-1].Date
+	returns := &portfolioReturns{
+		AsOf:    end.Format("2006-01-02"),
+		Periods: make(map[string]*periodReturn, len(returnPeriods)),
+	}
+	daily := dailyReturns(points)
+
+	for _, period := range returnPeriods {
+		// base is the index of the close the period starts from, or -1 to start from nothing
+		base := -1
+		start := points[0].Date
+		if period != "since_inception" {
+			start = periodStart(period, end)
+			for i := range points {
+				if points[i].Date.After(start) {
+					break
+				}
+				base = i
+			}
+			if base < 0 {
+				returns.Periods[period] = nil
+				continue
+			}
+			start = points[base].Date
+		}
+		returns.Periods[period] = periodReturnBetween(points, daily, base, start)
+	}
+	return returns
+}
+
+// periodReturnBetween computes the return from the close at base (or from nothing when base is -1,
+// starting on start) up to the last close
+func periodReturnBetween(points []valuationPoint, daily []float64, base int, start time.Time) *periodReturn {
+	last := points[len(points)-1]
+	days := int(math.Round(last.Date.Sub(start).Hours() / 24))
+	result := &periodReturn{
+		Start: start.Format("2006-01-02"),
+		End:   last.Date.Format("2006-01-02"),
+		Days:  days,
+	}
+
+	// Time-weighted: the daily returns linked geometrically
+	growth := 1.0
+	for i := base + 1; i < len(points); i++ {
+		growth *= 1 + daily[i]
+	}
+	result.TimeWeighted = newReturnFigures(growth-1, days)
+
+	// Money-weighted: the internal rate of return of the starting value, the flows and the ending value,
+	// from the investor's side
+	var flows []datedCashFlow
+	if base >= 0 {
+		flows = append(flows, datedCashFlow{Date: points[base].Date, Amount: -points[base].Value})
+	}
+	for i := base + 1; i < len(points); i++ {
+		if points[i].Flow != 0 {
+			flows = append(flows, datedCashFlow{Date: points[i].Date, Amount: -points[i].Flow})
+		}
+	}
+	flows = append(flows, datedCashFlow{Date: last.Date, Amount: last.Value})
+	if days > 0 {
+		if rate, ok := xirr(flows); ok {
+			result.MoneyWeighted = newReturnFigures(math.Pow(1+rate, float64(days)/daysPerYear)-1, days)
+		}
+	}
+	return result
+}
+
+// newReturnFigures converts a cumulative return over days into percentages, annualizing it only when
+// the period is at least a year long
+func newReturnFigures(cumulative float64, days int) returnFigures {
+	cumulativePercent := cumulative * 100
+	figures := returnFigures{CumulativePercent: &cumulativePercent}
+	if float64(days) >= 365 && cumulative > -1 {
+		annualizedPercent := (math.Pow(1+cumulative, daysPerYear/float64(days)) - 1) * 100
+		figures.AnnualizedPercent = &annualizedPercent
+	}
+	return figures
+}
+
+// datedCashFlow is an amount paid (negative) or received (positive) on a day
+type datedCashFlow struct {
+	Date   time.Time
+	Amount float64
+}
+
+// xirr finds the annual rate at which the flows' present value at the first flow's date is zero. It
+// uses Newton's method and falls back to bisection, and reports false when there is no rate, e.g.
+// when every flow has the same sign.
+func xirr(flows []datedCashFlow) (float64, bool) {
+	if len(flows) < 2 {
+		return 0, false
+	}
+	var hasPayment, hasReceipt bool
+	for _, flow := range flows {
+		hasPayment = hasPayment || flow.Amount < 0
+		hasReceipt = hasReceipt || flow.Amount > 0
+	}
+	if !hasPayment || !hasReceipt {
+		return 0, false
+	}
+
+	first := flows[0].Date
+	for _, flow := range flows {
+		if flow.Date.Before(first) {
+			first = flow.Date
+		}
+	}
+	presentValue := func(rate float64) (float64, float64) {
+		var value, derivative float64
+		for _, flow := range flows {
+			years := flow.Date.Sub(first).Hours() / 24 / daysPerYear
+			discount := math.Pow(1+rate, years)
+			value += flow.Amount / discount
+			derivative -= years * flow.Amount / (discount * (1 + rate))
+		}
+		return value, derivative
+	}
+
+	const tolerance = 1e-10
+	rate := 0.1
+	for i := 0; i < 100; i++ {
+		value, derivative := presentValue(rate)
+		if math.Abs(value) < tolerance {
+			return rate, true
+		}
+		if derivative == 0 || math.IsNaN(derivative) {
+			break
+		}
+		next := rate - value/derivative
+		if next <= -1 || math.IsNaN(next) || math.IsInf(next, 0) {
+			break
+		}
+		if math.Abs(next-rate) < tolerance {
+			return next, true
+		}
+		rate = next
+	}
+
+	// Bisection between a near-total loss and a thousandfold gain
+	low, high := -0.999999, 1000.0
+	lowValue, _ := presentValue(low)
+	highValue, _ := presentValue(high)
+	if lowValue*highValue > 0 {
+		return 0, false
+	}
+	for i := 0; i < 200; i++ {
+		mid := (low + high) / 2
+		midValue, _ := presentValue(mid)
+		if math.Abs(midValue) < tolerance || high-low < tolerance {
+			return mid, true
+		}
+		if lowValue*midValue < 0 {
+			high = mid
+		} else {
+			low, lowValue = mid, midValue
+		}
+	}
+	return (low + high) / 2, true
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"math"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDailyReturns tests that linked daily returns ignore deposits and withdrawals
+func TestDailyReturns(t *testing.T) {
+	points := []valuationPoint{
+		{Date: testDay("2024-03-04"), Value: 1000, Flow: 1000},
+		{Date: testDay("2024-03-05"), Value: 1100},
+		{Date: testDay("2024-03-06"), Value: 2200, Flow: 1100},
+		{Date: testDay("2024-03-07"), Value: 2420},
+		{Date: testDay("2024-03-08"), Value: 0, Flow: -2420},
+	}
+
+	returns := dailyReturns(points)
+
+	assert.InDeltaSlice(t, []float64{0, 0.1, 0, 0.1, 0}, returns, 1e-12)
+}
+
+// TestXIRR tests solving the internal rate of return of dated cash flows
+func TestXIRR(t *testing.T) {
+	t.Run("one year", func(t *testing.T) {
+		rate, ok := xirr([]datedCashFlow{
+			{Date: testDay("2023-01-01"), Amount: -1000},
+			{Date: testDay("2024-01-01"), Amount: 1100},
+		})
+		assert.True(t, ok)
+		assert.InDelta(t, math.Pow(1.1, daysPerYear/365)-1, rate, 1e-9)
+	})
+
+	t.Run("a loss with a later deposit", func(t *testing.T) {
+		flows := []datedCashFlow{
+			{Date: testDay("2022-01-03"), Amount: -1000},
+			{Date: testDay("2022-07-01"), Amount: -500},
+			{Date: testDay("2023-01-03"), Amount: 1200},
+		}
+		rate, ok := xirr(flows)
+		assert.True(t, ok)
+		assert.Less(t, rate, 0.0)
+
+		var presentValue float64
+		for _, flow := range flows {
+			years := flow.Date.Sub(flows[0].Date).Hours() / 24 / daysPerYear
+			presentValue += flow.Amount / math.Pow(1+rate, years)
+		}
+		assert.InDelta(t, 0, presentValue, 1e-6)
+	})
+
+	t.Run("no rate without both payments and receipts", func(t *testing.T) {
+		_, ok := xirr([]datedCashFlow{
+			{Date: testDay("2023-01-01"), Amount: -1000},
+			{Date: testDay("2024-01-01"), Amount: -100},
+		})
+		assert.False(t, ok)
+	})
+}
+
+// TestCalculateReturns tests time- and money-weighted returns over the reporting periods
+func TestCalculateReturns(t *testing.T) {
+	points := []valuationPoint{
+		{Date: testDay("2021-01-04"), Value: 1000, Flow: 1000},
+		{Date: testDay("2023-03-10"), Value: 1500},
+		{Date: testDay("2024-02-12"), Value: 1800},
+		{Date: testDay("2024-03-12"), Value: 2100, Flow: 200},
+	}
+
+	returns := calculateReturns(points)
+
+	assert.Equal(t, "2024-03-12", returns.AsOf)
+	assert.Len(t, returns.Periods, len(returnPeriods))
+
+	// One month starts from the 2024-02-12 close; the deposit isn't counted as a gain
+	month := returns.Periods["1M"]
+	if assert.NotNil(t, month) {
+		assert.Equal(t, "2024-02-12", month.Start)
+		assert.Equal(t, 29, month.Days)
+		assert.InDelta(t, 5, *month.TimeWeighted.CumulativePercent, 1e-9)
+		assert.Nil(t, month.TimeWeighted.AnnualizedPercent)
+		assert.InDelta(t, 100*(1900.0/1800-1), *month.MoneyWeighted.CumulativePercent, 1e-6)
+	}
+
+	// One year starts from the latest close on or before 2023-03-12
+	year := returns.Periods["1Y"]
+	if assert.NotNil(t, year) {
+		assert.Equal(t, "2023-03-10", year.Start)
+		assert.InDelta(t, 26, *year.TimeWeighted.CumulativePercent, 1e-9)
+		if assert.NotNil(t, year.TimeWeighted.AnnualizedPercent) {
+			assert.InDelta(t, 100*(math.Pow(1.26, daysPerYear/368)-1), *year.TimeWeighted.AnnualizedPercent, 1e-9)
+		}
+	}
+
+	inception := returns.Periods["since_inception"]
+	if assert.NotNil(t, inception) {
+		assert.Equal(t, "2021-01-04", inception.Start)
+		assert.InDelta(t, 89, *inception.TimeWeighted.CumulativePercent, 1e-9)
+		// 1000 invested grows to 1900 before the final deposit
+		assert.InDelta(t, 90, *inception.MoneyWeighted.CumulativePercent, 1e-6)
+		assert.NotNil(t, inception.MoneyWeighted.AnnualizedPercent)
+	}
+
+	t.Run("periods longer than the history", func(t *testing.T) {
+		returns := calculateReturns(points[2:])
+
+		assert.NotNil(t, returns.Periods["1M"])
+		assert.Nil(t, returns.Periods["1Y"])
+		assert.Nil(t, returns.Periods["3Y"])
+		assert.NotNil(t, returns.Periods["since_inception"])
+	})
+}
+
+// TestGetPortfolioReturns tests that a portfolio without snapshots has no returns yet
+func TestGetPortfolioReturns(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	mock.ExpectQuery(`SELECT snapshot_date, total_value, COALESCE\(net_flow, 0\) FROM portfolio_snapshots WHERE portfolio_id = \$1`).
+		WithArgs(testPortfolioID).
+		WillReturnRows(sqlmock.NewRows([]string{"snapshot_date", "total_value", "net_flow"}))
+
+	returns, err := handler.getPortfolioReturns(testPortfolioID)
+
+	assert.NoError(t, err)
+	assert.Nil(t, returns)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,401 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/portfolio-management/api-gateway/internal/services"
+)
+
+// returnMatrix holds the daily returns of several symbols, measured between the days all of them closed
+type returnMatrix struct {
+	Symbols []string
+	Start   time.Time   // the close the first returns are measured from
+	Dates   []time.Time // the close each return is measured to
+	Returns [][]float64 // per symbol, aligned with Dates
+}
+
+// alignReturns builds the daily returns of symbols over the days every one of them has a close
+func alignReturns(symbols []string, closes closingPrices) returnMatrix {
+	matrix := returnMatrix{Symbols: symbols, Returns: make([][]float64, len(symbols))}
+	if len(symbols) == 0 {
+		return matrix
+	}
+
+	byDay := make([]map[string]float64, len(symbols))
+	for i, symbol := range symbols {
+		byDay[i] = map[string]float64{}
+		for _, price := range closes[symbol] {
+			if price.Close > 0 {
+				byDay[i][price.Date.Format("2006-01-02")] = price.Close
+			}
+		}
+	}
+
+	// The first symbol's days, in order, are the candidates every other symbol must share
+	var previous []float64
+	for _, price := range closes[symbols[0]] {
+		day := price.Date.Format("2006-01-02")
+		dayCloses := make([]float64, len(symbols))
+		aligned := true
+		for i := range symbols {
+			dayClose, ok := byDay[i][day]
+			if !ok {
+				aligned = false
+				break
+			}
+			dayCloses[i] = dayClose
+		}
+		if !aligned {
+			continue
+		}
+
+		if previous == nil {
+			matrix.Start = price.Date
+		} else {
+			matrix.Dates = append(matrix.Dates, price.Date)
+			for i := range symbols {
+				matrix.Returns[i] = append(matrix.Returns[i], dayCloses[i]/previous[i]-1)
+			}
+		}
+		previous = dayCloses
+	}
+	return matrix
+}
+
+// weighted returns the daily returns of a portfolio holding the symbols at constant weights. Symbols
+// outside the matrix are ignored.
+func (m returnMatrix) weighted(weights map[string]float64) []float64 {
+	returns := make([]float64, len(m.Dates))
+	for i, symbol := range m.Symbols {
+		weight := weights[symbol]
+		if weight == 0 {
+			continue
+		}
+		for j, r := range m.Returns[i] {
+			returns[j] += weight * r
+		}
+	}
+	return returns
+}
+
+// benchmarkWeights returns a benchmark's components as weights by symbol
+func benchmarkWeights(components []services.BenchmarkComponent) map[string]float64 {
+	weights := make(map[string]float64, len(components))
+	for _, component := range components {
+		weights[component.Symbol] = component.Weight
+	}
+	return weights
+}
+
+// sampleCovariance returns the sample covariance of two equally long series, or 0 for fewer than two
+// observations
+func sampleCovariance(a, b []float64) float64 {
+	if len(a) < 2 || len(a) != len(b) {
+		return 0
+	}
+	meanA, meanB := mean(a), mean(b)
+	var sum float64
+	for i := range a {
+		sum += (a[i] - meanA) * (b[i] - meanB)
+	}
+	return sum / float64(len(a)-1)
+}
+
+// betaOf returns the beta of returns against benchmark returns, or nil when the benchmark doesn't vary
+func betaOf(returns, benchmark []float64) *float64 {
+	variance := sampleCovariance(benchmark, benchmark)
+	if variance == 0 {
+		return nil
+	}
+	return optionalFloat(sampleCovariance(returns, benchmark) / variance)
+}
+
+// riskHolding is a holding and its current market value in the base currency
+type riskHolding struct {
+	Symbol      string
+	Currency    string
+	Quantity    float64
+	MarketValue float64
+}
+
+// assetRisk is one holding's weight and its risk over the lookback window
+type assetRisk struct {
+	Symbol            string   `json:"symbol"`
+	WeightPercent     float64  `json:"weight_percent"`
+	VolatilityPercent *float64 `json:"volatility_percent"`
+	Beta              *float64 `json:"beta"`
+}
+
+// portfolioRisk is the risk of the current holdings over a lookback window, from their daily returns.
+// Figures that need more observations than there are are nil.
+type portfolioRisk struct {
+	Observations       int
+	Start, End         time.Time
+	Assets             []assetRisk
+	VolatilityPercent  *float64 // annualized
+	ReturnPercent      *float64 // annualized mean daily return
+	Beta               *float64
+	SharpeRatio        *float64
+	SortinoRatio       *float64
+	MaxDrawdownPercent *float64
+	DrawdownPeak       *time.Time
+	DrawdownTrough     *time.Time
+}
+
+// calculatePortfolioRisk measures the holdings at their current weights over the returns in matrix,
+// which must cover every holding and benchmark symbol
+func calculatePortfolioRisk(holdings []riskHolding, benchmark []services.BenchmarkComponent, matrix returnMatrix, riskFreeRate float64) portfolioRisk {
+	risk := portfolioRisk{Observations: len(matrix.Dates), Start: matrix.Start}
+	if len(matrix.Dates) > 0 {
+		risk.End = matrix.Dates[len(matrix.Dates)-1]
+	}
+
+	var total float64
+	for _, holding := range holdings {
+		total += holding.MarketValue
+	}
+	weights := map[string]float64{}
+	for _, holding := range holdings {
+		if total > 0 {
+			weights[holding.Symbol] += holding.MarketValue / total
+		}
+	}
+	benchmarkReturns := matrix.weighted(benchmarkWeights(benchmark))
+	annualize := math.Sqrt(tradingDaysPerYear)
+
+	index := map[string]int{}
+	for i, symbol := range matrix.Symbols {
+		index[symbol] = i
+	}
+	for _, holding := range holdings {
+		asset := assetRisk{Symbol: holding.Symbol, WeightPercent: weights[holding.Symbol] * 100}
+		if i, ok := index[holding.Symbol]; ok && risk.Observations >= 2 {
+			asset.VolatilityPercent = optionalFloat(sampleStdDev(matrix.Returns[i]) * annualize * 100)
+			asset.Beta = betaOf(matrix.Returns[i], benchmarkReturns)
+		}
+		risk.Assets = append(risk.Assets, asset)
+	}
+
+	if risk.Observations < 2 || total <= 0 {
+		return risk
+	}
+
+	returns := matrix.weighted(weights)
+	volatility := sampleStdDev(returns) * annualize
+	annualReturn := mean(returns) * tradingDaysPerYear
+	risk.VolatilityPercent = optionalFloat(volatility * 100)
+	risk.ReturnPercent = optionalFloat(annualReturn * 100)
+	risk.Beta = betaOf(returns, benchmarkReturns)
+	if volatility > 0 {
+		risk.SharpeRatio = optionalFloat((annualReturn - riskFreeRate) / volatility)
+	}
+
+	// Sortino only penalizes days that fall short of the daily risk-free rate
+	dailyRiskFree := riskFreeRate / tradingDaysPerYear
+	var downside float64
+	for _, r := range returns {
+		if shortfall := r - dailyRiskFree; shortfall < 0 {
+			downside += shortfall * shortfall
+		}
+	}
+	if downside > 0 {
+		downsideDeviation := math.Sqrt(downside/float64(len(returns))) * annualize
+		risk.SortinoRatio = optionalFloat((annualReturn - riskFreeRate) / downsideDeviation)
+	}
+
+	// The deepest fall of the compounded returns from a previous high
+	value, peak, maxDrawdown := 1.0, 1.0, 0.0
+	peakDate := matrix.Start
+	for i, r := range returns {
+		value *= 1 + r
+		if value > peak {
+			peak, peakDate = value, matrix.Dates[i]
+			continue
+		}
+		if drawdown := value/peak - 1; drawdown < maxDrawdown {
+			maxDrawdown = drawdown
+			peakAt, troughAt := peakDate, matrix.Dates[i]
+			risk.DrawdownPeak, risk.DrawdownTrough = &peakAt, &troughAt
+		}
+	}
+	risk.MaxDrawdownPercent = optionalFloat(maxDrawdown * 100)
+	return risk
+}
+
+// Helper function to read the annual risk-free rate from the "risk_free_rate" query parameter, as a
+// fraction, or the configured default
+func (h *Handler) requestedRiskFreeRate(c *gin.Context) (float64, bool) {
+	value := c.Query("risk_free_rate")
+	if value == "" {
+		return h.services.Analytics.RiskFreeRate, true
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(rate) || math.Abs(rate) >= 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid risk_free_rate, expected an annual rate as a fraction such as 0.04"})
+		return 0, false
+	}
+	return rate, true
+}
+
+// Helper function to load a portfolio's holdings, valued in its base currency at current prices, or at
+// cost without a quote
+func (h *Handler) loadRiskHoldings(portfolioID string, fx *fxConverter) ([]riskHolding, error) {
+	rows, err := h.services.DB.Query(`
+		SELECT
+			a.symbol,
+			COALESCE(a.currency, 'USD') as currency,
+			ph.quantity,
+			ph.average_cost,
+			(ph.quantity * ph.average_cost) as position_value
+		FROM portfolio_holdings ph
+		JOIN assets a ON ph.asset_id = a.id
+		WHERE ph.portfolio_id = $1
+	`, portfolioID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query holdings: %w", err)
+	}
+	defer rows.Close()
+
+	var holdings []riskHolding
+	for rows.Next() {
+		var symbol, currency string
+		var quantity, averageCost, positionValue float64
+		if err := rows.Scan(&symbol, &currency, &quantity, &averageCost, &positionValue); err != nil {
+			return nil, fmt.Errorf("failed to scan holding: %w", err)
+		}
+
+		rate, err := fx.rate(currency)
+		if err != nil {
+			return nil, err
+		}
+
+		marketValue := positionValue
+		if h.services.MarketData != nil {
+			if quote, priceErr := h.services.MarketData.GetQuote(symbol); priceErr == nil {
+				marketValue = quantity * quote.CurrentPrice
+			} else {
+				h.logger.Warn("Failed to fetch price for risk metrics", zap.String("symbol", symbol), zap.Error(priceErr))
+			}
+		}
+		holdings = append(holdings, riskHolding{Symbol: symbol, Currency: currency, Quantity: quantity, MarketValue: marketValue * rate})
+	}
+	return holdings, rows.Err()
+}
+
+// Helper function to load the aligned daily returns of holdings, and of extra symbols such as a
+// benchmark's, over a window. Holdings without price history are left out of the returned holdings,
+// and each symbol left out is named in a warning.
+func (h *Handler) loadHoldingReturns(holdings []riskHolding, extra []string, from, to time.Time) (returnMatrix, []riskHolding, []string, error) {
+	var symbols []string
+	seen := map[string]bool{}
+	for _, holding := range holdings {
+		if !seen[holding.Symbol] {
+			seen[holding.Symbol] = true
+			symbols = append(symbols, holding.Symbol)
+		}
+	}
+	if len(symbols) == 0 {
+		return returnMatrix{}, nil, nil, nil
+	}
+	for _, symbol := range extra {
+		if !seen[symbol] {
+			seen[symbol] = true
+			symbols = append(symbols, symbol)
+		}
+	}
+
+	matrix, warnings, err := h.loadAlignedReturns(symbols, from, to)
+	if err != nil {
+		return returnMatrix{}, nil, nil, err
+	}
+
+	priced := map[string]bool{}
+	for _, symbol := range matrix.Symbols {
+		priced[symbol] = true
+	}
+	var pricedHoldings []riskHolding
+	for _, holding := range holdings {
+		if priced[holding.Symbol] {
+			pricedHoldings = append(pricedHoldings, holding)
+		}
+	}
+	return matrix, pricedHoldings, warnings, nil
+}
+
+// Helper function to load the aligned daily returns of symbols over a window. Symbols without price
+// history are left out of the matrix, each with a warning.
+func (h *Handler) loadAlignedReturns(symbols []string, from, to time.Time) (returnMatrix, []string, error) {
+	closes, err := h.loadSymbolCloses(symbols, from, to)
+	if err != nil {
+		return returnMatrix{}, nil, err
+	}
+
+	var priced []string
+	var warnings []string
+	for _, symbol := range symbols {
+		if len(closes[symbol]) == 0 {
+			warnings = append(warnings, fmt.Sprintf("No price history for %s in the lookback window", symbol))
+			continue
+		}
+		priced = append(priced, symbol)
+	}
+	return alignReturns(priced, closes), warnings, nil
+}
+
+// holdingWeights returns the holdings' share of their total market value for each symbol, and the total
+func holdingWeights(holdings []riskHolding, symbols []string) ([]float64, float64) {
+	bySymbol := map[string]float64{}
+	var total float64
+	for _, holding := range holdings {
+		bySymbol[holding.Symbol] += holding.MarketValue
+		total += holding.MarketValue
+	}
+	weights := make([]float64, len(symbols))
+	if total > 0 {
+		for i, symbol := range symbols {
+			weights[i] = bySymbol[symbol] / total
+		}
+	}
+	return weights, total
+}
+
+// formatOptionalDate formats a day as YYYY-MM-DD, or nil
+func formatOptionalDate(day *time.Time) interface{} {
+	if day == nil {
+		return nil
+	}
+	return day.Format("2006-01-02")
+}
+
+// lookbackStart parses the "lookback" query parameter into the first day of the window ending today
+func lookbackStart(c *gin.Context, today time.Time) (string, time.Time, bool) {
+	lookback := c.DefaultQuery("lookback", "1y")
+	start, ok := priceHistoryStart(lookback, today)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid lookback %q, expected 7d, 30d, 90d, 1y, ytd, 5y or max", lookback)})
+		return "", time.Time{}, false
+	}
+	return lookback, start, true
+}
+
+// lookbackWindow describes a lookback window and the closes of the returns measured in it
+func lookbackWindow(lookback string, from, to time.Time, matrix returnMatrix) map[string]interface{} {
+	window := map[string]interface{}{
+		"lookback":     lookback,
+		"from":         from.Format("2006-01-02"),
+		"to":           to.Format("2006-01-02"),
+		"observations": len(matrix.Dates),
+	}
+	if len(matrix.Dates) > 0 {
+		window["first_close"] = matrix.Start.Format("2006-01-02")
+		window["last_close"] = matrix.Dates[len(matrix.Dates)-1].Format("2006-01-02")
+	}
+	return window
+}
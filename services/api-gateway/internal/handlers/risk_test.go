@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"math"
+	"testing"
+
+	"github.com/portfolio-management/api-gateway/internal/services"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAlignReturns tests that returns are only measured between days every symbol closed
+func TestAlignReturns(t *testing.T) {
+	closes := closingPrices{
+		"AAA": {
+			{Date: testDay("2024-03-04"), Close: 100},
+			{Date: testDay("2024-03-05"), Close: 110},
+			{Date: testDay("2024-03-06"), Close: 121},
+			{Date: testDay("2024-03-07"), Close: 133.1},
+		},
+		"BBB": {
+			{Date: testDay("2024-03-04"), Close: 50},
+			{Date: testDay("2024-03-06"), Close: 55},
+			{Date: testDay("2024-03-07"), Close: 44},
+		},
+	}
+
+	matrix := alignReturns([]string{"AAA", "BBB"}, closes)
+
+	assert.Equal(t, testDay("2024-03-04"), matrix.Start)
+	assert.Equal(t, []string{"AAA", "BBB"}, matrix.Symbols)
+	if assert.Len(t, matrix.Dates, 2) {
+		assert.Equal(t, testDay("2024-03-06"), matrix.Dates[0])
+		assert.InDeltaSlice(t, []float64{0.21, 0.1}, matrix.Returns[0], 1e-12)
+		assert.InDeltaSlice(t, []float64{0.1, -0.2}, matrix.Returns[1], 1e-12)
+	}
+	assert.InDeltaSlice(t, []float64{0.155, -0.05}, matrix.weighted(map[string]float64{"AAA": 0.5, "BBB": 0.5}), 1e-12)
+}
+
+// TestCalculatePortfolioRisk tests volatility, beta, Sharpe, Sortino and drawdown of weighted holdings
+func TestCalculatePortfolioRisk(t *testing.T) {
+	closes := closingPrices{
+		"AAA": {
+			{Date: testDay("2024-03-04"), Close: 100},
+			{Date: testDay("2024-03-05"), Close: 110},
+			{Date: testDay("2024-03-06"), Close: 99},
+			{Date: testDay("2024-03-07"), Close: 108.9},
+			{Date: testDay("2024-03-08"), Close: 104.544},
+		},
+		"BBB": {
+			{Date: testDay("2024-03-04"), Close: 50},
+			{Date: testDay("2024-03-05"), Close: 50},
+			{Date: testDay("2024-03-06"), Close: 50},
+			{Date: testDay("2024-03-07"), Close: 50},
+			{Date: testDay("2024-03-08"), Close: 50},
+		},
+	}
+	matrix := alignReturns([]string{"AAA", "BBB"}, closes)
+	holdings := []riskHolding{{Symbol: "AAA", MarketValue: 500}, {Symbol: "BBB", MarketValue: 500}}
+	benchmark := []services.BenchmarkComponent{{Symbol: "AAA", Weight: 1}}
+
+	risk := calculatePortfolioRisk(holdings, benchmark, matrix, 0.02)
+
+	assert.Equal(t, 4, risk.Observations)
+	assert.Equal(t, testDay("2024-03-04"), risk.Start)
+	assert.Equal(t, testDay("2024-03-08"), risk.End)
+
+	returns := []float64{0.05, -0.05, 0.05, -0.02}
+	volatility := sampleStdDev(returns) * math.Sqrt(tradingDaysPerYear)
+	annualReturn := mean(returns) * tradingDaysPerYear
+	assert.InDelta(t, volatility*100, *risk.VolatilityPercent, 1e-9)
+	assert.InDelta(t, annualReturn*100, *risk.ReturnPercent, 1e-9)
+	assert.InDelta(t, 0.5, *risk.Beta, 1e-9)
+	assert.InDelta(t, (annualReturn-0.02)/volatility, *risk.SharpeRatio, 1e-9)
+
+	dailyRiskFree := 0.02 / tradingDaysPerYear
+	downside := math.Sqrt((math.Pow(-0.05-dailyRiskFree, 2)+math.Pow(-0.02-dailyRiskFree, 2))/4) * math.Sqrt(tradingDaysPerYear)
+	assert.InDelta(t, (annualReturn-0.02)/downside, *risk.SortinoRatio, 1e-9)
+
+	// The deepest fall is from the first day's high to the next day's close
+	assert.InDelta(t, -5, *risk.MaxDrawdownPercent, 1e-9)
+	assert.Equal(t, testDay("2024-03-05"), *risk.DrawdownPeak)
+	assert.Equal(t, testDay("2024-03-06"), *risk.DrawdownTrough)
+
+	if assert.Len(t, risk.Assets, 2) {
+		assert.Equal(t, 50.0, risk.Assets[0].WeightPercent)
+		assert.InDelta(t, 1, *risk.Assets[0].Beta, 1e-9)
+		assert.InDelta(t, 0, *risk.Assets[1].VolatilityPercent, 1e-12)
+	}
+
+	t.Run("too few observations", func(t *testing.T) {
+		matrix := alignReturns([]string{"AAA"}, closingPrices{"AAA": closes["AAA"][:2]})
+
+		risk := calculatePortfolioRisk(holdings[:1], benchmark, matrix, 0.02)
+
+		assert.Equal(t, 1, risk.Observations)
+		assert.Nil(t, risk.VolatilityPercent)
+		assert.Nil(t, risk.SharpeRatio)
+		assert.Nil(t, risk.MaxDrawdownPercent)
+	})
+}
@@ -0,0 +1,1039 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// Scenario trade actions
+const (
+	scenarioBuy  = "buy"
+	scenarioSell = "sell"
+)
+
+// maxComparedScenarios is how many saved scenarios can be compared at once
+const maxComparedScenarios = 10
+
+// scenarioError is a scenario that can't be run against the portfolio as it stands
+type scenarioError struct {
+	message string
+}
+
+func (e *scenarioError) Error() string {
+	return e.message
+}
+
+// newScenarioError formats a scenarioError
+func newScenarioError(format string, args ...interface{}) error {
+	return &scenarioError{message: fmt.Sprintf(format, args...)}
+}
+
+// scenarioTrade is one trade of a scenario. Without a price it's made at the current market price, in
+// the asset's currency.
+type scenarioTrade struct {
+	Action   string   `json:"action" binding:"required,oneof=buy sell"`
+	Symbol   string   `json:"symbol" binding:"required"`
+	Quantity float64  `json:"quantity" binding:"required,gt=0"`
+	Price    *float64 `json:"price,omitempty" binding:"omitempty,gt=0"`
+	Fees     float64  `json:"fees" binding:"gte=0"`
+}
+
+// scenarioShocks move market prices by a fraction, such as -0.2 for a 20% fall, keyed by symbol or
+// sector. A symbol's own shock wins over its sector's.
+type scenarioShocks struct {
+	Symbols map[string]float64 `json:"symbols,omitempty"`
+	Sectors map[string]float64 `json:"sectors,omitempty"`
+}
+
+// scenarioDefinition is a basket of trades, made in order, and the price shocks applied after them
+type scenarioDefinition struct {
+	Trades []scenarioTrade `json:"trades"`
+	Shocks scenarioShocks  `json:"shocks"`
+}
+
+// normalize uppercases symbols and checks the scenario does something and that no price falls below zero
+func (d *scenarioDefinition) normalize() error {
+	if len(d.Trades) == 0 && len(d.Shocks.Symbols) == 0 && len(d.Shocks.Sectors) == 0 {
+		return errors.New("a scenario needs at least one trade or price shock")
+	}
+	if d.Trades == nil {
+		d.Trades = []scenarioTrade{}
+	}
+	for i := range d.Trades {
+		d.Trades[i].Symbol = normalizeTargetKey(d.Trades[i].Symbol)
+	}
+
+	symbols := map[string]float64{}
+	for key, shock := range d.Shocks.Symbols {
+		symbol := normalizeTargetKey(key)
+		if _, ok := symbols[symbol]; ok {
+			return fmt.Errorf("%s is shocked more than once", symbol)
+		}
+		if shock <= -1 {
+			return fmt.Errorf("the shock on %s must be above -1, a 100%% fall", symbol)
+		}
+		symbols[symbol] = shock
+	}
+	sectors := map[string]float64{}
+	seen := map[string]bool{}
+	for key, shock := range d.Shocks.Sectors {
+		sector := strings.TrimSpace(key)
+		if seen[strings.ToUpper(sector)] {
+			return fmt.Errorf("%s is shocked more than once", sector)
+		}
+		if shock <= -1 {
+			return fmt.Errorf("the shock on %s must be above -1, a 100%% fall", sector)
+		}
+		seen[strings.ToUpper(sector)] = true
+		sectors[sector] = shock
+	}
+	d.Shocks.Symbols, d.Shocks.Sectors = nil, nil
+	if len(symbols) > 0 {
+		d.Shocks.Symbols = symbols
+	}
+	if len(sectors) > 0 {
+		d.Shocks.Sectors = sectors
+	}
+	return nil
+}
+
+// shock returns the fraction a holding's price moves by
+func (d scenarioDefinition) shock(holding rebalanceHolding) (float64, string) {
+	if shock, ok := d.Shocks.Symbols[holding.Symbol]; ok {
+		return shock, holding.Symbol
+	}
+	for sector, shock := range d.Shocks.Sectors {
+		if holding.Sector != "" && strings.EqualFold(sector, holding.Sector) {
+			return shock, sector
+		}
+	}
+	return 0, ""
+}
+
+// scenarioPosition is a holding before or after a scenario, valued in the base currency
+type scenarioPosition struct {
+	Symbol        string  `json:"symbol"`
+	AssetType     string  `json:"asset_type"`
+	Sector        string  `json:"sector,omitempty"`
+	Currency      string  `json:"currency"`
+	Quantity      float64 `json:"quantity"`
+	Price         float64 `json:"price"` // in Currency
+	MarketValue   float64 `json:"market_value"`
+	WeightPercent float64 `json:"weight_percent"`
+}
+
+// scenarioRisk is the risk of the whole portfolio, cash included, from its holdings' daily returns
+type scenarioRisk struct {
+	VolatilityPercent      *float64 `json:"volatility_percent"` // annualized
+	VaR95Percent           *float64 `json:"var_95_percent"`     // one-day parametric, as a positive loss
+	DiversificationRatio   *float64 `json:"diversification_ratio"`
+	LargestPositionPercent float64  `json:"largest_position_percent"`
+}
+
+// scenarioState is a portfolio's value, allocation and risk before or after a scenario
+type scenarioState struct {
+	TotalValue    float64            `json:"total_value"`
+	HoldingsValue float64            `json:"holdings_value"`
+	CashValue     float64            `json:"cash_value"`
+	CashPercent   float64            `json:"cash_percent"`
+	CashBalances  []cashBalance      `json:"cash_balances"`
+	Positions     []scenarioPosition `json:"positions"`
+	ByAssetType   map[string]float64 `json:"by_asset_type"` // percent of the total value
+	BySector      map[string]float64 `json:"by_sector"`
+	Risk          scenarioRisk       `json:"risk"`
+}
+
+// newScenarioState values holdings and cash in the base currency
+func newScenarioState(holdings []rebalanceHolding, balances []cashBalance, fx *fxConverter) (scenarioState, error) {
+	state := scenarioState{
+		CashBalances: balances,
+		Positions:    []scenarioPosition{},
+		ByAssetType:  map[string]float64{},
+		BySector:     map[string]float64{},
+	}
+	for _, balance := range balances {
+		converted, err := fx.convert(balance.Balance, balance.Currency)
+		if err != nil {
+			return scenarioState{}, err
+		}
+		state.CashValue += converted
+	}
+	for _, holding := range holdings {
+		if holding.Quantity <= lotQuantityEpsilon {
+			continue
+		}
+		state.Positions = append(state.Positions, scenarioPosition{
+			Symbol:      holding.Symbol,
+			AssetType:   holding.AssetType,
+			Sector:      holding.Sector,
+			Currency:    holding.Currency,
+			Quantity:    holding.Quantity,
+			Price:       holding.Price,
+			MarketValue: holding.value(),
+		})
+		state.HoldingsValue += holding.value()
+	}
+	sort.Slice(state.Positions, func(i, j int) bool { return state.Positions[i].Symbol < state.Positions[j].Symbol })
+
+	state.TotalValue = state.HoldingsValue + state.CashValue
+	if state.TotalValue <= 0 {
+		return state, nil
+	}
+	state.CashPercent = state.CashValue / state.TotalValue * 100
+	for i, position := range state.Positions {
+		weight := position.MarketValue / state.TotalValue * 100
+		state.Positions[i].WeightPercent = weight
+		state.Risk.LargestPositionPercent = math.Max(state.Risk.LargestPositionPercent, weight)
+		state.ByAssetType[position.AssetType] += weight
+		sector := position.Sector
+		if sector == "" {
+			sector = "Unclassified"
+		}
+		state.BySector[sector] += weight
+	}
+	return state, nil
+}
+
+// measureRisk fills in the state's volatility, VaR and diversification from the covariance of its
+// holdings' daily returns. Cash is riskless, and holdings without price history are left out.
+func (s *scenarioState) measureRisk(covariance returnCovariance, means []float64, observations int) {
+	if observations < 2 || s.TotalValue <= 0 {
+		return
+	}
+	bySymbol := map[string]float64{}
+	for _, position := range s.Positions {
+		bySymbol[position.Symbol] += position.MarketValue / s.TotalValue
+	}
+	weights := make([]float64, len(covariance.Symbols))
+	for i, symbol := range covariance.Symbols {
+		weights[i] = bySymbol[symbol]
+	}
+
+	s.Risk.VolatilityPercent = optionalFloat(math.Sqrt(covariance.portfolioVariance(weights)*tradingDaysPerYear) * 100)
+	estimate := parametricVaR(covariance.Symbols, weights, means, covariance.Covariance, 1, 0.95, s.TotalValue)
+	s.Risk.VaR95Percent = optionalFloat(estimate.VaRPercent)
+	s.Risk.DiversificationRatio = covariance.diversificationRatio(weights)
+}
+
+// scenarioFill is a scenario's trade as made
+type scenarioFill struct {
+	Action      string   `json:"action"`
+	Symbol      string   `json:"symbol"`
+	Quantity    float64  `json:"quantity"`
+	Price       float64  `json:"price"` // in Currency
+	Currency    string   `json:"currency"`
+	Fees        float64  `json:"fees"`
+	CashAmount  float64  `json:"cash_amount"`            // in Currency; negative for buys
+	RealizedPnL *float64 `json:"realized_pnl,omitempty"` // in the base currency
+}
+
+// scenarioImpact is how a scenario changes the portfolio's value, in the base currency
+type scenarioImpact struct {
+	ValueChange        float64 `json:"value_change"`
+	ValueChangePercent float64 `json:"value_change_percent"`
+	ShockImpact        float64 `json:"shock_impact"`
+	Fees               float64 `json:"fees"`
+	CashChange         float64 `json:"cash_change"`
+}
+
+// scenarioOutcome is the portfolio after a scenario, and what the scenario's trades realized
+type scenarioOutcome struct {
+	After    scenarioState
+	Fills    []scenarioFill
+	Realized realizedBucket
+	Impact   scenarioImpact
+	Warnings []string
+}
+
+// runScenario makes a scenario's trades against the holdings, lots and cash, then applies its price
+// shocks. Assets that aren't held can be bought from assets; sales realize gains against the open
+// lots picked by method.
+func runScenario(definition scenarioDefinition, holdings []rebalanceHolding, assets map[string]rebalanceHolding, lots map[string][]taxLot, method string, cash []cashBalance, fx *fxConverter) (scenarioOutcome, error) {
+	outcome := scenarioOutcome{Fills: []scenarioFill{}}
+
+	positions := map[string]*rebalanceHolding{}
+	for _, holding := range holdings {
+		holding := holding
+		positions[holding.Symbol] = &holding
+	}
+	open := map[string][]taxLot{}
+	for symbol, symbolLots := range lots {
+		open[symbol] = append([]taxLot(nil), symbolLots...)
+	}
+	balances := map[string]float64{}
+	for _, balance := range cash {
+		balances[balance.Currency] += balance.Balance
+	}
+	// A scenario can't pick specific lots
+	if method == costBasisSpecific || method == "" {
+		method = costBasisFIFO
+	}
+
+	for i, trade := range definition.Trades {
+		position, held := positions[trade.Symbol]
+		if !held {
+			asset, known := assets[trade.Symbol]
+			if !known {
+				if trade.Action == scenarioSell {
+					return scenarioOutcome{}, newScenarioError("trade %d sells %s, which isn't held", i+1, trade.Symbol)
+				}
+				return scenarioOutcome{}, newScenarioError("trade %d buys %s, which isn't a known asset", i+1, trade.Symbol)
+			}
+			asset.Quantity, asset.AverageCost = 0, 0
+			position = &asset
+			positions[trade.Symbol] = position
+		}
+
+		price := position.Price
+		if trade.Price != nil {
+			price = *trade.Price
+		}
+		if price <= 0 {
+			return scenarioOutcome{}, newScenarioError("trade %d has no market price for %s, so it needs a price", i+1, trade.Symbol)
+		}
+
+		fill := scenarioFill{
+			Action:   trade.Action,
+			Symbol:   trade.Symbol,
+			Quantity: trade.Quantity,
+			Price:    price,
+			Currency: position.Currency,
+			Fees:     trade.Fees,
+		}
+		switch trade.Action {
+		case scenarioBuy:
+			fill.CashAmount = -(trade.Quantity*price + trade.Fees)
+			cost := position.Quantity*position.AverageCost + trade.Quantity*price
+			position.Quantity += trade.Quantity
+			position.AverageCost = cost / position.Quantity
+			open[trade.Symbol] = append(open[trade.Symbol], taxLot{
+				ID:                fmt.Sprintf("trade-%d", i+1),
+				Quantity:          trade.Quantity,
+				RemainingQuantity: trade.Quantity,
+				UnitCost:          price,
+				Fees:              trade.Fees,
+				AcquiredAt:        fx.today,
+			})
+
+		case scenarioSell:
+			if trade.Quantity > position.Quantity+lotQuantityEpsilon {
+				return scenarioOutcome{}, newScenarioError("trade %d sells %g %s, but only %g are held", i+1, trade.Quantity, trade.Symbol, position.Quantity)
+			}
+			fill.CashAmount = trade.Quantity*price - trade.Fees
+
+			realizedBefore := outcome.Realized.Realized
+			remaining, covered, err := sellLots(open[trade.Symbol], method, trade.Quantity, price, trade.Fees, position.Currency, fx, &outcome.Realized)
+			if err != nil {
+				return scenarioOutcome{}, err
+			}
+			if covered {
+				open[trade.Symbol] = remaining
+			} else {
+				rate, err := fx.rate(position.Currency)
+				if err != nil {
+					return scenarioOutcome{}, err
+				}
+				outcome.Realized.add(trade.Quantity, trade.Quantity*position.AverageCost*rate, fill.CashAmount*rate, holdingPeriodShortTerm)
+				outcome.Warnings = append(outcome.Warnings, fmt.Sprintf("No tax lots cover the sale of %s, so its gain is measured against the average cost and counted as short-term", trade.Symbol))
+			}
+			fill.RealizedPnL = optionalFloat(outcome.Realized.Realized - realizedBefore)
+
+			position.Quantity -= trade.Quantity
+			if position.Quantity < lotQuantityEpsilon {
+				position.Quantity = 0
+			}
+		}
+		balances[position.Currency] += fill.CashAmount
+		outcome.Impact.Fees += trade.Fees * position.Rate
+		outcome.Fills = append(outcome.Fills, fill)
+	}
+
+	// Prices move once the trades are made
+	shocked := map[string]bool{}
+	after := make([]rebalanceHolding, 0, len(positions))
+	for _, position := range positions {
+		holding := *position
+		if shock, key := definition.shock(holding); key != "" {
+			shocked[strings.ToUpper(key)] = true
+			outcome.Impact.ShockImpact += holding.value() * shock
+			holding.Price *= 1 + shock
+		}
+		after = append(after, holding)
+	}
+	for symbol := range definition.Shocks.Symbols {
+		if !shocked[symbol] {
+			outcome.Warnings = append(outcome.Warnings, fmt.Sprintf("The shock on %s matches no holding", symbol))
+		}
+	}
+	for sector := range definition.Shocks.Sectors {
+		if !shocked[strings.ToUpper(sector)] {
+			outcome.Warnings = append(outcome.Warnings, fmt.Sprintf("The shock on %s matches no holding", sector))
+		}
+	}
+	sort.Strings(outcome.Warnings)
+
+	cashAfter := []cashBalance{}
+	for currency, balance := range balances {
+		cashAfter = append(cashAfter, cashBalance{Currency: currency, Balance: balance})
+	}
+	sort.Slice(cashAfter, func(i, j int) bool { return cashAfter[i].Currency < cashAfter[j].Currency })
+	for _, balance := range cashAfter {
+		if balance.Balance < -lotQuantityEpsilon {
+			outcome.Warnings = append(outcome.Warnings, fmt.Sprintf("The trades overdraw the %s cash by %.2f", balance.Currency, -balance.Balance))
+		}
+	}
+
+	state, err := newScenarioState(after, cashAfter, fx)
+	if err != nil {
+		return scenarioOutcome{}, err
+	}
+	outcome.After = state
+	return outcome, nil
+}
+
+// sellLots realizes the sale of quantity at price, net of fees, against the open lots picked by method,
+// into bucket. Costs convert into the base currency at the rates of the days the lots were acquired, and
+// proceeds at today's. It returns the lots left open, or false when the lots don't cover the sale.
+func sellLots(lots []taxLot, method string, quantity, price, fees float64, currency string, fx *fxConverter, bucket *realizedBucket) ([]taxLot, bool, error) {
+	allocations, err := selectLots(lots, method, quantity, nil)
+	if err != nil {
+		return lots, false, nil
+	}
+	rate, err := fx.rate(currency)
+	if err != nil {
+		return nil, false, err
+	}
+
+	taken := map[string]float64{}
+	for _, allocation := range allocations {
+		lot := allocation.Lot
+		costRate, err := fx.rateAt(currency, lot.AcquiredAt)
+		if err != nil {
+			return nil, false, err
+		}
+		// Buy and sell fees are allocated pro rata to the quantity disposed, as in the ledger
+		costBasis := allocation.Quantity * lot.UnitCost
+		if lot.Quantity > 0 {
+			costBasis += lot.Fees * allocation.Quantity / lot.Quantity
+		}
+		proceeds := allocation.Quantity*price - fees*allocation.Quantity/quantity
+		bucket.add(allocation.Quantity, costBasis*costRate, proceeds*rate, holdingPeriod(lot.AcquiredAt, fx.today))
+		taken[lot.ID] += allocation.Quantity
+	}
+
+	var remaining []taxLot
+	for _, lot := range lots {
+		lot.RemainingQuantity -= taken[lot.ID]
+		if lot.RemainingQuantity > lotQuantityEpsilon {
+			remaining = append(remaining, lot)
+		}
+	}
+	return remaining, true, nil
+}
+
+// scenarioRun is scenarios run against a portfolio as it stands
+type scenarioRun struct {
+	Before   scenarioState
+	Outcomes []scenarioOutcome
+	Window   map[string]interface{}
+	Base     string
+	Warnings []string
+}
+
+// Helper function to run scenarios against a portfolio's current holdings, valued at market, and measure
+// the risk before and after each over the daily returns since from. Responds with an error and returns
+// false on failure.
+func (h *Handler) runScenarios(c *gin.Context, portfolioID string, definitions []scenarioDefinition, lookback string, from time.Time) (scenarioRun, bool) {
+	fx, err := h.newFXConverter(h.services.DB, portfolioID)
+	if err != nil {
+		h.logger.Error("Failed to get base currency", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run scenario"})
+		return scenarioRun{}, false
+	}
+	holdings, warnings, err := h.loadRebalanceHoldings(portfolioID, fx)
+	if err != nil {
+		h.respondFXError(c, err, "Failed to run scenario")
+		return scenarioRun{}, false
+	}
+	cash, _, err := h.getCashBalances(h.services.DB, portfolioID, fx)
+	if err != nil {
+		h.respondFXError(c, err, "Failed to run scenario")
+		return scenarioRun{}, false
+	}
+
+	held := map[string]bool{}
+	for _, holding := range holdings {
+		held[holding.Symbol] = true
+	}
+	var bought, sold []string
+	seen := map[string]bool{}
+	for _, definition := range definitions {
+		for _, trade := range definition.Trades {
+			if seen[trade.Action+trade.Symbol] {
+				continue
+			}
+			seen[trade.Action+trade.Symbol] = true
+			if trade.Action == scenarioSell {
+				sold = append(sold, trade.Symbol)
+			} else if !held[trade.Symbol] {
+				bought = append(bought, trade.Symbol)
+			}
+		}
+	}
+
+	assets := map[string]rebalanceHolding{}
+	if len(bought) > 0 {
+		priced, unknown, err := h.loadPricedAssets(bought, fx)
+		if err != nil {
+			h.respondFXError(c, err, "Failed to run scenario")
+			return scenarioRun{}, false
+		}
+		if len(unknown) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s isn't a known asset", strings.Join(unknown, ", "))})
+			return scenarioRun{}, false
+		}
+		for _, asset := range priced {
+			assets[asset.Symbol] = asset
+		}
+	}
+
+	var method string
+	var lots map[string][]taxLot
+	if len(sold) > 0 {
+		if err := h.services.DB.QueryRow("SELECT cost_basis_method FROM portfolios WHERE id = $1", portfolioID).Scan(&method); err != nil {
+			h.logger.Error("Failed to get cost basis method", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run scenario"})
+			return scenarioRun{}, false
+		}
+		if lots, err = h.loadOpenLots(portfolioID, sold); err != nil {
+			h.logger.Error("Failed to load tax lots", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run scenario"})
+			return scenarioRun{}, false
+		}
+	}
+
+	run := scenarioRun{Base: fx.base}
+	if run.Before, err = newScenarioState(holdings, cash, fx); err != nil {
+		h.respondFXError(c, err, "Failed to run scenario")
+		return scenarioRun{}, false
+	}
+	for _, definition := range definitions {
+		outcome, err := runScenario(definition, holdings, assets, lots, method, cash, fx)
+		var invalid *scenarioError
+		if errors.As(err, &invalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scenario: " + invalid.Error()})
+			return scenarioRun{}, false
+		}
+		if err != nil {
+			h.respondFXError(c, err, "Failed to run scenario")
+			return scenarioRun{}, false
+		}
+		run.Outcomes = append(run.Outcomes, outcome)
+	}
+
+	// Risk is measured over the returns of every symbol held before or after any of the scenarios
+	var symbols []string
+	inMatrix := map[string]bool{}
+	states := []*scenarioState{&run.Before}
+	for i := range run.Outcomes {
+		states = append(states, &run.Outcomes[i].After)
+	}
+	for _, state := range states {
+		for _, position := range state.Positions {
+			if !inMatrix[position.Symbol] {
+				inMatrix[position.Symbol] = true
+				symbols = append(symbols, position.Symbol)
+			}
+		}
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	var matrix returnMatrix
+	if len(symbols) > 0 {
+		var historyWarnings []string
+		matrix, historyWarnings, err = h.loadAlignedReturns(symbols, from, today)
+		if err != nil {
+			h.logger.Error("Failed to load price history", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run scenario"})
+			return scenarioRun{}, false
+		}
+		warnings = append(warnings, historyWarnings...)
+	}
+	if len(matrix.Dates) >= 2 {
+		covariance := newReturnCovariance(matrix, false)
+		means := seriesMeans(matrix.Returns)
+		for _, state := range states {
+			state.measureRisk(covariance, means, len(matrix.Dates))
+		}
+	}
+
+	run.Window = lookbackWindow(lookback, from, today, matrix)
+	run.Warnings = warnings
+	return run, true
+}
+
+// Helper function to load the open tax lots of symbols in a portfolio, oldest first
+func (h *Handler) loadOpenLots(portfolioID string, symbols []string) (map[string][]taxLot, error) {
+	rows, err := h.services.DB.Query(`
+		SELECT a.symbol, tl.id, tl.quantity, tl.remaining_quantity, tl.unit_cost, COALESCE(tl.fees, 0), tl.acquired_at
+		FROM tax_lots tl
+		JOIN assets a ON tl.asset_id = a.id
+		WHERE tl.portfolio_id = $1 AND a.symbol = ANY($2) AND tl.remaining_quantity > 0
+		ORDER BY tl.acquired_at
+	`, portfolioID, pq.Array(symbols))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query open lots: %w", err)
+	}
+	defer rows.Close()
+
+	lots := map[string][]taxLot{}
+	for rows.Next() {
+		var symbol string
+		var lot taxLot
+		if err := rows.Scan(&symbol, &lot.ID, &lot.Quantity, &lot.RemainingQuantity, &lot.UnitCost, &lot.Fees, &lot.AcquiredAt); err != nil {
+			return nil, fmt.Errorf("failed to scan lot: %w", err)
+		}
+		lots[symbol] = append(lots[symbol], lot)
+	}
+	return lots, rows.Err()
+}
+
+// outcomeResponse lays out a scenario's outcome
+func outcomeResponse(outcome scenarioOutcome) gin.H {
+	response := gin.H{
+		"after":    outcome.After,
+		"trades":   outcome.Fills,
+		"realized": outcome.Realized,
+		"impact":   outcome.Impact,
+	}
+	if len(outcome.Warnings) > 0 {
+		response["warnings"] = outcome.Warnings
+	}
+	return response
+}
+
+// completeImpact works out how far a scenario moves the portfolio from where it stands
+func completeImpact(before scenarioState, outcome *scenarioOutcome) {
+	outcome.Impact.ValueChange = outcome.After.TotalValue - before.TotalValue
+	if before.TotalValue > 0 {
+		outcome.Impact.ValueChangePercent = outcome.Impact.ValueChange / before.TotalValue * 100
+	}
+	outcome.Impact.CashChange = outcome.After.CashValue - before.CashValue
+}
+
+// RunScenario runs a basket of trades and price shocks against the portfolio without saving it
+func (h *Handler) RunScenario(c *gin.Context) {
+	var request struct {
+		PortfolioID string          `json:"portfolio_id"`
+		Trades      []scenarioTrade `json:"trades" binding:"dive"`
+		Shocks      scenarioShocks  `json:"shocks"`
+		Lookback    string          `json:"lookback"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	definition := scenarioDefinition{Trades: request.Trades, Shocks: request.Shocks}
+	if err := definition.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scenario: " + err.Error()})
+		return
+	}
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run scenario"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, request.PortfolioID)
+	if !ok {
+		return
+	}
+
+	lookback := request.Lookback
+	if lookback == "" {
+		lookback = "1y"
+	}
+	from, ok := priceHistoryStart(lookback, time.Now().UTC().Truncate(24*time.Hour))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid lookback %q, expected 7d, 30d, 90d, 1y, ytd, 5y or max", lookback)})
+		return
+	}
+
+	run, ok := h.runScenarios(c, portfolioID, []scenarioDefinition{definition}, lookback, from)
+	if !ok {
+		return
+	}
+	outcome := run.Outcomes[0]
+	completeImpact(run.Before, &outcome)
+
+	response := outcomeResponse(outcome)
+	response["base_currency"] = run.Base
+	response["portfolio_id"] = portfolioID
+	response["lookback_window"] = run.Window
+	response["before"] = run.Before
+	if warnings := append(run.Warnings, outcome.Warnings...); len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// savedScenario is a scenario saved for a portfolio
+type savedScenario struct {
+	ID          string             `json:"id"`
+	PortfolioID string             `json:"portfolio_id"`
+	Name        string             `json:"name"`
+	Definition  scenarioDefinition `json:"definition"`
+	CreatedAt   string             `json:"created_at"`
+	UpdatedAt   string             `json:"updated_at"`
+}
+
+// Helper function to scan saved scenarios
+func scanScenarios(rows *sql.Rows) ([]savedScenario, error) {
+	defer rows.Close()
+
+	scenarios := []savedScenario{}
+	for rows.Next() {
+		var scenario savedScenario
+		var definition []byte
+		if err := rows.Scan(&scenario.ID, &scenario.PortfolioID, &scenario.Name, &definition, &scenario.CreatedAt, &scenario.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan scenario: %w", err)
+		}
+		if err := json.Unmarshal(definition, &scenario.Definition); err != nil {
+			return nil, fmt.Errorf("failed to decode scenario %s: %w", scenario.ID, err)
+		}
+		if scenario.Definition.Trades == nil {
+			scenario.Definition.Trades = []scenarioTrade{}
+		}
+		scenarios = append(scenarios, scenario)
+	}
+	return scenarios, rows.Err()
+}
+
+// Helper function to load the user's saved scenarios with the given IDs
+func (h *Handler) loadScenarios(userID string, ids []string) ([]savedScenario, error) {
+	rows, err := h.services.DB.Query(`
+		SELECT s.id, s.portfolio_id, s.name, s.definition, s.created_at, s.updated_at
+		FROM scenarios s
+		JOIN portfolios p ON s.portfolio_id = p.id
+		WHERE s.id = ANY($1) AND p.user_id = $2
+	`, pq.Array(ids), userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query scenarios: %w", err)
+	}
+	return scanScenarios(rows)
+}
+
+// GetScenarios lists the scenarios saved for a portfolio
+func (h *Handler) GetScenarios(c *gin.Context) {
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch scenarios"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
+		return
+	}
+
+	rows, err := h.services.DB.Query(`
+		SELECT id, portfolio_id, name, definition, created_at, updated_at
+		FROM scenarios
+		WHERE portfolio_id = $1
+		ORDER BY name
+	`, portfolioID)
+	if err != nil {
+		h.logger.Error("Failed to query scenarios", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch scenarios"})
+		return
+	}
+	scenarios, err := scanScenarios(rows)
+	if err != nil {
+		h.logger.Error("Failed to read scenarios", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch scenarios"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"portfolio_id": portfolioID,
+		"scenarios":    scenarios,
+		"total":        len(scenarios),
+	})
+}
+
+// SaveScenario saves a named basket of trades and price shocks for a portfolio
+func (h *Handler) SaveScenario(c *gin.Context) {
+	var request struct {
+		PortfolioID string          `json:"portfolio_id"`
+		Name        string          `json:"name" binding:"required,max=255"`
+		Trades      []scenarioTrade `json:"trades" binding:"dive"`
+		Shocks      scenarioShocks  `json:"shocks"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	definition := scenarioDefinition{Trades: request.Trades, Shocks: request.Shocks}
+	if err := definition.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scenario: " + err.Error()})
+		return
+	}
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save scenario"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, request.PortfolioID)
+	if !ok {
+		return
+	}
+
+	encoded, err := json.Marshal(definition)
+	if err != nil {
+		h.logger.Error("Failed to encode scenario", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save scenario"})
+		return
+	}
+
+	scenario := savedScenario{PortfolioID: portfolioID, Name: strings.TrimSpace(request.Name), Definition: definition}
+	err = h.services.DB.QueryRow(`
+		INSERT INTO scenarios (portfolio_id, name, definition)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, updated_at
+	`, portfolioID, scenario.Name, encoded).Scan(&scenario.ID, &scenario.CreatedAt, &scenario.UpdatedAt)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "A scenario with this name already exists"})
+			return
+		}
+		h.logger.Error("Failed to save scenario", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save scenario"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":  "Scenario saved successfully",
+		"scenario": scenario,
+	})
+}
+
+// GetScenario runs a saved scenario against its portfolio as it stands
+func (h *Handler) GetScenario(c *gin.Context) {
+	scenarioID := c.Param("id")
+	if scenarioID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Scenario ID is required"})
+		return
+	}
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run scenario"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	lookback, from, ok := lookbackStart(c, time.Now().UTC().Truncate(24*time.Hour))
+	if !ok {
+		return
+	}
+
+	scenarios, err := h.loadScenarios(userID, []string{scenarioID})
+	if err != nil {
+		h.logger.Error("Failed to load scenario", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run scenario"})
+		return
+	}
+	if len(scenarios) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scenario not found"})
+		return
+	}
+	scenario := scenarios[0]
+
+	run, ok := h.runScenarios(c, scenario.PortfolioID, []scenarioDefinition{scenario.Definition}, lookback, from)
+	if !ok {
+		return
+	}
+	outcome := run.Outcomes[0]
+	completeImpact(run.Before, &outcome)
+
+	response := outcomeResponse(outcome)
+	response["scenario"] = scenario
+	response["base_currency"] = run.Base
+	response["lookback_window"] = run.Window
+	response["before"] = run.Before
+	if warnings := append(run.Warnings, outcome.Warnings...); len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// DeleteScenario deletes a saved scenario
+func (h *Handler) DeleteScenario(c *gin.Context) {
+	scenarioID := c.Param("id")
+	if scenarioID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Scenario ID is required"})
+		return
+	}
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete scenario"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	result, err := h.services.DB.Exec(`
+		DELETE FROM scenarios s
+		USING portfolios p
+		WHERE s.portfolio_id = p.id AND s.id = $1 AND p.user_id = $2
+	`, scenarioID, userID)
+	if err != nil {
+		h.logger.Error("Failed to delete scenario", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete scenario"})
+		return
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scenario not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Scenario deleted successfully",
+		"id":      scenarioID,
+	})
+}
+
+// CompareScenarios runs saved scenarios of one portfolio side by side against where it stands
+func (h *Handler) CompareScenarios(c *gin.Context) {
+	var ids []string
+	seen := map[string]bool{}
+	for _, id := range strings.Split(c.Query("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 || len(ids) > maxComparedScenarios {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("ids must list 1 to %d scenario IDs, separated by commas", maxComparedScenarios)})
+		return
+	}
+
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compare scenarios"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	lookback, from, ok := lookbackStart(c, time.Now().UTC().Truncate(24*time.Hour))
+	if !ok {
+		return
+	}
+
+	loaded, err := h.loadScenarios(userID, ids)
+	if err != nil {
+		h.logger.Error("Failed to load scenarios", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compare scenarios"})
+		return
+	}
+	byID := map[string]savedScenario{}
+	for _, scenario := range loaded {
+		byID[scenario.ID] = scenario
+	}
+	scenarios := make([]savedScenario, 0, len(ids))
+	definitions := make([]scenarioDefinition, 0, len(ids))
+	for _, id := range ids {
+		scenario, ok := byID[id]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Scenario not found: " + id})
+			return
+		}
+		if len(scenarios) > 0 && scenario.PortfolioID != scenarios[0].PortfolioID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Scenarios compared must belong to the same portfolio"})
+			return
+		}
+		scenarios = append(scenarios, scenario)
+		definitions = append(definitions, scenario.Definition)
+	}
+
+	run, ok := h.runScenarios(c, scenarios[0].PortfolioID, definitions, lookback, from)
+	if !ok {
+		return
+	}
+	results := make([]gin.H, len(scenarios))
+	for i := range scenarios {
+		completeImpact(run.Before, &run.Outcomes[i])
+		results[i] = outcomeResponse(run.Outcomes[i])
+		results[i]["scenario"] = scenarios[i]
+	}
+
+	response := gin.H{
+		"base_currency":   run.Base,
+		"portfolio_id":    scenarios[0].PortfolioID,
+		"lookback_window": run.Window,
+		"before":          run.Before,
+		"scenarios":       results,
+	}
+	if len(run.Warnings) > 0 {
+		response["warnings"] = run.Warnings
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,545 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/portfolio-management/api-gateway/internal/services"
+	"github.com/stretchr/testify/assert"
+)
+
+// scenarioTestHoldings returns 1,000 each of a technology stock bought at half its price and a bond
+// bought above it
+func scenarioTestHoldings() []rebalanceHolding {
+	return []rebalanceHolding{
+		{Symbol: "AAA", AssetType: "STOCK", Sector: "Technology", Currency: "USD", Quantity: 10, AverageCost: 50, Price: 100, Rate: 1},
+		{Symbol: "BBB", AssetType: "BOND", Sector: "Fixed Income", Currency: "USD", Quantity: 20, AverageCost: 60, Price: 50, Rate: 1},
+	}
+}
+
+// scenarioTestFX returns a converter into US dollars that needs no rates
+func scenarioTestFX() *fxConverter {
+	return &fxConverter{base: "USD", today: testDay("2024-06-28"), rates: map[string]float64{}}
+}
+
+// expectScenarioHoldings expects the portfolio's holdings to be read, at market
+func expectScenarioHoldings(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	mock.ExpectQuery(`SELECT a.symbol, a.asset_type, COALESCE\(a.sector, ''\), COALESCE\(a.currency, 'USD'\), ph.quantity, ph.average_cost FROM portfolio_holdings ph`).
+		WithArgs(testPortfolioID).
+		WillReturnRows(rows)
+}
+
+// expectReturnHistory expects the closes of the matrix's symbols to be read
+func expectReturnHistory(mock sqlmock.Sqlmock, matrix returnMatrix) {
+	rows := sqlmock.NewRows([]string{"symbol", "date", "close_price"})
+	for i, symbol := range matrix.Symbols {
+		price := 100.0
+		rows.AddRow(symbol, matrix.Start, price)
+		for j, r := range matrix.Returns[i] {
+			price *= 1 + r
+			rows.AddRow(symbol, matrix.Dates[j], price)
+		}
+	}
+	mock.ExpectQuery(`SELECT a.symbol, ph.date, ph.close_price FROM price_history ph JOIN assets a ON ph.asset_id = a.id WHERE a.symbol = ANY\(\$1\)`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(rows)
+}
+
+// scenarioRows returns saved scenario rows
+func scenarioRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "portfolio_id", "name", "definition", "created_at", "updated_at"})
+}
+
+// TestScenarioDefinition tests how scenarios are checked before they're run or saved
+func TestScenarioDefinition(t *testing.T) {
+	definition := scenarioDefinition{
+		Trades: []scenarioTrade{{Action: scenarioBuy, Symbol: " aaa ", Quantity: 1}},
+		Shocks: scenarioShocks{Symbols: map[string]float64{"bbb": 0.1}, Sectors: map[string]float64{" Technology ": -0.2}},
+	}
+	assert.NoError(t, definition.normalize())
+	assert.Equal(t, "AAA", definition.Trades[0].Symbol)
+	assert.Equal(t, map[string]float64{"BBB": 0.1}, definition.Shocks.Symbols)
+	assert.Equal(t, map[string]float64{"Technology": -0.2}, definition.Shocks.Sectors)
+
+	for _, invalid := range []scenarioDefinition{
+		{},
+		{Shocks: scenarioShocks{Symbols: map[string]float64{"AAA": -1}}},
+		{Shocks: scenarioShocks{Symbols: map[string]float64{"aaa": 0.1, "AAA": 0.2}}},
+		{Shocks: scenarioShocks{Sectors: map[string]float64{"energy": 0.1, "Energy": 0.2}}},
+	} {
+		assert.Error(t, invalid.normalize())
+	}
+}
+
+// TestRunScenario tests trades against lots and cash, and price shocks after them
+func TestRunScenario(t *testing.T) {
+	fx := scenarioTestFX()
+	cash := []cashBalance{{Currency: "USD", Balance: 1000}}
+	lots := map[string][]taxLot{"AAA": {
+		{ID: "lot-1", Quantity: 6, RemainingQuantity: 6, UnitCost: 40, AcquiredAt: testDay("2022-01-03")},
+		{ID: "lot-2", Quantity: 4, RemainingQuantity: 4, UnitCost: 65, AcquiredAt: testDay("2024-05-29")},
+	}}
+	assets := map[string]rebalanceHolding{
+		"CCC": {Symbol: "CCC", AssetType: "STOCK", Sector: "Technology", Currency: "USD", Price: 200, Rate: 1},
+	}
+
+	t.Run("trades and shocks", func(t *testing.T) {
+		definition := scenarioDefinition{
+			Trades: []scenarioTrade{
+				{Action: scenarioSell, Symbol: "AAA", Quantity: 8, Fees: 10},
+				{Action: scenarioBuy, Symbol: "CCC", Quantity: 5},
+			},
+			Shocks: scenarioShocks{Symbols: map[string]float64{"bbb": 0.02}, Sectors: map[string]float64{"technology": -0.1}},
+		}
+		assert.NoError(t, definition.normalize())
+
+		outcome, err := runScenario(definition, scenarioTestHoldings(), assets, lots, costBasisFIFO, cash, fx)
+
+		assert.NoError(t, err)
+		// The oldest lot is sold first: 6 held for over a year, then 2 of the recent one
+		assert.InDelta(t, 420, outcome.Realized.Realized, 1e-9)
+		assert.InDelta(t, 352.5, outcome.Realized.LongTerm, 1e-9)
+		assert.InDelta(t, 67.5, outcome.Realized.ShortTerm, 1e-9)
+		if assert.Len(t, outcome.Fills, 2) {
+			assert.InDelta(t, 790, outcome.Fills[0].CashAmount, 1e-9)
+			assert.InDelta(t, 420, *outcome.Fills[0].RealizedPnL, 1e-9)
+			assert.InDelta(t, -1000, outcome.Fills[1].CashAmount, 1e-9)
+			assert.Nil(t, outcome.Fills[1].RealizedPnL)
+		}
+
+		after := outcome.After
+		assert.InDelta(t, 790, after.CashValue, 1e-9)
+		assert.InDelta(t, 2890, after.TotalValue, 1e-9)
+		if assert.Len(t, after.Positions, 3) {
+			assert.Equal(t, "AAA", after.Positions[0].Symbol)
+			assert.InDelta(t, 90, after.Positions[0].Price, 1e-9)
+			assert.InDelta(t, 1020, after.Positions[1].MarketValue, 1e-9)
+			assert.InDelta(t, 900, after.Positions[2].MarketValue, 1e-9)
+		}
+		assert.InDelta(t, 1080/2890.0*100, after.BySector["Technology"], 1e-9)
+		assert.InDelta(t, -100, outcome.Impact.ShockImpact, 1e-9)
+		assert.InDelta(t, 10, outcome.Impact.Fees, 1e-9)
+		assert.Empty(t, outcome.Warnings)
+
+		before, err := newScenarioState(scenarioTestHoldings(), cash, fx)
+		assert.NoError(t, err)
+		completeImpact(before, &outcome)
+		assert.InDelta(t, -110, outcome.Impact.ValueChange, 1e-9)
+		assert.InDelta(t, -210, outcome.Impact.CashChange, 1e-9)
+	})
+
+	t.Run("sell without lots", func(t *testing.T) {
+		definition := scenarioDefinition{
+			Trades: []scenarioTrade{{Action: scenarioSell, Symbol: "BBB", Quantity: 20}, {Action: scenarioBuy, Symbol: "AAA", Quantity: 25}},
+			Shocks: scenarioShocks{Sectors: map[string]float64{"Energy": 0.5}},
+		}
+
+		outcome, err := runScenario(definition, scenarioTestHoldings(), assets, lots, costBasisSpecific, cash, fx)
+
+		assert.NoError(t, err)
+		// Measured against the average cost of 60
+		assert.InDelta(t, -200, outcome.Realized.Realized, 1e-9)
+		assert.Equal(t, []string{
+			"No tax lots cover the sale of BBB, so its gain is measured against the average cost and counted as short-term",
+			"The shock on Energy matches no holding",
+			"The trades overdraw the USD cash by 500.00",
+		}, outcome.Warnings)
+		assert.Len(t, outcome.After.Positions, 1)
+	})
+
+	t.Run("invalid trades", func(t *testing.T) {
+		for _, trade := range []scenarioTrade{
+			{Action: scenarioSell, Symbol: "AAA", Quantity: 11},
+			{Action: scenarioSell, Symbol: "CCC", Quantity: 1},
+			{Action: scenarioBuy, Symbol: "DDD", Quantity: 1},
+		} {
+			_, err := runScenario(scenarioDefinition{Trades: []scenarioTrade{trade}}, scenarioTestHoldings(), assets, lots, costBasisFIFO, cash, fx)
+			var invalid *scenarioError
+			assert.ErrorAs(t, err, &invalid, trade.Symbol)
+		}
+	})
+}
+
+// TestScenarioStateRisk tests that cash dampens the portfolio's risk
+func TestScenarioStateRisk(t *testing.T) {
+	matrix := varTestMatrix()
+	covariance := newReturnCovariance(matrix, false)
+	holdings := []rebalanceHolding{{Symbol: "AAA", AssetType: "STOCK", Currency: "USD", Quantity: 10, Price: 100, Rate: 1}}
+
+	state, err := newScenarioState(holdings, []cashBalance{{Currency: "USD", Balance: 1000}}, scenarioTestFX())
+	assert.NoError(t, err)
+	state.measureRisk(covariance, seriesMeans(matrix.Returns), len(matrix.Dates))
+
+	// Half in cash halves the volatility
+	if assert.NotNil(t, state.Risk.VolatilityPercent) {
+		assert.InDelta(t, 0.5*sampleStdDev(matrix.Returns[0])*math.Sqrt(tradingDaysPerYear)*100, *state.Risk.VolatilityPercent, 1e-9)
+	}
+	assert.NotNil(t, state.Risk.VaR95Percent)
+	assert.Equal(t, 50.0, state.Risk.LargestPositionPercent)
+	assert.Equal(t, 50.0, state.CashPercent)
+}
+
+// TestRunScenarioEndpoint tests running an unsaved scenario
+func TestRunScenarioEndpoint(t *testing.T) {
+	post := func(handler *Handler, body string) *httptest.ResponseRecorder {
+		router := createTestRouter(handler, "POST", "/analytics/scenarios/run", handler.RunScenario)
+		req, _ := http.NewRequest("POST", "/analytics/scenarios/run", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("trades and shocks", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		handler.services.MarketData = &mockMarketData{quotes: map[string]*services.Quote{
+			"AAA": {CurrentPrice: 100},
+			"BBB": {CurrentPrice: 50},
+			"CCC": {CurrentPrice: 200},
+		}}
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		expectBaseCurrency(mock, testPortfolioID, "USD")
+		expectScenarioHoldings(mock, sqlmock.NewRows([]string{"symbol", "asset_type", "sector", "currency", "quantity", "average_cost"}).
+			AddRow("AAA", "STOCK", "Technology", "USD", 10.0, 50.0).
+			AddRow("BBB", "BOND", "Fixed Income", "USD", 20.0, 60.0))
+		expectCashBalances(mock, testPortfolioID, newCashBalanceRows().AddRow("USD", 1000.0))
+		mock.ExpectQuery(`SELECT symbol, asset_type, COALESCE\(sector, ''\), COALESCE\(currency, 'USD'\) FROM assets WHERE symbol = ANY\(\$1\)`).
+			WithArgs(sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"symbol", "asset_type", "sector", "currency"}).
+				AddRow("CCC", "STOCK", "Technology", "USD"))
+		mock.ExpectQuery(`SELECT cost_basis_method FROM portfolios WHERE id = \$1`).
+			WithArgs(testPortfolioID).
+			WillReturnRows(sqlmock.NewRows([]string{"cost_basis_method"}).AddRow("HIFO"))
+		mock.ExpectQuery(`SELECT a.symbol, tl.id, tl.quantity, tl.remaining_quantity, tl.unit_cost, COALESCE\(tl.fees, 0\), tl.acquired_at FROM tax_lots tl`).
+			WithArgs(testPortfolioID, sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"symbol", "id", "quantity", "remaining_quantity", "unit_cost", "fees", "acquired_at"}).
+				AddRow("AAA", "lot-1", 6.0, 6.0, 40.0, 0.0, testDay("2022-01-03")).
+				AddRow("AAA", "lot-2", 4.0, 4.0, 65.0, 0.0, testDay("2024-05-29")))
+		expectReturnHistory(mock, varTestMatrix())
+
+		w := post(handler, `{"trades": [{"action": "sell", "symbol": "aaa", "quantity": 4}, {"action": "buy", "symbol": "CCC", "quantity": 2}], "shocks": {"sectors": {"Technology": -0.1}}, "lookback": "max"}`)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Before   scenarioState  `json:"before"`
+			After    scenarioState  `json:"after"`
+			Trades   []scenarioFill `json:"trades"`
+			Realized realizedBucket `json:"realized"`
+			Impact   scenarioImpact `json:"impact"`
+			Warnings []string       `json:"warnings"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.InDelta(t, 3000, response.Before.TotalValue, 1e-9)
+		assert.InDelta(t, 1000, response.After.CashValue, 1e-9)
+		// The portfolio sells its costliest lot first
+		assert.InDelta(t, 140, response.Realized.Realized, 1e-9)
+		assert.InDelta(t, -100, response.Impact.ShockImpact, 1e-9)
+		assert.InDelta(t, -100, response.Impact.ValueChange, 1e-9)
+		assert.Len(t, response.Trades, 2)
+		assert.NotNil(t, response.Before.Risk.VolatilityPercent)
+		assert.NotNil(t, response.After.Risk.VolatilityPercent)
+		assert.Equal(t, []string{"No price history for CCC in the lookback window"}, response.Warnings)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("oversold", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		expectBaseCurrency(mock, testPortfolioID, "USD")
+		expectScenarioHoldings(mock, sqlmock.NewRows([]string{"symbol", "asset_type", "sector", "currency", "quantity", "average_cost"}).
+			AddRow("AAA", "STOCK", "Technology", "USD", 10.0, 50.0))
+		expectCashBalances(mock, testPortfolioID, newCashBalanceRows())
+		mock.ExpectQuery(`SELECT cost_basis_method FROM portfolios WHERE id = \$1`).
+			WithArgs(testPortfolioID).
+			WillReturnRows(sqlmock.NewRows([]string{"cost_basis_method"}).AddRow("FIFO"))
+		mock.ExpectQuery(`SELECT a.symbol, tl.id, (.+) FROM tax_lots tl`).
+			WithArgs(testPortfolioID, sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"symbol", "id", "quantity", "remaining_quantity", "unit_cost", "fees", "acquired_at"}))
+
+		w := post(handler, `{"trades": [{"action": "sell", "symbol": "AAA", "quantity": 12}]}`)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "trade 1 sells 12 AAA, but only 10 are held")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		for _, body := range []string{
+			`{}`,
+			`{"trades": [{"action": "hold", "symbol": "AAA", "quantity": 1}]}`,
+			`{"trades": [{"action": "buy", "symbol": "AAA", "quantity": 0}]}`,
+			`{"shocks": {"symbols": {"AAA": -1.5}}}`,
+		} {
+			w := post(handler, body)
+			assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		}
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		w := post(handler, `{"shocks": {"symbols": {"AAA": -0.1}}, "lookback": "2w"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+// TestSaveScenario tests saving a named scenario
+func TestSaveScenario(t *testing.T) {
+	post := func(handler *Handler, body string) *httptest.ResponseRecorder {
+		router := createTestRouter(handler, "POST", "/analytics/scenarios", handler.SaveScenario)
+		req, _ := http.NewRequest("POST", "/analytics/scenarios", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	body := `{"name": "Tech sell-off", "trades": [{"action": "sell", "symbol": "aaa", "quantity": 5}], "shocks": {"sectors": {"Technology": -0.3}}}`
+
+	t.Run("saved", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		mock.ExpectQuery(`INSERT INTO scenarios \(portfolio_id, name, definition\) VALUES \(\$1, \$2, \$3\) RETURNING id, created_at, updated_at`).
+			WithArgs(testPortfolioID, "Tech sell-off", []byte(`{"trades":[{"action":"sell","symbol":"AAA","quantity":5,"fees":0}],"shocks":{"sectors":{"Technology":-0.3}}}`)).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow("scenario-1", "2024-06-28T10:00:00Z", "2024-06-28T10:00:00Z"))
+
+		w := post(handler, body)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var response struct {
+			Scenario savedScenario `json:"scenario"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, "scenario-1", response.Scenario.ID)
+		assert.Equal(t, "AAA", response.Scenario.Definition.Trades[0].Symbol)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("name taken", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		mock.ExpectQuery(`INSERT INTO scenarios`).
+			WillReturnError(&pq.Error{Code: "23505"})
+
+		w := post(handler, body)
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		for _, invalid := range []string{`{"shocks": {"sectors": {"Technology": -0.3}}}`, `{"name": "Nothing"}`} {
+			w := post(handler, invalid)
+			assert.Equal(t, http.StatusBadRequest, w.Code, invalid)
+		}
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+// TestGetScenarios tests listing a portfolio's saved scenarios
+func TestGetScenarios(t *testing.T) {
+	handler, mock, cleanup := createTestHandler(t)
+	defer cleanup()
+
+	expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+	mock.ExpectQuery(`SELECT id, portfolio_id, name, definition, created_at, updated_at FROM scenarios WHERE portfolio_id = \$1`).
+		WithArgs(testPortfolioID).
+		WillReturnRows(scenarioRows().
+			AddRow("scenario-1", testPortfolioID, "Rates up", []byte(`{"shocks":{"sectors":{"Fixed Income":-0.05}}}`), "2024-06-28T10:00:00Z", "2024-06-28T10:00:00Z"))
+
+	router := createTestRouter(handler, "GET", "/analytics/scenarios", handler.GetScenarios)
+	req, _ := http.NewRequest("GET", "/analytics/scenarios", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Scenarios []savedScenario `json:"scenarios"`
+		Total     int             `json:"total"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 1, response.Total)
+	if assert.Len(t, response.Scenarios, 1) {
+		assert.Equal(t, -0.05, response.Scenarios[0].Definition.Shocks.Sectors["Fixed Income"])
+		assert.Empty(t, response.Scenarios[0].Definition.Trades)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestGetScenario tests running a saved scenario against the portfolio as it stands
+func TestGetScenario(t *testing.T) {
+	get := func(handler *Handler, target string) *httptest.ResponseRecorder {
+		router := createTestRouter(handler, "GET", "/analytics/scenarios/:id", handler.GetScenario)
+		req, _ := http.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("run", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		handler.services.MarketData = &mockMarketData{quotes: map[string]*services.Quote{"AAA": {CurrentPrice: 100}}}
+
+		mock.ExpectQuery(`SELECT s.id, s.portfolio_id, s.name, s.definition, s.created_at, s.updated_at FROM scenarios s JOIN portfolios p ON s.portfolio_id = p.id WHERE s.id = ANY\(\$1\) AND p.user_id = \$2`).
+			WithArgs(sqlmock.AnyArg(), testUserID).
+			WillReturnRows(scenarioRows().
+				AddRow("scenario-1", testPortfolioID, "Crash", []byte(`{"trades":[],"shocks":{"symbols":{"AAA":-0.5}}}`), "2024-06-28T10:00:00Z", "2024-06-28T10:00:00Z"))
+		expectBaseCurrency(mock, testPortfolioID, "USD")
+		expectScenarioHoldings(mock, sqlmock.NewRows([]string{"symbol", "asset_type", "sector", "currency", "quantity", "average_cost"}).
+			AddRow("AAA", "STOCK", "Technology", "USD", 10.0, 50.0))
+		expectCashBalances(mock, testPortfolioID, newCashBalanceRows().AddRow("USD", 1000.0))
+		expectReturnHistory(mock, varTestMatrix())
+
+		w := get(handler, "/analytics/scenarios/scenario-1?lookback=max")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Scenario savedScenario  `json:"scenario"`
+			After    scenarioState  `json:"after"`
+			Impact   scenarioImpact `json:"impact"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, "Crash", response.Scenario.Name)
+		assert.InDelta(t, 1500, response.After.TotalValue, 1e-9)
+		assert.InDelta(t, -25, response.Impact.ValueChangePercent, 1e-9)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		mock.ExpectQuery(`SELECT s.id, (.+) FROM scenarios s`).
+			WithArgs(sqlmock.AnyArg(), testUserID).
+			WillReturnRows(scenarioRows())
+
+		w := get(handler, "/analytics/scenarios/scenario-9")
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+// TestCompareScenarios tests running saved scenarios side by side
+func TestCompareScenarios(t *testing.T) {
+	get := func(handler *Handler, target string) *httptest.ResponseRecorder {
+		router := createTestRouter(handler, "GET", "/analytics/scenarios/compare", handler.CompareScenarios)
+		req, _ := http.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("side by side", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		handler.services.MarketData = &mockMarketData{quotes: map[string]*services.Quote{"AAA": {CurrentPrice: 100}}}
+
+		mock.ExpectQuery(`SELECT s.id, (.+) FROM scenarios s`).
+			WithArgs(sqlmock.AnyArg(), testUserID).
+			WillReturnRows(scenarioRows().
+				AddRow("scenario-2", testPortfolioID, "Rally", []byte(`{"shocks":{"symbols":{"AAA":0.2}}}`), "2024-06-28T10:00:00Z", "2024-06-28T10:00:00Z").
+				AddRow("scenario-1", testPortfolioID, "Crash", []byte(`{"shocks":{"symbols":{"AAA":-0.5}}}`), "2024-06-28T10:00:00Z", "2024-06-28T10:00:00Z"))
+		expectBaseCurrency(mock, testPortfolioID, "USD")
+		expectScenarioHoldings(mock, sqlmock.NewRows([]string{"symbol", "asset_type", "sector", "currency", "quantity", "average_cost"}).
+			AddRow("AAA", "STOCK", "Technology", "USD", 10.0, 50.0))
+		expectCashBalances(mock, testPortfolioID, newCashBalanceRows())
+		expectReturnHistory(mock, returnMatrix{})
+
+		w := get(handler, "/analytics/scenarios/compare?ids=scenario-1,scenario-2,scenario-1")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Before    scenarioState `json:"before"`
+			Scenarios []struct {
+				Scenario savedScenario  `json:"scenario"`
+				Impact   scenarioImpact `json:"impact"`
+			} `json:"scenarios"`
+			Warnings []string `json:"warnings"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.InDelta(t, 1000, response.Before.TotalValue, 1e-9)
+		assert.Nil(t, response.Before.Risk.VolatilityPercent)
+		if assert.Len(t, response.Scenarios, 2) {
+			assert.Equal(t, "Crash", response.Scenarios[0].Scenario.Name)
+			assert.InDelta(t, -500, response.Scenarios[0].Impact.ValueChange, 1e-9)
+			assert.Equal(t, "Rally", response.Scenarios[1].Scenario.Name)
+			assert.InDelta(t, 200, response.Scenarios[1].Impact.ValueChange, 1e-9)
+		}
+		assert.Equal(t, []string{"No price history for AAA in the lookback window"}, response.Warnings)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("different portfolios", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		mock.ExpectQuery(`SELECT s.id, (.+) FROM scenarios s`).
+			WithArgs(sqlmock.AnyArg(), testUserID).
+			WillReturnRows(scenarioRows().
+				AddRow("scenario-1", testPortfolioID, "Crash", []byte(`{"shocks":{"symbols":{"AAA":-0.5}}}`), "2024-06-28T10:00:00Z", "2024-06-28T10:00:00Z").
+				AddRow("scenario-2", "other-portfolio", "Rally", []byte(`{"shocks":{"symbols":{"AAA":0.2}}}`), "2024-06-28T10:00:00Z", "2024-06-28T10:00:00Z"))
+
+		w := get(handler, "/analytics/scenarios/compare?ids=scenario-1,scenario-2")
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("missing ids", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		w := get(handler, "/analytics/scenarios/compare")
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+// TestDeleteScenario tests deleting a saved scenario
+func TestDeleteScenario(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		affected int64
+		status   int
+	}{
+		{"deleted", 1, http.StatusOK},
+		{"not found", 0, http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock, cleanup := createTestHandler(t)
+			defer cleanup()
+
+			mock.ExpectExec(`DELETE FROM scenarios s USING portfolios p WHERE s.portfolio_id = p.id AND s.id = \$1 AND p.user_id = \$2`).
+				WithArgs("scenario-1", testUserID).
+				WillReturnResult(sqlmock.NewResult(0, tt.affected))
+
+			router := createTestRouter(handler, "DELETE", "/analytics/scenarios/:id", handler.DeleteScenario)
+			req, _ := http.NewRequest("DELETE", "/analytics/scenarios/scenario-1", nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+
+	"github.com/portfolio-management/api-gateway/internal/services"
+)
+
+// valuationEntry is a ledger entry with the currency and cash amount needed to value the portfolio
+type valuationEntry struct {
+	ledgerEntry
+	Currency    string
+	TotalAmount float64
+}
+
+// datedClose is an asset's close on one day
+type datedClose struct {
+	Date  time.Time
+	Close float64
+}
+
+// closingPrices holds each asset's closes in date order, keyed by asset ID
+type closingPrices map[string][]datedClose
+
+// at returns an asset's latest close on or before day
+func (p closingPrices) at(assetID string, day time.Time) (float64, bool) {
+	closes := p[assetID]
+	i := sort.Search(len(closes), func(i int) bool { return closes[i].Date.After(day) })
+	if i == 0 {
+		return 0, false
+	}
+	return closes[i-1].Close, true
+}
+
+// Helper function to load a portfolio's whole ledger for valuation, in date order, without locking it
+func (h *Handler) loadValuationLedger(portfolioID string) ([]valuationEntry, error) {
+	rows, err := h.services.DB.Query(`
+		SELECT
+			t.id, t.asset_id, a.symbol, t.transaction_type, t.quantity, t.price,
+			COALESCE(t.fees, 0), t.transaction_date, COALESCE(t.cost_basis_method, ''),
+			t.lot_transaction_ids, t.realized_pnl, t.acquired_at, COALESCE(a.currency, 'USD'), t.total_amount
+		FROM transactions t
+		JOIN assets a ON t.asset_id = a.id
+		WHERE t.portfolio_id = $1
+		ORDER BY t.transaction_date ASC
+	`, portfolioID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ledger: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []valuationEntry
+	for rows.Next() {
+		var entry valuationEntry
+		var lotTransactionIDs pq.StringArray
+		err := rows.Scan(&entry.ID, &entry.AssetID, &entry.Symbol, &entry.Type, &entry.Quantity, &entry.Price,
+			&entry.Fees, &entry.Date, &entry.CostBasisMethod, &lotTransactionIDs, &entry.RealizedPnL,
+			&entry.AcquiredAt, &entry.Currency, &entry.TotalAmount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan ledger entry: %w", err)
+		}
+		entry.LotTransactionIDs = lotTransactionIDs
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// Helper function to load the closes of assets up to a day
+func (h *Handler) loadClosingPrices(assetIDs []string, to time.Time) (closingPrices, error) {
+	prices := closingPrices{}
+	if len(assetIDs) == 0 {
+		return prices, nil
+	}
+
+	rows, err := h.services.DB.Query(`
+		SELECT asset_id, date, close_price
+		FROM price_history
+		WHERE asset_id = ANY($1) AND date <= $2
+		ORDER BY asset_id, date ASC
+	`, pq.Array(assetIDs), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query closing prices: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var assetID string
+		var price datedClose
+		if err := rows.Scan(&assetID, &price.Date, &price.Close); err != nil {
+			return nil, fmt.Errorf("failed to scan closing price: %w", err)
+		}
+		prices[assetID] = append(prices[assetID], price)
+	}
+	return prices, rows.Err()
+}
+
+// Helper function to delete a portfolio's snapshots from the day a ledger change takes effect, in the
+// transaction making the change, so the snapshot scheduler values those days again from the new ledger
+func (h *Handler) invalidateSnapshots(tx *sql.Tx, portfolioID string, from time.Time) error {
+	_, err := tx.Exec("DELETE FROM portfolio_snapshots WHERE portfolio_id = $1 AND snapshot_date >= $2",
+		portfolioID, from.UTC().Format("2006-01-02"))
+	if err != nil {
+		return fmt.Errorf("failed to invalidate snapshots: %w", err)
+	}
+	return nil
+}
+
+// ValuePortfolio values a portfolio in its base currency at the close of each weekday from from to to.
+// Positions and cash are replayed from the ledger; holdings are priced at their latest close in
+// price_history, or at cost when they have none. Net flow covers the deposits and withdrawals since the
+// previous weekday, so flows on weekends aren't lost, and the part of any purchase or fee the cash
+// didn't cover, which counts as a deposit.
+func (h *Handler) ValuePortfolio(ctx context.Context, portfolioID string, from, to time.Time) ([]services.PortfolioValuation, error) {
+	fx, err := h.newFXConverter(h.services.DB, portfolioID)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := h.loadValuationLedger(portfolioID)
+	if err != nil {
+		return nil, err
+	}
+
+	currencies := map[string]string{} // asset ID -> currency
+	symbols := map[string]string{}
+	var assetIDs []string
+	for _, entry := range entries {
+		if _, seen := symbols[entry.AssetID]; !seen && affectsHoldings(entry.Type) {
+			assetIDs = append(assetIDs, entry.AssetID)
+			symbols[entry.AssetID] = entry.Symbol
+		}
+		currencies[entry.AssetID] = entry.Currency
+	}
+	prices, err := h.loadClosingPrices(assetIDs, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var ledger []ledgerEntry
+	var sells []valuationEntry
+	var state *ledgerState
+	cash := cashLedger{}
+	flows := map[string]float64{} // currency -> money paid in less withdrawals since the last valuation
+	next := 0
+	consume := func(before time.Time, countFlows bool) bool {
+		consumed := false
+		for next < len(entries) && entries[next].Date.Before(before) {
+			entry := entries[next]
+			next++
+			consumed = true
+
+			ledger = append(ledger, entry.ledgerEntry)
+			if entry.Type == transactionSell {
+				sells = append(sells, entry)
+			}
+			flow := cash.apply(entry.Currency, entry.Type, entry.TotalAmount, entry.Fees)
+			if countFlows {
+				flows[entry.Currency] += flow
+			}
+		}
+		return consumed
+	}
+
+	// Flows before from were part of earlier valuations
+	from, to = from.UTC().Truncate(24*time.Hour), to.UTC().Truncate(24*time.Hour)
+	consume(from, false)
+
+	var valuations []services.PortfolioValuation
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if consume(day.AddDate(0, 0, 1), true) || state == nil {
+			state = replayLedgerLenient(ledger)
+		}
+		if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+			continue
+		}
+
+		valuation := services.PortfolioValuation{Date: day}
+
+		quantities := map[string]float64{}
+		localCosts := map[string]float64{}
+		for _, lot := range state.Lots {
+			if lot.ClosedAt != nil || lot.RemainingQuantity < lotQuantityEpsilon {
+				continue
+			}
+			rate, err := fx.rateAt(currencies[lot.AssetID], lot.AcquiredAt)
+			if err != nil {
+				return nil, err
+			}
+			quantities[lot.AssetID] += lot.RemainingQuantity
+			localCosts[lot.AssetID] += lot.RemainingQuantity * lot.UnitCost
+			valuation.TotalCost += lot.RemainingQuantity * lot.UnitCost * rate
+		}
+
+		for assetID, quantity := range quantities {
+			rate, err := fx.rateAt(currencies[assetID], day)
+			if err != nil {
+				return nil, err
+			}
+			price, ok := prices.at(assetID, day)
+			if !ok {
+				price = localCosts[assetID] / quantity
+				valuation.MissingPrices = append(valuation.MissingPrices, symbols[assetID])
+			}
+			valuation.MarketValue += quantity * price * rate
+		}
+		sort.Strings(valuation.MissingPrices)
+
+		for currency, balance := range cash {
+			rate, err := fx.rateAt(currency, day)
+			if err != nil {
+				return nil, err
+			}
+			valuation.CashValue += balance * rate
+			valuation.NetFlow += flows[currency] * rate
+		}
+		flows = map[string]float64{}
+
+		for _, sell := range sells {
+			rate, err := fx.rateAt(sell.Currency, day)
+			if err != nil {
+				return nil, err
+			}
+			valuation.RealizedPnL += state.Realized[sell.ID] * rate
+		}
+
+		valuation.TotalValue = valuation.MarketValue + valuation.CashValue
+		valuation.UnrealizedPnL = valuation.MarketValue - valuation.TotalCost
+		valuations = append(valuations, valuation)
+	}
+	return valuations, nil
+}
+
+// RebuildSnapshots replaces a portfolio's daily snapshots with ones valued from its current ledger
+func (h *Handler) RebuildSnapshots(c *gin.Context) {
+	if h.services.Snapshots == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Snapshot scheduler is not running"})
+		return
+	}
+
+	portfolioID, ok := portfolioIDParam(c)
+	if !ok {
+		return
+	}
+	stored, err := h.services.Snapshots.Rebuild(c.Request.Context(), portfolioID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Portfolio not found"})
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to rebuild snapshots", zap.String("portfolio_id", portfolioID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rebuild snapshots"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"portfolio_id":     portfolioID,
+		"snapshots_stored": stored,
+	})
+}
@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/portfolio-management/api-gateway/internal/services"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+var valuationLedgerColumns = append(append([]string{}, ledgerColumns...), "currency", "total_amount")
+
+// testDay parses a YYYY-MM-DD day
+func testDay(day string) time.Time {
+	date, _ := time.Parse("2006-01-02", day)
+	return date
+}
+
+// expectValuationInputs expects the ledger and closes of a USD portfolio to be read for valuation
+func expectValuationInputs(mock sqlmock.Sqlmock, portfolioID, to string) {
+	expectBaseCurrency(mock, portfolioID, "USD")
+
+	mock.ExpectQuery(`SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.portfolio_id = \$1 ORDER BY t.transaction_date ASC`).
+		WithArgs(portfolioID).
+		WillReturnRows(sqlmock.NewRows(valuationLedgerColumns).
+			AddRow("t1", "cash-usd", "USD", "DEPOSIT", 10000.0, 1.0, 0.0, testDay("2024-03-04").Add(10*time.Hour), "", nil, nil, nil, "USD", 10000.0).
+			AddRow("t2", "asset-aapl", "AAPL", "BUY", 10.0, 150.0, 0.0, testDay("2024-03-04").Add(15*time.Hour), "", nil, nil, nil, "USD", 1500.0).
+			AddRow("t3", "cash-usd", "USD", "DEPOSIT", 500.0, 1.0, 0.0, testDay("2024-03-09").Add(9*time.Hour), "", nil, nil, nil, "USD", 500.0).
+			AddRow("t4", "asset-aapl", "AAPL", "SELL", 4.0, 170.0, 0.0, testDay("2024-03-12").Add(15*time.Hour), "", nil, nil, nil, "USD", 680.0))
+
+	mock.ExpectQuery(`SELECT asset_id, date, close_price FROM price_history WHERE asset_id = ANY\(\$1\) AND date <= \$2`).
+		WithArgs(sqlmock.AnyArg(), to).
+		WillReturnRows(sqlmock.NewRows([]string{"asset_id", "date", "close_price"}).
+			AddRow("asset-aapl", testDay("2024-03-04"), 155.0).
+			AddRow("asset-aapl", testDay("2024-03-05"), 160.0).
+			AddRow("asset-aapl", testDay("2024-03-08"), 165.0).
+			AddRow("asset-aapl", testDay("2024-03-12"), 170.0))
+}
+
+// TestValuePortfolio tests valuing a portfolio at each weekday's close from its ledger and price_history
+func TestValuePortfolio(t *testing.T) {
+	t.Run("values every weekday from the first transaction", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		expectValuationInputs(mock, testPortfolioID, "2024-03-12")
+
+		valuations, err := handler.ValuePortfolio(context.Background(), testPortfolioID, testDay("2024-03-04"), testDay("2024-03-12"))
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		// Weekends are skipped
+		if !assert.Len(t, valuations, 7) {
+			return
+		}
+		var days []string
+		for _, v := range valuations {
+			days = append(days, v.Date.Format("2006-01-02"))
+		}
+		assert.Equal(t, []string{"2024-03-04", "2024-03-05", "2024-03-06", "2024-03-07", "2024-03-08", "2024-03-11", "2024-03-12"}, days)
+
+		first := valuations[0]
+		assert.InDelta(t, 8500, first.CashValue, 0.001)
+		assert.InDelta(t, 1550, first.MarketValue, 0.001)
+		assert.InDelta(t, 10050, first.TotalValue, 0.001)
+		assert.InDelta(t, 1500, first.TotalCost, 0.001)
+		assert.InDelta(t, 50, first.UnrealizedPnL, 0.001)
+		assert.InDelta(t, 10000, first.NetFlow, 0.001)
+
+		// Days without a close keep the latest one
+		assert.InDelta(t, 1600, valuations[2].MarketValue, 0.001)
+		assert.InDelta(t, 0, valuations[2].NetFlow, 0.001)
+
+		// The Saturday deposit is counted on Monday
+		monday := valuations[5]
+		assert.InDelta(t, 500, monday.NetFlow, 0.001)
+		assert.InDelta(t, 9000, monday.CashValue, 0.001)
+		assert.InDelta(t, 1650, monday.MarketValue, 0.001)
+
+		last := valuations[6]
+		assert.InDelta(t, 9680, last.CashValue, 0.001)
+		assert.InDelta(t, 1020, last.MarketValue, 0.001)
+		assert.InDelta(t, 900, last.TotalCost, 0.001)
+		assert.InDelta(t, 80, last.RealizedPnL, 0.001)
+		assert.InDelta(t, 10700, last.TotalValue, 0.001)
+		assert.Empty(t, last.MissingPrices)
+	})
+
+	t.Run("continues from a later day", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		expectValuationInputs(mock, testPortfolioID, "2024-03-12")
+
+		valuations, err := handler.ValuePortfolio(context.Background(), testPortfolioID, testDay("2024-03-09"), testDay("2024-03-12"))
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		// Flows before from belong to earlier snapshots
+		if !assert.Len(t, valuations, 2) {
+			return
+		}
+		assert.InDelta(t, 500, valuations[0].NetFlow, 0.001)
+		assert.InDelta(t, 10650, valuations[0].TotalValue, 0.001)
+	})
+
+	t.Run("buys without deposits are paid in from outside", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		expectBaseCurrency(mock, testPortfolioID, "USD")
+		mock.ExpectQuery(`SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.portfolio_id = \$1 ORDER BY t.transaction_date ASC`).
+			WithArgs(testPortfolioID).
+			WillReturnRows(sqlmock.NewRows(valuationLedgerColumns).
+				AddRow("t1", "asset-aapl", "AAPL", "BUY", 10.0, 150.0, 0.0, testDay("2024-03-04").Add(15*time.Hour), "", nil, nil, nil, "USD", 1500.0).
+				AddRow("t2", "asset-aapl", "AAPL", "BUY", 10.0, 160.0, 0.0, testDay("2024-03-06").Add(15*time.Hour), "", nil, nil, nil, "USD", 1600.0))
+		mock.ExpectQuery(`SELECT asset_id, date, close_price FROM price_history WHERE asset_id = ANY\(\$1\) AND date <= \$2`).
+			WithArgs(sqlmock.AnyArg(), "2024-03-06").
+			WillReturnRows(sqlmock.NewRows([]string{"asset_id", "date", "close_price"}).
+				AddRow("asset-aapl", testDay("2024-03-04"), 150.0).
+				AddRow("asset-aapl", testDay("2024-03-05"), 165.0).
+				AddRow("asset-aapl", testDay("2024-03-06"), 160.0))
+
+		valuations, err := handler.ValuePortfolio(context.Background(), testPortfolioID, testDay("2024-03-04"), testDay("2024-03-06"))
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		if !assert.Len(t, valuations, 3) {
+			return
+		}
+
+		// Each purchase is a flow, and cash never goes negative
+		for i, v := range valuations {
+			assert.InDelta(t, 0, v.CashValue, 0.001)
+			assert.InDelta(t, v.MarketValue, v.TotalValue, 0.001)
+			assert.InDelta(t, []float64{1500, 0, 1600}[i], v.NetFlow, 0.001)
+		}
+
+		// So the returns are the holding's: up 10%, then down 1.5% on the day more is bought
+		var points []valuationPoint
+		for _, v := range valuations {
+			points = append(points, valuationPoint{Date: v.Date, Value: v.TotalValue, Flow: v.NetFlow})
+		}
+		daily := dailyReturns(points)
+		assert.InDelta(t, 0, daily[0], 1e-9)
+		assert.InDelta(t, 0.1, daily[1], 1e-9)
+		assert.InDelta(t, 3200.0/3250-1, daily[2], 1e-9)
+		returns := calculateReturns(points)
+		assert.InDelta(t, (1.1*3200.0/3250-1)*100, *returns.Periods["since_inception"].TimeWeighted.CumulativePercent, 1e-9)
+	})
+}
+
+// fakeValuer values portfolios with a fixed result, recording the days asked for
+type fakeValuer struct {
+	valuations map[string][]services.PortfolioValuation
+	from, to   map[string]time.Time
+}
+
+func (v *fakeValuer) ValuePortfolio(ctx context.Context, portfolioID string, from, to time.Time) ([]services.PortfolioValuation, error) {
+	v.from[portfolioID], v.to[portfolioID] = from, to
+	valuations, ok := v.valuations[portfolioID]
+	if !ok {
+		return nil, errors.New("valuation failed")
+	}
+	return valuations, nil
+}
+
+// expectSnapshotUpserts expects a transaction storing valuations as snapshots
+func expectSnapshotUpserts(mock sqlmock.Sqlmock, userID, portfolioID string, valuations []services.PortfolioValuation) {
+	for _, v := range valuations {
+		mock.ExpectExec(`INSERT INTO portfolio_snapshots (.+) ON CONFLICT \(portfolio_id, snapshot_date\) DO UPDATE`).
+			WithArgs(userID, portfolioID, v.Date.Format("2006-01-02"), v.TotalValue, v.MarketValue, v.CashValue,
+				v.TotalCost, v.UnrealizedPnL, v.RealizedPnL, v.NetFlow).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+}
+
+// TestSnapshotScheduler tests storing daily snapshots for every portfolio and rebuilding one
+func TestSnapshotScheduler(t *testing.T) {
+	valuation := services.PortfolioValuation{
+		Date: testDay("2024-03-11"), TotalValue: 10650, MarketValue: 1650, CashValue: 9000,
+		TotalCost: 1500, UnrealizedPnL: 150, NetFlow: 500,
+	}
+	newScheduler := func(t *testing.T) (*Handler, sqlmock.Sqlmock, *fakeValuer, func()) {
+		handler, mock, cleanup := createTestHandler(t)
+		valuer := &fakeValuer{
+			valuations: map[string][]services.PortfolioValuation{testPortfolioID: {valuation}},
+			from:       map[string]time.Time{},
+			to:         map[string]time.Time{},
+		}
+		handler.services.Snapshots = services.NewSnapshotScheduler(handler.services.DB, valuer, 22*time.Hour+30*time.Minute, zap.NewNop())
+		return handler, mock, valuer, cleanup
+	}
+
+	t.Run("snapshots every portfolio since its latest snapshot", func(t *testing.T) {
+		handler, mock, valuer, cleanup := newScheduler(t)
+		defer cleanup()
+
+		mock.ExpectQuery(`SELECT p.id, p.user_id, (.+) FROM portfolios p ORDER BY p.created_at, p.id`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "last_snapshot", "first_traded"}).
+				AddRow(testPortfolioID, "user-1", testDay("2024-03-08"), testDay("2024-03-04")).
+				AddRow("portfolio-2", "user-1", nil, nil).
+				AddRow("portfolio-3", "user-2", nil, testDay("2024-03-05")))
+		mock.ExpectBegin()
+		expectSnapshotUpserts(mock, "user-1", testPortfolioID, []services.PortfolioValuation{valuation})
+
+		result, err := handler.services.Snapshots.SnapshotAll(context.Background())
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		assert.Equal(t, 1, result.Portfolios)
+		assert.Equal(t, 1, result.Snapshots)
+		assert.Equal(t, []string{"portfolio-3"}, result.Failed)
+
+		// Portfolios continue the day after their latest snapshot, or start at their first transaction
+		assert.Equal(t, testDay("2024-03-09"), valuer.from[testPortfolioID])
+		assert.Equal(t, testDay("2024-03-05"), valuer.from["portfolio-3"])
+		assert.NotContains(t, valuer.from, "portfolio-2")
+		assert.Equal(t, handler.services.Snapshots.LastClosedDay(time.Now()), valuer.to[testPortfolioID])
+	})
+
+	t.Run("last closed day waits for the run time", func(t *testing.T) {
+		handler, _, _, cleanup := newScheduler(t)
+		defer cleanup()
+
+		scheduler := handler.services.Snapshots
+		assert.Equal(t, testDay("2024-03-10"), scheduler.LastClosedDay(testDay("2024-03-11").Add(22*time.Hour)))
+		assert.Equal(t, testDay("2024-03-11"), scheduler.LastClosedDay(testDay("2024-03-11").Add(23*time.Hour)))
+	})
+
+	rebuild := func(handler *Handler, portfolioID string) *httptest.ResponseRecorder {
+		router := createTestRouter(handler, "POST", "/admin/portfolios/:id/snapshots/rebuild", handler.RebuildSnapshots)
+		req, _ := http.NewRequest("POST", "/admin/portfolios/"+portfolioID+"/snapshots/rebuild", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("rebuild replaces all snapshots", func(t *testing.T) {
+		handler, mock, valuer, cleanup := newScheduler(t)
+		defer cleanup()
+
+		mock.ExpectQuery(`SELECT p.user_id, (.+) FROM portfolios p WHERE p.id = \$1`).
+			WithArgs(testPortfolioID).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "first_traded"}).AddRow("user-1", testDay("2024-03-04")))
+		mock.ExpectBegin()
+		mock.ExpectExec(`DELETE FROM portfolio_snapshots WHERE portfolio_id = \$1`).
+			WithArgs(testPortfolioID).
+			WillReturnResult(sqlmock.NewResult(0, 5))
+		expectSnapshotUpserts(mock, "user-1", testPortfolioID, []services.PortfolioValuation{valuation})
+
+		w := rebuild(handler, testPortfolioID)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"snapshots_stored":1`)
+		assert.Equal(t, testDay("2024-03-04"), valuer.from[testPortfolioID])
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("rebuild of an unknown portfolio", func(t *testing.T) {
+		handler, mock, _, cleanup := newScheduler(t)
+		defer cleanup()
+
+		mock.ExpectQuery(`SELECT p.user_id, (.+) FROM portfolios p WHERE p.id = \$1`).
+			WithArgs("0a9b8c7d-6e5f-4a3b-9c1d-0e1f2a3b4c5d").
+			WillReturnError(sql.ErrNoRows)
+
+		w := rebuild(handler, "0a9b8c7d-6e5f-4a3b-9c1d-0e1f2a3b4c5d")
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("rebuild without a scheduler", func(t *testing.T) {
+		handler, _, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		w := rebuild(handler, testPortfolioID)
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+}
+
+// expectSnapshotInvalidation expects a portfolio's snapshots to be deleted from the day a ledger change
+// takes effect
+func expectSnapshotInvalidation(mock sqlmock.Sqlmock, portfolioID string, from driver.Value) {
+	mock.ExpectExec(`DELETE FROM portfolio_snapshots WHERE portfolio_id = \$1 AND snapshot_date >= \$2`).
+		WithArgs(portfolioID, from).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import "math"
+
+// tradingDaysPerYear annualizes statistics of daily returns
+const tradingDaysPerYear = 252
+
+// mean returns the average of values, or 0 for none
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// sampleStdDev returns the sample standard deviation of values, or 0 for fewer than two
+func sampleStdDev(values []float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	m := mean(values)
+	var sum float64
+	for _, v := range values {
+		sum += (v - m) * (v - m)
+	}
+	return math.Sqrt(sum / float64(len(values)-1))
+}
+
+// geometricMean returns the average compounded return of returns
+func geometricMean(returns []float64) float64 {
+	growth := 1.0
+	for _, r := range returns {
+		growth *= 1 + r
+	}
+	if growth <= 0 {
+		return -1
+	}
+	return math.Pow(growth, 1/float64(len(returns))) - 1
+}
+
+// optionalFloat returns a pointer to value, or nil when it isn't finite, so it's reported as null
+func optionalFloat(value float64) *float64 {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	return &value
+}
+
+// covarianceMatrix returns the sample covariance matrix of equally long series
+func covarianceMatrix(series [][]float64) [][]float64 {
+	matrix := make([][]float64, len(series))
+	for i := range series {
+		matrix[i] = make([]float64, len(series))
+	}
+	for i := range series {
+		for j := i; j < len(series); j++ {
+			covariance := sampleCovariance(series[i], series[j])
+			matrix[i][j], matrix[j][i] = covariance, covariance
+		}
+	}
+	return matrix
+}
+
+// correlationMatrix returns the correlations of a covariance matrix. Series that don't vary are
+// uncorrelated with the others.
+func correlationMatrix(covariance [][]float64) [][]float64 {
+	matrix := make([][]float64, len(covariance))
+	for i := range covariance {
+		matrix[i] = make([]float64, len(covariance))
+		for j := range covariance {
+			switch {
+			case i == j:
+				matrix[i][j] = 1
+			case covariance[i][i] > 0 && covariance[j][j] > 0:
+				matrix[i][j] = covariance[i][j] / math.Sqrt(covariance[i][i]*covariance[j][j])
+			}
+		}
+	}
+	return matrix
+}
+
+// ledoitWolf shrinks the covariance of equally long series towards a multiple of the identity matrix,
+// with the intensity that minimizes the expected squared error (Ledoit and Wolf, 2004). It returns the
+// shrunk matrix and the intensity, from 0 for the sample covariance to 1 for the target.
+func ledoitWolf(series [][]float64) ([][]float64, float64) {
+	if len(series) == 0 || len(series[0]) < 2 {
+		return covarianceMatrix(series), 0
+	}
+	p, n := len(series), len(series[0])
+
+	centered := make([][]float64, p)
+	for i, values := range series {
+		m := mean(values)
+		centered[i] = make([]float64, n)
+		for k, v := range values {
+			centered[i][k] = v - m
+		}
+	}
+
+	// The estimator is derived for the maximum likelihood covariance, which divides by n
+	sample := make([][]float64, p)
+	var target float64
+	for i := range centered {
+		sample[i] = make([]float64, p)
+		for j := range centered {
+			var sum float64
+			for k := 0; k < n; k++ {
+				sum += centered[i][k] * centered[j][k]
+			}
+			sample[i][j] = sum / float64(n)
+		}
+		target += sample[i][i] / float64(p)
+	}
+
+	// Dispersion of the sample around the target, and the sample's own estimation error
+	var dispersion, noise float64
+	for i := range sample {
+		for j := range sample {
+			distance := sample[i][j]
+			if i == j {
+				distance -= target
+			}
+			dispersion += distance * distance
+			for k := 0; k < n; k++ {
+				deviation := centered[i][k]*centered[j][k] - sample[i][j]
+				noise += deviation * deviation
+			}
+		}
+	}
+	noise /= float64(n) * float64(n)
+
+	var intensity float64
+	if dispersion > 0 {
+		intensity = math.Min(noise, dispersion) / dispersion
+	}
+	shrunk := make([][]float64, p)
+	for i := range sample {
+		shrunk[i] = make([]float64, p)
+		for j := range sample {
+			shrunk[i][j] = (1 - intensity) * sample[i][j]
+			if i == j {
+				shrunk[i][j] += intensity * target
+			}
+		}
+	}
+	return shrunk, intensity
+}
+
+// cholesky returns the lower triangular L with L·Lᵀ = matrix. A matrix that is only positive
+// semi-definite, such as one with perfectly correlated series, gets a small ridge added to its diagonal.
+func cholesky(matrix [][]float64) ([][]float64, bool) {
+	n := len(matrix)
+	var scale float64
+	for i := range matrix {
+		scale = math.Max(scale, matrix[i][i])
+	}
+	for _, ridge := range []float64{0, 1e-12, 1e-10, 1e-8} {
+		lower := make([][]float64, n)
+		ok := true
+		for i := 0; i < n && ok; i++ {
+			lower[i] = make([]float64, n)
+			for j := 0; j <= i; j++ {
+				sum := matrix[i][j]
+				if i == j {
+					sum += ridge * scale
+				}
+				for k := 0; k < j; k++ {
+					sum -= lower[i][k] * lower[j][k]
+				}
+				if i == j {
+					if sum <= 0 {
+						ok = false
+						break
+					}
+					lower[i][i] = math.Sqrt(sum)
+				} else {
+					lower[i][j] = sum / lower[j][j]
+				}
+			}
+		}
+		if ok {
+			return lower, true
+		}
+	}
+	return nil, false
+}
+
+// choleskySolve solves L·Lᵀ·x = b for x, given the lower triangular factor L from cholesky
+func choleskySolve(lower [][]float64, b []float64) []float64 {
+	n := len(b)
+	y := make([]float64, n)
+	for i := 0; i < n; i++ {
+		sum := b[i]
+		for k := 0; k < i; k++ {
+			sum -= lower[i][k] * y[k]
+		}
+		y[i] = sum / lower[i][i]
+	}
+	x := make([]float64, n)
+	for i := n - 1; i >= 0; i-- {
+		sum := y[i]
+		for k := i + 1; k < n; k++ {
+			sum -= lower[k][i] * x[k]
+		}
+		x[i] = sum / lower[i][i]
+	}
+	return x
+}
+
+// normalPDF is the standard normal density
+func normalPDF(x float64) float64 {
+	return math.Exp(-x*x/2) / math.Sqrt(2*math.Pi)
+}
+
+// normalQuantile is the inverse of the standard normal distribution function, for 0 < p < 1
+// (Acklam's rational approximation, refined with one Halley step)
+func normalQuantile(p float64) float64 {
+	a := []float64{-3.969683028665376e+01, 2.209460984245205e+02, -2.759285104469687e+02, 1.383577518672690e+02, -3.066479806614716e+01, 2.506628277459239e+00}
+	b := []float64{-5.447609879822406e+01, 1.615858368580409e+02, -1.556989798598866e+02, 6.680131188771972e+01, -1.328068155288572e+01}
+	c := []float64{-7.784894002430293e-03, -3.223964580411365e-01, -2.400758277161838e+00, -2.549732539343734e+00, 4.374664141464968e+00, 2.938163982698783e+00}
+	d := []float64{7.784695709041462e-03, 3.224671290700398e-01, 2.445134137142996e+00, 3.754408661907416e+00}
+
+	const low = 0.02425
+	var x float64
+	switch {
+	case p < low:
+		q := math.Sqrt(-2 * math.Log(p))
+		x = (((((c[0]*q+c[1])*q+c[2])*q+c[3])*q+c[4])*q + c[5]) / ((((d[0]*q+d[1])*q+d[2])*q+d[3])*q + 1)
+	case p > 1-low:
+		q := math.Sqrt(-2 * math.Log(1-p))
+		x = -(((((c[0]*q+c[1])*q+c[2])*q+c[3])*q+c[4])*q + c[5]) / ((((d[0]*q+d[1])*q+d[2])*q+d[3])*q + 1)
+	default:
+		q := p - 0.5
+		r := q * q
+		x = (((((a[0]*r+a[1])*r+a[2])*r+a[3])*r+a[4])*r + a[5]) * q / (((((b[0]*r+b[1])*r+b[2])*r+b[3])*r+b[4])*r + 1)
+	}
+
+	// One Halley step against the exact distribution function
+	e := 0.5*math.Erfc(-x/math.Sqrt2) - p
+	u := e * math.Sqrt(2*math.Pi) * math.Exp(x*x/2)
+	return x - u/(1+x*u/2)
+}
@@ -0,0 +1,554 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Factors a hypothetical stress test can shock
+const (
+	factorMarket    = "market"     // moves each holding by its beta times the shock
+	factorRates     = "rates"      // a change in yields, moving bonds by minus their duration times it
+	factorSector    = "sector"     // moves the holdings in a sector
+	factorAssetType = "asset_type" // moves the holdings of an asset type
+	factorSymbol    = "symbol"     // moves one holding
+)
+
+// defaultBondDuration is the duration a rates shock assumes for bonds, in years
+const defaultBondDuration = 6.0
+
+// stressCoverageDays is how far a holding's first and last closes may fall inside a historical window
+// for the holding to be replayed through it
+const stressCoverageDays = 7
+
+// daysPerWeek is the number of trading days in a week
+const daysPerWeek = 5
+
+// stressWindow is a stretch of market history the current holdings are replayed through
+type stressWindow struct {
+	ID   string
+	Name string
+	From time.Time
+	To   time.Time
+}
+
+// historicalStressWindows are the market episodes replayed by default, from peak to trough
+var historicalStressWindows = []stressWindow{
+	{ID: "gfc_2008", Name: "2008 financial crisis", From: time.Date(2008, 9, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2009, 3, 9, 0, 0, 0, 0, time.UTC)},
+	{ID: "covid_2020", Name: "2020 COVID crash", From: time.Date(2020, 2, 19, 0, 0, 0, 0, time.UTC), To: time.Date(2020, 3, 23, 0, 0, 0, 0, time.UTC)},
+	{ID: "rates_2022", Name: "2022 rate shock", From: time.Date(2022, 1, 3, 0, 0, 0, 0, time.UTC), To: time.Date(2022, 10, 12, 0, 0, 0, 0, time.UTC)},
+}
+
+// factorShock moves one factor: prices by a fraction, or yields by an absolute change for rates
+type factorShock struct {
+	Factor string  `json:"factor"`
+	Key    string  `json:"key,omitempty"` // the sector, asset type or symbol
+	Shock  float64 `json:"shock"`
+}
+
+// hypotheticalStress is a set of factor shocks applied at once
+type hypotheticalStress struct {
+	ID     string
+	Name   string
+	Shocks []factorShock
+}
+
+// defaultHypotheticalStresses are the factor shocks applied unless others are asked for
+var defaultHypotheticalStresses = []hypotheticalStress{
+	{ID: "tech_selloff", Name: "Technology -30%", Shocks: []factorShock{{Factor: factorSector, Key: "Technology", Shock: -0.3}}},
+	{ID: "rates_up_200bp", Name: "Rates +200bp", Shocks: []factorShock{{Factor: factorRates, Shock: 0.02}}},
+	{ID: "equity_bear_market", Name: "Equities -20%", Shocks: []factorShock{{Factor: factorMarket, Shock: -0.2}}},
+}
+
+// holdingStress is one holding's part in a stress test, in the base currency. The return and P&L are nil
+// for a holding a historical window couldn't replay.
+type holdingStress struct {
+	Symbol        string   `json:"symbol"`
+	WeightPercent float64  `json:"weight_percent"`
+	ReturnPercent *float64 `json:"return_percent"`
+	PnL           *float64 `json:"pnl"`
+}
+
+// stressMove is the portfolio's change in value between two closes of a historical window
+type stressMove struct {
+	From    string  `json:"from"`
+	To      string  `json:"to"`
+	Percent float64 `json:"percent"`
+	PnL     float64 `json:"pnl"`
+}
+
+// stressResult is how the current holdings fare in one stress test. The historical figures are only set
+// for windows, where the P&L is that of the holdings replayed, covering CoveragePercent of the portfolio,
+// and nil when none could be.
+type stressResult struct {
+	ID                 string          `json:"id"`
+	Name               string          `json:"name"`
+	From               string          `json:"from,omitempty"`
+	To                 string          `json:"to,omitempty"`
+	Observations       *int            `json:"observations,omitempty"`
+	Shocks             []factorShock   `json:"shocks,omitempty"`
+	CoveragePercent    *float64        `json:"coverage_percent,omitempty"`
+	PnL                *float64        `json:"pnl"`
+	PnLPercent         *float64        `json:"pnl_percent"`
+	MaxDrawdownPercent *float64        `json:"max_drawdown_percent,omitempty"`
+	WorstDay           *stressMove     `json:"worst_day,omitempty"`
+	WorstWeek          *stressMove     `json:"worst_week,omitempty"`
+	Holdings           []holdingStress `json:"holdings"`
+	Excluded           []string        `json:"excluded,omitempty"` // holdings without price history across the window
+}
+
+// parseFactorShocks parses comma-separated factor shocks such as "sector:Technology:-0.3,rates:+200bp".
+// Shocks are fractions, percentages with a % sign, or basis points with a bp suffix.
+func parseFactorShocks(spec string) ([]factorShock, error) {
+	var shocks []factorShock
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.Split(part, ":")
+		shock := factorShock{Factor: strings.ToLower(strings.TrimSpace(fields[0]))}
+		switch {
+		case (shock.Factor == factorMarket || shock.Factor == factorRates) && len(fields) == 2:
+		case (shock.Factor == factorSector || shock.Factor == factorAssetType || shock.Factor == factorSymbol) && len(fields) == 3:
+			shock.Key = strings.TrimSpace(fields[1])
+			if shock.Factor != factorSector {
+				shock.Key = strings.ToUpper(shock.Key)
+			}
+			if shock.Key == "" {
+				return nil, fmt.Errorf("%q names no %s", part, shock.Factor)
+			}
+		default:
+			return nil, fmt.Errorf("%q isn't market:SHOCK, rates:SHOCK, or sector, asset_type or symbol:NAME:SHOCK", part)
+		}
+
+		value, err := parseShockValue(fields[len(fields)-1])
+		if err != nil {
+			return nil, fmt.Errorf("%q has an invalid shock", part)
+		}
+		if shock.Factor == factorRates && math.Abs(value) > 0.1 {
+			return nil, fmt.Errorf("%q moves rates by more than 1000bp", part)
+		}
+		if shock.Factor != factorRates && value <= -1 {
+			return nil, fmt.Errorf("%q must be above -1, a 100%% fall", part)
+		}
+		shock.Shock = value
+		shocks = append(shocks, shock)
+	}
+	if len(shocks) == 0 {
+		return nil, fmt.Errorf("no shocks given")
+	}
+	return shocks, nil
+}
+
+// parseShockValue parses a fraction, a percentage such as -30% or basis points such as +200bp
+func parseShockValue(value string) (float64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	scale := 1.0
+	switch {
+	case strings.HasSuffix(value, "bp"):
+		value, scale = strings.TrimSuffix(value, "bp"), 1e-4
+	case strings.HasSuffix(value, "%"):
+		value, scale = strings.TrimSuffix(value, "%"), 1e-2
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+		return 0, fmt.Errorf("invalid shock %q", value)
+	}
+	return parsed * scale, nil
+}
+
+// factorReturn returns a holding's return under shocks: the sum of each factor's shock times the
+// holding's exposure to it, and no worse than a total loss
+func factorReturn(holding rebalanceHolding, beta, bondDuration float64, shocks []factorShock) float64 {
+	var r float64
+	for _, shock := range shocks {
+		switch shock.Factor {
+		case factorMarket:
+			r += beta * shock.Shock
+		case factorRates:
+			if strings.EqualFold(holding.AssetType, "BOND") {
+				r -= bondDuration * shock.Shock
+			}
+		case factorSector:
+			if holding.Sector != "" && strings.EqualFold(holding.Sector, shock.Key) {
+				r += shock.Shock
+			}
+		case factorAssetType:
+			if strings.EqualFold(holding.AssetType, shock.Key) {
+				r += shock.Shock
+			}
+		case factorSymbol:
+			if holding.Symbol == shock.Key {
+				r += shock.Shock
+			}
+		}
+	}
+	return math.Max(r, -1)
+}
+
+// applyFactorShocks values the holdings under a hypothetical stress. Holdings without a beta take the
+// market shock in full.
+func applyFactorShocks(stress hypotheticalStress, holdings []rebalanceHolding, betas map[string]float64, bondDuration float64) stressResult {
+	result := stressResult{ID: stress.ID, Name: stress.Name, Shocks: stress.Shocks, Holdings: []holdingStress{}}
+
+	values, symbols, total := stressValues(holdings)
+	bySymbol := map[string]rebalanceHolding{}
+	for _, holding := range holdings {
+		bySymbol[holding.Symbol] = holding
+	}
+	var pnl float64
+	for _, symbol := range symbols {
+		beta, ok := betas[symbol]
+		if !ok {
+			beta = 1
+		}
+		r := factorReturn(bySymbol[symbol], beta, bondDuration, stress.Shocks)
+		holdingPnL := values[symbol] * r
+		holding := holdingStress{Symbol: symbol, ReturnPercent: optionalFloat(r * 100), PnL: &holdingPnL}
+		if total > 0 {
+			holding.WeightPercent = values[symbol] / total * 100
+		}
+		pnl += holdingPnL
+		result.Holdings = append(result.Holdings, holding)
+	}
+	result.PnL = &pnl
+	if total > 0 {
+		result.PnLPercent = optionalFloat(pnl / total * 100)
+	}
+	return result
+}
+
+// stressValues returns the holdings' market values in the base currency by symbol, the symbols in
+// order, and their total
+func stressValues(holdings []rebalanceHolding) (map[string]float64, []string, float64) {
+	values := map[string]float64{}
+	var symbols []string
+	var total float64
+	for _, holding := range holdings {
+		if _, ok := values[holding.Symbol]; !ok {
+			symbols = append(symbols, holding.Symbol)
+		}
+		values[holding.Symbol] += holding.value()
+		total += holding.value()
+	}
+	sort.Strings(symbols)
+	return values, symbols, total
+}
+
+// coveredSymbols returns the symbols whose closes span the window, give or take stressCoverageDays
+func coveredSymbols(symbols []string, closes closingPrices, window stressWindow) []string {
+	var covered []string
+	for _, symbol := range symbols {
+		prices := closes[symbol]
+		if len(prices) >= 2 &&
+			!prices[0].Date.After(window.From.AddDate(0, 0, stressCoverageDays)) &&
+			!prices[len(prices)-1].Date.Before(window.To.AddDate(0, 0, -stressCoverageDays)) {
+			covered = append(covered, symbol)
+		}
+	}
+	return covered
+}
+
+// replayWindow replays holdings worth values through a window's daily returns, holding the quantities
+// they'd have had at its start. Holdings left out of the matrix are listed without a return, and the
+// portfolio's figures are those of the holdings replayed.
+func replayWindow(window stressWindow, values map[string]float64, total float64, matrix returnMatrix) stressResult {
+	observations := len(matrix.Dates)
+	result := stressResult{
+		ID:           window.ID,
+		Name:         window.Name,
+		From:         window.From.Format("2006-01-02"),
+		To:           window.To.Format("2006-01-02"),
+		Observations: &observations,
+		Holdings:     []holdingStress{},
+	}
+
+	replayed := map[string]bool{}
+	var covered float64
+	if observations > 0 {
+		for _, symbol := range matrix.Symbols {
+			replayed[symbol] = true
+			covered += values[symbol]
+		}
+	}
+	weight := func(value float64) float64 {
+		if total > 0 {
+			return value / total * 100
+		}
+		return 0
+	}
+	for symbol, value := range values {
+		if !replayed[symbol] {
+			result.Holdings = append(result.Holdings, holdingStress{Symbol: symbol, WeightPercent: weight(value)})
+			result.Excluded = append(result.Excluded, symbol)
+		}
+	}
+	sort.Strings(result.Excluded)
+	if total > 0 {
+		result.CoveragePercent = optionalFloat(covered / total * 100)
+	}
+	if covered <= 0 {
+		sort.Slice(result.Holdings, func(i, j int) bool { return result.Holdings[i].Symbol < result.Holdings[j].Symbol })
+		return result
+	}
+
+	// The replayed holdings' value at every close
+	series := make([]float64, observations+1)
+	series[0] = covered
+	for i, symbol := range matrix.Symbols {
+		start := values[symbol]
+		value := start
+		for d, r := range matrix.Returns[i] {
+			value *= 1 + r
+			series[d+1] += value
+		}
+		pnl := value - start
+		result.Holdings = append(result.Holdings, holdingStress{
+			Symbol:        symbol,
+			WeightPercent: weight(start),
+			ReturnPercent: optionalFloat((value/start - 1) * 100),
+			PnL:           &pnl,
+		})
+	}
+	sort.Slice(result.Holdings, func(i, j int) bool { return result.Holdings[i].Symbol < result.Holdings[j].Symbol })
+
+	dates := append([]time.Time{matrix.Start}, matrix.Dates...)
+	move := func(from, to int) *stressMove {
+		return &stressMove{
+			From:    dates[from].Format("2006-01-02"),
+			To:      dates[to].Format("2006-01-02"),
+			Percent: (series[to]/series[from] - 1) * 100,
+			PnL:     series[to] - series[from],
+		}
+	}
+	for d := 1; d <= observations; d++ {
+		if day := move(d-1, d); result.WorstDay == nil || day.Percent < result.WorstDay.Percent {
+			result.WorstDay = day
+		}
+		if d >= daysPerWeek {
+			if week := move(d-daysPerWeek, d); result.WorstWeek == nil || week.Percent < result.WorstWeek.Percent {
+				result.WorstWeek = week
+			}
+		}
+	}
+
+	peak, maxDrawdown := series[0], 0.0
+	for _, value := range series {
+		peak = math.Max(peak, value)
+		maxDrawdown = math.Min(maxDrawdown, value/peak-1)
+	}
+	result.MaxDrawdownPercent = optionalFloat(maxDrawdown * 100)
+
+	pnl := series[observations] - covered
+	result.PnL = &pnl
+	result.PnLPercent = optionalFloat(pnl / covered * 100)
+	return result
+}
+
+// parseStressWindows parses the "windows" query parameter: a comma-separated list of historical
+// windows, all of them by default, or "none"
+func parseStressWindows(value string) ([]stressWindow, error) {
+	if value == "" {
+		return historicalStressWindows, nil
+	}
+	if value == "none" {
+		return nil, nil
+	}
+	var windows []stressWindow
+	seen := map[string]bool{}
+	for _, id := range strings.Split(value, ",") {
+		id = strings.ToLower(strings.TrimSpace(id))
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		found := false
+		for _, window := range historicalStressWindows {
+			if window.ID == id {
+				windows = append(windows, window)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown window %q, expected gfc_2008, covid_2020 or rates_2022", id)
+		}
+	}
+	return windows, nil
+}
+
+// GetStressTest replays the current holdings through historical market episodes and applies
+// hypothetical factor shocks to them
+func (h *Handler) GetStressTest(c *gin.Context) {
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run stress tests"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
+		return
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	windows, err := parseStressWindows(c.Query("windows"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid windows: %v", err)})
+		return
+	}
+	if from, to := c.Query("from"), c.Query("to"); from != "" || to != "" {
+		start, startErr := time.Parse("2006-01-02", from)
+		end, endErr := time.Parse("2006-01-02", to)
+		if startErr != nil || endErr != nil || !start.Before(end) || end.After(today) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from/to, expected a window of YYYY-MM-DD dates ending by today"})
+			return
+		}
+		windows = append(windows, stressWindow{ID: "custom", Name: fmt.Sprintf("%s to %s", from, to), From: start, To: end})
+	}
+
+	stresses := defaultHypotheticalStresses
+	if specs := c.QueryArray("shocks"); len(specs) > 0 {
+		stresses = nil
+		for i, spec := range specs {
+			if spec == "none" {
+				continue
+			}
+			shocks, err := parseFactorShocks(spec)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid shocks: %v", err)})
+				return
+			}
+			stresses = append(stresses, hypotheticalStress{ID: fmt.Sprintf("custom_%d", i+1), Name: spec, Shocks: shocks})
+		}
+	}
+
+	bondDuration := defaultBondDuration
+	if value := c.Query("bond_duration"); value != "" {
+		bondDuration, err = strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(bondDuration) || bondDuration < 0 || bondDuration > 30 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bond_duration, expected years from 0 to 30"})
+			return
+		}
+	}
+
+	// Betas for market shocks are measured over a lookback window against a benchmark
+	lookback, lookbackFrom, ok := lookbackStart(c, today)
+	if !ok {
+		return
+	}
+	benchmark, ok := h.requestedBenchmark(c)
+	if !ok {
+		return
+	}
+
+	// Holdings are valued in the portfolio's base currency
+	fx, err := h.newFXConverter(h.services.DB, portfolioID)
+	if err != nil {
+		h.logger.Error("Failed to load base currency", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run stress tests"})
+		return
+	}
+	holdings, warnings, err := h.loadRebalanceHoldings(portfolioID, fx)
+	if err != nil {
+		h.respondFXError(c, err, "Failed to run stress tests")
+		return
+	}
+	values, symbols, total := stressValues(holdings)
+
+	historical := []stressResult{}
+	if len(symbols) > 0 {
+		for _, window := range windows {
+			closes, err := h.loadSymbolCloses(symbols, window.From, window.To)
+			if err != nil {
+				h.logger.Error("Failed to load price history", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run stress tests"})
+				return
+			}
+			result := replayWindow(window, values, total, alignReturns(coveredSymbols(symbols, closes, window), closes))
+			if len(result.Excluded) > 0 {
+				warnings = append(warnings, fmt.Sprintf("No price history for %s across the %s window; its P&L covers the other holdings only", strings.Join(result.Excluded, ", "), window.Name))
+			}
+			historical = append(historical, result)
+		}
+	}
+
+	betas := map[string]float64{}
+	marketShocked := false
+	for _, stress := range stresses {
+		for _, shock := range stress.Shocks {
+			marketShocked = marketShocked || shock.Factor == factorMarket
+		}
+	}
+	var betaWindow map[string]interface{}
+	if marketShocked && len(symbols) > 0 {
+		betaSymbols := append([]string{}, symbols...)
+		for _, component := range benchmark {
+			if _, held := values[component.Symbol]; !held {
+				betaSymbols = append(betaSymbols, component.Symbol)
+			}
+		}
+		matrix, historyWarnings, err := h.loadAlignedReturns(betaSymbols, lookbackFrom, today)
+		if err != nil {
+			h.logger.Error("Failed to load price history", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run stress tests"})
+			return
+		}
+		warnings = append(warnings, historyWarnings...)
+		benchmarkReturns := matrix.weighted(benchmarkWeights(benchmark))
+		for i, symbol := range matrix.Symbols {
+			if beta := betaOf(matrix.Returns[i], benchmarkReturns); beta != nil {
+				betas[symbol] = *beta
+			}
+		}
+		var unmeasured []string
+		for _, symbol := range symbols {
+			if _, ok := betas[symbol]; !ok {
+				unmeasured = append(unmeasured, symbol)
+			}
+		}
+		if len(unmeasured) > 0 {
+			warnings = append(warnings, fmt.Sprintf("No beta for %s, so market shocks apply to them in full", strings.Join(unmeasured, ", ")))
+		}
+		betaWindow = lookbackWindow(lookback, lookbackFrom, today, matrix)
+	}
+
+	hypothetical := []stressResult{}
+	if len(symbols) > 0 {
+		for _, stress := range stresses {
+			hypothetical = append(hypothetical, applyFactorShocks(stress, holdings, betas, bondDuration))
+		}
+	}
+
+	response := gin.H{
+		"base_currency":   fx.base,
+		"portfolio_value": total,
+		"bond_duration":   bondDuration,
+		"historical":      historical,
+		"hypothetical":    hypothetical,
+	}
+	if betaWindow != nil {
+		response["beta_window"] = betaWindow
+	}
+	if len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/portfolio-management/api-gateway/internal/services"
+)
+
+// stressTestMatrix returns six days of returns in which AAA falls 10% on the first day and recovers on
+// the last, while BBB doesn't move
+func stressTestMatrix() returnMatrix {
+	return returnMatrix{
+		Symbols: []string{"AAA", "BBB"},
+		Start:   testDay("2020-02-19"),
+		Dates: []time.Time{
+			testDay("2020-02-20"), testDay("2020-02-21"), testDay("2020-02-24"),
+			testDay("2020-02-25"), testDay("2020-02-26"), testDay("2020-02-27"),
+		},
+		Returns: [][]float64{
+			{-0.1, 0, 0, 0, 0, 0.1},
+			{0, 0, 0, 0, 0, 0},
+		},
+	}
+}
+
+// TestParseFactorShocks tests how factor shocks are read from the query string
+func TestParseFactorShocks(t *testing.T) {
+	shocks, err := parseFactorShocks("sector:Technology:-0.3, rates:+200bp,market:-20%,symbol:aapl:-0.5,asset_type:crypto:-0.4")
+	assert.NoError(t, err)
+	assert.Equal(t, []factorShock{
+		{Factor: factorSector, Key: "Technology", Shock: -0.3},
+		{Factor: factorRates, Shock: 0.02},
+		{Factor: factorMarket, Shock: -0.2},
+		{Factor: factorSymbol, Key: "AAPL", Shock: -0.5},
+		{Factor: factorAssetType, Key: "CRYPTO", Shock: -0.4},
+	}, shocks)
+
+	for _, spec := range []string{"", "oil:-0.3", "sector:-0.3", "market:Technology:-0.3", "sector::-0.3", "market:lots", "market:-1", "rates:+2000bp"} {
+		_, err := parseFactorShocks(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+// TestApplyFactorShocks tests how each factor moves the holdings exposed to it
+func TestApplyFactorShocks(t *testing.T) {
+	holdings := scenarioTestHoldings()
+
+	result := applyFactorShocks(defaultHypotheticalStresses[0], holdings, nil, defaultBondDuration)
+	assert.InDelta(t, -300, *result.PnL, 1e-9)
+	assert.InDelta(t, -15, *result.PnLPercent, 1e-9)
+	assert.Len(t, result.Holdings, 2)
+	assert.InDelta(t, 50, result.Holdings[0].WeightPercent, 1e-9)
+	assert.InDelta(t, -30, *result.Holdings[0].ReturnPercent, 1e-9)
+	assert.InDelta(t, 0, *result.Holdings[1].PnL, 1e-9)
+
+	// A rise in rates moves bonds by their duration
+	result = applyFactorShocks(defaultHypotheticalStresses[1], holdings, nil, defaultBondDuration)
+	assert.InDelta(t, 0, *result.Holdings[0].PnL, 1e-9)
+	assert.InDelta(t, -120, *result.Holdings[1].PnL, 1e-9)
+
+	// The market moves holdings by their beta, or in full without one
+	result = applyFactorShocks(defaultHypotheticalStresses[2], holdings, map[string]float64{"AAA": 1.5}, defaultBondDuration)
+	assert.InDelta(t, -300, *result.Holdings[0].PnL, 1e-9)
+	assert.InDelta(t, -200, *result.Holdings[1].PnL, 1e-9)
+
+	// Shocks add up, but no holding loses more than it's worth
+	stress := hypotheticalStress{ID: "crash", Shocks: []factorShock{
+		{Factor: factorMarket, Shock: -0.5},
+		{Factor: factorSymbol, Key: "AAA", Shock: -0.9},
+	}}
+	result = applyFactorShocks(stress, holdings, nil, defaultBondDuration)
+	assert.InDelta(t, -100, *result.Holdings[0].ReturnPercent, 1e-9)
+	assert.InDelta(t, -1500, *result.PnL, 1e-9)
+}
+
+// TestReplayWindow tests how holdings are replayed through a historical window
+func TestReplayWindow(t *testing.T) {
+	window := historicalStressWindows[1]
+	values := map[string]float64{"AAA": 1000, "BBB": 1000, "CCC": 500}
+
+	// CCC isn't in the matrix, so the figures cover AAA and BBB only
+	result := replayWindow(window, values, 2500, stressTestMatrix())
+	assert.Equal(t, "covid_2020", result.ID)
+	assert.Equal(t, 6, *result.Observations)
+	assert.InDelta(t, 80, *result.CoveragePercent, 1e-9)
+	assert.InDelta(t, -10, *result.PnL, 1e-9)
+	assert.InDelta(t, -0.5, *result.PnLPercent, 1e-9)
+	assert.InDelta(t, -5, *result.MaxDrawdownPercent, 1e-9)
+	assert.Equal(t, "2020-02-19", result.WorstDay.From)
+	assert.Equal(t, "2020-02-20", result.WorstDay.To)
+	assert.InDelta(t, -5, result.WorstDay.Percent, 1e-9)
+	assert.InDelta(t, -100, result.WorstDay.PnL, 1e-9)
+	assert.Equal(t, "2020-02-19", result.WorstWeek.From)
+	assert.Equal(t, "2020-02-26", result.WorstWeek.To)
+	assert.InDelta(t, -5, result.WorstWeek.Percent, 1e-9)
+	assert.Len(t, result.Holdings, 3)
+	assert.Equal(t, "AAA", result.Holdings[0].Symbol)
+	assert.InDelta(t, 40, result.Holdings[0].WeightPercent, 1e-9)
+	assert.InDelta(t, -1, *result.Holdings[0].ReturnPercent, 1e-9)
+	assert.InDelta(t, -10, *result.Holdings[0].PnL, 1e-9)
+	assert.Equal(t, "CCC", result.Holdings[2].Symbol)
+	assert.InDelta(t, 20, result.Holdings[2].WeightPercent, 1e-9)
+	assert.Nil(t, result.Holdings[2].ReturnPercent)
+	assert.Nil(t, result.Holdings[2].PnL)
+	assert.Equal(t, []string{"CCC"}, result.Excluded)
+
+	// A window shorter than a week has no worst week
+	short := stressTestMatrix()
+	short.Dates = short.Dates[:3]
+	short.Returns = [][]float64{short.Returns[0][:3], short.Returns[1][:3]}
+	result = replayWindow(window, values, 2500, short)
+	assert.NotNil(t, result.WorstDay)
+	assert.Nil(t, result.WorstWeek)
+
+	// Without any history there's nothing to replay
+	result = replayWindow(window, values, 2500, returnMatrix{})
+	assert.Nil(t, result.PnL)
+	assert.InDelta(t, 0, *result.CoveragePercent, 1e-9)
+	assert.Len(t, result.Holdings, 3)
+	assert.Equal(t, []string{"AAA", "BBB", "CCC"}, result.Excluded)
+}
+
+// TestCoveredSymbols tests that only holdings with closes across a window are replayed through it
+func TestCoveredSymbols(t *testing.T) {
+	window := historicalStressWindows[1]
+	closes := closingPrices{
+		"AAA": {{Date: testDay("2020-02-19"), Close: 100}, {Date: testDay("2020-03-23"), Close: 70}},
+		"BBB": {{Date: testDay("2020-02-24"), Close: 100}, {Date: testDay("2020-03-18"), Close: 90}},
+		"CCC": {{Date: testDay("2020-03-02"), Close: 100}, {Date: testDay("2020-03-23"), Close: 80}},
+	}
+	covered := coveredSymbols([]string{"AAA", "BBB", "CCC", "DDD"}, closes, window)
+	assert.Equal(t, []string{"AAA", "BBB"}, covered)
+}
+
+// TestParseStressWindows tests choosing the historical windows to replay
+func TestParseStressWindows(t *testing.T) {
+	windows, err := parseStressWindows("")
+	assert.NoError(t, err)
+	assert.Len(t, windows, 3)
+
+	windows, err = parseStressWindows("RATES_2022, gfc_2008,gfc_2008")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"rates_2022", "gfc_2008"}, []string{windows[0].ID, windows[1].ID})
+
+	windows, err = parseStressWindows("none")
+	assert.NoError(t, err)
+	assert.Empty(t, windows)
+
+	_, err = parseStressWindows("dotcom_2000")
+	assert.Error(t, err)
+}
+
+// TestGetStressTest tests the stress test endpoint
+func TestGetStressTest(t *testing.T) {
+	get := func(handler *Handler, target string) *httptest.ResponseRecorder {
+		router := createTestRouter(handler, "GET", "/analytics/stress", handler.GetStressTest)
+		req, _ := http.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	holdingRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"symbol", "asset_type", "sector", "currency", "quantity", "average_cost"}).
+			AddRow("AAA", "STOCK", "Technology", "USD", 10.0, 50.0).
+			AddRow("BBB", "BOND", "Fixed Income", "USD", 20.0, 60.0)
+	}
+	quotes := map[string]*services.Quote{"AAA": {CurrentPrice: 100}, "BBB": {CurrentPrice: 50}}
+	type response struct {
+		PortfolioValue float64        `json:"portfolio_value"`
+		Historical     []stressResult `json:"historical"`
+		Hypothetical   []stressResult `json:"hypothetical"`
+		Warnings       []string       `json:"warnings"`
+	}
+
+	t.Run("historical window and factor shock", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		handler.services.MarketData = &mockMarketData{quotes: quotes}
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		expectBaseCurrency(mock, testPortfolioID, "USD")
+		expectScenarioHoldings(mock, holdingRows())
+		mock.ExpectQuery(`SELECT a.symbol, ph.date, ph.close_price FROM price_history ph JOIN assets a ON ph.asset_id = a.id WHERE a.symbol = ANY\(\$1\)`).
+			WithArgs(sqlmock.AnyArg(), "2020-02-19", "2020-03-23").
+			WillReturnRows(sqlmock.NewRows([]string{"symbol", "date", "close_price"}).
+				AddRow("AAA", testDay("2020-02-19"), 100.0).
+				AddRow("AAA", testDay("2020-03-02"), 80.0).
+				AddRow("AAA", testDay("2020-03-23"), 70.0))
+
+		w := get(handler, "/analytics/stress?windows=covid_2020&shocks=sector:Technology:-30%25")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var body response
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.InDelta(t, 2000, body.PortfolioValue, 1e-9)
+		if assert.Len(t, body.Historical, 1) {
+			// BBB has no history, so the figures cover AAA's half of the portfolio
+			covid := body.Historical[0]
+			assert.InDelta(t, 50, *covid.CoveragePercent, 1e-9)
+			assert.InDelta(t, -300, *covid.PnL, 1e-9)
+			assert.InDelta(t, -30, *covid.PnLPercent, 1e-9)
+			assert.InDelta(t, -20, covid.WorstDay.Percent, 1e-9)
+			assert.Nil(t, covid.WorstWeek)
+			assert.Equal(t, []string{"BBB"}, covid.Excluded)
+			if assert.Len(t, covid.Holdings, 2) {
+				assert.InDelta(t, 50, covid.Holdings[0].WeightPercent, 1e-9)
+				assert.InDelta(t, -300, *covid.Holdings[0].PnL, 1e-9)
+				assert.Nil(t, covid.Holdings[1].PnL)
+			}
+		}
+		if assert.Len(t, body.Hypothetical, 1) {
+			assert.Equal(t, "custom_1", body.Hypothetical[0].ID)
+			assert.InDelta(t, -300, *body.Hypothetical[0].PnL, 1e-9)
+		}
+		assert.Len(t, body.Warnings, 1)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("market shock by beta", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+		handler.services.MarketData = &mockMarketData{quotes: quotes}
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		expectBaseCurrency(mock, testPortfolioID, "USD")
+		expectScenarioHoldings(mock, holdingRows())
+		expectReturnHistory(mock, varTestMatrix())
+
+		w := get(handler, "/analytics/stress?windows=none&shocks=market:-0.2&benchmark=AAA")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var body response
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Empty(t, body.Historical)
+		if assert.Len(t, body.Hypothetical, 1) {
+			assert.InDelta(t, -20, *body.Hypothetical[0].Holdings[0].ReturnPercent, 1e-9)
+			assert.Less(t, *body.Hypothetical[0].Holdings[1].ReturnPercent, 0.0)
+			assert.Greater(t, *body.Hypothetical[0].Holdings[1].ReturnPercent, -20.0)
+		}
+		assert.Empty(t, body.Warnings)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		for _, target := range []string{
+			"/analytics/stress?windows=dotcom_2000",
+			"/analytics/stress?shocks=oil:-0.3",
+			"/analytics/stress?from=2020-03-01",
+			"/analytics/stress?from=2020-03-01&to=2020-02-01",
+			"/analytics/stress?bond_duration=-1",
+		} {
+			handler, mock, cleanup := createTestHandler(t)
+
+			expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+
+			w := get(handler, target)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code, target)
+			assert.NoError(t, mock.ExpectationsWereMet())
+			cleanup()
+		}
+	})
+}
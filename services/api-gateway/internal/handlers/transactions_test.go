@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gin-gonic/gin"
@@ -29,26 +30,23 @@ func TestGetTransactions(t *testing.T) {
 			name:        "successful transaction listing with pagination",
 			queryParams: "?limit=10&offset=0",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
+				expectDefaultPortfolio(mock, "user1", "portfolio1")
 
 				// Mock transactions query
 				rows := sqlmock.NewRows([]string{
 					"id", "transaction_type", "quantity", "price", "fees",
-					"total_amount", "transaction_date", "notes", "symbol", "name",
+					"total_amount", "transaction_date", "notes", "symbol", "name", "realized_pnl",
 				}).
-					AddRow("tx1", "BUY", 10.0, 150.0, 1.0, 1501.0, "2024-01-01", "Test buy", "AAPL", "Apple Inc.").
-					AddRow("tx2", "SELL", 5.0, 160.0, 1.0, 799.0, "2024-01-02", "Test sell", "AAPL", "Apple Inc.")
+					AddRow("tx1", "BUY", 10.0, 150.0, 1.0, 1501.0, "2024-01-01", "Test buy", "AAPL", "Apple Inc.", nil).
+					AddRow("tx2", "SELL", 5.0, 160.0, 1.0, 799.0, "2024-01-02", "Test sell", "AAPL", "Apple Inc.", 49.0)
 
-				mock.ExpectQuery("SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.user_id = \\$1 ORDER BY t.transaction_date DESC LIMIT \\$2 OFFSET \\$3").
-					WithArgs("user1", "10", "0").
+				mock.ExpectQuery("SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.portfolio_id = \\$1 ORDER BY t.transaction_date DESC LIMIT \\$2 OFFSET \\$3").
+					WithArgs("portfolio1", "10", "0").
 					WillReturnRows(rows)
 
 				// Mock count query
-				mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.user_id = \\$1").
-					WithArgs("user1").
+				mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.portfolio_id = \\$1").
+					WithArgs("portfolio1").
 					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
 			},
 			expectedStatus: http.StatusOK,
@@ -58,25 +56,22 @@ func TestGetTransactions(t *testing.T) {
 			name:        "transaction filtering by type",
 			queryParams: "?type=BUY&limit=10&offset=0",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
+				expectDefaultPortfolio(mock, "user1", "portfolio1")
 
 				// Mock filtered transactions query
 				rows := sqlmock.NewRows([]string{
 					"id", "transaction_type", "quantity", "price", "fees",
-					"total_amount", "transaction_date", "notes", "symbol", "name",
+					"total_amount", "transaction_date", "notes", "symbol", "name", "realized_pnl",
 				}).
-					AddRow("tx1", "BUY", 10.0, 150.0, 1.0, 1501.0, "2024-01-01", "Test buy", "AAPL", "Apple Inc.")
+					AddRow("tx1", "BUY", 10.0, 150.0, 1.0, 1501.0, "2024-01-01", "Test buy", "AAPL", "Apple Inc.", nil)
 
-				mock.ExpectQuery("SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.user_id = \\$1 AND t.transaction_type = \\$2 ORDER BY t.transaction_date DESC LIMIT \\$3 OFFSET \\$4").
-					WithArgs("user1", "BUY", "10", "0").
+				mock.ExpectQuery("SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.portfolio_id = \\$1 AND t.transaction_type = \\$2 ORDER BY t.transaction_date DESC LIMIT \\$3 OFFSET \\$4").
+					WithArgs("portfolio1", "BUY", "10", "0").
 					WillReturnRows(rows)
 
 				// Mock count query
-				mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.user_id = \\$1 AND t.transaction_type = \\$2").
-					WithArgs("user1", "BUY").
+				mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.portfolio_id = \\$1 AND t.transaction_type = \\$2").
+					WithArgs("portfolio1", "BUY").
 					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
 			},
 			expectedStatus: http.StatusOK,
@@ -105,6 +100,7 @@ func TestGetTransactions(t *testing.T) {
 			tt.setupMock(mock)
 
 			router := gin.New()
+			router.Use(withTestUser("user1"))
 			router.GET("/transactions", handler.GetTransactions)
 
 			req, _ := http.NewRequest("GET", "/transactions"+tt.queryParams, nil)
@@ -164,9 +160,7 @@ func TestCreateTransaction_BuyOrder(t *testing.T) {
 	handler := NewHandler(mockServices, logger)
 
 	// Setup mocks for successful buy transaction
-	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
+	expectDefaultPortfolio(mock, "user1", "portfolio1")
 
 	mock.ExpectQuery("SELECT id FROM assets WHERE symbol = \\$1").
 		WithArgs("AAPL").
@@ -174,18 +168,31 @@ func TestCreateTransaction_BuyOrder(t *testing.T) {
 
 	mock.ExpectBegin()
 
+	// The portfolio doesn't enforce its cash balance
+	expectCashRule(mock, "portfolio1", false)
+
 	// total_amount = 10 * 150 + 1 = 1501 for BUY
-	mock.ExpectQuery("INSERT INTO transactions \\(user_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes\\) VALUES \\(\\$1, \\$2, \\$3, \\$4, \\$5, \\$6, \\$7, \\$8\\) RETURNING id").
-		WithArgs("user1", "asset1", "BUY", 10.0, 150.0, 1.0, 1501.0, "Test buy transaction").
+	mock.ExpectQuery("INSERT INTO transactions \\(user_id, portfolio_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes, cost_basis_method, lot_transaction_ids\\) VALUES (.+) RETURNING id").
+		WithArgs("user1", "portfolio1", "asset1", "BUY", 10.0, 150.0, 1.0, 1501.0, "Test buy transaction", nil, nil).
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("tx1"))
-
-	mock.ExpectExec("INSERT INTO portfolio_holdings \\(user_id, asset_id, quantity, average_cost\\) VALUES \\(\\$1, \\$2, \\$3, \\$4\\) ON CONFLICT \\(user_id, asset_id\\) DO UPDATE SET (.+)").
-		WithArgs("user1", "asset1", 10.0, 150.0).
+	expectSnapshotInvalidation(mock, "portfolio1", sqlmock.AnyArg())
+
+	// Replaying the asset's ledger opens a lot for the purchase and creates the holding
+	expectReplay(mock, "portfolio1", "asset1",
+		newLedgerRows().AddRow("tx1", "asset1", "AAPL", "BUY", 10.0, 150.0, 1.0, time.Now(), "", nil, nil, nil),
+		newStoredHoldingRows(),
+		newStoredLotRows())
+	mock.ExpectExec("INSERT INTO tax_lots").
+		WithArgs(sqlmock.AnyArg(), "user1", "portfolio1", "asset1", "tx1", 10.0, 10.0, 150.0, 1.0, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO portfolio_holdings \\(user_id, portfolio_id, asset_id, quantity, average_cost, purchase_date\\) VALUES (.+) ON CONFLICT \\(portfolio_id, asset_id\\) DO UPDATE SET (.+)").
+		WithArgs("user1", "portfolio1", "asset1", 10.0, 150.0, sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	mock.ExpectCommit()
 
 	router := gin.New()
+	router.Use(withTestUser("user1"))
 	router.POST("/transactions", handler.CreateTransaction)
 
 	requestBody := map[string]interface{}{
@@ -232,9 +239,7 @@ func TestCreateTransaction_SellOrder(t *testing.T) {
 	handler := NewHandler(mockServices, logger)
 
 	// Setup mocks for successful sell transaction
-	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
+	expectDefaultPortfolio(mock, "user1", "portfolio1")
 
 	mock.ExpectQuery("SELECT id FROM assets WHERE symbol = \\$1").
 		WithArgs("AAPL").
@@ -242,24 +247,55 @@ func TestCreateTransaction_SellOrder(t *testing.T) {
 
 	mock.ExpectBegin()
 
-	// total_amount = 5 * 160 - 1 = 799 for SELL
-	mock.ExpectQuery("INSERT INTO transactions \\(user_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes\\) VALUES \\(\\$1, \\$2, \\$3, \\$4, \\$5, \\$6, \\$7, \\$8\\) RETURNING id").
-		WithArgs("user1", "asset1", "SELL", 5.0, 160.0, 1.0, 799.0, "Test sell transaction").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("tx2"))
-
 	// Mock current holdings check for SELL
-	mock.ExpectQuery("SELECT quantity FROM portfolio_holdings WHERE user_id = \\$1 AND asset_id = \\$2").
-		WithArgs("user1", "asset1").
+	mock.ExpectQuery("SELECT quantity FROM portfolio_holdings WHERE portfolio_id = \\$1 AND asset_id = \\$2").
+		WithArgs("portfolio1", "asset1").
 		WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(10.0))
 
-	// Mock portfolio holdings update for SELL (10 - 5 = 5 remaining)
-	mock.ExpectExec("UPDATE portfolio_holdings SET quantity = \\$1, updated_at = NOW\\(\\) WHERE user_id = \\$2 AND asset_id = \\$3").
-		WithArgs(5.0, "user1", "asset1").
+	// Portfolio uses FIFO
+	mock.ExpectQuery("SELECT cost_basis_method FROM portfolios WHERE id = \\$1").
+		WithArgs("portfolio1").
+		WillReturnRows(sqlmock.NewRows([]string{"cost_basis_method"}).AddRow("FIFO"))
+
+	// total_amount = 5 * 160 - 1 = 799 for SELL
+	mock.ExpectQuery("INSERT INTO transactions \\(user_id, portfolio_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes, cost_basis_method, lot_transaction_ids\\) VALUES (.+) RETURNING id").
+		WithArgs("user1", "portfolio1", "asset1", "SELL", 5.0, 160.0, 1.0, 799.0, "Test sell transaction", "FIFO", nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("tx2"))
+	expectSnapshotInvalidation(mock, "portfolio1", sqlmock.AnyArg())
+
+	// Two purchases: the older one at 140 is consumed first
+	expectReplay(mock, "portfolio1", "asset1",
+		newLedgerRows().
+			AddRow("tx0", "asset1", "AAPL", "BUY", 5.0, 140.0, 0.0, time.Now().AddDate(0, -2, 0), "", nil, nil, nil).
+			AddRow("tx1", "asset1", "AAPL", "BUY", 5.0, 160.0, 0.0, time.Now().AddDate(0, -1, 0), "", nil, nil, nil).
+			AddRow("tx2", "asset1", "AAPL", "SELL", 5.0, 160.0, 1.0, time.Now(), "FIFO", nil, nil, nil),
+		newStoredHoldingRows().AddRow("asset1", "AAPL", 10.0, 150.0),
+		newStoredLotRows().AddRow("lot1", "tx0").AddRow("lot2", "tx1"))
+
+	// Lot IDs survive the rebuild; lot1 is now closed
+	mock.ExpectExec("INSERT INTO tax_lots").
+		WithArgs("lot1", "user1", "portfolio1", "asset1", "tx0", 5.0, 0.0, 140.0, 0.0, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO tax_lots").
+		WithArgs("lot2", "user1", "portfolio1", "asset1", "tx1", 5.0, 5.0, 160.0, 0.0, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// cost basis 5 * 140 = 700, proceeds 5 * 160 - 1 = 799
+	mock.ExpectExec("INSERT INTO lot_disposals \\(lot_id, transaction_id, quantity, cost_basis, proceeds, disposed_at\\)").
+		WithArgs("lot1", "tx2", 5.0, 700.0, 799.0, sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
+	mock.ExpectExec("UPDATE transactions SET realized_pnl = \\$1 WHERE id = \\$2").
+		WithArgs(99.0, "tx2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// 10 - 5 = 5 remaining at the cost of lot2
+	expectHoldingUpsert(mock, "asset1", 5.0, 160.0)
+
 	mock.ExpectCommit()
 
 	router := gin.New()
+	router.Use(withTestUser("user1"))
 	router.POST("/transactions", handler.CreateTransaction)
 
 	requestBody := map[string]interface{}{
@@ -306,9 +342,7 @@ func TestCreateTransaction_InsufficientHoldings(t *testing.T) {
 	handler := NewHandler(mockServices, logger)
 
 	// Setup mocks for insufficient holdings
-	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
+	expectDefaultPortfolio(mock, "user1", "portfolio1")
 
 	mock.ExpectQuery("SELECT id FROM assets WHERE symbol = \\$1").
 		WithArgs("AAPL").
@@ -316,19 +350,16 @@ func TestCreateTransaction_InsufficientHoldings(t *testing.T) {
 
 	mock.ExpectBegin()
 
-	mock.ExpectQuery("INSERT INTO transactions \\(user_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes\\) VALUES \\(\\$1, \\$2, \\$3, \\$4, \\$5, \\$6, \\$7, \\$8\\) RETURNING id").
-		WithArgs("user1", "asset1", "SELL", 15.0, 160.0, 1.0, 2399.0, "").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("tx4"))
-
 	// Mock current holdings check (only 10 available)
-	mock.ExpectQuery("SELECT quantity FROM portfolio_holdings WHERE user_id = \\$1 AND asset_id = \\$2").
-		WithArgs("user1", "asset1").
+	mock.ExpectQuery("SELECT quantity FROM portfolio_holdings WHERE portfolio_id = \\$1 AND asset_id = \\$2").
+		WithArgs("portfolio1", "asset1").
 		WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(10.0))
 
 	// Expect rollback due to insufficient holdings
 	mock.ExpectRollback()
 
 	router := gin.New()
+	router.Use(withTestUser("user1"))
 	router.POST("/transactions", handler.CreateTransaction)
 
 	requestBody := map[string]interface{}{
@@ -401,22 +432,18 @@ func TestGetTransaction_Success(t *testing.T) {
 
 	handler := NewHandler(mockServices, logger)
 
-	// Mock user ID query
-	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 	// Mock transaction query
 	rows := sqlmock.NewRows([]string{
 		"id", "transaction_type", "quantity", "price", "fees",
-		"total_amount", "transaction_date", "notes", "symbol", "name", "asset_type",
-	}).AddRow("tx1", "BUY", 10.0, 150.0, 1.0, 1501.0, "2024-01-01", "Test transaction", "AAPL", "Apple Inc.", "STOCK")
+		"total_amount", "transaction_date", "notes", "symbol", "name", "asset_type", "realized_pnl",
+	}).AddRow("tx1", "BUY", 10.0, 150.0, 1.0, 1501.0, "2024-01-01", "Test transaction", "AAPL", "Apple Inc.", "STOCK", nil)
 
 	mock.ExpectQuery("SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.id = \\$1 AND t.user_id = \\$2").
 		WithArgs("tx1", "user1").
 		WillReturnRows(rows)
 
 	router := gin.New()
+	router.Use(withTestUser("user1"))
 	router.GET("/transactions/:id", handler.GetTransaction)
 
 	req, _ := http.NewRequest("GET", "/transactions/tx1", nil)
@@ -452,17 +479,13 @@ func TestGetTransaction_NotFound(t *testing.T) {
 
 	handler := NewHandler(mockServices, logger)
 
-	// Mock user ID query
-	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 	// Mock transaction query that returns no rows
 	mock.ExpectQuery("SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.id = \\$1 AND t.user_id = \\$2").
 		WithArgs("nonexistent", "user1").
 		WillReturnError(sql.ErrNoRows)
 
 	router := gin.New()
+	router.Use(withTestUser("user1"))
 	router.GET("/transactions/:id", handler.GetTransaction)
 
 	req, _ := http.NewRequest("GET", "/transactions/nonexistent", nil)
@@ -494,23 +517,31 @@ func TestUpdateTransaction_Success(t *testing.T) {
 
 	handler := NewHandler(mockServices, logger)
 
-	// Mock user ID query
-	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 	// Mock existing transaction query
-	mock.ExpectQuery("SELECT quantity, price, fees, notes, transaction_type FROM transactions WHERE id = \\$1 AND user_id = \\$2").
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT quantity, price, fees, notes, transaction_type, portfolio_id, asset_id, transaction_date FROM transactions WHERE id = \\$1 AND user_id = \\$2").
 		WithArgs("tx1", "user1").
-		WillReturnRows(sqlmock.NewRows([]string{"quantity", "price", "fees", "notes", "transaction_type"}).
-			AddRow(10.0, 150.0, 1.0, "Old notes", "BUY"))
+		WillReturnRows(sqlmock.NewRows([]string{"quantity", "price", "fees", "notes", "transaction_type", "portfolio_id", "asset_id", "transaction_date"}).
+			AddRow(10.0, 150.0, 1.0, "Old notes", "BUY", "portfolio1", "asset1", testDay("2024-03-04")))
+	expectCashRule(mock, "portfolio1", false)
 
 	// Mock update query - new total: 15 * 150 + 1 = 2251
 	mock.ExpectExec("UPDATE transactions SET quantity = \\$1, price = \\$2, fees = \\$3, notes = \\$4, total_amount = \\$5 WHERE id = \\$6 AND user_id = \\$7").
 		WithArgs(15.0, 150.0, 1.0, "Updated notes", 2251.0, "tx1", "user1").
 		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectSnapshotInvalidation(mock, "portfolio1", "2024-03-04")
+
+	// The holding is replayed with the new quantity
+	expectReplay(mock, "portfolio1", "asset1",
+		newLedgerRows().AddRow("tx1", "asset1", "AAPL", "BUY", 15.0, 150.0, 1.0, time.Now(), "", nil, nil, nil),
+		newStoredHoldingRows().AddRow("asset1", "AAPL", 10.0, 150.0),
+		newStoredLotRows().AddRow("lot1", "tx1"))
+	expectLotInsert(mock, "tx1", 15.0, 15.0)
+	expectHoldingUpsert(mock, "asset1", 15.0, 150.0)
+	mock.ExpectCommit()
 
 	router := gin.New()
+	router.Use(withTestUser("user1"))
 	router.PUT("/transactions/:id", handler.UpdateTransaction)
 
 	requestBody := map[string]interface{}{
@@ -550,22 +581,28 @@ func TestDeleteTransaction_Success(t *testing.T) {
 
 	handler := NewHandler(mockServices, logger)
 
-	// Mock user ID query
-	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 	// Mock transaction existence check query
-	mock.ExpectQuery("SELECT t.transaction_type, t.quantity, a.symbol FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.id = \\$1 AND t.user_id = \\$2").
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT t.transaction_type, t.quantity, a.symbol, t.portfolio_id, t.asset_id, t.transaction_date FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.id = \\$1 AND t.user_id = \\$2").
 		WithArgs("tx1", "user1").
-		WillReturnRows(sqlmock.NewRows([]string{"transaction_type", "quantity", "symbol"}).AddRow("BUY", 10.0, "AAPL"))
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_type", "quantity", "symbol", "portfolio_id", "asset_id", "transaction_date"}).AddRow("BUY", 10.0, "AAPL", "portfolio1", "asset1", testDay("2024-03-04")))
 
 	// Mock delete query
 	mock.ExpectExec("DELETE FROM transactions WHERE id = \\$1 AND user_id = \\$2").
 		WithArgs("tx1", "user1").
 		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectSnapshotInvalidation(mock, "portfolio1", "2024-03-04")
+
+	// With its only purchase gone the holding is removed
+	expectReplay(mock, "portfolio1", "asset1",
+		newLedgerRows(),
+		newStoredHoldingRows().AddRow("asset1", "AAPL", 10.0, 150.0),
+		newStoredLotRows())
+	expectHoldingDelete(mock, "portfolio1", "asset1")
+	mock.ExpectCommit()
 
 	router := gin.New()
+	router.Use(withTestUser("user1"))
 	router.DELETE("/transactions/:id", handler.DeleteTransaction)
 
 	req, _ := http.NewRequest("DELETE", "/transactions/tx1", nil)
@@ -598,11 +635,6 @@ func TestGetNotifications_Success(t *testing.T) {
 
 	handler := NewHandler(mockServices, logger)
 
-	// Mock user ID query
-	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 	// Mock notifications query
 	rows := sqlmock.NewRows([]string{
 		"id", "title", "message", "notification_type", "is_read", "created_at",
@@ -615,6 +647,7 @@ func TestGetNotifications_Success(t *testing.T) {
 		WillReturnRows(rows)
 
 	router := gin.New()
+	router.Use(withTestUser("user1"))
 	router.GET("/notifications", handler.GetNotifications)
 
 	req, _ := http.NewRequest("GET", "/notifications", nil)
@@ -650,11 +683,6 @@ func TestMarkNotificationRead_Success(t *testing.T) {
 
 	handler := NewHandler(mockServices, logger)
 
-	// Mock user ID query
-	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 	// Mock notification check (unread)
 	mock.ExpectQuery("SELECT is_read FROM notifications WHERE id = \\$1 AND user_id = \\$2").
 		WithArgs("notif1", "user1").
@@ -666,6 +694,7 @@ func TestMarkNotificationRead_Success(t *testing.T) {
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	router := gin.New()
+	router.Use(withTestUser("user1"))
 	router.PUT("/notifications/:id/read", handler.MarkNotificationRead)
 
 	req, _ := http.NewRequest("PUT", "/notifications/notif1/read", nil)
@@ -698,12 +727,8 @@ func TestUpdateNotificationSettings_Success(t *testing.T) {
 
 	handler := NewHandler(mockServices, logger)
 
-	// Mock user ID query
-	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-		WithArgs("default_user").
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 	router := gin.New()
+	router.Use(withTestUser("user1"))
 	router.PUT("/settings/notifications", handler.UpdateNotificationSettings)
 
 	requestBody := map[string]interface{}{
@@ -919,16 +944,11 @@ func TestGetTransaction(t *testing.T) {
 			name:          "successful transaction retrieval",
 			transactionID: "tx1",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 				// Mock transaction query
 				rows := sqlmock.NewRows([]string{
 					"id", "transaction_type", "quantity", "price", "fees",
-					"total_amount", "transaction_date", "notes", "symbol", "name", "asset_type",
-				}).AddRow("tx1", "BUY", 10.0, 150.0, 1.0, 1501.0, "2024-01-01", "Test transaction", "AAPL", "Apple Inc.", "STOCK")
+					"total_amount", "transaction_date", "notes", "symbol", "name", "asset_type", "realized_pnl",
+				}).AddRow("tx1", "BUY", 10.0, 150.0, 1.0, 1501.0, "2024-01-01", "Test transaction", "AAPL", "Apple Inc.", "STOCK", nil)
 
 				mock.ExpectQuery("SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.id = \\$1 AND t.user_id = \\$2").
 					WithArgs("tx1", "user1").
@@ -941,11 +961,6 @@ func TestGetTransaction(t *testing.T) {
 			name:          "transaction not found",
 			transactionID: "nonexistent",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 				// Mock transaction query that returns no rows
 				mock.ExpectQuery("SELECT (.+) FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.id = \\$1 AND t.user_id = \\$2").
 					WithArgs("nonexistent", "user1").
@@ -984,6 +999,7 @@ func TestGetTransaction(t *testing.T) {
 			tt.setupMock(mock)
 
 			router := gin.New()
+			router.Use(withTestUser("user1"))
 			router.GET("/transactions/:id", handler.GetTransaction)
 
 			url := "/transactions/" + tt.transactionID
@@ -1020,21 +1036,27 @@ func TestUpdateTransaction(t *testing.T) {
 				"notes":    "Updated notes",
 			},
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 				// Mock existing transaction query
-				mock.ExpectQuery("SELECT quantity, price, fees, notes, transaction_type FROM transactions WHERE id = \\$1 AND user_id = \\$2").
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT quantity, price, fees, notes, transaction_type, portfolio_id, asset_id, transaction_date FROM transactions WHERE id = \\$1 AND user_id = \\$2").
 					WithArgs("tx1", "user1").
-					WillReturnRows(sqlmock.NewRows([]string{"quantity", "price", "fees", "notes", "transaction_type"}).
-						AddRow(10.0, 150.0, 1.0, "Old notes", "BUY"))
+					WillReturnRows(sqlmock.NewRows([]string{"quantity", "price", "fees", "notes", "transaction_type", "portfolio_id", "asset_id", "transaction_date"}).
+						AddRow(10.0, 150.0, 1.0, "Old notes", "BUY", "portfolio1", "asset1", testDay("2024-03-04")))
+				expectCashRule(mock, "portfolio1", false)
 
 				// Mock update query - new total: 15 * 150 + 1 = 2251
 				mock.ExpectExec("UPDATE transactions SET quantity = \\$1, price = \\$2, fees = \\$3, notes = \\$4, total_amount = \\$5 WHERE id = \\$6 AND user_id = \\$7").
 					WithArgs(15.0, 150.0, 1.0, "Updated notes", 2251.0, "tx1", "user1").
 					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectSnapshotInvalidation(mock, "portfolio1", "2024-03-04")
+
+				expectReplay(mock, "portfolio1", "asset1",
+					newLedgerRows().AddRow("tx1", "asset1", "AAPL", "BUY", 15.0, 150.0, 1.0, time.Now(), "", nil, nil, nil),
+					newStoredHoldingRows().AddRow("asset1", "AAPL", 10.0, 150.0),
+					newStoredLotRows().AddRow("lot1", "tx1"))
+				expectLotInsert(mock, "tx1", 15.0, 15.0)
+				expectHoldingUpsert(mock, "asset1", 15.0, 150.0)
+				mock.ExpectCommit()
 			},
 			expectedStatus: http.StatusOK,
 			expectedBody:   []string{"Transaction updated successfully", "tx1"},
@@ -1049,25 +1071,108 @@ func TestUpdateTransaction(t *testing.T) {
 				"notes":    "Fully updated transaction",
 			},
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 				// Mock existing transaction query
-				mock.ExpectQuery("SELECT quantity, price, fees, notes, transaction_type FROM transactions WHERE id = \\$1 AND user_id = \\$2").
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT quantity, price, fees, notes, transaction_type, portfolio_id, asset_id, transaction_date FROM transactions WHERE id = \\$1 AND user_id = \\$2").
 					WithArgs("tx2", "user1").
-					WillReturnRows(sqlmock.NewRows([]string{"quantity", "price", "fees", "notes", "transaction_type"}).
-						AddRow(5.0, 160.0, 1.0, "Old notes", "SELL"))
+					WillReturnRows(sqlmock.NewRows([]string{"quantity", "price", "fees", "notes", "transaction_type", "portfolio_id", "asset_id", "transaction_date"}).
+						AddRow(5.0, 160.0, 1.0, "Old notes", "SELL", "portfolio1", "asset1", testDay("2024-03-04")))
 
 				// Mock update query - new total for SELL: 8 * 200 - 2 = 1598
 				mock.ExpectExec("UPDATE transactions SET quantity = \\$1, price = \\$2, fees = \\$3, notes = \\$4, total_amount = \\$5 WHERE id = \\$6 AND user_id = \\$7").
 					WithArgs(8.0, 200.0, 2.0, "Fully updated transaction", 1598.0, "tx2", "user1").
 					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectSnapshotInvalidation(mock, "portfolio1", "2024-03-04")
+
+				// The sale is replayed against the lot it draws from
+				expectReplay(mock, "portfolio1", "asset1",
+					newLedgerRows().
+						AddRow("tx0", "asset1", "AAPL", "BUY", 10.0, 150.0, 0.0, time.Now().AddDate(0, -1, 0), "", nil, nil, nil).
+						AddRow("tx2", "asset1", "AAPL", "SELL", 8.0, 200.0, 2.0, time.Now(), "FIFO", nil, 49.0, nil),
+					newStoredHoldingRows().AddRow("asset1", "AAPL", 5.0, 150.0),
+					newStoredLotRows().AddRow("lot1", "tx0"))
+				expectLotInsert(mock, "tx0", 10.0, 2.0)
+				mock.ExpectExec("INSERT INTO lot_disposals").
+					WithArgs("lot1", "tx2", 8.0, 1200.0, 1598.0, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("UPDATE transactions SET realized_pnl = \\$1 WHERE id = \\$2").
+					WithArgs(398.0, "tx2").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectHoldingUpsert(mock, "asset1", 2.0, 150.0)
+				mock.ExpectCommit()
 			},
 			expectedStatus: http.StatusOK,
 			expectedBody:   []string{"Transaction updated successfully", "tx2"},
 		},
+		{
+			name:          "edit that oversells the position",
+			transactionID: "tx2",
+			requestBody: map[string]interface{}{
+				"quantity": 12.0,
+			},
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT quantity, price, fees, notes, transaction_type, portfolio_id, asset_id, transaction_date FROM transactions WHERE id = \\$1 AND user_id = \\$2").
+					WithArgs("tx2", "user1").
+					WillReturnRows(sqlmock.NewRows([]string{"quantity", "price", "fees", "notes", "transaction_type", "portfolio_id", "asset_id", "transaction_date"}).
+						AddRow(5.0, 160.0, 0.0, "", "SELL", "portfolio1", "asset1", testDay("2024-03-04")))
+				mock.ExpectExec("UPDATE transactions SET").
+					WithArgs(12.0, 160.0, 0.0, "", 1920.0, "tx2", "user1").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectSnapshotInvalidation(mock, "portfolio1", "2024-03-04")
+
+				// Replay fails before anything is written, so the edit is rolled back
+				mock.ExpectQuery("SELECT (.+) FROM transactions t JOIN assets a").
+					WithArgs("portfolio1", "asset1").
+					WillReturnRows(newLedgerRows().
+						AddRow("tx0", "asset1", "AAPL", "BUY", 10.0, 150.0, 0.0, time.Now().AddDate(0, -1, 0), "", nil, nil, nil).
+						AddRow("tx2", "asset1", "AAPL", "SELL", 12.0, 160.0, 0.0, time.Now(), "FIFO", nil, nil, nil))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"Ledger would become inconsistent", "tx2"},
+		},
+		{
+			name:          "purchase edit the enforced balance can't cover",
+			transactionID: "tx1",
+			requestBody: map[string]interface{}{
+				"quantity": 15.0,
+			},
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT quantity, price, fees, notes, transaction_type, portfolio_id, asset_id, transaction_date FROM transactions WHERE id = \\$1 AND user_id = \\$2").
+					WithArgs("tx1", "user1").
+					WillReturnRows(sqlmock.NewRows([]string{"quantity", "price", "fees", "notes", "transaction_type", "portfolio_id", "asset_id", "transaction_date"}).
+						AddRow(10.0, 150.0, 1.0, "", "BUY", "portfolio1", "asset1", testDay("2024-03-04")))
+
+				// The edit spends 750 more, and only 500 is left besides the 1501 the purchase already spent
+				expectCashRule(mock, "portfolio1", true)
+				mock.ExpectQuery(`SELECT COALESCE\(currency, 'USD'\) FROM assets WHERE id = \$1`).
+					WithArgs("asset1").
+					WillReturnRows(sqlmock.NewRows([]string{"currency"}).AddRow("USD"))
+				expectCashBalance(mock, "portfolio1", "USD", 500.0)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"Insufficient cash to cover purchase", `"cash_balance":2001`, `"total_amount":2251`},
+		},
+		{
+			name:          "dividend tax withheld above the amount",
+			transactionID: "tx3",
+			requestBody: map[string]interface{}{
+				"fees": 120.0,
+			},
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT quantity, price, fees, notes, transaction_type, portfolio_id, asset_id, transaction_date FROM transactions WHERE id = \\$1 AND user_id = \\$2").
+					WithArgs("tx3", "user1").
+					WillReturnRows(sqlmock.NewRows([]string{"quantity", "price", "fees", "notes", "transaction_type", "portfolio_id", "asset_id", "transaction_date"}).
+						AddRow(100.0, 1.0, 15.0, "", "DIVIDEND", "portfolio1", "asset1", testDay("2024-03-04")))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"Tax withheld (fees) must be less than the dividend amount"},
+		},
 		{
 			name:          "transaction not found",
 			transactionID: "nonexistent",
@@ -1075,15 +1180,12 @@ func TestUpdateTransaction(t *testing.T) {
 				"quantity": 10.0,
 			},
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 				// Mock existing transaction query that returns no rows
-				mock.ExpectQuery("SELECT quantity, price, fees, notes, transaction_type FROM transactions WHERE id = \\$1 AND user_id = \\$2").
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT quantity, price, fees, notes, transaction_type, portfolio_id, asset_id, transaction_date FROM transactions WHERE id = \\$1 AND user_id = \\$2").
 					WithArgs("nonexistent", "user1").
 					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
 			},
 			expectedStatus: http.StatusNotFound,
 			expectedBody:   []string{"Transaction not found"},
@@ -1119,6 +1221,7 @@ func TestUpdateTransaction(t *testing.T) {
 			tt.setupMock(mock)
 
 			router := gin.New()
+			router.Use(withTestUser("user1"))
 			router.PUT("/transactions/:id", handler.UpdateTransaction)
 
 			jsonBody, _ := json.Marshal(tt.requestBody)
@@ -1151,37 +1254,63 @@ func TestDeleteTransaction(t *testing.T) {
 			name:          "successful transaction deletion",
 			transactionID: "tx1",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 				// Mock transaction existence check query
-				mock.ExpectQuery("SELECT t.transaction_type, t.quantity, a.symbol FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.id = \\$1 AND t.user_id = \\$2").
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT t.transaction_type, t.quantity, a.symbol, t.portfolio_id, t.asset_id, t.transaction_date FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.id = \\$1 AND t.user_id = \\$2").
 					WithArgs("tx1", "user1").
-					WillReturnRows(sqlmock.NewRows([]string{"transaction_type", "quantity", "symbol"}).AddRow("BUY", 10.0, "AAPL"))
+					WillReturnRows(sqlmock.NewRows([]string{"transaction_type", "quantity", "symbol", "portfolio_id", "asset_id", "transaction_date"}).AddRow("BUY", 4.0, "AAPL", "portfolio1", "asset1", testDay("2024-03-04")))
 
 				// Mock delete query
 				mock.ExpectExec("DELETE FROM transactions WHERE id = \\$1 AND user_id = \\$2").
 					WithArgs("tx1", "user1").
 					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectSnapshotInvalidation(mock, "portfolio1", "2024-03-04")
+
+				// The remaining purchase is all that's left of the holding
+				expectReplay(mock, "portfolio1", "asset1",
+					newLedgerRows().AddRow("tx0", "asset1", "AAPL", "BUY", 10.0, 150.0, 0.0, time.Now(), "", nil, nil, nil),
+					newStoredHoldingRows().AddRow("asset1", "AAPL", 14.0, 160.0),
+					newStoredLotRows().AddRow("lot0", "tx0"))
+				expectLotInsert(mock, "tx0", 10.0, 10.0)
+				expectHoldingUpsert(mock, "asset1", 10.0, 150.0)
+				mock.ExpectCommit()
 			},
 			expectedStatus: http.StatusOK,
 			expectedBody:   []string{"Transaction deleted successfully", "tx1"},
 		},
+		{
+			name:          "deleting a purchase a later sale depends on",
+			transactionID: "tx0",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT t.transaction_type, t.quantity, a.symbol, t.portfolio_id, t.asset_id, t.transaction_date FROM transactions t").
+					WithArgs("tx0", "user1").
+					WillReturnRows(sqlmock.NewRows([]string{"transaction_type", "quantity", "symbol", "portfolio_id", "asset_id", "transaction_date"}).AddRow("BUY", 10.0, "AAPL", "portfolio1", "asset1", testDay("2024-03-04")))
+				mock.ExpectExec("DELETE FROM transactions WHERE id = \\$1 AND user_id = \\$2").
+					WithArgs("tx0", "user1").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectSnapshotInvalidation(mock, "portfolio1", "2024-03-04")
+
+				// The sale no longer has lots to draw from
+				mock.ExpectQuery("SELECT (.+) FROM transactions t JOIN assets a").
+					WithArgs("portfolio1", "asset1").
+					WillReturnRows(newLedgerRows().
+						AddRow("tx2", "asset1", "AAPL", "SELL", 5.0, 200.0, 0.0, time.Now(), "FIFO", nil, 250.0, nil))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"Ledger would become inconsistent", "tx2"},
+		},
 		{
 			name:          "transaction not found",
 			transactionID: "nonexistent",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 				// Mock transaction existence check query that returns no rows
-				mock.ExpectQuery("SELECT t.transaction_type, t.quantity, a.symbol FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.id = \\$1 AND t.user_id = \\$2").
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT t.transaction_type, t.quantity, a.symbol, t.portfolio_id, t.asset_id, t.transaction_date FROM transactions t JOIN assets a ON t.asset_id = a.id WHERE t.id = \\$1 AND t.user_id = \\$2").
 					WithArgs("nonexistent", "user1").
 					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
 			},
 			expectedStatus: http.StatusNotFound,
 			expectedBody:   []string{"Transaction not found"},
@@ -1216,6 +1345,7 @@ func TestDeleteTransaction(t *testing.T) {
 			tt.setupMock(mock)
 
 			router := gin.New()
+			router.Use(withTestUser("user1"))
 			router.DELETE("/transactions/:id", handler.DeleteTransaction)
 
 			url := "/transactions/" + tt.transactionID
@@ -1247,11 +1377,6 @@ func TestGetNotifications(t *testing.T) {
 			name:        "successful notifications listing",
 			queryParams: "?limit=10",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 				// Mock notifications query
 				rows := sqlmock.NewRows([]string{
 					"id", "title", "message", "notification_type", "is_read", "created_at",
@@ -1270,11 +1395,6 @@ func TestGetNotifications(t *testing.T) {
 			name:        "unread notifications only",
 			queryParams: "?unread_only=true&limit=10",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 				// Mock unread notifications query
 				rows := sqlmock.NewRows([]string{
 					"id", "title", "message", "notification_type", "is_read", "created_at",
@@ -1292,11 +1412,6 @@ func TestGetNotifications(t *testing.T) {
 			name:        "empty notifications list",
 			queryParams: "?limit=10",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 				// Mock empty notifications query
 				rows := sqlmock.NewRows([]string{
 					"id", "title", "message", "notification_type", "is_read", "created_at",
@@ -1313,11 +1428,6 @@ func TestGetNotifications(t *testing.T) {
 			name:        "all notifications without limit",
 			queryParams: "?limit=all",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 				// Mock notifications query without limit
 				rows := sqlmock.NewRows([]string{
 					"id", "title", "message", "notification_type", "is_read", "created_at",
@@ -1355,6 +1465,7 @@ func TestGetNotifications(t *testing.T) {
 			tt.setupMock(mock)
 
 			router := gin.New()
+			router.Use(withTestUser("user1"))
 			router.GET("/notifications", handler.GetNotifications)
 
 			req, _ := http.NewRequest("GET", "/notifications"+tt.queryParams, nil)
@@ -1408,11 +1519,6 @@ func TestMarkNotificationRead(t *testing.T) {
 			name:           "successful notification mark as read",
 			notificationID: "notif1",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 				// Mock notification check (unread)
 				mock.ExpectQuery("SELECT is_read FROM notifications WHERE id = \\$1 AND user_id = \\$2").
 					WithArgs("notif1", "user1").
@@ -1430,11 +1536,6 @@ func TestMarkNotificationRead(t *testing.T) {
 			name:           "already read notification",
 			notificationID: "notif2",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 				// Mock notification check (already read)
 				mock.ExpectQuery("SELECT is_read FROM notifications WHERE id = \\$1 AND user_id = \\$2").
 					WithArgs("notif2", "user1").
@@ -1447,11 +1548,6 @@ func TestMarkNotificationRead(t *testing.T) {
 			name:           "notification not found",
 			notificationID: "nonexistent",
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
-
 				// Mock notification check that returns no rows
 				mock.ExpectQuery("SELECT is_read FROM notifications WHERE id = \\$1 AND user_id = \\$2").
 					WithArgs("nonexistent", "user1").
@@ -1490,6 +1586,7 @@ func TestMarkNotificationRead(t *testing.T) {
 			tt.setupMock(mock)
 
 			router := gin.New()
+			router.Use(withTestUser("user1"))
 			router.PUT("/notifications/:id/read", handler.MarkNotificationRead)
 
 			url := "/notifications/" + tt.notificationID + "/read"
@@ -1529,10 +1626,6 @@ func TestUpdateNotificationSettings(t *testing.T) {
 				"web_push_enabled":    true,
 			},
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
 			},
 			expectedStatus: http.StatusOK,
 			expectedBody: []string{
@@ -1553,10 +1646,6 @@ func TestUpdateNotificationSettings(t *testing.T) {
 				"web_push_enabled":    false,
 			},
 			setupMock: func(mock sqlmock.Sqlmock) {
-				// Mock user ID query
-				mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
-					WithArgs("default_user").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user1"))
 			},
 			expectedStatus: http.StatusOK,
 			expectedBody:   []string{"Notification settings updated successfully", "settings"},
@@ -1584,6 +1673,7 @@ func TestUpdateNotificationSettings(t *testing.T) {
 			tt.setupMock(mock)
 
 			router := gin.New()
+			router.Use(withTestUser("user1"))
 			router.PUT("/settings/notifications", handler.UpdateNotificationSettings)
 
 			jsonBody, _ := json.Marshal(tt.requestBody)
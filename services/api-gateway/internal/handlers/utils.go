@@ -3,23 +3,26 @@ package handlers
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
 )
 
-// CreateSampleData creates sample portfolio data for testing
-func (h *Handler) CreateSampleData() error {
+// sqlQuerier is satisfied by both *sql.DB and *sql.Tx
+type sqlQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// CreateSampleData creates sample portfolio data for the given user for testing
+func (h *Handler) CreateSampleData(userID string) error {
 	if h.services.DB == nil {
 		return fmt.Errorf("database connection is nil")
 	}
 
-	// Get user ID
-	var userID string
-	err := h.services.DB.QueryRow("SELECT id FROM users WHERE username = $1", "default_user").Scan(&userID)
-	if err != nil {
-		h.logger.Error("Failed to get user ID", zap.Error(err))
-		return err
+	if userID == "" {
+		return fmt.Errorf("user ID is required")
 	}
 
 	// Sample assets to add
@@ -39,19 +42,6 @@ func (h *Handler) CreateSampleData() error {
 		{"JNJ", "Johnson & Johnson", "STOCK", "Healthcare"},
 	}
 
-	// Sample holdings
-	sampleHoldings := []struct {
-		Symbol      string
-		Quantity    float64
-		AverageCost float64
-	}{
-		{"AAPL", 10.0, 175.50},
-		{"GOOGL", 5.0, 2800.75},
-		{"MSFT", 15.0, 380.25},
-		{"TSLA", 8.0, 220.00},
-		{"AMZN", 3.0, 3100.50},
-	}
-
 	// Sample transactions
 	sampleTransactions := []struct {
 		Symbol          string
@@ -62,6 +52,7 @@ func (h *Handler) CreateSampleData() error {
 		Notes           string
 		DaysAgo         int
 	}{
+		{"USD", "DEPOSIT", 40000.0, 1.0, 0, "Initial funding", 35},
 		{"AAPL", "BUY", 5.0, 170.00, 2.50, "Initial purchase", 30},
 		{"AAPL", "BUY", 5.0, 181.00, 2.50, "Dollar cost averaging", 15},
 		{"GOOGL", "BUY", 5.0, 2800.75, 5.00, "Growth investment", 25},
@@ -85,6 +76,11 @@ func (h *Handler) CreateSampleData() error {
 		{"Risk Alert", "Your portfolio concentration in tech sector is high", "RISK_ALERT", 5},
 	}
 
+	portfolioID, err := h.getDefaultPortfolioID(userID)
+	if err != nil {
+		return err
+	}
+
 	// Start transaction
 	tx, err := h.services.DB.Begin()
 	if err != nil {
@@ -105,34 +101,8 @@ func (h *Handler) CreateSampleData() error {
 		}
 	}
 
-	// Clear existing holdings for clean sample data
-	_, err = tx.Exec("DELETE FROM portfolio_holdings WHERE user_id = $1", userID)
-	if err != nil {
-		h.logger.Error("Failed to clear existing holdings", zap.Error(err))
-		return err
-	}
-
-	// Insert sample holdings
-	for _, holding := range sampleHoldings {
-		var assetID string
-		err = tx.QueryRow("SELECT id FROM assets WHERE symbol = $1", holding.Symbol).Scan(&assetID)
-		if err != nil {
-			h.logger.Error("Failed to get asset ID for holding", zap.String("symbol", holding.Symbol), zap.Error(err))
-			continue
-		}
-
-		_, err = tx.Exec(`
-			INSERT INTO portfolio_holdings (user_id, asset_id, quantity, average_cost)
-			VALUES ($1, $2, $3, $4)
-		`, userID, assetID, holding.Quantity, holding.AverageCost)
-		if err != nil {
-			h.logger.Error("Failed to insert sample holding", zap.String("symbol", holding.Symbol), zap.Error(err))
-			return err
-		}
-	}
-
 	// Clear existing transactions
-	_, err = tx.Exec("DELETE FROM transactions WHERE user_id = $1", userID)
+	_, err = tx.Exec("DELETE FROM transactions WHERE portfolio_id = $1", portfolioID)
 	if err != nil {
 		h.logger.Error("Failed to clear existing transactions", zap.Error(err))
 		return err
@@ -157,9 +127,9 @@ func (h *Handler) CreateSampleData() error {
 		transactionDate := time.Now().AddDate(0, 0, -transaction.DaysAgo)
 
 		_, err = tx.Exec(`
-			INSERT INTO transactions (user_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes, transaction_date)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-		`, userID, assetID, transaction.TransactionType, transaction.Quantity, transaction.Price,
+			INSERT INTO transactions (user_id, portfolio_id, asset_id, transaction_type, quantity, price, fees, total_amount, notes, transaction_date)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		`, userID, portfolioID, assetID, transaction.TransactionType, transaction.Quantity, transaction.Price,
 			transaction.Fees, totalAmount, transaction.Notes, transactionDate)
 		if err != nil {
 			h.logger.Error("Failed to insert sample transaction", zap.String("symbol", transaction.Symbol), zap.Error(err))
@@ -167,6 +137,18 @@ func (h *Handler) CreateSampleData() error {
 		}
 	}
 
+	// The replaced ledger invalidates every snapshot
+	if err = h.invalidateSnapshots(tx, portfolioID, time.Time{}); err != nil {
+		h.logger.Error("Failed to clear existing snapshots", zap.Error(err))
+		return err
+	}
+
+	// Holdings and tax lots are derived from the sample transactions
+	if _, _, err = h.rebuildHoldings(tx, userID, portfolioID, ""); err != nil {
+		h.logger.Error("Failed to rebuild sample holdings", zap.Error(err))
+		return err
+	}
+
 	// Clear existing notifications
 	_, err = tx.Exec("DELETE FROM notifications WHERE user_id = $1", userID)
 	if err != nil {
@@ -198,6 +180,27 @@ func (h *Handler) CreateSampleData() error {
 	return nil
 }
 
+// Helper function to name a new asset and pick its trading currency: the one requested, else the one the
+// market data provider reports for it, else USD
+func (h *Handler) describeNewAsset(symbol, currency string) (string, string) {
+	name := symbol // fallback to symbol
+	if h.services.MarketData != nil {
+		if profile, err := h.services.MarketData.GetCompanyProfile(symbol); err == nil && profile.Name != "" {
+			name = profile.Name
+			if currency == "" {
+				currency = profile.Currency
+			}
+			h.logger.Info("Fetched company name from market data provider", zap.String("symbol", symbol), zap.String("name", name))
+		} else {
+			h.logger.Warn("Failed to fetch company profile, using symbol as name", zap.String("symbol", symbol), zap.Error(err))
+		}
+	}
+	if currency == "" {
+		currency = "USD"
+	}
+	return name, strings.ToUpper(currency)
+}
+
 // Helper function to validate asset symbol
 func (h *Handler) validateAssetSymbol(symbol string) error {
 	if len(symbol) < 1 || len(symbol) > 10 {
@@ -0,0 +1,411 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Value-at-Risk methods
+const (
+	varHistorical = "historical"
+	varParametric = "parametric"
+	varMonteCarlo = "monte_carlo"
+)
+
+// Bounds of the VaR query parameters
+const (
+	maxVaRHorizon        = 252
+	defaultVaRSimulation = 10000
+	maxVaRSimulations    = 100000
+)
+
+// componentVaR is one holding's share of a VaR estimate; the components add up to the VaR
+type componentVaR struct {
+	Symbol              string  `json:"symbol"`
+	WeightPercent       float64 `json:"weight_percent"`
+	VaRAmount           float64 `json:"var_amount"`
+	ContributionPercent float64 `json:"contribution_percent"`
+}
+
+// varEstimate is the loss not exceeded with a given confidence over the horizon, and the expected loss
+// beyond it. Losses are positive.
+type varEstimate struct {
+	Confidence               float64        `json:"confidence"`
+	VaRPercent               float64        `json:"var_percent"`
+	VaRAmount                float64        `json:"var_amount"`
+	ExpectedShortfallPercent float64        `json:"expected_shortfall_percent"`
+	ExpectedShortfallAmount  float64        `json:"expected_shortfall_amount"`
+	Components               []componentVaR `json:"components"`
+}
+
+// varResult holds one method's estimates at each confidence level
+type varResult struct {
+	Method    string        `json:"method"`
+	Scenarios int           `json:"scenarios,omitempty"` // historical windows or simulated paths
+	Seed      *int64        `json:"seed,omitempty"`
+	Estimates []varEstimate `json:"estimates"`
+}
+
+// newComponents splits a VaR into per-symbol amounts in proportion to contributions
+func newComponents(symbols []string, weights, contributions []float64, value, varPercent float64) []componentVaR {
+	var total float64
+	for _, contribution := range contributions {
+		total += contribution
+	}
+	components := make([]componentVaR, 0, len(symbols))
+	for i, symbol := range symbols {
+		if weights[i] == 0 {
+			continue
+		}
+		component := componentVaR{Symbol: symbol, WeightPercent: weights[i] * 100}
+		if total != 0 {
+			share := contributions[i] / total
+			component.VaRAmount = share * varPercent * value
+			component.ContributionPercent = share * 100
+		}
+		components = append(components, component)
+	}
+	return components
+}
+
+// horizonScenarios returns each symbol's compounded return over every run of horizon consecutive days
+// in the matrix, one slice per symbol
+func horizonScenarios(matrix returnMatrix, horizon int) [][]float64 {
+	count := len(matrix.Dates) - horizon + 1
+	if count < 1 {
+		count = 0
+	}
+	scenarios := make([][]float64, len(matrix.Symbols))
+	for i, returns := range matrix.Returns {
+		scenarios[i] = make([]float64, count)
+		for s := 0; s < count; s++ {
+			growth := 1.0
+			for d := s; d < s+horizon; d++ {
+				growth *= 1 + returns[d]
+			}
+			scenarios[i][s] = growth - 1
+		}
+	}
+	return scenarios
+}
+
+// scenarioVaR estimates VaR and expected shortfall from scenarios of each symbol's return, held at
+// weights. The VaR is the loss of the worst ceil(n×(1-confidence)) scenarios' best; expected shortfall
+// is their average. Components split the VaR by each holding's share of the loss in those scenarios.
+func scenarioVaR(symbols []string, weights []float64, scenarios [][]float64, confidence, value float64) varEstimate {
+	count := 0
+	if len(scenarios) > 0 {
+		count = len(scenarios[0])
+	}
+	portfolio := make([]float64, count)
+	for i, weight := range weights {
+		for s := range portfolio {
+			portfolio[s] += weight * scenarios[i][s]
+		}
+	}
+
+	order := make([]int, count)
+	for s := range order {
+		order[s] = s
+	}
+	sort.SliceStable(order, func(a, b int) bool { return portfolio[order[a]] < portfolio[order[b]] })
+
+	tail := int(math.Ceil(float64(count)*(1-confidence) - 1e-9))
+	if tail < 1 {
+		tail = 1
+	}
+	varPercent := -portfolio[order[tail-1]]
+	var shortfall float64
+	contributions := make([]float64, len(symbols))
+	for _, s := range order[:tail] {
+		shortfall -= portfolio[s]
+		for i, weight := range weights {
+			contributions[i] -= weight * scenarios[i][s]
+		}
+	}
+	shortfall /= float64(tail)
+
+	return varEstimate{
+		Confidence:               confidence,
+		VaRPercent:               varPercent * 100,
+		VaRAmount:                varPercent * value,
+		ExpectedShortfallPercent: shortfall * 100,
+		ExpectedShortfallAmount:  shortfall * value,
+		Components:               newComponents(symbols, weights, contributions, value, varPercent),
+	}
+}
+
+// seriesMeans returns the mean of each series
+func seriesMeans(series [][]float64) []float64 {
+	means := make([]float64, len(series))
+	for i, values := range series {
+		means[i] = mean(values)
+	}
+	return means
+}
+
+// parametricVaR estimates VaR and expected shortfall assuming normally distributed returns with the
+// daily means and covariance observed, scaled to the horizon. Components are the marginal VaR of each
+// holding times its weight.
+func parametricVaR(symbols []string, weights, means []float64, covariance [][]float64, horizon int, confidence, value float64) varEstimate {
+	z := normalQuantile(confidence)
+	days := float64(horizon)
+
+	var mu, variance float64
+	marginal := make([]float64, len(weights)) // covariance times weights
+	for i := range weights {
+		mu += weights[i] * means[i]
+		for j := range weights {
+			marginal[i] += covariance[i][j] * weights[j]
+		}
+		variance += weights[i] * marginal[i]
+	}
+	sigma := math.Sqrt(math.Max(variance, 0))
+
+	varPercent := z*sigma*math.Sqrt(days) - mu*days
+	shortfall := sigma*math.Sqrt(days)*normalPDF(z)/(1-confidence) - mu*days
+	contributions := make([]float64, len(weights))
+	for i := range weights {
+		contributions[i] = -weights[i] * means[i] * days
+		if sigma > 0 {
+			contributions[i] += weights[i] * z * marginal[i] / sigma * math.Sqrt(days)
+		}
+	}
+
+	return varEstimate{
+		Confidence:               confidence,
+		VaRPercent:               varPercent * 100,
+		VaRAmount:                varPercent * value,
+		ExpectedShortfallPercent: shortfall * 100,
+		ExpectedShortfallAmount:  shortfall * value,
+		Components:               newComponents(symbols, weights, contributions, value, varPercent),
+	}
+}
+
+// simulateScenarios draws horizon returns for each symbol from a multivariate normal distribution of
+// log returns fitted to the matrix, so compounding over the horizon is kept. The same seed always
+// draws the same scenarios.
+func simulateScenarios(matrix returnMatrix, horizon, simulations int, seed int64) ([][]float64, bool) {
+	logReturns := make([][]float64, len(matrix.Returns))
+	for i, returns := range matrix.Returns {
+		logReturns[i] = make([]float64, len(returns))
+		for j, r := range returns {
+			logReturns[i][j] = math.Log1p(r)
+		}
+	}
+	means := seriesMeans(logReturns)
+	lower, ok := cholesky(covarianceMatrix(logReturns))
+	if !ok {
+		return nil, false
+	}
+
+	days := float64(horizon)
+	random := rand.New(rand.NewSource(seed))
+	scenarios := make([][]float64, len(matrix.Symbols))
+	for i := range scenarios {
+		scenarios[i] = make([]float64, simulations)
+	}
+	draws := make([]float64, len(matrix.Symbols))
+	for s := 0; s < simulations; s++ {
+		for i := range draws {
+			draws[i] = random.NormFloat64()
+		}
+		for i := range scenarios {
+			var shock float64
+			for k := 0; k <= i; k++ {
+				shock += lower[i][k] * draws[k]
+			}
+			scenarios[i][s] = math.Expm1(means[i]*days + shock*math.Sqrt(days))
+		}
+	}
+	return scenarios, true
+}
+
+// parseVaRMethods parses a comma-separated list of VaR methods, defaulting to all of them
+func parseVaRMethods(value string) ([]string, error) {
+	if value == "" {
+		return []string{varHistorical, varParametric, varMonteCarlo}, nil
+	}
+	var methods []string
+	seen := map[string]bool{}
+	for _, method := range strings.Split(value, ",") {
+		method = strings.ToLower(strings.TrimSpace(method))
+		switch method {
+		case varHistorical, varParametric, varMonteCarlo:
+		default:
+			return nil, fmt.Errorf("Invalid method %q, expected historical, parametric or monte_carlo", method)
+		}
+		if !seen[method] {
+			seen[method] = true
+			methods = append(methods, method)
+		}
+	}
+	return methods, nil
+}
+
+// parseConfidenceLevels parses a comma-separated list of confidence levels between 0.5 and 1
+func parseConfidenceLevels(value string) ([]float64, error) {
+	var levels []float64
+	for _, part := range strings.Split(value, ",") {
+		level, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || level < 0.5 || level >= 1 {
+			return nil, fmt.Errorf("Invalid confidence %q, expected a level from 0.5 up to but excluding 1, such as 0.95", part)
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// parseBoundedInt parses a query parameter as an integer between min and max, or returns fallback when
+// it's absent
+func parseBoundedInt(c *gin.Context, name string, fallback, min, max int64) (int64, error) {
+	value := c.Query(name)
+	if value == "" {
+		return fallback, nil
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number < min || number > max {
+		return 0, fmt.Errorf("Invalid %s, expected a whole number from %d to %d", name, min, max)
+	}
+	return number, nil
+}
+
+// GetValueAtRisk estimates the portfolio's Value-at-Risk and expected shortfall by historical
+// simulation, the variance-covariance method and Monte Carlo simulation
+func (h *Handler) GetValueAtRisk(c *gin.Context) {
+	// Check if database connection is available
+	if h.services.DB == nil {
+		h.logger.Error("Database connection is nil")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate value at risk"})
+		return
+	}
+
+	// Get user ID
+	userID, ok := h.requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the portfolio (defaults to the user's default portfolio)
+	portfolioID, ok := h.resolvePortfolioID(c, userID, "")
+	if !ok {
+		return
+	}
+
+	methods, err := parseVaRMethods(c.Query("method"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	confidenceLevels, err := parseConfidenceLevels(c.DefaultQuery("confidence", "0.95,0.99"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	horizon, err := parseBoundedInt(c, "horizon", 1, 1, maxVaRHorizon)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	simulations, err := parseBoundedInt(c, "simulations", defaultVaRSimulation, 100, maxVaRSimulations)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	seed := int64(1)
+	if value := c.Query("seed"); value != "" {
+		seed, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid seed, expected a whole number"})
+			return
+		}
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	lookback, lookbackFrom, ok := lookbackStart(c, today)
+	if !ok {
+		return
+	}
+
+	// Holdings are valued in the portfolio's base currency
+	fx, err := h.newFXConverter(h.services.DB, portfolioID)
+	if err != nil {
+		h.logger.Error("Failed to load base currency", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate value at risk"})
+		return
+	}
+	holdings, err := h.loadRiskHoldings(portfolioID, fx)
+	if err != nil {
+		h.respondFXError(c, err, "Failed to calculate value at risk")
+		return
+	}
+	matrix, pricedHoldings, warnings, err := h.loadHoldingReturns(holdings, nil, lookbackFrom, today)
+	if err != nil {
+		h.logger.Error("Failed to load price history for value at risk", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate value at risk"})
+		return
+	}
+	weights, value := holdingWeights(pricedHoldings, matrix.Symbols)
+	observations := len(matrix.Dates)
+
+	results := make([]varResult, 0, len(methods))
+	for _, method := range methods {
+		result := varResult{Method: method, Estimates: []varEstimate{}}
+		switch {
+		case value <= 0:
+		case method == varHistorical:
+			scenarios := horizonScenarios(matrix, int(horizon))
+			if len(scenarios) > 0 {
+				result.Scenarios = len(scenarios[0])
+			}
+			if result.Scenarios < 2 {
+				warnings = append(warnings, fmt.Sprintf("Historical VaR needs more than %d days of returns in the lookback window", horizon))
+				break
+			}
+			for _, confidence := range confidenceLevels {
+				result.Estimates = append(result.Estimates, scenarioVaR(matrix.Symbols, weights, scenarios, confidence, value))
+			}
+		case observations < 2:
+			warnings = append(warnings, fmt.Sprintf("%s VaR needs at least two days of returns in the lookback window", method))
+		case method == varParametric:
+			means, covariance := seriesMeans(matrix.Returns), newReturnCovariance(matrix, false).Covariance
+			for _, confidence := range confidenceLevels {
+				result.Estimates = append(result.Estimates, parametricVaR(matrix.Symbols, weights, means, covariance, int(horizon), confidence, value))
+			}
+		case method == varMonteCarlo:
+			scenarios, ok := simulateScenarios(matrix, int(horizon), int(simulations), seed)
+			if !ok {
+				warnings = append(warnings, "Monte Carlo VaR could not factor the covariance of the holdings' returns")
+				break
+			}
+			result.Scenarios = int(simulations)
+			result.Seed = &seed
+			for _, confidence := range confidenceLevels {
+				result.Estimates = append(result.Estimates, scenarioVaR(matrix.Symbols, weights, scenarios, confidence, value))
+			}
+		}
+		results = append(results, result)
+	}
+
+	response := gin.H{
+		"base_currency":     fx.base,
+		"portfolio_value":   value,
+		"horizon_days":      horizon,
+		"confidence_levels": confidenceLevels,
+		"lookback_window":   lookbackWindow(lookback, lookbackFrom, today, matrix),
+		"results":           results,
+	}
+	if len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+
+	c.JSON(http.StatusOK, response)
+}
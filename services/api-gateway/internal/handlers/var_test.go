@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// varTestMatrix returns ten days of returns for two symbols that mostly move together
+func varTestMatrix() returnMatrix {
+	return returnMatrix{
+		Symbols: []string{"AAA", "BBB"},
+		Start:   testDay("2024-03-01"),
+		Dates: []time.Time{
+			testDay("2024-03-04"), testDay("2024-03-05"), testDay("2024-03-06"), testDay("2024-03-07"), testDay("2024-03-08"),
+			testDay("2024-03-11"), testDay("2024-03-12"), testDay("2024-03-13"), testDay("2024-03-14"), testDay("2024-03-15"),
+		},
+		Returns: [][]float64{
+			{0.01, -0.02, 0.015, -0.04, 0.005, 0.02, -0.01, 0.0, -0.03, 0.012},
+			{0.005, -0.01, 0.01, -0.02, 0.0, 0.01, -0.015, 0.004, -0.01, 0.006},
+		},
+	}
+}
+
+// TestNormalQuantile tests the inverse normal distribution at common confidence levels
+func TestNormalQuantile(t *testing.T) {
+	assert.InDelta(t, 1.6448536, normalQuantile(0.95), 1e-6)
+	assert.InDelta(t, 1.9599640, normalQuantile(0.975), 1e-6)
+	assert.InDelta(t, 2.3263479, normalQuantile(0.99), 1e-6)
+	assert.InDelta(t, -2.3263479, normalQuantile(0.01), 1e-6)
+	assert.InDelta(t, 0, normalQuantile(0.5), 1e-12)
+}
+
+// TestScenarioVaR tests the tail of historical scenarios and how it's split between holdings
+func TestScenarioVaR(t *testing.T) {
+	matrix := varTestMatrix()
+	weights := []float64{0.5, 0.5}
+
+	// One-day windows are the daily returns: at 80% the tail is the two worst of ten days
+	estimate := scenarioVaR(matrix.Symbols, weights, horizonScenarios(matrix, 1), 0.8, 1000)
+
+	assert.InDelta(t, 2, estimate.VaRPercent, 1e-9)
+	assert.InDelta(t, 20, estimate.VaRAmount, 1e-9)
+	assert.InDelta(t, 2.5, estimate.ExpectedShortfallPercent, 1e-9)
+	assert.InDelta(t, 25, estimate.ExpectedShortfallAmount, 1e-9)
+	if assert.Len(t, estimate.Components, 2) {
+		assert.InDelta(t, 70, estimate.Components[0].ContributionPercent, 1e-9)
+		assert.InDelta(t, 14, estimate.Components[0].VaRAmount, 1e-9)
+		assert.InDelta(t, 6, estimate.Components[1].VaRAmount, 1e-9)
+	}
+
+	// Two-day windows compound consecutive returns
+	scenarios := horizonScenarios(matrix, 2)
+	if assert.Len(t, scenarios[0], 9) {
+		assert.InDelta(t, 1.01*0.98-1, scenarios[0][0], 1e-12)
+	}
+}
+
+// TestParametricVaR tests the variance-covariance VaR against the normal distribution's formulas
+func TestParametricVaR(t *testing.T) {
+	matrix := varTestMatrix()
+	weights := []float64{0.6, 0.4}
+	means, covariance := seriesMeans(matrix.Returns), covarianceMatrix(matrix.Returns)
+
+	estimate := parametricVaR(matrix.Symbols, weights, means, covariance, 5, 0.99, 10000)
+
+	portfolio := make([]float64, len(matrix.Dates))
+	for i := range portfolio {
+		portfolio[i] = 0.6*matrix.Returns[0][i] + 0.4*matrix.Returns[1][i]
+	}
+	sigma, mu, z := sampleStdDev(portfolio), mean(portfolio), normalQuantile(0.99)
+	expected := z*sigma*math.Sqrt(5) - mu*5
+	assert.InDelta(t, expected*100, estimate.VaRPercent, 1e-9)
+	assert.InDelta(t, expected*10000, estimate.VaRAmount, 1e-6)
+	assert.InDelta(t, (sigma*math.Sqrt(5)*normalPDF(z)/0.01-mu*5)*100, estimate.ExpectedShortfallPercent, 1e-9)
+	assert.Greater(t, estimate.ExpectedShortfallPercent, estimate.VaRPercent)
+
+	// Component VaRs add up to the VaR
+	var total float64
+	for _, component := range estimate.Components {
+		total += component.VaRAmount
+	}
+	assert.InDelta(t, estimate.VaRAmount, total, 1e-6)
+}
+
+// TestSimulateScenarios tests that Monte Carlo scenarios are reproducible with a seed and roughly
+// match the parametric VaR
+func TestSimulateScenarios(t *testing.T) {
+	matrix := varTestMatrix()
+	weights := []float64{0.5, 0.5}
+
+	first, ok := simulateScenarios(matrix, 1, 20000, 42)
+	assert.True(t, ok)
+	second, _ := simulateScenarios(matrix, 1, 20000, 42)
+	assert.Equal(t, first, second)
+	other, _ := simulateScenarios(matrix, 1, 20000, 7)
+	assert.NotEqual(t, first, other)
+
+	simulated := scenarioVaR(matrix.Symbols, weights, first, 0.95, 1000)
+	parametric := parametricVaR(matrix.Symbols, weights, seriesMeans(matrix.Returns), covarianceMatrix(matrix.Returns), 1, 0.95, 1000)
+	assert.InDelta(t, parametric.VaRPercent, simulated.VaRPercent, 0.1)
+}
+
+// TestGetValueAtRisk tests the VaR endpoint
+func TestGetValueAtRisk(t *testing.T) {
+	get := func(handler *Handler, target string) *httptest.ResponseRecorder {
+		router := createTestRouter(handler, "GET", "/analytics/var", handler.GetValueAtRisk)
+		req, _ := http.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("all methods", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+		expectBaseCurrency(mock, testPortfolioID, "USD")
+		mock.ExpectQuery(`SELECT a.symbol, COALESCE\(a.currency, 'USD'\) as currency, ph.quantity, ph.average_cost, \(ph.quantity \* ph.average_cost\) as position_value FROM portfolio_holdings ph JOIN assets a ON ph.asset_id = a.id WHERE ph.portfolio_id = \$1`).
+			WithArgs(testPortfolioID).
+			WillReturnRows(sqlmock.NewRows([]string{"symbol", "currency", "quantity", "average_cost", "position_value"}).
+				AddRow("AAA", "USD", 10.0, 50.0, 500.0).
+				AddRow("BBB", "USD", 5.0, 100.0, 500.0))
+
+		matrix := varTestMatrix()
+		rows := sqlmock.NewRows([]string{"symbol", "date", "close_price"})
+		for i, symbol := range matrix.Symbols {
+			price := 100.0
+			rows.AddRow(symbol, matrix.Start, price)
+			for j, r := range matrix.Returns[i] {
+				price *= 1 + r
+				rows.AddRow(symbol, matrix.Dates[j], price)
+			}
+		}
+		mock.ExpectQuery(`SELECT a.symbol, ph.date, ph.close_price FROM price_history ph JOIN assets a ON ph.asset_id = a.id WHERE a.symbol = ANY\(\$1\)`).
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(rows)
+
+		w := get(handler, "/analytics/var?confidence=0.9&simulations=1000&seed=3&lookback=max")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			PortfolioValue float64     `json:"portfolio_value"`
+			HorizonDays    int         `json:"horizon_days"`
+			Results        []varResult `json:"results"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, 1000.0, response.PortfolioValue)
+		assert.Equal(t, 1, response.HorizonDays)
+		if assert.Len(t, response.Results, 3) {
+			assert.Equal(t, varHistorical, response.Results[0].Method)
+			assert.Equal(t, 10, response.Results[0].Scenarios)
+			assert.Equal(t, varParametric, response.Results[1].Method)
+			assert.Equal(t, varMonteCarlo, response.Results[2].Method)
+			assert.Equal(t, int64(3), *response.Results[2].Seed)
+			for _, result := range response.Results {
+				if assert.Len(t, result.Estimates, 1) {
+					assert.Equal(t, 0.9, result.Estimates[0].Confidence)
+					assert.Greater(t, result.Estimates[0].VaRAmount, 0.0)
+				}
+			}
+		}
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		handler, mock, cleanup := createTestHandler(t)
+		defer cleanup()
+
+		for _, query := range []string{"method=delta", "confidence=95", "confidence=1", "horizon=0", "simulations=10", "seed=x", "lookback=2w"} {
+			expectDefaultPortfolio(mock, testUserID, testPortfolioID)
+			w := get(handler, "/analytics/var?"+query)
+			assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		}
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -1,13 +1,23 @@
 package middleware
 
 import (
+	"net/http"
+	"strings"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
-	"time"
+
+	"github.com/portfolio-management/api-gateway/internal/services"
 )
 
-const RequestIDKey = "X-Request-ID"
+const (
+	RequestIDKey = "X-Request-ID"
+	UserIDKey    = "user_id"
+	UsernameKey  = "username"
+	IsAdminKey   = "is_admin"
+)
 
 // RequestID adds a unique request ID to each request
 func RequestID() gin.HandlerFunc {
@@ -70,4 +80,49 @@ func CORS() gin.HandlerFunc {
 
 		c.Next()
 	}
-}
\ No newline at end of file
+}
+
+// Auth validates the bearer access token and puts the caller's user ID on the context.
+// Browsers can't set headers on WebSocket upgrades, so a "token" query parameter is accepted as a fallback.
+func Auth(tokens *services.TokenManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString := ""
+		if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			tokenString = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		} else {
+			tokenString = c.Query("token")
+		}
+
+		if tokenString == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization token required"})
+			return
+		}
+
+		claims, err := tokens.ParseToken(tokenString, services.AccessTokenType)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			return
+		}
+
+		c.Set(UserIDKey, claims.Subject)
+		c.Set(UsernameKey, claims.Username)
+		c.Set(IsAdminKey, claims.Admin)
+		c.Next()
+	}
+}
+
+// RequireAdmin rejects callers whose token doesn't carry the admin role. It must run after Auth.
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !c.GetBool(IsAdminKey) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// GetUserID returns the authenticated user ID set by Auth, or an empty string
+func GetUserID(c *gin.Context) string {
+	return c.GetString(UserIDKey)
+}
@@ -0,0 +1,66 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultBenchmark is the benchmark used when none is configured
+const DefaultBenchmark = "SPY"
+
+// AnalyticsSettings are the configured defaults of the analytics endpoints
+type AnalyticsSettings struct {
+	Benchmark    string  // a symbol or a weighted blend, e.g. "SPY:0.6,AGG:0.4"
+	RiskFreeRate float64 // annual, as a fraction
+}
+
+// BenchmarkComponent is one symbol of a benchmark and its weight in the blend
+type BenchmarkComponent struct {
+	Symbol string  `json:"symbol"`
+	Weight float64 `json:"weight"`
+}
+
+// ParseBenchmark parses a benchmark: a single symbol, or a comma-separated blend of SYMBOL:WEIGHT
+// pairs. Weights are normalized to sum to 1, so "SPY:60,AGG:40" and "SPY:0.6,AGG:0.4" are the same.
+func ParseBenchmark(spec string) ([]BenchmarkComponent, error) {
+	var components []BenchmarkComponent
+	seen := map[string]bool{}
+	var total float64
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		symbol, weight := part, 1.0
+		if i := strings.Index(part, ":"); i >= 0 {
+			symbol = part[:i]
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(part[i+1:]), 64)
+			if err != nil || parsed <= 0 || math.IsInf(parsed, 0) {
+				return nil, fmt.Errorf("invalid weight in benchmark %q, expected a positive number", part)
+			}
+			weight = parsed
+		}
+		symbol = strings.ToUpper(strings.TrimSpace(symbol))
+		if symbol == "" {
+			return nil, fmt.Errorf("missing symbol in benchmark %q", part)
+		}
+		if seen[symbol] {
+			return nil, fmt.Errorf("benchmark lists %s more than once", symbol)
+		}
+		seen[symbol] = true
+
+		components = append(components, BenchmarkComponent{Symbol: symbol, Weight: weight})
+		total += weight
+	}
+	if len(components) == 0 {
+		return nil, fmt.Errorf("benchmark is empty")
+	}
+
+	for i := range components {
+		components[i].Weight /= total
+	}
+	return components, nil
+}
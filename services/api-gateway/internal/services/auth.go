@@ -0,0 +1,110 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Token types carried in the "typ" claim so a refresh token can't be used as an access token
+const (
+	AccessTokenType  = "access"
+	RefreshTokenType = "refresh"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// TokenClaims are the JWT claims issued for an authenticated user
+type TokenClaims struct {
+	Username  string `json:"username"`
+	Admin     bool   `json:"admin,omitempty"`
+	TokenType string `json:"typ"`
+	jwt.RegisteredClaims
+}
+
+// TokenPair is returned to clients after register, login and refresh
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// TokenManager issues and validates HMAC-signed JWTs
+type TokenManager struct {
+	secret     []byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+// NewTokenManager creates a new token manager
+func NewTokenManager(secret string, accessTTL, refreshTTL time.Duration) *TokenManager {
+	return &TokenManager{
+		secret:     []byte(secret),
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+	}
+}
+
+// IssueTokens creates a new access/refresh token pair for the given user
+func (t *TokenManager) IssueTokens(userID, username string, admin bool) (*TokenPair, error) {
+	accessToken, err := t.sign(userID, username, admin, AccessTokenType, t.accessTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := t.sign(userID, username, admin, RefreshTokenType, t.refreshTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(t.accessTTL.Seconds()),
+	}, nil
+}
+
+// ParseToken validates a token's signature, expiry and type and returns its claims
+func (t *TokenManager) ParseToken(tokenString, expectedType string) (*TokenClaims, error) {
+	claims := &TokenClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return t.secret, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	if !token.Valid || claims.Subject == "" || claims.TokenType != expectedType {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+func (t *TokenManager) sign(userID, username string, admin bool, tokenType string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := TokenClaims{
+		Username:  username,
+		Admin:     admin,
+		TokenType: tokenType,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(t.secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign %s token: %w", tokenType, err)
+	}
+
+	return signed, nil
+}
@@ -0,0 +1,311 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CandleIngestResult summarizes one run of the candle ingester over every asset
+type CandleIngestResult struct {
+	Assets  int
+	Candles int
+	Failed  []string
+}
+
+// CandleIngester loads daily OHLCV candles from the market data provider into price_history. The first
+// run for an asset backfills backfillYears of history; later runs only fetch from its latest stored day.
+type CandleIngester struct {
+	db            *sql.DB
+	market        MarketDataProvider
+	backfillYears int
+	runAt         time.Duration // time of day in UTC
+	logger        *zap.Logger
+	ctx           context.Context
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+}
+
+// NewCandleIngester creates a candle ingester that runs daily at runAt past midnight UTC
+func NewCandleIngester(db *sql.DB, market MarketDataProvider, backfillYears int, runAt time.Duration, logger *zap.Logger) *CandleIngester {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &CandleIngester{
+		db:            db,
+		market:        market,
+		backfillYears: backfillYears,
+		runAt:         runAt,
+		logger:        logger,
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+}
+
+// ParseTimeOfDay parses an "HH:MM" time of day into its offset from midnight
+func ParseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// BackfillStart returns the first day a backfill fetches by default
+func (i *CandleIngester) BackfillStart() time.Time {
+	return time.Now().UTC().AddDate(-i.backfillYears, 0, 0).Truncate(24 * time.Hour)
+}
+
+// Start catches up on candles missed while the service was down, then ingests every day at the
+// configured time
+func (i *CandleIngester) Start() {
+	if i.market == nil {
+		i.logger.Warn("Market data provider not available, candle ingester will not start")
+		return
+	}
+
+	i.logger.Info("Starting candle ingester", zap.Duration("run_at", i.runAt), zap.Int("backfill_years", i.backfillYears))
+
+	i.wg.Add(1)
+	go func() {
+		defer i.wg.Done()
+		i.ingestAndLog()
+
+		for {
+			timer := time.NewTimer(time.Until(nextRunAt(time.Now(), i.runAt)))
+			select {
+			case <-i.ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+				i.ingestAndLog()
+			}
+		}
+	}()
+}
+
+// Stop gracefully shuts down the candle ingester
+func (i *CandleIngester) Stop() {
+	i.cancel()
+	i.wg.Wait()
+	i.logger.Info("Candle ingester stopped")
+}
+
+// nextRunAt returns the first time after now that is runAt past a midnight UTC
+func nextRunAt(now time.Time, runAt time.Duration) time.Time {
+	next := now.UTC().Truncate(24 * time.Hour).Add(runAt)
+	if !next.After(now) {
+		next = next.Add(24 * time.Hour)
+	}
+	return next
+}
+
+func (i *CandleIngester) ingestAndLog() {
+	result, err := i.IngestAll(i.ctx)
+	if err != nil {
+		i.logger.Error("Failed to ingest candles", zap.Error(err))
+		return
+	}
+	i.logger.Info("Ingested daily candles",
+		zap.Int("assets_count", result.Assets),
+		zap.Int("candles_count", result.Candles),
+		zap.Strings("failed", result.Failed))
+}
+
+// IngestAll brings every asset's daily candles up to date. An asset whose candles can't be fetched
+// or stored is reported in Failed and doesn't stop the others.
+func (i *CandleIngester) IngestAll(ctx context.Context) (CandleIngestResult, error) {
+	var result CandleIngestResult
+
+	rows, err := i.db.QueryContext(ctx, `
+		SELECT a.id, a.symbol, MAX(ph.date)
+		FROM assets a
+		LEFT JOIN price_history ph ON ph.asset_id = a.id
+		WHERE a.asset_type <> 'CASH'
+		GROUP BY a.id, a.symbol
+		ORDER BY a.symbol
+	`)
+	if err != nil {
+		return result, fmt.Errorf("failed to query assets: %w", err)
+	}
+
+	type pendingAsset struct {
+		id, symbol string
+		latest     sql.NullTime
+	}
+	var assets []pendingAsset
+	for rows.Next() {
+		var asset pendingAsset
+		if err := rows.Scan(&asset.id, &asset.symbol, &asset.latest); err != nil {
+			rows.Close()
+			return result, fmt.Errorf("failed to scan asset: %w", err)
+		}
+		assets = append(assets, asset)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	to := time.Now().UTC()
+	for _, asset := range assets {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+
+		// The latest stored day is fetched again, in case it was stored before the close
+		from := i.BackfillStart()
+		if asset.latest.Valid {
+			from = asset.latest.Time.UTC()
+		}
+
+		stored, err := i.Ingest(ctx, asset.id, asset.symbol, from, to)
+		if err != nil {
+			i.logger.Warn("Failed to ingest candles", zap.String("symbol", asset.symbol), zap.Error(err))
+			result.Failed = append(result.Failed, asset.symbol)
+			continue
+		}
+		result.Assets++
+		result.Candles += stored
+	}
+	return result, nil
+}
+
+// recordedSplit is a split applied to an asset, which restated its price history before the
+// effective date
+type recordedSplit struct {
+	id            string
+	ratio         float64
+	effectiveDate time.Time
+}
+
+// Helper function to load an asset's applied splits in the order they were applied
+func loadRecordedSplits(ctx context.Context, tx *sql.Tx, assetID string) ([]recordedSplit, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, ratio, effective_date
+		FROM corporate_actions
+		WHERE asset_id = $1 AND action_type IN ('SPLIT', 'REVERSE_SPLIT') AND status = 'APPLIED'
+		ORDER BY effective_date, created_at
+	`, assetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query splits: %w", err)
+	}
+	defer rows.Close()
+
+	var splits []recordedSplit
+	for rows.Next() {
+		var split recordedSplit
+		if err := rows.Scan(&split.id, &split.ratio, &split.effectiveDate); err != nil {
+			return nil, fmt.Errorf("failed to scan split: %w", err)
+		}
+		splits = append(splits, split)
+	}
+	return splits, rows.Err()
+}
+
+// Ingest fetches an asset's daily candles between from and to and stores them, replacing any
+// already stored for the same days, and returns how many were written. Unless the provider adjusts
+// for splits itself, candles from before a recorded split are restated by it as the split restated
+// the stored history, and recorded among its adjustments so reversing it restores the provider's prices.
+func (i *CandleIngester) Ingest(ctx context.Context, assetID, symbol string, from, to time.Time) (int, error) {
+	if i.market == nil {
+		return 0, errors.New("market data provider not available")
+	}
+
+	candles, err := i.market.GetCandles(symbol, "D", from, to)
+	if err != nil {
+		return 0, err
+	}
+	if len(candles) == 0 {
+		return 0, nil
+	}
+
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin price history transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Providers that adjust for splits have already restated their candles
+	var splits []recordedSplit
+	if !i.market.SplitAdjusted() {
+		splits, err = loadRecordedSplits(ctx, tx, assetID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	const upsert = `
+		INSERT INTO price_history (asset_id, open_price, high_price, low_price, close_price, volume, date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (asset_id, date) DO UPDATE SET
+			open_price = EXCLUDED.open_price,
+			high_price = EXCLUDED.high_price,
+			low_price = EXCLUDED.low_price,
+			close_price = EXCLUDED.close_price,
+			volume = EXCLUDED.volume
+	`
+	type adjustment struct {
+		splitID                                            string
+		volumeBefore, volumeAfter, closeBefore, closeAfter float64
+	}
+	for _, candle := range candles {
+		day := candle.Time.UTC().Format("2006-01-02")
+
+		// Each split after the candle restates it in turn, as restating the stored history did
+		var adjustments []adjustment
+		volume := candle.Volume
+		for _, split := range splits {
+			if day >= split.effectiveDate.UTC().Format("2006-01-02") || split.ratio <= 0 {
+				continue
+			}
+			next := adjustment{splitID: split.id, volumeBefore: volume, closeBefore: candle.Close}
+			candle.Open /= split.ratio
+			candle.High /= split.ratio
+			candle.Low /= split.ratio
+			candle.Close /= split.ratio
+			volume = math.Round(volume * split.ratio)
+			next.volumeAfter, next.closeAfter = volume, candle.Close
+			adjustments = append(adjustments, next)
+		}
+
+		if len(adjustments) == 0 {
+			_, err = tx.ExecContext(ctx, upsert, assetID, candle.Open, candle.High, candle.Low, candle.Close, int64(volume), day)
+			if err != nil {
+				return 0, fmt.Errorf("failed to store %s candle for %s: %w", symbol, day, err)
+			}
+			continue
+		}
+
+		var rowID string
+		err = tx.QueryRowContext(ctx, upsert+" RETURNING id", assetID, candle.Open, candle.High, candle.Low, candle.Close, int64(volume), day).Scan(&rowID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to store %s candle for %s: %w", symbol, day, err)
+		}
+		for _, adjustment := range adjustments {
+			_, err = tx.ExecContext(ctx, `
+				WITH updated AS (
+					UPDATE corporate_action_adjustments
+					SET quantity_before = $3, quantity_after = $4, price_before = $5, price_after = $6
+					WHERE corporate_action_id = $1 AND table_name = 'price_history' AND row_id = $2
+					RETURNING id
+				)
+				INSERT INTO corporate_action_adjustments (corporate_action_id, table_name, row_id, quantity_before, quantity_after, price_before, price_after)
+				SELECT $1, 'price_history', $2, $3, $4, $5, $6
+				WHERE NOT EXISTS (SELECT 1 FROM updated)
+			`, adjustment.splitID, rowID, adjustment.volumeBefore, adjustment.volumeAfter, adjustment.closeBefore, adjustment.closeAfter)
+			if err != nil {
+				return 0, fmt.Errorf("failed to record split adjustment of %s candle for %s: %w", symbol, day, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit price history: %w", err)
+	}
+	return len(candles), nil
+}
@@ -2,104 +2,249 @@ package services
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
+// FinnhubOptions sets the client's quota and how it retries and trips its circuit breaker
+type FinnhubOptions struct {
+	BaseURL          string
+	RequestsPerMin   int
+	MaxRetries       int
+	BackoffBase      time.Duration
+	BackoffMax       time.Duration
+	MaxRetryAfter    time.Duration // a longer Retry-After fails the request instead of waiting
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// DefaultFinnhubOptions fits Finnhub's free tier of 60 requests a minute
+func DefaultFinnhubOptions() FinnhubOptions {
+	return FinnhubOptions{
+		BaseURL:          "https://finnhub.io/api/v1",
+		RequestsPerMin:   60,
+		MaxRetries:       3,
+		BackoffBase:      500 * time.Millisecond,
+		BackoffMax:       10 * time.Second,
+		MaxRetryAfter:    30 * time.Second,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+	}
+}
+
 type FinnhubClient struct {
 	apiKey     string
-	baseURL    string
+	opts       FinnhubOptions
 	httpClient *http.Client
+	limiter    *TokenBucket
+	breaker    *CircuitBreaker
+}
+
+// finnhubError is a non-200 response from Finnhub
+type finnhubError struct {
+	status     int
+	body       string
+	retryAfter time.Duration
 }
 
-type FinnhubQuote struct {
-	CurrentPrice       float64 `json:"c"`
-	Change             float64 `json:"d"`
-	PercentChange      float64 `json:"dp"`
-	HighPriceOfDay     float64 `json:"h"`
-	LowPriceOfDay      float64 `json:"l"`
-	OpenPriceOfDay     float64 `json:"o"`
-	PreviousClosePrice float64 `json:"pc"`
-	Timestamp          int64   `json:"t"`
-}
-
-type FinnhubProfile struct {
-	Country         string  `json:"country"`
-	Currency        string  `json:"currency"`
-	Exchange        string  `json:"exchange"`
-	IPO             string  `json:"ipo"`
-	MarketCap       float64 `json:"marketCapitalization"`
-	Name            string  `json:"name"`
-	Phone           string  `json:"phone"`
-	SharesOut       float64 `json:"shareOutstanding"`
-	Ticker          string  `json:"ticker"`
-	WebURL          string  `json:"weburl"`
-	Logo            string  `json:"logo"`
-	FinnhubIndustry string  `json:"finnhubIndustry"`
-}
-
-func NewFinnhubClient(apiKey string) *FinnhubClient {
+func (e *finnhubError) Error() string {
+	return fmt.Sprintf("API error %d: %s", e.status, e.body)
+}
+
+// temporary reports whether a response is worth retrying: rate limiting or a server error
+func (e *finnhubError) temporary() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+type finnhubCandles struct {
+	Status string    `json:"s"`
+	Time   []int64   `json:"t"`
+	Open   []float64 `json:"o"`
+	High   []float64 `json:"h"`
+	Low    []float64 `json:"l"`
+	Close  []float64 `json:"c"`
+	Volume []float64 `json:"v"`
+}
+
+type finnhubSearch struct {
+	Result []struct {
+		Description string `json:"description"`
+		Symbol      string `json:"symbol"`
+		Type        string `json:"type"`
+	} `json:"result"`
+}
+
+func NewFinnhubClient(apiKey string, opts FinnhubOptions) *FinnhubClient {
+	if opts.BaseURL == "" {
+		opts.BaseURL = DefaultFinnhubOptions().BaseURL
+	}
 	return &FinnhubClient{
-		apiKey:  apiKey,
-		baseURL: "https://finnhub.io/api/v1",
+		apiKey: apiKey,
+		opts:   opts,
 		httpClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
+		limiter: NewTokenBucket(opts.RequestsPerMin),
+		breaker: NewCircuitBreaker(opts.BreakerThreshold, opts.BreakerCooldown),
 	}
 }
 
-func (f *FinnhubClient) GetQuote(symbol string) (*FinnhubQuote, error) {
-	url := fmt.Sprintf("%s/quote?symbol=%s&token=%s", f.baseURL, symbol, f.apiKey)
+func (f *FinnhubClient) Name() string {
+	return "finnhub"
+}
+
+// SplitAdjusted is true: Finnhub's candles are adjusted for splits
+func (f *FinnhubClient) SplitAdjusted() bool {
+	return true
+}
+
+// Degraded reports whether the circuit breaker is rejecting requests
+func (f *FinnhubClient) Degraded() bool {
+	return f.breaker.State() != breakerClosed
+}
 
-	resp, err := f.httpClient.Get(url)
+// get calls a Finnhub endpoint through the circuit breaker and decodes its JSON response into out.
+// Only network errors, rate limiting and server errors count against the breaker.
+func (f *FinnhubClient) get(path string, params url.Values, out interface{}) error {
+	if !f.breaker.Allow() {
+		return ErrProviderDegraded
+	}
+
+	err := f.getWithRetry(path, params, out)
+	var apiErr *finnhubError
+	f.breaker.Record(err == nil || (errors.As(err, &apiErr) && !apiErr.temporary()))
+	return err
+}
+
+// getWithRetry retries network errors, 429s and 5xx with jittered exponential backoff, waiting at
+// least as long as a Retry-After header asks. Every attempt takes a token from the rate limiter.
+func (f *FinnhubClient) getWithRetry(path string, params url.Values, out interface{}) error {
+	params.Set("token", f.apiKey)
+	for attempt := 0; ; attempt++ {
+		f.limiter.Wait()
+		err := f.do(path+"?"+params.Encode(), out)
+		if err == nil || attempt >= f.opts.MaxRetries {
+			return err
+		}
+
+		delay := backoffDelay(attempt, f.opts.BackoffBase, f.opts.BackoffMax)
+		var apiErr *finnhubError
+		if errors.As(err, &apiErr) {
+			if !apiErr.temporary() || apiErr.retryAfter > f.opts.MaxRetryAfter {
+				return err
+			}
+			if apiErr.retryAfter > delay {
+				delay = apiErr.retryAfter
+			}
+		}
+		time.Sleep(delay)
+	}
+}
+
+// do makes one request
+func (f *FinnhubClient) do(pathAndQuery string, out interface{}) error {
+	resp, err := f.httpClient.Get(f.opts.BaseURL + pathAndQuery)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch quote for %s: %w", symbol, err)
+		return err
 	}
 	defer resp.Body.Close()
 
+	body, err := io.ReadAll(resp.Body)
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
+		return &finnhubError{status: resp.StatusCode, body: string(body), retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
 	}
-
-	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	var quote FinnhubQuote
-	if err := json.Unmarshal(body, &quote); err != nil {
-		return nil, fmt.Errorf("failed to parse quote response: %w", err)
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
 	}
+	return nil
+}
 
-	return &quote, nil
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
 }
 
-func (f *FinnhubClient) GetCompanyProfile(symbol string) (*FinnhubProfile, error) {
-	url := fmt.Sprintf("%s/stock/profile2?symbol=%s&token=%s", f.baseURL, symbol, f.apiKey)
+func (f *FinnhubClient) GetQuote(symbol string) (*Quote, error) {
+	var quote Quote
+	if err := f.get("/quote", url.Values{"symbol": {symbol}}, &quote); err != nil {
+		return nil, fmt.Errorf("failed to fetch quote for %s: %w", symbol, err)
+	}
+	return &quote, nil
+}
 
-	resp, err := f.httpClient.Get(url)
-	if err != nil {
+func (f *FinnhubClient) GetCompanyProfile(symbol string) (*CompanyProfile, error) {
+	var profile CompanyProfile
+	if err := f.get("/stock/profile2", url.Values{"symbol": {symbol}}, &profile); err != nil {
 		return nil, fmt.Errorf("failed to fetch profile for %s: %w", symbol, err)
 	}
-	defer resp.Body.Close()
+	return &profile, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
+func (f *FinnhubClient) GetCandles(symbol, resolution string, from, to time.Time) ([]Candle, error) {
+	if _, err := candleStep(resolution); err != nil {
+		return nil, err
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	var response finnhubCandles
+	err := f.get("/stock/candle", url.Values{
+		"symbol":     {symbol},
+		"resolution": {resolution},
+		"from":       {strconv.FormatInt(from.Unix(), 10)},
+		"to":         {strconv.FormatInt(to.Unix(), 10)},
+	}, &response)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return nil, fmt.Errorf("failed to fetch candles for %s: %w", symbol, err)
+	}
+	if response.Status == "no_data" {
+		return []Candle{}, nil
 	}
 
-	var profile FinnhubProfile
-	if err := json.Unmarshal(body, &profile); err != nil {
-		return nil, fmt.Errorf("failed to parse profile response: %w", err)
+	candles := make([]Candle, 0, len(response.Time))
+	for i, timestamp := range response.Time {
+		if i >= len(response.Open) || i >= len(response.High) || i >= len(response.Low) || i >= len(response.Close) || i >= len(response.Volume) {
+			return nil, fmt.Errorf("failed to parse candles for %s: arrays have different lengths", symbol)
+		}
+		candles = append(candles, Candle{
+			Time:   time.Unix(timestamp, 0).UTC(),
+			Open:   response.Open[i],
+			High:   response.High[i],
+			Low:    response.Low[i],
+			Close:  response.Close[i],
+			Volume: response.Volume[i],
+		})
 	}
+	return candles, nil
+}
 
-	return &profile, nil
+func (f *FinnhubClient) SearchSymbols(query string) ([]SymbolMatch, error) {
+	var response finnhubSearch
+	if err := f.get("/search", url.Values{"q": {query}}, &response); err != nil {
+		return nil, fmt.Errorf("failed to search symbols for %q: %w", query, err)
+	}
+
+	matches := make([]SymbolMatch, 0, len(response.Result))
+	for _, result := range response.Result {
+		matches = append(matches, SymbolMatch{Symbol: result.Symbol, Description: result.Description, Type: result.Type})
+	}
+	return matches, nil
 }
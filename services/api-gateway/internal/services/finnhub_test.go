@@ -0,0 +1,193 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFinnhubServer serves Finnhub quotes, answering each request with the next status in statuses
+// (200 once they run out) and counting the requests it receives. Rate limited responses ask to be
+// retried after retryAfter.
+func newFinnhubServer(t *testing.T, retryAfter string, statuses ...int) (*httptest.Server, *int32) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&hits, 1))
+		if n <= len(statuses) && statuses[n-1] != http.StatusOK {
+			if statuses[n-1] == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]float64{"c": 150.25, "pc": 148})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+// testFinnhubOptions keeps retries and backoff short enough for tests
+func testFinnhubOptions(baseURL string) FinnhubOptions {
+	return FinnhubOptions{
+		BaseURL:          baseURL,
+		RequestsPerMin:   6000,
+		MaxRetries:       2,
+		BackoffBase:      time.Millisecond,
+		BackoffMax:       5 * time.Millisecond,
+		MaxRetryAfter:    time.Second,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Minute,
+	}
+}
+
+// TestFinnhubClient tests that Finnhub requests are retried and that a failing upstream trips the
+// circuit breaker
+func TestFinnhubClient(t *testing.T) {
+	t.Run("rate limited requests are retried", func(t *testing.T) {
+		srv, hits := newFinnhubServer(t, "0", http.StatusTooManyRequests, http.StatusServiceUnavailable)
+		client := NewFinnhubClient("key", testFinnhubOptions(srv.URL))
+
+		quote, err := client.GetQuote("AAPL")
+		assert.NoError(t, err)
+		assert.Equal(t, 150.25, quote.CurrentPrice)
+		assert.Equal(t, int32(3), atomic.LoadInt32(hits))
+		assert.False(t, client.Degraded())
+	})
+
+	t.Run("retries that would wait too long are given up", func(t *testing.T) {
+		srv, hits := newFinnhubServer(t, "120", http.StatusTooManyRequests)
+		client := NewFinnhubClient("key", testFinnhubOptions(srv.URL))
+
+		_, err := client.GetQuote("AAPL")
+		assert.Error(t, err)
+		assert.Equal(t, int32(1), atomic.LoadInt32(hits))
+	})
+
+	t.Run("client errors are not retried", func(t *testing.T) {
+		srv, hits := newFinnhubServer(t, "0", http.StatusForbidden)
+		client := NewFinnhubClient("key", testFinnhubOptions(srv.URL))
+
+		_, err := client.GetQuote("AAPL")
+		assert.Error(t, err)
+		assert.Equal(t, int32(1), atomic.LoadInt32(hits))
+		assert.False(t, client.Degraded())
+	})
+
+	t.Run("repeated failures open the circuit breaker", func(t *testing.T) {
+		statuses := make([]int, 6)
+		for i := range statuses {
+			statuses[i] = http.StatusInternalServerError
+		}
+		srv, hits := newFinnhubServer(t, "0", statuses...)
+		client := NewFinnhubClient("key", testFinnhubOptions(srv.URL))
+
+		for i := 0; i < 2; i++ {
+			_, err := client.GetQuote("AAPL")
+			assert.Error(t, err)
+		}
+		assert.Equal(t, int32(6), atomic.LoadInt32(hits))
+		assert.True(t, client.Degraded())
+
+		_, err := client.GetQuote("AAPL")
+		assert.ErrorIs(t, err, ErrProviderDegraded)
+		assert.Equal(t, int32(6), atomic.LoadInt32(hits))
+	})
+}
+
+// TestTokenBucket tests that no minute sees more requests than the quota, counting the initial burst
+func TestTokenBucket(t *testing.T) {
+	for _, perMinute := range []int{5, 60, 600, 6000} {
+		bucket := NewTokenBucket(perMinute)
+		assert.GreaterOrEqual(t, bucket.capacity, 1.0, perMinute)
+		assert.LessOrEqual(t, bucket.capacity+bucket.rate*60, float64(perMinute), perMinute)
+	}
+
+	// 600 a minute is a burst of 60, then 9 a second
+	bucket := NewTokenBucket(600)
+	start := time.Now()
+	requests := 0
+	for time.Since(start) < 300*time.Millisecond {
+		bucket.Wait()
+		requests++
+	}
+	elapsed := time.Since(start).Seconds()
+	assert.GreaterOrEqual(t, requests, 60)
+	assert.LessOrEqual(t, float64(requests), 60+9*elapsed+1)
+}
+
+// TestCircuitBreaker tests that the breaker opens after consecutive failures and lets one trial call
+// through once it cools down
+func TestCircuitBreaker(t *testing.T) {
+	breaker := NewCircuitBreaker(2, time.Minute)
+
+	assert.True(t, breaker.Allow())
+	breaker.Record(false)
+	assert.Equal(t, breakerClosed, breaker.State())
+
+	// A success in between starts the count again
+	assert.True(t, breaker.Allow())
+	breaker.Record(true)
+	assert.True(t, breaker.Allow())
+	breaker.Record(false)
+	assert.Equal(t, breakerClosed, breaker.State())
+
+	assert.True(t, breaker.Allow())
+	breaker.Record(false)
+	assert.Equal(t, breakerOpen, breaker.State())
+	assert.False(t, breaker.Allow())
+
+	// After the cooldown a single trial call goes through, and opens the breaker again if it fails
+	breaker.openedAt = time.Now().Add(-time.Minute)
+	assert.True(t, breaker.Allow())
+	assert.Equal(t, breakerHalfOpen, breaker.State())
+	assert.False(t, breaker.Allow())
+	breaker.Record(false)
+	assert.Equal(t, breakerOpen, breaker.State())
+	assert.False(t, breaker.Allow())
+
+	// or closes it if it succeeds
+	breaker.openedAt = time.Now().Add(-time.Minute)
+	assert.True(t, breaker.Allow())
+	breaker.Record(true)
+	assert.Equal(t, breakerClosed, breaker.State())
+	assert.True(t, breaker.Allow())
+}
+
+// TestBackoffDelay tests that retry delays grow exponentially up to the cap
+func TestBackoffDelay(t *testing.T) {
+	base, max := 10*time.Millisecond, 50*time.Millisecond
+	for attempt := 0; attempt < 5; attempt++ {
+		ceiling := base << uint(attempt)
+		if ceiling > max {
+			ceiling = max
+		}
+		for i := 0; i < 100; i++ {
+			delay := backoffDelay(attempt, base, max)
+			assert.GreaterOrEqual(t, delay, time.Duration(0))
+			assert.LessOrEqual(t, delay, ceiling)
+		}
+	}
+
+	// Shifts past the width of a duration are capped too
+	assert.LessOrEqual(t, backoffDelay(70, time.Second, time.Minute), time.Minute)
+	assert.Equal(t, time.Duration(0), backoffDelay(3, 0, 0))
+}
+
+// TestParseRetryAfter tests reading Retry-After as seconds or an HTTP date
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, 2*time.Second, parseRetryAfter("2"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-5"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon"))
+
+	// HTTP dates are counted from now, and dates past ask for no wait
+	wait := parseRetryAfter(time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat))
+	assert.Greater(t, wait, 28*time.Second)
+	assert.LessOrEqual(t, wait, 30*time.Second)
+	assert.Equal(t, time.Duration(0), parseRetryAfter(time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)))
+}
@@ -0,0 +1,242 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// FXQuote is a day's exchange rates, in units of each quote currency per unit of Base
+type FXQuote struct {
+	Base  string             `json:"base"`
+	Date  string             `json:"date"`
+	Rates map[string]float64 `json:"rates"`
+}
+
+// FXRateSource supplies the exchange rates stored in fx_rates
+type FXRateSource interface {
+	Name() string
+	Rates(ctx context.Context) ([]FXQuote, error)
+}
+
+// NewFXRateSource returns the rate source named by kind: "file" reads path, "static" serves built-in rates
+func NewFXRateSource(kind, path string) (FXRateSource, error) {
+	switch kind {
+	case "file":
+		if path == "" {
+			return nil, fmt.Errorf("FX_RATES_FILE is required for the file FX source")
+		}
+		return NewFileFXSource(path), nil
+	case "static", "":
+		return NewStaticFXSource(), nil
+	}
+	return nil, fmt.Errorf("unknown FX source %q", kind)
+}
+
+// FileFXSource reads rates from a JSON file holding one quote or an array of them
+type FileFXSource struct {
+	path string
+}
+
+// NewFileFXSource creates a rate source backed by a local JSON file
+func NewFileFXSource(path string) *FileFXSource {
+	return &FileFXSource{path: path}
+}
+
+func (s *FileFXSource) Name() string {
+	return "file"
+}
+
+// Rates re-reads the file on every call, so edits are picked up at the next refresh
+func (s *FileFXSource) Rates(ctx context.Context) ([]FXQuote, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read FX rates file: %w", err)
+	}
+
+	var quotes []FXQuote
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(data, &quotes)
+	} else {
+		var quote FXQuote
+		err = json.Unmarshal(data, &quote)
+		quotes = []FXQuote{quote}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse FX rates file: %w", err)
+	}
+
+	for _, quote := range quotes {
+		if len(quote.Base) != 3 {
+			return nil, fmt.Errorf("FX rates file has a quote without a valid base currency")
+		}
+		if _, err := time.Parse("2006-01-02", quote.Date); quote.Date != "" && err != nil {
+			return nil, fmt.Errorf("FX rates file has an invalid date %q", quote.Date)
+		}
+	}
+	return quotes, nil
+}
+
+// StaticFXSource serves a fixed set of indicative USD rates, dated the day they're read.
+// It keeps conversions working in development and tests without a rate feed.
+type StaticFXSource struct {
+	base  string
+	rates map[string]float64
+}
+
+// NewStaticFXSource creates the built-in stub rate source
+func NewStaticFXSource() *StaticFXSource {
+	return &StaticFXSource{
+		base: "USD",
+		rates: map[string]float64{
+			"EUR": 0.92, "GBP": 0.79, "JPY": 150.0, "CAD": 1.36,
+			"CHF": 0.88, "AUD": 1.52, "HKD": 7.82, "CNY": 7.2,
+		},
+	}
+}
+
+func (s *StaticFXSource) Name() string {
+	return "static"
+}
+
+func (s *StaticFXSource) Rates(ctx context.Context) ([]FXQuote, error) {
+	rates := make(map[string]float64, len(s.rates))
+	for currency, rate := range s.rates {
+		rates[currency] = rate
+	}
+	return []FXQuote{{Base: s.base, Date: time.Now().Format("2006-01-02"), Rates: rates}}, nil
+}
+
+// FXUpdater periodically loads rates from a source into fx_rates
+type FXUpdater struct {
+	db       *sql.DB
+	source   FXRateSource
+	interval time.Duration
+	logger   *zap.Logger
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// NewFXUpdater creates a new FX rate updater
+func NewFXUpdater(db *sql.DB, source FXRateSource, interval time.Duration, logger *zap.Logger) *FXUpdater {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &FXUpdater{
+		db:       db,
+		source:   source,
+		interval: interval,
+		logger:   logger,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Source returns the name of the updater's rate source
+func (u *FXUpdater) Source() string {
+	return u.source.Name()
+}
+
+// Start loads the current rates and then refreshes them on the updater's interval
+func (u *FXUpdater) Start() {
+	u.logger.Info("Starting FX rate updater", zap.String("source", u.source.Name()))
+
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		u.refreshAndLog()
+
+		ticker := time.NewTicker(u.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-u.ctx.Done():
+				return
+			case <-ticker.C:
+				u.refreshAndLog()
+			}
+		}
+	}()
+}
+
+// Stop gracefully shuts down the FX rate updater
+func (u *FXUpdater) Stop() {
+	u.cancel()
+	u.wg.Wait()
+	u.logger.Info("FX rate updater stopped")
+}
+
+func (u *FXUpdater) refreshAndLog() {
+	stored, err := u.Refresh(u.ctx)
+	if err != nil {
+		u.logger.Error("Failed to refresh FX rates", zap.String("source", u.source.Name()), zap.Error(err))
+		return
+	}
+	u.logger.Info("Refreshed FX rates", zap.String("source", u.source.Name()), zap.Int("rates_count", stored))
+}
+
+// Refresh stores the source's current rates, replacing any already stored for the same day, and
+// returns how many were written. Each base currency is also stored against itself at 1.
+func (u *FXUpdater) Refresh(ctx context.Context) (int, error) {
+	quotes, err := u.source.Rates(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin FX rates transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stored := 0
+	for _, quote := range quotes {
+		base := strings.ToUpper(quote.Base)
+		date := quote.Date
+		if date == "" {
+			date = time.Now().Format("2006-01-02")
+		}
+
+		rates := map[string]float64{base: 1}
+		for currency, rate := range quote.Rates {
+			if rate <= 0 {
+				return 0, fmt.Errorf("invalid %s/%s rate %v on %s", base, currency, rate, date)
+			}
+			rates[strings.ToUpper(currency)] = rate
+		}
+
+		currencies := make([]string, 0, len(rates))
+		for currency := range rates {
+			currencies = append(currencies, currency)
+		}
+		sort.Strings(currencies)
+
+		for _, currency := range currencies {
+			rate := rates[currency]
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO fx_rates (base_currency, quote_currency, rate, rate_date, source)
+				VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (base_currency, quote_currency, rate_date) DO UPDATE SET
+					rate = EXCLUDED.rate,
+					source = EXCLUDED.source
+			`, base, currency, rate, date, u.source.Name())
+			if err != nil {
+				return 0, fmt.Errorf("failed to store %s/%s rate: %w", base, currency, err)
+			}
+			stored++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit FX rates: %w", err)
+	}
+	return stored, nil
+}
@@ -0,0 +1,170 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/portfolio-management/api-gateway/internal/config"
+)
+
+// ErrSymbolNotFound is returned by providers that only know a fixed set of symbols
+var ErrSymbolNotFound = errors.New("symbol not found")
+
+// Quote is a symbol's latest price. The JSON tags follow Finnhub's quote response.
+type Quote struct {
+	CurrentPrice       float64 `json:"c"`
+	Change             float64 `json:"d"`
+	PercentChange      float64 `json:"dp"`
+	HighPriceOfDay     float64 `json:"h"`
+	LowPriceOfDay      float64 `json:"l"`
+	OpenPriceOfDay     float64 `json:"o"`
+	PreviousClosePrice float64 `json:"pc"`
+	Timestamp          int64   `json:"t"`
+
+	// Stale is set on a cached quote served because the provider couldn't be reached
+	Stale bool `json:"-"`
+}
+
+// CompanyProfile describes the issuer of a symbol. The JSON tags follow Finnhub's profile response.
+type CompanyProfile struct {
+	Country         string  `json:"country"`
+	Currency        string  `json:"currency"`
+	Exchange        string  `json:"exchange"`
+	IPO             string  `json:"ipo"`
+	MarketCap       float64 `json:"marketCapitalization"`
+	Name            string  `json:"name"`
+	Phone           string  `json:"phone"`
+	SharesOut       float64 `json:"shareOutstanding"`
+	Ticker          string  `json:"ticker"`
+	WebURL          string  `json:"weburl"`
+	Logo            string  `json:"logo"`
+	FinnhubIndustry string  `json:"finnhubIndustry"`
+}
+
+// Candle is one OHLCV bar starting at Time
+type Candle struct {
+	Time   time.Time `json:"time"`
+	Open   float64   `json:"open"`
+	High   float64   `json:"high"`
+	Low    float64   `json:"low"`
+	Close  float64   `json:"close"`
+	Volume float64   `json:"volume"`
+}
+
+// SymbolMatch is a symbol search result
+type SymbolMatch struct {
+	Symbol      string `json:"symbol"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+}
+
+// MarketDataProvider supplies quotes, company profiles, candles and symbol search.
+// Candle resolutions are Finnhub's: "1", "5", "15", "30" and "60" minutes, or "D", "W" and "M".
+// SplitAdjusted reports whether candles are already restated for every split since, rather than
+// priced as traded on the day.
+type MarketDataProvider interface {
+	Name() string
+	SplitAdjusted() bool
+	GetQuote(symbol string) (*Quote, error)
+	GetCompanyProfile(symbol string) (*CompanyProfile, error)
+	GetCandles(symbol, resolution string, from, to time.Time) ([]Candle, error)
+	SearchSymbols(query string) ([]SymbolMatch, error)
+}
+
+// NewMarketDataProvider returns the provider named by cfg.MarketDataProvider, or nil for "none".
+// Left unset, it uses Finnhub when an API key is configured and the simulated provider otherwise.
+func NewMarketDataProvider(cfg *config.Config) (MarketDataProvider, error) {
+	provider := cfg.MarketDataProvider
+	if provider == "" {
+		provider = "simulated"
+		if cfg.FinnhubAPIKey != "" {
+			provider = "finnhub"
+		}
+	}
+
+	switch provider {
+	case "finnhub":
+		if cfg.FinnhubAPIKey == "" {
+			return nil, fmt.Errorf("FINNHUB_API_KEY is required for the finnhub market data provider; set MARKET_DATA_PROVIDER=simulated to run without it")
+		}
+		opts := DefaultFinnhubOptions()
+		opts.RequestsPerMin = cfg.FinnhubRequestsPerMin
+		opts.MaxRetries = cfg.FinnhubMaxRetries
+		opts.BreakerThreshold = cfg.FinnhubBreakerThreshold
+		opts.BreakerCooldown = cfg.FinnhubBreakerCooldown
+		return NewFinnhubClient(cfg.FinnhubAPIKey, opts), nil
+	case "file":
+		if cfg.MarketDataFile == "" {
+			return nil, fmt.Errorf("MARKET_DATA_FILE is required for the file market data provider")
+		}
+		return NewFileMarketDataProvider(cfg.MarketDataFile)
+	case "simulated":
+		return NewSimulatedMarketDataProvider(cfg.MarketDataSeed), nil
+	case "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown market data provider %q", provider)
+}
+
+// MarketDataDegraded reports whether a provider, or the one a cache wraps, is failing fast after
+// repeated upstream errors
+func MarketDataDegraded(provider MarketDataProvider) bool {
+	if degradable, ok := provider.(interface{ Degraded() bool }); ok {
+		return degradable.Degraded()
+	}
+	return false
+}
+
+// candleStep returns the length of an intraday resolution, or 0 for daily, weekly and monthly ones
+func candleStep(resolution string) (time.Duration, error) {
+	switch resolution {
+	case "1", "5", "15", "30", "60":
+		minutes, _ := strconv.Atoi(resolution)
+		return time.Duration(minutes) * time.Minute, nil
+	case "D", "W", "M":
+		return 0, nil
+	}
+	return 0, fmt.Errorf("unsupported candle resolution %q", resolution)
+}
+
+// AggregateCandles merges daily candles into weekly ("W", starting Monday) or monthly ("M") ones, each
+// keeping its first open and last close, its highest high and lowest low, and its total volume
+func AggregateCandles(daily []Candle, resolution string) []Candle {
+	if resolution != "W" && resolution != "M" {
+		return daily
+	}
+
+	var candles []Candle
+	for _, day := range daily {
+		start := time.Date(day.Time.Year(), day.Time.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if resolution == "W" {
+			weekday := (int(day.Time.Weekday()) + 6) % 7
+			start = time.Date(day.Time.Year(), day.Time.Month(), day.Time.Day()-weekday, 0, 0, 0, 0, time.UTC)
+		}
+
+		last := len(candles) - 1
+		if last < 0 || !candles[last].Time.Equal(start) {
+			day.Time = start
+			candles = append(candles, day)
+			continue
+		}
+		if day.High > candles[last].High {
+			candles[last].High = day.High
+		}
+		if day.Low < candles[last].Low {
+			candles[last].Low = day.Low
+		}
+		candles[last].Close = day.Close
+		candles[last].Volume += day.Volume
+	}
+	return candles
+}
+
+// matchesSymbol reports whether a search query matches a symbol's prefix or its description
+func matchesSymbol(query, symbol, description string) bool {
+	query = strings.ToUpper(strings.TrimSpace(query))
+	return query != "" && (strings.HasPrefix(symbol, query) || strings.Contains(strings.ToUpper(description), query))
+}
@@ -0,0 +1,31 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/portfolio-management/api-gateway/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMarketDataProvider(t *testing.T) {
+	t.Run("unset without an API key runs simulated", func(t *testing.T) {
+		provider, err := NewMarketDataProvider(&config.Config{})
+
+		assert.NoError(t, err)
+		assert.IsType(t, &SimulatedMarketDataProvider{}, provider)
+	})
+
+	t.Run("unset with an API key uses finnhub", func(t *testing.T) {
+		provider, err := NewMarketDataProvider(&config.Config{FinnhubAPIKey: "key"})
+
+		assert.NoError(t, err)
+		assert.IsType(t, &FinnhubClient{}, provider)
+	})
+
+	t.Run("explicit finnhub still needs an API key", func(t *testing.T) {
+		provider, err := NewMarketDataProvider(&config.Config{MarketDataProvider: "finnhub"})
+
+		assert.Error(t, err)
+		assert.Nil(t, provider)
+	})
+}
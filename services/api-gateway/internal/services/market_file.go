@@ -0,0 +1,241 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileMarketDataProvider serves daily candles loaded from a CSV or JSON file. Quotes are the latest
+// close on or before today, with the change against the close before it.
+//
+// A CSV file has the header symbol,date,open,high,low,close,volume. A JSON file holds
+// {"assets": [{"symbol", "name", "currency", "exchange", "industry", "candles": [{"date", "open", "high", "low", "close", "volume"}]}]}.
+type FileMarketDataProvider struct {
+	assets map[string]*fileAsset
+}
+
+type fileAsset struct {
+	profile CompanyProfile
+	candles []Candle
+}
+
+type fileMarketData struct {
+	Assets []struct {
+		Symbol   string `json:"symbol"`
+		Name     string `json:"name"`
+		Currency string `json:"currency"`
+		Exchange string `json:"exchange"`
+		Industry string `json:"industry"`
+		Candles  []struct {
+			Date   string  `json:"date"`
+			Open   float64 `json:"open"`
+			High   float64 `json:"high"`
+			Low    float64 `json:"low"`
+			Close  float64 `json:"close"`
+			Volume float64 `json:"volume"`
+		} `json:"candles"`
+	} `json:"assets"`
+}
+
+// NewFileMarketDataProvider loads a market data file; the format is chosen by its .csv or .json extension
+func NewFileMarketDataProvider(path string) (*FileMarketDataProvider, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open market data file: %w", err)
+	}
+	defer file.Close()
+
+	p := &FileMarketDataProvider{assets: map[string]*fileAsset{}}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		err = p.loadCSV(file)
+	case ".json":
+		err = p.loadJSON(file)
+	default:
+		err = fmt.Errorf("unsupported file type %q", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load market data file: %w", err)
+	}
+
+	for _, asset := range p.assets {
+		sort.Slice(asset.candles, func(i, j int) bool { return asset.candles[i].Time.Before(asset.candles[j].Time) })
+	}
+	return p, nil
+}
+
+func (p *FileMarketDataProvider) loadCSV(r io.Reader) error {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("file is empty")
+	}
+
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"symbol", "date", "open", "high", "low", "close", "volume"} {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("missing %q column", name)
+		}
+	}
+
+	for line, record := range records[1:] {
+		date, err := time.Parse("2006-01-02", strings.TrimSpace(record[columns["date"]]))
+		if err != nil {
+			return fmt.Errorf("line %d: invalid date: %w", line+2, err)
+		}
+		candle := Candle{Time: date}
+		for name, field := range map[string]*float64{
+			"open": &candle.Open, "high": &candle.High, "low": &candle.Low, "close": &candle.Close, "volume": &candle.Volume,
+		} {
+			if *field, err = strconv.ParseFloat(strings.TrimSpace(record[columns[name]]), 64); err != nil {
+				return fmt.Errorf("line %d: invalid %s: %w", line+2, name, err)
+			}
+		}
+		asset := p.asset(record[columns["symbol"]])
+		asset.candles = append(asset.candles, candle)
+	}
+	return nil
+}
+
+func (p *FileMarketDataProvider) loadJSON(r io.Reader) error {
+	var data fileMarketData
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+
+	for _, entry := range data.Assets {
+		asset := p.asset(entry.Symbol)
+		if entry.Name != "" {
+			asset.profile.Name = entry.Name
+		}
+		if entry.Currency != "" {
+			asset.profile.Currency = strings.ToUpper(entry.Currency)
+		}
+		if entry.Exchange != "" {
+			asset.profile.Exchange = entry.Exchange
+		}
+		asset.profile.FinnhubIndustry = entry.Industry
+
+		for _, bar := range entry.Candles {
+			date, err := time.Parse("2006-01-02", bar.Date)
+			if err != nil {
+				return fmt.Errorf("%s: invalid date: %w", entry.Symbol, err)
+			}
+			asset.candles = append(asset.candles, Candle{
+				Time: date, Open: bar.Open, High: bar.High, Low: bar.Low, Close: bar.Close, Volume: bar.Volume,
+			})
+		}
+	}
+	return nil
+}
+
+// asset returns a symbol's entry, creating it with a default profile
+func (p *FileMarketDataProvider) asset(symbol string) *fileAsset {
+	symbol = strings.ToUpper(strings.TrimSpace(symbol))
+	asset, ok := p.assets[symbol]
+	if !ok {
+		asset = &fileAsset{profile: CompanyProfile{Ticker: symbol, Name: symbol, Currency: "USD", Exchange: "FILE"}}
+		p.assets[symbol] = asset
+	}
+	return asset
+}
+
+func (p *FileMarketDataProvider) Name() string {
+	return "file"
+}
+
+// SplitAdjusted is false: a file's candles are taken as priced on the day
+func (p *FileMarketDataProvider) SplitAdjusted() bool {
+	return false
+}
+
+func (p *FileMarketDataProvider) GetQuote(symbol string) (*Quote, error) {
+	asset, ok := p.assets[strings.ToUpper(symbol)]
+	if !ok {
+		return nil, fmt.Errorf("failed to fetch quote for %s: %w", symbol, ErrSymbolNotFound)
+	}
+
+	// The latest candle that isn't in the future
+	now := time.Now()
+	last := sort.Search(len(asset.candles), func(i int) bool { return asset.candles[i].Time.After(now) }) - 1
+	if last < 0 {
+		return nil, fmt.Errorf("failed to fetch quote for %s: no prices on or before today", symbol)
+	}
+
+	candle := asset.candles[last]
+	previousClose := candle.Open
+	if last > 0 {
+		previousClose = asset.candles[last-1].Close
+	}
+	quote := &Quote{
+		CurrentPrice:       candle.Close,
+		Change:             candle.Close - previousClose,
+		HighPriceOfDay:     candle.High,
+		LowPriceOfDay:      candle.Low,
+		OpenPriceOfDay:     candle.Open,
+		PreviousClosePrice: previousClose,
+		Timestamp:          candle.Time.Unix(),
+	}
+	if previousClose != 0 {
+		quote.PercentChange = quote.Change / previousClose * 100
+	}
+	return quote, nil
+}
+
+func (p *FileMarketDataProvider) GetCompanyProfile(symbol string) (*CompanyProfile, error) {
+	asset, ok := p.assets[strings.ToUpper(symbol)]
+	if !ok {
+		return nil, fmt.Errorf("failed to fetch profile for %s: %w", symbol, ErrSymbolNotFound)
+	}
+	profile := asset.profile
+	return &profile, nil
+}
+
+// GetCandles returns the file's daily candles in range, merged into weekly or monthly ones as requested.
+// Intraday resolutions aren't supported.
+func (p *FileMarketDataProvider) GetCandles(symbol, resolution string, from, to time.Time) ([]Candle, error) {
+	step, err := candleStep(resolution)
+	if err != nil {
+		return nil, err
+	}
+	if step > 0 {
+		return nil, fmt.Errorf("the file market data provider only has daily candles, not %q", resolution)
+	}
+
+	asset, ok := p.assets[strings.ToUpper(symbol)]
+	if !ok {
+		return nil, fmt.Errorf("failed to fetch candles for %s: %w", symbol, ErrSymbolNotFound)
+	}
+
+	candles := []Candle{}
+	for _, candle := range asset.candles {
+		if !candle.Time.Before(from) && !candle.Time.After(to) {
+			candles = append(candles, candle)
+		}
+	}
+	return AggregateCandles(candles, resolution), nil
+}
+
+func (p *FileMarketDataProvider) SearchSymbols(query string) ([]SymbolMatch, error) {
+	matches := []SymbolMatch{}
+	for symbol, asset := range p.assets {
+		if matchesSymbol(query, symbol, asset.profile.Name) {
+			matches = append(matches, SymbolMatch{Symbol: symbol, Description: asset.profile.Name, Type: "Common Stock"})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Symbol < matches[j].Symbol })
+	return matches, nil
+}
@@ -0,0 +1,250 @@
+package services
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// simulationStart is the first day of every simulated price series
+var simulationStart = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const (
+	// simulatedIntradayNoise is the size of the minute-by-minute wobble around a day's path
+	simulatedIntradayNoise = 0.002
+	// maxSimulatedCandles caps the number of intraday candles one request can generate
+	maxSimulatedCandles = 10000
+)
+
+// simulatedUniverse names some well-known symbols for search and profiles; any other symbol is priced too
+var simulatedUniverse = []struct {
+	symbol, name, industry string
+}{
+	{"AAPL", "Apple Inc.", "Technology"},
+	{"MSFT", "Microsoft Corporation", "Technology"},
+	{"GOOGL", "Alphabet Inc.", "Media"},
+	{"AMZN", "Amazon.com Inc.", "Retail"},
+	{"NVDA", "NVIDIA Corporation", "Semiconductors"},
+	{"META", "Meta Platforms Inc.", "Media"},
+	{"TSLA", "Tesla Inc.", "Automobiles"},
+	{"JPM", "JPMorgan Chase & Co.", "Banking"},
+	{"JNJ", "Johnson & Johnson", "Pharmaceuticals"},
+	{"XOM", "Exxon Mobil Corporation", "Energy"},
+	{"SPY", "SPDR S&P 500 ETF Trust", "ETF"},
+	{"QQQ", "Invesco QQQ Trust", "ETF"},
+}
+
+var simulatedIndustries = []string{"Technology", "Banking", "Energy", "Retail", "Pharmaceuticals", "Utilities"}
+
+// SimulatedMarketDataProvider prices any symbol with a deterministic random walk: each symbol gets its own
+// starting price, drift and volatility, and daily closes from 2020-01-01 follow from the seed alone, so
+// the same seed always produces the same history. Within a day the price moves from the previous close
+// towards the day's close, with a small wobble that changes every minute.
+type SimulatedMarketDataProvider struct {
+	seed   int64
+	mu     sync.Mutex
+	closes map[string][]float64
+}
+
+// NewSimulatedMarketDataProvider creates a random-walk provider; providers with the same seed agree on every price
+func NewSimulatedMarketDataProvider(seed int64) *SimulatedMarketDataProvider {
+	return &SimulatedMarketDataProvider{seed: seed, closes: map[string][]float64{}}
+}
+
+func (s *SimulatedMarketDataProvider) Name() string {
+	return "simulated"
+}
+
+// SplitAdjusted is true: simulated prices never split, so they already run on today's share count
+func (s *SimulatedMarketDataProvider) SplitAdjusted() bool {
+	return true
+}
+
+// uniform returns a number in (0, 1) determined by the seed and parts
+func (s *SimulatedMarketDataProvider) uniform(parts ...interface{}) float64 {
+	h := fnv.New64a()
+	fmt.Fprint(h, s.seed)
+	for _, part := range parts {
+		fmt.Fprint(h, "|", part)
+	}
+	return (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+}
+
+// normal returns a standard normal number determined by the seed and parts
+func (s *SimulatedMarketDataProvider) normal(parts ...interface{}) float64 {
+	u1 := s.uniform(append(parts, "u1")...)
+	u2 := s.uniform(append(parts, "u2")...)
+	return math.Sqrt(-2*math.Log(u1)) * math.Cos(2*math.Pi*u2)
+}
+
+// dailyVolatility returns a symbol's daily volatility, from 15% to 45% a year
+func (s *SimulatedMarketDataProvider) dailyVolatility(symbol string) float64 {
+	return (0.15 + 0.30*s.uniform(symbol, "volatility")) / math.Sqrt(365)
+}
+
+// closeOn returns a symbol's close on the given day after simulationStart; days before it close at the starting price
+func (s *SimulatedMarketDataProvider) closeOn(symbol string, day int) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	closes := s.closes[symbol]
+	if closes == nil {
+		closes = []float64{20 + 480*s.uniform(symbol, "start")}
+	}
+	if day < 0 {
+		return closes[0]
+	}
+
+	sigma := s.dailyVolatility(symbol)
+	drift := (0.08*s.uniform(symbol, "drift") - 0.01) / 365
+	for len(closes) <= day {
+		d := len(closes)
+		closes = append(closes, closes[d-1]*math.Exp(drift-sigma*sigma/2+sigma*s.normal(symbol, "day", d)))
+	}
+	s.closes[symbol] = closes
+	return closes[day]
+}
+
+// priceAt returns a symbol's simulated price at t
+func (s *SimulatedMarketDataProvider) priceAt(symbol string, t time.Time) float64 {
+	elapsed := t.Sub(simulationStart)
+	day := int(elapsed / (24 * time.Hour))
+	if elapsed < 0 {
+		return s.closeOn(symbol, -1)
+	}
+
+	previous, next := s.closeOn(symbol, day-1), s.closeOn(symbol, day)
+	fraction := float64(elapsed%(24*time.Hour)) / float64(24*time.Hour)
+	wobble := simulatedIntradayNoise * s.normal(symbol, "minute", t.Unix()/60) * math.Sqrt(fraction*(1-fraction)) * 2
+	return previous * math.Pow(next/previous, fraction) * math.Exp(wobble)
+}
+
+// dailyCandle returns a symbol's candle for a day after simulationStart
+func (s *SimulatedMarketDataProvider) dailyCandle(symbol string, day int) Candle {
+	openPrice, closePrice := s.closeOn(symbol, day-1), s.closeOn(symbol, day)
+	sigma := s.dailyVolatility(symbol)
+	return Candle{
+		Time:   simulationStart.AddDate(0, 0, day),
+		Open:   openPrice,
+		High:   math.Max(openPrice, closePrice) * (1 + sigma*s.uniform(symbol, "high", day)/2),
+		Low:    math.Min(openPrice, closePrice) * (1 - sigma*s.uniform(symbol, "low", day)/2),
+		Close:  closePrice,
+		Volume: math.Round(1e6 * (0.5 + s.uniform(symbol, "volume", day)) * (1 + math.Abs(closePrice-openPrice)/openPrice*20)),
+	}
+}
+
+// currentCandle returns the candle of the day in progress at now, closing at the price at now
+func (s *SimulatedMarketDataProvider) currentCandle(symbol string, now time.Time) Candle {
+	candle := s.dailyCandle(symbol, int(now.Sub(simulationStart)/(24*time.Hour)))
+	candle.Close = s.priceAt(symbol, now)
+	candle.High = math.Max(candle.Open, candle.Close)
+	candle.Low = math.Min(candle.Open, candle.Close)
+	return candle
+}
+
+func (s *SimulatedMarketDataProvider) GetQuote(symbol string) (*Quote, error) {
+	symbol = strings.ToUpper(symbol)
+	now := time.Now()
+
+	today := s.currentCandle(symbol, now)
+	return &Quote{
+		CurrentPrice:       today.Close,
+		Change:             today.Close - today.Open,
+		PercentChange:      (today.Close - today.Open) / today.Open * 100,
+		HighPriceOfDay:     today.High,
+		LowPriceOfDay:      today.Low,
+		OpenPriceOfDay:     today.Open,
+		PreviousClosePrice: today.Open,
+		Timestamp:          now.Unix(),
+	}, nil
+}
+
+func (s *SimulatedMarketDataProvider) GetCompanyProfile(symbol string) (*CompanyProfile, error) {
+	symbol = strings.ToUpper(symbol)
+	profile := &CompanyProfile{
+		Country:         "US",
+		Currency:        "USD",
+		Exchange:        "SIMULATED",
+		Name:            symbol,
+		Ticker:          symbol,
+		FinnhubIndustry: simulatedIndustries[int(s.uniform(symbol, "industry")*float64(len(simulatedIndustries)))],
+	}
+	for _, asset := range simulatedUniverse {
+		if asset.symbol == symbol {
+			profile.Name = asset.name
+			profile.FinnhubIndustry = asset.industry
+		}
+	}
+	return profile, nil
+}
+
+func (s *SimulatedMarketDataProvider) GetCandles(symbol, resolution string, from, to time.Time) ([]Candle, error) {
+	step, err := candleStep(resolution)
+	if err != nil {
+		return nil, err
+	}
+	symbol = strings.ToUpper(symbol)
+	if from.Before(simulationStart) {
+		from = simulationStart
+	}
+
+	// Nothing is simulated past the current moment
+	now := time.Now()
+	if to.After(now) {
+		to = now
+	}
+
+	candles := []Candle{}
+	if step > 0 {
+		if to.Sub(from)/step > maxSimulatedCandles {
+			return nil, fmt.Errorf("too many %s-minute candles requested", resolution)
+		}
+		for t := from.Truncate(step); !t.Add(step).After(to); t = t.Add(step) {
+			openPrice, closePrice := s.priceAt(symbol, t), s.priceAt(symbol, t.Add(step))
+			candles = append(candles, Candle{
+				Time:   t,
+				Open:   openPrice,
+				High:   math.Max(openPrice, closePrice),
+				Low:    math.Min(openPrice, closePrice),
+				Close:  closePrice,
+				Volume: math.Round(1e6 * s.uniform(symbol, "volume", t.Unix()) * step.Minutes() / 390),
+			})
+		}
+		return candles, nil
+	}
+
+	first := int(from.Sub(simulationStart) / (24 * time.Hour))
+	last := int(to.Sub(simulationStart) / (24 * time.Hour))
+	current := int(now.Sub(simulationStart) / (24 * time.Hour))
+	for day := first; day <= last; day++ {
+		if day == current {
+			candles = append(candles, s.currentCandle(symbol, now))
+			continue
+		}
+		candles = append(candles, s.dailyCandle(symbol, day))
+	}
+	return AggregateCandles(candles, resolution), nil
+}
+
+func (s *SimulatedMarketDataProvider) SearchSymbols(query string) ([]SymbolMatch, error) {
+	symbol := strings.ToUpper(strings.TrimSpace(query))
+	matches := []SymbolMatch{}
+	found := false
+	for _, asset := range simulatedUniverse {
+		if matchesSymbol(query, asset.symbol, asset.name) {
+			matches = append(matches, SymbolMatch{Symbol: asset.symbol, Description: asset.name, Type: "Common Stock"})
+			found = found || asset.symbol == symbol
+		}
+	}
+
+	// Every symbol has a simulated price, so the query itself is always a match
+	if symbol != "" && !found {
+		matches = append(matches, SymbolMatch{Symbol: symbol, Description: symbol, Type: "Common Stock"})
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Symbol < matches[j].Symbol })
+	return matches, nil
+}
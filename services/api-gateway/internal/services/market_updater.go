@@ -12,7 +12,7 @@ import (
 // MarketUpdater handles periodic market data updates and WebSocket broadcasting
 type MarketUpdater struct {
 	db        *sql.DB
-	finnhub   *FinnhubClient
+	market    MarketDataProvider
 	websocket *WebSocketHub
 	logger    *zap.Logger
 	ctx       context.Context
@@ -21,11 +21,11 @@ type MarketUpdater struct {
 }
 
 // NewMarketUpdater creates a new market updater service
-func NewMarketUpdater(db *sql.DB, finnhub *FinnhubClient, websocket *WebSocketHub, logger *zap.Logger) *MarketUpdater {
+func NewMarketUpdater(db *sql.DB, market MarketDataProvider, websocket *WebSocketHub, logger *zap.Logger) *MarketUpdater {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &MarketUpdater{
 		db:        db,
-		finnhub:   finnhub,
+		market:    market,
 		websocket: websocket,
 		logger:    logger,
 		ctx:       ctx,
@@ -35,8 +35,8 @@ func NewMarketUpdater(db *sql.DB, finnhub *FinnhubClient, websocket *WebSocketHu
 
 // Start begins the periodic market data updates
 func (m *MarketUpdater) Start() {
-	if m.finnhub == nil {
-		m.logger.Warn("Finnhub client not available, market updater will not start")
+	if m.market == nil {
+		m.logger.Warn("Market data provider not available, market updater will not start")
 		return
 	}
 
@@ -118,11 +118,9 @@ func (m *MarketUpdater) updatePortfolioPrices() {
 		symbols = append(symbols, symbol)
 	}
 
-	// Update prices for each symbol
+	// Update prices for each symbol; the provider paces its own requests
 	for _, symbol := range symbols {
 		m.updateAndBroadcastPrice(symbol)
-		// Small delay to avoid hitting API rate limits
-		time.Sleep(100 * time.Millisecond)
 	}
 
 	m.logger.Info("Updated prices for portfolio holdings", zap.Int("symbols_count", len(symbols)))
@@ -130,13 +128,19 @@ func (m *MarketUpdater) updatePortfolioPrices() {
 
 // updateAndBroadcastPrice fetches and broadcasts price update for a specific symbol
 func (m *MarketUpdater) updateAndBroadcastPrice(symbol string) {
-	quote, err := m.finnhub.GetQuote(symbol)
+	quote, err := m.market.GetQuote(symbol)
 	if err != nil {
 		m.logger.Error("Failed to get quote for symbol",
 			zap.String("symbol", symbol), zap.Error(err))
 		return
 	}
 
+	// A stale quote is already stored; it's only broadcast, flagged
+	if quote.Stale {
+		m.broadcastPrice(symbol, quote)
+		return
+	}
+
 	// Store price in database (optional - for historical tracking)
 	_, err = m.db.Exec(`
 		INSERT INTO market_data (asset_id, price, change_24h, timestamp)
@@ -154,28 +158,34 @@ func (m *MarketUpdater) updateAndBroadcastPrice(symbol string) {
 		// Continue with broadcast even if storage fails
 	}
 
-	// Broadcast price update via WebSocket
-	if m.websocket != nil {
-		update := PriceUpdate{
-			Symbol:        symbol,
-			CurrentPrice:  quote.CurrentPrice,
-			Change:        quote.Change,
-			ChangePercent: quote.PercentChange,
-			High:          quote.HighPriceOfDay,
-			Low:           quote.LowPriceOfDay,
-		}
+	m.broadcastPrice(symbol, quote)
+}
 
-		m.websocket.BroadcastPriceUpdate(update)
+// broadcastPrice sends a price update via WebSocket
+func (m *MarketUpdater) broadcastPrice(symbol string, quote *Quote) {
+	if m.websocket == nil {
+		return
+	}
+
+	update := PriceUpdate{
+		Symbol:        symbol,
+		CurrentPrice:  quote.CurrentPrice,
+		Change:        quote.Change,
+		ChangePercent: quote.PercentChange,
+		High:          quote.HighPriceOfDay,
+		Low:           quote.LowPriceOfDay,
+		Stale:         quote.Stale,
 	}
+
+	m.websocket.BroadcastPriceUpdate(update)
 }
 
-// broadcastPortfolioUpdates calculates and broadcasts portfolio summaries for all users
+// broadcastPortfolioUpdates calculates and broadcasts portfolio summaries for all portfolios
 func (m *MarketUpdater) broadcastPortfolioUpdates() {
-	// Get all users with portfolio holdings
+	// Get all portfolios with holdings
 	query := `
-		SELECT DISTINCT u.username, u.id
-		FROM users u
-		JOIN portfolio_holdings ph ON u.id = ph.user_id
+		SELECT DISTINCT ph.user_id, ph.portfolio_id
+		FROM portfolio_holdings ph
 		WHERE ph.quantity > 0
 	`
 
@@ -186,25 +196,25 @@ func (m *MarketUpdater) broadcastPortfolioUpdates() {
 	}
 	defer rows.Close()
 
-	userCount := 0
+	portfolioCount := 0
 	for rows.Next() {
-		var username, userID string
-		if err := rows.Scan(&username, &userID); err != nil {
-			m.logger.Error("Failed to scan user", zap.Error(err))
+		var userID, portfolioID string
+		if err := rows.Scan(&userID, &portfolioID); err != nil {
+			m.logger.Error("Failed to scan portfolio", zap.Error(err))
 			continue
 		}
 
-		m.calculateAndBroadcastPortfolioUpdate(userID)
-		userCount++
+		m.calculateAndBroadcastPortfolioUpdate(userID, portfolioID)
+		portfolioCount++
 	}
 
-	if userCount > 0 {
-		m.logger.Info("Broadcasted portfolio updates", zap.Int("users_count", userCount))
+	if portfolioCount > 0 {
+		m.logger.Info("Broadcasted portfolio updates", zap.Int("portfolios_count", portfolioCount))
 	}
 }
 
-// calculateAndBroadcastPortfolioUpdate calculates and broadcasts portfolio update for a specific user
-func (m *MarketUpdater) calculateAndBroadcastPortfolioUpdate(userID string) {
+// calculateAndBroadcastPortfolioUpdate calculates and broadcasts the update for one of a user's portfolios
+func (m *MarketUpdater) calculateAndBroadcastPortfolioUpdate(userID, portfolioID string) {
 	query := `
 		SELECT
 			a.symbol,
@@ -212,13 +222,13 @@ func (m *MarketUpdater) calculateAndBroadcastPortfolioUpdate(userID string) {
 			ph.average_cost
 		FROM portfolio_holdings ph
 		JOIN assets a ON ph.asset_id = a.id
-		WHERE ph.user_id = $1 AND ph.quantity > 0
+		WHERE ph.portfolio_id = $1 AND ph.quantity > 0
 	`
 
-	rows, err := m.db.Query(query, userID)
+	rows, err := m.db.Query(query, portfolioID)
 	if err != nil {
 		m.logger.Error("Failed to query user portfolio",
-			zap.String("user_id", userID), zap.Error(err))
+			zap.String("portfolio_id", portfolioID), zap.Error(err))
 		return
 	}
 	defer rows.Close()
@@ -241,7 +251,7 @@ func (m *MarketUpdater) calculateAndBroadcastPortfolioUpdate(userID string) {
 
 		// Get current price
 		currentPrice := averageCost // fallback
-		if quote, priceErr := m.finnhub.GetQuote(symbol); priceErr == nil {
+		if quote, priceErr := m.market.GetQuote(symbol); priceErr == nil {
 			currentPrice = quote.CurrentPrice
 		}
 
@@ -270,6 +280,7 @@ func (m *MarketUpdater) calculateAndBroadcastPortfolioUpdate(userID string) {
 	// Broadcast portfolio update
 	if m.websocket != nil {
 		update := PortfolioUpdate{
+			PortfolioID:               portfolioID,
 			TotalValue:                totalValue,
 			DailyChange:               dailyChange,
 			DailyChangePercent:        dailyChangePercent,
@@ -277,6 +288,6 @@ func (m *MarketUpdater) calculateAndBroadcastPortfolioUpdate(userID string) {
 			UnrealizedGainLossPercent: unrealizedGainLossPercent,
 		}
 
-		m.websocket.BroadcastPortfolioUpdate(update)
+		m.websocket.BroadcastPortfolioUpdate(userID, update)
 	}
 }
@@ -0,0 +1,207 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+const (
+	// quoteStoreTimeout bounds each cache read and write, so an unreachable cache only delays a quote briefly
+	quoteStoreTimeout = 250 * time.Millisecond
+	// lastKnownQuoteRetention is how long a quote is kept to fall back on while the provider is failing
+	lastKnownQuoteRetention = 24 * time.Hour
+)
+
+// ErrCacheMiss is returned by a QuoteStore that holds nothing under a key
+var ErrCacheMiss = errors.New("cache miss")
+
+// QuoteStore holds the serialized quotes of a QuoteCache
+type QuoteStore interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, expiration time.Duration) error
+}
+
+// RedisQuoteStore keeps cached quotes in Redis, so every handler and the market updater share them
+type RedisQuoteStore struct {
+	client *redis.Client
+}
+
+// NewRedisQuoteStore creates a quote store on a Redis client
+func NewRedisQuoteStore(client *redis.Client) *RedisQuoteStore {
+	return &RedisQuoteStore{client: client}
+}
+
+func (s *RedisQuoteStore) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrCacheMiss
+	}
+	return value, err
+}
+
+func (s *RedisQuoteStore) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	return s.client.Set(ctx, key, value, expiration).Err()
+}
+
+// cachedQuote is a quote with the time it was fetched upstream
+type cachedQuote struct {
+	Quote     Quote     `json:"quote"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// quoteFetch is an upstream quote request that concurrent callers wait on together
+type quoteFetch struct {
+	done  chan struct{}
+	quote *Quote
+	err   error
+}
+
+// QuoteCache is a read-through quote cache in front of a market data provider. Quotes younger than
+// ttl are served from the cache. Older ones are served for up to staleTTL more while a single
+// background request refreshes them. Concurrent misses for a symbol share one upstream request.
+// When the provider fails, the last known quote is served marked Stale.
+// Profiles, candles and search go straight to the provider.
+type QuoteCache struct {
+	MarketDataProvider
+	store    QuoteStore
+	ttl      time.Duration
+	staleTTL time.Duration
+	logger   *zap.Logger
+	mu       sync.Mutex
+	inflight map[string]*quoteFetch
+}
+
+// NewQuoteCache wraps a provider with a quote cache kept in store
+func NewQuoteCache(provider MarketDataProvider, store QuoteStore, ttl, staleTTL time.Duration, logger *zap.Logger) *QuoteCache {
+	return &QuoteCache{
+		MarketDataProvider: provider,
+		store:              store,
+		ttl:                ttl,
+		staleTTL:           staleTTL,
+		logger:             logger,
+		inflight:           map[string]*quoteFetch{},
+	}
+}
+
+// QuoteCacheKey returns the cache key of a provider's quote for symbol
+func QuoteCacheKey(provider, symbol string) string {
+	return "quote:" + provider + ":" + strings.ToUpper(symbol)
+}
+
+func (c *QuoteCache) GetQuote(symbol string) (*Quote, error) {
+	key := QuoteCacheKey(c.Name(), symbol)
+
+	cached, err := c.load(key)
+	if err == nil {
+		age := time.Since(cached.FetchedAt)
+		if age < c.ttl {
+			return &cached.Quote, nil
+		}
+		if age < c.ttl+c.staleTTL {
+			c.refreshInBackground(symbol, key)
+			return &cached.Quote, nil
+		}
+	} else if err != ErrCacheMiss {
+		c.logger.Warn("Failed to read cached quote", zap.String("symbol", symbol), zap.Error(err))
+	}
+
+	quote, err := c.fetch(symbol, key)
+	if err != nil && cached != nil {
+		c.logger.Warn("Serving last known quote", zap.String("symbol", symbol),
+			zap.Time("fetched_at", cached.FetchedAt), zap.Error(err))
+		stale := cached.Quote
+		stale.Stale = true
+		return &stale, nil
+	}
+	return quote, err
+}
+
+// Degraded reports whether the wrapped provider is failing fast
+func (c *QuoteCache) Degraded() bool {
+	return MarketDataDegraded(c.MarketDataProvider)
+}
+
+func (c *QuoteCache) load(key string) (*cachedQuote, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), quoteStoreTimeout)
+	defer cancel()
+
+	data, err := c.store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var cached cachedQuote
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, err
+	}
+	return &cached, nil
+}
+
+func (c *QuoteCache) save(key string, quote *Quote) {
+	data, err := json.Marshal(cachedQuote{Quote: *quote, FetchedAt: time.Now()})
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), quoteStoreTimeout)
+	defer cancel()
+	expiration := c.ttl + c.staleTTL
+	if expiration < lastKnownQuoteRetention {
+		expiration = lastKnownQuoteRetention
+	}
+	if err := c.store.Set(ctx, key, data, expiration); err != nil {
+		c.logger.Warn("Failed to cache quote", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// fetch requests a quote upstream and caches it, joining a request already in flight for the same key
+func (c *QuoteCache) fetch(symbol, key string) (*Quote, error) {
+	c.mu.Lock()
+	call, ok := c.inflight[key]
+	if !ok {
+		call = &quoteFetch{done: make(chan struct{})}
+		c.inflight[key] = call
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		call.quote, call.err = c.MarketDataProvider.GetQuote(symbol)
+		if call.err == nil {
+			c.save(key, call.quote)
+		}
+
+		c.mu.Lock()
+		delete(c.inflight, key)
+		c.mu.Unlock()
+		close(call.done)
+	}
+
+	<-call.done
+	if call.err != nil {
+		return nil, call.err
+	}
+	quote := *call.quote
+	return &quote, nil
+}
+
+// refreshInBackground refetches a stale quote unless a request for it is already in flight
+func (c *QuoteCache) refreshInBackground(symbol, key string) {
+	c.mu.Lock()
+	_, busy := c.inflight[key]
+	c.mu.Unlock()
+	if busy {
+		return
+	}
+
+	go func() {
+		if _, err := c.fetch(symbol, key); err != nil {
+			c.logger.Warn("Failed to refresh stale quote", zap.String("symbol", symbol), zap.Error(err))
+		}
+	}()
+}
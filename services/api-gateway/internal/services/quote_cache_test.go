@@ -0,0 +1,199 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// memoryQuoteStore is an in-process QuoteStore; when failing is set every call errors like an unreachable Redis
+type memoryQuoteStore struct {
+	mu      sync.Mutex
+	values  map[string][]byte
+	failing bool
+}
+
+func newMemoryQuoteStore() *memoryQuoteStore {
+	return &memoryQuoteStore{values: map[string][]byte{}}
+}
+
+func (s *memoryQuoteStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return nil, fmt.Errorf("connection refused")
+	}
+	value, ok := s.values[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	return value, nil
+}
+
+func (s *memoryQuoteStore) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return fmt.Errorf("connection refused")
+	}
+	s.values[key] = value
+	return nil
+}
+
+// storeQuote caches a quote as fetched age ago
+func (s *memoryQuoteStore) storeQuote(symbol string, price float64, age time.Duration) {
+	data, _ := json.Marshal(cachedQuote{Quote: Quote{CurrentPrice: price}, FetchedAt: time.Now().Add(-age)})
+	s.values[QuoteCacheKey("counting", symbol)] = data
+}
+
+// countingProvider counts upstream quote requests; when release is set each request waits for it, and
+// when failing is set each one fails
+type countingProvider struct {
+	calls   int32
+	price   float64
+	release chan struct{}
+	failing bool
+}
+
+func (p *countingProvider) Name() string {
+	return "counting"
+}
+
+func (p *countingProvider) SplitAdjusted() bool {
+	return false
+}
+
+func (p *countingProvider) GetQuote(symbol string) (*Quote, error) {
+	atomic.AddInt32(&p.calls, 1)
+	if p.release != nil {
+		<-p.release
+	}
+	if p.failing {
+		return nil, ErrProviderDegraded
+	}
+	return &Quote{CurrentPrice: p.price}, nil
+}
+
+func (p *countingProvider) GetCompanyProfile(symbol string) (*CompanyProfile, error) {
+	return nil, errors.New("no profiles")
+}
+
+func (p *countingProvider) GetCandles(symbol, resolution string, from, to time.Time) ([]Candle, error) {
+	return nil, errors.New("no candles")
+}
+
+func (p *countingProvider) SearchSymbols(query string) ([]SymbolMatch, error) {
+	return nil, nil
+}
+
+// TestQuoteCache tests that quotes are served from the cache, refreshed when stale and fetched once per symbol
+func TestQuoteCache(t *testing.T) {
+	newCache := func(provider MarketDataProvider, store QuoteStore) *QuoteCache {
+		return NewQuoteCache(provider, store, time.Minute, time.Minute, zap.NewNop())
+	}
+
+	t.Run("fresh quotes come from the cache", func(t *testing.T) {
+		provider := &countingProvider{price: 190.5}
+		cache := newCache(provider, newMemoryQuoteStore())
+
+		for i := 0; i < 3; i++ {
+			quote, err := cache.GetQuote("AAPL")
+			assert.NoError(t, err)
+			assert.Equal(t, 190.5, quote.CurrentPrice)
+			assert.False(t, quote.Stale)
+		}
+		_, err := cache.GetQuote("MSFT")
+		assert.NoError(t, err)
+
+		assert.Equal(t, int32(2), atomic.LoadInt32(&provider.calls))
+	})
+
+	t.Run("concurrent misses share one upstream request", func(t *testing.T) {
+		provider := &countingProvider{price: 50, release: make(chan struct{})}
+		cache := newCache(provider, newMemoryQuoteStore())
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				quote, err := cache.GetQuote("AAPL")
+				if assert.NoError(t, err) {
+					assert.Equal(t, 50.0, quote.CurrentPrice)
+				}
+			}()
+		}
+		assert.Eventually(t, func() bool { return atomic.LoadInt32(&provider.calls) == 1 }, time.Second, time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+		close(provider.release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), atomic.LoadInt32(&provider.calls))
+	})
+
+	t.Run("stale quotes are served while they refresh", func(t *testing.T) {
+		provider := &countingProvider{price: 110}
+		store := newMemoryQuoteStore()
+		store.storeQuote("AAPL", 100, 90*time.Second)
+		cache := newCache(provider, store)
+
+		quote, err := cache.GetQuote("AAPL")
+		assert.NoError(t, err)
+		assert.Equal(t, 100.0, quote.CurrentPrice)
+
+		assert.Eventually(t, func() bool {
+			quote, err := cache.GetQuote("AAPL")
+			return err == nil && quote.CurrentPrice == 110
+		}, time.Second, 5*time.Millisecond)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&provider.calls))
+	})
+
+	t.Run("expired quotes are fetched before responding", func(t *testing.T) {
+		provider := &countingProvider{price: 120}
+		store := newMemoryQuoteStore()
+		store.storeQuote("AAPL", 100, 3*time.Minute)
+		cache := newCache(provider, store)
+
+		quote, err := cache.GetQuote("AAPL")
+		assert.NoError(t, err)
+		assert.Equal(t, 120.0, quote.CurrentPrice)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&provider.calls))
+	})
+
+	t.Run("last known quote is served stale while the provider fails", func(t *testing.T) {
+		provider := &countingProvider{failing: true}
+		store := newMemoryQuoteStore()
+		store.storeQuote("AAPL", 100, time.Hour)
+		cache := newCache(provider, store)
+
+		quote, err := cache.GetQuote("AAPL")
+		assert.NoError(t, err)
+		assert.Equal(t, 100.0, quote.CurrentPrice)
+		assert.True(t, quote.Stale)
+
+		_, err = cache.GetQuote("MSFT")
+		assert.ErrorIs(t, err, ErrProviderDegraded)
+	})
+
+	t.Run("unreachable cache falls through to the provider", func(t *testing.T) {
+		provider := &countingProvider{price: 75}
+		store := newMemoryQuoteStore()
+		store.failing = true
+		cache := newCache(provider, store)
+
+		for i := 0; i < 2; i++ {
+			quote, err := cache.GetQuote("AAPL")
+			assert.NoError(t, err)
+			assert.Equal(t, 75.0, quote.CurrentPrice)
+		}
+		assert.Equal(t, int32(2), atomic.LoadInt32(&provider.calls))
+	})
+}
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrProviderDegraded is returned without calling upstream while a provider's circuit breaker is open
+var ErrProviderDegraded = errors.New("market data provider is degraded")
+
+// TokenBucket is a rate limiter shared by every goroutine using a client. It is sized so that no
+// 60-second window can exceed the per-minute quota, including the initial burst.
+type TokenBucket struct {
+	mu       sync.Mutex
+	capacity float64
+	tokens   float64
+	rate     float64 // tokens per second
+	last     time.Time
+}
+
+// NewTokenBucket creates a limiter for perMinute requests a minute, allowing a burst of a tenth of them
+func NewTokenBucket(perMinute int) *TokenBucket {
+	if perMinute < 1 {
+		perMinute = 1
+	}
+	burst := float64(perMinute / 10)
+	if burst < 1 {
+		burst = 1
+	}
+	rate := (float64(perMinute) - burst) / 60
+	if rate <= 0 {
+		rate = 1.0 / 60
+	}
+	return &TokenBucket{capacity: burst, tokens: burst, rate: rate, last: time.Now()}
+}
+
+// Wait blocks until a request may be made
+func (b *TokenBucket) Wait() {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+		b.last = now
+
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return
+		}
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// CircuitBreaker stops calls to a failing upstream. After threshold consecutive failures it opens and
+// rejects calls for cooldown; then a single trial call decides whether it closes or opens again.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	trial     bool
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown, state: breakerClosed}
+}
+
+// Allow reports whether a call may go upstream; every allowed call must be followed by Record
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.trial = true
+		return true
+	case breakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+// Record reports the outcome of an allowed call
+func (b *CircuitBreaker) Record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		b.state = breakerClosed
+		b.failures = 0
+		b.trial = false
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.trial = false
+	}
+}
+
+// State returns "closed", "open" or "half_open"
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// backoffDelay returns a jittered exponential delay before retry attempt (0 for the first retry):
+// a random duration up to base * 2^attempt, capped at max
+func backoffDelay(attempt int, base, max time.Duration) time.Duration {
+	ceiling := base << uint(attempt)
+	if ceiling <= 0 || ceiling > max {
+		ceiling = max
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
@@ -3,6 +3,7 @@ package services
 import (
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	_ "github.com/lib/pq"
@@ -16,10 +17,17 @@ type Services struct {
 	DB            *sql.DB
 	Redis         *redis.Client
 	NATS          *nats.Conn
-	Finnhub       *FinnhubClient
+	MarketData    MarketDataProvider
+	Tokens        *TokenManager
 	WebSocket     *WebSocketHub
 	MarketUpdater *MarketUpdater
+	Candles       *CandleIngester
+	Snapshots     *SnapshotScheduler
+	FX            *FXUpdater
+	Analytics     AnalyticsSettings
 	Logger        *zap.Logger
+
+	snapshotAt time.Duration
 }
 
 func NewServices(cfg *config.Config, logger *zap.Logger) (*Services, error) {
@@ -52,12 +60,25 @@ func NewServices(cfg *config.Config, logger *zap.Logger) (*Services, error) {
 	}
 	services.NATS = nc
 
-	// Initialize Finnhub client
-	if cfg.FinnhubAPIKey != "" {
-		services.Finnhub = NewFinnhubClient(cfg.FinnhubAPIKey)
-		logger.Info("Finnhub client initialized")
+	// Initialize JWT token manager
+	services.Tokens = NewTokenManager(cfg.JWTSecret, cfg.JWTAccessTTL, cfg.JWTRefreshTTL)
+
+	// Initialize the market data provider
+	marketData, err := NewMarketDataProvider(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure market data: %w", err)
+	}
+	if marketData != nil {
+		services.MarketData = marketData
+		logger.Info("Market data provider initialized", zap.String("provider", marketData.Name()))
+
+		// Quotes are shared through Redis by every handler and the market updater
+		if cfg.QuoteCacheTTL > 0 {
+			services.MarketData = NewQuoteCache(marketData, NewRedisQuoteStore(rdb), cfg.QuoteCacheTTL, cfg.QuoteCacheStaleTTL, logger)
+			logger.Info("Quote cache enabled", zap.Duration("ttl", cfg.QuoteCacheTTL), zap.Duration("stale_ttl", cfg.QuoteCacheStaleTTL))
+		}
 	} else {
-		logger.Warn("Finnhub API key not provided, market data features will be limited")
+		logger.Warn("Market data provider disabled, prices will fall back to average cost")
 	}
 
 	// Initialize WebSocket hub
@@ -66,14 +87,50 @@ func NewServices(cfg *config.Config, logger *zap.Logger) (*Services, error) {
 	logger.Info("WebSocket hub initialized and started")
 
 	// Initialize and start MarketUpdater
-	services.MarketUpdater = NewMarketUpdater(services.DB, services.Finnhub, services.WebSocket, logger)
+	services.MarketUpdater = NewMarketUpdater(services.DB, services.MarketData, services.WebSocket, logger)
 	go services.MarketUpdater.Start() // Start the market updater in a goroutine
 	logger.Info("Market updater initialized and started")
 
+	// Initialize and start the daily candle ingester
+	ingestAt, err := ParseTimeOfDay(cfg.CandleIngestTime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure candle ingestion: %w", err)
+	}
+	services.Candles = NewCandleIngester(services.DB, services.MarketData, cfg.CandleBackfillYears, ingestAt, logger)
+	services.Candles.Start()
+
+	// The snapshot scheduler is started by StartSnapshots once the handlers that value portfolios exist
+	services.snapshotAt, err = ParseTimeOfDay(cfg.SnapshotTime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure portfolio snapshots: %w", err)
+	}
+
+	// Analytics defaults are checked up front so a bad setting fails at startup, not on each request
+	if _, err := ParseBenchmark(cfg.Benchmark); err != nil {
+		return nil, fmt.Errorf("failed to configure analytics: %w", err)
+	}
+	services.Analytics = AnalyticsSettings{Benchmark: cfg.Benchmark, RiskFreeRate: cfg.RiskFreeRate}
+
+	// Initialize and start the FX rate updater
+	fxSource, err := NewFXRateSource(cfg.FXSource, cfg.FXRatesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure FX rates: %w", err)
+	}
+	services.FX = NewFXUpdater(services.DB, fxSource, cfg.FXRefreshInterval, logger)
+	services.FX.Start()
+	logger.Info("FX rate updater initialized and started", zap.String("source", fxSource.Name()))
+
 	logger.Info("All services initialized successfully")
 	return services, nil
 }
 
+// StartSnapshots starts the daily portfolio snapshot scheduler, valuing portfolios with valuer
+func (s *Services) StartSnapshots(valuer PortfolioValuer) {
+	s.Snapshots = NewSnapshotScheduler(s.DB, valuer, s.snapshotAt, s.Logger)
+	s.Snapshots.Start()
+	s.Logger.Info("Portfolio snapshot scheduler initialized and started")
+}
+
 func (s *Services) Close() error {
 	var errs []error
 
@@ -97,6 +154,18 @@ func (s *Services) Close() error {
 		s.MarketUpdater.Stop()
 	}
 
+	if s.Candles != nil {
+		s.Candles.Stop()
+	}
+
+	if s.Snapshots != nil {
+		s.Snapshots.Stop()
+	}
+
+	if s.FX != nil {
+		s.FX.Stop()
+	}
+
 	if len(errs) > 0 {
 		return fmt.Errorf("errors closing services: %v", errs)
 	}
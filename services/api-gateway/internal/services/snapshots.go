@@ -0,0 +1,276 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// PortfolioValuation is a portfolio's end-of-day value in its base currency
+type PortfolioValuation struct {
+	Date          time.Time
+	TotalValue    float64 // market value plus cash
+	MarketValue   float64
+	CashValue     float64
+	TotalCost     float64
+	UnrealizedPnL float64
+	RealizedPnL   float64  // realized to date
+	NetFlow       float64  // deposits less withdrawals during the day
+	MissingPrices []string // symbols without a close on or before the day, valued at cost
+}
+
+// PortfolioValuer values a portfolio at the close of each weekday from from to to, from its ledger
+// and price_history
+type PortfolioValuer interface {
+	ValuePortfolio(ctx context.Context, portfolioID string, from, to time.Time) ([]PortfolioValuation, error)
+}
+
+// SnapshotResult summarizes one run of the snapshot scheduler
+type SnapshotResult struct {
+	Portfolios int
+	Snapshots  int
+	Failed     []string
+}
+
+// SnapshotScheduler writes one end-of-day row per portfolio and weekday into portfolio_snapshots. Each
+// run fills every day since a portfolio's latest snapshot, or since its first transaction. Ledger changes
+// delete the snapshots from the day they take effect, so those days are filled again.
+type SnapshotScheduler struct {
+	db     *sql.DB
+	valuer PortfolioValuer
+	runAt  time.Duration // time of day in UTC
+	logger *zap.Logger
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewSnapshotScheduler creates a snapshot scheduler that values portfolios with valuer daily at runAt
+// past midnight UTC
+func NewSnapshotScheduler(db *sql.DB, valuer PortfolioValuer, runAt time.Duration, logger *zap.Logger) *SnapshotScheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &SnapshotScheduler{
+		db:     db,
+		valuer: valuer,
+		runAt:  runAt,
+		logger: logger,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Start backfills missing snapshots, then snapshots every day at the configured time
+func (s *SnapshotScheduler) Start() {
+	s.logger.Info("Starting portfolio snapshot scheduler", zap.Duration("run_at", s.runAt))
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.snapshotAndLog()
+
+		for {
+			timer := time.NewTimer(time.Until(nextRunAt(time.Now(), s.runAt)))
+			select {
+			case <-s.ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+				s.snapshotAndLog()
+			}
+		}
+	}()
+}
+
+// Stop gracefully shuts down the snapshot scheduler
+func (s *SnapshotScheduler) Stop() {
+	s.cancel()
+	s.wg.Wait()
+	s.logger.Info("Portfolio snapshot scheduler stopped")
+}
+
+// LastClosedDay returns the latest day whose snapshot is due: today once the run time has passed,
+// yesterday before
+func (s *SnapshotScheduler) LastClosedDay(now time.Time) time.Time {
+	today := now.UTC().Truncate(24 * time.Hour)
+	if now.UTC().Before(today.Add(s.runAt)) {
+		return today.AddDate(0, 0, -1)
+	}
+	return today
+}
+
+func (s *SnapshotScheduler) snapshotAndLog() {
+	result, err := s.SnapshotAll(s.ctx)
+	if err != nil {
+		s.logger.Error("Failed to snapshot portfolios", zap.Error(err))
+		return
+	}
+	s.logger.Info("Snapshotted portfolios",
+		zap.Int("portfolios_count", result.Portfolios),
+		zap.Int("snapshots_count", result.Snapshots),
+		zap.Strings("failed", result.Failed))
+}
+
+// SnapshotAll brings every portfolio's snapshots up to the last closed day. A portfolio that can't be
+// valued is reported in Failed and doesn't stop the others.
+func (s *SnapshotScheduler) SnapshotAll(ctx context.Context) (SnapshotResult, error) {
+	var result SnapshotResult
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT p.id, p.user_id,
+			(SELECT MAX(snapshot_date) FROM portfolio_snapshots WHERE portfolio_id = p.id),
+			(SELECT MIN(transaction_date) FROM transactions WHERE portfolio_id = p.id)
+		FROM portfolios p
+		ORDER BY p.created_at, p.id
+	`)
+	if err != nil {
+		return result, fmt.Errorf("failed to query portfolios: %w", err)
+	}
+
+	type pendingPortfolio struct {
+		id, userID                string
+		lastSnapshot, firstTraded sql.NullTime
+	}
+	var portfolios []pendingPortfolio
+	for rows.Next() {
+		var p pendingPortfolio
+		if err := rows.Scan(&p.id, &p.userID, &p.lastSnapshot, &p.firstTraded); err != nil {
+			rows.Close()
+			return result, fmt.Errorf("failed to scan portfolio: %w", err)
+		}
+		portfolios = append(portfolios, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	to := s.LastClosedDay(time.Now())
+	for _, p := range portfolios {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		// Portfolios without transactions have nothing to value yet
+		if !p.firstTraded.Valid {
+			continue
+		}
+
+		from := p.firstTraded.Time.UTC().Truncate(24 * time.Hour)
+		if p.lastSnapshot.Valid {
+			from = p.lastSnapshot.Time.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+		}
+		if from.After(to) {
+			result.Portfolios++
+			continue
+		}
+
+		stored, err := s.Snapshot(ctx, p.id, p.userID, from, to)
+		if err != nil {
+			s.logger.Warn("Failed to snapshot portfolio", zap.String("portfolio_id", p.id), zap.Error(err))
+			result.Failed = append(result.Failed, p.id)
+			continue
+		}
+		result.Portfolios++
+		result.Snapshots += stored
+	}
+	return result, nil
+}
+
+// Snapshot values a portfolio on each weekday from from to to and stores the snapshots, replacing any
+// already stored for the same days, and returns how many were written
+func (s *SnapshotScheduler) Snapshot(ctx context.Context, portfolioID, userID string, from, to time.Time) (int, error) {
+	valuations, err := s.valuer.ValuePortfolio(ctx, portfolioID, from, to)
+	if err != nil {
+		return 0, err
+	}
+	s.warnMissingPrices(portfolioID, valuations)
+	return s.store(ctx, portfolioID, userID, valuations, false)
+}
+
+// warnMissingPrices logs the holdings that were valued at cost for lack of a close
+func (s *SnapshotScheduler) warnMissingPrices(portfolioID string, valuations []PortfolioValuation) {
+	missing := map[string]bool{}
+	var symbols []string
+	for _, v := range valuations {
+		for _, symbol := range v.MissingPrices {
+			if !missing[symbol] {
+				missing[symbol] = true
+				symbols = append(symbols, symbol)
+			}
+		}
+	}
+	if len(symbols) > 0 {
+		s.logger.Warn("Valued holdings at cost without closing prices",
+			zap.String("portfolio_id", portfolioID), zap.Strings("symbols", symbols))
+	}
+}
+
+// store upserts a portfolio's snapshots, first deleting all of its existing ones if replace is set
+func (s *SnapshotScheduler) store(ctx context.Context, portfolioID, userID string, valuations []PortfolioValuation, replace bool) (int, error) {
+	if len(valuations) == 0 && !replace {
+		return 0, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin snapshot transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if replace {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM portfolio_snapshots WHERE portfolio_id = $1", portfolioID); err != nil {
+			return 0, fmt.Errorf("failed to delete snapshots: %w", err)
+		}
+	}
+
+	for _, v := range valuations {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO portfolio_snapshots (user_id, portfolio_id, snapshot_date, total_value, market_value, cash_value, total_cost, unrealized_pnl, realized_pnl, net_flow)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			ON CONFLICT (portfolio_id, snapshot_date) DO UPDATE SET
+				total_value = EXCLUDED.total_value,
+				market_value = EXCLUDED.market_value,
+				cash_value = EXCLUDED.cash_value,
+				total_cost = EXCLUDED.total_cost,
+				unrealized_pnl = EXCLUDED.unrealized_pnl,
+				realized_pnl = EXCLUDED.realized_pnl,
+				net_flow = EXCLUDED.net_flow
+		`, userID, portfolioID, v.Date.Format("2006-01-02"), v.TotalValue, v.MarketValue, v.CashValue,
+			v.TotalCost, v.UnrealizedPnL, v.RealizedPnL, v.NetFlow)
+		if err != nil {
+			return 0, fmt.Errorf("failed to store snapshot for %s: %w", v.Date.Format("2006-01-02"), err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit snapshots: %w", err)
+	}
+	return len(valuations), nil
+}
+
+// Rebuild replaces all of a portfolio's snapshots with ones valued from its current ledger and price
+// history, e.g. after closes are backfilled, and returns how many were written
+func (s *SnapshotScheduler) Rebuild(ctx context.Context, portfolioID string) (int, error) {
+	var userID string
+	var firstTraded sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		SELECT p.user_id, (SELECT MIN(transaction_date) FROM transactions WHERE portfolio_id = p.id)
+		FROM portfolios p WHERE p.id = $1
+	`, portfolioID).Scan(&userID, &firstTraded)
+	if err != nil {
+		return 0, err
+	}
+
+	var valuations []PortfolioValuation
+	if firstTraded.Valid {
+		valuations, err = s.valuer.ValuePortfolio(ctx, portfolioID, firstTraded.Time.UTC().Truncate(24*time.Hour), s.LastClosedDay(time.Now()))
+		if err != nil {
+			return 0, err
+		}
+		s.warnMissingPrices(portfolioID, valuations)
+	}
+	return s.store(ctx, portfolioID, userID, valuations, true)
+}
@@ -49,6 +49,7 @@ type WSMessage struct {
 
 // Portfolio update message
 type PortfolioUpdate struct {
+	PortfolioID               string  `json:"portfolio_id,omitempty"`
 	TotalValue                float64 `json:"total_value"`
 	DailyChange               float64 `json:"daily_change"`
 	DailyChangePercent        float64 `json:"daily_change_percent"`
@@ -65,6 +66,7 @@ type PriceUpdate struct {
 	High          float64 `json:"high"`
 	Low           float64 `json:"low"`
 	Volume        int64   `json:"volume,omitempty"`
+	Stale         bool    `json:"stale,omitempty"`
 }
 
 // NewWebSocketHub creates a new WebSocket hub
@@ -127,8 +129,8 @@ func (h *WebSocketHub) Run() {
 	}
 }
 
-// BroadcastPortfolioUpdate sends portfolio updates to all connected clients
-func (h *WebSocketHub) BroadcastPortfolioUpdate(update PortfolioUpdate) {
+// BroadcastPortfolioUpdate sends portfolio updates to the connected clients of the owning user
+func (h *WebSocketHub) BroadcastPortfolioUpdate(userID string, update PortfolioUpdate) {
 	message := WSMessage{
 		Type:      "portfolio_update",
 		Data:      update,
@@ -136,11 +138,19 @@ func (h *WebSocketHub) BroadcastPortfolioUpdate(update PortfolioUpdate) {
 	}
 
 	if data, err := json.Marshal(message); err == nil {
-		select {
-		case h.broadcast <- data:
-		default:
-			h.logger.Warn("Failed to broadcast portfolio update: channel full")
+		h.mutex.RLock()
+		for client := range h.clients {
+			if client.UserID != userID {
+				continue
+			}
+			select {
+			case client.Send <- data:
+			default:
+				h.logger.Warn("Failed to send portfolio update: client buffer full",
+					zap.String("client_id", client.ID))
+			}
 		}
+		h.mutex.RUnlock()
 	}
 }
 
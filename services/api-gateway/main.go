@@ -60,8 +60,11 @@ func main() {
 	// Initialize handlers
 	handler := handlers.NewHandler(svc, logger)
 
+	// Snapshot every portfolio at each day's close, valued from its ledger by the handlers
+	svc.StartSnapshots(handler)
+
 	// Setup router
-	router := setupRouter(handler, logger)
+	router := setupRouter(handler, svc.Tokens, logger)
 
 	// Setup server
 	srv := &http.Server{
@@ -95,7 +98,7 @@ func main() {
 	logger.Info("Server exited")
 }
 
-func setupRouter(handler *handlers.Handler, logger *zap.Logger) *gin.Engine {
+func setupRouter(handler *handlers.Handler, tokens *services.TokenManager, logger *zap.Logger) *gin.Engine {
 	if os.Getenv("GIN_MODE") == "release" {
 		gin.SetMode(gin.ReleaseMode)
 	}
@@ -118,9 +121,12 @@ func setupRouter(handler *handlers.Handler, logger *zap.Logger) *gin.Engine {
 	// Health check
 	router.GET("/health", handler.HealthCheck)
 
-	// Development endpoint to create sample data
-	router.POST("/dev/sample-data", func(c *gin.Context) {
-		if err := handler.CreateSampleData(); err != nil {
+	// Authentication middleware for user-scoped routes
+	requireAuth := middleware.Auth(tokens)
+
+	// Development endpoint to create sample data for the authenticated user
+	router.POST("/dev/sample-data", requireAuth, func(c *gin.Context) {
+		if err := handler.CreateSampleData(middleware.GetUserID(c)); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create sample data"})
 			return
 		}
@@ -130,6 +136,36 @@ func setupRouter(handler *handlers.Handler, logger *zap.Logger) *gin.Engine {
 	// API routes
 	v1 := router.Group("/api/v1")
 	{
+		// Auth routes (public)
+		auth := v1.Group("/auth")
+		{
+			auth.POST("/register", handler.Register)
+			auth.POST("/login", handler.Login)
+			auth.POST("/refresh", handler.RefreshToken)
+		}
+
+		// Market data routes (public)
+		market := v1.Group("/market")
+		{
+			market.GET("/assets", handler.GetAssets)
+			market.GET("/assets/:symbol", handler.GetAsset)
+			market.GET("/prices/:symbol", handler.GetCurrentPrice)
+			market.GET("/prices/:symbol/history", handler.GetPriceHistory)
+		}
+
+		// Everything below requires an authenticated user
+		v1.Use(requireAuth)
+
+		// Portfolio management routes
+		portfolios := v1.Group("/portfolios")
+		{
+			portfolios.GET("/", handler.GetPortfolios)
+			portfolios.POST("/", handler.CreatePortfolio)
+			portfolios.GET("/:id", handler.GetPortfolioByID)
+			portfolios.PUT("/:id", handler.UpdatePortfolio)
+			portfolios.DELETE("/:id", handler.DeletePortfolio)
+		}
+
 		// Portfolio routes
 		portfolio := v1.Group("/portfolio")
 		{
@@ -139,6 +175,12 @@ func setupRouter(handler *handlers.Handler, logger *zap.Logger) *gin.Engine {
 			portfolio.POST("/holdings", handler.AddHolding)
 			portfolio.PUT("/holdings/:id", handler.UpdateHolding)
 			portfolio.DELETE("/holdings/:id", handler.RemoveHolding)
+			portfolio.GET("/lots", handler.GetTaxLots)
+			portfolio.GET("/reconcile", handler.ReconcilePortfolio)
+			portfolio.POST("/reconcile", handler.ReconcilePortfolio)
+			portfolio.GET("/targets", handler.GetTargetAllocations)
+			portfolio.PUT("/targets", handler.SetTargetAllocations)
+			portfolio.GET("/rebalance", handler.GetRebalance)
 		}
 
 		// Transactions routes
@@ -151,22 +193,26 @@ func setupRouter(handler *handlers.Handler, logger *zap.Logger) *gin.Engine {
 			transactions.DELETE("/:id", handler.DeleteTransaction)
 		}
 
-		// Market data routes
-		market := v1.Group("/market")
-		{
-			market.GET("/assets", handler.GetAssets)
-			market.GET("/assets/:symbol", handler.GetAsset)
-			market.GET("/prices/:symbol", handler.GetCurrentPrice)
-			market.GET("/prices/:symbol/history", handler.GetPriceHistory)
-		}
-
 		// Analytics routes
 		analytics := v1.Group("/analytics")
 		{
 			analytics.GET("/performance", handler.GetPerformanceAnalytics)
 			analytics.GET("/risk", handler.GetRiskMetrics)
+			analytics.GET("/stress", handler.GetStressTest)
 			analytics.GET("/allocation", handler.GetAssetAllocation)
+			analytics.GET("/realized", handler.GetRealizedPnL)
+			analytics.GET("/income", handler.GetIncome)
+			analytics.GET("/benchmark", handler.GetBenchmarkComparison)
+			analytics.GET("/var", handler.GetValueAtRisk)
+			analytics.GET("/correlation", handler.GetCorrelation)
+			analytics.POST("/optimize", handler.OptimizePortfolio)
 			analytics.POST("/whatif", handler.WhatIfAnalysis)
+			analytics.GET("/scenarios", handler.GetScenarios)
+			analytics.POST("/scenarios", handler.SaveScenario)
+			analytics.POST("/scenarios/run", handler.RunScenario)
+			analytics.GET("/scenarios/compare", handler.CompareScenarios)
+			analytics.GET("/scenarios/:id", handler.GetScenario)
+			analytics.DELETE("/scenarios/:id", handler.DeleteScenario)
 		}
 
 		// Notifications routes
@@ -177,6 +223,18 @@ func setupRouter(handler *handlers.Handler, logger *zap.Logger) *gin.Engine {
 			notifications.POST("/settings", handler.UpdateNotificationSettings)
 		}
 
+		// Admin routes
+		admin := v1.Group("/admin", middleware.RequireAdmin())
+		{
+			admin.POST("/portfolios/:id/rebuild", handler.RebuildPortfolio)
+			admin.POST("/portfolios/:id/snapshots/rebuild", handler.RebuildSnapshots)
+			admin.GET("/corporate-actions", handler.GetCorporateActions)
+			admin.POST("/corporate-actions", handler.CreateCorporateAction)
+			admin.POST("/corporate-actions/:id/reverse", handler.ReverseCorporateAction)
+			admin.POST("/fx/refresh", handler.RefreshFXRates)
+			admin.POST("/price-history/:symbol/backfill", handler.BackfillPriceHistory)
+		}
+
 		// WebSocket for real-time updates
 		v1.GET("/ws", handler.WebSocketHandler)
 	}